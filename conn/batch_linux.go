@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr, which x/sys/unix does not export.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// SendBatch implements BatchBind with sendmmsg.
+func (bind *LinuxSocketBind) SendBatch(bufs [][]byte, end Endpoint) error {
+	nend, ok := end.(*LinuxSocketEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if len(bufs) == 0 {
+		return nil
+	}
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	sock := bind.sock4
+	if nend.isV6 {
+		sock = bind.sock6
+	}
+	if sock == -1 {
+		return net.ErrClosed
+	}
+
+	sent, err := sendmmsg(sock, nend, bufs)
+	if err == unix.EINVAL {
+		// As in send4 and send6, clear src and retry.
+		nend.ClearSrc()
+		var more int
+		more, err = sendmmsg(sock, nend, bufs[sent:])
+		sent += more
+	}
+	if err == unix.ENOSYS {
+		for _, buf := range bufs[sent:] {
+			if err = bind.sendLocked(sock, nend, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+func (bind *LinuxSocketBind) sendLocked(sock int, end *LinuxSocketEndpoint, buf []byte) error {
+	if end.isV6 {
+		return send6(sock, end, buf)
+	}
+	return send4(sock, end, buf)
+}
+
+// sendmmsg sends bufs to end from its cached source, and returns the number
+// of packets sent before an error.
+func sendmmsg(sock int, end *LinuxSocketEndpoint, bufs [][]byte) (int, error) {
+	var name []byte
+	var control []byte
+	end.mu.Lock()
+	if end.isV6 {
+		dst := end.dst6()
+		rsa := &unix.RawSockaddrInet6{
+			Family:   unix.AF_INET6,
+			Addr:     dst.Addr,
+			Scope_id: dst.ZoneId,
+		}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:], uint16(dst.Port))
+		name = (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(rsa))[:]
+		cmsg := &struct {
+			cmsghdr unix.Cmsghdr
+			pktinfo unix.Inet6Pktinfo
+		}{
+			unix.Cmsghdr{
+				Level: unix.IPPROTO_IPV6,
+				Type:  unix.IPV6_PKTINFO,
+				Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
+			},
+			unix.Inet6Pktinfo{
+				Addr:    end.src6().src,
+				Ifindex: dst.ZoneId,
+			},
+		}
+		if cmsg.pktinfo.Addr == [16]byte{} {
+			cmsg.pktinfo.Ifindex = 0
+		}
+		control = (*[unsafe.Sizeof(*cmsg)]byte)(unsafe.Pointer(cmsg))[:]
+	} else {
+		dst := end.dst4()
+		rsa := &unix.RawSockaddrInet4{
+			Family: unix.AF_INET,
+			Addr:   dst.Addr,
+		}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:], uint16(dst.Port))
+		name = (*[unix.SizeofSockaddrInet4]byte)(unsafe.Pointer(rsa))[:]
+		cmsg := &struct {
+			cmsghdr unix.Cmsghdr
+			pktinfo unix.Inet4Pktinfo
+		}{
+			unix.Cmsghdr{
+				Level: unix.IPPROTO_IP,
+				Type:  unix.IP_PKTINFO,
+				Len:   unix.SizeofInet4Pktinfo + unix.SizeofCmsghdr,
+			},
+			unix.Inet4Pktinfo{
+				Spec_dst: end.src4().Src,
+				Ifindex:  end.src4().Ifindex,
+			},
+		}
+		control = (*[unsafe.Sizeof(*cmsg)]byte)(unsafe.Pointer(cmsg))[:]
+	}
+	end.mu.Unlock()
+
+	iovs := make([]unix.Iovec, len(bufs))
+	msgs := make([]mmsghdr, len(bufs))
+	for i, buf := range bufs {
+		iovs[i].Base = unsafe.SliceData(buf)
+		iovs[i].SetLen(len(buf))
+		msgs[i].hdr.Name = unsafe.SliceData(name)
+		msgs[i].hdr.Namelen = uint32(len(name))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.SetIovlen(1)
+		msgs[i].hdr.Control = unsafe.SliceData(control)
+		msgs[i].hdr.SetControllen(len(control))
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(sock), uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+		if errno != 0 {
+			runtime.KeepAlive(bufs)
+			return sent, errno
+		}
+		sent += int(n)
+	}
+	runtime.KeepAlive(bufs)
+	runtime.KeepAlive(iovs)
+	return sent, nil
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestLinuxSocketBindSendBatch(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "[::1]"} {
+		t.Run(addr, func(t *testing.T) {
+			bind := conn.NewLinuxSocketBind()
+			fns, port, err := bind.Open(0)
+			if err != nil {
+				t.Skipf("cannot open bind: %v", err)
+			}
+			defer bind.Close()
+			ep, err := bind.ParseEndpoint(fmt.Sprintf("%s:%d", addr, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := make(chan []byte, 16)
+			for _, fn := range fns {
+				go func(fn conn.ReceiveFunc) {
+					for {
+						buf := make([]byte, 1500)
+						n, _, err := fn(buf)
+						if err != nil {
+							return
+						}
+						received <- buf[:n]
+					}
+				}(fn)
+			}
+
+			var bufs [][]byte
+			for i := 1; i <= 5; i++ {
+				bufs = append(bufs, bytes.Repeat([]byte{byte(i)}, 10*i))
+			}
+			if err := bind.(conn.BatchBind).SendBatch(bufs, ep); err != nil {
+				if addr == "[::1]" {
+					t.Skipf("cannot send over IPv6: %v", err)
+				}
+				t.Fatal(err)
+			}
+			for i, want := range bufs {
+				select {
+				case got := <-received:
+					if !bytes.Equal(got, want) {
+						t.Errorf("packet %d: got %x, want %x", i, got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("packet %d not received", i)
+				}
+			}
+		})
+	}
+}
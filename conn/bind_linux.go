@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -28,12 +29,22 @@ type ipv6Source struct {
 }
 
 type LinuxSocketEndpoint struct {
-	mu   sync.Mutex
-	dst  [unsafe.Sizeof(unix.SockaddrInet6{})]byte
-	src  [unsafe.Sizeof(ipv6Source{})]byte
-	isV6 bool
+	mu       sync.Mutex
+	dst      [unsafe.Sizeof(unix.SockaddrInet6{})]byte
+	src      [unsafe.Sizeof(ipv6Source{})]byte
+	isV6     bool
+	received int64 // kernel receive time in Unix nanoseconds, or 0
+
+	// TTL or hop limit, and traffic class, of the received packet
+	hopLimit, trafficClass       uint8
+	hasHopLimit, hasTrafficClass bool
 }
 
+var (
+	_ TimestampedEndpoint = (*LinuxSocketEndpoint)(nil)
+	_ IPHeaderEndpoint    = (*LinuxSocketEndpoint)(nil)
+)
+
 func (endpoint *LinuxSocketEndpoint) Src4() *ipv4Source         { return endpoint.src4() }
 func (endpoint *LinuxSocketEndpoint) Dst4() *unix.SockaddrInet4 { return endpoint.dst4() }
 func (endpoint *LinuxSocketEndpoint) IsV6() bool                { return endpoint.isV6 }
@@ -61,14 +72,18 @@ type LinuxSocketBind struct {
 	mu    sync.RWMutex
 	sock4 int
 	sock6 int
+
+	flowLabels flowLabelLeases
 }
 
 func NewLinuxSocketBind() Bind { return &LinuxSocketBind{sock4: -1, sock6: -1} }
 func NewDefaultBind() Bind     { return NewLinuxSocketBind() }
 
 var (
-	_ Endpoint = (*LinuxSocketEndpoint)(nil)
-	_ Bind     = (*LinuxSocketBind)(nil)
+	_ Endpoint       = (*LinuxSocketEndpoint)(nil)
+	_ Bind           = (*LinuxSocketBind)(nil)
+	_ FlowLabelBind  = (*LinuxSocketBind)(nil)
+	_ SourceAddrBind = (*LinuxSocketBind)(nil)
 )
 
 func (*LinuxSocketBind) ParseEndpoint(s string) (Endpoint, error) {
@@ -104,6 +119,25 @@ func (*LinuxSocketBind) ParseEndpoint(s string) (Endpoint, error) {
 	return nil, errors.New("invalid IP address")
 }
 
+// SetEndpointSource implements SourceAddrBind. The outgoing interface is left
+// to the routing table, which lets source-based policy routing pick the uplink.
+func (*LinuxSocketBind) SetEndpointSource(ep Endpoint, src netip.Addr) error {
+	end, ok := ep.(*LinuxSocketEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	src = src.Unmap()
+	switch {
+	case src.Is4() && !end.isV6:
+		*end.src4() = ipv4Source{Src: src.As4()}
+	case src.Is6() && end.isV6:
+		*end.src6() = ipv6Source{src: src.As16()}
+	default:
+		return errors.New("source address family does not match endpoint")
+	}
+	return nil
+}
+
 func (bind *LinuxSocketBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
@@ -265,6 +299,27 @@ func (bind *LinuxSocketBind) Send(buff []byte, end Endpoint) error {
 	}
 }
 
+// ReceiveTime returns when the kernel received the packet the endpoint was
+// returned with, if the socket delivered a timestamp for it.
+func (end *LinuxSocketEndpoint) ReceiveTime() (time.Time, bool) {
+	if end.received == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, end.received), true
+}
+
+// ReceiveHopLimit returns the TTL or hop limit of the packet the endpoint was
+// returned with, if the socket delivered it.
+func (end *LinuxSocketEndpoint) ReceiveHopLimit() (uint8, bool) {
+	return end.hopLimit, end.hasHopLimit
+}
+
+// ReceiveDSCP returns the DSCP of the packet the endpoint was returned with,
+// if the socket delivered its traffic class.
+func (end *LinuxSocketEndpoint) ReceiveDSCP() (uint8, bool) {
+	return end.trafficClass >> 2, end.hasTrafficClass
+}
+
 func (end *LinuxSocketEndpoint) SrcIP() netip.Addr {
 	if !end.isV6 {
 		return netip.AddrFrom4(end.src4().Src)
@@ -354,6 +409,12 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		// Receive timestamps and IP header fields are best effort:
+		// without them, endpoints simply report no value.
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+		unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+		unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -405,6 +466,12 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		// Receive timestamps and IP header fields are best effort:
+		// without them, endpoints simply report no value.
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+		unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+		unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -501,15 +568,59 @@ func send6(sock int, end *LinuxSocketEndpoint, buff []byte) error {
 	return err
 }
 
+// receiveOOB holds the control messages of a received packet: its packet
+// info and, if enabled, its kernel receive timestamp, TTL or hop limit, and
+// traffic class. It is made of uint64s to keep the control message headers
+// aligned.
+type receiveOOB [24]uint64
+
+// nextCmsg splits the first control message off oob. It reports false once
+// no complete control message is left.
+func nextCmsg(oob []byte) (hdr *unix.Cmsghdr, data []byte, rest []byte, ok bool) {
+	if len(oob) < unix.SizeofCmsghdr {
+		return nil, nil, nil, false
+	}
+	hdr = (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	if int(hdr.Len) < unix.CmsgLen(0) || int(hdr.Len) > len(oob) {
+		return nil, nil, nil, false
+	}
+	data = oob[unix.CmsgLen(0):hdr.Len]
+	if space := unix.CmsgSpace(len(data)); space < len(oob) {
+		rest = oob[space:]
+	}
+	return hdr, data, rest, true
+}
+
+// receiveTimestamp returns the kernel receive time carried by a control
+// message in Unix nanoseconds, or 0 if it carries none.
+func receiveTimestamp(hdr *unix.Cmsghdr, data []byte) int64 {
+	if hdr.Level != unix.SOL_SOCKET || hdr.Type != unix.SCM_TIMESTAMPNS || len(data) < int(unsafe.Sizeof(unix.Timespec{})) {
+		return 0
+	}
+	return (*unix.Timespec)(unsafe.Pointer(&data[0])).Nano()
+}
+
+// receiveIPHeader records the IP header field carried by a control message,
+// if any, in end.
+func receiveIPHeader(hdr *unix.Cmsghdr, data []byte, end *LinuxSocketEndpoint) {
+	switch {
+	case hdr.Level == unix.IPPROTO_IP && hdr.Type == unix.IP_TTL && len(data) >= 4:
+		end.hopLimit, end.hasHopLimit = uint8(*(*int32)(unsafe.Pointer(&data[0]))), true
+	case hdr.Level == unix.IPPROTO_IP && hdr.Type == unix.IP_TOS && len(data) >= 1:
+		end.trafficClass, end.hasTrafficClass = data[0], true
+	case hdr.Level == unix.IPPROTO_IPV6 && hdr.Type == unix.IPV6_HOPLIMIT && len(data) >= 4:
+		end.hopLimit, end.hasHopLimit = uint8(*(*int32)(unsafe.Pointer(&data[0]))), true
+	case hdr.Level == unix.IPPROTO_IPV6 && hdr.Type == unix.IPV6_TCLASS && len(data) >= 4:
+		end.trafficClass, end.hasTrafficClass = uint8(*(*int32)(unsafe.Pointer(&data[0]))), true
+	}
+}
+
 func receive4(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}
+	var oob receiveOOB
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:], 0)
 	if err != nil {
 		return 0, err
 	}
@@ -519,13 +630,21 @@ func receive4(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 		*end.dst4() = *newDst4
 	}
 
-	// update source cache
-
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IP &&
-		cmsg.cmsghdr.Type == unix.IP_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
-		end.src4().Src = cmsg.pktinfo.Spec_dst
-		end.src4().Ifindex = cmsg.pktinfo.Ifindex
+	// update source cache, receive time and IP header fields
+
+	cmsgs := (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:oobn]
+	for hdr, data, rest, ok := nextCmsg(cmsgs); ok; hdr, data, rest, ok = nextCmsg(rest) {
+		if hdr.Level == unix.IPPROTO_IP &&
+			hdr.Type == unix.IP_PKTINFO &&
+			len(data) >= unix.SizeofInet4Pktinfo {
+			pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src4().Src = pktinfo.Spec_dst
+			end.src4().Ifindex = pktinfo.Ifindex
+		} else if received := receiveTimestamp(hdr, data); received != 0 {
+			end.received = received
+		} else {
+			receiveIPHeader(hdr, data, end)
+		}
 	}
 
 	return size, nil
@@ -534,12 +653,9 @@ func receive4(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 func receive6(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}
+	var oob receiveOOB
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:], 0)
 	if err != nil {
 		return 0, err
 	}
@@ -549,13 +665,21 @@ func receive6(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 		*end.dst6() = *newDst6
 	}
 
-	// update source cache
-
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IPV6 &&
-		cmsg.cmsghdr.Type == unix.IPV6_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
-		end.src6().src = cmsg.pktinfo.Addr
-		end.dst6().ZoneId = cmsg.pktinfo.Ifindex
+	// update source cache, receive time and IP header fields
+
+	cmsgs := (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:oobn]
+	for hdr, data, rest, ok := nextCmsg(cmsgs); ok; hdr, data, rest, ok = nextCmsg(rest) {
+		if hdr.Level == unix.IPPROTO_IPV6 &&
+			hdr.Type == unix.IPV6_PKTINFO &&
+			len(data) >= unix.SizeofInet6Pktinfo {
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src6().src = pktinfo.Addr
+			end.dst6().ZoneId = pktinfo.Ifindex
+		} else if received := receiveTimestamp(hdr, data); received != 0 {
+			end.received = received
+		} else {
+			receiveIPHeader(hdr, data, end)
+		}
 	}
 
 	return size, nil
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestLinuxSocketBindReceiveTime(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "[::1]"} {
+		t.Run(addr, func(t *testing.T) {
+			bind := conn.NewLinuxSocketBind()
+			fns, port, err := bind.Open(0)
+			if err != nil {
+				t.Skipf("cannot open bind: %v", err)
+			}
+			defer bind.Close()
+			ep, err := bind.ParseEndpoint(fmt.Sprintf("%s:%d", addr, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := make(chan conn.Endpoint, len(fns))
+			for _, fn := range fns {
+				go func(fn conn.ReceiveFunc) {
+					buf := make([]byte, 1500)
+					if _, ep, err := fn(buf); err == nil {
+						received <- ep
+					}
+				}(fn)
+			}
+
+			before := time.Now()
+			if err := bind.Send([]byte("timestamp"), ep); err != nil {
+				if addr == "[::1]" {
+					t.Skipf("cannot send over IPv6: %v", err)
+				}
+				t.Fatal(err)
+			}
+			var got conn.Endpoint
+			select {
+			case got = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("packet not received")
+			}
+			after := time.Now()
+
+			timestamped, ok := got.(conn.TimestampedEndpoint)
+			if !ok {
+				t.Fatalf("endpoint %T does not implement TimestampedEndpoint", got)
+			}
+			at, ok := timestamped.ReceiveTime()
+			if !ok {
+				t.Skip("kernel delivered no receive timestamp")
+			}
+			// The kernel clock is not the monotonic clock of the runtime,
+			// so allow for some slack.
+			if at.Before(before.Add(-time.Second)) || at.After(after.Add(time.Second)) {
+				t.Errorf("receive time %v not between %v and %v", at, before, after)
+			}
+		})
+	}
+}
+
+func TestLinuxSocketBindIPHeader(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "[::1]"} {
+		t.Run(addr, func(t *testing.T) {
+			bind := conn.NewLinuxSocketBind()
+			fns, port, err := bind.Open(0)
+			if err != nil {
+				t.Skipf("cannot open bind: %v", err)
+			}
+			defer bind.Close()
+			ep, err := bind.ParseEndpoint(fmt.Sprintf("%s:%d", addr, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := make(chan conn.Endpoint, len(fns))
+			for _, fn := range fns {
+				go func(fn conn.ReceiveFunc) {
+					buf := make([]byte, 1500)
+					if _, ep, err := fn(buf); err == nil {
+						received <- ep
+					}
+				}(fn)
+			}
+
+			if err := bind.Send([]byte("header"), ep); err != nil {
+				if addr == "[::1]" {
+					t.Skipf("cannot send over IPv6: %v", err)
+				}
+				t.Fatal(err)
+			}
+			var got conn.Endpoint
+			select {
+			case got = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("packet not received")
+			}
+
+			header, ok := got.(conn.IPHeaderEndpoint)
+			if !ok {
+				t.Fatalf("endpoint %T does not implement IPHeaderEndpoint", got)
+			}
+			hopLimit, ok := header.ReceiveHopLimit()
+			if !ok {
+				t.Skip("kernel delivered no hop limit")
+			}
+			if hopLimit == 0 {
+				t.Error("received packet with a hop limit of 0")
+			}
+			// The bind sends with the default traffic class.
+			if dscp, ok := header.ReceiveDSCP(); ok && dscp != 0 {
+				t.Errorf("received DSCP %d, want 0", dscp)
+			}
+		})
+	}
+}
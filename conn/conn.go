@@ -13,6 +13,7 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // A ReceiveFunc receives a single inbound packet from the network.
@@ -20,10 +21,16 @@ import (
 // ep is the remote endpoint.
 type ReceiveFunc func(b []byte) (n int, ep Endpoint, err error)
 
+// A BatchReceiveFunc receives up to len(bufs) inbound packets from the network
+// per call. It waits for at least one, writes packet i into bufs[i], its
+// length into sizes[i] and its remote endpoint into eps[i], and returns the
+// number of packets received.
+type BatchReceiveFunc func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error)
+
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
-// depending on the platform-specific implementation.
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface, FlowLabelBind, BatchBind
+// or BatchReceiveBind, depending on the platform-specific implementation.
 type Bind interface {
 	// Open puts the Bind into a listening state on a given port and reports the actual
 	// port that it bound to. Passing zero results in a random selection.
@@ -59,6 +66,38 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// FlowLabelBind is implemented by Bind objects that can stamp an IPv6 flow
+// label onto the packets they send. The label is ignored for IPv4 endpoints.
+// Resources a bind holds to send a label, such as a kernel lease, are kept
+// until ReleaseFlowLabel is called with it or the bind is closed.
+type FlowLabelBind interface {
+	SendWithFlowLabel(b []byte, ep Endpoint, flowLabel uint32) error
+	ReleaseFlowLabel(flowLabel uint32)
+}
+
+// BatchBind is implemented by Bind objects that can send several packets to
+// the same endpoint in one system call. The packets are sent in order, and
+// the error is that of the first packet that could not be sent.
+type BatchBind interface {
+	SendBatch(bufs [][]byte, ep Endpoint) error
+}
+
+// BatchReceiveBind is implemented by Bind objects that can receive several
+// packets per call. OpenBatch is like Open, but returns batched receive
+// functions, which fill up to BatchSize packets per call.
+type BatchReceiveBind interface {
+	OpenBatch(port uint16) (fns []BatchReceiveFunc, actualPort uint16, err error)
+	BatchSize() int
+}
+
+// SourceAddrBind is implemented by Bind objects that can pin the local source
+// address of the packets sent to an endpoint, so that they leave through the
+// uplink that owns that address. The endpoint's cached source is overwritten,
+// so the address must be set again whenever the endpoint is replaced.
+type SourceAddrBind interface {
+	SetEndpointSource(ep Endpoint, src netip.Addr) error
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -72,12 +111,41 @@ type Endpoint interface {
 	SrcIP() netip.Addr
 }
 
+// A TimestampedEndpoint is an Endpoint that a ReceiveFunc returns along with
+// the time the kernel received the packet, on platforms where the Bind can
+// obtain kernel receive timestamps. ReceiveTime reports false if no timestamp
+// was delivered with the packet.
+type TimestampedEndpoint interface {
+	Endpoint
+	ReceiveTime() (time.Time, bool)
+}
+
+// An IPHeaderEndpoint is an Endpoint that a ReceiveFunc returns along with
+// fields of the IP header of the packet, on platforms where the Bind can
+// obtain them. ReceiveHopLimit returns the TTL of an IPv4 packet or the hop
+// limit of an IPv6 packet, and ReceiveDSCP its differentiated services code
+// point. Each reports false if the kernel delivered no value with the packet.
+type IPHeaderEndpoint interface {
+	Endpoint
+	ReceiveHopLimit() (uint8, bool)
+	ReceiveDSCP() (uint8, bool)
+}
+
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
+	ErrPathMTUNotFound   = errors.New("no probed size fits the path")
 )
 
 func (fn ReceiveFunc) PrettyName() string {
+	return prettyName(fn)
+}
+
+func (fn BatchReceiveFunc) PrettyName() string {
+	return prettyName(fn)
+}
+
+func prettyName(fn any) string {
 	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
 	// 0. cheese/taco.beansIPv6.func12.func21218-fm
 	name = strings.TrimSuffix(name, "-fm")
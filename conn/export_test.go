@@ -0,0 +1,10 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+func (bind *PaddingBind) LengthMask(prefix []byte) uint16 {
+	return bind.lengthMask(prefix)
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Not exported by x/sys/unix; see include/uapi/linux/in6.h.
+const (
+	ipv6FlowLabelMgr  = 32 // IPV6_FLOWLABEL_MGR
+	ipv6FlowInfoSend  = 33 // IPV6_FLOWINFO_SEND
+	ipv6FlActionGet   = 0  // IPV6_FL_A_GET
+	ipv6FlActionPut   = 1  // IPV6_FL_A_PUT
+	ipv6FlFlagCreate  = 1  // IPV6_FL_F_CREATE
+	ipv6FlShareExcl   = 1  // IPV6_FL_S_EXCL
+	ipv6FlowLabelMask = 0x000fffff
+
+	// The kernel caps the number of labels an unprivileged socket may hold.
+	maxFlowLabelLeases = 16
+
+	// Labels the kernel refused to lease are remembered so that sends with
+	// them do not retry the lease. The set is forgotten once it grows past
+	// this size.
+	maxFailedFlowLabels = 64
+)
+
+// in6FlowLabelReq mirrors struct in6_flowlabel_req.
+type in6FlowLabelReq struct {
+	dst     [16]byte
+	label   uint32 // network byte order
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+// flowLabelLeases tracks the labels leased on the current IPv6 socket. The
+// kernel refuses to send a non-zero flow label unless the socket holds a
+// lease for it. A lease is held until the label is released, so that sending
+// does not need a system call to lease a label once it is held. Labels
+// beyond maxFlowLabelLeases are not leased, and sent without a label.
+type flowLabelLeases struct {
+	sync.Mutex
+	fd          int
+	initialized bool // whether fd has been set up for sending flow labels
+	unsupported bool // whether the socket refused sending flow labels
+	leased      []uint32
+	failed      map[uint32]bool
+}
+
+func setFlowLabelLease(fd int, label uint32, action uint8) error {
+	req := in6FlowLabelReq{action: action, share: ipv6FlShareExcl}
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&req.label))[:], label)
+	if action == ipv6FlActionGet {
+		req.flags = ipv6FlFlagCreate
+	}
+	_, _, errno := unix.Syscall6(
+		unix.SYS_SETSOCKOPT,
+		uintptr(fd),
+		unix.IPPROTO_IPV6,
+		ipv6FlowLabelMgr,
+		uintptr(unsafe.Pointer(&req)),
+		unsafe.Sizeof(req),
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reset starts tracking the leases of fd, if it is not the socket tracked so
+// far. The leases of a closed socket are dropped by the kernel.
+func (leases *flowLabelLeases) reset(fd int) {
+	if leases.initialized && leases.fd == fd {
+		return
+	}
+	leases.fd = fd
+	leases.initialized = true
+	leases.leased = leases.leased[:0]
+	leases.failed = make(map[uint32]bool)
+	leases.unsupported = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, ipv6FlowInfoSend, 1) != nil
+}
+
+// acquire makes sure fd holds a lease for label, and reports whether it does.
+func (leases *flowLabelLeases) acquire(fd int, label uint32) bool {
+	leases.Lock()
+	defer leases.Unlock()
+
+	leases.reset(fd)
+	if leases.unsupported || leases.failed[label] {
+		return false
+	}
+	for _, l := range leases.leased {
+		if l == label {
+			return true
+		}
+	}
+	if len(leases.leased) >= maxFlowLabelLeases {
+		return false
+	}
+	if err := setFlowLabelLease(fd, label, ipv6FlActionGet); err != nil {
+		if len(leases.failed) >= maxFailedFlowLabels {
+			clear(leases.failed)
+		}
+		leases.failed[label] = true
+		return false
+	}
+	leases.leased = append(leases.leased, label)
+	return true
+}
+
+// release gives up the lease of label on fd, if it holds one, and forgets
+// that the label could not be leased.
+func (leases *flowLabelLeases) release(fd int, label uint32) {
+	leases.Lock()
+	defer leases.Unlock()
+	if !leases.initialized || leases.fd != fd {
+		return
+	}
+	delete(leases.failed, label)
+	for i, l := range leases.leased {
+		if l == label {
+			setFlowLabelLease(fd, label, ipv6FlActionPut)
+			leases.leased = append(leases.leased[:i], leases.leased[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget drops a lease the kernel no longer knows about.
+func (leases *flowLabelLeases) forget(fd int, label uint32) {
+	leases.Lock()
+	defer leases.Unlock()
+	if !leases.initialized || leases.fd != fd {
+		return
+	}
+	for i, l := range leases.leased {
+		if l == label {
+			leases.leased = append(leases.leased[:i], leases.leased[i+1:]...)
+			return
+		}
+	}
+}
+
+// SendWithFlowLabel implements FlowLabelBind. IPv4 endpoints, and labels the
+// socket cannot lease, are sent without a label.
+func (bind *LinuxSocketBind) SendWithFlowLabel(buff []byte, end Endpoint, flowLabel uint32) error {
+	nend, ok := end.(*LinuxSocketEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	flowLabel &= ipv6FlowLabelMask
+	if !nend.isV6 || flowLabel == 0 {
+		return bind.Send(buff, end)
+	}
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if bind.sock6 == -1 {
+		return net.ErrClosed
+	}
+	if !bind.flowLabels.acquire(bind.sock6, flowLabel) {
+		return send6(bind.sock6, nend, buff)
+	}
+	err := send6FlowLabel(bind.sock6, nend, buff, flowLabel)
+	if err == unix.EINVAL {
+		bind.flowLabels.forget(bind.sock6, flowLabel)
+		return send6(bind.sock6, nend, buff)
+	}
+	return err
+}
+
+// ReleaseFlowLabel implements FlowLabelBind.
+func (bind *LinuxSocketBind) ReleaseFlowLabel(flowLabel uint32) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if bind.sock6 != -1 {
+		bind.flowLabels.release(bind.sock6, flowLabel&ipv6FlowLabelMask)
+	}
+}
+
+// send6FlowLabel is like send6, but carries the flow label in sin6_flowinfo,
+// which unix.SockaddrInet6 has no field for.
+func send6FlowLabel(sock int, end *LinuxSocketEndpoint, buff []byte, flowLabel uint32) error {
+	cmsg := struct {
+		cmsghdr unix.Cmsghdr
+		pktinfo unix.Inet6Pktinfo
+	}{
+		cmsghdr: unix.Cmsghdr{
+			Level: unix.IPPROTO_IPV6,
+			Type:  unix.IPV6_PKTINFO,
+			Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
+		},
+	}
+
+	end.mu.Lock()
+	dst := end.dst6()
+	cmsg.pktinfo = unix.Inet6Pktinfo{
+		Addr:    end.src6().src,
+		Ifindex: dst.ZoneId,
+	}
+	rsa := unix.RawSockaddrInet6{
+		Family:   unix.AF_INET6,
+		Addr:     dst.Addr,
+		Scope_id: dst.ZoneId,
+	}
+	end.mu.Unlock()
+	if cmsg.pktinfo.Addr == [16]byte{} {
+		cmsg.pktinfo.Ifindex = 0
+	}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:], uint16(dst.Port))
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&rsa.Flowinfo))[:], flowLabel)
+
+	iov := unix.Iovec{Base: unsafe.SliceData(buff)}
+	iov.SetLen(len(buff))
+	msg := unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&rsa)),
+		Namelen: unix.SizeofSockaddrInet6,
+		Iov:     &iov,
+		Control: (*byte)(unsafe.Pointer(&cmsg)),
+	}
+	msg.SetIovlen(1)
+	msg.SetControllen(int(unsafe.Sizeof(cmsg)))
+
+	_, _, errno := unix.Syscall(unix.SYS_SENDMSG, uintptr(sock), uintptr(unsafe.Pointer(&msg)), 0)
+	if errno == 0 {
+		return nil
+	}
+
+	// clear src and retry
+
+	if errno == unix.EINVAL {
+		end.mu.Lock()
+		end.ClearSrc()
+		end.mu.Unlock()
+		cmsg.pktinfo = unix.Inet6Pktinfo{}
+		_, _, errno = unix.Syscall(unix.SYS_SENDMSG, uintptr(sock), uintptr(unsafe.Pointer(&msg)), 0)
+		if errno == 0 {
+			return nil
+		}
+	}
+	return errno
+}
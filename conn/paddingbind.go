@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/rand"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+const (
+	// PaddingKeySize is the size of the key shared by the two ends of a
+	// PaddingBind.
+	PaddingKeySize = 32
+
+	// paddingFlag marks a padded datagram in the first reserved byte of the
+	// WireGuard message header, which is zero in unpadded messages.
+	paddingFlag = 0x80
+
+	// paddingMaskedLen is the length of the message prefix that the mask of
+	// the original length is derived from: the header and the sender or
+	// receiver index, and the counter or the start of the ephemeral key,
+	// which make the prefix unique per message.
+	paddingMaskedLen = 16
+
+	minPaddedSize = 32 // the size of the smallest WireGuard message
+	maxPaddedSize = 65535
+)
+
+// A PaddingBind pads every datagram it sends to one of a set of sizes, so that
+// the size of the outer packets reveals little about the traffic, without
+// running DAITA. A datagram is padded to the smallest size that fits it, and
+// sent as is if it fits none.
+//
+// The original length of a padded datagram is stored, masked with a keyed
+// hash so that only the other end can read it, in the reserved bytes of the
+// WireGuard header, and the first of them is flagged. The other end must
+// therefore also send and receive through a PaddingBind with the same key.
+// Received datagrams without the flag pass through unchanged, so a peer can
+// start padding before the other end does.
+type PaddingBind struct {
+	bind    Bind
+	sizes   []int
+	hashers sync.Pool
+	buffers sync.Pool
+}
+
+// NewPaddingBind returns a PaddingBind wrapping bind, which pads datagrams to
+// sizes, in ascending order. A single size pads every datagram to a fixed size.
+func NewPaddingBind(bind Bind, key [PaddingKeySize]byte, sizes ...int) (*PaddingBind, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("no padding sizes")
+	}
+	for i, size := range sizes {
+		if size < minPaddedSize || size > maxPaddedSize {
+			return nil, fmt.Errorf("padding size %d out of range [%d, %d]", size, minPaddedSize, maxPaddedSize)
+		}
+		if i > 0 && size <= sizes[i-1] {
+			return nil, errors.New("padding sizes are not in ascending order")
+		}
+	}
+	largest := sizes[len(sizes)-1]
+	return &PaddingBind{
+		bind:  bind,
+		sizes: append([]int(nil), sizes...),
+		hashers: sync.Pool{New: func() any {
+			h, err := blake2s.New128(key[:])
+			if err != nil {
+				panic(err)
+			}
+			return h
+		}},
+		buffers: sync.Pool{New: func() any {
+			b := make([]byte, largest)
+			return &b
+		}},
+	}, nil
+}
+
+// lengthMask returns the mask of the original length of the message starting
+// with prefix.
+func (bind *PaddingBind) lengthMask(prefix []byte) uint16 {
+	h := bind.hashers.Get().(hash.Hash)
+	defer bind.hashers.Put(h)
+	h.Reset()
+	h.Write(prefix[4:paddingMaskedLen])
+	var sum [blake2s.Size128]byte
+	return binary.LittleEndian.Uint16(h.Sum(sum[:0]))
+}
+
+// pad returns b padded to the smallest configured size that fits it, and a
+// function releasing the returned buffer, or b itself if it fits no size.
+func (bind *PaddingBind) pad(b []byte) ([]byte, func()) {
+	size := -1
+	for _, s := range bind.sizes {
+		if s >= len(b) {
+			size = s
+			break
+		}
+	}
+	if size < 0 || len(b) < paddingMaskedLen || b[1] != 0 {
+		return b, func() {}
+	}
+	buffer := bind.buffers.Get().(*[]byte)
+	padded := (*buffer)[:size]
+	copy(padded, b)
+	rand.Read(padded[len(b):])
+	padded[1] = paddingFlag
+	binary.LittleEndian.PutUint16(padded[2:4], uint16(len(b))^bind.lengthMask(b))
+	return padded, func() { bind.buffers.Put(buffer) }
+}
+
+// unpad strips the padding of a received datagram, and reports whether it is
+// well-formed.
+func (bind *PaddingBind) unpad(b []byte) (int, bool) {
+	if len(b) < paddingMaskedLen || b[1] != paddingFlag {
+		return len(b), true
+	}
+	n := int(binary.LittleEndian.Uint16(b[2:4]) ^ bind.lengthMask(b))
+	if n < paddingMaskedLen || n > len(b) {
+		return 0, false
+	}
+	b[1], b[2], b[3] = 0, 0, 0
+	return n, true
+}
+
+func (bind *PaddingBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := bind.bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	wrapped := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		wrapped[i] = func(b []byte) (int, Endpoint, error) {
+			for {
+				n, ep, err := fn(b)
+				if err != nil {
+					return n, ep, err
+				}
+				if n, ok := bind.unpad(b[:n]); ok {
+					return n, ep, nil
+				}
+				// Drop datagrams whose length cannot be recovered.
+			}
+		}
+	}
+	return wrapped, actualPort, nil
+}
+
+func (bind *PaddingBind) Close() error {
+	return bind.bind.Close()
+}
+
+func (bind *PaddingBind) SetMark(mark uint32) error {
+	return bind.bind.SetMark(mark)
+}
+
+func (bind *PaddingBind) Send(b []byte, ep Endpoint) error {
+	padded, release := bind.pad(b)
+	defer release()
+	return bind.bind.Send(padded, ep)
+}
+
+func (bind *PaddingBind) ParseEndpoint(s string) (Endpoint, error) {
+	return bind.bind.ParseEndpoint(s)
+}
+
+// SendWithFlowLabel implements FlowLabelBind, ignoring the flow label if the
+// wrapped bind does not support it.
+func (bind *PaddingBind) SendWithFlowLabel(b []byte, ep Endpoint, flowLabel uint32) error {
+	inner, ok := bind.bind.(FlowLabelBind)
+	if !ok {
+		return bind.Send(b, ep)
+	}
+	padded, release := bind.pad(b)
+	defer release()
+	return inner.SendWithFlowLabel(padded, ep, flowLabel)
+}
+
+// ReleaseFlowLabel implements FlowLabelBind.
+func (bind *PaddingBind) ReleaseFlowLabel(flowLabel uint32) {
+	if inner, ok := bind.bind.(FlowLabelBind); ok {
+		inner.ReleaseFlowLabel(flowLabel)
+	}
+}
+
+// SetEndpointSource implements SourceAddrBind if the wrapped bind does.
+func (bind *PaddingBind) SetEndpointSource(ep Endpoint, src netip.Addr) error {
+	inner, ok := bind.bind.(SourceAddrBind)
+	if !ok {
+		return errors.New("wrapped bind does not support source addresses")
+	}
+	return inner.SetEndpointSource(ep, src)
+}
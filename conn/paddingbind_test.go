@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+)
+
+// openPair opens a and b, which are connected channel binds, and returns the
+// IPv4 receive function of b and the IPv4 endpoint of b as seen from a.
+func openPair(t *testing.T, a, b conn.Bind) (conn.ReceiveFunc, conn.Endpoint) {
+	t.Helper()
+	if _, _, err := a.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	ep, err := a.ParseEndpoint("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fns[0], ep
+}
+
+func transportMessage(size int) []byte {
+	message := make([]byte, size)
+	rand.Read(message)
+	message[0], message[1], message[2], message[3] = 4, 0, 0, 0
+	return message
+}
+
+func receive(t *testing.T, fn conn.ReceiveFunc) []byte {
+	t.Helper()
+	b := make([]byte, 2048)
+	n, _, err := fn(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func TestPaddingBind(t *testing.T) {
+	var key [conn.PaddingKeySize]byte
+	rand.Read(key[:])
+	sizes := []int{256, 1024}
+
+	binds := bindtest.NewChannelBinds()
+	sender, err := conn.NewPaddingBind(binds[0], key, sizes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := conn.NewPaddingBind(binds[1], key, sizes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, ep := openPair(t, sender, receiver)
+	for _, size := range []int{32, 100, 256, 257, 1024, 1500} {
+		message := transportMessage(size)
+		if err := sender.Send(message, ep); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(t, fn); !bytes.Equal(got, message) {
+			t.Errorf("%d byte message not restored, got %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestPaddingBindWire(t *testing.T) {
+	var key [conn.PaddingKeySize]byte
+	binds := bindtest.NewChannelBinds()
+	sender, err := conn.NewPaddingBind(binds[0], key, 256, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, ep := openPair(t, sender, binds[1])
+
+	for _, tc := range []struct{ size, wire int }{{100, 256}, {256, 256}, {300, 1024}, {1500, 1500}} {
+		message := transportMessage(tc.size)
+		if err := sender.Send(message, ep); err != nil {
+			t.Fatal(err)
+		}
+		got := receive(t, fn)
+		if len(got) != tc.wire {
+			t.Errorf("%d byte message sent as %d bytes, expected %d", tc.size, len(got), tc.wire)
+		}
+		if tc.wire == tc.size {
+			continue
+		}
+		if got[1] != 0x80 {
+			t.Errorf("padded %d byte message not flagged", tc.size)
+		}
+		if length := binary.LittleEndian.Uint16(got[2:4]) ^ sender.LengthMask(got); int(length) != tc.size {
+			t.Errorf("%d byte message sent with length %d", tc.size, length)
+		}
+	}
+}
+
+func TestPaddingBindPassthrough(t *testing.T) {
+	var key [conn.PaddingKeySize]byte
+	binds := bindtest.NewChannelBinds()
+	receiver, err := conn.NewPaddingBind(binds[1], key, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, ep := openPair(t, binds[0], receiver)
+
+	// Unpadded datagrams are received unchanged.
+	message := transportMessage(100)
+	if err := binds[0].Send(message, ep); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, fn); !bytes.Equal(got, message) {
+		t.Error("unpadded message modified")
+	}
+
+	// Flagged datagrams whose length does not fit are dropped.
+	bogus := transportMessage(64)
+	bogus[1] = 0x80
+	binary.LittleEndian.PutUint16(bogus[2:4], 65^receiver.LengthMask(bogus))
+	if err := binds[0].Send(bogus, ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := binds[0].Send(message, ep); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, fn); !bytes.Equal(got, message) {
+		t.Error("malformed padded message not dropped")
+	}
+}
+
+func TestNewPaddingBindSizes(t *testing.T) {
+	var key [conn.PaddingKeySize]byte
+	for _, sizes := range [][]int{nil, {16}, {70000}, {512, 256}, {256, 256}} {
+		if _, err := conn.NewPaddingBind(bindtest.NewChannelBinds()[0], key, sizes...); err == nil {
+			t.Errorf("sizes %v accepted", sizes)
+		}
+	}
+}
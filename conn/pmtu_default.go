@@ -0,0 +1,27 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ProbePathMTU is only supported on Linux, and returns errors.ErrUnsupported
+// elsewhere.
+func ProbePathMTU(ctx context.Context, dst netip.AddrPort, sizes []int, wait time.Duration) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// PathMTU is only supported on Linux, and returns errors.ErrUnsupported
+// elsewhere.
+func PathMTU(dst netip.AddrPort) (int, error) {
+	return 0, errors.ErrUnsupported
+}
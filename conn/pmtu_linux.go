@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pmtuSocket returns a UDP socket connected to dst that sets the
+// don't-fragment bit, along with the socket option level, the option reading
+// the path MTU, and the length of the IP and UDP headers.
+func pmtuSocket(dst netip.AddrPort) (fd, level, mtu, header int, err error) {
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	var (
+		sa                           unix.Sockaddr
+		family, discover, pmtudiscDo int
+	)
+	if dst.Addr().Is4() {
+		family, level, discover, pmtudiscDo, mtu, header = unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO, unix.IP_MTU, 20
+		sa = &unix.SockaddrInet4{Port: int(dst.Port()), Addr: dst.Addr().As4()}
+	} else {
+		family, level, discover, pmtudiscDo, mtu, header = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO, unix.IPV6_MTU, 40
+		sa = &unix.SockaddrInet6{Port: int(dst.Port()), Addr: dst.Addr().As16()}
+	}
+	header += 8 // UDP
+
+	fd, err = unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, 0, 0, 0, err
+	}
+	if err = unix.SetsockoptInt(fd, level, discover, pmtudiscDo); err == nil {
+		err = unix.Connect(fd, sa)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, 0, 0, 0, err
+	}
+	return fd, level, mtu, header, nil
+}
+
+// PathMTU returns the path MTU to dst known to the kernel, which is the MTU
+// of the outgoing interface unless routers on the path reported a smaller one.
+func PathMTU(dst netip.AddrPort) (int, error) {
+	fd, level, mtu, _, err := pmtuSocket(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	return unix.GetsockoptInt(fd, level, mtu)
+}
+
+// ProbePathMTU returns the path MTU to dst, the largest of sizes that a UDP
+// datagram with the don't-fragment bit set can have on the way to dst. Sizes
+// are those of whole IP packets, largest first. Each probe is given wait for
+// routers on the path to report it as too big, which the kernel learns from;
+// routers dropping probes silently go unnoticed. It returns ErrPathMTUNotFound
+// if even the smallest size is too big.
+//
+// The probes carry zeros, which WireGuard drops as messages of unknown type.
+func ProbePathMTU(ctx context.Context, dst netip.AddrPort, sizes []int, wait time.Duration) (int, error) {
+	fd, level, mtu, header, err := pmtuSocket(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	var buf []byte
+	limit := math.MaxInt // path MTU known to the kernel
+	for _, size := range sizes {
+		if size > limit || size <= header {
+			continue
+		}
+		if len(buf) < size-header {
+			buf = make([]byte, size-header)
+		}
+		_, err := unix.Write(fd, buf[:size-header])
+		if errors.Is(err, unix.ECONNREFUSED) {
+			// Reported for an earlier probe; nobody listens at dst.
+			_, err = unix.Write(fd, buf[:size-header])
+		}
+		if errors.Is(err, unix.EMSGSIZE) {
+			limit = size - 1
+			if known, err := unix.GetsockoptInt(fd, level, mtu); err == nil && known < size {
+				limit = known
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if known, err := unix.GetsockoptInt(fd, level, mtu); err == nil && known < size {
+			limit = known
+			continue
+		}
+		return size, nil
+	}
+	return 0, ErrPathMTUNotFound
+}
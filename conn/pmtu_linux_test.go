@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestProbePathMTU(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			dst := netip.AddrPortFrom(netip.MustParseAddr(addr), 9)
+			// The first size exceeds the largest UDP datagram, so it is
+			// refused locally.
+			mtu, err := conn.ProbePathMTU(context.Background(), dst, []int{70000, 1500, 1280}, time.Millisecond)
+			if err != nil {
+				t.Skipf("cannot probe %v: %v", dst, err)
+			}
+			if mtu != 1500 {
+				t.Errorf("expected a path MTU of 1500, got %d", mtu)
+			}
+
+			if _, err := conn.ProbePathMTU(context.Background(), dst, []int{70000}, time.Millisecond); err != conn.ErrPathMTUNotFound {
+				t.Errorf("expected ErrPathMTUNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	mtu, err := conn.PathMTU(netip.MustParseAddrPort("127.0.0.1:9"))
+	if err != nil {
+		t.Skipf("cannot look up path MTU: %v", err)
+	}
+	// Loopback has a large MTU.
+	if mtu < 1500 {
+		t.Errorf("expected a path MTU of at least 1500, got %d", mtu)
+	}
+}
@@ -178,6 +178,44 @@ func TestTrieIPv4(t *testing.T) {
 	assertNEQ(a, 192, 168, 0, 1)
 }
 
+func TestTrieRemove(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+
+	var allowedIPs AllowedIPs
+	prefix := netip.MustParsePrefix
+
+	allowedIPs.Insert(prefix("10.0.0.0/8"), a)
+	allowedIPs.Insert(prefix("10.1.0.0/16"), a)
+	allowedIPs.Insert(prefix("10.1.2.0/24"), b)
+
+	allowedIPs.Remove(prefix("10.1.2.0/24"), a)
+	if p := allowedIPs.Lookup([]byte{10, 1, 2, 3}); p != b {
+		t.Error("Removed a prefix of another peer")
+	}
+	allowedIPs.Remove(prefix("10.1.0.0/17"), a)
+	if p := allowedIPs.Lookup([]byte{10, 1, 1, 1}); p != a {
+		t.Error("Removed a prefix that does not match exactly")
+	}
+
+	allowedIPs.Remove(prefix("10.1.2.0/24"), b)
+	if p := allowedIPs.Lookup([]byte{10, 1, 2, 3}); p != a {
+		t.Error("Failed to fall back to the covering prefix after removal")
+	}
+	allowedIPs.Remove(prefix("10.0.0.0/8"), a)
+	if p := allowedIPs.Lookup([]byte{10, 2, 0, 1}); p != nil {
+		t.Error("Failed to remove prefix")
+	}
+	if p := allowedIPs.Lookup([]byte{10, 1, 0, 1}); p != a {
+		t.Error("Removed a more specific prefix")
+	}
+
+	allowedIPs.Remove(prefix("10.1.0.0/16"), a)
+	if allowedIPs.IPv4 != nil {
+		t.Error("Expected removing all the prefixes to empty trie, but it did not")
+	}
+}
+
 /* Test ported from kernel implementation:
  * selftest/allowedips.h
  */
@@ -19,14 +19,16 @@ import (
 // call wg.Done to remove the initial reference.
 // When the refcount hits 0, the queue's channel is closed.
 type outboundQueue struct {
-	c  chan *QueueOutboundElement
-	wg sync.WaitGroup
+	c     chan *QueueOutboundElement
+	wg    sync.WaitGroup
+	clock queueClock
 }
 
-func newOutboundQueue() *outboundQueue {
+func newOutboundQueue(size int) *outboundQueue {
 	q := &outboundQueue{
-		c: make(chan *QueueOutboundElement, QueueOutboundSize),
+		c: make(chan *QueueOutboundElement, size),
 	}
+	q.clock.reset()
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
@@ -35,16 +37,46 @@ func newOutboundQueue() *outboundQueue {
 	return q
 }
 
+// receiveBatch appends to batch the next element of the queue, waiting for
+// it, and the elements already queued behind it. It takes at most cap(batch)
+// elements, and no more than a fair share of the queue among consumers, so
+// that concurrent consumers are kept busy. It returns batch unchanged once
+// the queue is closed and drained.
+func (q *outboundQueue) receiveBatch(batch []*QueueOutboundElement, consumers int) []*QueueOutboundElement {
+	elem, ok := <-q.c
+	if !ok {
+		return batch
+	}
+	q.clock.dequeued(elem.queuedAt)
+	batch = append(batch, elem)
+	limit := min(cap(batch), len(batch)+len(q.c)/max(consumers, 1))
+	for len(batch) < limit {
+		select {
+		case elem, ok := <-q.c:
+			if !ok {
+				return batch
+			}
+			q.clock.dequeued(elem.queuedAt)
+			batch = append(batch, elem)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
 // A inboundQueue is similar to an outboundQueue; see those docs.
 type inboundQueue struct {
-	c  chan *QueueInboundElement
-	wg sync.WaitGroup
+	c     chan *QueueInboundElement
+	wg    sync.WaitGroup
+	clock queueClock
 }
 
-func newInboundQueue() *inboundQueue {
+func newInboundQueue(size int) *inboundQueue {
 	q := &inboundQueue{
-		c: make(chan *QueueInboundElement, QueueInboundSize),
+		c: make(chan *QueueInboundElement, size),
 	}
+	q.clock.reset()
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
@@ -55,14 +87,16 @@ func newInboundQueue() *inboundQueue {
 
 // A handshakeQueue is similar to an outboundQueue; see those docs.
 type handshakeQueue struct {
-	c  chan QueueHandshakeElement
-	wg sync.WaitGroup
+	c     chan QueueHandshakeElement
+	wg    sync.WaitGroup
+	clock queueClock
 }
 
-func newHandshakeQueue() *handshakeQueue {
+func newHandshakeQueue(size int) *handshakeQueue {
 	q := &handshakeQueue{
-		c: make(chan QueueHandshakeElement, QueueHandshakeSize),
+		c: make(chan QueueHandshakeElement, size),
 	}
+	q.clock.reset()
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
@@ -72,17 +106,19 @@ func newHandshakeQueue() *handshakeQueue {
 }
 
 type autodrainingInboundQueue struct {
-	c chan *QueueInboundElement
+	c     chan *QueueInboundElement
+	clock queueClock
 }
 
 // newAutodrainingInboundQueue returns a channel that will be drained when it gets GC'd.
 // It is useful in cases in which is it hard to manage the lifetime of the channel.
 // The returned channel must not be closed. Senders should signal shutdown using
-// some other means, such as sending a sentinel nil values.
+// some other means, such as cancelling the context of the receivers.
 func newAutodrainingInboundQueue(device *Device) *autodrainingInboundQueue {
 	q := &autodrainingInboundQueue{
-		c: make(chan *QueueInboundElement, QueueInboundSize),
+		c: make(chan *QueueInboundElement, device.options.queueInboundSize),
 	}
+	q.clock.reset()
 	runtime.SetFinalizer(q, device.flushInboundQueue)
 	return q
 }
@@ -101,18 +137,20 @@ func (device *Device) flushInboundQueue(q *autodrainingInboundQueue) {
 }
 
 type autodrainingOutboundQueue struct {
-	c chan *QueueOutboundElement
+	c     chan *QueueOutboundElement
+	clock queueClock
 }
 
 // newAutodrainingOutboundQueue returns a channel that will be drained when it gets GC'd.
 // It is useful in cases in which is it hard to manage the lifetime of the channel.
 // The returned channel must not be closed. Senders should signal shutdown using
-// some other means, such as sending a sentinel nil values.
+// some other means, such as cancelling the context of the receivers.
 // All sends to the channel must be best-effort, because there may be no receivers.
 func newAutodrainingOutboundQueue(device *Device) *autodrainingOutboundQueue {
 	q := &autodrainingOutboundQueue{
-		c: make(chan *QueueOutboundElement, QueueOutboundSize),
+		c: make(chan *QueueOutboundElement, device.options.queueOutboundSize),
 	}
+	q.clock.reset()
 	runtime.SetFinalizer(q, device.flushOutboundQueue)
 	return q
 }
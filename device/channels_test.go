@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "testing"
+
+func TestOutboundQueueReceiveBatch(t *testing.T) {
+	q := newOutboundQueue(64)
+	for i := 0; i < 40; i++ {
+		q.c <- &QueueOutboundElement{nonce: uint64(i)}
+	}
+
+	// Two consumers share the 39 elements waiting behind the first one.
+	batch := q.receiveBatch(make([]*QueueOutboundElement, 0, EncryptionBatchSize), 2)
+	if len(batch) != 1+39/2 {
+		t.Fatalf("expected a fair share of %d elements, got %d", 1+39/2, len(batch))
+	}
+	// A single consumer takes a full batch.
+	batch = q.receiveBatch(make([]*QueueOutboundElement, 0, EncryptionBatchSize), 1)
+	if len(batch) != 40-(1+39/2) {
+		t.Fatalf("expected the remaining %d elements, got %d", 40-(1+39/2), len(batch))
+	}
+	for i, elem := range batch {
+		if expected := uint64(1 + 39/2 + i); elem.nonce != expected {
+			t.Fatalf("expected element %d, got %d", expected, elem.nonce)
+		}
+	}
+
+	q.wg.Done()
+	if batch := q.receiveBatch(batch[:0], 1); len(batch) != 0 {
+		t.Fatalf("expected no elements from a closed queue, got %d", len(batch))
+	}
+}
@@ -0,0 +1,203 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// classifyTopPorts is the number of destination ports a traffic classifier
+// keeps counts for. Ports beyond it evict the least counted one.
+const classifyTopPorts = 16
+
+// A TrafficClass is the transport protocol of a packet sent to a peer.
+type TrafficClass int
+
+const (
+	TrafficTCP TrafficClass = iota
+	TrafficUDP
+	TrafficICMP
+	TrafficOther
+
+	trafficClasses
+)
+
+func (class TrafficClass) String() string {
+	switch class {
+	case TrafficTCP:
+		return "tcp"
+	case TrafficUDP:
+		return "udp"
+	case TrafficICMP:
+		return "icmp"
+	case TrafficOther:
+		return "other"
+	}
+	return fmt.Sprintf("TrafficClass(%d)", int(class))
+}
+
+// A PortCount estimates how many packets were sent to a destination port.
+// The count is at most Error too high.
+type PortCount struct {
+	Class   TrafficClass // TrafficTCP or TrafficUDP
+	Port    uint16
+	Packets uint64
+	Error   uint64
+}
+
+// TrafficClassification is the mix of the packets sent to a peer since
+// traffic classification was enabled for it.
+type TrafficClassification struct {
+	Packets  [trafficClasses]uint64 // indexed by TrafficClass
+	TopPorts []PortCount            // most counted first
+}
+
+// peerClassifier counts the packets sent to a peer by transport protocol,
+// and estimates the most common destination ports with the Space-Saving
+// algorithm in bounded memory. It is enabled with the "classify_traffic"
+// UAPI key, and costs nothing while disabled.
+type peerClassifier struct {
+	enabled atomic.Bool
+	packets [trafficClasses]atomic.Uint64
+
+	sync.Mutex // protects ports
+	ports      []PortCount
+}
+
+// classify returns the traffic class and destination port of an IP packet.
+// The port is 0 if the packet is not TCP or UDP, or is not its first fragment.
+func classify(packet []byte) (TrafficClass, uint16) {
+	var protocol byte
+	var payload []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || len(packet) < ihl {
+			return TrafficOther, 0
+		}
+		protocol = packet[9]
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			payload = packet[ihl:]
+		}
+	case ipv6.Version:
+		protocol = packet[6]
+		payload = packet[ipv6.HeaderLen:]
+	default:
+		return TrafficOther, 0
+	}
+
+	var class TrafficClass
+	switch protocol {
+	case 6:
+		class = TrafficTCP
+	case 17:
+		class = TrafficUDP
+	case 1, 58:
+		return TrafficICMP, 0
+	default:
+		return TrafficOther, 0
+	}
+	if len(payload) < 4 {
+		return class, 0
+	}
+	return class, binary.BigEndian.Uint16(payload[2:4])
+}
+
+// count classifies a packet sent to the peer. It is only called while
+// classification is enabled.
+func (c *peerClassifier) count(packet []byte) {
+	class, port := classify(packet)
+	c.packets[class].Add(1)
+	if port == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.ports {
+		if c.ports[i].Class == class && c.ports[i].Port == port {
+			c.ports[i].Packets++
+			return
+		}
+	}
+	if len(c.ports) < classifyTopPorts {
+		c.ports = append(c.ports, PortCount{Class: class, Port: port, Packets: 1})
+		return
+	}
+	// Replace the least counted port, inheriting its count as the error.
+	least := 0
+	for i := range c.ports {
+		if c.ports[i].Packets < c.ports[least].Packets {
+			least = i
+		}
+	}
+	evicted := c.ports[least].Packets
+	c.ports[least] = PortCount{Class: class, Port: port, Packets: evicted + 1, Error: evicted}
+}
+
+// setEnabled enables or disables classification, starting the counts afresh
+// when it is enabled.
+func (c *peerClassifier) setEnabled(enabled bool) {
+	c.Lock()
+	defer c.Unlock()
+	if enabled && !c.enabled.Load() {
+		for i := range c.packets {
+			c.packets[i].Store(0)
+		}
+		c.ports = nil
+	}
+	c.enabled.Store(enabled)
+}
+
+func (c *peerClassifier) snapshot() TrafficClassification {
+	var tc TrafficClassification
+	for i := range c.packets {
+		tc.Packets[i] = c.packets[i].Load()
+	}
+	c.Lock()
+	tc.TopPorts = slices.Clone(c.ports)
+	c.Unlock()
+	slices.SortStableFunc(tc.TopPorts, func(a, b PortCount) int {
+		if a.Packets != b.Packets {
+			if a.Packets > b.Packets {
+				return -1
+			}
+			return 1
+		}
+		return int(a.Port) - int(b.Port)
+	})
+	return tc
+}
+
+// TrafficClassification returns the mix of the packets sent to the peer with
+// the given public key, and false if there is no such peer or
+// classification is disabled for it.
+func (device *Device) TrafficClassification(pk NoisePublicKey) (TrafficClassification, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil || !peer.classifier.enabled.Load() {
+		return TrafficClassification{}, false
+	}
+	return peer.classifier.snapshot(), true
+}
+
+// ipcTrafficClassification serializes the traffic classification of a peer
+// for IpcGet.
+func ipcTrafficClassification(sendf func(string, ...any), tc TrafficClassification) {
+	sendf("classify_traffic=true")
+	for class, packets := range tc.Packets {
+		sendf("tx_packets_%s=%d", TrafficClass(class), packets)
+	}
+	for _, port := range tc.TopPorts {
+		sendf("tx_top_port=%s/%d/%d/%d", port.Class, port.Port, port.Packets, port.Error)
+	}
+}
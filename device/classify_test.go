@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// classifyPacket returns a packet of the given IP version and protocol, with
+// the given destination port.
+func classifyPacket(version int, protocol byte, port uint16) []byte {
+	var packet []byte
+	if version == 4 {
+		packet = make([]byte, 20+8)
+		packet[0] = 0x45
+		packet[9] = protocol
+		binary.BigEndian.PutUint16(packet[22:], port)
+	} else {
+		packet = make([]byte, 40+8)
+		packet[0] = 0x60
+		packet[6] = protocol
+		binary.BigEndian.PutUint16(packet[42:], port)
+	}
+	return packet
+}
+
+func TestClassify(t *testing.T) {
+	fragment := classifyPacket(4, 17, 53)
+	fragment[7] = 1 // fragment offset of 8 bytes
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		class  TrafficClass
+		port   uint16
+	}{
+		{"ipv4 tcp", classifyPacket(4, 6, 443), TrafficTCP, 443},
+		{"ipv4 udp", classifyPacket(4, 17, 53), TrafficUDP, 53},
+		{"ipv4 icmp", classifyPacket(4, 1, 0), TrafficICMP, 0},
+		{"ipv4 gre", classifyPacket(4, 47, 0), TrafficOther, 0},
+		{"ipv4 fragment", fragment, TrafficUDP, 0},
+		{"ipv4 truncated", classifyPacket(4, 6, 443)[:22], TrafficTCP, 0},
+		{"ipv6 tcp", classifyPacket(6, 6, 22), TrafficTCP, 22},
+		{"ipv6 udp", classifyPacket(6, 17, 51820), TrafficUDP, 51820},
+		{"ipv6 icmp", classifyPacket(6, 58, 0), TrafficICMP, 0},
+		{"ipv6 extension header", classifyPacket(6, 0, 0), TrafficOther, 0},
+	} {
+		class, port := classify(tc.packet)
+		if class != tc.class || port != tc.port {
+			t.Errorf("%s: got %v port %d, want %v port %d", tc.name, class, port, tc.class, tc.port)
+		}
+	}
+}
+
+func TestClassifierTopPorts(t *testing.T) {
+	var c peerClassifier
+	c.setEnabled(true)
+	for i := 0; i < 100; i++ {
+		c.count(classifyPacket(4, 6, 443))
+	}
+	for i := 0; i < 10; i++ {
+		c.count(classifyPacket(6, 17, 53))
+	}
+	// Many rare ports evict each other, not the common ones.
+	for port := uint16(1000); port < 1100; port++ {
+		c.count(classifyPacket(4, 17, port))
+	}
+
+	tc := c.snapshot()
+	if tc.Packets[TrafficTCP] != 100 || tc.Packets[TrafficUDP] != 110 {
+		t.Errorf("unexpected packet counts %v", tc.Packets)
+	}
+	if len(tc.TopPorts) != classifyTopPorts {
+		t.Fatalf("%d top ports kept, want %d", len(tc.TopPorts), classifyTopPorts)
+	}
+	if top := tc.TopPorts[0]; top != (PortCount{TrafficTCP, 443, 100, 0}) {
+		t.Errorf("unexpected top port %+v", top)
+	}
+	for _, port := range tc.TopPorts[1:] {
+		if port.Packets > 100 || port.Packets-port.Error > 10 {
+			t.Errorf("count %+v out of bounds", port)
+		}
+	}
+
+	// Enabling classification again starts afresh.
+	c.setEnabled(false)
+	c.setEnabled(true)
+	if tc := c.snapshot(); tc.Packets != ([trafficClasses]uint64{}) || len(tc.TopPorts) != 0 {
+		t.Errorf("counts kept after reenabling: %+v", tc)
+	}
+}
+
+func TestClassifyTrafficUAPI(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[1].dev
+	pk := pair[0].dev.staticIdentity.publicKey
+
+	pair.Send(t, Ping, nil)
+	if _, ok := dev.TrafficClassification(pk); ok {
+		t.Fatal("traffic classified by default")
+	}
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"classify_traffic", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+
+	tc, ok := dev.TrafficClassification(pk)
+	if !ok || tc.Packets[TrafficICMP] != 2 || len(tc.TopPorts) != 0 {
+		t.Errorf("unexpected classification %+v", tc)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"classify_traffic=true\n", "tx_packets_icmp=2\n", "tx_packets_tcp=0\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("%q missing from IpcGet:\n%s", line, cfg)
+		}
+	}
+}
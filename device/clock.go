@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// A Clock schedules the DAITA padding of a device. Devices use the system
+// clock unless created with WithClock, which lets tests replace it with a
+// simulated one and verify the timing of padding deterministically.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine, or any goroutine not holding
+	// locks of the device, once d has elapsed.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A ClockTimer is a function scheduled by a Clock. Stop reports whether it
+// prevented the function from being called, as time.Timer.Stop does.
+type ClockTimer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+// A responder drops initiations whose timestamp is not newer than the newest
+// one it accepted from the initiator. Once the wall clock of the initiator
+// steps back, for example when it is corrected after waking from sleep, its
+// initiations are silently dropped until the clock catches up again, which
+// looks like any other unresponsive peer. peerClockSkew detects this, and
+// sends a NotificationClockSkew for every such episode.
+type peerClockSkew struct {
+	sync.Mutex
+	newestSent    tai64n.Timestamp // newest timestamp sent in an initiation
+	lastHandshake time.Time        // of the last completed handshake, with a monotonic reading
+	alerted       bool             // whether the current episode was reported
+
+	alerts atomic.Uint64
+}
+
+// wallStepBack returns how far the wall clock stepped back while the given
+// monotonic and wall clock times elapsed, beyond ClockSkewTolerance. It is zero
+// if it did not.
+func wallStepBack(monotonic, wall time.Duration) time.Duration {
+	if step := monotonic - wall; step > ClockSkewTolerance {
+		return step
+	}
+	return 0
+}
+
+// clockSkewInitiation is called with the timestamp of every initiation
+// created for the peer.
+func (peer *Peer) clockSkewInitiation(timestamp tai64n.Timestamp) {
+	s := &peer.clockSkew
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.newestSent.After(timestamp) {
+		s.newestSent = timestamp
+		return
+	}
+	peer.clockSkewAlertLocked(fmt.Sprintf("initiation timestamp %v is older than %v sent before, so the peer will drop it as a replay until the clock catches up", timestamp, s.newestSent))
+}
+
+// clockSkewRetransmit is called when an initiation got no response, with the
+// number of attempts so far.
+func (peer *Peer) clockSkewRetransmit(attempts uint32) {
+	if attempts < ClockSkewAttempts {
+		return
+	}
+	s := &peer.clockSkew
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lastHandshake.IsZero() {
+		return
+	}
+	now := time.Now()
+	if step := wallStepBack(now.Sub(s.lastHandshake), now.Round(0).Sub(s.lastHandshake.Round(0))); step != 0 {
+		peer.clockSkewAlertLocked(fmt.Sprintf("no response to %d initiations since the clock stepped back by %v after the last handshake, so the peer may drop them as replays", attempts, step.Round(time.Millisecond)))
+	}
+}
+
+// clockSkewHandshakeComplete ends an episode of clock skew.
+func (peer *Peer) clockSkewHandshakeComplete() {
+	s := &peer.clockSkew
+	s.Lock()
+	defer s.Unlock()
+	s.lastHandshake = time.Now()
+	s.alerted = false
+}
+
+func (peer *Peer) clockSkewAlertLocked(message string) {
+	if peer.clockSkew.alerted {
+		return
+	}
+	peer.clockSkew.alerted = true
+	peer.clockSkew.alerts.Add(1)
+	peer.device.log.Errorf("%v - Handshake may fail because of clock skew: %s", peer, message)
+	peer.device.notify(NotificationClockSkew, peer, message)
+}
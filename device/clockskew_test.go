@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+func TestWallStepBack(t *testing.T) {
+	for _, tc := range []struct {
+		monotonic, wall, want time.Duration
+	}{
+		{time.Minute, time.Minute, 0},
+		{time.Minute, time.Hour, 0}, // woke from sleep
+		{time.Minute, time.Minute - ClockSkewTolerance, 0},
+		{time.Minute, 0, time.Minute},
+		{time.Minute, -time.Hour, time.Hour + time.Minute},
+	} {
+		if got := wallStepBack(tc.monotonic, tc.wall); got != tc.want {
+			t.Errorf("wallStepBack(%v, %v) = %v, want %v", tc.monotonic, tc.wall, got, tc.want)
+		}
+	}
+}
+
+func TestClockSkewInitiation(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	alerts := make(chan Notification, 4)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationClockSkew {
+			alerts <- n
+		}
+	})()
+
+	// Pretend an initiation was sent with a timestamp minutes ahead.
+	future := tai64n.Now()
+	future[6]++
+	peer.clockSkewInitiation(future)
+	select {
+	case n := <-alerts:
+		t.Fatalf("unexpected alert: %s", n.Message)
+	default:
+	}
+
+	peer.clockSkewInitiation(tai64n.Now())
+	peer.clockSkewInitiation(tai64n.Now())
+	select {
+	case n := <-alerts:
+		if n.Peer != peer.handshake.remoteStatic || !strings.Contains(n.Message, "replay") {
+			t.Errorf("unexpected alert %+v", n)
+		}
+	default:
+		t.Fatal("no alert for an initiation older than one sent before")
+	}
+	select {
+	case <-alerts:
+		t.Fatal("alerted twice for the same episode")
+	default:
+	}
+
+	// A completed handshake ends the episode.
+	peer.timersHandshakeComplete()
+	peer.clockSkewInitiation(tai64n.Now())
+	if len(alerts) != 1 {
+		t.Errorf("got %d alerts after the handshake, want 1", len(alerts))
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "clock_skew_alerts=2\n") {
+		t.Errorf("clock_skew_alerts missing from IpcGet:\n%s", cfg)
+	}
+}
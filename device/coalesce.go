@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// coalesceMaxPackets is the most packets sent in one batch.
+	coalesceMaxPackets = 64
+
+	// coalesceMaxPacketSize is the size of the largest transport message
+	// held back to be coalesced. Larger messages are sent at once, along
+	// with the messages held back before them.
+	coalesceMaxPacketSize = 512
+)
+
+// Coalescing is an opt-in layer on the outbound path, configured per device
+// with the "coalesce_window" UAPI key or SetCoalesceWindow, that holds small
+// transport messages for at most the window so that the sequential sender of
+// a peer passes them to the bind in one system call, such as sendmmsg,
+// instead of one each. The messages are still sent as separate datagrams.
+// This cuts the system calls of relays forwarding many small packets, at the
+// cost of up to the window of added latency, which is reported as
+// tx_coalesce_delay. It has no effect with pacing, pinned source addresses or
+// IPv6 flow labels, or with binds that are not a conn.BatchBind.
+type deviceCoalescing struct {
+	window atomic.Int64 // a time.Duration, 0 if disabled
+
+	batches atomic.Uint64 // batches of more than one message sent
+	packets atomic.Uint64 // messages sent in those batches
+	delay   atomic.Int64  // total time the first message of each batch was held back
+}
+
+// SetCoalesceWindow sets how long small transport messages may be held back
+// to be sent together, up to MaxCoalesceWindow. Zero disables coalescing.
+func (device *Device) SetCoalesceWindow(window time.Duration) error {
+	if err := checkCoalesceWindow(window); err != nil {
+		return err
+	}
+	device.coalesce.window.Store(int64(window))
+	return nil
+}
+
+func checkCoalesceWindow(window time.Duration) error {
+	if window < 0 || window > MaxCoalesceWindow {
+		return fmt.Errorf("coalesce window %v out of range [0, %v]", window, MaxCoalesceWindow)
+	}
+	return nil
+}
+
+// canCoalesce returns the coalescing window if packets of the peer may be
+// coalesced, or 0.
+func (peer *Peer) canCoalesce() time.Duration {
+	window := time.Duration(peer.device.coalesce.window.Load())
+	if window == 0 || peer.pacing.Load() != nil {
+		return 0
+	}
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.batchBindLocked() == nil {
+		return 0
+	}
+	return window
+}
+
+// batchBindLocked returns the bind of the device if it can send a batch of
+// packets to the peer as sendTo would send them one by one, or nil. The
+// caller must hold the read locks of the peer and the device's net.
+func (peer *Peer) batchBindLocked() conn.BatchBind {
+	bind, ok := peer.device.net.bind.(conn.BatchBind)
+	if !ok || peer.endpoint == nil || peer.sourceAddr.IsValid() {
+		return nil
+	}
+	if _, ok := bind.(conn.FlowLabelBind); ok && peer.device.FlowLabelPolicy() != FlowLabelOff && peer.endpoint.DstIP().Is6() {
+		return nil
+	}
+	return bind
+}
+
+// coalesce appends the elements queued for the peer within window to batch,
+// which holds a small element, until a large element, or coalesceMaxPackets
+// in total. It returns false if ctx was cancelled, in which case the caller
+// must release the batch.
+func (peer *Peer) coalesce(ctx context.Context, batch []*QueueOutboundElement, window time.Duration) ([]*QueueOutboundElement, bool) {
+	device := peer.device
+	start := time.Now()
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < coalesceMaxPackets {
+		var elem *QueueOutboundElement
+		select {
+		case <-ctx.Done():
+			return batch, false
+		case <-timer.C:
+			return peer.coalesced(batch, start), true
+		case elem = <-peer.queue.outbound.c:
+		}
+		peer.queue.outbound.clock.dequeued(elem.queuedAt)
+		elem.Lock()
+		if !peer.isRunning.Load() {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			continue
+		}
+		batch = append(batch, elem)
+		if len(elem.packet) > coalesceMaxPacketSize {
+			break
+		}
+	}
+	return peer.coalesced(batch, start), true
+}
+
+func (peer *Peer) coalesced(batch []*QueueOutboundElement, start time.Time) []*QueueOutboundElement {
+	if len(batch) > 1 {
+		stats := &peer.device.coalesce
+		stats.batches.Add(1)
+		stats.packets.Add(uint64(len(batch)))
+		stats.delay.Add(int64(time.Since(start)))
+	}
+	return batch
+}
+
+// SendBuffers sends buffers to the endpoint of the peer in one batch, or one
+// by one if the bind of the device is not a conn.BatchBind.
+func (peer *Peer) SendBuffers(buffers [][]byte) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.isClosed() {
+		return nil
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.endpoint == nil {
+		return errNoEndpoint
+	}
+	if !peer.allowSend() {
+		return errSendCircuitOpen
+	}
+	err := peer.sendBuffersLocked(buffers)
+	peer.sendDone(err)
+	return err
+}
+
+// sendBuffersLocked sends buffers to the endpoint of the peer. The caller must
+// hold the read locks of the peer and the device's net.
+func (peer *Peer) sendBuffersLocked(buffers [][]byte) error {
+	bind := peer.batchBindLocked()
+	if bind == nil {
+		for _, buffer := range buffers {
+			if err := peer.sendTo(buffer, peer.endpoint, peer.sourceAddr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := bind.SendBatch(buffers, peer.endpoint); err != nil {
+		if errors.Is(err, syscall.EMSGSIZE) {
+			size := 0
+			for _, buffer := range buffers {
+				size = max(size, len(buffer))
+			}
+			peer.sendTooBig(size, peer.endpoint)
+		}
+		return err
+	}
+	for _, buffer := range buffers {
+		peer.txBytes.Add(uint64(len(buffer)))
+	}
+	peer.autoKeepaliveSent()
+	return nil
+}
+
+// ipcCoalescing serializes the coalescing configuration and counters for
+// IpcGet.
+func ipcCoalescing(sendf func(string, ...any), c *deviceCoalescing) {
+	if window := time.Duration(c.window.Load()); window != 0 {
+		sendf("coalesce_window=%s", window)
+	}
+	if batches := c.batches.Load(); batches != 0 {
+		sendf("tx_coalesced_batches=%d", batches)
+		sendf("tx_coalesced_packets=%d", c.packets.Load())
+		sendf("tx_coalesce_delay=%s", time.Duration(c.delay.Load()))
+	}
+}
@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSetCoalesceWindow(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+	for _, window := range []time.Duration{-time.Microsecond, MaxCoalesceWindow + 1} {
+		if err := dev.SetCoalesceWindow(window); err == nil {
+			t.Errorf("accepted a coalesce window of %v", window)
+		}
+	}
+	if err := dev.IpcSet(uapiCfg("coalesce_window", "1ms")); err == nil {
+		t.Error("accepted a coalesce window of 1ms")
+	}
+	if err := dev.IpcSet(uapiCfg("coalesce_window", "200us")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "coalesce_window=200µs\n") {
+		t.Errorf("coalesce_window missing from IpcGet:\n%s", cfg)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]))); err != nil {
+		t.Fatal(err)
+	}
+	// The device is down, so no sequential sender competes for the queue.
+	peer := dev.LookupPeer(pk)
+	peer.isRunning.Store(true)
+	defer peer.isRunning.Store(false)
+
+	elem := func(size int) *QueueOutboundElement {
+		elem := dev.NewOutboundElement()
+		elem.packet = elem.buffer[:size]
+		return elem
+	}
+	queue := func(sizes ...int) {
+		for _, size := range sizes {
+			peer.queue.outbound.c <- elem(size)
+		}
+	}
+	drain := func() int {
+		n := 0
+		for len(peer.queue.outbound.c) > 0 {
+			<-peer.queue.outbound.c
+			n++
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name      string
+		queued    []int
+		batch     int
+		remaining int
+	}{
+		{"nothing queued", nil, 1, 0},
+		{"small packets", []int{32, 64, 128}, 4, 0},
+		{"up to a large packet", []int{32, 1000, 32}, 3, 1},
+		{"up to the maximum", make([]int, coalesceMaxPackets+5), coalesceMaxPackets, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			queue(tc.queued...)
+			start := time.Now()
+			batch, ok := peer.coalesce(context.Background(), []*QueueOutboundElement{elem(32)}, time.Millisecond)
+			if !ok || len(batch) != tc.batch {
+				t.Errorf("got a batch of %d, %v, want %d", len(batch), ok, tc.batch)
+			}
+			if tc.remaining == 0 && time.Since(start) < time.Millisecond {
+				t.Error("batch sent before the window elapsed")
+			}
+			if n := drain(); n != tc.remaining {
+				t.Errorf("%d packets left queued, want %d", n, tc.remaining)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := peer.coalesce(ctx, []*QueueOutboundElement{elem(32)}, time.Second); ok {
+		t.Error("coalescing not cancelled")
+	}
+}
+
+// batchRecorder is a conn.BatchBind recording the size of every batch.
+type batchRecorder struct {
+	conn.Bind
+	mu      sync.Mutex
+	batches []int
+}
+
+func (b *batchRecorder) SendBatch(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	b.batches = append(b.batches, len(bufs))
+	b.mu.Unlock()
+	for _, buf := range bufs {
+		if err := b.Send(buf, ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCoalescedPing(t *testing.T) {
+	recorder := new(batchRecorder)
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			recorder.Bind = bind
+			bind = recorder
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	if err := pair[1].dev.SetCoalesceWindow(MaxCoalesceWindow); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+
+	const pings = 32
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	for i := 0; i < pings; i++ {
+		pair[1].tun.Outbound <- msg
+	}
+	for i := 0; i < pings; i++ {
+		select {
+		case <-pair[0].tun.Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ping %d did not transit", i)
+		}
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	packets := 0
+	for _, n := range recorder.batches {
+		packets += n
+	}
+	t.Logf("%d pings sent in %d batches", packets, len(recorder.batches))
+	if dev := pair[1].dev; uint64(len(recorder.batches)) != dev.coalesce.batches.Load() || uint64(packets) != dev.coalesce.packets.Load() {
+		t.Errorf("sent %d packets in %d batches, counted %d in %d", packets, len(recorder.batches), dev.coalesce.packets.Load(), dev.coalesce.batches.Load())
+	}
+}
@@ -0,0 +1,380 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Compression of inner packets is an opt-in extension that is negotiated
+// between both ends of a tunnel, and is disabled by default. It is enabled
+// with the "compression" UAPI key, set to the name of a compressor, "lz4" being
+// built in.
+//
+// WARNING: compressing packets before encryption leaks information about their
+// content through their size, as exploited by CRIME and BREACH. It should only be
+// enabled on bandwidth constrained links where that trade-off is acceptable.
+//
+// After every handshake, an end with compression enabled offers its compressor
+// in the new session:
+//
+//	0      1      2             4
+//	+------+------+-------------+-------------------
+//	| 0xfe | 0x01 | name length | compressor name ...
+//	+------+------+-------------+-------------------
+//
+// Packets are compressed in a session once both ends have offered the same
+// compressor in it. Offers are not retransmitted, so a lost offer leaves the
+// session uncompressed until the next handshake, and changing the compressor
+// takes effect in the next session. Disabling compression stops compressing
+// sent packets at once.
+//
+// A compressed packet takes the place of an IP packet inside the transport
+// message and is prefixed by a header, similar to DAITA padding:
+//
+//	0      1      2             4
+//	+------+------+-------------+---------------------
+//	| 0xfe | 0x00 | orig length | compressed packet ...
+//	+------+------+-------------+---------------------
+const (
+	// Length (in bytes) of the header of a compressed packet or offer.
+	CompressionHeaderLen = 4
+
+	// The first byte of the header, taking the place of the IP version field.
+	CompressionMarker uint8 = 0xfe
+
+	// Offset (in bytes) before the 16 bit uncompressed packet length, or
+	// compressor name length, field.
+	CompressionOffsetLength = 2
+)
+
+// Types of compression messages, in the second byte of their header.
+const (
+	compressionTypePacket uint8 = iota
+	compressionTypeOffer
+)
+
+// A Compressor compresses and decompresses individual inner packets.
+// Compressors must be safe for concurrent use.
+type Compressor interface {
+	// Compress appends the compressed form of src to dst and returns the updated slice.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decompresses src into dst, which has exactly the length of the
+	// uncompressed packet. It must fail rather than produce more than len(dst) bytes.
+	// The compressed packet in src may be followed by zero padding.
+	Decompress(dst, src []byte) (int, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	byName map[string]Compressor
+}{
+	byName: map[string]Compressor{
+		"lz4": new(lz4Compressor),
+	},
+}
+
+// RegisterCompressor makes a Compressor available to peers under name, for use with
+// the "compression" UAPI key. The "lz4" compressor is always available.
+func RegisterCompressor(name string, compressor Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	compressors.byName[name] = compressor
+}
+
+func lookupCompressor(name string) (Compressor, bool) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	compressor, ok := compressors.byName[name]
+	return compressor, ok
+}
+
+type peerCompression struct {
+	name string
+	Compressor
+}
+
+var compressionScratchPool = sync.Pool{
+	New: func() any { return new([MaxMessageSize]byte) },
+}
+
+var (
+	errDecompressedTooLarge = errors.New("decompressed packet exceeds expected length")
+	errCompressedCorrupt    = errors.New("corrupt compressed packet")
+)
+
+// offerCompression offers the compressor of the peer in its current session,
+// if it has enabled compression.
+func (peer *Peer) offerCompression() {
+	compression := peer.compression.Load()
+	if compression == nil || !peer.isRunning.Load() {
+		return
+	}
+	size := CompressionHeaderLen + len(compression.name)
+	elem := peer.device.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+	elem.packet[0] = CompressionMarker
+	elem.packet[1] = compressionTypeOffer
+	binary.BigEndian.PutUint16(elem.packet[CompressionOffsetLength:], uint16(len(compression.name)))
+	copy(elem.packet[CompressionHeaderLen:], compression.name)
+	elem.queuedAt = queueNow()
+	peer.StagePacket(elem)
+	peer.device.log.Verbosef("%v - Offering compression: %s", peer, compression.name)
+	peer.SendStagedPackets()
+}
+
+// receivedCompressionOffer enables compression in the session of keypair if
+// the peer offered the compressor it is configured with.
+func (peer *Peer) receivedCompressionOffer(keypair *Keypair, packet []byte) {
+	compression := peer.compression.Load()
+	if compression == nil || len(packet) < CompressionHeaderLen {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(packet[CompressionOffsetLength:]))
+	if length > len(packet)-CompressionHeaderLen {
+		return
+	}
+	name := string(packet[CompressionHeaderLen : CompressionHeaderLen+length])
+	if name != compression.name {
+		peer.device.log.Verbosef("%v - Ignoring offer of unconfigured compression: %q", peer, name)
+		return
+	}
+	if keypair.compression.CompareAndSwap(nil, compression) {
+		peer.device.log.Verbosef("%v - Negotiated compression: %s", peer, name)
+	}
+}
+
+// compressPacket replaces the IP packet in elem with its compressed form,
+// if compressing it makes it smaller.
+func (peer *Peer) compressPacket(elem *QueueOutboundElement, compression *peerCompression) {
+	if len(elem.packet) == 0 {
+		return
+	}
+	if version := elem.packet[0] >> 4; version != ipv4.Version && version != ipv6.Version {
+		return
+	}
+
+	scratch := compressionScratchPool.Get().(*[MaxMessageSize]byte)
+	defer compressionScratchPool.Put(scratch)
+
+	compressed, err := compression.Compress(scratch[:0], elem.packet)
+	if err != nil {
+		peer.device.log.Verbosef("%v - Failed to compress packet: %v", peer, err)
+		return
+	}
+	if CompressionHeaderLen+len(compressed) >= len(elem.packet) {
+		return
+	}
+
+	offset := MessageTransportHeaderSize
+	header := elem.buffer[offset : offset+CompressionHeaderLen]
+	header[0] = CompressionMarker
+	header[1] = compressionTypePacket
+	binary.BigEndian.PutUint16(header[CompressionOffsetLength:], uint16(len(elem.packet)))
+	n := copy(elem.buffer[offset+CompressionHeaderLen:], compressed)
+	elem.packet = elem.buffer[offset : offset+CompressionHeaderLen+n]
+}
+
+// decompressPacket replaces the compressed packet in elem with the IP packet it contains.
+// It reports whether the packet was successfully decompressed.
+func (peer *Peer) decompressPacket(elem *QueueInboundElement, compression *peerCompression) bool {
+	if len(elem.packet) < CompressionHeaderLen || elem.packet[1] != compressionTypePacket {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(elem.packet[CompressionOffsetLength:]))
+	if length == 0 || length > MaxContentSize {
+		return false
+	}
+
+	scratch := compressionScratchPool.Get().(*[MaxMessageSize]byte)
+	defer compressionScratchPool.Put(scratch)
+
+	n, err := compression.Decompress(scratch[:length], elem.packet[CompressionHeaderLen:])
+	if err != nil || n != length {
+		peer.device.log.Verbosef("%v - Failed to decompress packet: %v", peer, err)
+		return false
+	}
+
+	offset := MessageTransportOffsetContent
+	copy(elem.buffer[offset:], scratch[:n])
+	elem.packet = elem.buffer[offset : offset+n]
+	return true
+}
+
+const (
+	lz4MinMatch     = 4
+	lz4MatchLimit   = 12 // the last match starts at least this far from the end
+	lz4LastLiterals = 5  // the last bytes are always literals
+	lz4MaxOffset    = 1<<16 - 1
+	lz4HashLog      = 12
+)
+
+// lz4Compressor is a Compressor producing LZ4 blocks, without the framing of
+// the LZ4 frame format, using a single hash table probe per position.
+type lz4Compressor struct {
+	tables sync.Pool
+}
+
+func lz4Hash(sequence uint32) uint32 {
+	return sequence * 2654435761 >> (32 - lz4HashLog)
+}
+
+func (c *lz4Compressor) Compress(dst, src []byte) ([]byte, error) {
+	table, _ := c.tables.Get().(*[1 << lz4HashLog]int32)
+	if table == nil {
+		table = new([1 << lz4HashLog]int32)
+	} else {
+		clear(table[:])
+	}
+	defer c.tables.Put(table)
+
+	// The table holds the position of a sequence plus one, so that zero is empty.
+	anchor := 0
+	for i := 0; i <= len(src)-lz4MatchLimit; {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(sequence)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > lz4MaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != sequence {
+			i++
+			continue
+		}
+		end := i + lz4MinMatch
+		for end < len(src)-lz4LastLiterals && src[end] == src[candidate+end-i] {
+			end++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-candidate, end-i)
+		i, anchor = end, end
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0), nil
+}
+
+// lz4AppendSequence appends literals followed by a match of length matchLength
+// at offset to dst. The last sequence of a block has no match.
+func lz4AppendSequence(dst, literals []byte, offset, matchLength int) []byte {
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	extra := matchLength - lz4MinMatch
+	if matchLength != 0 {
+		if extra >= 15 {
+			token |= 15
+		} else {
+			token |= byte(extra)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLength == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if extra >= 15 {
+		dst = lz4AppendLength(dst, extra-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4ReadLength reads the extra bytes of a length from src at *s. Lengths
+// longer than limit are rejected before they are summed up.
+func lz4ReadLength(src []byte, s *int, limit int) (int, error) {
+	n := 0
+	for {
+		if *s >= len(src) {
+			return 0, errCompressedCorrupt
+		}
+		b := src[*s]
+		*s++
+		n += int(b)
+		if n > limit {
+			return 0, errDecompressedTooLarge
+		}
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
+
+func (c *lz4Compressor) Decompress(dst, src []byte) (int, error) {
+	d, s := 0, 0
+	for {
+		if s >= len(src) {
+			return d, errCompressedCorrupt
+		}
+		token := src[s]
+		s++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, err := lz4ReadLength(src, &s, len(dst))
+			if err != nil {
+				return d, err
+			}
+			literals += n
+		}
+		if literals > len(dst)-d {
+			return d, errDecompressedTooLarge
+		}
+		if literals > len(src)-s {
+			return d, errCompressedCorrupt
+		}
+		d += copy(dst[d:], src[s:s+literals])
+		s += literals
+		if s == len(src) || d == len(dst) {
+			// The last sequence has no match, and may be followed by padding.
+			return d, nil
+		}
+
+		if len(src)-s < 2 {
+			return d, errCompressedCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[s:]))
+		s += 2
+		if offset == 0 || offset > d {
+			return d, errCompressedCorrupt
+		}
+		length := int(token & 15)
+		if length == 15 {
+			n, err := lz4ReadLength(src, &s, len(dst))
+			if err != nil {
+				return d, err
+			}
+			length += n
+		}
+		length += lz4MinMatch
+		if length > len(dst)-d {
+			return d, errDecompressedTooLarge
+		}
+		if offset >= length {
+			d += copy(dst[d:d+length], dst[d-offset:])
+		} else {
+			// The match overlaps the bytes it produces.
+			for i := 0; i < length; i++ {
+				dst[d+i] = dst[d-offset+i]
+			}
+			d += length
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestLZ4CompressorRoundTrip(t *testing.T) {
+	var c lz4Compressor
+	random := make([]byte, 1500)
+	rand.Read(random)
+	packets := [][]byte{
+		{0x45},
+		bytes.Repeat([]byte{0x45}, 12),
+		bytes.Repeat([]byte{0x45}, 13),
+		bytes.Repeat([]byte{0x45, 0x00, 0x01, 0x02}, 256),
+		bytes.Repeat([]byte{0x60, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, 300),
+		append(bytes.Repeat([]byte{0x45}, 300), random[:300]...),
+		random,
+	}
+	for i, packet := range packets {
+		compressed, err := c.Compress(nil, packet)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		out := make([]byte, len(packet))
+		n, err := c.Decompress(out, compressed)
+		if err != nil || !bytes.Equal(out[:n], packet) {
+			t.Fatalf("packet %d: round trip failed: %v", i, err)
+		}
+		padded := append(compressed, make([]byte, PaddingMultiple)...)
+		if n, err := c.Decompress(out, padded); err != nil || !bytes.Equal(out[:n], packet) {
+			t.Fatalf("packet %d: round trip with padding failed: %v", i, err)
+		}
+	}
+}
+
+func TestLZ4CompressorBounds(t *testing.T) {
+	var c lz4Compressor
+	packet := bytes.Repeat([]byte{0x45, 0x00, 0x01, 0x02}, 256)
+
+	compressed, err := c.Compress(nil, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(packet) {
+		t.Fatalf("expected compressed packet to be smaller than %d bytes, got %d", len(packet), len(compressed))
+	}
+
+	out := make([]byte, len(packet))
+	if _, err := c.Decompress(out[:len(packet)-1], compressed); err == nil {
+		t.Fatal("expected decompressing into a too small buffer to fail")
+	}
+	if _, err := c.Decompress(make([]byte, len(packet)+1), compressed[:len(compressed)-1]); err == nil {
+		t.Fatal("expected decompressing a truncated packet to fail")
+	}
+	// A match reaching back before the start of the output.
+	if _, err := c.Decompress(out, []byte{0x10, 0x45, 0x02, 0x00, 0x00}); err == nil {
+		t.Fatal("expected decompressing an out of bounds match to fail")
+	}
+	// A literal length far beyond the output, encoded in many bytes.
+	huge := append([]byte{0xf0}, bytes.Repeat([]byte{255}, 1000)...)
+	if _, err := c.Decompress(out, append(huge, 0)); err != errDecompressedTooLarge {
+		t.Fatalf("expected decompressing an oversized literal run to fail, got %v", err)
+	}
+}
+
+// waitCompressionNegotiated waits until the current session of each peer of
+// the pair has negotiated compression, or reports whether it has after timeout.
+func waitCompressionNegotiated(pair testPair, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		negotiated := true
+		for i := range pair {
+			for _, peer := range pair[i].dev.peers.keyMap {
+				keypair := peer.keypairs.Current()
+				negotiated = negotiated && keypair != nil && keypair.compression.Load() != nil
+			}
+		}
+		if negotiated || time.Now().After(deadline) {
+			return negotiated
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func setCompression(t *testing.T, d *Device, value string) {
+	for key := range d.peers.keyMap {
+		cfg := uapiCfg(
+			"public_key", hex.EncodeToString(key[:]),
+			"compression", value,
+		)
+		if err := d.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	pair := genTestPair(t, true)
+	setCompression(t, pair[1].dev, "lz4")
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	if waitCompressionNegotiated(pair, 200*time.Millisecond) {
+		t.Fatal("expected compression not to be negotiated with one end enabling it")
+	}
+
+	msg := append(tuntest.Ping(pair[0].ip, pair[1].ip), make([]byte, 1000)...)
+	binary.BigEndian.PutUint16(msg[IPv4offsetTotalLength:], uint16(len(msg)))
+	pair[1].tun.Outbound <- msg
+	select {
+	case msgRecv := <-pair[0].tun.Inbound:
+		if !bytes.Equal(msg, msgRecv) {
+			t.Fatal("uncompressed packet did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("uncompressed packet did not transit")
+	}
+}
+
+func TestCompressionTransit(t *testing.T) {
+	pair := genTestPair(t, true)
+	for i := range pair {
+		setCompression(t, pair[i].dev, "lz4")
+	}
+	pair.Send(t, Ping, nil)
+	if !waitCompressionNegotiated(pair, 5*time.Second) {
+		t.Fatal("compression was not negotiated")
+	}
+
+	var sender *Peer
+	for _, peer := range pair[1].dev.peers.keyMap {
+		sender = peer
+	}
+	txBefore := sender.txBytes.Load()
+
+	msg := append(tuntest.Ping(pair[0].ip, pair[1].ip), make([]byte, 1000)...)
+	binary.BigEndian.PutUint16(msg[IPv4offsetTotalLength:], uint16(len(msg)))
+	pair[1].tun.Outbound <- msg
+
+	select {
+	case msgRecv := <-pair[0].tun.Inbound:
+		if !bytes.Equal(msg, msgRecv) {
+			t.Fatal("compressed packet did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("compressed packet did not transit")
+	}
+
+	if sent := sender.txBytes.Load() - txBefore; sent >= uint64(len(msg)) {
+		t.Fatalf("expected less than %d bytes on the wire, got %d", len(msg), sent)
+	}
+}
@@ -0,0 +1,270 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ConnectivityResult describes the outcome of VerifyConnectivity.
+type ConnectivityResult struct {
+	HandshakeOK   bool          // a session with the peer is established
+	LastHandshake time.Time     // time of the most recent completed handshake
+	TrafficOK     bool          // an echo reply came back through the tunnel
+	RTT           time.Duration // round-trip time of the echo, if TrafficOK
+}
+
+const (
+	connectivityPollInterval = 20 * time.Millisecond
+	connectivityProbeTTL     = 64
+
+	icmpv4ProtocolNumber = 1
+	icmpv6ProtocolNumber = 58
+)
+
+// connectivityPinger is implemented by TUN devices backed by a userspace
+// network stack, such as netstack, which send echo requests and receive their
+// replies themselves.
+type connectivityPinger interface {
+	Ping(ctx context.Context, source, target netip.Addr) error
+}
+
+// connectivityProbes tracks the echo requests sent by VerifyConnectivity, so
+// that their replies can be taken out of the receive path instead of being
+// written to the TUN device.
+type connectivityProbes struct {
+	sync.Mutex
+	pending atomic.Int32 // number of waiters, checked on the receive path without the lock
+	nextID  uint16
+	waiters map[uint16]connectivityProbe
+	random  *seededRand // source of the identifiers, nil for the global one
+}
+
+// connectivityProbe is an echo request awaiting its reply.
+type connectivityProbe struct {
+	target netip.Addr // the reply must come from the address the request was sent to
+	seq    uint16
+	done   chan struct{}
+}
+
+func (probes *connectivityProbes) register(target netip.Addr) (uint16, connectivityProbe) {
+	probes.Lock()
+	defer probes.Unlock()
+	if probes.waiters == nil {
+		probes.waiters = make(map[uint16]connectivityProbe)
+		probes.nextID = uint16(probes.random.Uint32())
+	}
+	for {
+		probes.nextID++
+		if _, ok := probes.waiters[probes.nextID]; !ok {
+			break
+		}
+	}
+	probe := connectivityProbe{
+		target: target,
+		seq:    uint16(probes.random.Uint32()),
+		done:   make(chan struct{}),
+	}
+	probes.waiters[probes.nextID] = probe
+	probes.pending.Add(1)
+	return probes.nextID, probe
+}
+
+func (probes *connectivityProbes) unregister(id uint16) {
+	probes.Lock()
+	defer probes.Unlock()
+	if _, ok := probes.waiters[id]; ok {
+		delete(probes.waiters, id)
+		probes.pending.Add(-1)
+	}
+}
+
+// complete reports whether packet is the echo reply to a pending probe, that
+// is, it comes from the probe's target and carries its identifier and
+// sequence number, and wakes up its waiter if so.
+func (probes *connectivityProbes) complete(packet []byte) bool {
+	var icmpMsg []byte
+	var replyType byte
+	var source netip.Addr
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		headerLen := int(packet[0]&0x0f) * 4
+		if packet[9] != icmpv4ProtocolNumber || len(packet) < headerLen+8 {
+			return false
+		}
+		icmpMsg = packet[headerLen:]
+		replyType = byte(ipv4.ICMPTypeEchoReply)
+		source = netip.AddrFrom4([4]byte(packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]))
+	case ipv6.Version:
+		if packet[6] != icmpv6ProtocolNumber || len(packet) < ipv6.HeaderLen+8 {
+			return false
+		}
+		icmpMsg = packet[ipv6.HeaderLen:]
+		replyType = byte(ipv6.ICMPTypeEchoReply)
+		source = netip.AddrFrom16([16]byte(packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]))
+	default:
+		return false
+	}
+	if icmpMsg[0] != replyType || icmpMsg[1] != 0 {
+		return false
+	}
+	id := binary.BigEndian.Uint16(icmpMsg[4:6])
+	seq := binary.BigEndian.Uint16(icmpMsg[6:8])
+
+	probes.Lock()
+	defer probes.Unlock()
+	probe, ok := probes.waiters[id]
+	if !ok || probe.seq != seq || probe.target != source {
+		return false
+	}
+	delete(probes.waiters, id)
+	probes.pending.Add(-1)
+	close(probe.done)
+	return true
+}
+
+// VerifyConnectivity checks that traffic flows to and from peer. A handshake
+// is initiated if there is no fresh session, and if target is valid, an ICMP
+// echo request from source to target is sent through the tunnel. If the TUN
+// device is a userspace network stack, such as netstack, the echo is sent
+// through that stack. Otherwise, with an OS TUN, it is handed to the peer
+// directly, and the reply is consumed by the device and never reaches the TUN
+// device. source must be the tunnel address the peer routes back to this
+// device, and target must be within the peer's allowed IPs.
+//
+// If ctx expires before a stage completes, the partial result is returned
+// together with the context's error.
+func (device *Device) VerifyConnectivity(ctx context.Context, peer *Peer, source, target netip.Addr) (ConnectivityResult, error) {
+	var result ConnectivityResult
+	if !peer.isRunning.Load() {
+		return result, errors.New("peer is not running")
+	}
+	if target.IsValid() && (!source.IsValid() || source.Is4() != target.Is4()) {
+		return result, fmt.Errorf("source %v and target %v must be addresses of the same family", source, target)
+	}
+
+	keypair := peer.keypairs.Current()
+	if keypair == nil || time.Since(keypair.created) >= RekeyAfterTime {
+		previous := peer.lastHandshakeNano.Load()
+		peer.SendHandshakeInitiation(false)
+		ticker := time.NewTicker(connectivityPollInterval)
+		defer ticker.Stop()
+		for peer.lastHandshakeNano.Load() == previous {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+	result.HandshakeOK = true
+	result.LastHandshake = time.Unix(0, peer.lastHandshakeNano.Load())
+
+	if !target.IsValid() {
+		return result, nil
+	}
+
+	tunDevice, _ := device.currentTUN()
+	if pinger, ok := tunDevice.(connectivityPinger); ok {
+		start := time.Now()
+		if err := pinger.Ping(ctx, source, target); err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			return result, err
+		}
+		result.TrafficOK = true
+		result.RTT = time.Since(start)
+		return result, nil
+	}
+
+	id, probe := device.probes.register(target)
+	defer device.probes.unregister(id)
+
+	elem := device.NewOutboundElement()
+	packet, err := connectivityEchoRequest(source, target, id, probe.seq)
+	if err != nil {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return result, err
+	}
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(packet)]
+	copy(elem.packet, packet)
+
+	start := time.Now()
+	peer.StagePacket(elem)
+	peer.SendStagedPackets()
+
+	select {
+	case <-ctx.Done():
+		return result, ctx.Err()
+	case <-probe.done:
+	}
+	result.TrafficOK = true
+	result.RTT = time.Since(start)
+	return result, nil
+}
+
+// connectivityEchoRequest builds an IP packet holding an ICMP or ICMPv6 echo
+// request with the given identifier and sequence number.
+func connectivityEchoRequest(source, target netip.Addr, id, seq uint16) ([]byte, error) {
+	echo := &icmp.Echo{ID: int(id), Seq: int(seq), Data: []byte("wireguard-go connectivity check")}
+
+	if target.Is4() {
+		msg, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: echo}).Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		packet := make([]byte, ipv4.HeaderLen+len(msg))
+		packet[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+		binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+		packet[8] = connectivityProbeTTL
+		packet[9] = icmpv4ProtocolNumber
+		copy(packet[IPv4offsetSrc:], source.AsSlice())
+		copy(packet[IPv4offsetDst:], target.AsSlice())
+		binary.BigEndian.PutUint16(packet[10:], ipv4HeaderChecksum(packet[:ipv4.HeaderLen]))
+		copy(packet[ipv4.HeaderLen:], msg)
+		return packet, nil
+	}
+
+	pseudoHeader := icmp.IPv6PseudoHeader(net.IP(source.AsSlice()), net.IP(target.AsSlice()))
+	msg, err := (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Body: echo}).Marshal(pseudoHeader)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, ipv6.HeaderLen+len(msg))
+	packet[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(len(msg)))
+	packet[6] = icmpv6ProtocolNumber
+	packet[7] = connectivityProbeTTL
+	copy(packet[IPv6offsetSrc:], source.AsSlice())
+	copy(packet[IPv6offsetDst:], target.AsSlice())
+	copy(packet[ipv6.HeaderLen:], msg)
+	return packet, nil
+}
+
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func TestVerifyConnectivity(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[1].dev
+
+	var peer *Peer
+	dev.peers.RLock()
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	dev.peers.RUnlock()
+
+	// Answer echo requests arriving at the other end of the tunnel.
+	go func() {
+		for packet := range pair[0].tun.Inbound {
+			msg, err := icmp.ParseMessage(icmpv4ProtocolNumber, packet[ipv4.HeaderLen:])
+			if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+				continue
+			}
+			msg.Type = ipv4.ICMPTypeEchoReply
+			body, err := msg.Marshal(nil)
+			if err != nil {
+				continue
+			}
+			reply := append([]byte(nil), packet[:ipv4.HeaderLen]...)
+			copy(reply[IPv4offsetSrc:], packet[IPv4offsetDst:IPv4offsetDst+4])
+			copy(reply[IPv4offsetDst:], packet[IPv4offsetSrc:IPv4offsetSrc+4])
+			binary.BigEndian.PutUint16(reply[10:], 0)
+			binary.BigEndian.PutUint16(reply[10:], ipv4HeaderChecksum(reply))
+			pair[0].tun.Outbound <- append(reply, body...)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := dev.VerifyConnectivity(ctx, peer, pair[1].ip, pair[0].ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.HandshakeOK || result.LastHandshake.IsZero() {
+		t.Errorf("handshake not reported: %+v", result)
+	}
+	if !result.TrafficOK || result.RTT <= 0 {
+		t.Errorf("echo reply not reported: %+v", result)
+	}
+	select {
+	case packet := <-pair[1].tun.Inbound:
+		t.Errorf("echo reply leaked to the TUN device: %x", packet)
+	default:
+	}
+}
+
+func TestConnectivityProbeReplyMatching(t *testing.T) {
+	var probes connectivityProbes
+	local := netip.AddrFrom4([4]byte{10, 0, 0, 1})
+	target := netip.AddrFrom4([4]byte{10, 0, 0, 2})
+	id, probe := probes.register(target)
+	defer probes.unregister(id)
+
+	reply := func(source netip.Addr, seq uint16) []byte {
+		packet, err := connectivityEchoRequest(source, local, id, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet[ipv4.HeaderLen] = byte(ipv4.ICMPTypeEchoReply)
+		return packet
+	}
+	if probes.complete(reply(netip.AddrFrom4([4]byte{10, 0, 0, 3}), probe.seq)) {
+		t.Error("matched a reply from another address")
+	}
+	if probes.complete(reply(target, probe.seq+1)) {
+		t.Error("matched a reply with another sequence number")
+	}
+	if !probes.complete(reply(target, probe.seq)) {
+		t.Fatal("did not match the reply to the probe")
+	}
+	select {
+	case <-probe.done:
+	default:
+		t.Error("probe not completed")
+	}
+}
+
+// pingerTUN is a TUN device with its own network stack answering pings.
+type pingerTUN struct {
+	tun.Device
+	pinged chan [2]netip.Addr
+}
+
+func (tun *pingerTUN) Ping(ctx context.Context, source, target netip.Addr) error {
+	tun.pinged <- [2]netip.Addr{source, target}
+	return nil
+}
+
+func TestVerifyConnectivityPinger(t *testing.T) {
+	pinger := &pingerTUN{pinged: make(chan [2]netip.Addr, 1)}
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			pinger.Device = tun
+			return NewDevice(pinger, bind, logger)
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := dev.VerifyConnectivity(ctx, peer, pair[1].ip, pair[0].ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TrafficOK {
+		t.Errorf("echo reply not reported: %+v", result)
+	}
+	if pinged := <-pinger.pinged; pinged != [2]netip.Addr{pair[1].ip, pair[0].ip} {
+		t.Errorf("expected a ping from %v to %v through the TUN device, got %v", pair[1].ip, pair[0].ip, pinged)
+	}
+}
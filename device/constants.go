@@ -35,6 +35,51 @@ const (
 /* Implementation constants */
 
 const (
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadAfterTime = time.Second            // how long does the device remain under load after detected
+	MaxPeers           = 1 << 16                // maximum number of configured peers
+	nonIPSampleBytes   = 16                     // leading bytes logged of sampled non-IP frames
+	MaxPacingSpacing   = time.Second            // longest spacing between packets when pacing
+	MaxCoalesceWindow  = 500 * time.Microsecond // longest time small packets are held back to be sent together
+
+	handshakeFailureRingSize = 32 // recent handshake failures kept for diagnostics
+
+	ClockSkewAttempts  = 3           // unanswered initiations before suspecting clock skew
+	ClockSkewTolerance = time.Second // wall clock steps back tolerated before suspecting clock skew
+
+	MTUProbeWait    = 200 * time.Millisecond // time given to routers to report a path MTU probe as too big
+	MTUProbeTimeout = 5 * time.Second        // longest probing of the path MTU to one endpoint
+
+	RTTIdleGap   = time.Second  // quiet time after which sending data starts a round-trip sample
+	RTTMaxSample = RekeyTimeout // longest round-trip sample, beyond which no answer is assumed
+	RTTSmoothing = 8            // weight of the estimate against a new round-trip sample
+)
+
+/* Handling of TUN devices failing to accept packets */
+
+const (
+	TUNWriteFailureThreshold = 64                    // consecutive failed writes making a failure persistent
+	TUNWriteRetryMinBackoff  = time.Millisecond * 10 // first wait before retrying a failed write
+	TUNWriteRetryMaxBackoff  = time.Second * 5       // longest wait between retries of a failed write
+)
+
+const (
+	SendFailureThreshold = 16                     // consecutive persistent send failures suspending sending to a peer
+	SendProbeMinBackoff  = time.Millisecond * 100 // first wait before probing whether sending recovered
+	SendProbeMaxBackoff  = time.Second * 5        // longest wait between probes
+)
+
+/* Detection of suspends of the system, see Device.NotifyResume */
+
+const (
+	SuspendCheckInterval = time.Second * 10 // interval between comparisons of the clocks while the device is up
+	SuspendThreshold     = time.Second * 30 // lead of the wall clock over the monotonic clock taken as a suspend
+)
+
+/* Limits of UAPI input, protecting against misbehaving clients */
+
+const (
+	MaxIpcLineSize   = 64 << 10 // longest key=value line
+	MaxIpcSetSize    = 32 << 20 // largest configuration of a set operation
+	MaxIpcSetPeers   = MaxPeers // most public_key lines in a set operation
+	maxIpcOpLineSize = 4096     // longest operation line, such as "set=1"
 )
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// With a constant packet size, every transport message sent to a peer, be it
+// data, a keepalive or DAITA padding, is padded to the MTU of the device, so
+// that its size reveals nothing of its contents. It is set with the
+// "constant_packet_size" UAPI key, and needs FeatureConstantPacketSize.
+
+// ConstantPacketSize reports whether the packets sent to the peer are padded
+// to the MTU.
+func (peer *Peer) ConstantPacketSize() bool {
+	return peer.constantPacketSize.Load()
+}
+
+// SetConstantPacketSize sets whether the packets sent to the peer are padded
+// to the MTU, from the next packet on. Enabling it fails if the feature is
+// disabled for the device.
+func (peer *Peer) SetConstantPacketSize(enabled bool) error {
+	if enabled {
+		if err := peer.device.requireFeature(FeatureConstantPacketSize); err != nil {
+			return err
+		}
+	}
+	if peer.constantPacketSize.Swap(enabled) == enabled {
+		return nil
+	}
+	if enabled {
+		peer.device.log.Verbosef("%v - Padding packets to the MTU", peer)
+	} else {
+		peer.device.log.Verbosef("%v - No longer padding packets to the MTU", peer)
+	}
+	return nil
+}
+
+// padToConstantSize extends the packet of elem to the MTU, with zeros, if
+// the peer has a constant packet size.
+func (peer *Peer) padToConstantSize(elem *QueueOutboundElement) {
+	if !peer.constantPacketSize.Load() {
+		return
+	}
+	mtu := int(peer.device.tun.mtu.Load())
+	size := len(elem.packet)
+	offset := MessageTransportHeaderSize
+	// size should not and cannot be larger than mtu as far as we can tell, but for safety we check
+	if mtu > size {
+		// Here, we extend the packet to always be MTU sized as an obfuscation.
+		if offset+mtu < len(elem.buffer) {
+			elem.packet = elem.buffer[offset : offset+mtu]
+		} else {
+			elem.packet = elem.buffer[offset:]
+		}
+
+		// To avoid sending data from the previous packet, we need to clear the extra buffer content that we add.
+		clear(elem.packet[size:])
+	}
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// sizeBind records the size of every transport message sent through it.
+type sizeBind struct {
+	conn.Bind
+	sync.Mutex
+	sizes []int
+}
+
+func (bind *sizeBind) Send(b []byte, ep conn.Endpoint) error {
+	if binary.LittleEndian.Uint32(b) == MessageTransportType {
+		bind.Lock()
+		bind.sizes = append(bind.sizes, len(b))
+		bind.Unlock()
+	}
+	return bind.Bind.Send(b, ep)
+}
+
+func (bind *sizeBind) sent() []int {
+	bind.Lock()
+	defer bind.Unlock()
+	return append([]int(nil), bind.sizes...)
+}
+
+func TestConstantPacketSize(t *testing.T) {
+	var wire *sizeBind
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			wire = &sizeBind{Bind: bind}
+			bind = wire
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	dev := pair[1].dev
+	remote := pair[0].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(remote)
+	mtu := int(dev.tun.mtu.Load())
+
+	// Data and keepalives are padded to the MTU.
+	if err := peer.SetConstantPacketSize(true); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	peer.SendKeepalive()
+	pair.Send(t, Ping, nil)
+	sizes := wire.sent()
+	if len(sizes) < 3 {
+		t.Fatalf("expected at least 3 transport messages, got %d", len(sizes))
+	}
+	for i, size := range sizes {
+		if want := MessageTransportSize + mtu; size != want {
+			t.Errorf("transport message %d is %d bytes, want %d", i, size, want)
+		}
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "constant_packet_size=true\n") {
+		t.Errorf("constant_packet_size missing from IpcGet:\n%s", cfg)
+	}
+
+	// Disabling it through UAPI takes effect from the next packet.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"constant_packet_size", "false",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if peer.ConstantPacketSize() {
+		t.Fatal("constant packet size still enabled")
+	}
+	sent := len(wire.sent())
+	pair.Send(t, Ping, nil)
+	if sizes := wire.sent()[sent:]; len(sizes) == 0 || sizes[0] >= MessageTransportSize+mtu {
+		t.Errorf("transport messages of %v bytes sent after disabling constant packet size", sizes)
+	}
+
+	// Enabling it needs the feature, unlike disabling it.
+	dev.SetFeatures(AllFeatures &^ FeatureConstantPacketSize)
+	if peer.SetConstantPacketSize(true) == nil {
+		t.Error("enabled constant packet size with the feature disabled")
+	}
+	if err := peer.SetConstantPacketSize(false); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,30 +4,93 @@
 package device
 
 import (
-	"encoding/binary"
-	"sync"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-// #include <stdio.h>
-// #include <stdlib.h>
-// #include "../maybenot/crates/maybenot-ffi/maybenot.h"
-// #cgo LDFLAGS: -L${SRCDIR}/../ -lmaybenot -lm
-import "C"
-
 type MaybenotDaita struct {
-	events          chan Event
-	eventsClosed    bool
-	eventsCloseLock sync.RWMutex
-	actions         chan Action
-	maybenot        *C.MaybenotFramework
-	newActionsBuf   []C.MaybenotAction
-	paddingQueue    map[uint64]*time.Timer // Map from machine to queued padding packets
-	logger          *Logger
-	stopping        sync.WaitGroup // waitgroup for handleEvents and HandleDaitaActions
+	ctx           context.Context // derived from the context of the peer, cancelled by Close
+	cancel        context.CancelFunc
+	events        chan Event
+	eventsClock   queueClock
+	actions       chan Action
+	frameworks    []daitaFramework
+	queue         *daitaQueue          // queued padding, blocking and internal timers of the machines
+	counters      map[uint64][2]uint64 // Map from machine to its counters
+	machineLabels []string             // Human-readable machine labels, indexed by machine ID
+	logger        *Logger
+	eventsHandled chan struct{} // closed when handleEvents has returned
+	queueHandled  chan struct{} // closed when the queue has stopped running
+	stats         daitaStats
+	memory        *daitaMemory
+	reserved      atomic.Uint64 // bytes of memory reserved, released by Close
+}
+
+// daitaStats are the counters behind DaitaStats.
+type daitaStats struct {
+	txPaddingPackets atomic.Uint64
+	txPaddingBytes   atomic.Uint64
+	rxPaddingPackets atomic.Uint64
+	rxPaddingBytes   atomic.Uint64
+	blocked          atomic.Int64 // nanoseconds of blocking that ended
+	blockedSince     atomic.Int64 // Unix nanoseconds the ongoing blocking began at, 0 if none
+	droppedEvents    atomic.Uint64
+	actions          atomic.Uint64
+	clock            Clock
+}
+
+// A daitaFramework runs a set of machines, which are numbered from
+// firstMachine within the peer, on the events of its directions.
+type daitaFramework struct {
+	runtime      maybenotRuntime
+	firstMachine uint64
+	numMachines  uint64
+	directions   daitaDirection
+	budgets      DaitaMachines // the budgets of the runtime, without its machines
 }
 
+// A maybenotRuntime runs a set of maybenot machines, numbered from 0, turning
+// the events it is fed into actions of the machines. It is either the maybenot
+// FFI, linked in with cgo, or the pure-Go runtime, built with the maybenot_go
+// tag or without cgo.
+type maybenotRuntime interface {
+	onEvent(event Event) ([]Action, error)
+	stop()
+}
+
+// A daitaDirection is a set of directions of traffic whose events a
+// daitaFramework sees.
+type daitaDirection uint8
+
+const (
+	daitaSent daitaDirection = 1 << iota
+	daitaReceived
+)
+
+func (event EventType) direction() daitaDirection {
+	switch event {
+	case NonpaddingSent, PaddingSent, BlockingBegin, BlockingEnd:
+		return daitaSent
+	}
+	return daitaReceived
+}
+
+// ofMachine reports whether the event is only seen by the machine it is about.
+func (event EventType) ofMachine() bool {
+	return event == PaddingSent || event == TimerBegin || event == TimerEnd || event == CounterZero
+}
+
+// noDaitaMachine is the machine of a BlockingBegin event passed to a
+// framework that does not run the machine that began the blocking.
+const noDaitaMachine = math.MaxUint64
+
 type Event struct {
 	// The machine that generated the action that generated this event, if any.
 	Machine uint64
@@ -35,6 +98,11 @@ type Event struct {
 	Peer      NoisePublicKey
 	EventType EventType
 	XmitBytes uint16
+	// When the kernel received the packet of a received event, or the zero
+	// time if unknown.
+	ReceivedAt time.Time
+
+	queuedAt int64 // see queueClock
 }
 
 type ActionType uint32
@@ -43,6 +111,40 @@ const (
 	ActionTypeCancel ActionType = iota
 	ActionTypeInjectPadding
 	ActionTypeBlockOutgoing
+
+	// ActionTypeUpdateTimer (re)starts the internal timer of the machine,
+	// which is reported with a TimerBegin event, and expires with a TimerEnd
+	// event.
+	ActionTypeUpdateTimer
+
+	// ActionTypeUpdateCounter updates a counter of the machine, which is
+	// reported with a CounterZero event when it drops to zero.
+	ActionTypeUpdateCounter
+)
+
+func (actionType ActionType) String() string {
+	switch actionType {
+	case ActionTypeCancel:
+		return "Cancel"
+	case ActionTypeInjectPadding:
+		return "InjectPadding"
+	case ActionTypeBlockOutgoing:
+		return "BlockOutgoing"
+	case ActionTypeUpdateTimer:
+		return "UpdateTimer"
+	case ActionTypeUpdateCounter:
+		return "UpdateCounter"
+	}
+	return "ActionType(" + strconv.FormatUint(uint64(actionType), 10) + ")"
+}
+
+// daitaTimers are the timers of a machine cancelled by ActionTypeCancel.
+type daitaTimers uint8
+
+const (
+	daitaActionTimer   daitaTimers = iota // the queued padding or blocking
+	daitaInternalTimer                    // the internal timer
+	daitaAllTimers
 )
 
 const (
@@ -62,250 +164,658 @@ type Action struct {
 
 	// Information about the padding action
 	Payload Padding
+
+	// Information about the blocking action
+	Blocking Blocking
+
+	// Information about the timer update action
+	Timer TimerUpdate
+
+	// Information about the counter update action
+	Counter CounterUpdate
+
+	// The timers cancelled by a cancel action.
+	cancel daitaTimers
 }
 
 type Padding struct {
 	// The size of the padding packet, in bytes. NOT including the Daita header.
 	ByteCount uint16
 	Replace   bool
+	// Bypass lets the padding be sent while outgoing traffic is blocked, if
+	// the blocking may be bypassed.
+	Bypass bool
 }
 
-func (peer *Peer) EnableDaita(machines string, eventsCapacity uint, actionsCapacity uint, maxPaddingBytes float64, maxBlockingBytes float64) bool {
+type Blocking struct {
+	// For how long outgoing traffic is blocked.
+	Duration time.Duration
+	// Replace replaces any ongoing blocking, which is otherwise only extended.
+	Replace bool
+	// Bypass lets padding that may bypass blocking be sent during the blocking.
+	Bypass bool
+}
+
+type TimerUpdate struct {
+	// When the timer expires.
+	Duration time.Duration
+	// Replace replaces a running timer, which is otherwise only extended.
+	Replace bool
+}
+
+type CounterUpdate struct {
+	// Which of the two counters of the machine to update, 0 or 1.
+	Counter   uint8
+	Operation CounterOperation
+	Value     uint64
+}
+
+// A CounterOperation is how a counter update changes the counter.
+type CounterOperation uint8
+
+const (
+	CounterIncrement CounterOperation = iota
+	CounterDecrement
+	CounterSet
+)
+
+// EnableDaita enables DAITA with machines, separated by newlines, for both
+// directions of traffic. maxPaddingFrac and maxBlockingFrac bound the
+// fraction of the traffic that the machines may pad and block, between 0 and
+// 1, with 0 leaving it unbounded.
+func (peer *Peer) EnableDaita(machines string, eventsCapacity uint, actionsCapacity uint, maxPaddingFrac float64, maxBlockingFrac float64) error {
+	return peer.enableDaita([]DaitaMachines{{
+		Machines:        machines,
+		MaxPaddingFrac:  maxPaddingFrac,
+		MaxBlockingFrac: maxBlockingFrac,
+	}}, []daitaDirection{daitaSent | daitaReceived}, eventsCapacity, actionsCapacity)
+}
+
+// daitaSupported reports whether this package was built with DAITA support.
+const daitaSupported = true
+
+// enableDaitaMachines enables DAITA with a set of machines for both
+// directions of traffic, and a set for each direction, any of which may be
+// empty.
+func (peer *Peer) enableDaitaMachines(both, sent, received DaitaMachines, eventsCapacity uint, actionsCapacity uint) error {
+	sets := []DaitaMachines{both, sent, received}
+	directions := []daitaDirection{daitaSent | daitaReceived, daitaSent, daitaReceived}
+	return peer.enableDaita(sets, directions, eventsCapacity, actionsCapacity)
+}
+
+// EnableDaitaDirectional enables DAITA with separate machines, and separate
+// padding and blocking budgets, for each direction of traffic. The sent
+// machines only see the packets sent to the peer, and the received machines
+// only those received from it, along with the padding each machine sent
+// itself. Either set may be empty, but not both. Machines are numbered
+// starting with the sent machines.
+func (peer *Peer) EnableDaitaDirectional(sent, received DaitaMachines, eventsCapacity uint, actionsCapacity uint) error {
+	return peer.enableDaita([]DaitaMachines{sent, received}, []daitaDirection{daitaSent, daitaReceived}, eventsCapacity, actionsCapacity)
+}
+
+func (peer *Peer) enableDaita(sets []DaitaMachines, directions []daitaDirection, eventsCapacity uint, actionsCapacity uint) error {
+	// Holding the state lock keeps the peer from stopping, and closing DAITA,
+	// before it is enabled.
+	peer.state.Lock()
+	defer peer.state.Unlock()
 	peer.Lock()
 	defer peer.Unlock()
 
 	if !peer.isRunning.Load() {
-		return false
+		return errors.New("peer is not running")
 	}
 
 	if peer.daita != nil {
 		peer.device.log.Errorf("Failed to activate DAITA as it is already active")
-		return false
+		return errors.New("DAITA is already active")
+	}
+
+	if !peer.device.Features().Has(FeatureDaita) {
+		peer.device.log.Errorf("Failed to activate DAITA as the feature is disabled")
+		return errors.New("DAITA feature is disabled")
 	}
 
 	peer.device.log.Verbosef("Enabling DAITA for peer: %v", peer)
 
+	frameworks, labels, err := peer.newDaitaFrameworks(sets, directions)
+	if err != nil {
+		peer.device.log.Errorf("Failed to activate DAITA: %v", err)
+		return err
+	}
+	eventsCapacity, reserved, err := peer.reserveDaitaMemory(frameworks, eventsCapacity, 0)
+	if err != nil {
+		for _, framework := range frameworks {
+			framework.runtime.stop()
+		}
+		return err
+	}
+	peer.startDaitaLocked(frameworks, labels, eventsCapacity, reserved)
+	return nil
+}
+
+// daitaStateSize estimates the memory of the DAITA state of a peer running
+// numMachines machines with an event queue of eventsCapacity: its routines,
+// the queue, and for every machine the actions returned by the runtime, its
+// queued padding or blocking and internal timer, and its counters.
+func daitaStateSize(numMachines uint64, eventsCapacity uint) uint64 {
+	const routines = 2 * 8 << 10 // the stacks of the event handler and of the queue
+	const mapEntry = 64          // roughly, for a key, a value and overhead
+	instance := uint64(unsafe.Sizeof(MaybenotDaita{}) + unsafe.Sizeof(daitaQueue{}) + routines)
+	events := uint64(eventsCapacity) * uint64(unsafe.Sizeof(Event{}))
+	machine := uint64(unsafe.Sizeof(Action{}) + 2*(unsafe.Sizeof(daitaQueueEntry{})+mapEntry) + mapEntry)
+	return instance + events + numMachines*machine
+}
+
+// reserveDaitaMemory reserves the memory of the DAITA state of the peer
+// running frameworks with an event queue of eventsCapacity, giving up
+// replaced bytes reserved before. If the memory limit of the device does not
+// allow it, the queue is shrunk, down to DaitaMinEventsCapacity. It returns
+// the capacity of the queue and the bytes reserved, or an error, with a
+// NotificationDaitaMemoryLimit, if even the smallest queue does not fit.
+func (peer *Peer) reserveDaitaMemory(frameworks []daitaFramework, eventsCapacity uint, replaced uint64) (uint, uint64, error) {
+	var numMachines uint64
+	for _, framework := range frameworks {
+		numMachines += framework.numMachines
+	}
+	memory := &peer.device.daitaMemory
+	capacity := eventsCapacity
+	for {
+		size := daitaStateSize(numMachines, capacity)
+		if memory.reserve(size, replaced) {
+			if capacity < eventsCapacity {
+				peer.device.log.Errorf("%v - DAITA: event queue shrunk from %d to %d to stay within the memory limit of %d bytes",
+					peer, eventsCapacity, capacity, memory.limit)
+			}
+			return capacity, size, nil
+		}
+		if capacity <= DaitaMinEventsCapacity {
+			break
+		}
+		capacity = max(capacity/2, DaitaMinEventsCapacity)
+	}
+	message := fmt.Sprintf("DAITA memory limit of %d bytes reached, with %d bytes in use", memory.limit, memory.used.Load())
+	peer.device.log.Errorf("%v - Failed to activate DAITA: %s", peer, message)
+	peer.device.notify(NotificationDaitaMemoryLimit, peer, message)
+	return 0, 0, errors.New(message)
+}
+
+// newDaitaFrameworks starts a runtime for each non-empty set of machines,
+// seeing the events of the matching directions, and returns them with the
+// labels of their machines.
+func (peer *Peer) newDaitaFrameworks(sets []DaitaMachines, directions []daitaDirection) ([]daitaFramework, []string, error) {
 	mtu := peer.device.tun.mtu.Load()
 
 	peer.device.log.Verbosef("MTU %v", mtu)
-	var maybenot *C.MaybenotFramework
-	c_machines := C.CString(machines)
+	var frameworks []daitaFramework
+	var machines []string
+	var numMachines uint64
+	for i, set := range sets {
+		if strings.TrimSpace(set.Machines) == "" {
+			continue
+		}
+		runtime, n, err := newMaybenotRuntime(set.Machines, set.MaxPaddingFrac, set.MaxBlockingFrac, uint16(mtu), peer.device.options.clock, peer.device.options.random)
+		if err != nil {
+			for _, framework := range frameworks {
+				framework.runtime.stop()
+			}
+			return nil, nil, fmt.Errorf("failed to initialize maybenot: %w", err)
+		}
 
-	c_maxPaddingBytes := C.double(maxPaddingBytes)
-	c_maxBlockingBytes := C.double(maxBlockingBytes)
+		frameworks = append(frameworks, daitaFramework{
+			runtime:      runtime,
+			firstMachine: numMachines,
+			numMachines:  n,
+			directions:   directions[i],
+			budgets:      DaitaMachines{MaxPaddingFrac: set.MaxPaddingFrac, MaxBlockingFrac: set.MaxBlockingFrac},
+		})
+		machines = append(machines, set.Machines)
+		numMachines += n
+	}
+	if len(frameworks) == 0 {
+		return nil, nil, errors.New("no machines")
+	}
+	return frameworks, labelDaitaMachines(strings.Join(machines, "\n")), nil
+}
 
-	maybenot_result := C.maybenot_start(
-		c_machines, c_maxPaddingBytes, c_maxBlockingBytes, C.ushort(mtu),
-		&maybenot,
-	)
-	C.free(unsafe.Pointer(c_machines))
+// ReloadDaitaMachines replaces the machines of the peer, which must have DAITA
+// enabled, with machines, separated by newlines, without bringing the tunnel
+// down. The new machines see both directions of traffic, with the padding and
+// blocking budgets of the old ones, and the same capacity of the event queue.
+// Peers with machines for a single direction, enabled by
+// EnableDaitaDirectional or the "daita_sent_machines" and
+// "daita_received_machines" keys, cannot be reloaded, as that would lose the
+// machines and budgets of each direction. The old machines are stopped, dropping their queued
+// padding, blocking and timers, before the new ones start, and the counters
+// of DaitaStats restart. If the new machines fail to start, the old ones keep
+// running and the error is returned.
+func (peer *Peer) ReloadDaitaMachines(machines string) error {
+	// Holding the state lock keeps the peer from stopping, and DAITA from
+	// being enabled or disabled, during the reload.
+	peer.state.Lock()
+	defer peer.state.Unlock()
 
-	if maybenot_result != 0 {
-		peer.device.log.Errorf("Failed to initialize maybenot, code=%d", maybenot_result)
-		return false
+	peer.Lock()
+	old, ok := peer.daita.(*MaybenotDaita)
+	if !ok || !peer.isRunning.Load() {
+		peer.Unlock()
+		peer.device.log.Errorf("%v - Failed to reload DAITA machines as DAITA is not active", peer)
+		return errors.New("DAITA is not active")
+	}
+	for _, framework := range old.frameworks {
+		if framework.directions != daitaSent|daitaReceived {
+			peer.Unlock()
+			peer.device.log.Errorf("%v - Failed to reload DAITA machines as they are directional", peer)
+			return errors.New("DAITA machines are directional")
+		}
 	}
+	set := old.frameworks[0].budgets
+	set.Machines = machines
+	frameworks, labels, err := peer.newDaitaFrameworks([]DaitaMachines{set}, []daitaDirection{daitaSent | daitaReceived})
+	peer.Unlock()
+	if err != nil {
+		peer.device.log.Errorf("%v - Failed to reload DAITA machines: %v", peer, err)
+		return err
+	}
+	// The new instance takes over the memory reserved by the old one.
+	reserved := old.reserved.Load()
+	eventsCapacity, size, err := peer.reserveDaitaMemory(frameworks, uint(cap(old.events)), reserved)
+	if err != nil {
+		for _, framework := range frameworks {
+			framework.runtime.stop()
+		}
+		return err
+	}
+	old.reserved.Store(0)
+
+	// The old instance is closed without the lock of the peer, which its
+	// routines may be waiting for. Events of the peer meanwhile are dropped.
+	peer.stopDaitaPaddingCheck()
+	old.Close()
+	peer.endDaitaBlocking()
+	peer.Lock()
+	if peer.daitaConfig.enabled {
+		// Keep the machines if DAITA is restarted as configured through UAPI.
+		peer.daitaConfig.machines = nil
+		for _, machine := range strings.Split(machines, "\n") {
+			if strings.TrimSpace(machine) != "" {
+				peer.daitaConfig.machines = append(peer.daitaConfig.machines, machine)
+			}
+		}
+	}
+	peer.startDaitaLocked(frameworks, labels, eventsCapacity, size)
+	peer.Unlock()
+	peer.SendStagedPackets()
+	peer.device.log.Verbosef("%v - DAITA: reloaded machines", peer)
+	return nil
+}
 
-	numMachines := C.maybenot_num_machines(maybenot)
+// startDaitaLocked runs frameworks for the peer, which takes ownership of
+// them and of the reserved bytes of DAITA memory. The caller must hold the
+// state lock and the lock of the peer.
+func (peer *Peer) startDaitaLocked(frameworks []daitaFramework, machineLabels []string, eventsCapacity uint, reserved uint64) {
+	ctx, cancel := context.WithCancel(peer.state.ctx)
 	daita := MaybenotDaita{
+		ctx:           ctx,
+		cancel:        cancel,
 		events:        make(chan Event, eventsCapacity),
-		eventsClosed:  false,
-		maybenot:      maybenot,
-		newActionsBuf: make([]C.MaybenotAction, numMachines),
-		paddingQueue:  map[uint64]*time.Timer{},
+		frameworks:    frameworks,
+		queue:         newDaitaQueue(peer.device.options.clock),
+		counters:      map[uint64][2]uint64{},
+		machineLabels: machineLabels,
 		logger:        peer.device.log,
+		eventsHandled: make(chan struct{}),
+		queueHandled:  make(chan struct{}),
 	}
+	daita.stats.clock = peer.device.options.clock
+	daita.memory = &peer.device.daitaMemory
+	daita.reserved.Store(reserved)
+
+	daita.eventsClock.reset()
 
-	daita.stopping.Add(1)
+	peer.device.log.Verbosef("%v - DAITA: started machines %v", peer, daita.machineLabels)
+
+	peer.goroutineEnter(GoroutineDaita)
 	go daita.handleEvents(peer)
+	peer.goroutineEnter(GoroutineDaita)
+	go daita.runQueue(peer)
 	peer.daita = &daita
-
-	return true
+	peer.startDaitaPaddingCheck()
 }
 
 // Stop the MaybenotDaita instance. It must not be used after calling this.
+// When Close returns, the event handler and the queue have stopped, queued
+// padding, blocking and timers have been dropped, and the maybenot framework
+// has been freed.
 func (daita *MaybenotDaita) Close() {
 	daita.logger.Verbosef("Waiting for DAITA routines to stop")
 
-	daita.eventsCloseLock.Lock()
-	close(daita.events)
-	daita.eventsClosed = true
-	daita.eventsCloseLock.Unlock()
+	daita.cancel()
 
-	for _, queuedPadding := range daita.paddingQueue {
-		if queuedPadding.Stop() {
-			daita.stopping.Done()
-		}
+	// The queue is only added to by the event handler, so it can only be
+	// dropped once both are done.
+	<-daita.eventsHandled
+	<-daita.queueHandled
+	daita.queue.stop()
+
+	for _, framework := range daita.frameworks {
+		framework.runtime.stop()
 	}
-	daita.stopping.Wait()
+	daita.frameworks = nil
+	daita.memory.release(daita.reserved.Swap(0))
 	daita.logger.Verbosef("DAITA routines have stopped")
 }
 
-func (daita *MaybenotDaita) NonpaddingReceived(peer *Peer, packetLen uint) {
-	daita.event(peer, NonpaddingReceived, packetLen, 0)
+// MachineLabels returns the label of each running machine, indexed by machine
+// ID. The labels are fixed when DAITA is enabled and must not be modified.
+func (daita *MaybenotDaita) MachineLabels() []string {
+	return daita.machineLabels
 }
 
-func (daita *MaybenotDaita) PaddingReceived(peer *Peer, packetLen uint) {
-	daita.event(peer, PaddingReceived, packetLen, 0)
+func (daita *MaybenotDaita) Stats() DaitaStats {
+	stats := &daita.stats
+	blocked := time.Duration(stats.blocked.Load())
+	if since := stats.blockedSince.Load(); since != 0 {
+		blocked += max(stats.clock.Now().Sub(time.Unix(0, since)), 0)
+	}
+	return DaitaStats{
+		TxPaddingPackets: stats.txPaddingPackets.Load(),
+		TxPaddingBytes:   stats.txPaddingBytes.Load(),
+		RxPaddingPackets: stats.rxPaddingPackets.Load(),
+		RxPaddingBytes:   stats.rxPaddingBytes.Load(),
+		BlockedTime:      blocked,
+		DroppedEvents:    stats.droppedEvents.Load(),
+		ActionsProcessed: stats.actions.Load(),
+		TimerSamples:     daita.queue.lateness.samples.Load(),
+		TimerLatenessAvg: daita.queue.lateness.mean(),
+		TimerLatenessMax: time.Duration(daita.queue.lateness.max.Load()),
+		MemoryBytes:      daita.reserved.Load(),
+	}
+}
+
+// blockingBegan records that the outgoing traffic of the peer is blocked
+// from now on, unless it already was.
+func (stats *daitaStats) blockingBegan() {
+	stats.blockedSince.CompareAndSwap(0, stats.clock.Now().UnixNano())
+}
+
+// blockingEnded adds the time since the blocking began to the blocked time.
+func (stats *daitaStats) blockingEnded() {
+	if since := stats.blockedSince.Swap(0); since != 0 {
+		stats.blocked.Add(int64(max(stats.clock.Now().Sub(time.Unix(0, since)), 0)))
+	}
+}
+
+func (daita *MaybenotDaita) EventQueue() QueueStat {
+	return daita.eventsClock.stat(len(daita.events), cap(daita.events))
+}
+
+// machineLabel returns the human-readable label of the machine with the given ID.
+func (daita *MaybenotDaita) machineLabel(machine uint64) string {
+	if machine < uint64(len(daita.machineLabels)) {
+		return daita.machineLabels[machine]
+	}
+	return strconv.FormatUint(machine, 10)
+}
+
+func (daita *MaybenotDaita) NonpaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time) {
+	daita.event(peer, NonpaddingReceived, packetLen, 0, receivedAt)
+}
+
+func (daita *MaybenotDaita) PaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time) {
+	daita.stats.rxPaddingPackets.Add(1)
+	daita.stats.rxPaddingBytes.Add(uint64(packetLen))
+	daita.event(peer, PaddingReceived, packetLen, 0, receivedAt)
 }
 
 func (daita *MaybenotDaita) PaddingSent(peer *Peer, packetLen uint, machine uint64) {
-	daita.event(peer, PaddingSent, packetLen, machine)
+	daita.event(peer, PaddingSent, packetLen, machine, time.Time{})
 }
 
 func (daita *MaybenotDaita) NonpaddingSent(peer *Peer, packetLen uint) {
-	daita.event(peer, NonpaddingSent, packetLen, 0)
+	daita.event(peer, NonpaddingSent, packetLen, 0, time.Time{})
 }
 
-func (daita *MaybenotDaita) event(peer *Peer, eventType EventType, packetLen uint, machine uint64) {
+func (daita *MaybenotDaita) event(peer *Peer, eventType EventType, packetLen uint, machine uint64, receivedAt time.Time) {
 	if daita == nil {
 		return
 	}
 
-	event := Event{
-		Machine:   machine,
-		Peer:      peer.handshake.remoteStatic,
-		EventType: eventType,
-		XmitBytes: uint16(packetLen),
+	if daita.ctx.Err() != nil {
+		return
 	}
 
-	daita.eventsCloseLock.RLock()
-	defer daita.eventsCloseLock.RUnlock()
-
-	if daita.eventsClosed {
-		return
+	event := Event{
+		Machine:    machine,
+		Peer:       peer.handshake.remoteStatic,
+		EventType:  eventType,
+		XmitBytes:  uint16(packetLen),
+		ReceivedAt: receivedAt,
+		queuedAt:   queueNow(),
 	}
 
 	select {
 	case daita.events <- event:
 	default:
-		peer.device.log.Verbosef("Dropped DAITA event %v due to full buffer", event.EventType)
+		daita.stats.droppedEvents.Add(1)
+		peer.device.log.Verbosef("Dropped DAITA event %v (machine %v) due to full buffer", event.EventType, daita.machineLabel(machine))
 	}
 }
 
-func injectPadding(action Action, peer *Peer) {
+func (daita *MaybenotDaita) injectPadding(action Action, peer *Peer) {
 	if action.ActionType != ActionTypeInjectPadding {
 		peer.device.log.Errorf("Got unknown action type %v", action.ActionType)
 		return
 	}
 
-	elem := peer.device.NewOutboundElement()
-
 	size := action.Payload.ByteCount
-	if size < DaitaHeaderLen || size > uint16(peer.device.tun.mtu.Load()) {
-		peer.device.log.Errorf("DAITA padding action contained invalid size %v bytes", size)
+	if err := peer.SendDaitaPadding(size, action.Payload.Bypass); err != nil {
+		if peer.isRunning.Load() {
+			peer.device.log.Errorf("DAITA padding action from machine %v failed: %v", daita.machineLabel(action.Machine), err)
+		}
 		return
 	}
+	daita.stats.txPaddingPackets.Add(1)
+	daita.stats.txPaddingBytes.Add(uint64(size))
+	daita.PaddingSent(peer, uint(size), action.Machine)
+}
 
-	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+int(size)]
-	elem.packet[0] = DaitaPaddingMarker
-	binary.BigEndian.PutUint16(elem.packet[DaitaOffsetTotalLength:DaitaOffsetTotalLength+2], size)
-
-	if peer.isRunning.Load() {
-		peer.StagePacket(elem)
-		elem = nil
-		peer.SendStagedPackets()
-
-		peer.daita.PaddingSent(peer, uint(size), action.Machine)
+func (daita *MaybenotDaita) blockOutgoing(action Action, peer *Peer) {
+	if !peer.isRunning.Load() {
+		return
 	}
+	blocking := action.Blocking
+	peer.blockOutgoing(blocking.Duration, blocking.Bypass, blocking.Replace, func() {
+		daita.stats.blockingBegan()
+		daita.event(peer, BlockingBegin, 0, action.Machine, time.Time{})
+	}, func() {
+		daita.stats.blockingEnded()
+		daita.event(peer, BlockingEnd, 0, action.Machine, time.Time{})
+	})
 }
 
 func (daita *MaybenotDaita) handleEvents(peer *Peer) {
 	defer func() {
-		C.maybenot_stop(daita.maybenot)
-		daita.stopping.Done()
+		peer.goroutineExit(GoroutineDaita)
+		close(daita.eventsHandled)
 		daita.logger.Verbosef("%v - DAITA: event handler - stopped", peer)
 	}()
 
 	for {
-		event, more := <-daita.events
-		if !more {
+		var event Event
+		select {
+		case <-daita.ctx.Done():
 			return
+		case event = <-daita.events:
 		}
+		daita.eventsClock.dequeued(event.queuedAt)
 
 		daita.handleEvent(event, peer)
 	}
 }
 
+// runQueue performs the queued padding and blocking, and ends the internal
+// timers, of the machines as they fall due, until the instance is closed.
+func (daita *MaybenotDaita) runQueue(peer *Peer) {
+	defer func() {
+		peer.goroutineExit(GoroutineDaita)
+		close(daita.queueHandled)
+	}()
+	daita.queue.run(daita.ctx)
+}
+
 func (daita *MaybenotDaita) handleEvent(event Event, peer *Peer) {
+	daita.traceEvent(event, peer)
+	for i := range daita.frameworks {
+		framework := &daita.frameworks[i]
+		// Padding is only seen by the framework of the machine that sent it,
+		// everything else by the frameworks of its direction.
+		if event.EventType.ofMachine() {
+			if !framework.ownsMachine(event.Machine) {
+				continue
+			}
+		} else if framework.directions&event.EventType.direction() == 0 {
+			continue
+		}
+		daita.handleFrameworkEvent(framework, event, peer)
+	}
+}
 
-	for _, cAction := range daita.maybenotEventToActions(event) {
-		action := cActionToGo(cAction)
+func (daita *MaybenotDaita) handleFrameworkEvent(framework *daitaFramework, event Event, peer *Peer) {
+	// Machines take events to happen when they are handled. Padding timeouts
+	// are shortened by how long the packet of the event waited since the
+	// kernel received it, so that scheduling jitter in userspace does not
+	// delay the padding.
+	lag := daitaReceiveLag(event.ReceivedAt, time.Now())
+	machine := event.Machine
+	if framework.ownsMachine(machine) {
+		machine -= framework.firstMachine
+	} else if event.EventType == BlockingBegin {
+		machine = noDaitaMachine
+	}
+	event.Machine = machine
+	actions, err := framework.runtime.onEvent(event)
+	if err != nil {
+		daita.logger.Errorf("%v - DAITA: failed to handle event %v: %v", peer, event.EventType, err)
+		return
+	}
+	daita.stats.actions.Add(uint64(len(actions)))
+	for _, action := range actions {
+		action.Machine += framework.firstMachine
+		daita.traceAction(action, peer)
 
 		switch action.ActionType {
 		case ActionTypeCancel:
-			machine := action.Machine
-			// If padding is queued for the machine, cancel it
-			if queuedPadding, ok := daita.paddingQueue[machine]; ok {
-				if queuedPadding.Stop() {
-					daita.stopping.Done()
-				}
+			// Cancel the padding or blocking queued for the machine, and
+			// its internal timer, as the action asks.
+			if action.cancel != daitaInternalTimer {
+				daita.queue.remove(daitaQueueKey{machine: action.Machine})
 			}
-		case ActionTypeInjectPadding:
-			// Check if a padding packet was already queued for the machine
-			// If so, try to cancel it
-			timer, paddingWasQueued := daita.paddingQueue[action.Machine]
-			// If no padding was queued, or the action fire before we manage to
-			// cancel it, we need to increment the wait group again
-			if !paddingWasQueued || !timer.Stop() {
-				daita.stopping.Add(1)
+			if action.cancel != daitaActionTimer {
+				daita.queue.remove(daitaQueueKey{machine: action.Machine, internal: true})
 			}
-
-			daita.paddingQueue[action.Machine] =
-				time.AfterFunc(action.Timeout, func() {
-					defer daita.stopping.Done()
-					injectPadding(action, peer)
-				})
+		case ActionTypeInjectPadding:
+			daita.schedule(action, max(action.Timeout-lag, 0), peer, daita.injectPadding)
 		case ActionTypeBlockOutgoing:
-			daita.logger.Errorf("ignoring action type ActionTypeBlockOutgoing, unimplemented")
-			continue
+			daita.schedule(action, max(action.Timeout-lag, 0), peer, daita.blockOutgoing)
+		case ActionTypeUpdateTimer:
+			daita.updateTimer(action, peer)
+		case ActionTypeUpdateCounter:
+			daita.updateCounter(action, peer)
 		}
 	}
 }
 
-func (daita *MaybenotDaita) maybenotEventToActions(event Event) []C.MaybenotAction {
-	cEvent := C.MaybenotEvent{
-		machine:    C.uintptr_t(event.Machine),
-		event_type: C.uint32_t(event.EventType),
-		xmit_bytes: C.uint16_t(event.XmitBytes),
+// traceEvent records event in the DAITA trace of the device, if any.
+func (daita *MaybenotDaita) traceEvent(event Event, peer *Peer) {
+	trace := peer.device.options.daitaTrace
+	if trace == nil {
+		return
 	}
+	trace.write(daita.logger, daitaTraceRecord{
+		time:     peer.device.options.clock.Now(),
+		peer:     event.Peer,
+		typ:      uint8(event.EventType),
+		typeName: event.EventType.String(),
+		machine:  event.Machine,
+		size:     event.XmitBytes,
+	})
+}
 
-	var actionsWritten C.uintptr_t
-
-	// TODO: use unsafe.SliceData instead of the pointer dereference when the Go version gets bumped to 1.20 or later
-	// TODO: fetch an error string from the FFI corresponding to the error code
-	result := C.maybenot_on_events(daita.maybenot, &cEvent, 1, &daita.newActionsBuf[0], &actionsWritten)
-	if result != 0 {
-		daita.logger.Errorf("Failed to handle event as it was a null pointer\nEvent: %d\n", event)
-		return nil
+// traceAction records action in the DAITA trace of the device, if any.
+func (daita *MaybenotDaita) traceAction(action Action, peer *Peer) {
+	trace := peer.device.options.daitaTrace
+	if trace == nil {
+		return
 	}
-
-	newActions := daita.newActionsBuf[:actionsWritten]
-	return newActions
+	record := daitaTraceRecord{
+		time:     peer.device.options.clock.Now(),
+		peer:     peer.handshake.remoteStatic,
+		action:   true,
+		typ:      uint8(action.ActionType),
+		typeName: action.ActionType.String(),
+		machine:  action.Machine,
+	}
+	switch action.ActionType {
+	case ActionTypeInjectPadding:
+		record.size = action.Payload.ByteCount
+		record.timeout = action.Timeout
+	case ActionTypeBlockOutgoing:
+		record.timeout = action.Timeout
+		record.duration = action.Blocking.Duration
+	case ActionTypeUpdateTimer:
+		record.duration = action.Timer.Duration
+	}
+	trace.write(daita.logger, record)
 }
 
-func cActionToGo(action_c C.MaybenotAction) Action {
-	if action_c.tag != C.MaybenotAction_InjectPadding {
-		panic("Unsupported tag")
+// updateTimer (re)starts the internal timer of the machine of action, unless
+// it is running, would expire later, and the action does not replace it.
+func (daita *MaybenotDaita) updateTimer(action Action, peer *Peer) {
+	machine := action.Machine
+	key := daitaQueueKey{machine: machine, internal: true}
+	end := peer.device.options.clock.Now().Add(action.Timer.Duration)
+	if due, ok := daita.queue.due(key); ok && !action.Timer.Replace && !end.After(due) {
+		return
 	}
+	daita.queue.put(key, end, func() {
+		daita.event(peer, TimerEnd, 0, machine, time.Time{})
+	})
+	daita.event(peer, TimerBegin, 0, machine, time.Time{})
+}
 
-	// cast union to the ActionInjectPadding variant
-	padding_action := (*C.MaybenotAction_InjectPadding_Body)(unsafe.Pointer(&action_c.anon0[0]))
-
-	timeout := maybenotDurationToGoDuration(padding_action.timeout)
-
-	return Action{
-		Machine:    uint64(padding_action.machine),
-		Timeout:    timeout,
-		ActionType: ActionTypeInjectPadding,
-		Payload: Padding{
-			ByteCount: uint16(padding_action.size),
-			Replace:   bool(padding_action.replace),
-		},
+// updateCounter updates a counter of the machine of action, saturating at 0
+// and the largest uint64, and reports it dropping to zero.
+func (daita *MaybenotDaita) updateCounter(action Action, peer *Peer) {
+	update := action.Counter
+	if update.Counter > 1 {
+		daita.logger.Errorf("%v - DAITA: machine %v updated invalid counter %d", peer, daita.machineLabel(action.Machine), update.Counter)
+		return
 	}
+	counters := daita.counters[action.Machine]
+	before := counters[update.Counter]
+	switch update.Operation {
+	case CounterIncrement:
+		counters[update.Counter] = before + min(update.Value, math.MaxUint64-before)
+	case CounterDecrement:
+		counters[update.Counter] = before - min(update.Value, before)
+	case CounterSet:
+		counters[update.Counter] = update.Value
+	}
+	daita.counters[action.Machine] = counters
+	if before != 0 && counters[update.Counter] == 0 {
+		daita.event(peer, CounterZero, 0, action.Machine, time.Time{})
+	}
+}
+
+// schedule performs action after timeout, replacing the padding or blocking
+// queued for its machine, if any.
+func (daita *MaybenotDaita) schedule(action Action, timeout time.Duration, peer *Peer, perform func(Action, *Peer)) {
+	due := peer.device.options.clock.Now().Add(timeout)
+	daita.queue.put(daitaQueueKey{machine: action.Machine}, due, func() {
+		perform(action, peer)
+	})
 }
 
-func maybenotDurationToGoDuration(duration C.MaybenotDuration) time.Duration {
-	// let's just assume this is fine...
-	nanoseconds := uint64(duration.secs)*1_000_000_000 + uint64(duration.nanos)
-	return time.Duration(nanoseconds)
+func (framework *daitaFramework) ownsMachine(machine uint64) bool {
+	return machine >= framework.firstMachine && machine-framework.firstMachine < framework.numMachines
 }
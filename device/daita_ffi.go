@@ -0,0 +1,225 @@
+//go:build daita && cgo && !maybenot_go
+// +build daita,cgo,!maybenot_go
+
+package device
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// #include <stdio.h>
+// #include <stdlib.h>
+// #include "../maybenot/crates/maybenot-ffi/maybenot.h"
+// #cgo LDFLAGS: -L${SRCDIR}/../ -lmaybenot -lm
+import "C"
+
+// A maybenotResult is an error code returned by the maybenot FFI.
+type maybenotResult uint32
+
+// NOTE: discriminants must be kept in sync with `MaybenotResult` in maybenot-ffi/maybenot.h
+const (
+	maybenotMachineStringNotUtf8 = maybenotResult(1)
+	maybenotInvalidMachineString = maybenotResult(2)
+	maybenotStartFramework       = maybenotResult(3)
+	maybenotUnknownMachine       = maybenotResult(4)
+	maybenotNullPointer          = maybenotResult(5)
+)
+
+func (result maybenotResult) Error() string {
+	var message string
+	switch result {
+	case maybenotMachineStringNotUtf8:
+		message = "machine string is not valid UTF-8"
+	case maybenotInvalidMachineString:
+		message = "invalid machine string"
+	case maybenotStartFramework:
+		message = "failed to start framework"
+	case maybenotUnknownMachine:
+		message = "event for an unknown machine"
+	case maybenotNullPointer:
+		message = "null pointer"
+	default:
+		message = "unknown error"
+	}
+	return fmt.Sprintf("%s (code=%d)", message, uint32(result))
+}
+
+// ffiRuntime runs machines in a maybenot framework created through the FFI.
+type ffiRuntime struct {
+	maybenot      *C.MaybenotFramework
+	newActionsBuf []C.MaybenotAction
+}
+
+// newMaybenotRuntime starts a maybenot framework through the FFI, running the
+// newline separated machines, and returns it with its number of machines.
+// The framework seeds itself, so random is ignored.
+func newMaybenotRuntime(machines string, maxPaddingFrac, maxBlockingFrac float64, mtu uint16, clock Clock, _ *seededRand) (maybenotRuntime, uint64, error) {
+	var maybenot *C.MaybenotFramework
+	c_machines := C.CString(machines)
+
+	c_maxPaddingBytes := C.double(maxPaddingFrac)
+	c_maxBlockingBytes := C.double(maxBlockingFrac)
+
+	maybenot_result := C.maybenot_start(
+		c_machines, c_maxPaddingBytes, c_maxBlockingBytes, C.ushort(mtu),
+		&maybenot,
+	)
+	C.free(unsafe.Pointer(c_machines))
+
+	if maybenot_result != 0 {
+		return nil, 0, maybenotResult(maybenot_result)
+	}
+
+	daitaFFI.allocated.Add(1)
+
+	n := uint64(C.maybenot_num_machines(maybenot))
+	return &ffiRuntime{
+		maybenot:      maybenot,
+		newActionsBuf: make([]C.MaybenotAction, max(n, 1)),
+	}, n, nil
+}
+
+// validateDaitaMachine checks that maybenot can parse machine, by starting and
+// stopping a framework running it.
+func validateDaitaMachine(machine string) error {
+	var maybenot *C.MaybenotFramework
+	c_machine := C.CString(machine)
+	result := C.maybenot_start(c_machine, 0, 0, C.ushort(DefaultMTU), &maybenot)
+	C.free(unsafe.Pointer(c_machine))
+	if result != 0 {
+		return fmt.Errorf("invalid maybenot machine: %w", maybenotResult(result))
+	}
+	C.maybenot_stop(maybenot)
+	return nil
+}
+
+// daitaMachineField returns "", as the FFI does not tell which field of a
+// machine is invalid.
+func daitaMachineField(err error) string {
+	return ""
+}
+
+func (runtime *ffiRuntime) onEvent(event Event) ([]Action, error) {
+	cEvent := C.MaybenotEvent{
+		machine:    C.uintptr_t(event.Machine),
+		event_type: C.uint32_t(event.EventType),
+		xmit_bytes: C.uint16_t(event.XmitBytes),
+	}
+
+	var actionsWritten C.uintptr_t
+
+	// TODO: use unsafe.SliceData instead of the pointer dereference when the Go version gets bumped to 1.20 or later
+	result := C.maybenot_on_events(runtime.maybenot, &cEvent, 1, &runtime.newActionsBuf[0], &actionsWritten)
+	if result != 0 {
+		return nil, fmt.Errorf("maybenot failed: %w", maybenotResult(result))
+	}
+
+	actions := make([]Action, 0, actionsWritten)
+	for _, cAction := range runtime.newActionsBuf[:actionsWritten] {
+		action, err := cActionToGo(cAction)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func (runtime *ffiRuntime) stop() {
+	C.maybenot_stop(runtime.maybenot)
+	daitaFFI.freed.Add(1)
+}
+
+func cActionToGo(action_c C.MaybenotAction) (Action, error) {
+	// cast the union to the variant of the tag
+	body := unsafe.Pointer(&action_c.anon0[0])
+
+	switch action_c.tag {
+	case C.MaybenotAction_Cancel:
+		cancel_action := (*C.MaybenotAction_Cancel_Body)(body)
+
+		action := Action{
+			Machine:    uint64(cancel_action.machine),
+			ActionType: ActionTypeCancel,
+		}
+		switch cancel_action.timer {
+		case C.MaybenotTimer_Internal:
+			action.cancel = daitaInternalTimer
+		case C.MaybenotTimer_All:
+			action.cancel = daitaAllTimers
+		}
+		return action, nil
+
+	case C.MaybenotAction_InjectPadding:
+		padding_action := (*C.MaybenotAction_InjectPadding_Body)(body)
+
+		return Action{
+			Machine:    uint64(padding_action.machine),
+			Timeout:    maybenotDurationToGoDuration(padding_action.timeout),
+			ActionType: ActionTypeInjectPadding,
+			Payload: Padding{
+				ByteCount: uint16(padding_action.size),
+				Replace:   bool(padding_action.replace),
+				Bypass:    bool(padding_action.bypass),
+			},
+		}, nil
+
+	case C.MaybenotAction_BlockOutgoing:
+		block_action := (*C.MaybenotAction_BlockOutgoing_Body)(body)
+
+		return Action{
+			Machine:    uint64(block_action.machine),
+			Timeout:    maybenotDurationToGoDuration(block_action.timeout),
+			ActionType: ActionTypeBlockOutgoing,
+			Blocking: Blocking{
+				Duration: maybenotDurationToGoDuration(block_action.duration),
+				Replace:  bool(block_action.replace),
+				Bypass:   bool(block_action.bypass),
+			},
+		}, nil
+
+	case C.MaybenotAction_UpdateTimer:
+		timer_action := (*C.MaybenotAction_UpdateTimer_Body)(body)
+
+		return Action{
+			Machine:    uint64(timer_action.machine),
+			ActionType: ActionTypeUpdateTimer,
+			Timer: TimerUpdate{
+				Duration: maybenotDurationToGoDuration(timer_action.duration),
+				Replace:  bool(timer_action.replace),
+			},
+		}, nil
+
+	case C.MaybenotAction_UpdateCounter:
+		counter_action := (*C.MaybenotAction_UpdateCounter_Body)(body)
+
+		action := Action{
+			Machine:    uint64(counter_action.machine),
+			ActionType: ActionTypeUpdateCounter,
+			Counter: CounterUpdate{
+				Counter: uint8(counter_action.counter),
+				Value:   uint64(counter_action.value),
+			},
+		}
+		switch counter_action.operation {
+		case C.MaybenotCounterOperation_Increment:
+			action.Counter.Operation = CounterIncrement
+		case C.MaybenotCounterOperation_Decrement:
+			action.Counter.Operation = CounterDecrement
+		case C.MaybenotCounterOperation_Set:
+			action.Counter.Operation = CounterSet
+		default:
+			return Action{}, fmt.Errorf("unsupported counter operation %d", counter_action.operation)
+		}
+		return action, nil
+	}
+	return Action{}, fmt.Errorf("unsupported action tag %d", action_c.tag)
+}
+
+func maybenotDurationToGoDuration(duration C.MaybenotDuration) time.Duration {
+	// let's just assume this is fine...
+	nanoseconds := uint64(duration.secs)*1_000_000_000 + uint64(duration.nanos)
+	return time.Duration(nanoseconds)
+}
@@ -0,0 +1,97 @@
+//go:build daita && cgo && !maybenot_go
+// +build daita,cgo,!maybenot_go
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	mathrand "math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device/maybenot"
+)
+
+// TestDaitaRuntimeEquivalence runs the same machines in maybenot through the
+// FFI and in the pure-Go runtime, and checks that they act alike. The machines
+// only sample fixed distributions and take certain transitions, so that both
+// act the same whatever they draw.
+func TestDaitaRuntimeEquivalence(t *testing.T) {
+	// The machines of WG_TEST_DAITA_MACHINES are set when maybenot is linked in.
+	testDaitaMachines(t)
+
+	fixed := func(v float64) maybenot.Dist {
+		return maybenot.Dist{Type: maybenot.Uniform, Param1: v, Param2: v}
+	}
+	on := func(event maybenot.Event, state int) (transitions [maybenot.NumEvents][]maybenot.Trans) {
+		transitions[event] = []maybenot.Trans{{State: state, Probability: 1}}
+		return transitions
+	}
+	padding := &maybenot.Machine{States: []maybenot.State{
+		{Transitions: on(maybenot.NormalSent, 1)},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionSendPadding, Replace: true, Timeout: fixed(1000)},
+			Transitions: on(maybenot.PaddingSent, 0),
+		},
+	}}
+	blocking := &maybenot.Machine{States: []maybenot.State{
+		{Transitions: on(maybenot.NormalRecv, 1)},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionBlockOutgoing, Bypass: true, Timeout: fixed(2000), Duration: fixed(5000)},
+			Transitions: on(maybenot.BlockingBegin, 2),
+		},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionCancel, Timer: maybenot.TimerAll},
+			Transitions: on(maybenot.BlockingEnd, 0),
+		},
+	}}
+	machines := []*maybenot.Machine{padding, blocking}
+	serialized := make([]string, len(machines))
+	for i, machine := range machines {
+		serialized[i] = machine.String()
+	}
+
+	ffi, n, err := newMaybenotRuntime(strings.Join(serialized, "\n"), 0, 0, DefaultMTU, systemClock{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ffi.stop()
+	if n != uint64(len(machines)) {
+		t.Fatalf("maybenot runs %d machines, want %d", n, len(machines))
+	}
+	goRuntime, err := newGoRuntime(machines, 0, 0, DefaultMTU, systemClock{}, mathrand.New(mathrand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goRuntime.stop()
+
+	for _, event := range []Event{
+		{EventType: NonpaddingSent, XmitBytes: 100},
+		{EventType: PaddingSent, XmitBytes: DefaultMTU, Machine: 0},
+		{EventType: NonpaddingReceived, XmitBytes: 100},
+		{EventType: BlockingBegin, Machine: 1},
+		{EventType: NonpaddingSent, XmitBytes: 100},
+		{EventType: BlockingEnd},
+		{EventType: NonpaddingReceived, XmitBytes: 100},
+	} {
+		want, err := ffi.onEvent(event)
+		if err != nil {
+			t.Fatalf("%v: %v", event.EventType, err)
+		}
+		got, err := goRuntime.onEvent(event)
+		if err != nil {
+			t.Fatalf("%v: %v", event.EventType, err)
+		}
+		if len(got) == 0 && len(want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: pure-Go runtime acted %+v, maybenot %+v", event.EventType, got, want)
+		}
+	}
+}
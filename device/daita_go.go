@@ -0,0 +1,63 @@
+//go:build daita && (!cgo || maybenot_go)
+// +build daita
+// +build !cgo maybenot_go
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+
+	"golang.zx2c4.com/wireguard/device/maybenot"
+)
+
+// newMaybenotRuntime starts a pure-Go maybenot framework running the newline
+// separated machines, and returns it with its number of machines. The machines
+// draw from a generator seeded from random if the device is deterministic.
+func newMaybenotRuntime(machines string, maxPaddingFrac, maxBlockingFrac float64, mtu uint16, clock Clock, random *seededRand) (maybenotRuntime, uint64, error) {
+	parsed, err := maybenot.ParseMachines(machines)
+	if err != nil {
+		return nil, 0, err
+	}
+	var seed int64
+	if random != nil {
+		seed = random.Int63()
+	} else {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, 0, err
+		}
+		seed = int64(binary.LittleEndian.Uint64(b[:]))
+	}
+	runtime, err := newGoRuntime(parsed, maxPaddingFrac, maxBlockingFrac, mtu, clock, mathrand.New(mathrand.NewSource(seed)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return runtime, uint64(runtime.framework.NumMachines()), nil
+}
+
+// validateDaitaMachine checks that machine can be run by the pure-Go runtime.
+func validateDaitaMachine(machine string) error {
+	if _, err := maybenot.ParseMachine(machine); err != nil {
+		return fmt.Errorf("invalid maybenot machine: %w", err)
+	}
+	return nil
+}
+
+// daitaMachineField returns the path to the invalid field of a machine that
+// validateDaitaMachine failed with err.
+func daitaMachineField(err error) string {
+	var fieldErr *maybenot.FieldError
+	if errors.As(err, &fieldErr) {
+		return fieldErr.Field
+	}
+	return ""
+}
@@ -0,0 +1,236 @@
+//go:build daita && (!cgo || maybenot_go)
+// +build daita
+// +build !cgo maybenot_go
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device/maybenot"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// transitionOn returns the transitions of a state that moves to state on event.
+func transitionOn(event maybenot.Event, state int) (transitions [maybenot.NumEvents][]maybenot.Trans) {
+	transitions[event] = []maybenot.Trans{{State: state, Probability: 1}}
+	return transitions
+}
+
+// microseconds returns a distribution that always samples d.
+func microseconds(d time.Duration) maybenot.Dist {
+	us := float64(d / time.Microsecond)
+	return maybenot.Dist{Type: maybenot.Uniform, Param1: us, Param2: us}
+}
+
+func init() {
+	// The pure-Go runtime runs the machines of any build, so the DAITA tests
+	// run without WG_TEST_DAITA_MACHINES, with a machine padding every
+	// packet sent after a millisecond.
+	builtinTestDaitaMachines = (&maybenot.Machine{States: []maybenot.State{
+		{Transitions: transitionOn(maybenot.NormalSent, 1)},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionSendPadding, Timeout: microseconds(time.Millisecond)},
+			Transitions: transitionOn(maybenot.NormalSent, 1),
+		},
+	}}).String()
+}
+
+func TestValidateDaitaMachines(t *testing.T) {
+	if err := ValidateDaitaMachines("\n" + builtinTestDaitaMachines + "\n\n" + builtinTestDaitaMachines + "\n"); err != nil {
+		t.Fatalf("valid machines rejected: %v", err)
+	}
+	if err := ValidateDaitaMachines(" \n"); err == nil {
+		t.Error("no machines accepted")
+	}
+
+	invalid := (&maybenot.Machine{States: []maybenot.State{
+		{Transitions: transitionOn(maybenot.NormalSent, 1)},
+		{Action: &maybenot.Action{Kind: maybenot.ActionSendPadding, Timeout: maybenot.Dist{Type: maybenot.Uniform, Param1: 2, Param2: 1}}},
+	}}).String()
+	for _, test := range []struct {
+		machines string
+		machine  int
+		field    string
+	}{
+		{builtinTestDaitaMachines + "\n\n" + invalid, 1, "states[1].action.timeout"},
+		{"not a machine\n" + builtinTestDaitaMachines, 0, ""},
+	} {
+		err := ValidateDaitaMachines(test.machines)
+		machineErr, ok := err.(*DaitaMachineError)
+		if !ok {
+			t.Errorf("got %v, want a DaitaMachineError", err)
+			continue
+		}
+		if machineErr.Machine != test.machine || machineErr.Field != test.field {
+			t.Errorf("got error of machine %d field %q, want machine %d field %q: %v",
+				machineErr.Machine, machineErr.Field, test.machine, test.field, err)
+		}
+	}
+}
+
+// TestDaitaInternalTimer checks that the internal timer of a machine expires,
+// moving the machine to a state sending padding.
+func TestDaitaInternalTimer(t *testing.T) {
+	machine := &maybenot.Machine{States: []maybenot.State{
+		{Transitions: transitionOn(maybenot.NormalSent, 1)},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionUpdateTimer, Duration: microseconds(20 * time.Millisecond)},
+			Transitions: transitionOn(maybenot.TimerEnd, 2),
+		},
+		{Action: &maybenot.Action{Kind: maybenot.ActionSendPadding}},
+	}}
+	pair := genTestPair(t, false)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if err := peer.EnableDaita(machine.String(), 64, 64, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	pair.Send(t, Ping, nil)
+
+	// The other end has not enabled DAITA, so it counts the padding as it
+	// drops it.
+	dropped := &pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey).rxDroppedDaitaMarker
+	for deadline := time.Now().Add(5 * time.Second); dropped.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no padding sent when the timer expired")
+		}
+	}
+}
+
+// TestDaitaBlockOutgoing checks that packets sent while a machine blocks
+// outgoing traffic are held until the blocking ends, and that the machine is
+// told when it does.
+func TestDaitaBlockOutgoing(t *testing.T) {
+	machine := &maybenot.Machine{States: []maybenot.State{
+		{Transitions: transitionOn(maybenot.NormalSent, 1)},
+		{
+			Action:      &maybenot.Action{Kind: maybenot.ActionBlockOutgoing, Timeout: microseconds(50 * time.Millisecond), Duration: microseconds(300 * time.Millisecond)},
+			Transitions: transitionOn(maybenot.BlockingEnd, 2),
+		},
+		{Action: &maybenot.Action{Kind: maybenot.ActionSendPadding}},
+	}}
+	pair := genTestPair(t, false)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if err := peer.EnableDaita(machine.String(), 64, 64, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	// Complete the handshake with a pong, so that the ping beginning the
+	// blocking is sent before it.
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+	for deadline := time.Now().Add(5 * time.Second); !peer.daitaBlocking.blocked.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("outgoing traffic not blocked")
+		}
+	}
+
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("packet sent while blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not sent when the blocking ended")
+	}
+
+	dropped := &pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey).rxDroppedDaitaMarker
+	for deadline := time.Now().Add(5 * time.Second); dropped.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no padding sent on the end of the blocking")
+		}
+	}
+	if stats, _ := peer.DaitaStats(); stats.BlockedTime < 300*time.Millisecond {
+		t.Errorf("blocked for %v, want at least 300ms", stats.BlockedTime)
+	}
+}
+
+// TestDaitaStats checks that the padding sent by one end is counted by both,
+// and that the counters are reported by IpcGet.
+func TestDaitaStats(t *testing.T) {
+	pair := genTestPair(t, false)
+	sender := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	receiver := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if err := sender.EnableDaita(builtinTestDaitaMachines, 64, 64, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	// The receiver runs a machine that never pads, to count the padding.
+	if err := receiver.EnableDaita((&maybenot.Machine{States: []maybenot.State{{}}}).String(), 64, 64, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	pair.Send(t, Ping, nil)
+
+	var sent, received DaitaStats
+	for deadline := time.Now().Add(5 * time.Second); sent.TxPaddingPackets == 0 || received.RxPaddingPackets != sent.TxPaddingPackets; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("padding not counted: sent %+v, received %+v", sent, received)
+		}
+		sent, _ = sender.DaitaStats()
+		received, _ = receiver.DaitaStats()
+	}
+	if sent.TxPaddingBytes == 0 || received.RxPaddingBytes != sent.TxPaddingBytes {
+		t.Errorf("sent %d bytes of padding, received %d", sent.TxPaddingBytes, received.RxPaddingBytes)
+	}
+	if sent.ActionsProcessed == 0 {
+		t.Error("no actions counted")
+	}
+	if sent.TimerSamples == 0 || sent.TimerLatenessMax < sent.TimerLatenessAvg {
+		t.Errorf("timer lateness not measured: %d samples, mean %v, max %v", sent.TimerSamples, sent.TimerLatenessAvg, sent.TimerLatenessMax)
+	}
+
+	cfg, err := pair[1].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "daita_tx_padding_packets=") {
+		t.Errorf("daita_tx_padding_packets missing from IpcGet:\n%s", cfg)
+	}
+
+	if _, ok := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey).DaitaStats(); !ok {
+		t.Error("no stats for a peer with DAITA enabled")
+	}
+}
+
+// TestDaitaTrace checks that the events handled by the machines of a peer,
+// and their actions, are traced.
+func TestDaitaTrace(t *testing.T) {
+	var trace strings.Builder
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			return NewDeviceWithOptions(tun, bind, logger, WithDaitaTrace(&trace, DaitaTraceCSV))
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if err := peer.EnableDaita(builtinTestDaitaMachines, 64, 64, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	pair.Send(t, Ping, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if stats, _ := peer.DaitaStats(); stats.TxPaddingPackets != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no padding sent")
+		}
+	}
+	// Disabling DAITA stops its routines, and so the tracing.
+	peer.disableDaita()
+
+	for _, record := range []string{",event,NonpaddingSent,", ",action,InjectPadding,", ",event,PaddingSent,"} {
+		if !strings.Contains(trace.String(), record) {
+			t.Errorf("trace is missing %q:\n%s", record, trace.String())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	mathrand "math/rand"
+
+	"golang.zx2c4.com/wireguard/device/maybenot"
+)
+
+// goRuntime runs machines in the pure-Go maybenot framework, which takes
+// the place of the FFI when built with the maybenot_go tag or without cgo.
+// Machines are in the format of maybenot v2.
+type goRuntime struct {
+	framework *maybenot.Framework
+	clock     Clock
+	mtu       uint16
+	events    []maybenot.TriggerEvent
+}
+
+// newGoRuntime starts a pure-Go maybenot framework running machines, which
+// draw from rng. It is built alongside the FFI, to be tested against it.
+func newGoRuntime(machines []*maybenot.Machine, maxPaddingFrac, maxBlockingFrac float64, mtu uint16, clock Clock, rng *mathrand.Rand) (*goRuntime, error) {
+	framework, err := maybenot.NewFramework(machines, maxPaddingFrac, maxBlockingFrac, clock.Now(), rng)
+	if err != nil {
+		return nil, err
+	}
+
+	daitaFFI.allocated.Add(1)
+
+	return &goRuntime{
+		framework: framework,
+		clock:     clock,
+		mtu:       mtu,
+	}, nil
+}
+
+func (runtime *goRuntime) onEvent(event Event) ([]Action, error) {
+	machine := int(event.Machine)
+	events := runtime.events[:0]
+	switch event.EventType {
+	case NonpaddingSent:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.NormalSent}, maybenot.TriggerEvent{Event: maybenot.TunnelSent})
+	case PaddingSent:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.PaddingSent, Machine: machine}, maybenot.TriggerEvent{Event: maybenot.TunnelSent})
+	case NonpaddingReceived:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.NormalRecv}, maybenot.TriggerEvent{Event: maybenot.TunnelRecv})
+	case PaddingReceived:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.PaddingRecv}, maybenot.TriggerEvent{Event: maybenot.TunnelRecv})
+	case BlockingBegin:
+		if event.Machine == noDaitaMachine {
+			machine = -1
+		}
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.BlockingBegin, Machine: machine})
+	case BlockingEnd:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.BlockingEnd})
+	case TimerBegin, CounterZero:
+		// The framework runs the timers and counters of machines itself.
+		return nil, nil
+	case TimerEnd:
+		events = append(events, maybenot.TriggerEvent{Event: maybenot.TimerEnd, Machine: machine})
+	default:
+		return nil, fmt.Errorf("unsupported event %v", event.EventType)
+	}
+	runtime.events = events
+
+	triggered := runtime.framework.TriggerEvents(events, runtime.clock.Now())
+	actions := make([]Action, 0, len(triggered))
+	for _, action := range triggered {
+		actions = append(actions, runtime.action(action))
+	}
+	return actions, nil
+}
+
+func (runtime *goRuntime) action(triggered maybenot.TriggerAction) Action {
+	action := Action{
+		Machine: uint64(triggered.Machine),
+		Timeout: triggered.Timeout,
+	}
+	switch triggered.Kind {
+	case maybenot.ActionCancel:
+		action.ActionType = ActionTypeCancel
+		switch triggered.Timer {
+		case maybenot.TimerInternal:
+			action.cancel = daitaInternalTimer
+		case maybenot.TimerAll:
+			action.cancel = daitaAllTimers
+		}
+	case maybenot.ActionSendPadding:
+		// Padding packets of maybenot v2 have the size of the MTU.
+		action.ActionType = ActionTypeInjectPadding
+		action.Payload = Padding{ByteCount: runtime.mtu, Replace: triggered.Replace, Bypass: triggered.Bypass}
+	case maybenot.ActionBlockOutgoing:
+		action.ActionType = ActionTypeBlockOutgoing
+		action.Blocking = Blocking{Duration: triggered.Duration, Replace: triggered.Replace, Bypass: triggered.Bypass}
+	case maybenot.ActionUpdateTimer:
+		// The framework only updates a timer when the action should.
+		action.ActionType = ActionTypeUpdateTimer
+		action.Timer = TimerUpdate{Duration: triggered.Duration, Replace: true}
+	}
+	return action
+}
+
+func (runtime *goRuntime) stop() {
+	daitaFFI.freed.Add(1)
+}
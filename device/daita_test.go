@@ -0,0 +1,614 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// builtinTestDaitaMachines are maybenot machines known to run in the runtime
+// built in, if any.
+var builtinTestDaitaMachines string
+
+// testDaitaMachines returns the maybenot machines to run in tests, which are
+// specific to the version of maybenot linked in.
+func testDaitaMachines(t *testing.T) string {
+	machines := os.Getenv("WG_TEST_DAITA_MACHINES")
+	if machines == "" {
+		machines = builtinTestDaitaMachines
+	}
+	if machines == "" {
+		t.Skip("WG_TEST_DAITA_MACHINES is not set")
+	}
+	return machines
+}
+
+func TestDaitaCloseLifecycle(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+
+	closed := make(chan NoisePublicKey, 1)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationDaitaClosed {
+			closed <- n.Peer
+		}
+	})()
+
+	enable := func() *Peer {
+		t.Helper()
+		peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+		if err := peer.EnableDaita(machines, 64, 64, 0, 0); err != nil {
+			t.Fatalf("failed to enable DAITA: %v", err)
+		}
+		return peer
+	}
+	assertClosed := func(peer *Peer, allocated, freed uint64) {
+		t.Helper()
+		select {
+		case pk := <-closed:
+			if pk != peer.handshake.remoteStatic {
+				t.Errorf("notification for the wrong peer %x", pk[:])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification that DAITA was closed")
+		}
+		// The notification is only sent once the framework is freed.
+		if a, f := DaitaFFIAllocations(); a-allocated != 1 || f-freed != 1 {
+			t.Errorf("expected one framework allocated and freed, got %d and %d", a-allocated, f-freed)
+		}
+		if n := dev.Goroutines()[GoroutineDaita]; n != 0 {
+			t.Errorf("%d DAITA goroutines still running", n)
+		}
+	}
+
+	// Bringing the device down stops DAITA.
+	allocated, freed := DaitaFFIAllocations()
+	peer := enable()
+	pair.Send(t, Ping, nil)
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	assertClosed(peer, allocated, freed)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// So does removing the peer.
+	allocated, freed = DaitaFFIAllocations()
+	peer = enable()
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(peer.handshake.remoteStatic[:]),
+		"remove", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	assertClosed(peer, allocated, freed)
+}
+
+func TestDaitaDirectional(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	if peer.EnableDaitaDirectional(DaitaMachines{}, DaitaMachines{}, 64, 64) == nil {
+		t.Fatal("enabled DAITA without any machines")
+	}
+
+	allocated, freed := DaitaFFIAllocations()
+	sent := DaitaMachines{Machines: machines, MaxPaddingFrac: 0.5}
+	received := DaitaMachines{Machines: machines + "\n" + machines, MaxPaddingFrac: 0.1}
+	if err := peer.EnableDaitaDirectional(sent, received, 64, 64); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	if a, _ := DaitaFFIAllocations(); a-allocated != 2 {
+		t.Errorf("expected a framework per direction, got %d", a-allocated)
+	}
+	daita := peer.daita.(*MaybenotDaita)
+	numSent := daita.frameworks[0].numMachines
+	if n := len(daita.MachineLabels()); uint64(n) != 3*numSent {
+		t.Errorf("got %d machine labels, want %d", n, 3*numSent)
+	}
+	if f := daita.frameworks[1]; f.firstMachine != numSent || f.directions != daitaReceived {
+		t.Errorf("received machines start at %d for directions %b", f.firstMachine, f.directions)
+	}
+	pair.Send(t, Ping, nil)
+
+	// Reloading would merge the directions and their budgets.
+	if err := peer.ReloadDaitaMachines(machines); err == nil || !strings.Contains(err.Error(), "directional") {
+		t.Errorf("reloading directional machines failed with %v", err)
+	}
+	if peer.daita != daita || len(daita.frameworks) != 2 || daita.frameworks[0].budgets.MaxPaddingFrac != 0.5 {
+		t.Error("directional machines were replaced")
+	}
+
+	if err := pair[0].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if _, f := DaitaFFIAllocations(); f-freed != 2 {
+		t.Errorf("expected both frameworks freed, got %d", f-freed)
+	}
+}
+
+func TestDaitaReloadMachines(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	if peer.ReloadDaitaMachines(machines) == nil {
+		t.Fatal("reloaded machines without DAITA enabled")
+	}
+	if err := peer.EnableDaita(machines, 64, 64, 0.5, 0.25); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	if err := peer.EnableDaita(machines, 64, 64, 0, 0); err == nil || !strings.Contains(err.Error(), "already active") {
+		t.Errorf("enabling DAITA again failed with %v", err)
+	}
+	pair.Send(t, Ping, nil)
+	old := peer.daita.(*MaybenotDaita)
+
+	allocated, freed := DaitaFFIAllocations()
+	if err := peer.ReloadDaitaMachines(machines + "\n" + machines); err != nil {
+		t.Fatalf("failed to reload machines: %v", err)
+	}
+	if a, f := DaitaFFIAllocations(); a-allocated != 1 || f-freed != 1 {
+		t.Errorf("expected one framework allocated and freed, got %d and %d", a-allocated, f-freed)
+	}
+	daita := peer.daita.(*MaybenotDaita)
+	if daita == old || old.frameworks != nil {
+		t.Fatal("old machines are still running")
+	}
+	if n := len(daita.MachineLabels()); n != 2*len(old.MachineLabels()) {
+		t.Errorf("got %d machine labels after reload, want %d", n, 2*len(old.MachineLabels()))
+	}
+	if budgets := daita.frameworks[0].budgets; budgets.MaxPaddingFrac != 0.5 || budgets.MaxBlockingFrac != 0.25 {
+		t.Errorf("budgets changed to %+v", budgets)
+	}
+	if cap(daita.events) != 64 {
+		t.Errorf("event queue capacity changed to %d", cap(daita.events))
+	}
+	pair.Send(t, Ping, nil)
+
+	// Machines failing to start leave the running ones in place.
+	if peer.ReloadDaitaMachines("not a machine") == nil {
+		t.Fatal("reloaded invalid machines")
+	}
+	if peer.daita != daita {
+		t.Fatal("running machines were replaced by invalid ones")
+	}
+	pair.Send(t, Ping, nil)
+	if n := pair[0].dev.Goroutines()[GoroutineDaita]; n != 2 {
+		t.Errorf("%d DAITA goroutines running, want 2", n)
+	}
+}
+
+// paddingMachines is a minimal set of machines for tests, which does not
+// depend on the version of maybenot linked in. Machine i answers the first
+// packet sent by padding sizes[i] bytes right away, and records the padding
+// it sees sent.
+type paddingMachines struct {
+	sync.Mutex
+	sizes  []uint16
+	fired  bool
+	padded []uint64 // machines whose padding was sent
+}
+
+func (machines *paddingMachines) onEvent(event Event) ([]Action, error) {
+	machines.Lock()
+	defer machines.Unlock()
+	switch event.EventType {
+	case NonpaddingSent:
+		if machines.fired {
+			return nil, nil
+		}
+		machines.fired = true
+		var actions []Action
+		for i, size := range machines.sizes {
+			actions = append(actions, Action{
+				ActionType: ActionTypeInjectPadding,
+				Machine:    uint64(i),
+				Payload:    Padding{ByteCount: size},
+			})
+		}
+		return actions, nil
+	case PaddingSent:
+		machines.padded = append(machines.padded, event.Machine)
+	}
+	return nil, nil
+}
+
+func (machines *paddingMachines) stop() {}
+
+func (machines *paddingMachines) paddingSent() int {
+	machines.Lock()
+	defer machines.Unlock()
+	return len(machines.padded)
+}
+
+// TestDaitaMemoryLimit checks that DAITA is enabled for peers with event
+// queues shrunk to stay within the memory limit of the device, then not at
+// all, and that the memory is released as DAITA stops.
+func TestDaitaMemoryLimit(t *testing.T) {
+	machines := testDaitaMachines(t)
+	numMachines := uint64(len(labelDaitaMachines(machines)))
+	limit := daitaStateSize(numMachines, 64) + daitaStateSize(numMachines, DaitaMinEventsCapacity)
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		return NewDeviceWithOptions(tun, bind, logger, WithDaitaMemoryLimit(limit))
+	})
+	dev := pair[0].dev
+
+	limited := make(chan NoisePublicKey, 1)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationDaitaMemoryLimit {
+			limited <- n.Peer
+		}
+	})()
+
+	peers := []*Peer{dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)}
+	for len(peers) < 3 {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := dev.NewPeer(sk.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.Start()
+		peers = append(peers, peer)
+	}
+	enable := func(peer *Peer, capacity int) {
+		t.Helper()
+		if err := peer.EnableDaita(machines, 64, 64, 0, 0); err != nil {
+			t.Fatalf("failed to enable DAITA: %v", err)
+		}
+		peer.RLock()
+		defer peer.RUnlock()
+		if got := cap(peer.daita.(*MaybenotDaita).events); got != capacity {
+			t.Errorf("got an event queue of %d, want %d", got, capacity)
+		}
+	}
+
+	enable(peers[0], 64)
+	enable(peers[1], DaitaMinEventsCapacity)
+	if used, _ := dev.DaitaMemory(); used != limit {
+		t.Errorf("%d bytes of DAITA memory in use, want %d", used, limit)
+	}
+	if stats, _ := peers[0].DaitaStats(); stats.MemoryBytes != daitaStateSize(numMachines, 64) {
+		t.Errorf("got %d bytes of DAITA memory for the peer, want %d", stats.MemoryBytes, daitaStateSize(numMachines, 64))
+	}
+
+	if peers[2].EnableDaita(machines, 64, 64, 0, 0) == nil {
+		t.Fatal("enabled DAITA beyond the memory limit")
+	}
+	select {
+	case pk := <-limited:
+		if pk != peers[2].handshake.remoteStatic {
+			t.Errorf("notification for the wrong peer %x", pk[:])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification that the memory limit was reached")
+	}
+
+	// Stopping DAITA for a peer makes room for another.
+	peers[0].disableDaita()
+	enable(peers[2], 64)
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := dev.DaitaMemory(); used != 0 {
+		t.Errorf("%d bytes of DAITA memory still in use", used)
+	}
+}
+
+// enableTestDaita enables DAITA for peer, running machines instead of
+// machines started through the FFI.
+func enableTestDaita(peer *Peer, machines *paddingMachines) {
+	peer.state.Lock()
+	defer peer.state.Unlock()
+	peer.Lock()
+	defer peer.Unlock()
+	peer.startDaitaLocked([]daitaFramework{{
+		runtime:     machines,
+		numMachines: uint64(len(machines.sizes)),
+		directions:  daitaSent | daitaReceived,
+	}}, nil, 64, 0)
+}
+
+// TestDaitaConstantPacketSize checks that with a constant packet size, data,
+// keepalives and DAITA padding of any size all leave as transport messages
+// of the same, MTU-derived size, and that padding requested by the machines
+// is actually sent and reported back to them.
+func TestDaitaConstantPacketSize(t *testing.T) {
+	var wire *sizeBind
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			wire = &sizeBind{Bind: bind}
+			bind = wire
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	dev := pair[1].dev
+	remote := pair[0].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"constant_packet_size", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	mtu := int(dev.tun.mtu.Load())
+	machines := &paddingMachines{sizes: []uint16{DaitaHeaderLen, 100, uint16(mtu)}}
+	peer := dev.LookupPeer(remote)
+	enableTestDaita(peer, machines)
+	pair.Send(t, Ping, nil)
+
+	// The other end has not enabled DAITA, so it counts the padding as it
+	// drops it.
+	paddings := len(machines.sizes)
+	dropped := &pair[0].dev.LookupPeer(dev.staticIdentity.publicKey).rxDroppedDaitaMarker
+	for deadline := time.Now().Add(5 * time.Second); dropped.Load() < uint64(paddings) || machines.paddingSent() < paddings; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d padding packets sent and received, got %d and %d", paddings, machines.paddingSent(), dropped.Load())
+		}
+	}
+
+	sizes := wire.sent()
+	if len(sizes) < 1+paddings {
+		t.Fatalf("expected at least %d transport messages, got %d", 1+paddings, len(sizes))
+	}
+	for i, size := range sizes {
+		if want := MessageTransportSize + mtu; size != want {
+			t.Errorf("transport message %d is %d bytes, want %d", i, size, want)
+		}
+	}
+}
+
+func TestDaitaUAPI(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pub)
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pub[:]),
+		"daita", "true",
+		"daita_machines", machines,
+		"daita_events_capacity", "64",
+		"daita_max_padding_frac", "0.5",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if peer.daita == nil {
+		t.Fatal("DAITA not enabled")
+	}
+	if n := cap(peer.daita.(*MaybenotDaita).events); n != 64 {
+		t.Errorf("expected an events capacity of 64, got %d", n)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"daita=true\n", "daita_machines=" + machines + "\n", "daita_events_capacity=64\n", "daita_max_padding_frac=0.5\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+
+	// DAITA configured through UAPI is restarted when the device comes up.
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if peer.daita == nil {
+		t.Fatal("DAITA not enabled after the device came up")
+	}
+	pair.Send(t, Ping, nil)
+
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "daita", "false")); err != nil {
+		t.Fatal(err)
+	}
+	if peer.daita != nil {
+		t.Error("DAITA not disabled")
+	}
+}
+
+func TestDaitaUAPIDirectional(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pub)
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pub[:]),
+		"daita", "true",
+		"daita_sent_machines", machines,
+		"daita_received_machines", machines,
+		"daita_received_machines", machines,
+	)); err != nil {
+		t.Fatal(err)
+	}
+	frameworks := func() []daitaFramework {
+		t.Helper()
+		peer.RLock()
+		defer peer.RUnlock()
+		if peer.daita == nil {
+			t.Fatal("DAITA not enabled")
+		}
+		return peer.daita.(*MaybenotDaita).frameworks
+	}
+	f := frameworks()
+	if len(f) != 2 || f[0].directions != daitaSent || f[1].directions != daitaReceived || f[1].numMachines != 2*f[0].numMachines {
+		t.Fatalf("unexpected frameworks %+v", f)
+	}
+	pair.Send(t, Ping, nil)
+
+	// Setting the machines of one direction keeps those of the other.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pub[:]),
+		"daita_received_machines", machines,
+		"daita_machines", machines,
+	)); err != nil {
+		t.Fatal(err)
+	}
+	f = frameworks()
+	if len(f) != 3 || f[0].directions != daitaSent|daitaReceived || f[1].directions != daitaSent || f[2].directions != daitaReceived || f[2].numMachines != f[1].numMachines {
+		t.Fatalf("unexpected frameworks %+v", f)
+	}
+	if peer.ReloadDaitaMachines(machines) == nil {
+		t.Fatal("reloaded directional machines")
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"daita_machines=" + machines + "\n", "daita_sent_machines=" + machines + "\n", "daita_received_machines=" + machines + "\n"} {
+		if strings.Count(cfg, line) != 1 {
+			t.Errorf("expected IpcGet to contain %q once, got:\n%s", line, cfg)
+		}
+	}
+}
+
+func TestDaitaDefault(t *testing.T) {
+	machines := testDaitaMachines(t)
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	if err := dev.SetDefaultDaita(strings.Split(machines, "\n"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers configured before are left alone.
+	if peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey); peer.daita != nil {
+		t.Error("DAITA enabled for an existing peer")
+	}
+
+	for _, daita := range []string{"", "false"} {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := sk.publicKey()
+		cfg := []string{"public_key", hex.EncodeToString(pub[:])}
+		if daita != "" {
+			cfg = append(cfg, "daita", daita)
+		}
+		if err := dev.IpcSet(uapiCfg(cfg...)); err != nil {
+			t.Fatal(err)
+		}
+		peer := dev.LookupPeer(pub)
+		if enabled := peer.daita != nil; enabled != (daita == "") {
+			t.Errorf("daita=%q: expected DAITA enabled to be %v", daita, daita == "")
+		}
+	}
+}
+
+// TestDaitaUpdateTimer checks that a timer update only shortens a running
+// timer of the machine if it replaces it, and that timers that begin are
+// reported to the machine.
+func TestDaitaUpdateTimer(t *testing.T) {
+	pair := genTestPair(t, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	daita := &MaybenotDaita{
+		ctx:    ctx,
+		events: make(chan Event, 8),
+		queue:  newDaitaQueue(peer.device.options.clock),
+		logger: peer.device.log,
+	}
+	defer daita.queue.stop()
+
+	update := func(duration time.Duration, replace bool) {
+		daita.updateTimer(Action{
+			ActionType: ActionTypeUpdateTimer,
+			Machine:    1,
+			Timer:      TimerUpdate{Duration: duration, Replace: replace},
+		}, peer)
+	}
+	ends := func() time.Duration {
+		due, _ := daita.queue.due(daitaQueueKey{machine: 1, internal: true})
+		return time.Until(due).Round(time.Minute)
+	}
+
+	update(time.Hour, false)
+	update(time.Minute, false)
+	if ends() != time.Hour {
+		t.Errorf("timer ends in %v after a shorter update, want 1h", ends())
+	}
+	update(time.Minute, true)
+	if ends() != time.Minute {
+		t.Errorf("timer ends in %v after a replacing update, want 1m", ends())
+	}
+	update(2*time.Hour, false)
+	if ends() != 2*time.Hour {
+		t.Errorf("timer ends in %v after a longer update, want 2h", ends())
+	}
+
+	if n := len(daita.events); n != 3 {
+		t.Fatalf("got %d events, want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		if event := <-daita.events; event.EventType != TimerBegin || event.Machine != 1 {
+			t.Errorf("got event %v of machine %d", event.EventType, event.Machine)
+		}
+	}
+}
+
+// TestDaitaUpdateCounter checks that counters saturate, and that a counter
+// dropping to zero is reported to its machine.
+func TestDaitaUpdateCounter(t *testing.T) {
+	pair := genTestPair(t, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	daita := &MaybenotDaita{
+		ctx:      ctx,
+		events:   make(chan Event, 8),
+		counters: map[uint64][2]uint64{},
+		logger:   peer.device.log,
+	}
+
+	update := func(counter uint8, operation CounterOperation, value uint64) {
+		daita.updateCounter(Action{
+			ActionType: ActionTypeUpdateCounter,
+			Machine:    1,
+			Counter:    CounterUpdate{Counter: counter, Operation: operation, Value: value},
+		}, peer)
+	}
+
+	update(1, CounterSet, 3)
+	update(1, CounterIncrement, math.MaxUint64)
+	if got := daita.counters[1][1]; got != math.MaxUint64 {
+		t.Errorf("counter is %d after overflowing, want %d", got, uint64(math.MaxUint64))
+	}
+	update(0, CounterDecrement, 1)
+	update(1, CounterDecrement, 10)
+	if len(daita.events) != 0 {
+		t.Fatalf("got %d events before a counter dropped to zero", len(daita.events))
+	}
+	update(1, CounterDecrement, math.MaxUint64)
+	update(1, CounterDecrement, 1)
+	if n := len(daita.events); n != 1 {
+		t.Fatalf("got %d events, want 1", n)
+	}
+	if event := <-daita.events; event.EventType != CounterZero || event.Machine != 1 {
+		t.Errorf("got event %v of machine %d", event.EventType, event.Machine)
+	}
+}
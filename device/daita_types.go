@@ -1,5 +1,15 @@
 package device
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type EventType uint32
 
 // NOTE: discriminants must be kept in sync with `MaybenotEventType` in maybenot-ffi/maybenot.h
@@ -8,6 +18,11 @@ const (
 	NonpaddingReceived = EventType(1)
 	PaddingSent        = EventType(2)
 	PaddingReceived    = EventType(3)
+	BlockingBegin      = EventType(4)
+	BlockingEnd        = EventType(5)
+	TimerBegin         = EventType(6)
+	TimerEnd           = EventType(7)
+	CounterZero        = EventType(8)
 )
 
 const (
@@ -22,12 +37,117 @@ const (
 	DaitaOffsetTotalLength uint16 = 2
 )
 
+// DaitaMaxReceiveLag bounds how long the kernel may have received a packet
+// before its event is handled for the padding triggered by the event to be
+// scheduled relative to the kernel receive time. Longer lags are taken to be
+// steps of the wall clock and ignored.
+const DaitaMaxReceiveLag = time.Second
+
+// DaitaMinEventsCapacity is the capacity that the event queue of a peer is
+// shrunk down to, before DAITA is not enabled at all, to stay within the
+// limit set with WithDaitaMemoryLimit.
+const DaitaMinEventsCapacity = 16
+
+// DaitaMachines are maybenot machines, separated by newlines, sharing the
+// budgets limiting the fraction of traffic that they may pad or block.
+type DaitaMachines struct {
+	Machines        string
+	MaxPaddingFrac  float64
+	MaxBlockingFrac float64
+}
+
 type Daita interface {
+	// Close stops the machines of the peer and frees their resources. It
+	// returns once no routine of the instance is left running.
 	Close()
 	NonpaddingSent(peer *Peer, packetLen uint)
-	NonpaddingReceived(peer *Peer, packetLen uint)
+	// NonpaddingReceived and PaddingReceived take the time the kernel
+	// received the packet, or the zero time if the bind did not report it.
+	NonpaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time)
 	PaddingSent(peer *Peer, packetLen uint, machine_id uint64)
-	PaddingReceived(peer *Peer, packetLen uint)
+	PaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time)
+
+	// MachineLabels returns the label of each running machine, indexed by machine ID.
+	MachineLabels() []string
+
+	// EventQueue returns the occupancy of the queue of events waiting for the machines.
+	EventQueue() QueueStat
+
+	// Stats returns the counters of the instance, since DAITA was enabled.
+	Stats() DaitaStats
+}
+
+// DaitaStats are the counters of the DAITA instance of a peer, which measure
+// the overhead of its machines.
+type DaitaStats struct {
+	TxPaddingPackets uint64        // padding packets sent
+	TxPaddingBytes   uint64        // bytes of padding sent, including the DAITA header
+	RxPaddingPackets uint64        // padding packets received
+	RxPaddingBytes   uint64        // bytes of padding received, including the DAITA header
+	BlockedTime      time.Duration // time the outgoing traffic was blocked, including any ongoing blocking
+	DroppedEvents    uint64        // events dropped because the event queue was full
+	ActionsProcessed uint64        // actions of the machines handled
+
+	// The lateness of the padding, blocking and internal timers of the
+	// machines, from when they were due until they were performed, for
+	// machine designers to tell how closely the timing of their machines is
+	// kept.
+	TimerSamples     uint64        // padding, blocking and timers performed after a timeout
+	TimerLatenessAvg time.Duration // mean lateness
+	TimerLatenessMax time.Duration // worst lateness
+
+	MemoryBytes uint64 // estimated memory of the DAITA state of the peer
+}
+
+// DaitaStats returns the counters of the DAITA instance of the peer, and false
+// if DAITA is not enabled for it.
+func (peer *Peer) DaitaStats() (DaitaStats, bool) {
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.daita == nil {
+		return DaitaStats{}, false
+	}
+	return peer.daita.Stats(), true
+}
+
+// ipcDaitaStats serializes the non-zero DAITA counters of a peer for IpcGet.
+func ipcDaitaStats(sendf func(string, ...any), stats DaitaStats) {
+	for _, counter := range []struct {
+		key   string
+		value uint64
+	}{
+		{"daita_tx_padding_packets", stats.TxPaddingPackets},
+		{"daita_tx_padding_bytes", stats.TxPaddingBytes},
+		{"daita_rx_padding_packets", stats.RxPaddingPackets},
+		{"daita_rx_padding_bytes", stats.RxPaddingBytes},
+		{"daita_blocked_nsec", uint64(stats.BlockedTime)},
+		{"daita_dropped_events", stats.DroppedEvents},
+		{"daita_actions", stats.ActionsProcessed},
+		{"daita_timer_samples", stats.TimerSamples},
+		{"daita_timer_lateness_avg_nsec", uint64(stats.TimerLatenessAvg)},
+		{"daita_timer_lateness_max_nsec", uint64(stats.TimerLatenessMax)},
+		{"daita_memory_bytes", stats.MemoryBytes},
+	} {
+		if counter.value != 0 {
+			sendf("%s=%d", counter.key, counter.value)
+		}
+	}
+}
+
+// daitaFFI counts the maybenot frameworks allocated and freed through the FFI,
+// or by the pure-Go runtime in its place.
+var daitaFFI struct {
+	allocated atomic.Uint64
+	freed     atomic.Uint64
+}
+
+// DaitaFFIAllocations returns the number of maybenot frameworks allocated and
+// freed through the FFI, or by the pure-Go runtime, by this process. Their
+// difference is the number of frameworks in use; it drops when a peer with
+// DAITA enabled is removed or its device is brought down, which also sends a
+// NotificationDaitaClosed.
+func DaitaFFIAllocations() (allocated, freed uint64) {
+	return daitaFFI.allocated.Load(), daitaFFI.freed.Load()
 }
 
 func (event EventType) String() string {
@@ -41,6 +161,126 @@ func (event EventType) String() string {
 		pretty = "PaddingSent"
 	case PaddingReceived:
 		pretty = "PaddingReceived"
+	case BlockingBegin:
+		pretty = "BlockingBegin"
+	case BlockingEnd:
+		pretty = "BlockingEnd"
+	case TimerBegin:
+		pretty = "TimerBegin"
+	case TimerEnd:
+		pretty = "TimerEnd"
+	case CounterZero:
+		pretty = "CounterZero"
 	}
 	return pretty
 }
+
+var daitaMachineLabels struct {
+	sync.RWMutex
+	labels map[string]string // machine string -> label
+}
+
+// RegisterDaitaMachineLabel binds a human-readable label to a maybenot machine string.
+// Machines started by EnableDaita are referred to by their label, instead of by their
+// numeric machine ID, in logs and in IpcGet. Registering an empty label removes the binding.
+// Labels must not contain a newline or '=', which would break the UAPI output.
+func RegisterDaitaMachineLabel(machine string, label string) error {
+	if strings.ContainsAny(label, "\n=") {
+		return fmt.Errorf("invalid DAITA machine label %q", label)
+	}
+	machine = strings.TrimSpace(machine)
+
+	daitaMachineLabels.Lock()
+	defer daitaMachineLabels.Unlock()
+
+	if label == "" {
+		delete(daitaMachineLabels.labels, machine)
+		return nil
+	}
+	if daitaMachineLabels.labels == nil {
+		daitaMachineLabels.labels = make(map[string]string)
+	}
+	daitaMachineLabels.labels[machine] = label
+	return nil
+}
+
+// DaitaMachineLabel returns the label registered for machine, if any.
+func DaitaMachineLabel(machine string) (string, bool) {
+	daitaMachineLabels.RLock()
+	defer daitaMachineLabels.RUnlock()
+
+	label, ok := daitaMachineLabels.labels[strings.TrimSpace(machine)]
+	return label, ok
+}
+
+// labelDaitaMachines returns a label for every machine in the newline separated
+// machines string, indexed by machine ID. Machines without a registered label are
+// labelled by their machine ID.
+func labelDaitaMachines(machines string) []string {
+	var labels []string
+	for _, machine := range strings.Split(machines, "\n") {
+		if strings.TrimSpace(machine) == "" {
+			continue
+		}
+		label, ok := DaitaMachineLabel(machine)
+		if !ok {
+			label = strconv.Itoa(len(labels))
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// A DaitaMachineError is an invalid machine found by ValidateDaitaMachines.
+type DaitaMachineError struct {
+	Machine int    // index of the machine among the non-empty lines
+	Field   string // path to the invalid field, named as in maybenot, if known
+	Err     error
+}
+
+func (err *DaitaMachineError) Error() string {
+	return fmt.Sprintf("machine %d: %v", err.Machine, err.Err)
+}
+
+func (err *DaitaMachineError) Unwrap() error {
+	return err.Err
+}
+
+// ValidateDaitaMachines checks that the newline separated machines can be run
+// by the maybenot linked in, as EnableDaita would, without a peer, so that
+// front-ends can check machines supplied by users before applying them. The
+// first invalid machine is returned as a *DaitaMachineError. The field of the
+// machine is only known to the pure-Go runtime.
+func ValidateDaitaMachines(machines string) error {
+	if !daitaSupported {
+		return errDaitaNotSupported
+	}
+	n := 0
+	for _, machine := range strings.Split(machines, "\n") {
+		machine = strings.TrimSpace(machine)
+		if machine == "" {
+			continue
+		}
+		if err := validateDaitaMachine(machine); err != nil {
+			return &DaitaMachineError{Machine: n, Field: daitaMachineField(err), Err: err}
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no machines")
+	}
+	return nil
+}
+
+// daitaReceiveLag returns how long before now the kernel received a packet,
+// or 0 if that is unknown or implausible.
+func daitaReceiveLag(receivedAt, now time.Time) time.Duration {
+	if receivedAt.IsZero() {
+		return 0
+	}
+	lag := now.Sub(receivedAt)
+	if lag < 0 || lag > DaitaMaxReceiveLag {
+		return 0
+	}
+	return lag
+}
@@ -0,0 +1,55 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDaitaMachineLabels(t *testing.T) {
+	const machineA = "02eNpjYEAHjOgCAAA0AAI="
+	const machineB = "02eNpjYEAHjOgCAAA0AAM="
+
+	if err := RegisterDaitaMachineLabel(machineB, "front"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RegisterDaitaMachineLabel(machineB, "") })
+
+	labels := labelDaitaMachines(machineA + "\n" + machineB + "\n")
+	if expected := []string{"0", "front"}; !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected labels %v, got %v", expected, labels)
+	}
+
+	if label, ok := DaitaMachineLabel(" " + machineB + "\n"); !ok || label != "front" {
+		t.Fatalf("expected label to ignore surrounding whitespace, got %q", label)
+	}
+
+	for _, label := range []string{"front\nback", "front=back"} {
+		if err := RegisterDaitaMachineLabel(machineA, label); err == nil {
+			t.Fatalf("expected label %q to be rejected", label)
+		}
+	}
+
+	RegisterDaitaMachineLabel(machineB, "")
+	if _, ok := DaitaMachineLabel(machineB); ok {
+		t.Fatal("expected label to be removed")
+	}
+}
+
+func TestDaitaReceiveLag(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name       string
+		receivedAt time.Time
+		want       time.Duration
+	}{
+		{"unknown", time.Time{}, 0},
+		{"recent", now.Add(-3 * time.Millisecond), 3 * time.Millisecond},
+		{"future", now.Add(time.Millisecond), 0},
+		{"stale", now.Add(-DaitaMaxReceiveLag - time.Millisecond), 0},
+	} {
+		if got := daitaReceiveLag(tc.receivedAt, now); got != tc.want {
+			t.Errorf("%s: expected lag %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DAITA machines may block the outgoing traffic of a peer for a while, so
+// that a burst of it can be sent at a time of their choosing. Packets staged
+// while the peer is blocked are held in their staging queues, which keep
+// their capacity, and sent when the blocking ends. If the blocking may be
+// bypassed, padding that may bypass blocking is still sent.
+type daitaBlocking struct {
+	blocked    atomic.Bool
+	bypassable atomic.Bool
+
+	sync.Mutex
+	generation uint64     // of the blocking, changed when it is updated or ended
+	timer      ClockTimer // ends the blocking, nil if not blocked
+	until      time.Time
+	onEnd      func()
+}
+
+// blockOutgoing blocks the outgoing traffic of the peer for duration. An
+// ongoing blocking is only updated if replace is set, or if it would end
+// sooner. onBegin is called if the blocking begins or is updated, and onEnd
+// when it ends by itself, unless it is updated before.
+func (peer *Peer) blockOutgoing(duration time.Duration, bypass, replace bool, onBegin, onEnd func()) {
+	blocking := &peer.daitaBlocking
+	blocking.Lock()
+	defer blocking.Unlock()
+
+	clock := peer.device.options.clock
+	until := clock.Now().Add(duration)
+	if blocking.timer != nil {
+		if !replace && !until.After(blocking.until) {
+			return
+		}
+		blocking.timer.Stop()
+	}
+	blocking.generation++
+	generation := blocking.generation
+	blocking.until = until
+	blocking.onEnd = onEnd
+	blocking.bypassable.Store(bypass)
+	blocking.blocked.Store(true)
+	onBegin()
+	blocking.timer = clock.AfterFunc(duration, func() {
+		peer.unblockOutgoing(generation)
+	})
+}
+
+func (peer *Peer) unblockOutgoing(generation uint64) {
+	blocking := &peer.daitaBlocking
+	blocking.Lock()
+	if blocking.generation != generation || blocking.timer == nil {
+		blocking.Unlock()
+		return
+	}
+	onEnd := blocking.endLocked()
+	blocking.Unlock()
+
+	peer.SendStagedPackets()
+	onEnd()
+}
+
+// endDaitaBlocking ends the blocking of the outgoing traffic of the peer, if
+// any, without calling its onEnd. The packets held by the blocking are left
+// staged for the caller to send.
+func (peer *Peer) endDaitaBlocking() {
+	blocking := &peer.daitaBlocking
+	blocking.Lock()
+	defer blocking.Unlock()
+	if blocking.timer != nil {
+		blocking.timer.Stop()
+		blocking.endLocked()
+	}
+}
+
+func (blocking *daitaBlocking) endLocked() (onEnd func()) {
+	blocking.generation++
+	blocking.timer = nil
+	blocking.blocked.Store(false)
+	onEnd, blocking.onEnd = blocking.onEnd, nil
+	return onEnd
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The DAITA padding check is an optional self-check that DAITA is not
+// silently failing. When the "daita_padding_check" UAPI key of a peer is set
+// to a window, every time DAITA is enabled for the peer, at least one DAITA
+// padding packet must be sent to its endpoint within the window. Otherwise an
+// error is logged and a NotificationDaitaPaddingNotSent is sent.
+//
+// Padding counts as sent once the bind has accepted it, so padding requested
+// by the machines but dropped on its way, for example for lack of a session,
+// does not pass the check.
+type daitaPaddingCheck struct {
+	window      atomic.Int64  // a time.Duration, 0 if disabled
+	transmitted atomic.Uint64 // padding packets sent to the peer
+
+	sync.Mutex
+	generation uint64     // of the pending check, changed when it is stopped
+	timer      ClockTimer // the pending check, nil if none
+}
+
+// daitaPaddingTransmitted records a DAITA padding packet sent to the peer.
+func (peer *Peer) daitaPaddingTransmitted() {
+	peer.daitaCheck.transmitted.Add(1)
+}
+
+// startDaitaPaddingCheck starts checking that DAITA padding is sent to the
+// peer, if the check is enabled, replacing any pending check.
+func (peer *Peer) startDaitaPaddingCheck() {
+	check := &peer.daitaCheck
+	check.Lock()
+	defer check.Unlock()
+
+	check.stopLocked()
+	window := time.Duration(check.window.Load())
+	if window <= 0 {
+		return
+	}
+	generation := check.generation
+	transmitted := check.transmitted.Load()
+	check.timer = peer.device.options.clock.AfterFunc(window, func() {
+		peer.finishDaitaPaddingCheck(generation, transmitted, window)
+	})
+}
+
+// stopDaitaPaddingCheck cancels the pending DAITA padding check, if any.
+func (peer *Peer) stopDaitaPaddingCheck() {
+	check := &peer.daitaCheck
+	check.Lock()
+	defer check.Unlock()
+	check.stopLocked()
+}
+
+func (check *daitaPaddingCheck) stopLocked() {
+	check.generation++
+	if check.timer != nil {
+		check.timer.Stop()
+		check.timer = nil
+	}
+}
+
+func (peer *Peer) finishDaitaPaddingCheck(generation, transmitted uint64, window time.Duration) {
+	check := &peer.daitaCheck
+	check.Lock()
+	pending := check.generation == generation
+	if pending {
+		check.timer = nil
+	}
+	check.Unlock()
+
+	if !pending || check.transmitted.Load() != transmitted {
+		return
+	}
+	message := fmt.Sprintf("no DAITA padding sent within %v of enabling DAITA", window)
+	peer.device.log.Errorf("%v - %s", peer, message)
+	peer.device.notify(NotificationDaitaPaddingNotSent, peer, message)
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaitaPaddingCheck(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pub)
+
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "daita_padding_check", "20ms")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "daita_padding_check=20ms\n") {
+		t.Errorf("expected IpcGet to contain the padding check window, got:\n%s", cfg)
+	}
+
+	notSent := make(chan Notification, 4)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationDaitaPaddingNotSent {
+			notSent <- n
+		}
+	})()
+	expectNotification := func(want bool) {
+		t.Helper()
+		select {
+		case n := <-notSent:
+			if !want {
+				t.Errorf("unexpected notification: %s", n.Message)
+			} else if n.Peer != pub {
+				t.Errorf("notification for the wrong peer %x", n.Peer[:])
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Error("expected a notification")
+			}
+		}
+	}
+
+	peer.startDaitaPaddingCheck()
+	expectNotification(true)
+
+	peer.startDaitaPaddingCheck()
+	peer.daitaPaddingTransmitted()
+	expectNotification(false)
+
+	peer.startDaitaPaddingCheck()
+	peer.stopDaitaPaddingCheck()
+	expectNotification(false)
+
+	// A disabled check does not start.
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "daita_padding_check", "0s")); err != nil {
+		t.Fatal(err)
+	}
+	peer.startDaitaPaddingCheck()
+	expectNotification(false)
+}
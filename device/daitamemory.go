@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync/atomic"
+
+// daitaMemory accounts for the estimated memory of the DAITA state of the
+// peers of a device, such as their event queues and queued actions, against
+// the limit set with WithDaitaMemoryLimit, so that enabling DAITA for
+// thousands of peers cannot exhaust memory unnoticed.
+type daitaMemory struct {
+	limit uint64 // 0 for none, fixed at creation
+	used  atomic.Uint64
+}
+
+// WithDaitaMemoryLimit caps the estimated memory of the DAITA state of all
+// the peers of the device to limit bytes. Once the cap is reached, DAITA is
+// enabled with event queues shrunk down to DaitaMinEventsCapacity, and then
+// not at all, with a NotificationDaitaMemoryLimit.
+func WithDaitaMemoryLimit(limit uint64) Option {
+	return func(o *deviceOptions) {
+		o.daitaMemoryLimit = limit
+	}
+}
+
+// reserve reserves size bytes, giving up replaced bytes reserved before, and
+// reports whether the limit allows it. Shrinking a reservation always
+// succeeds.
+func (memory *daitaMemory) reserve(size, replaced uint64) bool {
+	for {
+		used := memory.used.Load()
+		next := used - replaced + size
+		if memory.limit != 0 && size > replaced && next > memory.limit {
+			return false
+		}
+		if memory.used.CompareAndSwap(used, next) {
+			return true
+		}
+	}
+}
+
+// release gives up size bytes reserved before.
+func (memory *daitaMemory) release(size uint64) {
+	memory.used.Add(^(size - 1))
+}
+
+// DaitaMemory returns the estimated memory of the DAITA state of the peers of
+// the device, in bytes, and its limit, 0 if there is none.
+func (device *Device) DaitaMemory() (used, limit uint64) {
+	return device.daitaMemory.used.Load(), device.daitaMemory.limit
+}
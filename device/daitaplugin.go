@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Embedders may plug in defenses of their own, such as research schedulers,
+// in place of the maybenot machines: SetDaita attaches a Daita to a running
+// peer, and the DaitaFactory set with WithDaitaFactory attaches one to every
+// peer as it starts. The Daita of a peer is told of the packets sent to and
+// received from it as the machines are, and pads and blocks the traffic with
+// SendDaitaPadding and BlockOutgoing. It is closed when the peer stops.
+
+// A DaitaFactory returns the Daita of peer as it starts, or nil to leave it
+// without one. It is called without any lock of the peer held.
+type DaitaFactory func(peer *Peer) (Daita, error)
+
+// WithDaitaFactory has factory create the Daita of each peer of the device
+// as it starts, unless DAITA is enabled for the peer through UAPI, which
+// takes its place. The factory is called again when DAITA is disabled for
+// the peer through UAPI.
+func WithDaitaFactory(factory DaitaFactory) Option {
+	return func(o *deviceOptions) {
+		o.daitaFactory = factory
+	}
+}
+
+// SetDaita attaches daita to the peer, which must be running, without DAITA
+// enabled. The peer closes daita when it stops, or when DAITA is disabled
+// for it. A nil daita disables DAITA for the peer.
+func (peer *Peer) SetDaita(daita Daita) error {
+	if daita == nil {
+		peer.disableDaita()
+		return nil
+	}
+
+	// Holding the state lock keeps the peer from stopping, and closing DAITA,
+	// before it is attached.
+	peer.state.Lock()
+	defer peer.state.Unlock()
+	peer.Lock()
+	defer peer.Unlock()
+
+	if !peer.isRunning.Load() {
+		return errors.New("peer is not running")
+	}
+	if peer.daita != nil {
+		return errors.New("DAITA is already active")
+	}
+	if !peer.device.Features().Has(FeatureDaita) {
+		return errors.New("DAITA feature is disabled")
+	}
+
+	peer.device.log.Verbosef("%v - DAITA: attached %T", peer, daita)
+	peer.daita = daita
+	peer.startDaitaPaddingCheck()
+	return nil
+}
+
+// startFactoryDaita attaches the Daita created by the DaitaFactory of the
+// device to the peer, if there is a factory.
+func (peer *Peer) startFactoryDaita() error {
+	factory := peer.device.options.daitaFactory
+	if factory == nil {
+		return nil
+	}
+	daita, err := factory(peer)
+	if err != nil || daita == nil {
+		return err
+	}
+	if err := peer.SetDaita(daita); err != nil {
+		daita.Close()
+		return err
+	}
+	return nil
+}
+
+// SendDaitaPadding sends a DAITA padding packet of size bytes, including the
+// DAITA header, to the peer. Padding that may bypass blocking is sent even
+// while the outgoing traffic of the peer is blocked with a bypassable
+// blocking. The Daita of the peer is not told of the padding, as it is the
+// one sending it.
+func (peer *Peer) SendDaitaPadding(size uint16, bypass bool) error {
+	if size < DaitaHeaderLen || size > uint16(peer.device.tun.mtu.Load()) {
+		return fmt.Errorf("invalid padding size %d bytes", size)
+	}
+	if !peer.isRunning.Load() {
+		return errors.New("peer is not running")
+	}
+
+	elem := peer.device.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+int(size)]
+	elem.bypass = bypass
+	elem.packet[0] = DaitaPaddingMarker
+	binary.BigEndian.PutUint16(elem.packet[DaitaOffsetTotalLength:DaitaOffsetTotalLength+2], size)
+	peer.StagePadding(elem)
+	peer.SendStagedPackets()
+	return nil
+}
+
+// BlockOutgoing blocks the outgoing traffic of the peer for duration, holding
+// the packets sent to it until the blocking ends. If bypass is set, padding
+// sent with SendDaitaPadding may bypass the blocking. An ongoing blocking is
+// only updated if replace is set, or if it would end sooner. onBegin is
+// called if the blocking begins or is updated, and onEnd when it ends by
+// itself, unless it is updated before. Both may be nil. The blocking ends
+// without calling onEnd when the peer stops or DAITA is disabled for it.
+func (peer *Peer) BlockOutgoing(duration time.Duration, bypass, replace bool, onBegin, onEnd func()) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid blocking duration %v", duration)
+	}
+	if !peer.isRunning.Load() {
+		return errors.New("peer is not running")
+	}
+	if onBegin == nil {
+		onBegin = func() {}
+	}
+	if onEnd == nil {
+		onEnd = func() {}
+	}
+	peer.blockOutgoing(duration, bypass, replace, onBegin, onEnd)
+	return nil
+}
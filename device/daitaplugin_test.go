@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// paddingDaita is a Daita sending one padding packet of testPaddingSize bytes
+// after the first packet sent, and counting the events of the peer.
+type paddingDaita struct {
+	nonpaddingSent     atomic.Uint64
+	nonpaddingReceived atomic.Uint64
+	paddingReceived    atomic.Uint64
+	closed             atomic.Bool
+	pad                sync.Once
+}
+
+const testPaddingSize = 100
+
+func (d *paddingDaita) Close() { d.closed.Store(true) }
+
+func (d *paddingDaita) NonpaddingSent(peer *Peer, packetLen uint) {
+	d.nonpaddingSent.Add(1)
+	d.pad.Do(func() {
+		go peer.SendDaitaPadding(testPaddingSize, false)
+	})
+}
+
+func (d *paddingDaita) NonpaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time) {
+	d.nonpaddingReceived.Add(1)
+}
+
+func (d *paddingDaita) PaddingSent(peer *Peer, packetLen uint, machineID uint64) {}
+
+func (d *paddingDaita) PaddingReceived(peer *Peer, packetLen uint, receivedAt time.Time) {
+	d.paddingReceived.Add(1)
+}
+
+func (d *paddingDaita) MachineLabels() []string { return nil }
+func (d *paddingDaita) EventQueue() QueueStat   { return QueueStat{} }
+func (d *paddingDaita) Stats() DaitaStats       { return DaitaStats{} }
+
+func TestDaitaFactory(t *testing.T) {
+	var daitas [2]*paddingDaita
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		return NewDeviceWithOptions(tun, bind, logger, WithDaitaFactory(func(peer *Peer) (Daita, error) {
+			daitas[i] = new(paddingDaita)
+			return daitas[i], nil
+		}))
+	})
+	if daitas[0] == nil || daitas[1] == nil {
+		t.Fatal("factory not called as the peers started")
+	}
+
+	pair.Send(t, Ping, nil)
+	if daitas[1].nonpaddingSent.Load() == 0 {
+		t.Error("sent packet not reported")
+	}
+	if daitas[0].nonpaddingReceived.Load() == 0 {
+		t.Error("received packet not reported")
+	}
+	for deadline := time.Now().Add(5 * time.Second); daitas[0].paddingReceived.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("padding not received")
+		}
+	}
+
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if err := peer.SetDaita(new(paddingDaita)); err == nil {
+		t.Error("attached a second Daita")
+	}
+	if err := peer.SendDaitaPadding(DaitaHeaderLen-1, false); err == nil {
+		t.Error("sent padding shorter than its header")
+	}
+	if err := peer.SetDaita(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !daitas[1].closed.Load() {
+		t.Error("detached Daita not closed")
+	}
+
+	replaced := new(paddingDaita)
+	if err := peer.SetDaita(replaced); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	if replaced.nonpaddingSent.Load() == 0 {
+		t.Error("sent packet not reported to the attached Daita")
+	}
+	pair[1].dev.Down()
+	if !replaced.closed.Load() {
+		t.Error("Daita not closed when the peer stopped")
+	}
+	if err := peer.SetDaita(new(paddingDaita)); err == nil {
+		t.Error("attached a Daita to a stopped peer")
+	}
+}
+
+func TestPeerBlockOutgoing(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+
+	ended := make(chan struct{})
+	if err := peer.BlockOutgoing(100*time.Millisecond, false, false, nil, func() { close(ended) }); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	pair.Send(t, Ping, nil)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("ping sent after %v while blocked", elapsed)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocking did not end")
+	}
+	if err := peer.BlockOutgoing(0, false, false, nil, nil); err == nil {
+		t.Error("blocked for no time")
+	}
+}
+
+func TestDaitaPaddingReceived(t *testing.T) {
+	var callbacks atomic.Uint64
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			return NewDevice(tun, bind, logger)
+		}
+		return NewDeviceWithOptions(tun, bind, logger,
+			WithDaitaFactory(func(peer *Peer) (Daita, error) {
+				return new(paddingDaita), nil
+			}),
+			WithDaitaPaddingReceived(func(peer *Peer, packetLen uint) {
+				if packetLen == testPaddingSize {
+					callbacks.Add(1)
+				}
+			}))
+	})
+	pair.Send(t, Ping, nil)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	for i := 0; i < 2; i++ {
+		if err := peer.SendDaitaPadding(testPaddingSize, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Padding claiming to be longer than it is.
+	elem := pair[1].dev.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+DaitaHeaderLen]
+	elem.packet[0] = DaitaPaddingMarker
+	elem.packet[DaitaOffsetTotalLength] = 0xff
+	peer.StagePadding(elem)
+	peer.SendStagedPackets()
+	pair.Send(t, Ping, nil)
+
+	for deadline := time.Now().Add(5 * time.Second); callbacks.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("callback called for %d padding packets, want 2", callbacks.Load())
+		}
+	}
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"rx_daita_padding=2", "rx_daita_padding_bytes=200", "rx_daita_padding_malformed=1"} {
+		if !regexp.MustCompile(`(?m)^` + want + `$`).MatchString(cfg) {
+			t.Errorf("IpcGet does not report %s:\n%s", want, cfg)
+		}
+	}
+}
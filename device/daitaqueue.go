@@ -0,0 +1,191 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// A daitaQueue holds what the machines of a peer have scheduled: their
+// padding and blocking, performed after a timeout, and the expiry of their
+// internal timers. A machine has at most one of each queued, which a later
+// one replaces. The queue is a heap ordered by when entries are due, which a
+// single goroutine works through, sleeping on a single daitaTimer until the
+// earliest entry is due, however many machines there are.
+type daitaQueue struct {
+	clock    Clock
+	wake     chan struct{} // signalled when the earliest entry may be due
+	timer    daitaTimer    // signals wake when the earliest entry is due
+	lateness daitaTimerStats
+
+	sync.Mutex
+	entries  daitaQueueHeap
+	byKey    map[daitaQueueKey]*daitaQueueEntry
+	seq      uint64    // of the latest entry, ordering entries due at the same time
+	timerDue time.Time // what the timer is armed for, zero if it is not
+}
+
+type daitaQueueKey struct {
+	machine  uint64
+	internal bool // the internal timer of the machine, not its padding or blocking
+}
+
+type daitaQueueEntry struct {
+	key   daitaQueueKey
+	due   time.Time
+	seq   uint64
+	run   func()
+	index int // in entries
+}
+
+func newDaitaQueue(clock Clock) *daitaQueue {
+	wake := make(chan struct{}, 1)
+	return &daitaQueue{
+		clock: clock,
+		wake:  wake,
+		timer: newDaitaTimer(clock, wake),
+		byKey: map[daitaQueueKey]*daitaQueueEntry{},
+	}
+}
+
+// put queues run to be called at due, replacing the entry of key, if any.
+func (queue *daitaQueue) put(key daitaQueueKey, due time.Time, run func()) {
+	queue.Lock()
+	defer queue.Unlock()
+	if entry, ok := queue.byKey[key]; ok {
+		heap.Remove(&queue.entries, entry.index)
+	}
+	queue.seq++
+	entry := &daitaQueueEntry{key: key, due: due, seq: queue.seq, run: run}
+	heap.Push(&queue.entries, entry)
+	queue.byKey[key] = entry
+	queue.armLocked()
+}
+
+// due returns when the entry of key is due, if it is queued.
+func (queue *daitaQueue) due(key daitaQueueKey) (time.Time, bool) {
+	queue.Lock()
+	defer queue.Unlock()
+	entry, ok := queue.byKey[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return entry.due, true
+}
+
+// remove cancels the entry of key, if it is queued. An entry that is already
+// being run is not waited for.
+func (queue *daitaQueue) remove(key daitaQueueKey) {
+	queue.Lock()
+	defer queue.Unlock()
+	if entry, ok := queue.byKey[key]; ok {
+		heap.Remove(&queue.entries, entry.index)
+		delete(queue.byKey, key)
+		queue.armLocked()
+	}
+}
+
+// run calls the entries of the queue as they fall due, in order, until ctx is
+// done, measuring how late they are.
+func (queue *daitaQueue) run(ctx context.Context) {
+	for {
+		due := queue.popDue()
+		if len(due) != 0 {
+			now := queue.clock.Now()
+			for _, entry := range due {
+				queue.lateness.record(now.Sub(entry.due))
+			}
+		}
+		for _, entry := range due {
+			entry.run()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.wake:
+		}
+	}
+}
+
+// stop drops the entries of the queue and releases its timer. It must only be
+// called once run has returned.
+func (queue *daitaQueue) stop() {
+	queue.Lock()
+	defer queue.Unlock()
+	queue.entries = nil
+	clear(queue.byKey)
+	queue.timer.close()
+	queue.timerDue = time.Time{}
+}
+
+func (queue *daitaQueue) popDue() []*daitaQueueEntry {
+	queue.Lock()
+	defer queue.Unlock()
+	// Having been woken, the timer may have expired, so it is armed again
+	// whatever it was armed for.
+	queue.timerDue = time.Time{}
+	var due []*daitaQueueEntry
+	now := queue.clock.Now()
+	for len(queue.entries) > 0 && !queue.entries[0].due.After(now) {
+		entry := heap.Pop(&queue.entries).(*daitaQueueEntry)
+		delete(queue.byKey, entry.key)
+		due = append(due, entry)
+	}
+	queue.armLocked()
+	return due
+}
+
+// armLocked sets the timer of the queue for its earliest entry.
+func (queue *daitaQueue) armLocked() {
+	if len(queue.entries) == 0 {
+		if !queue.timerDue.IsZero() {
+			queue.timer.cancel()
+			queue.timerDue = time.Time{}
+		}
+		return
+	}
+	if due := queue.entries[0].due; !queue.timerDue.Equal(due) {
+		queue.timerDue = due
+		queue.timer.set(due)
+	}
+}
+
+type daitaQueueHeap []*daitaQueueEntry
+
+func (h daitaQueueHeap) Len() int { return len(h) }
+
+func (h daitaQueueHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].due.Before(h[j].due)
+}
+
+func (h daitaQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *daitaQueueHeap) Push(x any) {
+	entry := x.(*daitaQueueEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *daitaQueueHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,78 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDaitaQueue checks that queued entries run in order of when they are
+// due, that entries are replaced and removed by key, and that the queue stops
+// with its context.
+func TestDaitaQueue(t *testing.T) {
+	queue := newDaitaQueue(systemClock{})
+	var mu sync.Mutex
+	var ran []daitaQueueKey
+	done := make(chan struct{})
+	put := func(key daitaQueueKey, after time.Duration) {
+		queue.put(key, time.Now().Add(after), func() {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, key)
+			if len(ran) == 3 {
+				close(done)
+			}
+		})
+	}
+
+	put(daitaQueueKey{machine: 1}, 10*time.Millisecond)
+	put(daitaQueueKey{machine: 2}, 5*time.Millisecond)
+	put(daitaQueueKey{machine: 3}, 20*time.Millisecond)
+	put(daitaQueueKey{machine: 1, internal: true}, 20*time.Millisecond)
+	put(daitaQueueKey{machine: 2}, 30*time.Millisecond)
+	queue.remove(daitaQueueKey{machine: 3})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		queue.run(ctx)
+		close(stopped)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued entries did not run")
+	}
+	want := []daitaQueueKey{{machine: 1}, {machine: 1, internal: true}, {machine: 2}}
+	mu.Lock()
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("entries ran in order %v, want %v", ran, want)
+	}
+	mu.Unlock()
+	if samples := queue.lateness.samples.Load(); samples != 3 {
+		t.Errorf("measured the lateness of %d entries, want 3", samples)
+	}
+
+	put(daitaQueueKey{machine: 4}, time.Hour)
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not stop with its context")
+	}
+	queue.stop()
+	if _, ok := queue.due(daitaQueueKey{machine: 4}); ok || !queue.timerDue.IsZero() {
+		t.Error("stopped queue still holds entries")
+	}
+}
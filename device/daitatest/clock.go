@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package daitatest
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// A Clock is a simulated device.Clock, whose time only moves when advanced.
+// Functions scheduled on it are called in order of their deadline, and in
+// order of scheduling for equal deadlines, by the goroutine advancing it.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers clockHeap
+	seq    uint64
+}
+
+var _ device.Clock = (*Clock)(nil)
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) device.ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	timer := &clockTimer{clock: c, when: c.now.Add(d), seq: c.seq, f: f}
+	heap.Push(&c.timers, timer)
+	return timer
+}
+
+// Pending returns the number of functions scheduled and not yet called.
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Step moves the clock to the earliest deadline at or before until, and calls
+// the function scheduled for it. It reports false, leaving the clock
+// unchanged, if no function is due by until.
+func (c *Clock) Step(until time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(until) {
+		c.mu.Unlock()
+		return false
+	}
+	timer := heap.Pop(&c.timers).(*clockTimer)
+	if timer.when.After(c.now) {
+		c.now = timer.when
+	}
+	c.mu.Unlock()
+	timer.f()
+	return true
+}
+
+// Advance moves the clock forward by d, calling the functions falling due on
+// the way, including those they schedule themselves.
+func (c *Clock) Advance(d time.Duration) {
+	until := c.Now().Add(d)
+	for c.Step(until) {
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until.After(c.now) {
+		c.now = until
+	}
+}
+
+type clockTimer struct {
+	clock *Clock
+	when  time.Time
+	seq   uint64
+	f     func()
+	index int // in clock.timers, or -1 once called or stopped
+}
+
+func (timer *clockTimer) Stop() bool {
+	c := timer.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timer.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, timer.index)
+	return true
+}
+
+type clockHeap []*clockTimer
+
+func (h clockHeap) Len() int { return len(h) }
+
+func (h clockHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h clockHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *clockHeap) Push(x any) {
+	timer := x.(*clockTimer)
+	timer.index = len(*h)
+	*h = append(*h, timer)
+}
+
+func (h *clockHeap) Pop() any {
+	old := *h
+	timer := old[len(old)-1]
+	old[len(old)-1] = nil
+	timer.index = -1
+	*h = old[:len(old)-1]
+	return timer
+}
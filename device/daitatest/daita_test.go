@@ -0,0 +1,52 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package daitatest
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestDaitaPadding runs the machines in WG_TEST_DAITA_MACHINES on device 0
+// and checks that the padding seen on the wire is the padding device 1
+// received, which it drops as DAITA is disabled on its side.
+func TestDaitaPadding(t *testing.T) {
+	machines := os.Getenv("WG_TEST_DAITA_MACHINES")
+	if machines == "" {
+		t.Skip("WG_TEST_DAITA_MACHINES is not set")
+	}
+	pair := NewPair(t)
+	pair.Send(t, 0, 100)
+	if err := pair.Peer(0).EnableDaita(machines, 1024, 1024, 0, 0); err != nil {
+		t.Fatalf("failed to enable DAITA: %v", err)
+	}
+	pair.Run(t, Periodic(0, 1000, 100, 10*time.Millisecond))
+	pair.Advance(time.Second)
+
+	transport := pair.Trace().From(0).Transport()
+	padding := len(transport) - pair.Sent(0)
+	fraction := pair.PaddingFraction(0)
+	t.Logf("%d transport messages, %d of them padding (%.1f%%) in %d bursts",
+		len(transport), padding, 100*fraction, len(transport.Bursts(5*time.Millisecond)))
+
+	cfg, err := pair.Device(1).IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := 0
+	if m := regexp.MustCompile(`rx_dropped_daita_marker=(\d+)`).FindStringSubmatch(cfg); m != nil {
+		received, _ = strconv.Atoi(m[1])
+	}
+	if received != padding {
+		t.Errorf("%d padding messages on the wire, but %d received", padding, received)
+	}
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package daitatest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewClock(start)
+	var calls []string
+	at := func(name string) func() {
+		return func() { calls = append(calls, name+"@"+clock.Now().Sub(start).String()) }
+	}
+	clock.AfterFunc(20*time.Millisecond, at("b"))
+	clock.AfterFunc(10*time.Millisecond, func() {
+		at("a")()
+		clock.AfterFunc(5*time.Millisecond, at("a2"))
+	})
+	clock.AfterFunc(20*time.Millisecond, at("c"))
+	stopped := clock.AfterFunc(15*time.Millisecond, at("stopped"))
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("expected only the first Stop to succeed")
+	}
+
+	clock.Advance(20 * time.Millisecond)
+	want := []string{"a@10ms", "a2@15ms", "b@20ms", "c@20ms"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+	if now := clock.Now().Sub(start); now != 20*time.Millisecond {
+		t.Errorf("expected the clock at 20ms, got %v", now)
+	}
+	if clock.Pending() != 0 {
+		t.Errorf("%d functions still pending", clock.Pending())
+	}
+}
+
+func TestTraceBursts(t *testing.T) {
+	trace := Trace{
+		{At: 0, Size: 100},
+		{At: time.Millisecond, Size: 200},
+		{At: 10 * time.Millisecond, Size: 300},
+		{At: 11 * time.Millisecond, Size: 400},
+		{At: 12 * time.Millisecond, Size: 500},
+	}
+	bursts := trace.Bursts(5 * time.Millisecond)
+	if len(bursts) != 2 || len(bursts[0]) != 2 || len(bursts[1]) != 3 {
+		t.Fatalf("unexpected bursts %v", bursts)
+	}
+	if bursts[1].Bytes() != 1200 {
+		t.Errorf("expected 1200 bytes in the second burst, got %d", bursts[1].Bytes())
+	}
+	if gaps := trace.Gaps(); gaps[1] != 9*time.Millisecond {
+		t.Errorf("unexpected gaps %v", gaps)
+	}
+}
+
+func TestPairWithoutDaita(t *testing.T) {
+	pair := NewPair(t)
+	pair.Run(t, Periodic(0, 500, 10, 100*time.Millisecond))
+
+	transport := pair.Trace().From(0).Transport()
+	if len(transport) != 10 {
+		t.Fatalf("expected 10 transport messages, got %d", len(transport))
+	}
+	if fraction := pair.PaddingFraction(0); fraction != 0 {
+		t.Errorf("expected no padding, got a fraction of %v", fraction)
+	}
+	for i, d := range transport {
+		if want := time.Duration(i+1) * 100 * time.Millisecond; d.At != want {
+			t.Errorf("message %d sent at %v, expected %v", i, d.At, want)
+		}
+		// Packets are padded to a multiple of 16 bytes.
+		if d.Size != 512+device.MessageTransportSize {
+			t.Errorf("message %d is %d bytes", i, d.Size)
+		}
+	}
+	if len(transport.Bursts(50*time.Millisecond)) != 10 {
+		t.Errorf("expected each message to be its own burst")
+	}
+	if handshakes := len(pair.Trace().From(0)) - len(pair.Trace().From(0).Transport()); handshakes == 0 {
+		t.Error("no handshake recorded")
+	}
+}
@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package daitatest runs a pair of devices on a simulated clock, sends
+// scripted traffic between them and records the datagrams on the wire, for
+// asserting the properties of the padding expected from maybenot machines.
+//
+// The clock schedules the padding actions of the machines, so padding is only
+// sent when the test advances it. The devices otherwise run in real time, and
+// so does the maybenot framework itself: machines whose state depends on the
+// time elapsed between events see the real time a test takes to run.
+package daitatest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// DefaultSettle is how long a Pair waits for its devices to go quiet before
+// advancing its clock.
+const DefaultSettle = 5 * time.Millisecond
+
+// A Pair is two devices peered over in-memory binds, device 0 at 10.0.0.1
+// and device 1 at 10.0.0.2.
+type Pair struct {
+	Clock *Clock
+
+	// Settle is how long no datagram is sent and no padding is scheduled
+	// for the devices to be considered quiet, DefaultSettle if 0.
+	Settle time.Duration
+
+	start   time.Time
+	devices [2]*device.Device
+	tuns    [2]*tuntest.ChannelTUN
+	keys    [2]device.NoisePublicKey
+
+	mu    sync.Mutex
+	trace Trace
+	sent  [2]int
+}
+
+// NewPair creates a pair of devices, closed when the test completes, with
+// opts applied to both of them along with WithClock.
+func NewPair(tb testing.TB, opts ...device.Option) *Pair {
+	tb.Helper()
+	start := time.Unix(0, 0)
+	p := &Pair{Clock: NewClock(start), start: start}
+
+	var private [2]device.NoisePrivateKey
+	for i := range private {
+		if _, err := rand.Read(private[i][:]); err != nil {
+			tb.Fatal(err)
+		}
+		private[i][0] &= 248
+		private[i][31] = (private[i][31] & 127) | 64
+		public, err := curve25519.X25519(private[i][:], curve25519.Basepoint)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		copy(p.keys[i][:], public)
+	}
+
+	binds := bindtest.NewChannelBinds()
+	opts = append(opts, device.WithClock(p.Clock))
+	for i := range p.devices {
+		p.tuns[i] = tuntest.NewChannelTUN()
+		bind := &recordingBind{Bind: binds[i], pair: p, from: i}
+		logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("dev%d: ", i))
+		dev := device.NewDeviceWithOptions(p.tuns[i].TUN(), bind, logger, opts...)
+		tb.Cleanup(dev.Close)
+		p.devices[i] = dev
+
+		// The in-memory bind of device i sends to port i+1.
+		if err := dev.IpcSet(fmt.Sprintf(""+
+			"private_key=%s\n"+
+			"public_key=%s\n"+
+			"endpoint=127.0.0.1:%d\n"+
+			"allowed_ip=%s/32\n",
+			hex.EncodeToString(private[i][:]),
+			hex.EncodeToString(p.keys[i^1][:]),
+			i+1,
+			p.addr(i^1),
+		)); err != nil {
+			tb.Fatalf("failed to configure device %d: %v", i, err)
+		}
+		if err := dev.Up(); err != nil {
+			tb.Fatalf("failed to bring up device %d: %v", i, err)
+		}
+	}
+	return p
+}
+
+func (p *Pair) addr(i int) string {
+	return fmt.Sprintf("10.0.0.%d", i+1)
+}
+
+// Device returns device i.
+func (p *Pair) Device(i int) *device.Device {
+	return p.devices[i]
+}
+
+// Peer returns the peer of device i, which is device i^1.
+func (p *Pair) Peer(i int) *device.Peer {
+	return p.devices[i].LookupPeer(p.keys[i^1])
+}
+
+// Send sends a packet of size bytes from device from to the other, and waits
+// for it to be delivered.
+func (p *Pair) Send(tb testing.TB, from, size int) {
+	tb.Helper()
+	packet := ipv4Packet(size, from+1, (from^1)+1)
+	p.tuns[from].Outbound <- packet
+	select {
+	case <-p.tuns[from^1].Inbound:
+	case <-time.After(5 * time.Second):
+		tb.Fatalf("packet from device %d was not delivered", from)
+	}
+	p.mu.Lock()
+	p.sent[from]++
+	p.mu.Unlock()
+}
+
+// Advance advances the clock by d once the devices are quiet, letting them go
+// quiet again after each padding action falling due.
+func (p *Pair) Advance(d time.Duration) {
+	until := p.Clock.Now().Add(d)
+	p.settle()
+	for p.Clock.Step(until) {
+		p.settle()
+	}
+	p.Clock.Advance(until.Sub(p.Clock.Now()))
+}
+
+// settle waits for the devices to send no datagram and schedule no padding
+// for p.Settle.
+func (p *Pair) settle() {
+	settle := p.Settle
+	if settle == 0 {
+		settle = DefaultSettle
+	}
+	observe := func() (int, int) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.trace), p.Clock.Pending()
+	}
+	for {
+		sent, pending := observe()
+		time.Sleep(settle)
+		if sentNow, pendingNow := observe(); sentNow == sent && pendingNow == pending {
+			return
+		}
+	}
+}
+
+// A Step of a Script waits After, then sends a packet of Size bytes from
+// device From.
+type Step struct {
+	After time.Duration
+	From  int
+	Size  int
+}
+
+type Script []Step
+
+// Periodic returns a script sending n packets of size bytes from device from,
+// one every interval.
+func Periodic(from, size, n int, interval time.Duration) Script {
+	script := make(Script, n)
+	for i := range script {
+		script[i] = Step{After: interval, From: from, Size: size}
+	}
+	return script
+}
+
+// Run plays script.
+func (p *Pair) Run(tb testing.TB, script Script) {
+	tb.Helper()
+	for _, step := range script {
+		p.Advance(step.After)
+		p.Send(tb, step.From, step.Size)
+	}
+}
+
+// Trace returns the datagrams sent so far.
+func (p *Pair) Trace() Trace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append(Trace(nil), p.trace...)
+}
+
+// Sent returns the number of packets sent by Send from device from.
+func (p *Pair) Sent(from int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sent[from]
+}
+
+// PaddingFraction returns the fraction of the transport messages sent by
+// device from which carried padding rather than packets sent by Send.
+func (p *Pair) PaddingFraction(from int) float64 {
+	transport := len(p.Trace().From(from).Transport())
+	if transport == 0 {
+		return 0
+	}
+	return float64(transport-p.Sent(from)) / float64(transport)
+}
+
+// ipv4Packet returns an IPv4 packet of size bytes, at least an IPv4 and a UDP
+// header, from 10.0.0.src to 10.0.0.dst.
+func ipv4Packet(size, src, dst int) []byte {
+	size = max(size, 28)
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(size))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], []byte{10, 0, 0, byte(src)})
+	copy(packet[16:20], []byte{10, 0, 0, byte(dst)})
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(packet[10:], ^uint16(sum))
+	binary.BigEndian.PutUint16(packet[24:], uint16(size-20))
+	return packet
+}
+
+// recordingBind records the datagrams sent through the bind of a device.
+type recordingBind struct {
+	conn.Bind
+	pair *Pair
+	from int
+}
+
+func (bind *recordingBind) Send(b []byte, ep conn.Endpoint) error {
+	d := Datagram{From: bind.from, Size: len(b)}
+	if len(b) >= 4 {
+		d.Type = binary.LittleEndian.Uint32(b)
+	}
+	p := bind.pair
+	p.mu.Lock()
+	d.At = p.Clock.Now().Sub(p.start)
+	p.trace = append(p.trace, d)
+	p.mu.Unlock()
+	return bind.Bind.Send(b, ep)
+}
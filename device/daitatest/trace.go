@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package daitatest
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// A Datagram is a datagram sent by one device of a Pair to the other, as seen
+// by an observer on the wire.
+type Datagram struct {
+	At   time.Duration // since the pair was created, on its Clock
+	From int           // index of the sending device
+	Type uint32        // message type, such as device.MessageTransportType
+	Size int
+}
+
+// A Trace is a sequence of datagrams, in the order they were sent.
+type Trace []Datagram
+
+// From returns the datagrams sent by device i.
+func (trace Trace) From(i int) Trace {
+	return trace.filter(func(d Datagram) bool { return d.From == i })
+}
+
+// Transport returns the transport messages carrying data or padding, leaving
+// out handshake messages and keepalives.
+func (trace Trace) Transport() Trace {
+	return trace.filter(func(d Datagram) bool {
+		return d.Type == device.MessageTransportType && d.Size > device.MessageKeepaliveSize
+	})
+}
+
+func (trace Trace) filter(keep func(Datagram) bool) Trace {
+	var filtered Trace
+	for _, d := range trace {
+		if keep(d) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// Sizes returns the size of each datagram.
+func (trace Trace) Sizes() []int {
+	sizes := make([]int, len(trace))
+	for i, d := range trace {
+		sizes[i] = d.Size
+	}
+	return sizes
+}
+
+// Bytes returns the total size of the datagrams.
+func (trace Trace) Bytes() int {
+	total := 0
+	for _, d := range trace {
+		total += d.Size
+	}
+	return total
+}
+
+// Gaps returns the time between each datagram and the next.
+func (trace Trace) Gaps() []time.Duration {
+	if len(trace) < 2 {
+		return nil
+	}
+	gaps := make([]time.Duration, len(trace)-1)
+	for i := range gaps {
+		gaps[i] = trace[i+1].At - trace[i].At
+	}
+	return gaps
+}
+
+// Bursts splits the trace wherever more than gap separates two datagrams.
+func (trace Trace) Bursts(gap time.Duration) []Trace {
+	var bursts []Trace
+	start := 0
+	for i := 1; i <= len(trace); i++ {
+		if i == len(trace) || trace[i].At-trace[i-1].At > gap {
+			bursts = append(bursts, trace[start:i])
+			start = i
+		}
+	}
+	return bursts
+}
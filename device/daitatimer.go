@@ -0,0 +1,124 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A daitaTimer wakes the queue of a peer when its earliest entry is due, by
+// signalling its wake channel without blocking. The timer of time.AfterFunc
+// may fire a millisecond or more late, and 15.6ms late on Windows, which
+// distorts the timing of padding that machines schedule a few hundred
+// microseconds ahead. Where the OS offers a high-resolution timer the queue
+// can wait on without spinning, it is used instead, and the lateness of the
+// queue is measured either way, as DaitaStats reports.
+type daitaTimer interface {
+	// set arms the timer for due, replacing when it was armed for.
+	set(due time.Time)
+	// cancel disarms the timer.
+	cancel()
+	// close disarms the timer and releases its resources. It returns once
+	// the timer will no longer signal.
+	close()
+}
+
+// newDaitaTimer returns a timer signalling wake. The system clock gets a
+// high-resolution timer, if the OS has one, and other clocks, such as those
+// of tests, a timer of the clock.
+func newDaitaTimer(clock Clock, wake chan<- struct{}) daitaTimer {
+	if _, ok := clock.(systemClock); ok {
+		if timer, err := newPreciseDaitaTimer(wake); err == nil {
+			return timer
+		}
+	}
+	return &clockDaitaTimer{clock: clock, wake: wake}
+}
+
+// wakeQueue wakes the queue, unless it is already to be woken.
+func wakeQueue(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// clockDaitaTimer is a daitaTimer on the AfterFunc of a clock.
+type clockDaitaTimer struct {
+	clock Clock
+	wake  chan<- struct{}
+
+	sync.Mutex
+	timer      ClockTimer
+	generation uint64 // of the timer, changed when it is replaced
+}
+
+func (timer *clockDaitaTimer) set(due time.Time) {
+	timer.Lock()
+	defer timer.Unlock()
+	timer.stopLocked()
+	generation := timer.generation
+	timer.timer = timer.clock.AfterFunc(due.Sub(timer.clock.Now()), func() {
+		timer.Lock()
+		current := timer.generation == generation
+		timer.Unlock()
+		if current {
+			wakeQueue(timer.wake)
+		}
+	})
+}
+
+func (timer *clockDaitaTimer) cancel() {
+	timer.Lock()
+	defer timer.Unlock()
+	timer.stopLocked()
+}
+
+func (timer *clockDaitaTimer) close() {
+	timer.cancel()
+}
+
+func (timer *clockDaitaTimer) stopLocked() {
+	timer.generation++
+	if timer.timer != nil {
+		timer.timer.Stop()
+		timer.timer = nil
+	}
+}
+
+// daitaTimerStats measure how late the entries of a queue run after they are
+// due.
+type daitaTimerStats struct {
+	samples atomic.Uint64
+	total   atomic.Int64 // nanoseconds
+	max     atomic.Int64 // nanoseconds
+}
+
+func (stats *daitaTimerStats) record(lateness time.Duration) {
+	lateness = max(lateness, 0)
+	stats.samples.Add(1)
+	stats.total.Add(int64(lateness))
+	for {
+		old := stats.max.Load()
+		if int64(lateness) <= old || stats.max.CompareAndSwap(old, int64(lateness)) {
+			return
+		}
+	}
+}
+
+// mean returns the mean lateness, or 0 before any entry ran.
+func (stats *daitaTimerStats) mean() time.Duration {
+	samples := stats.samples.Load()
+	if samples == 0 {
+		return 0
+	}
+	return time.Duration(stats.total.Load() / int64(samples))
+}
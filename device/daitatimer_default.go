@@ -0,0 +1,16 @@
+//go:build daita && !linux && !windows
+// +build daita,!linux,!windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "errors"
+
+// newPreciseDaitaTimer fails, so that the timers of the runtime are used.
+func newPreciseDaitaTimer(wake chan<- struct{}) (daitaTimer, error) {
+	return nil, errors.New("no high-resolution timer")
+}
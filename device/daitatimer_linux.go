@@ -0,0 +1,84 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// timerfdDaitaTimer is a daitaTimer on a timerfd, which expires with the
+// resolution of the high-resolution timers of the kernel. The runtime polls
+// it like a socket, so waiting for it takes no thread.
+type timerfdDaitaTimer struct {
+	file *os.File
+	conn syscall.RawConn
+	wake chan<- struct{}
+	done chan struct{} // closed when the reader has returned
+}
+
+func newPreciseDaitaTimer(wake chan<- struct{}) (daitaTimer, error) {
+	fd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "timerfd")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	timer := &timerfdDaitaTimer{file: file, conn: conn, wake: wake, done: make(chan struct{})}
+	go timer.read()
+	return timer, nil
+}
+
+// read signals wake whenever the timer expires, until it is closed.
+func (timer *timerfdDaitaTimer) read() {
+	defer close(timer.done)
+	var expirations [8]byte
+	for {
+		if _, err := timer.file.Read(expirations[:]); err != nil {
+			return
+		}
+		wakeQueue(timer.wake)
+	}
+}
+
+func (timer *timerfdDaitaTimer) settime(spec *unix.ItimerSpec) error {
+	var err error
+	if controlErr := timer.conn.Control(func(fd uintptr) {
+		err = unix.TimerfdSettime(int(fd), 0, spec, nil)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+func (timer *timerfdDaitaTimer) set(due time.Time) {
+	// A zero value would disarm the timer rather than expire it right away.
+	spec := unix.ItimerSpec{Value: unix.NsecToTimespec(int64(max(time.Until(due), 1)))}
+	if timer.settime(&spec) != nil {
+		// Rather than stall the queue, let it run what is due and arm the
+		// timer again.
+		wakeQueue(timer.wake)
+	}
+}
+
+func (timer *timerfdDaitaTimer) cancel() {
+	timer.settime(&unix.ItimerSpec{})
+}
+
+func (timer *timerfdDaitaTimer) close() {
+	timer.file.Close()
+	<-timer.done
+}
@@ -0,0 +1,47 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDaitaTimer checks that the timer of the system clock wakes its queue
+// once it is due, not before, and not once cancelled or replaced.
+func TestDaitaTimer(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	timer := newDaitaTimer(systemClock{}, wake)
+	defer timer.close()
+	t.Logf("timer %T", timer)
+
+	for _, after := range []time.Duration{0, 300 * time.Microsecond, 2 * time.Millisecond} {
+		due := time.Now().Add(after)
+		timer.set(due)
+		select {
+		case <-wake:
+			if woken := time.Now(); woken.Before(due) {
+				t.Errorf("woken %v early", due.Sub(woken))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not woken %v after being due", 5*time.Second)
+		}
+	}
+
+	timer.set(time.Now().Add(time.Hour))
+	timer.set(time.Now().Add(10 * time.Millisecond))
+	timer.set(time.Now().Add(time.Hour))
+	timer.set(time.Now().Add(10 * time.Millisecond))
+	timer.cancel()
+	select {
+	case <-wake:
+		t.Error("woken by a cancelled timer")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,90 @@
+//go:build daita
+// +build daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modkernel32                = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateWaitableTimerExW = modkernel32.NewProc("CreateWaitableTimerExW")
+	procSetWaitableTimer       = modkernel32.NewProc("SetWaitableTimer")
+	procCancelWaitableTimer    = modkernel32.NewProc("CancelWaitableTimer")
+)
+
+const (
+	createWaitableTimerHighResolution = 0x00000002
+	timerAllAccess                    = 0x001f0003
+)
+
+// waitableDaitaTimer is a daitaTimer on a high-resolution waitable timer,
+// which Windows 10 1803 and later have, and which expires with a resolution
+// finer than the 15.6ms of the timers of the runtime.
+type waitableDaitaTimer struct {
+	timer windows.Handle
+	stop  windows.Handle // event set by close
+	wake  chan<- struct{}
+	done  chan struct{} // closed when the waiter has returned
+}
+
+func newPreciseDaitaTimer(wake chan<- struct{}) (daitaTimer, error) {
+	if err := procCreateWaitableTimerExW.Find(); err != nil {
+		return nil, err
+	}
+	handle, _, err := procCreateWaitableTimerExW.Call(0, 0, createWaitableTimerHighResolution, timerAllAccess)
+	if handle == 0 {
+		return nil, err
+	}
+	stop, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(windows.Handle(handle))
+		return nil, err
+	}
+	timer := &waitableDaitaTimer{timer: windows.Handle(handle), stop: stop, wake: wake, done: make(chan struct{})}
+	go timer.wait()
+	return timer, nil
+}
+
+// wait signals wake whenever the timer expires, until it is closed.
+func (timer *waitableDaitaTimer) wait() {
+	defer close(timer.done)
+	handles := []windows.Handle{timer.timer, timer.stop}
+	for {
+		event, err := windows.WaitForMultipleObjects(handles, false, windows.INFINITE)
+		if err != nil || event != windows.WAIT_OBJECT_0 {
+			return
+		}
+		wakeQueue(timer.wake)
+	}
+}
+
+func (timer *waitableDaitaTimer) set(due time.Time) {
+	// Negative due times are relative, in units of 100ns.
+	dueTime := -max(int64(time.Until(due)/100), 1)
+	if ok, _, _ := procSetWaitableTimer.Call(uintptr(timer.timer), uintptr(unsafe.Pointer(&dueTime)), 0, 0, 0, 0); ok == 0 {
+		// Rather than stall the queue, let it run what is due and arm the
+		// timer again.
+		wakeQueue(timer.wake)
+	}
+}
+
+func (timer *waitableDaitaTimer) cancel() {
+	procCancelWaitableTimer.Call(uintptr(timer.timer))
+}
+
+func (timer *waitableDaitaTimer) close() {
+	windows.SetEvent(timer.stop)
+	<-timer.done
+	windows.CloseHandle(timer.timer)
+	windows.CloseHandle(timer.stop)
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A DaitaTraceFormat is the format of the records written by WithDaitaTrace.
+// A record is either an event handled by the machines of a peer, or an action
+// of one of the machines, with:
+//
+//	time      when the event was handled or the action taken, on the clock of the device
+//	peer      public key of the peer
+//	kind      event or action
+//	type      EventType or ActionType
+//	machine   machine of the event or action, as numbered in daita_machine
+//	size      bytes sent or received for an event, or of padding to inject for an action
+//	timeout   after which a padding or blocking action is performed
+//	duration  of the blocking or timer set by an action
+type DaitaTraceFormat int
+
+const (
+	// DaitaTraceCSV writes a header line, then a line per record:
+	//
+	//	time_ns,peer,kind,type,machine,size,timeout_ns,duration_ns
+	//
+	// where time_ns is in Unix nanoseconds, peer is in hex, kind is "event"
+	// or "action", and type is the name of the event or action type.
+	DaitaTraceCSV DaitaTraceFormat = iota
+
+	// DaitaTraceBinary writes each record as DaitaTraceRecordSize bytes, all
+	// little-endian: time in Unix nanoseconds (int64), peer (32 bytes),
+	// machine (uint64), timeout and duration in nanoseconds (int64), size
+	// (uint16), kind (uint8, 0 for an event and 1 for an action) and type
+	// (uint8).
+	DaitaTraceBinary
+)
+
+// DaitaTraceRecordSize is the size of a record in the DaitaTraceBinary format.
+const DaitaTraceRecordSize = 8 + NoisePublicKeySize + 8 + 8 + 8 + 2 + 1 + 1
+
+func (format DaitaTraceFormat) String() string {
+	switch format {
+	case DaitaTraceCSV:
+		return "csv"
+	case DaitaTraceBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("DaitaTraceFormat(%d)", int(format))
+}
+
+// WithDaitaTrace records every DAITA event handled by the machines of the
+// peers of the device, and every action of the machines, to w in format, so
+// that machines can be validated against the traffic of the device. Records
+// are written one at a time, in order, and tracing stops at the first error
+// writing to w.
+func WithDaitaTrace(w io.Writer, format DaitaTraceFormat) Option {
+	return func(o *deviceOptions) {
+		if w != nil {
+			o.daitaTrace = &daitaTrace{w: w, format: format}
+		}
+	}
+}
+
+type daitaTrace struct {
+	sync.Mutex
+	w       io.Writer
+	format  DaitaTraceFormat
+	started bool // the CSV header has been written
+	failed  bool // writing failed, so tracing stopped
+}
+
+type daitaTraceRecord struct {
+	time     time.Time
+	peer     NoisePublicKey
+	action   bool
+	typ      uint8
+	typeName string
+	machine  uint64
+	size     uint16
+	timeout  time.Duration
+	duration time.Duration
+}
+
+// write writes record to the trace. The first error is logged, after which
+// nothing more is written.
+func (trace *daitaTrace) write(logger *Logger, record daitaTraceRecord) {
+	trace.Lock()
+	defer trace.Unlock()
+	if trace.failed {
+		return
+	}
+
+	var buf []byte
+	switch trace.format {
+	case DaitaTraceBinary:
+		buf = make([]byte, 0, DaitaTraceRecordSize)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(record.time.UnixNano()))
+		buf = append(buf, record.peer[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, record.machine)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(record.timeout))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(record.duration))
+		buf = binary.LittleEndian.AppendUint16(buf, record.size)
+		kind := byte(0)
+		if record.action {
+			kind = 1
+		}
+		buf = append(buf, kind, record.typ)
+	default:
+		if !trace.started {
+			buf = append(buf, "time_ns,peer,kind,type,machine,size,timeout_ns,duration_ns\n"...)
+		}
+		kind := "event"
+		if record.action {
+			kind = "action"
+		}
+		buf = fmt.Appendf(buf, "%d,%s,%s,%s,%d,%d,%d,%d\n", record.time.UnixNano(), hex.EncodeToString(record.peer[:]),
+			kind, record.typeName, record.machine, record.size, record.timeout.Nanoseconds(), record.duration.Nanoseconds())
+	}
+
+	if _, err := trace.w.Write(buf); err != nil {
+		trace.failed = true
+		logger.Errorf("DAITA: failed to write trace, tracing stopped: %v", err)
+		return
+	}
+	trace.started = true
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{ writes int }
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	w.writes++
+	return 0, errors.New("disk full")
+}
+
+func TestDaitaTraceFormats(t *testing.T) {
+	logger := NewLogger(LogLevelSilent, "")
+	record := daitaTraceRecord{
+		time:     time.Unix(1, 500),
+		peer:     NoisePublicKey{0xab},
+		action:   true,
+		typ:      2,
+		typeName: "BlockOutgoing",
+		machine:  3,
+		size:     0,
+		timeout:  time.Millisecond,
+		duration: time.Second,
+	}
+
+	var csv bytes.Buffer
+	trace := &daitaTrace{w: &csv, format: DaitaTraceCSV}
+	trace.write(logger, record)
+	trace.write(logger, daitaTraceRecord{time: time.Unix(2, 0), typeName: "NonpaddingSent", size: 1420})
+	lines := strings.Split(strings.TrimSuffix(csv.String(), "\n"), "\n")
+	want := []string{
+		"time_ns,peer,kind,type,machine,size,timeout_ns,duration_ns",
+		"1000000500,ab" + strings.Repeat("00", NoisePublicKeySize-1) + ",action,BlockOutgoing,3,0,1000000,1000000000",
+		"2000000000," + strings.Repeat("00", NoisePublicKeySize) + ",event,NonpaddingSent,0,1420,0,0",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), csv.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d is %q, want %q", i, lines[i], want[i])
+		}
+	}
+
+	var bin bytes.Buffer
+	trace = &daitaTrace{w: &bin, format: DaitaTraceBinary}
+	trace.write(logger, record)
+	b := bin.Bytes()
+	if len(b) != DaitaTraceRecordSize {
+		t.Fatalf("got a record of %d bytes, want %d", len(b), DaitaTraceRecordSize)
+	}
+	if at := binary.LittleEndian.Uint64(b); at != 1000000500 {
+		t.Errorf("got time %d", at)
+	}
+	if b[8] != 0xab {
+		t.Errorf("got peer %x", b[8:8+NoisePublicKeySize])
+	}
+	rest := b[8+NoisePublicKeySize:]
+	if machine := binary.LittleEndian.Uint64(rest); machine != 3 {
+		t.Errorf("got machine %d", machine)
+	}
+	if duration := binary.LittleEndian.Uint64(rest[16:]); duration != uint64(time.Second) {
+		t.Errorf("got duration %d", duration)
+	}
+	if kind, typ := rest[26], rest[27]; kind != 1 || typ != 2 {
+		t.Errorf("got kind %d and type %d", kind, typ)
+	}
+
+	// Tracing stops at the first error.
+	failing := &failingWriter{}
+	trace = &daitaTrace{w: failing, format: DaitaTraceCSV}
+	trace.write(logger, record)
+	trace.write(logger, record)
+	if failing.writes != 1 {
+		t.Errorf("got %d writes after an error, want 1", failing.writes)
+	}
+}
@@ -0,0 +1,300 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+const (
+	DefaultDaitaEventsCapacity  = 1024
+	DefaultDaitaActionsCapacity = 1024
+)
+
+var errDaitaNotSupported = errors.New("built without DAITA support")
+
+// peerDaitaConfig is the DAITA configuration of a peer set through UAPI, with
+// the "daita" key and the "daita_" keys of the arguments of EnableDaita. It is
+// applied at the end of each IpcSet of the peer that changes it, and again
+// whenever the device comes up, as DAITA is stopped along with the peer.
+//
+// The machines of "daita_machines" see both directions of traffic, while
+// those of "daita_sent_machines" and "daita_received_machines" only see the
+// packets sent to and received from the peer, as with EnableDaitaDirectional.
+// Each set runs with its own padding and blocking budgets, both limited by
+// the fractions configured.
+type peerDaitaConfig struct {
+	enabled          bool
+	machines         []string // one machine per "daita_machines" line
+	sentMachines     []string // one machine per "daita_sent_machines" line
+	receivedMachines []string // one machine per "daita_received_machines" line
+	eventsCapacity   uint
+	actionsCapacity  uint
+	maxPaddingFrac   float64
+	maxBlockingFrac  float64
+}
+
+// machineList returns the machines configured with key, one of the
+// "daita_*machines" keys.
+func (config *peerDaitaConfig) machineList(key string) *[]string {
+	switch key {
+	case "daita_sent_machines":
+		return &config.sentMachines
+	case "daita_received_machines":
+		return &config.receivedMachines
+	}
+	return &config.machines
+}
+
+// hasMachines reports whether any machine is configured, in either direction.
+func (config *peerDaitaConfig) hasMachines() bool {
+	return len(config.machines) != 0 || len(config.sentMachines) != 0 || len(config.receivedMachines) != 0
+}
+
+// machineSet returns machines as a set with the budgets of config.
+func (config *peerDaitaConfig) machineSet(machines []string) DaitaMachines {
+	return DaitaMachines{
+		Machines:        strings.Join(machines, "\n"),
+		MaxPaddingFrac:  config.maxPaddingFrac,
+		MaxBlockingFrac: config.maxBlockingFrac,
+	}
+}
+
+func defaultDaitaConfig() peerDaitaConfig {
+	return peerDaitaConfig{
+		eventsCapacity:  DefaultDaitaEventsCapacity,
+		actionsCapacity: DefaultDaitaActionsCapacity,
+	}
+}
+
+// SetDefaultDaita enables DAITA, running machines with the default
+// capacities, for the peers created by later configuration through UAPI, with
+// the padding and blocking limits of EnableDaita. They can still disable it
+// with the "daita" key. Passing no machines stops enabling DAITA for new
+// peers.
+func (device *Device) SetDefaultDaita(machines []string, maxPaddingFrac, maxBlockingFrac float64) error {
+	if len(machines) == 0 {
+		device.daitaDefault.Store(nil)
+		return nil
+	}
+	if !daitaSupported {
+		return errDaitaNotSupported
+	}
+	if err := device.requireFeature(FeatureDaita); err != nil {
+		return err
+	}
+	config := defaultDaitaConfig()
+	config.enabled = true
+	for _, frac := range []float64{maxPaddingFrac, maxBlockingFrac} {
+		if err := checkDaitaFrac(frac); err != nil {
+			return err
+		}
+	}
+	config.maxPaddingFrac = maxPaddingFrac
+	config.maxBlockingFrac = maxBlockingFrac
+	for _, value := range machines {
+		machine, err := parseDaitaMachine(value)
+		if err != nil {
+			return err
+		}
+		config.machines = append(config.machines, machine)
+	}
+	device.daitaDefault.Store(&config)
+	return nil
+}
+
+func parseDaitaFrac(value string) (float64, error) {
+	frac, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return frac, checkDaitaFrac(frac)
+}
+
+// checkDaitaFrac checks that frac is a valid padding or blocking limit.
+func checkDaitaFrac(frac float64) error {
+	if !(frac >= 0 && frac <= 1) {
+		return fmt.Errorf("fraction %v out of range [0, 1]", frac)
+	}
+	return nil
+}
+
+// parseDaitaMachine parses a single maybenot machine, which must be supported
+// by the maybenot linked in.
+func parseDaitaMachine(value string) (string, error) {
+	machine := strings.TrimSpace(value)
+	if machine == "" {
+		return "", errors.New("empty machine")
+	}
+	if err := validateDaitaMachine(machine); err != nil {
+		return "", err
+	}
+	return machine, nil
+}
+
+// handleDaitaLine updates the pending DAITA configuration of the peer with a
+// "daita" or "daita_" UAPI key. The first line of each of the
+// "daita_*machines" keys in an IpcSet replaces the machines configured before
+// with the key.
+func (peer *ipcSetPeer) handleDaitaLine(device *Device, key, value string) error {
+	if peer.pendingDaita == nil {
+		peer.RLock()
+		config := peer.daitaConfig
+		peer.RUnlock()
+		peer.pendingDaita = &config
+		peer.pendingDaitaReplaced = nil
+	}
+	config := peer.pendingDaita
+
+	switch key {
+	case "daita":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set daita, invalid value: %v", value)
+		}
+		if enabled {
+			if !daitaSupported {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set daita: %w", errDaitaNotSupported)
+			}
+			if err := device.requireFeature(FeatureDaita); err != nil {
+				return err
+			}
+		}
+		config.enabled = enabled
+
+	case "daita_machines", "daita_sent_machines", "daita_received_machines":
+		machine, err := parseDaitaMachine(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+		}
+		machines := config.machineList(key)
+		if !peer.pendingDaitaReplaced[key] {
+			*machines = nil
+			if peer.pendingDaitaReplaced == nil {
+				peer.pendingDaitaReplaced = make(map[string]bool)
+			}
+			peer.pendingDaitaReplaced[key] = true
+		}
+		*machines = append(*machines, machine)
+
+	case "daita_events_capacity", "daita_actions_capacity":
+		capacity, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+		}
+		if key == "daita_events_capacity" {
+			config.eventsCapacity = uint(capacity)
+		} else {
+			config.actionsCapacity = uint(capacity)
+		}
+
+	case "daita_max_padding_frac", "daita_max_blocking_frac":
+		frac, err := parseDaitaFrac(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+		}
+		if key == "daita_max_padding_frac" {
+			config.maxPaddingFrac = frac
+		} else {
+			config.maxBlockingFrac = frac
+		}
+	}
+	return nil
+}
+
+// applyPendingDaita stores the DAITA configuration changed by the IpcSet of
+// the peer, and restarts DAITA with it if the peer is running.
+func (peer *ipcSetPeer) applyPendingDaita() error {
+	config := peer.pendingDaita
+	if config == nil {
+		return nil
+	}
+	peer.pendingDaita = nil
+
+	peer.Lock()
+	peer.daitaConfig = *config
+	peer.Unlock()
+
+	peer.device.log.Verbosef("%v - UAPI: Updating DAITA", peer.Peer)
+	peer.disableDaita()
+	if !peer.isRunning.Load() {
+		return nil
+	}
+	if err := peer.startConfiguredDaita(); err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "failed to enable DAITA: %w", err)
+	}
+	return nil
+}
+
+// startConfiguredDaita enables DAITA for the peer as configured through UAPI,
+// if it is enabled there, and otherwise attaches the Daita of the DaitaFactory
+// of the device, if any.
+func (peer *Peer) startConfiguredDaita() error {
+	peer.RLock()
+	config := peer.daitaConfig
+	peer.RUnlock()
+	if !config.enabled {
+		return peer.startFactoryDaita()
+	}
+	if !config.hasMachines() {
+		return errors.New("no machines configured")
+	}
+	both := config.machineSet(config.machines)
+	sent := config.machineSet(config.sentMachines)
+	received := config.machineSet(config.receivedMachines)
+	if err := peer.enableDaitaMachines(both, sent, received, config.eventsCapacity, config.actionsCapacity); err != nil {
+		return fmt.Errorf("failed to start machines: %w", err)
+	}
+	return nil
+}
+
+// disableDaita stops DAITA for the peer, if it is running.
+func (peer *Peer) disableDaita() {
+	peer.state.Lock()
+	defer peer.state.Unlock()
+
+	if peer.daita == nil {
+		return
+	}
+	peer.stopDaitaPaddingCheck()
+	daita := peer.daita
+	peer.daita = nil
+	daita.Close()
+	peer.endDaitaBlocking()
+	peer.SendStagedPackets()
+	peer.device.notify(NotificationDaitaClosed, peer, "DAITA stopped")
+}
+
+// ipcDaitaConfig serializes the DAITA configuration of the peer for IpcGet.
+// The caller must hold the read lock of the peer.
+func ipcDaitaConfig(sendf func(string, ...any), config *peerDaitaConfig) {
+	if !config.enabled {
+		return
+	}
+	sendf("daita=true")
+	for _, key := range []string{"daita_machines", "daita_sent_machines", "daita_received_machines"} {
+		for _, machine := range *config.machineList(key) {
+			sendf("%s=%s", key, machine)
+		}
+	}
+	if config.eventsCapacity != DefaultDaitaEventsCapacity {
+		sendf("daita_events_capacity=%d", config.eventsCapacity)
+	}
+	if config.actionsCapacity != DefaultDaitaActionsCapacity {
+		sendf("daita_actions_capacity=%d", config.actionsCapacity)
+	}
+	if config.maxPaddingFrac != 0 {
+		sendf("daita_max_padding_frac=%s", strconv.FormatFloat(config.maxPaddingFrac, 'g', -1, 64))
+	}
+	if config.maxBlockingFrac != 0 {
+		sendf("daita_max_blocking_frac=%s", strconv.FormatFloat(config.maxBlockingFrac, 'g', -1, 64))
+	}
+}
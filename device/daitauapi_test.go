@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestDaitaUAPIValidation(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	for _, c := range [][]string{
+		{"daita_max_padding_frac", "1.5"},
+		{"daita_max_blocking_frac", "-0.1"},
+		{"daita_events_capacity", "-1"},
+		{"daita_machines", " "},
+	} {
+		var ipcErr *IPCError
+		err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), c[0], c[1]))
+		if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+			t.Errorf("%s=%s: expected IpcErrorInvalid, got %v", c[0], c[1], err)
+		}
+	}
+
+	if daitaSupported {
+		return
+	}
+	var ipcErr *IPCError
+	err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "daita", "true"))
+	if !errors.As(err, &ipcErr) || !errors.Is(err, errDaitaNotSupported) {
+		t.Errorf("expected enabling DAITA to fail without DAITA support, got %v", err)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "daita", "false")); err != nil {
+		t.Errorf("disabling DAITA failed: %v", err)
+	}
+}
+
+func TestDefaultDaitaValidation(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	if err := dev.SetDefaultDaita(nil, 0, 0); err != nil {
+		t.Errorf("clearing the default DAITA failed: %v", err)
+	}
+	err := dev.SetDefaultDaita([]string{" "}, 0, 0)
+	if daitaSupported && err == nil {
+		t.Error("expected an empty machine to fail")
+	}
+	if !daitaSupported && !errors.Is(err, errDaitaNotSupported) {
+		t.Errorf("expected enabling DAITA to fail without DAITA support, got %v", err)
+	}
+	err = dev.SetDefaultDaita([]string{" "}, 0, 1.5)
+	if daitaSupported && (err == nil || !strings.Contains(err.Error(), "out of range")) {
+		t.Errorf("expected a blocking limit above 1 to fail, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dedupMaxPackets is the number of packets a dedup window remembers at most.
+// Beyond it, the oldest packets are forgotten before their time is up.
+const dedupMaxPackets = 4096
+
+// peerDedup drops inner packets identical to one received from the peer within
+// a short window, configured with the "dedup_window" UAPI key. The replay
+// filter already drops copies of a transport packet, such as those sent in
+// multipath mode, but not packets duplicated before encryption, which would
+// otherwise reach the TUN device twice and confuse inner TCP stacks.
+//
+// TCP retransmissions are also identical to the original packet, so the
+// window must stay well below the smallest retransmission timeout, 200ms on
+// Linux.
+type peerDedup struct {
+	window  atomic.Int64 // a time.Duration, 0 if disabled
+	dropped atomic.Uint64
+
+	sync.Mutex // protects the fields below
+	seed       maphash.Seed
+	seen       map[uint64]struct{} // hashes of the packets in order
+	order      []dedupPacket       // ring of the packets remembered, oldest at head
+	head       int
+	n          int
+}
+
+type dedupPacket struct {
+	hash uint64
+	at   int64
+}
+
+// setWindow sets the dedup window, disabling deduplication if it is 0.
+func (dedup *peerDedup) setWindow(window time.Duration) {
+	dedup.Lock()
+	defer dedup.Unlock()
+	dedup.window.Store(int64(window))
+	dedup.seen, dedup.order, dedup.head, dedup.n = nil, nil, 0, 0
+	if window != 0 {
+		dedup.seed = maphash.MakeSeed()
+		dedup.seen = make(map[uint64]struct{})
+		dedup.order = make([]dedupPacket, dedupMaxPackets)
+	}
+}
+
+// duplicate reports whether packet is identical to a packet received within
+// the window, counting it as dropped, and remembers it otherwise.
+func (dedup *peerDedup) duplicate(packet []byte) bool {
+	window := dedup.window.Load()
+	if window == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+
+	dedup.Lock()
+	defer dedup.Unlock()
+	if dedup.seen == nil {
+		return false
+	}
+	// Forget the packets that left the window, and the oldest if full.
+	for dedup.n > 0 {
+		oldest := dedup.order[dedup.head]
+		if now-oldest.at <= window && dedup.n < len(dedup.order) {
+			break
+		}
+		delete(dedup.seen, oldest.hash)
+		dedup.head = (dedup.head + 1) % len(dedup.order)
+		dedup.n--
+	}
+
+	hash := maphash.Bytes(dedup.seed, packet)
+	if _, ok := dedup.seen[hash]; ok {
+		dedup.dropped.Add(1)
+		return true
+	}
+	dedup.seen[hash] = struct{}{}
+	dedup.order[(dedup.head+dedup.n)%len(dedup.order)] = dedupPacket{hash: hash, at: now}
+	dedup.n++
+	return false
+}
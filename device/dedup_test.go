@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestDedupWindow(t *testing.T) {
+	var dedup peerDedup
+	a, b := []byte("packet a"), []byte("packet b")
+	if dedup.duplicate(a) || dedup.duplicate(a) {
+		t.Fatal("duplicate dropped while disabled")
+	}
+
+	dedup.setWindow(50 * time.Millisecond)
+	if dedup.duplicate(a) || !dedup.duplicate(a) || dedup.duplicate(b) {
+		t.Fatal("expected only the second copy of a to be a duplicate")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if dedup.duplicate(a) {
+		t.Error("packet outside the window dropped")
+	}
+	if n := dedup.dropped.Load(); n != 1 {
+		t.Errorf("expected 1 dropped packet, got %d", n)
+	}
+
+	// Past dedupMaxPackets, the oldest packets are forgotten.
+	dedup.setWindow(time.Hour)
+	packet := make([]byte, 4)
+	for i := 0; i <= dedupMaxPackets; i++ {
+		binary.BigEndian.PutUint32(packet, uint32(i))
+		dedup.duplicate(packet)
+	}
+	binary.BigEndian.PutUint32(packet, 0)
+	if dedup.duplicate(packet) {
+		t.Error("oldest packet still remembered")
+	}
+	binary.BigEndian.PutUint32(packet, dedupMaxPackets)
+	if !dedup.duplicate(packet) {
+		t.Error("newest packet forgotten")
+	}
+}
+
+func TestDedupWindowUAPI(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"dedup_window", "100ms",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet is duplicated before encryption, so the replay filter
+	// cannot tell the copies apart.
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair[1].tun.Outbound <- msg
+	pair[1].tun.Outbound <- msg
+	<-pair[0].tun.Inbound
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("duplicate delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"dedup_window=100ms\n", "rx_dedup_dropped=1\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"dedup_window", "-1s",
+	)); err == nil {
+		t.Error("negative dedup window accepted")
+	}
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"dedup_window", "0",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// WithDeterministic makes the device reproducible, for integration tests
+// comparing its traffic byte for byte: the handshake timers are set without
+// jitter, and the connectivity probes, flow labels, pacing and pure-Go DAITA
+// machines draw from a pseudo-random source seeded with seed instead of the
+// global or cryptographic ones. Keys, ephemerals, indices and cookies are
+// still random, so tests need to fix them through the bind or compare
+// decrypted traffic. DAITA machines run through the FFI cannot be seeded.
+// Ports are chosen by the kernel unless listen_port is set. The option is not
+// meant for production use, where the jitter avoids synchronized handshakes
+// and predictable probes and labels can be spoofed.
+func WithDeterministic(seed int64) Option {
+	return func(o *deviceOptions) {
+		o.random = &seededRand{rand: rand.New(rand.NewSource(seed))}
+	}
+}
+
+// A seededRand is a pseudo-random source safe for concurrent use. A nil
+// *seededRand draws from the global source of math/rand.
+type seededRand struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func (r *seededRand) Uint32() uint32 {
+	if r == nil {
+		return rand.Uint32()
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Uint32()
+}
+
+func (r *seededRand) Int63() int64 {
+	if r == nil {
+		return rand.Int63()
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Int63()
+}
+
+func (r *seededRand) Int63n(n int64) int64 {
+	if r == nil {
+		return rand.Int63n(n)
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Int63n(n)
+}
+
+func (r *seededRand) ExpFloat64() float64 {
+	if r == nil {
+		return rand.ExpFloat64()
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.ExpFloat64()
+}
+
+// handshakeJitter returns the random delay added to the handshake timers, so
+// that peers do not all retry at once, or 0 if the device is deterministic.
+func (device *Device) handshakeJitter() time.Duration {
+	if device.options.random != nil {
+		return 0
+	}
+	return time.Millisecond * time.Duration(fastrandn(RekeyTimeoutJitterMaxMs))
+}
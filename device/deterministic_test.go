@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// TestDeterministic checks that two devices created with the same seed set
+// their handshake timers without jitter, and draw the same flow labels, probe
+// identifiers and pacing.
+func TestDeterministic(t *testing.T) {
+	draw := func() []any {
+		pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+			return NewDeviceWithOptions(tun, bind, logger, WithDeterministic(42))
+		})
+		dev := pair[0].dev
+		pk := pair[1].dev.staticIdentity.publicKey
+		peer := dev.LookupPeer(pk)
+		if jitter := dev.handshakeJitter(); jitter != 0 {
+			t.Errorf("handshake jitter is %v, want 0", jitter)
+		}
+		draws := []any{peer.flowLabel.Load()}
+		id, probe := dev.probes.register(netip.MustParseAddr("10.0.0.1"))
+		dev.probes.unregister(id)
+		draws = append(draws, id, probe.seq)
+
+		if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "pacing", "exponential:1ms")); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 8; i++ {
+			draws = append(draws, peer.pacing.Load().spacing())
+		}
+		return draws
+	}
+
+	first, second := draw(), draw()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("devices with the same seed drew %v and %v", first, second)
+	}
+}
@@ -6,11 +6,11 @@
 package device
 
 import (
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/blake2s"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ratelimiter"
 	"golang.zx2c4.com/wireguard/rwcancel"
@@ -37,6 +37,8 @@ type Device struct {
 		sync.Mutex
 	}
 
+	disabledFeatures atomic.Uint32 // actually Features, see SetFeatures
+
 	net struct {
 		stopping sync.WaitGroup
 		sync.RWMutex
@@ -45,17 +47,23 @@ type Device struct {
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
 		brokenRoaming bool
+		flowLabel     atomic.Uint32 // actually a FlowLabelPolicy
+		stealth       atomic.Bool   // never send cookie replies, see SetStealth
+		externalPort  uint16        // listening port as observed from outside, see SetExternalPort
+		behindNAT     atomic.Bool   // externalPort differs from port
 	}
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
-		publicKey  NoisePublicKey
+		privateKey  NoisePrivateKey
+		publicKey   NoisePublicKey
+		initialHash [blake2s.Size]byte // see precomputeInitialHash
 	}
 
 	peers struct {
-		sync.RWMutex // protects keyMap
+		sync.RWMutex // protects keyMap and sorted
 		keyMap       map[NoisePublicKey]*Peer
+		sorted       []*Peer // the peers of keyMap ordered by public key, see Peers
 	}
 
 	rate struct {
@@ -80,13 +88,43 @@ type Device struct {
 	}
 
 	tun struct {
-		device tun.Device
-		mtu    atomic.Int32
+		sync.RWMutex  // held for writing while SwapTUN replaces the device
+		device        tun.Device
+		generation    uint64 // incremented by SwapTUN
+		mtu           atomic.Int32
+		writeFailures atomic.Uint32 // consecutive failed writes
+	}
+
+	coalesce deviceCoalescing
+
+	stats struct {
+		txDroppedNonIP atomic.Uint64 // frames read from the TUN device that were not IPv4/IPv6
+	}
+
+	debug struct {
+		nonIPSampleRate atomic.Uint32 // log every nth dropped non-IP frame (0 = disabled)
 	}
 
-	ipcMutex sync.RWMutex
-	closed   chan struct{}
-	log      *Logger
+	notifications     notifications
+	handshakeFailures handshakeFailures
+	goroutines        goroutineGauge
+	probes            connectivityProbes
+	relay             relayTable
+	peerState         peerState
+	suspend           suspendWatch
+	statsExport       statsExport
+
+	options          deviceOptions                      // fixed at creation, see NewDeviceWithOptions
+	timerWheel       *timerWheel                        // shared by the timers of all peers
+	protocolVersions atomic.Pointer[protocolVersionSet] // nil for supportedProtocolVersions
+	daitaDefault     atomic.Pointer[peerDaitaConfig]    // for new peers, see SetDefaultDaita
+	daitaMemory      daitaMemory
+
+	ipcMutex      sync.RWMutex
+	ipcPermissive atomic.Bool // ignore unknown UAPI keys, see SetIpcPermissive
+	closed        chan struct{}
+	log           *Logger
+	logLevel      atomic.Int32 // caps log, see SetLogLevel
 }
 
 // deviceState represents the state of a Device.
@@ -127,10 +165,12 @@ func (device *Device) isUp() bool {
 func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	device.allowedips.RemoveByPeer(peer)
+	device.relay.removePeer(peer)
 	peer.Stop()
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
+	device.removeSortedPeerLocked(key)
 }
 
 // changeState attempts to change the device state to match want.
@@ -167,6 +207,11 @@ func (device *Device) changeState(want deviceState) (err error) {
 // upLocked attempts to bring the device up and reports whether it succeeded.
 // The caller must hold device.state.mu and is responsible for updating device.state.state.
 func (device *Device) upLocked() error {
+	if err := startupCryptoSelfTest(); err != nil {
+		device.log.Errorf("Refusing to come up: %v", err)
+		return err
+	}
+
 	if err := device.BindUpdate(); err != nil {
 		device.log.Errorf("Unable to update bind: %v", err)
 		return err
@@ -180,17 +225,29 @@ func (device *Device) upLocked() error {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.Start()
-		if peer.persistentKeepaliveInterval.Load() > 0 {
+		if peer.keepaliveInterval() > 0 {
 			peer.SendKeepalive()
 		}
+		if err := peer.startConfiguredDaita(); err != nil {
+			device.log.Errorf("%v - Failed to enable DAITA: %v", peer, err)
+		}
 	}
 	device.peers.RUnlock()
+
+	if device.options.mtuDiscovery {
+		device.state.stopping.Add(1)
+		go device.discoverMTU()
+	}
+	device.startSuspendWatch()
 	return nil
 }
 
 // downLocked attempts to bring the device down.
 // The caller must hold device.state.mu and is responsible for updating device.state.state.
 func (device *Device) downLocked() error {
+	device.stopSuspendWatch()
+	device.sendGoodbyes()
+
 	err := device.BindClose()
 	if err != nil {
 		device.log.Errorf("Bind close failed: %v", err)
@@ -215,15 +272,25 @@ func (device *Device) Down() error {
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 	now := time.Now()
-	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
+	underLoad := len(device.queue.handshake.c) >= cap(device.queue.handshake.c)/8
 	if underLoad {
-		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
+		device.rate.underLoadUntil.Store(now.Add(device.options.underLoadAfterTime).UnixNano())
 		return true
 	}
 	// check if recently under load
 	return device.rate.underLoadUntil.Load() > now.UnixNano()
 }
 
+// SetStealth controls whether the device may answer senders that have not
+// authenticated as a configured peer. WireGuard already ignores traffic that
+// fails MAC1 validation; the only remaining answer is the cookie reply sent
+// to handshakes while under load. In stealth mode, those handshakes are rate
+// limited by source address instead, so the listening port stays dark to
+// scanners at the cost of weaker protection against spoofed floods.
+func (device *Device) SetStealth(stealth bool) {
+	device.net.stealth.Store(stealth)
+}
+
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// lock required resources
 
@@ -259,6 +326,9 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.staticIdentity.privateKey = sk
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
+	if device.options.handshakePrecomputation {
+		precomputeInitialHash(&device.staticIdentity.initialHash, publicKey)
+	}
 
 	// do static-static DH pre-computations
 
@@ -280,12 +350,28 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 }
 
 func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
+	return NewDeviceWithOptions(tunDevice, bind, logger)
+}
+
+// NewDeviceWithOptions is like NewDevice, but configures the device with opts
+// instead of the defaults.
+func NewDeviceWithOptions(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts ...Option) *Device {
 	device := new(Device)
+	device.options = defaultDeviceOptions()
+	for _, opt := range opts {
+		opt(&device.options)
+	}
+	device.probes.random = device.options.random
+	device.daitaMemory.limit = device.options.daitaMemoryLimit
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
-	device.log = logger
+	device.logLevel.Store(LogLevelVerbose)
+	device.log = device.newLevelLogger(logger)
 	device.net.bind = bind
 	device.tun.device = tunDevice
+	if err := startupCryptoSelfTest(); err != nil {
+		device.log.Errorf("Cryptographic self-test failed: %v", err)
+	}
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
 		device.log.Errorf("Trouble determining MTU, assuming default: %v", err)
@@ -299,16 +385,17 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 
 	// create queues
 
-	device.queue.handshake = newHandshakeQueue()
-	device.queue.encryption = newOutboundQueue()
-	device.queue.decryption = newInboundQueue()
+	device.queue.handshake = newHandshakeQueue(device.options.queueHandshakeSize)
+	device.queue.encryption = newOutboundQueue(device.options.queueOutboundSize)
+	device.queue.decryption = newInboundQueue(device.options.queueInboundSize)
+	device.timerWheel = newTimerWheel()
 
 	// start workers
 
-	cpus := runtime.NumCPU()
+	workers := device.options.workers
 	device.state.stopping.Wait()
-	device.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
-	for i := 0; i < cpus; i++ {
+	device.queue.encryption.wg.Add(workers) // One for each RoutineHandshake
+	for i := 0; i < workers; i++ {
 		go device.RoutineEncryption(i + 1)
 		go device.RoutineDecryption(i + 1)
 		go device.RoutineHandshake(i + 1)
@@ -318,6 +405,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutineTimerWheel()
 
 	return device
 }
@@ -330,25 +418,39 @@ func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 }
 
 func (device *Device) RemovePeer(key NoisePublicKey) {
+	if peer := device.LookupPeer(key); peer != nil {
+		peer.sendGoodbye()
+	}
+
 	device.peers.Lock()
-	defer device.peers.Unlock()
 	// stop peer and remove from routing
 
 	peer, ok := device.peers.keyMap[key]
 	if ok {
 		removePeerLocked(device, peer, key)
 	}
+	device.peers.Unlock()
+
+	if ok {
+		device.releaseFlowLabels(peer)
+	}
 }
 
 func (device *Device) RemoveAllPeers() {
-	device.peers.Lock()
-	defer device.peers.Unlock()
+	device.sendGoodbyes()
 
+	device.peers.Lock()
+	// Removing every peer from the middle of sorted would take quadratic time.
+	device.peers.sorted = nil
+	removed := make([]*Peer, 0, len(device.peers.keyMap))
 	for key, peer := range device.peers.keyMap {
 		removePeerLocked(device, peer, key)
+		removed = append(removed, peer)
 	}
-
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.Unlock()
+
+	device.releaseFlowLabels(removed...)
 }
 
 func (device *Device) Close() {
@@ -362,6 +464,9 @@ func (device *Device) Close() {
 
 	device.tun.device.Close()
 	device.downLocked()
+	device.stopStatsExport()
+
+	device.closePeerState()
 
 	// Remove peers before closing queues,
 	// because peers assume that queues are active.
@@ -467,12 +572,24 @@ func (device *Device) BindUpdate() error {
 	if !device.isUp() {
 		return nil
 	}
+	return openBindLocked(device)
+}
 
-	// bind to new port
+// openBindLocked opens the device's net.bind on net.port, or on a random port
+// if net.port is 0, and starts receiving from it.
+// The caller must hold the net mutex.
+func openBindLocked(device *Device) error {
+	// bind to new port, receiving batches of packets if the bind can
 	var err error
 	var recvFns []conn.ReceiveFunc
+	var batchRecvFns []conn.BatchReceiveFunc
 	netc := &device.net
-	recvFns, netc.port, err = netc.bind.Open(netc.port)
+	batchBind, batched := netc.bind.(conn.BatchReceiveBind)
+	if batched {
+		batchRecvFns, netc.port, err = batchBind.OpenBatch(netc.port)
+	} else {
+		recvFns, netc.port, err = netc.bind.Open(netc.port)
+	}
 	if err != nil {
 		netc.port = 0
 		return err
@@ -492,6 +609,8 @@ func (device *Device) BindUpdate() error {
 		}
 	}
 
+	device.updateBehindNATLocked()
+
 	// clear cached source addresses
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
@@ -500,16 +619,21 @@ func (device *Device) BindUpdate() error {
 		if peer.endpoint != nil {
 			peer.endpoint.ClearSrc()
 		}
+		peer.autoKeepaliveReset()
 	}
 	device.peers.RUnlock()
 
 	// start receiving routines
-	device.net.stopping.Add(len(recvFns))
-	device.queue.decryption.wg.Add(len(recvFns)) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
-	device.queue.handshake.wg.Add(len(recvFns))  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
+	routines := len(recvFns) + len(batchRecvFns)
+	device.net.stopping.Add(routines)
+	device.queue.decryption.wg.Add(routines) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
+	device.queue.handshake.wg.Add(routines)  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
 	for _, fn := range recvFns {
 		go device.RoutineReceiveIncoming(fn)
 	}
+	for _, fn := range batchRecvFns {
+		go device.routineReceiveIncoming(fn.PrettyName(), fn, batchBind.BatchSize())
+	}
 
 	device.log.Verbosef("UDP bind has been updated")
 	return nil
@@ -7,13 +7,16 @@ package device
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/netip"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -21,6 +24,8 @@ import (
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -148,6 +153,14 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 
 // genTestPair creates a testPair.
 func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
+	return genTestPairWith(tb, realSocket, func(_ int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		return NewDevice(tun, bind, logger)
+	})
+}
+
+// genTestPairWith creates a testPair whose devices are created by newDevice,
+// which may wrap the TUN device or pass options.
+func genTestPairWith(tb testing.TB, realSocket bool, newDevice func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device) (pair testPair) {
 	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
@@ -164,7 +177,7 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 		if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
 			level = LogLevelError
 		}
-		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		p.dev = newDevice(i, p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -190,6 +203,34 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 	return
 }
 
+func TestEncryptionBatchOrder(t *testing.T) {
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		return NewDeviceWithOptions(tun, bind, logger, WithWorkers(2))
+	})
+	pair.Send(t, Ping, nil)
+
+	// Queue a burst of pings, so that they are encrypted in batches shared
+	// by both workers, and check that they arrive in order.
+	const count = 100
+	go func() {
+		for seq := 0; seq < count; seq++ {
+			ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+			binary.BigEndian.PutUint16(ping[len(ping)-2:], uint16(seq))
+			pair[1].tun.Outbound <- ping
+		}
+	}()
+	for seq := 0; seq < count; seq++ {
+		select {
+		case msg := <-pair[0].tun.Inbound:
+			if got := binary.BigEndian.Uint16(msg[len(msg)-2:]); got != uint16(seq) {
+				t.Fatalf("expected ping %d, got ping %d", seq, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for ping %d", seq)
+		}
+	}
+}
+
 func TestTwoDevicePing(t *testing.T) {
 	goroutineLeakCheck(t)
 	pair := genTestPair(t, true)
@@ -325,8 +366,18 @@ func BenchmarkLatency(b *testing.B) {
 }
 
 func BenchmarkThroughput(b *testing.B) {
-	pair := genTestPair(b, true)
+	benchmarkThroughput(b, genTestPair(b, true))
+}
 
+// BenchmarkThroughputSingleWorker measures the throughput of a single core
+// doing the encryption and decryption of the devices.
+func BenchmarkThroughputSingleWorker(b *testing.B) {
+	benchmarkThroughput(b, genTestPairWith(b, true, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		return NewDeviceWithOptions(tun, bind, logger, WithWorkers(1))
+	}))
+}
+
+func benchmarkThroughput(b *testing.B, pair testPair) {
 	// Establish a connection.
 	pair.Send(b, Ping, nil)
 	pair.Send(b, Pong, nil)
@@ -405,3 +456,152 @@ func goroutineLeakCheck(t *testing.T) {
 		t.Fatalf("expected %d goroutines, got %d, leak?", startGoroutines, endGoroutines)
 	})
 }
+
+func TestDropNonIPFrames(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[1].dev
+	if err := dev.IpcSet(uapiCfg("debug_non_ip_sample_rate", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	pair[1].tun.Outbound <- []byte{0x00, 0x01, 0x02, 0x03}
+	pair[1].tun.Outbound <- []byte{0x45, 0x00}
+	pair.Send(t, Ping, nil)
+
+	if dropped := dev.stats.txDroppedNonIP.Load(); dropped != 2 {
+		t.Fatalf("expected 2 dropped non-IP frames, got %d", dropped)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"debug_non_ip_sample_rate=1\n", "tx_dropped_non_ip=2\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+}
+
+func TestRemoveAllowedIP(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pub[:]),
+		"update_only", "true",
+		"allowed_ip", "10.0.0.0/24",
+		"allowed_ip", "10.0.1.0/24",
+		"remove_allowed_ip", "10.0.0.0/24",
+		"remove_allowed_ip", "192.168.0.0/16",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"allowed_ip=1.0.0.2/32\n", "allowed_ip=10.0.1.0/24\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+	if strings.Contains(cfg, "allowed_ip=10.0.0.0/24\n") {
+		t.Errorf("removed allowed IP still present:\n%s", cfg)
+	}
+	pair.Send(t, Ping, nil)
+
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pub[:]),
+		"remove_allowed_ip", "10.0.0.0",
+	))
+	var ipcErr *IPCError
+	if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+		t.Errorf("expected invalid prefix to fail with IpcErrorInvalid, got %v", err)
+	}
+}
+
+func TestDisableRoaming(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	setRoaming := func(disabled string) {
+		t.Helper()
+		if err := dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"update_only", "true",
+			"disable_roaming", disabled,
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer := dev.LookupPeer(pub)
+	peer.RLock()
+	configured := peer.endpoint
+	peer.RUnlock()
+	roamed, err := CreateDummyEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setRoaming("true")
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "disable_roaming=true\n") {
+		t.Errorf("expected disable_roaming in IpcGet, got:\n%s", cfg)
+	}
+	peer.SetEndpointFromPacket(roamed)
+	peer.RLock()
+	if peer.endpoint != configured {
+		t.Errorf("endpoint roamed to %v while pinned", peer.endpoint.DstToString())
+	}
+	peer.RUnlock()
+	pair.Send(t, Ping, nil)
+
+	setRoaming("false")
+	peer.SetEndpointFromPacket(roamed)
+	peer.RLock()
+	if peer.endpoint != conn.Endpoint(roamed) {
+		t.Errorf("endpoint did not roam once unpinned")
+	}
+	peer.RUnlock()
+}
+
+func TestIpcSetLimits(t *testing.T) {
+	dev := NewDeviceWithOptions(
+		tuntest.NewChannelTUN().TUN(),
+		bindtest.NewChannelBinds()[0],
+		NewLogger(LogLevelSilent, ""),
+		WithIpcLimits(100, 400, 2),
+	)
+	defer dev.Close()
+
+	peer := func(i byte) []string {
+		sk := NoisePrivateKey{i}
+		pk := sk.publicKey()
+		return []string{"public_key", hex.EncodeToString(pk[:])}
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"long line", uapiCfg("fwmark", strings.Repeat("1", 100)), "line 1 exceeds the maximum length of 100 bytes"},
+		{"large config", uapiCfg(peer(1)...) + strings.Repeat("allowed_ip=10.0.0.0/8\n", 20), "maximum size of 400 bytes"},
+		{"many peers", uapiCfg(append(append(peer(1), peer(2)...), peer(3)...)...), "maximum of 2 peers"},
+	} {
+		err := dev.IpcSet(tc.cfg)
+		var ipcErr *IPCError
+		if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorProtocol || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected a protocol error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+	if cfg, _ := dev.IpcGet(); strings.Contains(cfg, "public_key=") {
+		t.Errorf("configuration applied despite exceeding limits:\n%s", cfg)
+	}
+
+	if err := dev.IpcSet(uapiCfg(append(peer(1), peer(2)...)...)); err != nil {
+		t.Errorf("configuration within limits rejected: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// PeerDirection restricts the data exchanged with a peer to one direction,
+// for example for monitoring taps or one-way telemetry links. It is set with
+// the "direction" UAPI key. Handshakes, keepalives and other control messages
+// are exchanged in both directions regardless, so that sessions are
+// established and kept alive as usual.
+type PeerDirection uint32
+
+const (
+	// PeerDirectionBoth exchanges data in both directions.
+	PeerDirectionBoth PeerDirection = iota
+	// PeerDirectionSendOnly sends data to the peer, and drops the data
+	// received from it.
+	PeerDirectionSendOnly
+	// PeerDirectionReceiveOnly receives data from the peer, and drops the
+	// data read from the TUN device for it.
+	PeerDirectionReceiveOnly
+)
+
+func (direction PeerDirection) String() string {
+	switch direction {
+	case PeerDirectionBoth:
+		return "both"
+	case PeerDirectionSendOnly:
+		return "send"
+	case PeerDirectionReceiveOnly:
+		return "receive"
+	}
+	return fmt.Sprintf("PeerDirection(%d)", uint32(direction))
+}
+
+func parsePeerDirection(s string) (PeerDirection, error) {
+	switch s {
+	case "both":
+		return PeerDirectionBoth, nil
+	case "send":
+		return PeerDirectionSendOnly, nil
+	case "receive":
+		return PeerDirectionReceiveOnly, nil
+	}
+	return 0, fmt.Errorf("unknown direction %q", s)
+}
+
+type peerDirection struct {
+	direction atomic.Uint32 // actually a PeerDirection
+	txDropped atomic.Uint64 // data for a receive-only peer
+	rxDropped atomic.Uint64 // data from a send-only peer
+}
+
+// Direction returns the direction data is exchanged with the peer in.
+func (peer *Peer) Direction() PeerDirection {
+	return PeerDirection(peer.direction.direction.Load())
+}
+
+// SetDirection sets the direction data is exchanged with the peer in.
+func (peer *Peer) SetDirection(direction PeerDirection) {
+	peer.direction.direction.Store(uint32(direction))
+}
+
+// dropSend reports whether data to the peer is dropped, and counts it if so.
+func (peer *Peer) dropSend() bool {
+	if peer.Direction() != PeerDirectionReceiveOnly {
+		return false
+	}
+	peer.direction.txDropped.Add(1)
+	return true
+}
+
+// dropReceive reports whether data from the peer is dropped, and counts it if
+// so.
+func (peer *Peer) dropReceive() bool {
+	if peer.Direction() != PeerDirectionSendOnly {
+		return false
+	}
+	peer.direction.rxDropped.Add(1)
+	return true
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPeerDirection(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pub)
+	setDirection := func(direction string) {
+		t.Helper()
+		if err := dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"direction", direction,
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	awaitDropped := func(counter *atomic.Uint64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); counter.Load() != 1; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected a dropped packet, got %d", counter.Load())
+			}
+		}
+	}
+	assertNothingReceived := func(p *testPeer) {
+		t.Helper()
+		select {
+		case <-p.tun.Inbound:
+			t.Error("received a packet that should have been dropped")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// A send-only peer drops the data it receives, but still sends.
+	setDirection("send")
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	awaitDropped(&peer.direction.rxDropped)
+	assertNothingReceived(&pair[0])
+	pair.Send(t, Pong, nil)
+
+	// A receive-only peer drops the data it would send, but still receives.
+	setDirection("receive")
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	awaitDropped(&peer.direction.txDropped)
+	assertNothingReceived(&pair[1])
+	pair.Send(t, Ping, nil)
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"direction=receive\n", "tx_dropped_direction=1\n", "rx_dropped_direction=1\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+
+	setDirection("both")
+	pair.Send(t, Pong, nil)
+	if direction := peer.Direction(); direction != PeerDirectionBoth {
+		t.Errorf("expected both directions, got %v", direction)
+	}
+}
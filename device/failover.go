@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// An endpointFailover decides which endpoint a peer falls back to when
+// handshakes to its current endpoint keep failing.
+// It is protected by the peer's mutex.
+type endpointFailover struct {
+	threshold  uint32          // consecutive failed handshake attempts before failing over (0 = disabled)
+	lastGood   conn.Endpoint   // endpoint in use when a handshake last completed
+	configured conn.Endpoint   // endpoint most recently set through UAPI
+	candidates []conn.Endpoint // additional fallback endpoints, in order of preference
+	index      int             // position in the fallback order to try next
+}
+
+// next returns the endpoint to fail over to from current, or nil if there is none.
+// Fallbacks are tried in order: the last known good endpoint, the configured
+// candidates, and finally the configured endpoint, before starting over.
+func (f *endpointFailover) next(current conn.Endpoint) conn.Endpoint {
+	var order []conn.Endpoint
+	for _, endpoint := range append([]conn.Endpoint{f.lastGood}, append(f.candidates, f.configured)...) {
+		if endpoint != nil && !containsEndpoint(order, endpoint) {
+			order = append(order, endpoint)
+		}
+	}
+	for range order {
+		endpoint := order[f.index%len(order)]
+		f.index++
+		if current == nil || endpoint.DstToString() != current.DstToString() {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func containsEndpoint(endpoints []conn.Endpoint, endpoint conn.Endpoint) bool {
+	for _, other := range endpoints {
+		if other.DstToString() == endpoint.DstToString() {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverEndpoint switches the peer to a fallback endpoint if the number of
+// consecutive failed handshake attempts has reached the failover threshold.
+func (peer *Peer) failoverEndpoint() {
+	attempts := peer.timers.handshakeAttempts.Load()
+
+	peer.Lock()
+	threshold := peer.failover.threshold
+	if threshold == 0 || attempts == 0 || attempts%threshold != 0 {
+		peer.Unlock()
+		return
+	}
+	old := peer.endpoint
+	endpoint := peer.failover.next(old)
+	if endpoint == nil {
+		peer.Unlock()
+		return
+	}
+	peer.endpoint = endpoint
+	peer.Unlock()
+
+	var from string
+	if old != nil {
+		from = old.DstToString()
+	}
+	message := fmt.Sprintf("handshake did not complete after %d attempts, switching endpoint from %q to %q", attempts, from, endpoint.DstToString())
+	peer.device.log.Verbosef("%v - %s", peer, message)
+	peer.device.notify(NotificationEndpointFailover, peer, message)
+}
+
+// markEndpointGood records the current endpoint as the last known good one,
+// restarts the fallback order and schedules a save of the peer state file.
+func (peer *Peer) markEndpointGood() {
+	peer.Lock()
+	if peer.endpoint != nil {
+		peer.failover.lastGood = peer.endpoint
+	}
+	peer.failover.index = 0
+	peer.Unlock()
+	peer.device.schedulePeerStateSave()
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+)
+
+func TestEndpointFailoverOrder(t *testing.T) {
+	configured := bindtest.ChannelEndpoint(1)
+	lastGood := bindtest.ChannelEndpoint(2)
+	candidateA := bindtest.ChannelEndpoint(3)
+	candidateB := bindtest.ChannelEndpoint(4)
+
+	f := endpointFailover{
+		threshold:  3,
+		configured: configured,
+		lastGood:   lastGood,
+		candidates: []conn.Endpoint{candidateA, configured, candidateB},
+	}
+
+	expected := []conn.Endpoint{lastGood, candidateA, configured, candidateB, lastGood}
+	current := conn.Endpoint(configured)
+	for i, want := range expected {
+		got := f.next(current)
+		if got != want {
+			t.Fatalf("failover %d: expected %v, got %v", i, want, got)
+		}
+		current = got
+	}
+
+	// The current endpoint is skipped if it comes up in the fallback order.
+	f.index = 0
+	if got := f.next(lastGood); got != candidateA {
+		t.Fatalf("expected current endpoint to be skipped, got %v", got)
+	}
+
+	empty := endpointFailover{configured: configured}
+	if got := empty.next(configured); got != nil {
+		t.Fatalf("expected no fallback endpoint, got %v", got)
+	}
+}
@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// Feature flags tell which extensions of this fork a device supports. The
+// enabled features of a device are set with the "features" UAPI key, and all
+// are enabled by default. Configuring a feature that is disabled fails.
+//
+// Feature announcements are an opt-in extension that must be enabled on both
+// ends of a tunnel, using the "announce_features" UAPI key, so that clients
+// and servers can detect mismatched capabilities without trial and error.
+// After every handshake, each end announces the enabled features of its
+// device in the new session:
+//
+//	0      1      2      3      4
+//	+------+------+------+------+
+//	| 0xfc | 0x00 |   features  |
+//	+------+------+------+------+
+//
+// where features is a little-endian Features bit mask. If a peer is
+// configured with a feature the other end did not announce, a
+// NotificationFeatureMismatch is sent.
+type Features uint16
+
+const (
+	// FeatureDaita is DAITA, see Peer.EnableDaita.
+	FeatureDaita Features = 1 << iota
+	// FeatureConstantPacketSize is the "constant_packet_size" peer key.
+	FeatureConstantPacketSize
+	// FeatureObfuscation is stealth mode, the "stealth" device key.
+	FeatureObfuscation
+	// FeatureMultipath is the "multipath_endpoint" peer key.
+	FeatureMultipath
+
+	// AllFeatures are the features known to this version.
+	AllFeatures = FeatureDaita | FeatureConstantPacketSize | FeatureObfuscation | FeatureMultipath
+)
+
+const (
+	// Length (in bytes) of a feature announcement.
+	FeaturesLen = 4
+
+	// The first byte of a feature announcement, taking the place of the IP
+	// version field.
+	FeaturesMarker uint8 = 0xfc
+)
+
+var featureNames = []struct {
+	feature Features
+	name    string
+}{
+	{FeatureDaita, "daita"},
+	{FeatureConstantPacketSize, "constant_packet_size"},
+	{FeatureObfuscation, "obfuscation"},
+	{FeatureMultipath, "multipath"},
+}
+
+// String returns the names of the features, separated by commas, or "none".
+// Unknown features, announced by newer versions, are given in hex.
+func (features Features) String() string {
+	var names []string
+	for _, f := range featureNames {
+		if features&f.feature != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if unknown := features &^ AllFeatures; unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint16(unknown)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Has reports whether all of want are among features.
+func (features Features) Has(want Features) bool {
+	return features&want == want
+}
+
+func parseFeatures(s string) (Features, error) {
+	if s == "none" {
+		return 0, nil
+	}
+	var features Features
+next:
+	for _, name := range strings.Split(s, ",") {
+		for _, f := range featureNames {
+			if name == f.name {
+				features |= f.feature
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("unknown feature %q", name)
+	}
+	return features, nil
+}
+
+// Features returns the enabled features of the device.
+func (device *Device) Features() Features {
+	return AllFeatures &^ Features(device.disabledFeatures.Load())
+}
+
+// SetFeatures sets the enabled features of the device. Disabling a feature
+// does not turn it off where it is already configured.
+func (device *Device) SetFeatures(features Features) {
+	device.disabledFeatures.Store(uint32(AllFeatures &^ features))
+}
+
+// requireFeature fails configuring feature if it is disabled.
+func (device *Device) requireFeature(feature Features) error {
+	if !device.Features().Has(feature) {
+		return ipcErrorf(ipc.IpcErrorInvalid, "feature %s is disabled", feature)
+	}
+	return nil
+}
+
+// peerFeatures is the state of feature announcements with a peer.
+type peerFeatures struct {
+	announce atomic.Bool
+	remote   atomic.Uint32 // the announced features | featuresKnown, or 0 if none were
+}
+
+const featuresKnown = 1 << 16
+
+// remoteFeatures returns the features the peer announced last, and whether
+// it announced any.
+func (peer *Peer) remoteFeatures() (Features, bool) {
+	remote := peer.features.remote.Load()
+	return Features(remote), remote&featuresKnown != 0
+}
+
+// configuredFeatures returns the features the peer is configured with.
+func (peer *Peer) configuredFeatures() Features {
+	var features Features
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.daita != nil {
+		features |= FeatureDaita
+	}
+	if peer.constantPacketSize.Load() {
+		features |= FeatureConstantPacketSize
+	}
+	if peer.multipath.endpoint != nil {
+		features |= FeatureMultipath
+	}
+	return features
+}
+
+// announceFeatures sends the enabled features of the device to the peer in
+// its current session, if it has enabled feature announcements.
+func (peer *Peer) announceFeatures() {
+	if !peer.features.announce.Load() || !peer.isRunning.Load() {
+		return
+	}
+	elem := peer.device.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+FeaturesLen]
+	elem.packet[0] = FeaturesMarker
+	elem.packet[1] = 0
+	binary.LittleEndian.PutUint16(elem.packet[2:], uint16(peer.device.Features()))
+	elem.queuedAt = queueNow()
+	peer.StagePacket(elem)
+	peer.device.log.Verbosef("%v - Announcing features: %v", peer, peer.device.Features())
+	peer.SendStagedPackets()
+}
+
+// receivedFeatures records the features announced by the peer, and reports
+// the configured features of the peer that its end lacks whenever they change.
+func (peer *Peer) receivedFeatures(packet []byte) {
+	if len(packet) < FeaturesLen {
+		return
+	}
+	remote := Features(binary.LittleEndian.Uint16(packet[2:]))
+	previous := peer.features.remote.Swap(uint32(remote) | featuresKnown)
+	if previous == uint32(remote)|featuresKnown {
+		return
+	}
+	peer.device.log.Verbosef("%v - Peer announced features: %v", peer, remote)
+	if missing := peer.configuredFeatures() &^ remote; missing != 0 {
+		message := fmt.Sprintf("peer does not support configured features: %v", missing)
+		peer.device.log.Errorf("%v - %s", peer, message)
+		peer.device.notify(NotificationFeatureMismatch, peer, message)
+	}
+}
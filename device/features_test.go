@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestFeaturesString(t *testing.T) {
+	for _, tc := range []struct {
+		features Features
+		want     string
+	}{
+		{0, "none"},
+		{FeatureDaita, "daita"},
+		{FeatureConstantPacketSize | FeatureMultipath, "constant_packet_size,multipath"},
+		{AllFeatures, "daita,constant_packet_size,obfuscation,multipath"},
+		{FeatureObfuscation | 0x8000, "obfuscation,0x8000"},
+	} {
+		if got := tc.features.String(); got != tc.want {
+			t.Errorf("%#x: expected %q, got %q", uint16(tc.features), tc.want, got)
+		}
+		if tc.features&^AllFeatures != 0 {
+			continue
+		}
+		if parsed, err := parseFeatures(tc.want); err != nil || parsed != tc.features {
+			t.Errorf("parsing %q: expected %#x, got %#x, %v", tc.want, uint16(tc.features), uint16(parsed), err)
+		}
+	}
+	if _, err := parseFeatures("daita,teleport"); err == nil {
+		t.Error("expected an unknown feature to fail")
+	}
+}
+
+func TestFeaturesDisabled(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg("features", "daita,multipath")); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Features(); got != FeatureDaita|FeatureMultipath {
+		t.Errorf("expected daita,multipath, got %v", got)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "features=daita,multipath\n") {
+		t.Errorf("features missing from IpcGet:\n%s", cfg)
+	}
+
+	for _, c := range []string{
+		uapiCfg("stealth", "true"),
+		uapiCfg("public_key", hex.EncodeToString(pub[:]), "constant_packet_size", "true"),
+	} {
+		var ipcErr *IPCError
+		if err := dev.IpcSet(c); !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+			t.Errorf("expected configuring a disabled feature to fail with IpcErrorInvalid, got %v", err)
+		}
+	}
+	if err := dev.IpcSet(uapiCfg("stealth", "false")); err != nil {
+		t.Errorf("turning off a disabled feature failed: %v", err)
+	}
+}
+
+func TestFeatureAnnouncements(t *testing.T) {
+	pair := genTestPair(t, false)
+	for i := range pair {
+		peer := pair[i^1].dev.staticIdentity.publicKey
+		if err := pair[i].dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(peer[:]),
+			"announce_features", "true",
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair[0].dev.SetFeatures(AllFeatures &^ FeatureConstantPacketSize)
+	pk := pair[0].dev.staticIdentity.publicKey
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"constant_packet_size", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	mismatches := make(chan Notification, 1)
+	defer pair[1].dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationFeatureMismatch {
+			mismatches <- n
+		}
+	})()
+
+	pair.Send(t, Ping, nil)
+	select {
+	case n := <-mismatches:
+		if n.Peer != pk || !strings.HasSuffix(n.Message, ": constant_packet_size") {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a feature mismatch")
+	}
+
+	// The responder announces once the session is confirmed.
+	remote := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if features, ok := remote.remoteFeatures(); ok {
+			if features != AllFeatures {
+				t.Errorf("expected all features announced, got %v", features)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no features announced to the responder")
+		}
+	}
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "remote_features=daita,constant_packet_size,obfuscation,multipath\n") {
+		t.Errorf("remote_features missing from IpcGet:\n%s", cfg)
+	}
+}
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// FlowLabelPolicy controls the IPv6 flow label stamped onto outgoing
+// transport packets by binds implementing conn.FlowLabelBind. A fixed label
+// per peer lets ECMP load balancers that hash on the flow label keep a session
+// on a single path. Binds may only be able to hold labels for a limited
+// number of peers, and send the packets of the others without one.
+type FlowLabelPolicy uint32
+
+const (
+	// FlowLabelOff leaves the flow label to the bind. It is the default.
+	FlowLabelOff FlowLabelPolicy = iota
+	// FlowLabelStable uses one random label for the lifetime of the peer.
+	FlowLabelStable
+	// FlowLabelPerRekey draws a new random label whenever a session is derived.
+	FlowLabelPerRekey
+)
+
+const flowLabelMask = 0xfffff
+
+func (policy FlowLabelPolicy) String() string {
+	switch policy {
+	case FlowLabelStable:
+		return "stable"
+	case FlowLabelPerRekey:
+		return "rekey"
+	case FlowLabelOff:
+		return "off"
+	}
+	return fmt.Sprintf("FlowLabelPolicy(%d)", uint32(policy))
+}
+
+func parseFlowLabelPolicy(s string) (FlowLabelPolicy, error) {
+	switch s {
+	case "stable":
+		return FlowLabelStable, nil
+	case "rekey":
+		return FlowLabelPerRekey, nil
+	case "off":
+		return FlowLabelOff, nil
+	}
+	return 0, fmt.Errorf("unknown flow label policy %q", s)
+}
+
+// FlowLabelPolicy returns the device's current flow label policy.
+func (device *Device) FlowLabelPolicy() FlowLabelPolicy {
+	return FlowLabelPolicy(device.net.flowLabel.Load())
+}
+
+// SetFlowLabelPolicy changes the flow label policy. Switching to
+// FlowLabelPerRekey takes effect at the next session of each peer.
+func (device *Device) SetFlowLabelPolicy(policy FlowLabelPolicy) {
+	device.net.flowLabel.Store(uint32(policy))
+}
+
+// rotateFlowLabel draws a new flow label for the peer. The old label is
+// released by the next send, which holds the locks needed to reach the bind.
+// The caller must hold the handshake lock of the peer.
+func (peer *Peer) rotateFlowLabel() {
+	if peer.staleFlowLabel.Load() != 0 {
+		// The label replaced last is yet to be released; keep the current one
+		// rather than leak a lease.
+		return
+	}
+	peer.staleFlowLabel.Store(peer.flowLabel.Swap(randomFlowLabel(peer.device.options.random)))
+}
+
+// releaseStaleFlowLabel releases the label replaced by rotateFlowLabel, if
+// any. The caller must hold the read lock of the device's net.
+func (peer *Peer) releaseStaleFlowLabel(bind conn.FlowLabelBind) {
+	if label := peer.staleFlowLabel.Swap(0); label != 0 {
+		bind.ReleaseFlowLabel(label)
+	}
+}
+
+// releaseFlowLabels releases the flow labels of removed peers.
+func (device *Device) releaseFlowLabels(peers ...*Peer) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind, ok := device.net.bind.(conn.FlowLabelBind)
+	if !ok {
+		return
+	}
+	for _, peer := range peers {
+		peer.releaseStaleFlowLabel(bind)
+		bind.ReleaseFlowLabel(peer.flowLabel.Load())
+	}
+}
+
+// randomFlowLabel returns a random, non-zero 20-bit flow label, drawn from
+// random if the device is deterministic. A zero label would ask the kernel to
+// pick one itself.
+func randomFlowLabel(random *seededRand) uint32 {
+	if random != nil {
+		return random.Uint32()&flowLabelMask | 1
+	}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 1
+	}
+	return binary.LittleEndian.Uint32(b[:])&flowLabelMask | 1
+}
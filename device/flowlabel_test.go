@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestFlowLabelPolicy(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[1].dev
+
+	if policy := dev.FlowLabelPolicy(); policy != FlowLabelOff {
+		t.Fatalf("default flow label policy is %v, want off", policy)
+	}
+	if err := dev.IpcSet(uapiCfg("flow_label", "bogus")); err == nil {
+		t.Fatal("expected invalid flow_label to be rejected")
+	}
+	if err := dev.IpcSet(uapiCfg("flow_label", "rekey")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "flow_label=rekey\n") {
+		t.Fatalf("flow_label missing from IpcGet:\n%s", cfg)
+	}
+
+	var peer *Peer
+	dev.peers.RLock()
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	dev.peers.RUnlock()
+
+	before := peer.flowLabel.Load()
+	if before == 0 || before&^flowLabelMask != 0 {
+		t.Fatalf("invalid initial flow label %#x", before)
+	}
+	pair.Send(t, Ping, nil)
+	if after := peer.flowLabel.Load(); after == before {
+		t.Fatalf("flow label %#x was not rotated by the handshake", after)
+	}
+}
+
+type releaseRecorder struct {
+	conn.FlowLabelBind
+	released []uint32
+}
+
+func (bind *releaseRecorder) ReleaseFlowLabel(flowLabel uint32) {
+	bind.released = append(bind.released, flowLabel)
+}
+
+func TestRotateFlowLabel(t *testing.T) {
+	peer := &Peer{device: new(Device)}
+	peer.flowLabel.Store(1)
+	peer.rotateFlowLabel()
+	second := peer.flowLabel.Load()
+	if second == 1 {
+		t.Fatal("flow label was not rotated")
+	}
+	// The first label is still to be released, so it is not rotated again.
+	peer.rotateFlowLabel()
+	if peer.flowLabel.Load() != second {
+		t.Fatal("flow label rotated before the previous one was released")
+	}
+
+	var bind releaseRecorder
+	peer.releaseStaleFlowLabel(&bind)
+	peer.releaseStaleFlowLabel(&bind)
+	if len(bind.released) != 1 || bind.released[0] != 1 {
+		t.Fatalf("released %v, want [1]", bind.released)
+	}
+	peer.rotateFlowLabel()
+	if peer.flowLabel.Load() == second {
+		t.Fatal("flow label was not rotated after releasing the previous one")
+	}
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Goodbye messages are an opt-in extension that must be enabled on both ends
+// of a tunnel, using the "goodbye" UAPI key. When a peer is removed or its
+// device brought down, a goodbye is sent in the current session, so the other
+// end can expire the session at once instead of waiting for it to time out,
+// and fail over sooner, for example to another hop of a multihop chain.
+//
+// A goodbye takes the place of an IP packet inside the transport message, so
+// it is authenticated by the session like any other packet:
+//
+//	0      1      2      3      4
+//	+------+------+------+------+
+//	| 0xfd | 0x00 | 0x00 | 0x00 |
+//	+------+------+------+------+
+const (
+	// Length (in bytes) of a goodbye message.
+	GoodbyeLen = 4
+
+	// The first byte of a goodbye, taking the place of the IP version field.
+	GoodbyeMarker uint8 = 0xfd
+)
+
+// sendGoodbye sends a goodbye to the peer in its current session, if it has
+// enabled goodbyes. It is best-effort: the goodbye is not retransmitted.
+func (peer *Peer) sendGoodbye() {
+	if !peer.goodbye.Load() || !peer.isRunning.Load() {
+		return
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil || time.Since(keypair.created) >= RejectAfterTime {
+		return
+	}
+	counter := keypair.sendNonce.Add(1) - 1
+	if counter >= RejectAfterMessages {
+		keypair.sendNonce.Store(RejectAfterMessages)
+		return
+	}
+
+	content := make([]byte, GoodbyeLen, GoodbyeLen+PaddingMultiple)
+	content[0] = GoodbyeMarker
+	content = content[:GoodbyeLen+calculatePaddingSize(GoodbyeLen, int(peer.device.tun.mtu.Load()))]
+
+	packet := make([]byte, MessageTransportHeaderSize, MessageTransportHeaderSize+len(content)+chacha20poly1305.Overhead)
+	binary.LittleEndian.PutUint32(packet[0:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(packet[4:8], keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(packet[8:16], counter)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	packet = keypair.send.Seal(packet, nonce[:], content, nil)
+
+	// The device may already be closing, so this bypasses SendBuffer.
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.endpoint == nil {
+		return
+	}
+	if err := peer.sendTo(packet, peer.endpoint, peer.sourceAddr); err != nil {
+		peer.device.log.Verbosef("%v - Failed to send goodbye: %v", peer, err)
+		return
+	}
+	peer.device.log.Verbosef("%v - Sent goodbye", peer)
+}
+
+// sendGoodbyes sends a goodbye to every peer. The peers are collected first,
+// as sending takes the net lock, which must not be taken while holding the
+// peers lock.
+func (device *Device) sendGoodbyes() {
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+
+	for _, peer := range peers {
+		peer.sendGoodbye()
+	}
+}
+
+// receivedGoodbye expires the sessions with the peer, which said goodbye, so
+// that the next packet to it starts a new handshake.
+func (peer *Peer) receivedGoodbye() {
+	peer.device.log.Verbosef("%v - Received goodbye", peer)
+	peer.ExpireCurrentKeypairs()
+	peer.device.notify(NotificationPeerGoodbye, peer, "peer said goodbye")
+}
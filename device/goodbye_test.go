@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func enableGoodbye(t *testing.T, pair testPair, enabled string) {
+	t.Helper()
+	for i := range pair {
+		peer := pair[i^1].dev.staticIdentity.publicKey
+		if err := pair[i].dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(peer[:]),
+			"goodbye", enabled,
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Confirm the session in both directions, so that both ends have a
+	// current keypair to send a goodbye with.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func subscribeGoodbye(dev *Device) (<-chan NoisePublicKey, func()) {
+	goodbyes := make(chan NoisePublicKey, 1)
+	unsubscribe := dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationPeerGoodbye {
+			goodbyes <- n.Peer
+		}
+	})
+	return goodbyes, unsubscribe
+}
+
+func TestGoodbyeOnRemove(t *testing.T) {
+	pair := genTestPair(t, false)
+	enableGoodbye(t, pair, "true")
+	goodbyes, unsubscribe := subscribeGoodbye(pair[0].dev)
+	defer unsubscribe()
+	remote := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "goodbye=true\n") {
+		t.Errorf("goodbye missing from IpcGet:\n%s", cfg)
+	}
+
+	pk := pair[0].dev.staticIdentity.publicKey
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"remove", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-goodbyes:
+		if got != pair[1].dev.staticIdentity.publicKey {
+			t.Errorf("goodbye from the wrong peer %x", got[:])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no goodbye received")
+	}
+	if keypair := remote.keypairs.Current(); keypair != nil && keypair.sendNonce.Load() < RejectAfterMessages {
+		t.Error("session not expired after goodbye")
+	}
+}
+
+func TestGoodbyeOnDown(t *testing.T) {
+	pair := genTestPair(t, false)
+	enableGoodbye(t, pair, "true")
+	goodbyes, unsubscribe := subscribeGoodbye(pair[0].dev)
+	defer unsubscribe()
+
+	if err := pair[1].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-goodbyes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no goodbye received")
+	}
+}
+
+func TestGoodbyeDisabled(t *testing.T) {
+	pair := genTestPair(t, false)
+	enableGoodbye(t, pair, "true")
+	// Goodbyes from a peer that has not enabled them are ignored.
+	pk := pair[1].dev.staticIdentity.publicKey
+	if err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"goodbye", "false",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	goodbyes, unsubscribe := subscribeGoodbye(pair[0].dev)
+	defer unsubscribe()
+	remote := pair[0].dev.LookupPeer(pk)
+
+	if err := pair[1].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-goodbyes:
+		t.Fatal("goodbye accepted from a peer with goodbyes disabled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if remote.keypairs.Current().sendNonce.Load() >= RejectAfterMessages {
+		t.Error("session expired by an ignored goodbye")
+	}
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// GoroutineKind identifies what a goroutine of a device does.
+type GoroutineKind int
+
+const (
+	// GoroutineWorker is a device-wide worker: the encryption, decryption
+	// and handshake workers, the TUN and route listeners, and the timer wheel.
+	GoroutineWorker GoroutineKind = iota
+	// GoroutineReceive receives from the bind, one per receive function.
+	GoroutineReceive
+	// GoroutinePeer is a sequential sender or receiver of a running peer.
+	GoroutinePeer
+	// GoroutineTimer is a peer timer whose expiration is being handled.
+	GoroutineTimer
+	// GoroutineDaita is a DAITA event handler or action queue.
+	GoroutineDaita
+
+	goroutineKinds
+)
+
+func (kind GoroutineKind) String() string {
+	switch kind {
+	case GoroutineWorker:
+		return "worker"
+	case GoroutineReceive:
+		return "receive"
+	case GoroutinePeer:
+		return "peer"
+	case GoroutineTimer:
+		return "timer"
+	case GoroutineDaita:
+		return "daita"
+	}
+	return fmt.Sprintf("GoroutineKind(%d)", int(kind))
+}
+
+type goroutineGauge [goroutineKinds]atomic.Int64
+
+// Goroutines returns how many goroutines of each kind the device is running.
+func (device *Device) Goroutines() map[GoroutineKind]int {
+	counts := make(map[GoroutineKind]int)
+	for kind := range device.goroutines {
+		if n := device.goroutines[kind].Load(); n != 0 {
+			counts[GoroutineKind(kind)] = int(n)
+		}
+	}
+	return counts
+}
+
+func (device *Device) goroutineEnter(kind GoroutineKind) {
+	device.goroutines[kind].Add(1)
+}
+
+func (device *Device) goroutineExit(kind GoroutineKind) {
+	device.goroutines[kind].Add(-1)
+}
+
+// goroutineEnter also counts the goroutine for the peer, which must have none
+// left once it is stopped. Timers are only counted for the device, as they
+// may be rearmed while the peer is stopping.
+func (peer *Peer) goroutineEnter(kind GoroutineKind) {
+	peer.goroutines.Add(1)
+	peer.device.goroutineEnter(kind)
+}
+
+func (peer *Peer) goroutineExit(kind GoroutineKind) {
+	peer.device.goroutineExit(kind)
+	peer.goroutines.Add(-1)
+}
+
+// checkGoroutinesStopped logs an error if goroutines of a stopped peer are
+// still running, which means they leaked.
+func (peer *Peer) checkGoroutinesStopped() {
+	if n := peer.goroutines.Load(); n != 0 {
+		peer.device.log.Errorf("%v - %d goroutines still running after stopping, this is a bug", peer, n)
+	}
+}
+
+// ipcGoroutines serializes the goroutine gauge for IpcGet.
+func ipcGoroutines(sendf func(string, ...any), counts map[GoroutineKind]int) {
+	for kind := GoroutineKind(0); kind < goroutineKinds; kind++ {
+		if n := counts[kind]; n != 0 {
+			sendf("goroutines_%s=%d", kind, n)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestGoroutinesPeerSoak(t *testing.T) {
+	cycles := 10000
+	if testing.Short() {
+		cycles = 1000
+	}
+
+	logger := &Logger{
+		Verbosef: DiscardLogf,
+		Errorf: func(format string, args ...any) {
+			if msg := fmt.Sprintf(format, args...); strings.Contains(msg, "goroutines still running") {
+				t.Error(msg)
+			}
+		},
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], logger)
+	defer dev.Close()
+	sk := NoisePrivateKey{8}
+	if err := dev.IpcSet(uapiCfg("private_key", hex.EncodeToString(sk[:]))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// Encryption, decryption and handshake workers per CPU, and the TUN
+	// reader, event reader and timer wheel.
+	workers := 3*runtime.NumCPU() + 3
+	var baseline map[GoroutineKind]int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if baseline = dev.Goroutines(); baseline[GoroutineWorker] >= workers && baseline[GoroutineReceive] != 0 {
+			break
+		}
+	}
+	if baseline[GoroutineWorker] < workers || baseline[GoroutineReceive] == 0 {
+		t.Fatalf("device workers not counted: %v", baseline)
+	}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < cycles; i++ {
+		peerSk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk := peerSk.publicKey()
+		if err := dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pk[:]),
+			"allowed_ip", "1.0.0.2/32",
+			"persistent_keepalive_interval", "25",
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if n := dev.Goroutines()[GoroutinePeer]; n != 2 {
+				t.Fatalf("expected 2 goroutines for a running peer, got %d", n)
+			}
+		}
+		if err := dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pk[:]),
+			"remove", "true",
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if counts := dev.Goroutines(); counts[GoroutinePeer] != 0 || counts[GoroutineDaita] != 0 {
+		t.Errorf("peer goroutines leaked after %d cycles: %v", cycles, counts)
+	}
+	// Allow exited goroutines to be reaped before comparing with the runtime.
+	var after int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if after = runtime.NumGoroutine(); after <= before {
+			break
+		}
+	}
+	if after > before {
+		t.Errorf("goroutines grew from %d to %d after %d peer cycles", before, after, cycles)
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, fmt.Sprintf("goroutines_worker=%d\n", baseline[GoroutineWorker])) || strings.Contains(cfg, "goroutines_peer=") {
+		t.Errorf("unexpected goroutine gauge in IpcGet:\n%s", cfg)
+	}
+}
+
+// TestGoroutinesPeerChurn removes and re-adds a peer while traffic flows in
+// both directions, which must neither deadlock nor leak its routines.
+func TestGoroutinesPeerChurn(t *testing.T) {
+	cycles := 500
+	if testing.Short() {
+		cycles = 50
+	}
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peerCfg := uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"allowed_ip", "1.0.0.2/32",
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", pair[1].dev.net.port),
+	)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range pair {
+		p, other := pair[i], pair[i^1]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-p.tun.Inbound:
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case p.tun.Outbound <- tuntest.Ping(other.ip, p.ip):
+				}
+			}
+		}()
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < cycles; i++ {
+			if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "remove", "true")); err != nil {
+				done <- err
+				return
+			}
+			if err := dev.IpcSet(peerCfg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatal("adding and removing the peer deadlocked")
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := dev.Goroutines()[GoroutinePeer]; n != 2 {
+		t.Errorf("expected 2 goroutines for the running peer, got %d", n)
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+}
@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// HandshakeFailureReason classifies why a handshake message was dropped or
+// could not be sent.
+type HandshakeFailureReason int
+
+const (
+	// HandshakeFailureMAC is a handshake message with an invalid mac1,
+	// usually sent to the wrong public key.
+	HandshakeFailureMAC HandshakeFailureReason = iota
+	// HandshakeFailureDecrypt is a handshake message that could not be
+	// decrypted, for example because of a mismatched preshared key.
+	HandshakeFailureDecrypt
+	// HandshakeFailureReplay is an initiation with a timestamp that is not
+	// newer than the last one, or a response to an initiation that was
+	// already answered.
+	HandshakeFailureReplay
+	// HandshakeFailureFlood is an initiation that arrived too soon after the
+	// previous one from the same peer.
+	HandshakeFailureFlood
+	// HandshakeFailureUnknownPeer is an initiation from a public key that is
+	// not configured, or a response to an initiation that is not pending.
+	HandshakeFailureUnknownPeer
+	// HandshakeFailureNoRoute is a handshake message that could not be sent
+	// because the peer has no endpoint, or the network is unreachable.
+	HandshakeFailureNoRoute
+	// HandshakeFailureSend is any other error sending a handshake message.
+	HandshakeFailureSend
+	// HandshakeFailureProtocolVersion is a handshake message from a peer
+	// configured with an unsupported protocol version.
+	HandshakeFailureProtocolVersion
+
+	handshakeFailureReasons
+)
+
+func (reason HandshakeFailureReason) String() string {
+	switch reason {
+	case HandshakeFailureMAC:
+		return "mac"
+	case HandshakeFailureDecrypt:
+		return "decrypt"
+	case HandshakeFailureReplay:
+		return "replay"
+	case HandshakeFailureFlood:
+		return "flood"
+	case HandshakeFailureUnknownPeer:
+		return "unknown_peer"
+	case HandshakeFailureNoRoute:
+		return "no_route"
+	case HandshakeFailureSend:
+		return "send"
+	case HandshakeFailureProtocolVersion:
+		return "protocol_version"
+	}
+	return fmt.Sprintf("HandshakeFailureReason(%d)", int(reason))
+}
+
+// A HandshakeFailure records one failed handshake message.
+type HandshakeFailure struct {
+	Time   time.Time
+	Reason HandshakeFailureReason
+
+	// Peer is the public key of the peer the message was from or to.
+	// It is the zero key if the peer could not be identified.
+	Peer NoisePublicKey
+
+	// Endpoint is the remote address of the message, if known.
+	Endpoint string
+
+	// Err describes a send error.
+	Err string
+}
+
+// HandshakeFailureStats holds how many handshake messages failed for each
+// reason since the device was created, and the most recent failures.
+type HandshakeFailureStats struct {
+	Counts map[HandshakeFailureReason]uint64
+	Recent []HandshakeFailure // oldest first
+}
+
+type handshakeFailures struct {
+	counts [handshakeFailureReasons]atomic.Uint64
+
+	sync.Mutex
+	ring [handshakeFailureRingSize]HandshakeFailure
+	next int // index in ring of the next failure
+	len  int
+}
+
+// HandshakeFailures returns the handshake failures of the device, to tell
+// why a handshake did not complete.
+func (device *Device) HandshakeFailures() HandshakeFailureStats {
+	failures := &device.handshakeFailures
+	stats := HandshakeFailureStats{
+		Counts: make(map[HandshakeFailureReason]uint64),
+	}
+	for reason := range failures.counts {
+		if count := failures.counts[reason].Load(); count != 0 {
+			stats.Counts[HandshakeFailureReason(reason)] = count
+		}
+	}
+
+	failures.Lock()
+	defer failures.Unlock()
+	stats.Recent = make([]HandshakeFailure, 0, failures.len)
+	for i := failures.len; i > 0; i-- {
+		stats.Recent = append(stats.Recent, failures.ring[(failures.next-i+len(failures.ring))%len(failures.ring)])
+	}
+	return stats
+}
+
+// recordHandshakeFailure counts a failed handshake message and adds it to
+// the recent failures. peer, endpoint and err may be nil.
+func (device *Device) recordHandshakeFailure(reason HandshakeFailureReason, peer *Peer, endpoint conn.Endpoint, err error) {
+	failures := &device.handshakeFailures
+	failures.counts[reason].Add(1)
+
+	failure := HandshakeFailure{
+		Time:   time.Now(),
+		Reason: reason,
+	}
+	if peer != nil {
+		failure.Peer = peer.handshake.remoteStatic
+	}
+	if endpoint != nil {
+		failure.Endpoint = endpoint.DstToString()
+	}
+	if err != nil {
+		failure.Err = strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+	if peer != nil {
+		detail := reason.String()
+		if failure.Err != "" {
+			detail += ": " + failure.Err
+		}
+		peer.recordError(PeerErrorHandshake, detail)
+	}
+
+	failures.Lock()
+	defer failures.Unlock()
+	failures.ring[failures.next] = failure
+	failures.next = (failures.next + 1) % len(failures.ring)
+	failures.len = min(failures.len+1, len(failures.ring))
+}
+
+// recordHandshakeSendFailure classifies an error from sending a handshake
+// message to peer.
+func (peer *Peer) recordHandshakeSendFailure(err error) {
+	reason := HandshakeFailureSend
+	if errors.Is(err, errNoEndpoint) || errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		reason = HandshakeFailureNoRoute
+	}
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	peer.device.recordHandshakeFailure(reason, peer, endpoint, err)
+}
+
+// ipcHandshakeFailures serializes the handshake failures for IpcGet.
+func ipcHandshakeFailures(sendf func(string, ...any), stats HandshakeFailureStats) {
+	for reason := HandshakeFailureReason(0); reason < handshakeFailureReasons; reason++ {
+		if count := stats.Counts[reason]; count != 0 {
+			sendf("handshake_failures_%s=%d", reason, count)
+		}
+	}
+	for _, failure := range stats.Recent {
+		line := fmt.Sprintf("handshake_failure=%d/%s/%x/%s", failure.Time.UnixNano(), failure.Reason, failure.Peer[:], failure.Endpoint)
+		if failure.Err != "" {
+			line += "/" + failure.Err
+		}
+		sendf("%s", line)
+	}
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// waitHandshakeFailure waits until dev has recorded a failure for reason.
+func waitHandshakeFailure(t *testing.T, dev *Device, reason HandshakeFailureReason) HandshakeFailure {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats := dev.HandshakeFailures()
+		if stats.Counts[reason] == 0 {
+			continue
+		}
+		for i := len(stats.Recent) - 1; i >= 0; i-- {
+			if stats.Recent[i].Reason == reason {
+				return stats.Recent[i]
+			}
+		}
+	}
+	t.Fatalf("no %v handshake failure recorded: %+v", reason, dev.HandshakeFailures())
+	return HandshakeFailure{}
+}
+
+func TestHandshakeFailureClassification(t *testing.T) {
+	pair := genTestPair(t, false)
+	responder, initiator := pair[0].dev, pair[1].dev
+	peer := initiator.LookupPeer(responder.staticIdentity.publicKey)
+
+	// A message that is not addressed to the responder's public key fails
+	// the mac1 check.
+	junk := make([]byte, MessageInitiationSize)
+	junk[0] = MessageInitiationType
+	if err := peer.SendBuffer(junk); err != nil {
+		t.Fatal(err)
+	}
+	if failure := waitHandshakeFailure(t, responder, HandshakeFailureMAC); failure.Peer != (NoisePublicKey{}) || failure.Endpoint == "" {
+		t.Errorf("unexpected mac failure %+v", failure)
+	}
+
+	// The second copy of a valid initiation is a replay.
+	msg, err := initiator.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, msg)
+	packet := buf.Bytes()
+	peer.cookieGenerator.AddMacs(packet)
+	for i := 0; i < 2; i++ {
+		if err := peer.SendBuffer(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failure := waitHandshakeFailure(t, responder, HandshakeFailureReplay); failure.Peer != initiator.staticIdentity.publicKey {
+		t.Errorf("replay attributed to %x", failure.Peer[:])
+	}
+
+	cfg, err := responder.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "handshake_failures_mac=1\n") || !strings.Contains(cfg, "handshake_failures_replay=1\n") {
+		t.Errorf("handshake failure counters missing from IpcGet:\n%s", cfg)
+	}
+	if !strings.Contains(cfg, "/replay/"+hex.EncodeToString(initiator.staticIdentity.publicKey[:])+"/") {
+		t.Errorf("recent handshake failure missing from IpcGet:\n%s", cfg)
+	}
+}
+
+func TestHandshakeFailureNoRoute(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, peerSk := NoisePrivateKey{8}, NoisePrivateKey{16}
+	pk := peerSk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.LookupPeer(pk).SendHandshakeInitiation(false); err == nil {
+		t.Fatal("expected sending without an endpoint to fail")
+	}
+	failure := waitHandshakeFailure(t, dev, HandshakeFailureNoRoute)
+	if failure.Peer != pk || failure.Err == "" {
+		t.Errorf("unexpected no route failure %+v", failure)
+	}
+}
+
+func TestHandshakeFailureRing(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	for i := 0; i < handshakeFailureRingSize+3; i++ {
+		reason := HandshakeFailureDecrypt
+		if i%2 == 1 {
+			reason = HandshakeFailureFlood
+		}
+		dev.recordHandshakeFailure(reason, nil, nil, nil)
+	}
+	stats := dev.HandshakeFailures()
+	if len(stats.Recent) != handshakeFailureRingSize {
+		t.Fatalf("expected %d recent failures, got %d", handshakeFailureRingSize, len(stats.Recent))
+	}
+	if stats.Counts[HandshakeFailureDecrypt]+stats.Counts[HandshakeFailureFlood] != handshakeFailureRingSize+3 {
+		t.Errorf("unexpected counts %v", stats.Counts)
+	}
+	// The three oldest failures were overwritten, so the ring starts at the
+	// fourth, which is a flood.
+	if stats.Recent[0].Reason != HandshakeFailureFlood || stats.Recent[len(stats.Recent)-1].Reason != HandshakeFailureDecrypt {
+		t.Errorf("recent failures out of order: first %v, last %v", stats.Recent[0].Reason, stats.Recent[len(stats.Recent)-1].Reason)
+	}
+	for i := 1; i < len(stats.Recent); i++ {
+		if stats.Recent[i].Time.Before(stats.Recent[i-1].Time) {
+			t.Fatalf("recent failures not oldest first")
+		}
+	}
+}
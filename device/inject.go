@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Embedders may feed packets of their own, such as probes or control
+// traffic, into the device without wrapping its TUN device: InjectOutbound
+// sends a packet to a peer as if it had been read from the TUN device, and
+// InjectInbound writes a packet to the TUN device as if it had been received
+// from a peer.
+
+// checkInjectedPacket checks that packet is an IPv4 or IPv6 packet that fits
+// in a message.
+func checkInjectedPacket(packet []byte) error {
+	if len(packet) == 0 || len(packet) > MaxContentSize {
+		return fmt.Errorf("packet of %d bytes, must be between 1 and %d", len(packet), MaxContentSize)
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return errors.New("truncated IPv4 packet")
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return errors.New("truncated IPv6 packet")
+		}
+	default:
+		return errors.New("not an IPv4 or IPv6 packet")
+	}
+	return nil
+}
+
+// InjectOutbound sends buf, an IPv4 or IPv6 packet, through the tunnel to the
+// peer with the given public key, as if it had been read from the TUN device,
+// initiating a handshake if needed. The peer is not looked up by the
+// destination of the packet, so it need not be within the peer's allowed IPs.
+// buf is copied, and may be reused once InjectOutbound returns.
+func (device *Device) InjectOutbound(buf []byte, peerKey NoisePublicKey) error {
+	if err := checkInjectedPacket(buf); err != nil {
+		return err
+	}
+	peer := device.LookupPeer(peerKey)
+	if peer == nil {
+		return errors.New("unknown peer")
+	}
+	if !peer.isRunning.Load() {
+		return errors.New("peer is not running")
+	}
+	if peer.dropSend() {
+		return errors.New("peer only receives data")
+	}
+	peer.stagePacketCopy(buf)
+	return nil
+}
+
+// stagePacketCopy sends a copy of packet to the peer, as if it had been read
+// from the TUN device.
+func (peer *Peer) stagePacketCopy(packet []byte) {
+	if peer.classifier.enabled.Load() {
+		peer.classifier.count(packet)
+	}
+
+	elem := peer.device.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(packet)]
+	copy(elem.packet, packet)
+	peer.StagePacket(elem)
+	peer.SendStagedPackets()
+
+	if peer.daita != nil {
+		peer.daita.NonpaddingSent(peer, uint(len(packet)))
+	}
+}
+
+// InjectInbound writes buf, an IPv4 or IPv6 packet, to the TUN device, as if
+// it had been received from a peer. Unlike received packets, its source is
+// not checked against the allowed IPs of any peer, and a failed write is
+// returned rather than handled by the TUNWriteFailurePolicy of the device.
+func (device *Device) InjectInbound(buf []byte) error {
+	if err := checkInjectedPacket(buf); err != nil {
+		return err
+	}
+	if !device.isUp() {
+		return errors.New("device is not up")
+	}
+
+	msg := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(msg)
+	n := copy(msg[MessageTransportOffsetContent:], buf)
+
+	// Writes wait while SwapTUN replaces the device.
+	device.tun.RLock()
+	defer device.tun.RUnlock()
+	if _, err := device.tun.device.Write(msg[:MessageTransportOffsetContent+n], MessageTransportOffsetContent); err != nil {
+		return err
+	}
+	return device.tun.device.Flush()
+}
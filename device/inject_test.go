@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestInject(t *testing.T) {
+	pair := genTestPair(t, false)
+	receive := func(want []byte) {
+		t.Helper()
+		select {
+		case got := <-pair[0].tun.Inbound:
+			if !bytes.Equal(got, want) {
+				t.Errorf("TUN device got %x, want %x", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("injected packet did not reach the TUN device")
+		}
+	}
+
+	// A packet injected outbound goes through the tunnel to the peer.
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	if err := pair[1].dev.InjectOutbound(msg, pair[0].dev.staticIdentity.publicKey); err != nil {
+		t.Fatal(err)
+	}
+	receive(msg)
+
+	// A packet injected inbound is written to the TUN device directly.
+	// The channel TUN device blocks writes until they are received.
+	msg = tuntest.Ping(pair[0].ip, pair[0].ip)
+	injected := make(chan error, 1)
+	go func() { injected <- pair[0].dev.InjectInbound(msg) }()
+	receive(msg)
+	if err := <-injected; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, packet := range [][]byte{nil, {0x45, 0}, {0x60}, {0x10, 0, 0, 0}, make([]byte, MaxContentSize+1)} {
+		if pair[0].dev.InjectInbound(packet) == nil {
+			t.Errorf("injected invalid packet %x inbound", packet[:min(len(packet), 4)])
+		}
+		if pair[1].dev.InjectOutbound(packet, pair[0].dev.staticIdentity.publicKey) == nil {
+			t.Errorf("injected invalid packet %x outbound", packet[:min(len(packet), 4)])
+		}
+	}
+	if pair[1].dev.InjectOutbound(msg, NoisePublicKey{}) == nil {
+		t.Error("injected packet to an unknown peer")
+	}
+	if err := pair[0].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if pair[0].dev.InjectInbound(msg) == nil {
+		t.Error("injected packet into a device that is down")
+	}
+}
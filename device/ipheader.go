@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// IPHeaderDistribution is the distribution of the TTL or hop limit, and of
+// the DSCP, of the IP headers of the transport packets received from a peer,
+// on binds that report them. A change of hop limit suggests that the path
+// from the peer changed, and an unexpected DSCP that a middlebox rewrites it.
+type IPHeaderDistribution struct {
+	HopLimits       map[uint8]uint64 // packets by TTL or hop limit
+	DSCPs           map[uint8]uint64 // packets by DSCP
+	HopLimitChanges uint64           // packets whose hop limit differed from the previous one
+	DSCPChanges     uint64           // packets whose DSCP differed from the previous one
+}
+
+// peerIPHeaders counts the IP header fields of the packets received from a
+// peer. Its histograms are only allocated once the bind reports a field.
+type peerIPHeaders struct {
+	histograms      atomic.Pointer[ipHeaderHistograms]
+	lastHopLimit    atomic.Uint32 // plus one, 0 before the first packet
+	lastDSCP        atomic.Uint32 // plus one, 0 before the first packet
+	hopLimitChanges atomic.Uint64
+	dscpChanges     atomic.Uint64
+}
+
+type ipHeaderHistograms struct {
+	hopLimits [256]atomic.Uint64
+	dscps     [64]atomic.Uint64
+}
+
+// recordIPHeader counts the IP header fields of a packet authenticated as
+// coming from the peer through endpoint, if the bind reported them.
+func (peer *Peer) recordIPHeader(endpoint conn.Endpoint) {
+	header, ok := endpoint.(conn.IPHeaderEndpoint)
+	if !ok {
+		return
+	}
+	hopLimit, hasHopLimit := header.ReceiveHopLimit()
+	dscp, hasDSCP := header.ReceiveDSCP()
+	if !hasHopLimit && !hasDSCP {
+		return
+	}
+	stats := &peer.ipHeaders
+	histograms := stats.histograms.Load()
+	if histograms == nil {
+		stats.histograms.CompareAndSwap(nil, new(ipHeaderHistograms))
+		histograms = stats.histograms.Load()
+	}
+	if hasHopLimit {
+		histograms.hopLimits[hopLimit].Add(1)
+		if last := stats.lastHopLimit.Swap(uint32(hopLimit) + 1); last != 0 && last != uint32(hopLimit)+1 {
+			stats.hopLimitChanges.Add(1)
+		}
+	}
+	if hasDSCP {
+		dscp &= 63
+		histograms.dscps[dscp].Add(1)
+		if last := stats.lastDSCP.Swap(uint32(dscp) + 1); last != 0 && last != uint32(dscp)+1 {
+			stats.dscpChanges.Add(1)
+		}
+	}
+}
+
+func (stats *peerIPHeaders) snapshot() IPHeaderDistribution {
+	distribution := IPHeaderDistribution{
+		HopLimitChanges: stats.hopLimitChanges.Load(),
+		DSCPChanges:     stats.dscpChanges.Load(),
+	}
+	histograms := stats.histograms.Load()
+	if histograms == nil {
+		return distribution
+	}
+	for value := range histograms.hopLimits {
+		if packets := histograms.hopLimits[value].Load(); packets != 0 {
+			if distribution.HopLimits == nil {
+				distribution.HopLimits = make(map[uint8]uint64)
+			}
+			distribution.HopLimits[uint8(value)] = packets
+		}
+	}
+	for value := range histograms.dscps {
+		if packets := histograms.dscps[value].Load(); packets != 0 {
+			if distribution.DSCPs == nil {
+				distribution.DSCPs = make(map[uint8]uint64)
+			}
+			distribution.DSCPs[uint8(value)] = packets
+		}
+	}
+	return distribution
+}
+
+// IPHeaderDistribution returns the distribution of the IP header fields of
+// the packets received from the peer with the given public key, and false if
+// there is no such peer.
+func (device *Device) IPHeaderDistribution(pk NoisePublicKey) (IPHeaderDistribution, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return IPHeaderDistribution{}, false
+	}
+	return peer.ipHeaders.snapshot(), true
+}
+
+// ipcIPHeaders serializes the IP header fields of the packets received from
+// a peer for IpcGet, in increasing order of value.
+func ipcIPHeaders(sendf func(string, ...any), stats *peerIPHeaders) {
+	histograms := stats.histograms.Load()
+	if histograms == nil {
+		return
+	}
+	for value := range histograms.hopLimits {
+		if packets := histograms.hopLimits[value].Load(); packets != 0 {
+			sendf("rx_hop_limit=%d/%d", value, packets)
+		}
+	}
+	for value := range histograms.dscps {
+		if packets := histograms.dscps[value].Load(); packets != 0 {
+			sendf("rx_dscp=%d/%d", value, packets)
+		}
+	}
+	if changes := stats.hopLimitChanges.Load(); changes != 0 {
+		sendf("rx_hop_limit_changes=%d", changes)
+	}
+	if changes := stats.dscpChanges.Load(); changes != 0 {
+		sendf("rx_dscp_changes=%d", changes)
+	}
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type ipHeaderEndpoint struct {
+	*DummyEndpoint
+	hopLimit, dscp uint8
+}
+
+func (e ipHeaderEndpoint) ReceiveHopLimit() (uint8, bool) { return e.hopLimit, true }
+func (e ipHeaderEndpoint) ReceiveDSCP() (uint8, bool)     { return e.dscp, true }
+
+func TestIPHeaderDistribution(t *testing.T) {
+	pair := genTestPair(t, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	dummy, err := CreateDummyEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []struct{ hopLimit, dscp uint8 }{
+		{60, 0}, {60, 0}, {58, 0}, {60, 46},
+	} {
+		peer.recordIPHeader(ipHeaderEndpoint{dummy, header.hopLimit, header.dscp})
+	}
+	// Endpoints of binds that do not report IP headers are ignored.
+	peer.recordIPHeader(dummy)
+
+	got, ok := pair[0].dev.IPHeaderDistribution(pair[1].dev.staticIdentity.publicKey)
+	if !ok {
+		t.Fatal("no distribution for peer")
+	}
+	want := IPHeaderDistribution{
+		HopLimits:       map[uint8]uint64{58: 1, 60: 3},
+		DSCPs:           map[uint8]uint64{0: 3, 46: 1},
+		HopLimitChanges: 2,
+		DSCPChanges:     1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got distribution %+v, want %+v", got, want)
+	}
+
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"rx_hop_limit=58/1\nrx_hop_limit=60/3\n",
+		"rx_dscp=0/3\nrx_dscp=46/1\n",
+		"rx_hop_limit_changes=2\n",
+		"rx_dscp_changes=1\n",
+	} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet is missing %q:\n%s", line, cfg)
+		}
+	}
+}
+
+func TestIPHeaderDistributionReceived(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	got, _ := pair[0].dev.IPHeaderDistribution(pair[1].dev.staticIdentity.publicKey)
+	if got.HopLimits == nil {
+		t.Skip("bind reports no hop limits")
+	}
+	for hopLimit := range got.HopLimits {
+		if hopLimit == 0 {
+			t.Error("received packet with a hop limit of 0")
+		}
+	}
+}
@@ -30,6 +30,8 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	limits       keypairLimits
+	compression  atomic.Pointer[peerCompression] // negotiated in this session, nil if none
 }
 
 type Keypairs struct {
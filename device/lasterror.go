@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PeerErrorKind classifies the last error of a peer.
+type PeerErrorKind int
+
+const (
+	// PeerErrorSend is a transport data packet that could not be sent.
+	PeerErrorSend PeerErrorKind = iota
+	// PeerErrorHandshake is a handshake message to or from the peer that
+	// was dropped or could not be sent, see HandshakeFailureReason.
+	PeerErrorHandshake
+	// PeerErrorCookieRequired is a cookie reply from the peer, which is
+	// under load and requires a cookie before it answers handshakes.
+	PeerErrorCookieRequired
+	// PeerErrorDecrypt is a transport data packet from the peer that
+	// failed authentication.
+	PeerErrorDecrypt
+)
+
+func (kind PeerErrorKind) String() string {
+	switch kind {
+	case PeerErrorSend:
+		return "send"
+	case PeerErrorHandshake:
+		return "handshake"
+	case PeerErrorCookieRequired:
+		return "cookie_required"
+	case PeerErrorDecrypt:
+		return "decrypt"
+	}
+	return fmt.Sprintf("PeerErrorKind(%d)", int(kind))
+}
+
+// A PeerError is the last transport or handshake error of a peer, kept so
+// that a tunnel that does not come up can be diagnosed without verbose logs.
+type PeerError struct {
+	Time time.Time
+	Kind PeerErrorKind
+	Err  string
+}
+
+type peerLastError struct {
+	sync.Mutex
+	err PeerError // zero Time if there was none
+}
+
+func (peer *Peer) recordError(kind PeerErrorKind, detail string) {
+	peer.lastError.Lock()
+	peer.lastError.err = PeerError{
+		Time: time.Now(),
+		Kind: kind,
+		Err:  strings.ReplaceAll(detail, "\n", " "),
+	}
+	peer.lastError.Unlock()
+}
+
+func (peer *Peer) loadLastError() (PeerError, bool) {
+	peer.lastError.Lock()
+	defer peer.lastError.Unlock()
+	return peer.lastError.err, !peer.lastError.err.Time.IsZero()
+}
+
+// lastErrorTimeSec returns the time of the last error in seconds since the
+// epoch, or 0 if there was none.
+func (peer *Peer) lastErrorTimeSec() uint64 {
+	if lastError, ok := peer.loadLastError(); ok {
+		return uint64(lastError.Time.Unix())
+	}
+	return 0
+}
+
+// PeerLastError returns the last error of the peer with public key pk, and
+// whether it had any.
+func (device *Device) PeerLastError(pk NoisePublicKey) (PeerError, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return PeerError{}, false
+	}
+	return peer.loadLastError()
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPeerLastError(t *testing.T) {
+	pair := genTestPairWith(t, false, func(i int, dev tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			bind = &tooBigBind{bind}
+		}
+		return NewDevice(dev, bind, logger)
+	})
+	dev := pair[1].dev
+	pk := pair[0].dev.staticIdentity.publicKey
+	if _, ok := dev.PeerLastError(pk); ok {
+		t.Fatal("unexpected error before sending")
+	}
+
+	var lastError PeerError
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+		var ok bool
+		if lastError, ok = dev.PeerLastError(pk); ok && lastError.Kind == PeerErrorSend {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a send error, got %+v", lastError)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(lastError.Err, "message too long") || time.Since(lastError.Time) > 5*time.Second {
+		t.Errorf("unexpected error %+v", lastError)
+	}
+
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "last_error=") || !strings.Contains(config, "/send/") {
+		t.Errorf("expected last_error in IpcGet, got:\n%s", config)
+	}
+
+	peer := dev.LookupPeer(pk)
+	peer.device.recordHandshakeFailure(HandshakeFailureFlood, peer, nil, nil)
+	if lastError, _ := dev.PeerLastError(pk); lastError.Kind != PeerErrorHandshake || lastError.Err != "flood" {
+		t.Errorf("unexpected error after handshake failure %+v", lastError)
+	}
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// An anycast endpoint is served by several servers, and the route to it may
+// change in the middle of a session, sending the traffic of the peer to a
+// server without the session. The endpointLatch records the address that the
+// latest handshake message of the peer was received from, which is the
+// unicast address of the server that completed the handshake, and, if
+// enabled, sends the traffic of the peer to that address until a handshake
+// to it fails.
+type endpointLatch struct {
+	enabled   atomic.Bool   // see latch_endpoint
+	handshake conn.Endpoint // source of the latest handshake message, protected by the peer's mutex
+}
+
+// setEndpointFromHandshake records endpoint, the source of a handshake message
+// received from the peer, and latches onto it if enabled, ignoring roaming
+// settings. Otherwise, endpoint is handled as that of any other packet.
+func (peer *Peer) setEndpointFromHandshake(endpoint conn.Endpoint) {
+	peer.Lock()
+	peer.latch.handshake = endpoint
+	if !peer.latch.enabled.Load() {
+		peer.Unlock()
+		peer.SetEndpointFromPacket(endpoint)
+		return
+	}
+	latched := peer.endpoint == nil || peer.endpoint.DstToString() != endpoint.DstToString()
+	peer.endpoint = endpoint
+	peer.Unlock()
+	if latched {
+		peer.device.log.Verbosef("%v - Latched onto endpoint %s", peer, endpoint.DstToString())
+		peer.autoKeepaliveReset()
+	}
+}
+
+// latchEndpoint enables or disables latching onto the source of the handshake
+// messages of the peer. Enabling it latches onto that of the latest one, if
+// any, at once.
+func (peer *Peer) latchEndpoint(enabled bool) {
+	peer.latch.enabled.Store(enabled)
+	if !enabled {
+		return
+	}
+	peer.Lock()
+	endpoint := peer.latch.handshake
+	if endpoint != nil {
+		peer.endpoint = endpoint
+	}
+	peer.Unlock()
+}
+
+// unlatchEndpoint returns the peer to its configured endpoint when a
+// handshake to the endpoint it is latched onto does not complete, as the
+// server behind it may be gone.
+func (peer *Peer) unlatchEndpoint() {
+	if !peer.latch.enabled.Load() {
+		return
+	}
+	peer.Lock()
+	latched := peer.latch.handshake
+	configured := peer.failover.configured
+	if latched == nil || configured == nil || peer.endpoint == nil ||
+		peer.endpoint.DstToString() != latched.DstToString() ||
+		latched.DstToString() == configured.DstToString() {
+		peer.Unlock()
+		return
+	}
+	peer.endpoint = configured
+	peer.latch.handshake = nil
+	peer.Unlock()
+	peer.device.log.Verbosef("%v - Handshake to latched endpoint %s did not complete, returning to %s", peer, latched.DstToString(), configured.DstToString())
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEndpointLatch(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	// The initiator records the source of the handshake response.
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "handshake_endpoint=127.0.0.1:") {
+		t.Fatalf("handshake_endpoint missing from IpcGet:\n%s", cfg)
+	}
+
+	if err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pair[1].dev.staticIdentity.publicKey[:]),
+		"latch_endpoint", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "latch_endpoint=true\n") {
+		t.Fatalf("latch_endpoint missing from IpcGet:\n%s", cfg)
+	}
+
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	peer.RLock()
+	configured := peer.endpoint
+	peer.RUnlock()
+
+	unicast, err := CreateDummyEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roamed, err := CreateDummyEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+
+	// The peer latches onto the source of handshake messages, and does not
+	// roam to the sources of other packets.
+	peer.setEndpointFromHandshake(unicast)
+	peer.SetEndpointFromPacket(roamed)
+	if got := endpoint(); got != unicast.DstToString() {
+		t.Fatalf("expected endpoint to be latched onto %s, got %s", unicast.DstToString(), got)
+	}
+
+	// A failed handshake returns the peer to its configured endpoint.
+	peer.unlatchEndpoint()
+	if got := endpoint(); got != configured.DstToString() {
+		t.Fatalf("expected endpoint to return to %s, got %s", configured.DstToString(), got)
+	}
+}
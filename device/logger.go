@@ -6,6 +6,7 @@
 package device
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
@@ -46,3 +47,55 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// newLevelLogger wraps logger so that its output is capped at device's
+// current log level, which can be changed with SetLogLevel.
+func (device *Device) newLevelLogger(logger *Logger) *Logger {
+	return &Logger{
+		Verbosef: func(format string, args ...any) {
+			if logger.Verbosef != nil && device.logLevel.Load() >= LogLevelVerbose {
+				logger.Verbosef(format, args...)
+			}
+		},
+		Errorf: func(format string, args ...any) {
+			if logger.Errorf != nil && device.logLevel.Load() >= LogLevelError {
+				logger.Errorf(format, args...)
+			}
+		},
+	}
+}
+
+// SetLogLevel caps the device's logging at level, one of the LogLevel
+// constants, without recreating the device. Lines that the Logger passed to
+// NewDevice discards stay discarded, so pass a verbose Logger to be able to
+// raise the level later.
+func (device *Device) SetLogLevel(level int) {
+	device.logLevel.Store(int32(level))
+}
+
+// LogLevel returns the level set by SetLogLevel, LogLevelVerbose by default.
+func (device *Device) LogLevel() int {
+	return int(device.logLevel.Load())
+}
+
+func logLevelString(level int) string {
+	switch level {
+	case LogLevelSilent:
+		return "silent"
+	case LogLevelError:
+		return "error"
+	}
+	return "verbose"
+}
+
+func parseLogLevel(s string) (int, error) {
+	switch s {
+	case "verbose", "debug":
+		return LogLevelVerbose, nil
+	case "error":
+		return LogLevelError, nil
+	case "silent":
+		return LogLevelSilent, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestRuntimeLogLevel(t *testing.T) {
+	var verbose, errors atomic.Int32
+	logger := &Logger{
+		Verbosef: func(string, ...any) { verbose.Add(1) },
+		Errorf:   func(string, ...any) { errors.Add(1) },
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], logger)
+	defer dev.Close()
+
+	if err := dev.IpcSet(uapiCfg("log_level", "loud")); err == nil {
+		t.Fatal("expected invalid log_level to be rejected")
+	}
+	if err := dev.IpcSet(uapiCfg("log_level", "error")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "log_level=error\n") {
+		t.Fatalf("log_level missing from IpcGet:\n%s", cfg)
+	}
+
+	verbose.Store(0)
+	errors.Store(0)
+	dev.log.Verbosef("hidden")
+	dev.log.Errorf("shown")
+	if verbose.Load() != 0 || errors.Load() != 1 {
+		t.Fatalf("at error level: got %d verbose and %d error lines", verbose.Load(), errors.Load())
+	}
+
+	dev.SetLogLevel(LogLevelSilent)
+	dev.log.Errorf("hidden")
+	if errors.Load() != 1 {
+		t.Fatal("error line logged while silent")
+	}
+
+	if err := dev.IpcSet(uapiCfg("log_level", "verbose")); err != nil {
+		t.Fatal(err)
+	}
+	dev.log.Verbosef("shown")
+	if verbose.Load() == 0 {
+		t.Fatal("verbose line not logged after raising the level")
+	}
+}
@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package maybenot
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+type DistType uint32
+
+// The parameters of each type of distribution, in the order of Param1, Param2
+// and Param3, are in its comment.
+const (
+	Uniform    DistType = iota // low, high
+	Normal                     // mean, standard deviation
+	SkewNormal                 // location, scale, shape
+	LogNormal                  // mu, sigma
+	Binomial                   // trials, probability
+	Geometric                  // probability
+	Pareto                     // scale, shape
+	Poisson                    // lambda
+	Weibull                    // scale, shape
+	Gamma                      // scale, shape
+	Beta                       // alpha, beta
+)
+
+func (t DistType) params() int {
+	switch t {
+	case SkewNormal:
+		return 3
+	case Geometric, Poisson:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// A Dist is a probability distribution. Samples are offset by Start, clamped
+// to 0, and capped to Max unless it is 0.
+type Dist struct {
+	Type                   DistType
+	Param1, Param2, Param3 float64
+	Start                  float64
+	Max                    float64
+}
+
+// Validate checks the parameters of the distribution.
+func (dist *Dist) Validate() error {
+	for _, f := range []float64{dist.Param1, dist.Param2, dist.Param3, dist.Start, dist.Max} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("non-finite parameter of distribution %d", dist.Type)
+		}
+	}
+	positive := func(f ...float64) bool {
+		for _, f := range f {
+			if f <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	var ok bool
+	switch dist.Type {
+	case Uniform:
+		ok = dist.Param1 <= dist.Param2
+	case Normal, LogNormal:
+		ok = dist.Param2 >= 0
+	case SkewNormal:
+		ok = positive(dist.Param2)
+	case Binomial:
+		ok = dist.Param1 >= 0 && dist.Param1 <= 1<<32 && isFraction(dist.Param2)
+	case Geometric:
+		ok = dist.Param1 > 0 && dist.Param1 <= 1
+	case Poisson:
+		ok = positive(dist.Param1)
+	case Pareto, Weibull, Gamma, Beta:
+		ok = positive(dist.Param1, dist.Param2)
+	default:
+		return fmt.Errorf("invalid distribution %d", dist.Type)
+	}
+	if !ok {
+		return fmt.Errorf("invalid parameters of distribution %d: %v, %v, %v", dist.Type, dist.Param1, dist.Param2, dist.Param3)
+	}
+	return nil
+}
+
+// Sample draws a value from the distribution.
+func (dist *Dist) Sample(rng *rand.Rand) float64 {
+	v := dist.sample(rng) + dist.Start
+	if !(v > 0) {
+		return 0
+	}
+	if dist.Max > 0 {
+		return min(v, dist.Max)
+	}
+	return v
+}
+
+func (dist *Dist) sample(rng *rand.Rand) float64 {
+	switch dist.Type {
+	case Uniform:
+		return dist.Param1 + (dist.Param2-dist.Param1)*rng.Float64()
+	case Normal:
+		return dist.Param1 + dist.Param2*rng.NormFloat64()
+	case SkewNormal:
+		delta := dist.Param3 / math.Sqrt(1+dist.Param3*dist.Param3)
+		z := delta*math.Abs(rng.NormFloat64()) + math.Sqrt(1-delta*delta)*rng.NormFloat64()
+		return dist.Param1 + dist.Param2*z
+	case LogNormal:
+		return math.Exp(dist.Param1 + dist.Param2*rng.NormFloat64())
+	case Binomial:
+		return float64(binomial(rng, uint64(dist.Param1), dist.Param2))
+	case Geometric:
+		if dist.Param1 == 1 {
+			return 0
+		}
+		return math.Floor(math.Log(uniformOpen(rng)) / math.Log1p(-dist.Param1))
+	case Pareto:
+		return dist.Param1 * math.Pow(uniformOpen(rng), -1/dist.Param2)
+	case Poisson:
+		return float64(poisson(rng, dist.Param1))
+	case Weibull:
+		return dist.Param1 * math.Pow(-math.Log(uniformOpen(rng)), 1/dist.Param2)
+	case Gamma:
+		return dist.Param1 * gamma(rng, dist.Param2)
+	case Beta:
+		x, y := gamma(rng, dist.Param1), gamma(rng, dist.Param2)
+		if x+y == 0 {
+			return 0
+		}
+		return x / (x + y)
+	}
+	return 0
+}
+
+// uniformOpen returns a uniform sample in (0, 1].
+func uniformOpen(rng *rand.Rand) float64 {
+	return 1 - rng.Float64()
+}
+
+// gamma samples the gamma distribution with the given shape and a scale of 1,
+// by Marsaglia and Tsang's method.
+func gamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return gamma(rng, shape+1) * math.Pow(uniformOpen(rng), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := uniformOpen(rng)
+		if math.Log(u) < x*x/2+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+func lgamma(x float64) float64 {
+	y, _ := math.Lgamma(x)
+	return y
+}
+
+// poisson samples the Poisson distribution by multiplication of uniform
+// samples for small means, and otherwise by Hörmann's PTRS.
+func poisson(rng *rand.Rand, lambda float64) uint64 {
+	if lambda < 10 {
+		limit, product := math.Exp(-lambda), rng.Float64()
+		var k uint64
+		for product > limit {
+			product *= rng.Float64()
+			k++
+		}
+		return k
+	}
+	slam, loglam := math.Sqrt(lambda), math.Log(lambda)
+	b := 0.931 + 2.53*slam
+	a := -0.059 + 0.02483*b
+	invalpha := 1.1239 + 1.1328/(b-3.4)
+	vr := 0.9277 - 3.6224/(b-2)
+	for {
+		u := rng.Float64() - 0.5
+		v := rng.Float64()
+		us := 0.5 - math.Abs(u)
+		k := math.Floor((2*a/us+b)*u + lambda + 0.43)
+		if us >= 0.07 && v <= vr {
+			return uint64(k)
+		}
+		if k < 0 || (us < 0.013 && v > us) {
+			continue
+		}
+		if math.Log(v)+math.Log(invalpha)-math.Log(a/(us*us)+b) <= -lambda+k*loglam-lgamma(k+1) {
+			return uint64(k)
+		}
+	}
+}
+
+// binomial samples the binomial distribution by skipping geometrically
+// distributed failures for few expected successes, and otherwise by
+// Hörmann's BTRS.
+func binomial(rng *rand.Rand, n uint64, p float64) uint64 {
+	if p > 0.5 {
+		return n - binomial(rng, n, 1-p)
+	}
+	if n == 0 || p == 0 {
+		return 0
+	}
+	if float64(n)*p < 10 {
+		lq := math.Log1p(-p)
+		var successes, trial uint64
+		for {
+			skip := math.Floor(math.Log(uniformOpen(rng))/lq) + 1
+			if skip > float64(n-trial) {
+				return successes
+			}
+			trial += uint64(skip)
+			successes++
+		}
+	}
+	nf, q := float64(n), 1-p
+	spq := math.Sqrt(nf * p * q)
+	b := 1.15 + 2.53*spq
+	a := -0.0873 + 0.0248*b + 0.01*p
+	c := nf*p + 0.5
+	vr := 0.92 - 4.2/b
+	alpha := (2.83 + 5.1/b) * spq
+	lpq := math.Log(p / q)
+	m := math.Floor((nf + 1) * p)
+	h := lgamma(m+1) + lgamma(nf-m+1)
+	for {
+		u := rng.Float64() - 0.5
+		v := rng.Float64()
+		us := 0.5 - math.Abs(u)
+		k := math.Floor((2*a/us+b)*u + c)
+		if k < 0 || k > nf {
+			continue
+		}
+		if us >= 0.07 && v <= vr {
+			return uint64(k)
+		}
+		v = math.Log(v * alpha / (a/(us*us) + b))
+		if v <= h-lgamma(k+1)-lgamma(nf-k+1)+(k-m)*lpq {
+			return uint64(k)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package maybenot
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// maxInternalEvents bounds the events that machines may trigger among
+// themselves, such as LimitReached, CounterZero and Signal, in a call to
+// TriggerEvents, so that machines cannot loop forever.
+const maxInternalEvents = 1024
+
+// A TriggerEvent is an event reported to a Framework. Machine is the machine
+// that the event is about for PaddingSent, BlockingBegin and TimerEnd, and
+// is ignored otherwise. BlockingBegin may have a negative Machine for blocking
+// begun by a machine of another framework.
+type TriggerEvent struct {
+	Event   Event
+	Machine int
+}
+
+// A TriggerAction is an action of a machine, to be performed by the caller of
+// TriggerEvents.
+type TriggerAction struct {
+	Kind    ActionKind
+	Machine int
+
+	// With ActionCancel, the timers to cancel. The framework has already
+	// stopped an internal timer.
+	Timer Timer
+
+	// With ActionSendPadding and ActionBlockOutgoing.
+	Bypass  bool
+	Replace bool
+	Timeout time.Duration
+
+	// With ActionBlockOutgoing, for how long to block. With
+	// ActionUpdateTimer, when to report TimerEnd, replacing any earlier timer
+	// of the machine.
+	Duration time.Duration
+}
+
+// A Framework runs machines on the events it is told about. It is not safe for
+// concurrent use.
+type Framework struct {
+	machines        []*Machine
+	runtimes        []machineRuntime
+	maxPaddingFrac  float64
+	maxBlockingFrac float64
+	rng             *rand.Rand
+	start           time.Time
+
+	normalSent  uint64
+	paddingSent uint64
+	blocked     time.Duration // blocking that has ended
+	blocking    struct {
+		active  bool
+		machine int
+		since   time.Time
+	}
+
+	pending   []TriggerEvent // internal events
+	actions   []TriggerAction
+	hasAction []bool
+	out       []TriggerAction
+}
+
+type machineRuntime struct {
+	state       int
+	stateLimit  uint64
+	counters    [2]uint64
+	normalSent  uint64
+	paddingSent uint64
+	blocked     time.Duration
+	timerEnd    time.Time // zero if the internal timer is not running
+}
+
+// NewFramework starts machines at now, sharing limits on the fractions of the
+// sent packets that may be padding, and of the time outgoing traffic may be
+// blocked, or 0 for no limit. The framework samples its distributions from rng.
+func NewFramework(machines []*Machine, maxPaddingFrac, maxBlockingFrac float64, now time.Time, rng *rand.Rand) (*Framework, error) {
+	if len(machines) == 0 {
+		return nil, errors.New("no machines")
+	}
+	if !isFraction(maxPaddingFrac) || !isFraction(maxBlockingFrac) {
+		return nil, fmt.Errorf("invalid max padding or blocking fraction %v, %v", maxPaddingFrac, maxBlockingFrac)
+	}
+	for i, machine := range machines {
+		if err := machine.Validate(); err != nil {
+			return nil, fmt.Errorf("machine %d: %w", i, err)
+		}
+	}
+	f := &Framework{
+		machines:        machines,
+		runtimes:        make([]machineRuntime, len(machines)),
+		maxPaddingFrac:  maxPaddingFrac,
+		maxBlockingFrac: maxBlockingFrac,
+		rng:             rng,
+		start:           now,
+		actions:         make([]TriggerAction, len(machines)),
+		hasAction:       make([]bool, len(machines)),
+	}
+	// Machines start in their first state, without taking its action.
+	for i := range f.runtimes {
+		f.runtimes[i].stateLimit = f.sampleLimit(machines[i].States[0].Action)
+	}
+	return f, nil
+}
+
+// NumMachines returns the number of machines run by the framework.
+func (f *Framework) NumMachines() int {
+	return len(f.machines)
+}
+
+// TriggerEvents runs the machines on events that happened at now, and returns
+// at most one action per machine, the last it took. The actions are only
+// valid until the next call.
+func (f *Framework) TriggerEvents(events []TriggerEvent, now time.Time) []TriggerAction {
+	clear(f.hasAction)
+	for _, event := range events {
+		f.process(event, now)
+	}
+	for i := 0; i < len(f.pending); i++ {
+		f.process(f.pending[i], now)
+	}
+	f.pending = f.pending[:0]
+
+	f.out = f.out[:0]
+	for i, ok := range f.hasAction {
+		if ok {
+			f.out = append(f.out, f.actions[i])
+		}
+	}
+	return f.out
+}
+
+func (f *Framework) process(event TriggerEvent, now time.Time) {
+	machine := event.Machine
+	switch event.Event {
+	case PaddingSent, TimerBegin, TimerEnd, LimitReached, CounterZero, Signal:
+		if machine < 0 || machine >= len(f.machines) {
+			return
+		}
+	}
+
+	switch event.Event {
+	case NormalSent:
+		f.normalSent++
+		for i := range f.runtimes {
+			f.runtimes[i].normalSent++
+		}
+	case PaddingSent:
+		f.paddingSent++
+		f.runtimes[machine].paddingSent++
+		f.performed(machine, ActionSendPadding)
+		f.transition(machine, PaddingSent, now)
+		return
+	case BlockingBegin:
+		if machine >= len(f.machines) {
+			machine = -1
+		}
+		f.endBlocking(now)
+		f.blocking.active = true
+		f.blocking.machine = machine
+		f.blocking.since = now
+		if machine >= 0 {
+			f.performed(machine, ActionBlockOutgoing)
+		}
+	case BlockingEnd:
+		f.endBlocking(now)
+	case TimerBegin:
+		f.performed(machine, ActionUpdateTimer)
+		f.transition(machine, TimerBegin, now)
+		return
+	case TimerEnd:
+		runtime := &f.runtimes[machine]
+		// A timer that was replaced or cancelled may still expire.
+		if runtime.timerEnd.IsZero() || now.Before(runtime.timerEnd) {
+			return
+		}
+		runtime.timerEnd = time.Time{}
+		f.transition(machine, TimerEnd, now)
+		return
+	case LimitReached, CounterZero:
+		f.transition(machine, event.Event, now)
+		return
+	case Signal:
+		for i := range f.machines {
+			if i != machine {
+				f.transition(i, Signal, now)
+			}
+		}
+		return
+	}
+	for i := range f.machines {
+		f.transition(i, event.Event, now)
+	}
+}
+
+// endBlocking accounts for the blocking that is active, if any, as ended at now.
+func (f *Framework) endBlocking(now time.Time) {
+	if !f.blocking.active {
+		return
+	}
+	blocked := max(now.Sub(f.blocking.since), 0)
+	f.blocked += blocked
+	if f.blocking.machine >= 0 {
+		f.runtimes[f.blocking.machine].blocked += blocked
+	}
+	f.blocking.active = false
+}
+
+// performed counts the action of kind as performed by machine, against the
+// limit of its state.
+func (f *Framework) performed(machine int, kind ActionKind) {
+	runtime := &f.runtimes[machine]
+	if runtime.state >= len(f.machines[machine].States) {
+		return
+	}
+	action := f.machines[machine].States[runtime.state].Action
+	if action == nil || action.Kind != kind || runtime.stateLimit == 0 {
+		return
+	}
+	runtime.stateLimit--
+	if runtime.stateLimit == 0 {
+		f.trigger(LimitReached, machine)
+	}
+}
+
+// trigger queues an internal event.
+func (f *Framework) trigger(event Event, machine int) {
+	if len(f.pending) < maxInternalEvents {
+		f.pending = append(f.pending, TriggerEvent{Event: event, Machine: machine})
+	}
+}
+
+func (f *Framework) transition(machine int, event Event, now time.Time) {
+	runtime := &f.runtimes[machine]
+	states := f.machines[machine].States
+	if runtime.state >= len(states) {
+		return
+	}
+
+	r := f.rng.Float64()
+	var sum float64
+	for _, trans := range states[runtime.state].Transitions[event] {
+		sum += float64(trans.Probability)
+		if r >= sum {
+			continue
+		}
+		switch trans.State {
+		case StateEnd:
+			runtime.state = StateEnd
+		case StateSignal:
+			f.trigger(Signal, machine)
+		default:
+			f.enter(machine, trans.State, now)
+		}
+		return
+	}
+}
+
+func (f *Framework) enter(machine, state int, now time.Time) {
+	runtime := &f.runtimes[machine]
+	runtime.state = state
+	s := &f.machines[machine].States[state]
+	runtime.stateLimit = f.sampleLimit(s.Action)
+
+	for i, counter := range s.Counters {
+		if counter == nil {
+			continue
+		}
+		value := uint64(1)
+		if counter.Copy {
+			value = runtime.counters[1-i]
+		} else if counter.Dist != nil {
+			value = toUint64(counter.Dist.Sample(f.rng))
+		}
+		before := runtime.counters[i]
+		switch counter.Operation {
+		case Increment:
+			runtime.counters[i] = before + min(value, math.MaxUint64-before)
+		case Decrement:
+			runtime.counters[i] = before - min(value, before)
+		case Set:
+			runtime.counters[i] = value
+		}
+		if before != 0 && runtime.counters[i] == 0 {
+			f.trigger(CounterZero, machine)
+		}
+	}
+
+	if s.Action != nil && runtime.stateLimit != 0 {
+		f.act(machine, s.Action, now)
+	}
+}
+
+func (f *Framework) act(machine int, action *Action, now time.Time) {
+	runtime := &f.runtimes[machine]
+	triggered := TriggerAction{
+		Kind:    action.Kind,
+		Machine: machine,
+		Bypass:  action.Bypass,
+		Replace: action.Replace,
+	}
+	switch action.Kind {
+	case ActionCancel:
+		if action.Timer != TimerAction {
+			runtime.timerEnd = time.Time{}
+		}
+		triggered.Timer = action.Timer
+	case ActionSendPadding:
+		if !f.belowPaddingLimit(machine) {
+			return
+		}
+		triggered.Timeout = toDuration(action.Timeout.Sample(f.rng))
+	case ActionBlockOutgoing:
+		if !f.belowBlockingLimit(machine, now) {
+			return
+		}
+		triggered.Timeout = toDuration(action.Timeout.Sample(f.rng))
+		triggered.Duration = toDuration(action.Duration.Sample(f.rng))
+	case ActionUpdateTimer:
+		duration := toDuration(action.Duration.Sample(f.rng))
+		end := now.Add(duration)
+		if !action.Replace && !runtime.timerEnd.IsZero() && !end.After(runtime.timerEnd) {
+			return
+		}
+		runtime.timerEnd = end
+		triggered.Duration = duration
+		f.trigger(TimerBegin, machine)
+	}
+	f.actions[machine] = triggered
+	f.hasAction[machine] = true
+}
+
+func (f *Framework) belowPaddingLimit(machine int) bool {
+	m, runtime := f.machines[machine], &f.runtimes[machine]
+	if runtime.paddingSent < m.AllowedPaddingPackets {
+		return true
+	}
+	if m.MaxPaddingFrac > 0 && fraction(runtime.paddingSent, runtime.paddingSent+runtime.normalSent) >= m.MaxPaddingFrac {
+		return false
+	}
+	if f.maxPaddingFrac > 0 && fraction(f.paddingSent, f.paddingSent+f.normalSent) >= f.maxPaddingFrac {
+		return false
+	}
+	return true
+}
+
+func (f *Framework) belowBlockingLimit(machine int, now time.Time) bool {
+	m, runtime := f.machines[machine], &f.runtimes[machine]
+	blocked, machineBlocked := f.blocked, runtime.blocked
+	if f.blocking.active {
+		ongoing := max(now.Sub(f.blocking.since), 0)
+		blocked += ongoing
+		if f.blocking.machine == machine {
+			machineBlocked += ongoing
+		}
+	}
+	if machineBlocked < time.Duration(m.AllowedBlockedMicrosec)*time.Microsecond {
+		return true
+	}
+	elapsed := uint64(max(now.Sub(f.start), 0))
+	if m.MaxBlockingFrac > 0 && fraction(uint64(machineBlocked), elapsed) >= m.MaxBlockingFrac {
+		return false
+	}
+	if f.maxBlockingFrac > 0 && fraction(uint64(blocked), elapsed) >= f.maxBlockingFrac {
+		return false
+	}
+	return true
+}
+
+func fraction(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+func (f *Framework) sampleLimit(action *Action) uint64 {
+	if action == nil || action.Limit == nil {
+		return math.MaxUint64
+	}
+	return toUint64(action.Limit.Sample(f.rng))
+}
+
+func toUint64(f float64) uint64 {
+	if f >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(f)
+}
+
+// toDuration converts microseconds to a duration.
+func toDuration(microseconds float64) time.Duration {
+	ns := microseconds * float64(time.Microsecond)
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
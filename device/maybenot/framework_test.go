@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package maybenot
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestFramework(t *testing.T, maxPaddingFrac float64, machines ...*Machine) (*Framework, time.Time) {
+	t.Helper()
+	now := time.Unix(1_700_000_000, 0)
+	f, err := NewFramework(machines, maxPaddingFrac, 0, now, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, now
+}
+
+// paddingMachine pads every sent packet after 10µs.
+func paddingMachine() *Machine {
+	return &Machine{States: []State{
+		{Transitions: on(NormalSent, 1)},
+		{
+			Action:      &Action{Kind: ActionSendPadding, Timeout: fixed(10)},
+			Transitions: on(NormalSent, 1),
+		},
+	}}
+}
+
+func TestFrameworkPadding(t *testing.T) {
+	f, now := newTestFramework(t, 0, paddingMachine())
+
+	if actions := f.TriggerEvents([]TriggerEvent{{Event: NormalRecv}}, now); len(actions) != 0 {
+		t.Errorf("got actions %+v on an event without transitions", actions)
+	}
+	actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}, {Event: TunnelSent}}, now)
+	if len(actions) != 1 {
+		t.Fatalf("got %d actions, want 1", len(actions))
+	}
+	if a := actions[0]; a.Kind != ActionSendPadding || a.Machine != 0 || a.Timeout != 10*time.Microsecond {
+		t.Errorf("got action %+v", a)
+	}
+}
+
+func TestFrameworkPaddingLimit(t *testing.T) {
+	f, now := newTestFramework(t, 0.5, paddingMachine())
+
+	padded := 0
+	for i := 0; i < 100; i++ {
+		if actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now); len(actions) != 0 {
+			padded++
+			// Pad twice, exceeding the limit unless the framework stops padding.
+			f.TriggerEvents([]TriggerEvent{{Event: PaddingSent}, {Event: PaddingSent}}, now)
+		}
+	}
+	if padded == 0 || f.paddingSent > f.normalSent+2 {
+		t.Errorf("padded %d times, sent %d padding and %d normal packets", padded, f.paddingSent, f.normalSent)
+	}
+}
+
+func TestFrameworkStateLimit(t *testing.T) {
+	limit := fixed(2)
+	machine := &Machine{States: []State{
+		{Transitions: on(NormalSent, 1)},
+		{
+			Action:      &Action{Kind: ActionSendPadding, Timeout: fixed(0), Limit: &limit},
+			Transitions: on(LimitReached, StateEnd),
+		},
+	}}
+	f, now := newTestFramework(t, 0, machine)
+
+	f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now)
+	f.TriggerEvents([]TriggerEvent{{Event: PaddingSent}}, now)
+	if f.runtimes[0].state != 1 {
+		t.Fatalf("left the padding state after one packet, in state %d", f.runtimes[0].state)
+	}
+	f.TriggerEvents([]TriggerEvent{{Event: PaddingSent}}, now)
+	if f.runtimes[0].state != StateEnd {
+		t.Fatalf("in state %d after reaching the limit", f.runtimes[0].state)
+	}
+	if actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now); len(actions) != 0 {
+		t.Errorf("ended machine took actions %+v", actions)
+	}
+}
+
+func TestFrameworkCounter(t *testing.T) {
+	three := fixed(3)
+	machine := &Machine{States: []State{
+		{Transitions: on(NormalRecv, 1)},
+		{Counters: [2]*Counter{{Operation: Set, Dist: &three}}, Transitions: on(NormalSent, 2)},
+		{Counters: [2]*Counter{{Operation: Decrement}}, Transitions: [NumEvents][]Trans{
+			NormalSent:  {{State: 2, Probability: 1}},
+			CounterZero: {{State: 3, Probability: 1}},
+		}},
+		{Action: &Action{Kind: ActionSendPadding, Timeout: fixed(0)}},
+	}}
+	f, now := newTestFramework(t, 0, machine)
+
+	f.TriggerEvents([]TriggerEvent{{Event: NormalRecv}}, now)
+	for i := 0; i < 2; i++ {
+		if actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now); len(actions) != 0 {
+			t.Fatalf("padded after %d packets", i+1)
+		}
+	}
+	if actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now); len(actions) != 1 {
+		t.Fatalf("got %d actions once the counter reached zero", len(actions))
+	}
+}
+
+func TestFrameworkTimer(t *testing.T) {
+	machine := &Machine{States: []State{
+		{Transitions: on(NormalSent, 1)},
+		{
+			Action:      &Action{Kind: ActionUpdateTimer, Duration: fixed(1000)},
+			Transitions: on(TimerEnd, 2),
+		},
+		{Action: &Action{Kind: ActionSendPadding, Timeout: fixed(0)}},
+	}}
+	f, now := newTestFramework(t, 0, machine)
+
+	actions := f.TriggerEvents([]TriggerEvent{{Event: NormalSent}}, now)
+	if len(actions) != 1 || actions[0].Kind != ActionUpdateTimer || actions[0].Duration != time.Millisecond {
+		t.Fatalf("got actions %+v", actions)
+	}
+	if actions := f.TriggerEvents([]TriggerEvent{{Event: TimerEnd}}, now.Add(time.Millisecond/2)); len(actions) != 0 {
+		t.Errorf("timer expired early with actions %+v", actions)
+	}
+	actions = f.TriggerEvents([]TriggerEvent{{Event: TimerEnd}}, now.Add(time.Millisecond))
+	if len(actions) != 1 || actions[0].Kind != ActionSendPadding {
+		t.Errorf("got actions %+v when the timer expired", actions)
+	}
+	if actions := f.TriggerEvents([]TriggerEvent{{Event: TimerEnd}}, now.Add(time.Second)); len(actions) != 0 {
+		t.Errorf("timer expired twice with actions %+v", actions)
+	}
+}
+
+func TestFrameworkSignal(t *testing.T) {
+	signaller := &Machine{States: []State{{Transitions: on(NormalRecv, StateSignal)}}}
+	f, now := newTestFramework(t, 0, signaller, paddingMachine(), &Machine{States: []State{
+		{Transitions: on(Signal, 1)},
+		{Action: &Action{Kind: ActionSendPadding, Timeout: fixed(0)}},
+	}})
+
+	actions := f.TriggerEvents([]TriggerEvent{{Event: NormalRecv}}, now)
+	if len(actions) != 1 || actions[0].Machine != 2 {
+		t.Errorf("got actions %+v on a signal", actions)
+	}
+}
+
+func TestFrameworkBlocking(t *testing.T) {
+	machine := &Machine{States: []State{
+		{Transitions: on(BlockingBegin, 1)},
+		{Action: &Action{Kind: ActionSendPadding, Timeout: fixed(0)}},
+	}}
+	f, now := newTestFramework(t, 0, machine)
+
+	// Blocking begun by a machine of another framework is seen by all machines,
+	// but accounted to none of them.
+	actions := f.TriggerEvents([]TriggerEvent{{Event: BlockingBegin, Machine: -1}}, now)
+	if len(actions) != 1 || actions[0].Kind != ActionSendPadding {
+		t.Errorf("got actions %+v on blocking", actions)
+	}
+	f.TriggerEvents([]TriggerEvent{{Event: BlockingEnd}}, now.Add(time.Millisecond))
+	if f.blocked != time.Millisecond || f.runtimes[0].blocked != 0 {
+		t.Errorf("blocked for %v, the machine for %v", f.blocked, f.runtimes[0].blocked)
+	}
+}
@@ -0,0 +1,642 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package maybenot is a pure-Go implementation of the maybenot framework for
+// traffic analysis defenses, running machines in the format of maybenot v2.
+//
+// A machine is a probabilistic state machine. Every event, such as a packet
+// being sent or received, may move each machine to another state, and
+// entering a state may take an action, such as scheduling a padding packet
+// or blocking outgoing traffic. A Framework runs a set of machines and
+// enforces their padding and blocking limits.
+package maybenot
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// An Event is something that happened, which may move a machine to another state.
+type Event uint8
+
+const (
+	NormalRecv    Event = iota // a non-padding packet was received
+	PaddingRecv                // a padding packet was received
+	TunnelRecv                 // a packet, padding or not, was received
+	NormalSent                 // a non-padding packet was sent
+	PaddingSent                // the machine sent a padding packet
+	TunnelSent                 // a packet, padding or not, was sent
+	BlockingBegin              // outgoing traffic started being blocked
+	BlockingEnd                // outgoing traffic stopped being blocked
+	LimitReached               // the action of the state of the machine reached its limit
+	CounterZero                // a counter of the machine was decremented to zero
+	TimerBegin                 // the internal timer of the machine was started
+	TimerEnd                   // the internal timer of the machine expired
+	Signal                     // another machine signalled
+	NumEvents     = int(iota)
+)
+
+func (event Event) String() string {
+	names := [...]string{
+		"NormalRecv", "PaddingRecv", "TunnelRecv", "NormalSent", "PaddingSent", "TunnelSent",
+		"BlockingBegin", "BlockingEnd", "LimitReached", "CounterZero", "TimerBegin", "TimerEnd", "Signal",
+	}
+	if int(event) < len(names) {
+		return names[event]
+	}
+	return fmt.Sprintf("Event(%d)", event)
+}
+
+const (
+	// StateEnd is the target of a transition that stops the machine.
+	StateEnd = 1<<32 - 1
+
+	// StateSignal is the target of a transition that sends a Signal event to
+	// the other machines of the framework, without changing state.
+	StateSignal = StateEnd - 1
+
+	// MaxStates is the largest number of states of a machine.
+	MaxStates = 1 << 16
+)
+
+// Machines are serialized as the version, followed by the base64 encoded
+// zlib compressed bincode encoding of the machine.
+const (
+	version             = "02"
+	maxDecompressedSize = 1 << 20
+)
+
+// A Machine is a probabilistic state machine. It starts in its first state.
+type Machine struct {
+	// The number of padding packets the machine may send before
+	// MaxPaddingFrac applies.
+	AllowedPaddingPackets uint64
+	// The largest fraction of the packets sent that may be padding sent by
+	// the machine, or 0 for no limit.
+	MaxPaddingFrac float64
+	// How long, in microseconds, the machine may block outgoing traffic
+	// before MaxBlockingFrac applies.
+	AllowedBlockedMicrosec uint64
+	// The largest fraction of the time that outgoing traffic may be blocked
+	// by the machine, or 0 for no limit.
+	MaxBlockingFrac float64
+
+	States []State
+}
+
+// A State takes an action and updates counters when it is entered, and
+// moves the machine on events.
+type State struct {
+	Action *Action
+	// The updates of counters A and B.
+	Counters [2]*Counter
+	// The transitions to take on each event.
+	Transitions [NumEvents][]Trans
+}
+
+// A Trans moves the machine to State, a state of the machine, StateEnd or
+// StateSignal, with Probability. The probabilities of the transitions of an
+// event sum up to at most 1, the rest being the probability of staying in the
+// current state without entering it again.
+type Trans struct {
+	State       int
+	Probability float32
+}
+
+type ActionKind uint32
+
+const (
+	ActionCancel ActionKind = iota
+	ActionSendPadding
+	ActionBlockOutgoing
+	ActionUpdateTimer
+)
+
+// A Timer is the timers cancelled by a cancel action: the timer of the last
+// padding or blocking action of the machine, its internal timer, or both.
+type Timer uint32
+
+const (
+	TimerAction Timer = iota
+	TimerInternal
+	TimerAll
+)
+
+// An Action is taken by a machine when it enters a state.
+type Action struct {
+	Kind ActionKind
+
+	// The timers cancelled by ActionCancel.
+	Timer Timer
+
+	// Whether the padding or blocking may bypass blocking, and whether it
+	// may be replaced by other traffic.
+	Bypass  bool
+	Replace bool
+
+	// In microseconds, how long before the padding is sent or the blocking
+	// begins.
+	Timeout Dist
+	// In microseconds, for how long outgoing traffic is blocked, or the
+	// internal timer runs. With ActionUpdateTimer, Replace sets the internal
+	// timer even if it would expire sooner than it does now.
+	Duration Dist
+
+	// How many times the action may be performed before the state reports
+	// LimitReached, or nil for no limit.
+	Limit *Dist
+}
+
+type Operation uint32
+
+const (
+	Increment Operation = iota
+	Decrement
+	Set
+)
+
+// A Counter updates one of the two counters of a machine. The update is by a
+// value sampled from Dist, 1 if Dist is nil, or the value of the other counter
+// if Copy is set.
+type Counter struct {
+	Operation Operation
+	Dist      *Dist
+	Copy      bool
+}
+
+// ParseMachine parses a serialized machine and validates it.
+func ParseMachine(s string) (*Machine, error) {
+	s = strings.TrimSpace(s)
+	encoded, ok := strings.CutPrefix(s, version)
+	if !ok {
+		return nil, fmt.Errorf("unsupported machine version %.2q", s)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(encoding) > maxDecompressedSize {
+		return nil, errors.New("machine too large")
+	}
+
+	d := decoder{buf: encoding}
+	machine := d.machine()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) != 0 {
+		return nil, errors.New("trailing data after machine")
+	}
+	if err := machine.Validate(); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// ParseMachines parses machines separated by newlines, ignoring empty lines.
+func ParseMachines(s string) ([]*Machine, error) {
+	var machines []*Machine
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		machine, err := ParseMachine(line)
+		if err != nil {
+			return nil, fmt.Errorf("machine %d: %w", len(machines), err)
+		}
+		machines = append(machines, machine)
+	}
+	return machines, nil
+}
+
+// String serializes the machine, in the format read by ParseMachine.
+func (machine *Machine) String() string {
+	var e encoder
+	e.machine(machine)
+	var compressed bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	w.Write(e.buf)
+	w.Close()
+	return version + base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
+
+// A FieldError is an invalid field of a machine, found by Validate.
+type FieldError struct {
+	// Field is the path to the field, named as in maybenot, such as
+	// "states[1].action.timeout".
+	Field string
+	Err   error
+}
+
+func (err *FieldError) Error() string {
+	return err.Field + ": " + err.Err.Error()
+}
+
+func (err *FieldError) Unwrap() error {
+	return err.Err
+}
+
+// fieldError returns err as an error of field, prepending field to the path
+// of err if it is a FieldError of a nested field.
+func fieldError(field string, err error) error {
+	if nested, ok := err.(*FieldError); ok {
+		return &FieldError{Field: field + "." + nested.Field, Err: nested.Err}
+	}
+	return &FieldError{Field: field, Err: err}
+}
+
+// Validate checks that the machine can be run. Its errors are FieldErrors.
+func (machine *Machine) Validate() error {
+	if len(machine.States) == 0 || len(machine.States) > MaxStates {
+		return fieldError("states", fmt.Errorf("machine has %d states", len(machine.States)))
+	}
+	if !isFraction(machine.MaxPaddingFrac) {
+		return fieldError("max_padding_frac", fmt.Errorf("invalid fraction %v", machine.MaxPaddingFrac))
+	}
+	if !isFraction(machine.MaxBlockingFrac) {
+		return fieldError("max_blocking_frac", fmt.Errorf("invalid fraction %v", machine.MaxBlockingFrac))
+	}
+	for i := range machine.States {
+		if err := machine.States[i].validate(len(machine.States)); err != nil {
+			return fieldError(fmt.Sprintf("states[%d]", i), err)
+		}
+	}
+	return nil
+}
+
+func isFraction(f float64) bool {
+	return f >= 0 && f <= 1
+}
+
+func (state *State) validate(numStates int) error {
+	if action := state.Action; action != nil {
+		if action.Kind > ActionUpdateTimer {
+			return fieldError("action", fmt.Errorf("invalid action %d", action.Kind))
+		}
+		if action.Kind == ActionCancel && action.Timer > TimerAll {
+			return fieldError("action.timer", fmt.Errorf("invalid timer %d", action.Timer))
+		}
+		if action.Kind == ActionSendPadding || action.Kind == ActionBlockOutgoing {
+			if err := action.Timeout.Validate(); err != nil {
+				return fieldError("action.timeout", err)
+			}
+		}
+		if action.Kind == ActionBlockOutgoing || action.Kind == ActionUpdateTimer {
+			if err := action.Duration.Validate(); err != nil {
+				return fieldError("action.duration", err)
+			}
+		}
+		if action.Limit != nil {
+			if err := action.Limit.Validate(); err != nil {
+				return fieldError("action.limit", err)
+			}
+		}
+	}
+	for i, counter := range state.Counters {
+		if counter == nil {
+			continue
+		}
+		if counter.Operation > Set {
+			return fieldError(fmt.Sprintf("counter[%d].operation", i), fmt.Errorf("invalid counter operation %d", counter.Operation))
+		}
+		if counter.Dist != nil {
+			if err := counter.Dist.Validate(); err != nil {
+				return fieldError(fmt.Sprintf("counter[%d].dist", i), err)
+			}
+		}
+	}
+	for event, transitions := range state.Transitions {
+		field := fmt.Sprintf("transitions[%v]", Event(event))
+		var sum float64
+		for _, trans := range transitions {
+			if trans.State < 0 || (trans.State >= numStates && trans.State != StateEnd && trans.State != StateSignal) {
+				return fieldError(field, fmt.Errorf("transition to invalid state %d", trans.State))
+			}
+			if !(trans.Probability > 0 && trans.Probability <= 1) {
+				return fieldError(field, fmt.Errorf("transition with invalid probability %v", trans.Probability))
+			}
+			sum += float64(trans.Probability)
+		}
+		// Allow for the rounding of the 32 bit probabilities.
+		if sum > 1+1e-6 {
+			return fieldError(field, fmt.Errorf("transitions sum up to %v", sum))
+		}
+	}
+	return nil
+}
+
+// decoder reads the bincode encoding of a machine, in the variable length
+// integer configuration used by maybenot: integers, lengths and enum variants
+// are a byte below 251, or a tag from 251 to 253 followed by a 16, 32 or 64 bit
+// little endian integer. Floats are little endian, and options and bools a byte.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errTruncated = errors.New("truncated machine")
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.buf) < n {
+		d.err = errTruncated
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) uint() uint64 {
+	switch b := d.u8(); b {
+	case 251:
+		return uint64(binary.LittleEndian.Uint16(d.next(2)))
+	case 252:
+		return uint64(binary.LittleEndian.Uint32(d.next(4)))
+	case 253:
+		return binary.LittleEndian.Uint64(d.next(8))
+	case 254, 255:
+		d.fail(fmt.Errorf("invalid integer tag %d", b))
+		return 0
+	default:
+		return uint64(b)
+	}
+}
+
+func (d *decoder) f32() float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(d.next(4)))
+}
+
+func (d *decoder) f64() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(d.next(8)))
+}
+
+func (d *decoder) bool() bool {
+	switch b := d.u8(); b {
+	case 0, 1:
+		return b == 1
+	default:
+		d.fail(fmt.Errorf("invalid bool %d", b))
+		return false
+	}
+}
+
+// option reads the tag of an option, and reports whether a value follows.
+func (d *decoder) option() bool {
+	return d.bool()
+}
+
+// variant reads the variant of an enum with n variants.
+func (d *decoder) variant(n uint32) uint32 {
+	v := d.uint()
+	if v >= uint64(n) {
+		d.fail(fmt.Errorf("invalid variant %d", v))
+		return 0
+	}
+	return uint32(v)
+}
+
+// length reads the length of a sequence, whose elements are at least minSize
+// bytes long, so that no more than the rest of the encoding is allocated.
+func (d *decoder) length(minSize int) int {
+	n := d.uint()
+	if n > uint64(len(d.buf)/minSize) {
+		d.fail(errTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) machine() *Machine {
+	machine := new(Machine)
+	machine.AllowedPaddingPackets = d.uint()
+	machine.MaxPaddingFrac = d.f64()
+	machine.AllowedBlockedMicrosec = d.uint()
+	machine.MaxBlockingFrac = d.f64()
+	n := d.length(1 + 2 + NumEvents)
+	if n > MaxStates {
+		d.fail(fmt.Errorf("machine has %d states", n))
+		return machine
+	}
+	machine.States = make([]State, n)
+	for i := range machine.States {
+		d.state(&machine.States[i])
+	}
+	return machine
+}
+
+func (d *decoder) state(state *State) {
+	if d.option() {
+		state.Action = d.action()
+	}
+	for i := range state.Counters {
+		if d.option() {
+			state.Counters[i] = d.counter()
+		}
+	}
+	for event := range state.Transitions {
+		n := d.length(1 + 4)
+		if n == 0 {
+			continue
+		}
+		transitions := make([]Trans, n)
+		for i := range transitions {
+			target := d.uint()
+			if target > StateEnd {
+				d.fail(fmt.Errorf("transition to invalid state %d", target))
+			}
+			transitions[i] = Trans{State: int(target), Probability: d.f32()}
+		}
+		state.Transitions[event] = transitions
+	}
+}
+
+func (d *decoder) action() *Action {
+	action := &Action{Kind: ActionKind(d.variant(uint32(ActionUpdateTimer) + 1))}
+	switch action.Kind {
+	case ActionCancel:
+		action.Timer = Timer(d.variant(uint32(TimerAll) + 1))
+		return action
+	case ActionSendPadding, ActionBlockOutgoing:
+		action.Bypass = d.bool()
+		action.Replace = d.bool()
+		action.Timeout = d.dist()
+		if action.Kind == ActionBlockOutgoing {
+			action.Duration = d.dist()
+		}
+	case ActionUpdateTimer:
+		action.Replace = d.bool()
+		action.Duration = d.dist()
+	}
+	if d.option() {
+		limit := d.dist()
+		action.Limit = &limit
+	}
+	return action
+}
+
+func (d *decoder) counter() *Counter {
+	counter := &Counter{Operation: Operation(d.variant(uint32(Set) + 1))}
+	if d.option() {
+		dist := d.dist()
+		counter.Dist = &dist
+	}
+	counter.Copy = d.bool()
+	return counter
+}
+
+func (d *decoder) dist() Dist {
+	dist := Dist{Type: DistType(d.variant(uint32(Beta) + 1))}
+	if dist.Type == Binomial {
+		dist.Param1 = float64(d.uint())
+		dist.Param2 = d.f64()
+	} else {
+		dist.Param1 = d.f64()
+		if dist.Type.params() > 1 {
+			dist.Param2 = d.f64()
+		}
+		if dist.Type.params() > 2 {
+			dist.Param3 = d.f64()
+		}
+	}
+	dist.Start = d.f64()
+	dist.Max = d.f64()
+	return dist
+}
+
+// encoder writes the bincode encoding of a machine, read by decoder.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(v uint64) {
+	switch {
+	case v < 251:
+		e.buf = append(e.buf, byte(v))
+	case v <= math.MaxUint16:
+		e.buf = binary.LittleEndian.AppendUint16(append(e.buf, 251), uint16(v))
+	case v <= math.MaxUint32:
+		e.buf = binary.LittleEndian.AppendUint32(append(e.buf, 252), uint32(v))
+	default:
+		e.buf = binary.LittleEndian.AppendUint64(append(e.buf, 253), v)
+	}
+}
+
+func (e *encoder) f32(v float32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(v))
+}
+
+func (e *encoder) f64(v float64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) machine(machine *Machine) {
+	e.uint(machine.AllowedPaddingPackets)
+	e.f64(machine.MaxPaddingFrac)
+	e.uint(machine.AllowedBlockedMicrosec)
+	e.f64(machine.MaxBlockingFrac)
+	e.uint(uint64(len(machine.States)))
+	for i := range machine.States {
+		e.state(&machine.States[i])
+	}
+}
+
+func (e *encoder) state(state *State) {
+	e.bool(state.Action != nil)
+	if action := state.Action; action != nil {
+		e.uint(uint64(action.Kind))
+		switch action.Kind {
+		case ActionCancel:
+			e.uint(uint64(action.Timer))
+		case ActionSendPadding, ActionBlockOutgoing:
+			e.bool(action.Bypass)
+			e.bool(action.Replace)
+			e.dist(action.Timeout)
+			if action.Kind == ActionBlockOutgoing {
+				e.dist(action.Duration)
+			}
+		case ActionUpdateTimer:
+			e.bool(action.Replace)
+			e.dist(action.Duration)
+		}
+		if action.Kind != ActionCancel {
+			e.bool(action.Limit != nil)
+			if action.Limit != nil {
+				e.dist(*action.Limit)
+			}
+		}
+	}
+	for _, counter := range state.Counters {
+		e.bool(counter != nil)
+		if counter != nil {
+			e.uint(uint64(counter.Operation))
+			e.bool(counter.Dist != nil)
+			if counter.Dist != nil {
+				e.dist(*counter.Dist)
+			}
+			e.bool(counter.Copy)
+		}
+	}
+	for _, transitions := range state.Transitions {
+		e.uint(uint64(len(transitions)))
+		for _, trans := range transitions {
+			e.uint(uint64(trans.State))
+			e.f32(trans.Probability)
+		}
+	}
+}
+
+func (e *encoder) dist(dist Dist) {
+	e.uint(uint64(dist.Type))
+	if dist.Type == Binomial {
+		e.uint(uint64(dist.Param1))
+		e.f64(dist.Param2)
+	} else {
+		e.f64(dist.Param1)
+		if dist.Type.params() > 1 {
+			e.f64(dist.Param2)
+		}
+		if dist.Type.params() > 2 {
+			e.f64(dist.Param3)
+		}
+	}
+	e.f64(dist.Start)
+	e.f64(dist.Max)
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package maybenot
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fixed returns a distribution that always samples v.
+func fixed(v float64) Dist {
+	return Dist{Type: Uniform, Param1: v, Param2: v}
+}
+
+// on returns the transitions of a state that moves to state on event.
+func on(event Event, state int) (transitions [NumEvents][]Trans) {
+	transitions[event] = []Trans{{State: state, Probability: 1}}
+	return transitions
+}
+
+func TestMachineRoundTrip(t *testing.T) {
+	limit := Dist{Type: Poisson, Param1: 3, Start: 1, Max: 10}
+	machine := &Machine{
+		AllowedPaddingPackets:  10,
+		MaxPaddingFrac:         0.5,
+		AllowedBlockedMicrosec: 1000,
+		MaxBlockingFrac:        0.25,
+		States: []State{
+			{
+				Action: &Action{Kind: ActionSendPadding, Bypass: true, Timeout: Dist{Type: SkewNormal, Param1: 1, Param2: 2, Param3: -3}, Limit: &limit},
+				Transitions: [NumEvents][]Trans{
+					NormalSent: {{State: 1, Probability: 0.25}, {State: StateEnd, Probability: 0.5}},
+					Signal:     {{State: StateSignal, Probability: 1}},
+				},
+			},
+			{
+				Action:   &Action{Kind: ActionBlockOutgoing, Replace: true, Timeout: fixed(5), Duration: Dist{Type: Binomial, Param1: 20, Param2: 0.5}},
+				Counters: [2]*Counter{{Operation: Decrement, Dist: &limit}, {Operation: Set, Copy: true}},
+			},
+			{Action: &Action{Kind: ActionUpdateTimer, Duration: Dist{Type: Beta, Param1: 2, Param2: 3}}},
+			{Action: &Action{Kind: ActionCancel, Timer: TimerAll}, Transitions: on(TimerEnd, 0)},
+		},
+	}
+	parsed, err := ParseMachine(machine.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, machine) {
+		t.Errorf("got %+v, want %+v", parsed, machine)
+	}
+
+	machines, err := ParseMachines("\n" + machine.String() + "\n\n" + machine.String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 2 {
+		t.Errorf("parsed %d machines, want 2", len(machines))
+	}
+}
+
+// goldenMachines are machines serialized by maybenot itself, with the machine
+// they parse to.
+var goldenMachines = []struct {
+	name    string
+	machine string
+	want    *Machine
+}{
+	{
+		// The no-op machine of the maybenot documentation.
+		name:    "no-op",
+		machine: "02eNpjYEAHjOgCAAA0AAI=",
+		want:    &Machine{States: []State{{}}},
+	},
+}
+
+func TestParseGoldenMachines(t *testing.T) {
+	for _, test := range goldenMachines {
+		machine, err := ParseMachine(test.machine)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(machine, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, machine, test.want)
+		}
+		// The compression differs from maybenot's, but the bincode encoding
+		// it compresses must not.
+		var e encoder
+		e.machine(machine)
+		if want := decode(t, test.machine); !bytes.Equal(e.buf, want) {
+			t.Errorf("%s: encoded as %x, want %x", test.name, e.buf, want)
+		}
+	}
+}
+
+// encode serializes the bincode encoding of a machine, valid or not.
+func encode(encoding []byte) string {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(encoding)
+	w.Close()
+	return version + base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
+
+// decode returns the bincode encoding of a serialized machine.
+func decode(t *testing.T, machine string) []byte {
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(machine, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoding, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoding
+}
+
+func TestParseMachineInvalid(t *testing.T) {
+	valid := &Machine{States: []State{{Transitions: on(NormalSent, 0)}}}
+	var e encoder
+	e.machine(valid)
+
+	for _, test := range []struct {
+		name    string
+		machine string
+	}{
+		{"empty", ""},
+		{"version", "01" + strings.TrimPrefix(valid.String(), version)},
+		{"base64", version + "!!!"},
+		{"zlib", version + base64.StdEncoding.EncodeToString([]byte("not zlib"))},
+		{"truncated", encode(e.buf[:len(e.buf)-1])},
+		{"trailing", encode(append(e.buf, 0))},
+		{"no states", (&Machine{}).String()},
+		{"padding fraction", (&Machine{MaxPaddingFrac: 2, States: valid.States}).String()},
+		{"state", (&Machine{States: []State{{Transitions: on(NormalSent, 1)}}}).String()},
+		{"probabilities", (&Machine{States: []State{{Transitions: [NumEvents][]Trans{
+			NormalRecv: {{State: 0, Probability: 0.75}, {State: StateEnd, Probability: 0.75}},
+		}}}}).String()},
+		{"distribution", (&Machine{States: []State{{Action: &Action{
+			Kind:    ActionSendPadding,
+			Timeout: Dist{Type: Uniform, Param1: 2, Param2: 1},
+		}}}}).String()},
+		{"huge states", func() string {
+			var e encoder
+			e.machine(valid)
+			// Claim far more states than the encoding holds.
+			e.buf[18] = 250
+			return encode(e.buf)
+		}()},
+		{"integer tag", encode(append([]byte{255}, e.buf[1:]...))},
+	} {
+		if _, err := ParseMachine(test.machine); err == nil {
+			t.Errorf("%s: parsed invalid machine", test.name)
+		}
+	}
+}
+
+func TestValidateFieldError(t *testing.T) {
+	for _, test := range []struct {
+		machine *Machine
+		field   string
+	}{
+		{&Machine{}, "states"},
+		{&Machine{MaxBlockingFrac: -1, States: []State{{}}}, "max_blocking_frac"},
+		{&Machine{States: []State{{}, {Action: &Action{
+			Kind:     ActionBlockOutgoing,
+			Duration: Dist{Type: Uniform, Param1: 2, Param2: 1},
+		}}}}, "states[1].action.duration"},
+		{&Machine{States: []State{{Transitions: on(PaddingSent, 3)}}}, "states[0].transitions[PaddingSent]"},
+	} {
+		err := test.machine.Validate()
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Errorf("%s: got %v, want a FieldError", test.field, err)
+			continue
+		}
+		if fieldErr.Field != test.field {
+			t.Errorf("got error of field %q, want %q: %v", fieldErr.Field, test.field, err)
+		}
+	}
+}
+
+func TestDistSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		dist Dist
+		mean float64
+	}{
+		{Dist{Type: Uniform, Param1: 10, Param2: 20}, 15},
+		{Dist{Type: Normal, Param1: 100, Param2: 10}, 100},
+		{Dist{Type: SkewNormal, Param1: 100, Param2: 10, Param3: 0}, 100},
+		{Dist{Type: LogNormal, Param1: 0, Param2: 0.5}, math.Exp(0.125)},
+		{Dist{Type: Binomial, Param1: 20, Param2: 0.1}, 2},
+		{Dist{Type: Binomial, Param1: 1000, Param2: 0.3}, 300},
+		{Dist{Type: Binomial, Param1: 50, Param2: 0.9}, 45},
+		{Dist{Type: Geometric, Param1: 0.2}, 4},
+		{Dist{Type: Pareto, Param1: 1, Param2: 3}, 1.5},
+		{Dist{Type: Poisson, Param1: 4}, 4},
+		{Dist{Type: Poisson, Param1: 500}, 500},
+		{Dist{Type: Weibull, Param1: 2, Param2: 1}, 2},
+		{Dist{Type: Gamma, Param1: 2, Param2: 3}, 6},
+		{Dist{Type: Gamma, Param1: 1, Param2: 0.5}, 0.5},
+		{Dist{Type: Beta, Param1: 2, Param2: 6}, 0.25},
+	} {
+		if err := test.dist.Validate(); err != nil {
+			t.Errorf("%+v: %v", test.dist, err)
+			continue
+		}
+		const n = 20000
+		var sum float64
+		for i := 0; i < n; i++ {
+			sum += test.dist.Sample(rng)
+		}
+		if mean := sum / n; math.Abs(mean-test.mean) > 0.05*test.mean {
+			t.Errorf("%+v: mean %v, want %v", test.dist, mean, test.mean)
+		}
+	}
+
+	offset := Dist{Type: Normal, Param1: 0, Param2: 10, Start: 5, Max: 8}
+	for i := 0; i < 1000; i++ {
+		if v := offset.Sample(rng); v < 0 || v > 8 {
+			t.Fatalf("sample %v out of [0, 8]", v)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// mtuProbeSizes are the outer packet sizes probed by discoverMTU, largest
+// first: Ethernet, PPPoE, and common encapsulations down to the minimum MTU
+// of IPv6.
+var mtuProbeSizes = []int{1500, 1492, 1480, 1460, 1440, 1420, 1400, 1380, 1360, 1340, 1320, 1300, 1280}
+
+// tunnelOverhead returns the bytes added to every packet sent through the
+// tunnel to an endpoint at dst.
+func tunnelOverhead(dst netip.Addr) int {
+	const udpHeaderLen = 8
+	overhead := udpHeaderLen + MessageTransportHeaderSize + chacha20poly1305.Overhead
+	if dst.Unmap().Is4() {
+		return overhead + ipv4.HeaderLen
+	}
+	return overhead + ipv6.HeaderLen
+}
+
+// discoverMTU probes the path MTU to the endpoint of every peer, and sets the
+// MTU of the TUN device to fit the smallest. It is started by Up for devices
+// created with WithMTUDiscovery.
+func (device *Device) discoverMTU() {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
+	defer device.state.stopping.Done()
+
+	var dsts []netip.AddrPort
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.RLock()
+		if peer.endpoint != nil {
+			if dst, err := netip.ParseAddrPort(peer.endpoint.DstToString()); err == nil {
+				dsts = append(dsts, dst)
+			}
+		}
+		peer.RUnlock()
+	}
+	device.peers.RUnlock()
+
+	mtu := 0
+	for _, dst := range dsts {
+		if device.isClosed() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), MTUProbeTimeout)
+		pmtu, err := conn.ProbePathMTU(ctx, dst, mtuProbeSizes, MTUProbeWait)
+		cancel()
+		if err != nil {
+			device.log.Verbosef("Failed to probe path MTU to %v: %v", dst, err)
+			continue
+		}
+		device.log.Verbosef("Path MTU to %v is %d", dst, pmtu)
+		if fit := pmtu - tunnelOverhead(dst.Addr()); mtu == 0 || fit < mtu {
+			mtu = fit
+		}
+	}
+	if mtu == 0 || device.isClosed() {
+		return
+	}
+
+	if int(device.tun.mtu.Load()) == mtu {
+		device.log.Verbosef("MTU of %d fits the paths to the endpoints of the peers", mtu)
+		return
+	}
+	device.setTUNMTU(mtu, "to fit the paths to the endpoints of the peers")
+}
+
+// setTUNMTU sets the MTU of the TUN device, if it is a tun.MTUSetter, and
+// logs why.
+func (device *Device) setTUNMTU(mtu int, why string) {
+	tunDevice, _ := device.currentTUN()
+	setter, ok := tunDevice.(tun.MTUSetter)
+	if !ok {
+		device.log.Verbosef("MTU should be %d %s, but the TUN device cannot be changed", mtu, why)
+		return
+	}
+	if err := setter.SetMTU(mtu); err != nil {
+		device.log.Errorf("Failed to set MTU to %d: %v", mtu, err)
+		return
+	}
+	device.tun.mtu.Store(int32(mtu))
+	device.log.Verbosef("MTU set to %d %s", mtu, why)
+}
+
+// peerPathMTU tracks the sends to a peer that failed for exceeding the path MTU
+// to its endpoint.
+type peerPathMTU struct {
+	reported atomic.Int32 // last path MTU reported, or -1 if it was unknown
+	pending  atomic.Bool  // whether a lookup of the path MTU is running
+}
+
+// sendTooBig is called when a datagram of size bytes could not be sent to
+// endpoint because it exceeds the path MTU. It looks up the path MTU in the
+// background, once at a time per peer.
+func (peer *Peer) sendTooBig(size int, endpoint conn.Endpoint) {
+	dst, err := netip.ParseAddrPort(endpoint.DstToString())
+	if err != nil || !peer.pathMTU.pending.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer peer.pathMTU.pending.Store(false)
+		peer.pathMTUExceeded(dst, size)
+	}()
+}
+
+// pathMTUExceeded reports a datagram of size bytes exceeding the path MTU to
+// dst with a NotificationPathMTU, once for every path MTU the kernel learns,
+// and lowers the MTU of the TUN device to fit if the device was created with
+// WithPathMTUFeedback.
+func (peer *Peer) pathMTUExceeded(dst netip.AddrPort, size int) {
+	device := peer.device
+	pmtu, err := conn.PathMTU(dst)
+	if err != nil || pmtu >= size {
+		pmtu = -1
+	}
+	if peer.pathMTU.reported.Swap(int32(pmtu)) == int32(pmtu) {
+		return
+	}
+
+	var message string
+	if pmtu == -1 {
+		message = fmt.Sprintf("datagram of %d bytes to %v exceeds the path MTU", size, dst)
+	} else {
+		message = fmt.Sprintf("datagram of %d bytes to %v exceeds the path MTU of %d", size, dst, pmtu)
+	}
+	device.log.Errorf("%v - Failed to send: %s", peer, message)
+	device.notify(NotificationPathMTU, peer, message)
+
+	if pmtu == -1 || !device.options.mtuFeedback {
+		return
+	}
+	if fit := pmtu - tunnelOverhead(dst.Addr()); fit < int(device.tun.mtu.Load()) {
+		device.setTUNMTU(fit, fmt.Sprintf("to fit the path MTU of %d to %v", pmtu, dst))
+	}
+}
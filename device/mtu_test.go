@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// mtuSetterTUN records the MTU set on it.
+type mtuSetterTUN struct {
+	tun.Device
+	mtu atomic.Int32
+}
+
+func (t *mtuSetterTUN) SetMTU(mtu int) error {
+	t.mtu.Store(int32(mtu))
+	return nil
+}
+
+func TestTunnelOverhead(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want int
+	}{
+		{"192.0.2.1", 60},
+		{"::ffff:192.0.2.1", 60},
+		{"2001:db8::1", 80},
+	} {
+		if got := tunnelOverhead(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("tunnelOverhead(%s) = %d, want %d", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestMTUDiscovery(t *testing.T) {
+	var setter *mtuSetterTUN
+	pair := genTestPairWith(t, true, func(i int, dev tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 0 {
+			setter = &mtuSetterTUN{Device: dev}
+			return NewDeviceWithOptions(setter, bind, logger, WithMTUDiscovery(true))
+		}
+		return NewDevice(dev, bind, logger)
+	})
+
+	// The endpoint of the peer is only known after the device was first
+	// brought up, so probe again.
+	dev := pair[0].dev
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loopback has no trouble with the largest probe.
+	want := mtuProbeSizes[0] - tunnelOverhead(netip.MustParseAddr("127.0.0.1"))
+	for deadline := time.Now().Add(5 * time.Second); setter.mtu.Load() != int32(want); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			if _, err := conn.ProbePathMTU(context.Background(), netip.MustParseAddrPort("127.0.0.1:9"), mtuProbeSizes, 0); err != nil {
+				t.Skipf("cannot probe path MTU: %v", err)
+			}
+			t.Fatalf("expected the MTU to be set to %d, got %d", want, setter.mtu.Load())
+		}
+	}
+	if mtu := dev.tun.mtu.Load(); mtu != int32(want) {
+		t.Errorf("expected the device to use MTU %d, got %d", want, mtu)
+	}
+	pair.Send(t, Ping, nil)
+}
+
+// tooBigBind fails to send transport messages carrying more than a keepalive,
+// as if they exceeded the path MTU.
+type tooBigBind struct {
+	conn.Bind
+}
+
+func (bind *tooBigBind) Send(b []byte, ep conn.Endpoint) error {
+	if binary.LittleEndian.Uint32(b) == MessageTransportType && len(b) > MessageKeepaliveSize {
+		return syscall.EMSGSIZE
+	}
+	return bind.Bind.Send(b, ep)
+}
+
+func TestPathMTUExceeded(t *testing.T) {
+	pair := genTestPairWith(t, false, func(i int, dev tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			bind = &tooBigBind{bind}
+		}
+		return NewDeviceWithOptions(dev, bind, logger, WithPathMTUFeedback(true))
+	})
+	dev := pair[1].dev
+	notifications := make(chan Notification, 4)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationPathMTU {
+			notifications <- n
+		}
+	})()
+
+	for i := 0; i < 2; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	}
+	select {
+	case n := <-notifications:
+		// The kernel knows of no path MTU on loopback too small for the
+		// datagram.
+		if n.Peer != pair[0].dev.staticIdentity.publicKey || !strings.Contains(n.Message, "exceeds the path MTU") {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case n := <-notifications:
+		t.Errorf("expected a single notification, got another: %s", n.Message)
+	default:
+	}
+	if mtu := dev.tun.mtu.Load(); mtu != tuntest.DefaultMTU {
+		t.Errorf("expected the MTU to stay %d without a known path MTU, got %d", tuntest.DefaultMTU, mtu)
+	}
+}
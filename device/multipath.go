@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// peerMultipath configures the experimental multipath mode of a peer, in which
+// every transport packet is also sent to a second endpoint, for example over
+// cellular in addition to Wi-Fi. The receiver needs no support for it: the
+// replay filter drops whichever copy of a packet arrives last, so the session
+// survives either path going away during a handover, at twice the bandwidth.
+type peerMultipath struct {
+	endpoint     conn.Endpoint // protected by the peer's mutex
+	sourceAddr   netip.Addr    // protected by the peer's mutex
+	txDuplicates atomic.Uint64
+}
+
+// sendDuplicate sends a copy of a transport packet to the multipath endpoint
+// of the peer, if it has one, and reports whether that succeeded.
+// Handshakes are not duplicated; their retransmission handles packet loss.
+func (peer *Peer) sendDuplicate(buffer []byte) bool {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.isClosed() {
+		return false
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.multipath.endpoint == nil {
+		return false
+	}
+	if err := peer.sendTo(buffer, peer.multipath.endpoint, peer.multipath.sourceAddr); err != nil {
+		return false
+	}
+	peer.multipath.txDuplicates.Add(1)
+	return true
+}
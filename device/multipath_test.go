@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+)
+
+func TestMultipathDuplicates(t *testing.T) {
+	pair := genTestPair(t, false)
+	sender, receiver := pair[1].dev, pair[0].dev
+	senderPeer := sender.LookupPeer(receiver.staticIdentity.publicKey)
+	receiverPeer := receiver.LookupPeer(sender.staticIdentity.publicKey)
+	pk := hex.EncodeToString(receiver.staticIdentity.publicKey[:])
+
+	// The channel binds connect the devices over two paths, with endpoints 2
+	// and 4 on the sending side. Send duplicates over the one not in use.
+	senderPeer.RLock()
+	primary := senderPeer.endpoint.(bindtest.ChannelEndpoint)
+	senderPeer.RUnlock()
+	secondary := 6 - primary
+	if err := sender.IpcSet(uapiCfg(
+		"public_key", pk,
+		"multipath_endpoint", fmt.Sprintf("127.0.0.1:%d", secondary),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	pair.Send(t, Ping, nil)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("duplicate was written to the TUN device")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if senderPeer.multipath.txDuplicates.Load() == 0 {
+		t.Error("no duplicates sent")
+	}
+	if receiverPeer.rxDuplicates.Load() == 0 {
+		t.Error("no duplicates dropped")
+	}
+
+	cfg, err := sender.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, fmt.Sprintf("multipath_endpoint=127.0.0.1:%d\n", secondary)) || !strings.Contains(cfg, "tx_duplicates=") {
+		t.Errorf("multipath state missing from IpcGet:\n%s", cfg)
+	}
+
+	// With the primary path gone, packets still arrive over the other one.
+	if err := sender.IpcSet(uapiCfg(
+		"public_key", pk,
+		"endpoint", "127.0.0.1:9",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+
+	// Disabling multipath stops the duplicates.
+	if err := sender.IpcSet(uapiCfg(
+		"public_key", pk,
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", primary),
+		"multipath_endpoint", "",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	sent := senderPeer.multipath.txDuplicates.Load()
+	pair.Send(t, Ping, nil)
+	if senderPeer.multipath.txDuplicates.Load() != sent {
+		t.Error("duplicates sent after disabling multipath")
+	}
+}
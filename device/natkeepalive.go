@@ -0,0 +1,147 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AutoKeepaliveInterval is the persistent keepalive interval, in
+	// seconds, enabled for peers we are likely behind NAT to. It is below
+	// the shortest UDP mapping timeouts NATs are commonly configured with.
+	AutoKeepaliveInterval = 25
+
+	// natMappingTimeout is how long after the last packet sent to a peer an
+	// initiation from it is assumed to no longer pass through a NAT
+	// mapping opened by us, and so to prove that the peer can reach us.
+	natMappingTimeout = 30 * time.Second
+
+	// autoKeepaliveHandshakes is the number of handshakes initiated by us,
+	// with none initiated unsolicited by the peer, after which we are
+	// likely behind NAT to the peer, if the peer opted into this heuristic.
+	autoKeepaliveHandshakes = 2
+)
+
+// peerAutoKeepalive enables a persistent keepalive for a peer that has none
+// configured once we are likely behind NAT to it, so that its mapping does
+// not expire while the tunnel is idle. It is opted out of with the
+// "auto_keepalive" UAPI key.
+//
+// We are behind NAT to all peers when the external port reported with
+// SetExternalPort differs from the listening port. With the
+// "auto_keepalive_handshakes" UAPI key, we are also considered behind NAT to a
+// peer that only ever answers handshakes we initiated. That is how every
+// server behaves towards its clients, so it is off by default.
+type peerAutoKeepalive struct {
+	disabled    atomic.Bool
+	handshakes  atomic.Bool   // guess from handshakes whether we are behind NAT
+	initiated   atomic.Uint32 // handshakes initiated by us since the last unsolicited one
+	unsolicited atomic.Bool   // the peer has initiated a handshake unsolicited
+	natted      atomic.Bool   // we are likely behind NAT to the peer
+	lastSent    atomic.Int64  // nanoseconds since epoch
+}
+
+// SetExternalPort reports the port the device's listening port is observed
+// as from outside, for example by a STUN helper, or 0 if unknown. If it
+// differs from the listening port we are behind NAT, and persistent
+// keepalives are enabled for all peers with none configured.
+func (device *Device) SetExternalPort(port uint16) {
+	device.net.Lock()
+	device.net.externalPort = port
+	natted := device.updateBehindNATLocked()
+	device.net.Unlock()
+	if !natted {
+		return
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.startAutoKeepalive()
+	}
+}
+
+// updateBehindNATLocked records whether the external port reported with
+// SetExternalPort differs from the listening port, and returns it. The caller
+// must hold the device's net lock.
+func (device *Device) updateBehindNATLocked() bool {
+	natted := device.net.externalPort != 0 && device.net.externalPort != device.net.port
+	device.net.behindNAT.Store(natted)
+	return natted
+}
+
+// keepaliveInterval returns the persistent keepalive interval of the peer in
+// seconds, the configured one, or AutoKeepaliveInterval if none is configured
+// and we are likely behind NAT to the peer.
+func (peer *Peer) keepaliveInterval() uint32 {
+	if interval := peer.persistentKeepaliveInterval.Load(); interval != 0 {
+		return interval
+	}
+	if peer.autoKeepaliveActive() {
+		return AutoKeepaliveInterval
+	}
+	return 0
+}
+
+// autoKeepaliveActive reports whether an automatic persistent keepalive is
+// enabled for the peer, regardless of a configured one.
+func (peer *Peer) autoKeepaliveActive() bool {
+	if peer.autoKeepalive.disabled.Load() {
+		return false
+	}
+	return peer.autoKeepalive.natted.Load() || peer.device.net.behindNAT.Load()
+}
+
+// startAutoKeepalive sends a keepalive, arming the persistent keepalive
+// timer, if the peer now has an automatic persistent keepalive.
+func (peer *Peer) startAutoKeepalive() {
+	if peer.persistentKeepaliveInterval.Load() != 0 || !peer.autoKeepaliveActive() || !peer.isRunning.Load() {
+		return
+	}
+	peer.device.log.Verbosef("%v - Likely behind NAT, enabling a persistent keepalive of %d seconds", peer, AutoKeepaliveInterval)
+	peer.SendKeepalive()
+}
+
+// autoKeepaliveSent records that a packet was sent to the peer.
+func (peer *Peer) autoKeepaliveSent() {
+	peer.autoKeepalive.lastSent.Store(time.Now().UnixNano())
+}
+
+// autoKeepaliveInitiationReceived records a handshake initiation from the
+// peer. If nothing was sent to the peer for natMappingTimeout, the initiation
+// was unsolicited, and the peer can reach us without a keepalive.
+func (peer *Peer) autoKeepaliveInitiationReceived() {
+	if time.Since(time.Unix(0, peer.autoKeepalive.lastSent.Load())) < natMappingTimeout {
+		return
+	}
+	peer.autoKeepalive.unsolicited.Store(true)
+	peer.autoKeepalive.initiated.Store(0)
+}
+
+// autoKeepaliveResponseReceived records a handshake initiated by us. Once
+// autoKeepaliveHandshakes of them completed without the peer ever initiating
+// one unsolicited, the peer only answers after we sent to it, and we are
+// likely behind NAT.
+func (peer *Peer) autoKeepaliveResponseReceived() {
+	if !peer.autoKeepalive.handshakes.Load() || peer.autoKeepalive.unsolicited.Load() || peer.autoKeepalive.natted.Load() {
+		return
+	}
+	if peer.autoKeepalive.initiated.Add(1) < autoKeepaliveHandshakes {
+		return
+	}
+	if !peer.autoKeepalive.natted.Swap(true) {
+		peer.startAutoKeepalive()
+	}
+}
+
+// autoKeepaliveReset forgets what handshakes told about NAT between us and
+// the peer, after the path to it changed by roaming or rebinding.
+func (peer *Peer) autoKeepaliveReset() {
+	peer.autoKeepalive.natted.Store(false)
+	peer.autoKeepalive.unsolicited.Store(false)
+	peer.autoKeepalive.initiated.Store(0)
+}
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestAutoKeepaliveExternalPort(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pub)
+	setPeer := func(key, value string) {
+		t.Helper()
+		if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), key, value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertInterval := func(want uint32, line string) {
+		t.Helper()
+		if got := peer.keepaliveInterval(); got != want {
+			t.Errorf("expected a keepalive interval of %d, got %d", want, got)
+		}
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "" && !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+	assertInterval(0, "")
+
+	// The port we are seen from is that of the listening port.
+	dev.net.RLock()
+	port := dev.net.port
+	dev.net.RUnlock()
+	dev.SetExternalPort(port)
+	assertInterval(0, "")
+
+	if err := dev.IpcSet(uapiCfg("external_port", "1")); err != nil {
+		t.Fatal(err)
+	}
+	assertInterval(AutoKeepaliveInterval, "auto_keepalive_interval=25\n")
+
+	// A configured keepalive takes precedence.
+	setPeer("persistent_keepalive_interval", "10")
+	assertInterval(10, "persistent_keepalive_interval=10\n")
+	setPeer("persistent_keepalive_interval", "0")
+
+	setPeer("auto_keepalive", "false")
+	assertInterval(0, "auto_keepalive=false\n")
+	setPeer("auto_keepalive", "true")
+	dev.SetExternalPort(0)
+	assertInterval(0, "")
+}
+
+func TestAutoKeepaliveHandshakes(t *testing.T) {
+	pair := genTestPair(t, false)
+	pub := pair[1].dev.staticIdentity.publicKey
+	peer := pair[0].dev.LookupPeer(pub)
+
+	// Handshakes are not considered unless the peer opted in, as every
+	// client of a server sees them as if it was behind NAT.
+	for i := 0; i < autoKeepaliveHandshakes; i++ {
+		peer.autoKeepaliveResponseReceived()
+	}
+	if peer.keepaliveInterval() != 0 {
+		t.Error("expected no keepalive without auto_keepalive_handshakes")
+	}
+	if err := pair[0].dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "auto_keepalive_handshakes", "true")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An initiation from the peer while we have sent nothing to it was
+	// unsolicited, so the peer can reach us.
+	peer.autoKeepalive.lastSent.Store(0)
+	peer.autoKeepaliveInitiationReceived()
+	for i := 0; i < autoKeepaliveHandshakes; i++ {
+		peer.autoKeepaliveResponseReceived()
+	}
+	if peer.keepaliveInterval() != 0 {
+		t.Error("expected no keepalive for a peer that initiated unsolicited")
+	}
+
+	// Handshakes that are only ever answered, and an initiation soon after
+	// we sent, mean that we are likely behind NAT.
+	peer.autoKeepalive.unsolicited.Store(false)
+	peer.autoKeepaliveSent()
+	peer.autoKeepaliveInitiationReceived()
+	for i := 0; i < autoKeepaliveHandshakes; i++ {
+		if peer.keepaliveInterval() != 0 {
+			t.Fatalf("expected no keepalive after %d handshakes", i)
+		}
+		peer.autoKeepaliveResponseReceived()
+	}
+	if got := peer.keepaliveInterval(); got != AutoKeepaliveInterval {
+		t.Errorf("expected a keepalive interval of %d, got %d", AutoKeepaliveInterval, got)
+	}
+
+	// Rebinding changes the path to the peer, so NAT has to be detected
+	// again.
+	if err := pair[0].dev.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if peer.keepaliveInterval() != 0 {
+		t.Error("expected no keepalive after rebinding")
+	}
+}
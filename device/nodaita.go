@@ -0,0 +1,27 @@
+//go:build !daita
+// +build !daita
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// daitaSupported reports whether this package was built with DAITA support.
+const daitaSupported = false
+
+// validateDaitaMachine fails, as the package was built without DAITA support.
+func validateDaitaMachine(machine string) error {
+	return errDaitaNotSupported
+}
+
+// daitaMachineField returns "", as no machine is validated.
+func daitaMachineField(err error) string {
+	return ""
+}
+
+// enableDaitaMachines fails, as the package was built without DAITA support.
+func (peer *Peer) enableDaitaMachines(both, sent, received DaitaMachines, eventsCapacity uint, actionsCapacity uint) error {
+	return errDaitaNotSupported
+}
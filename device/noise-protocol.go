@@ -127,6 +127,7 @@ type Handshake struct {
 	remoteStatic              NoisePublicKey           // long term key
 	remoteEphemeral           NoisePublicKey           // ephemeral public key
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
+	initialHash               [blake2s.Size]byte       // see precomputeInitialHash
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
@@ -169,6 +170,14 @@ func (h *Handshake) mixKey(data []byte) {
 
 /* Do basic precomputations
  */
+// precomputeInitialHash sets dst to the handshake hash once the static key of
+// the responder, pk, is mixed in, which every initiation to pk starts from.
+// Devices created WithHandshakePrecomputation keep it for their own key and
+// the key of each peer, instead of hashing it for every handshake.
+func precomputeInitialHash(dst *[blake2s.Size]byte, pk NoisePublicKey) {
+	mixHash(dst, &InitialHash, pk[:])
+}
+
 func init() {
 	InitialChainKey = blake2s.Sum256([]byte(NoiseConstruction))
 	mixHash(&InitialHash, &InitialChainKey, []byte(WGIdentifier))
@@ -178,21 +187,28 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
+	if err := peer.checkProtocolVersion(); err != nil {
+		return nil, err
+	}
+
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
 	// create ephemeral key
 	var err error
-	handshake.hash = InitialHash
+	if device.options.handshakePrecomputation {
+		handshake.hash = handshake.initialHash
+	} else {
+		handshake.hash = InitialHash
+		handshake.mixHash(handshake.remoteStatic[:])
+	}
 	handshake.chainKey = InitialChainKey
 	handshake.localEphemeral, err = newPrivateKey()
 	if err != nil {
 		return nil, err
 	}
 
-	handshake.mixHash(handshake.remoteStatic[:])
-
 	msg := MessageInitiation{
 		Type:      MessageInitiationType,
 		Ephemeral: handshake.localEphemeral.publicKey(),
@@ -228,6 +244,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.precomputedStaticStatic[:],
 	)
 	timestamp := tai64n.Now()
+	peer.clockSkewInitiation(timestamp)
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
@@ -245,19 +262,34 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, _, ok := device.consumeMessageInitiation(msg)
+	if !ok {
+		return nil
+	}
+	return peer
+}
+
+// consumeMessageInitiation is ConsumeMessageInitiation, which also returns why
+// the initiation was rejected if ok is false. In that case, peer is the sender
+// if it could be identified before the initiation was rejected, or nil.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation) (peer *Peer, failure HandshakeFailureReason, ok bool) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, HandshakeFailureDecrypt, false
 	}
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
+	if device.options.handshakePrecomputation {
+		hash = device.staticIdentity.initialHash
+	} else {
+		mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
+	}
 	mixHash(&hash, &hash, msg.Ephemeral[:])
 	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
 
@@ -266,21 +298,24 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	var key [chacha20poly1305.KeySize]byte
 	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
 	if err != nil {
-		return nil
+		return nil, HandshakeFailureDecrypt, false
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
-		return nil
+		return nil, HandshakeFailureDecrypt, false
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
-	peer := device.LookupPeer(peerPK)
+	peer = device.LookupPeer(peerPK)
 	if peer == nil || !peer.isRunning.Load() {
-		return nil
+		return nil, HandshakeFailureUnknownPeer, false
+	}
+	if peer.checkProtocolVersion() != nil {
+		return peer, HandshakeFailureProtocolVersion, false
 	}
 
 	handshake := &peer.handshake
@@ -293,7 +328,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return peer, HandshakeFailureDecrypt, false
 	}
 	KDF2(
 		&chainKey,
@@ -305,7 +340,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return peer, HandshakeFailureDecrypt, false
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
@@ -316,11 +351,11 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
-		return nil
+		return peer, HandshakeFailureReplay, false
 	}
 	if flood {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
-		return nil
+		return peer, HandshakeFailureFlood, false
 	}
 
 	// update handshake state
@@ -345,7 +380,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, 0, true
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -356,6 +391,9 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	if handshake.state != handshakeInitiationConsumed {
 		return nil, errors.New("handshake initiation must be consumed first")
 	}
+	if err := peer.checkProtocolVersion(); err != nil {
+		return nil, err
+	}
 
 	// assign index
 
@@ -417,16 +455,30 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
-	if msg.Type != MessageResponseType {
+	peer, _, ok := device.consumeMessageResponse(msg)
+	if !ok {
 		return nil
 	}
+	return peer
+}
+
+// consumeMessageResponse is ConsumeMessageResponse, which also returns why the
+// response was rejected if ok is false. In that case, peer is the peer the
+// response was addressed to, or nil if there is none.
+func (device *Device) consumeMessageResponse(msg *MessageResponse) (peer *Peer, failure HandshakeFailureReason, ok bool) {
+	if msg.Type != MessageResponseType {
+		return nil, HandshakeFailureDecrypt, false
+	}
 
 	// lookup handshake by receiver
 
 	lookup := device.indexTable.Lookup(msg.Receiver)
 	handshake := lookup.handshake
 	if handshake == nil {
-		return nil
+		return nil, HandshakeFailureUnknownPeer, false
+	}
+	if lookup.peer.checkProtocolVersion() != nil {
+		return lookup.peer, HandshakeFailureProtocolVersion, false
 	}
 
 	var (
@@ -434,14 +486,14 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		chainKey [blake2s.Size]byte
 	)
 
-	ok := func() bool {
+	failure, ok = func() (HandshakeFailureReason, bool) {
 		// lock handshake state
 
 		handshake.mutex.RLock()
 		defer handshake.mutex.RUnlock()
 
 		if handshake.state != handshakeInitiationCreated {
-			return false
+			return HandshakeFailureReplay, false
 		}
 
 		// lock private key for reading
@@ -456,14 +508,14 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 		ss, err := handshake.localEphemeral.sharedSecret(msg.Ephemeral)
 		if err != nil {
-			return false
+			return HandshakeFailureDecrypt, false
 		}
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
 		ss, err = device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
 		if err != nil {
-			return false
+			return HandshakeFailureDecrypt, false
 		}
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
@@ -486,14 +538,14 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		aead, _ := chacha20poly1305.New(key[:])
 		_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
 		if err != nil {
-			return false
+			return HandshakeFailureDecrypt, false
 		}
 		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		return 0, true
 	}()
 
 	if !ok {
-		return nil
+		return lookup.peer, failure, false
 	}
 
 	// update handshake state
@@ -510,7 +562,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return lookup.peer
+	return lookup.peer, 0, true
 }
 
 /* Derives a new keypair from the current handshake state
@@ -602,6 +654,10 @@ func (peer *Peer) BeginSymmetricSession() error {
 		device.DeleteKeypair(previous)
 	}
 
+	if device.FlowLabelPolicy() == FlowLabelPerRekey {
+		peer.rotateFlowLabel()
+	}
+
 	return nil
 }
 
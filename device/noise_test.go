@@ -8,9 +8,12 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"testing"
+	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -177,3 +180,71 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+// handshakePeers creates an initiating device with initiatorOpts and a
+// responding device with responderOpts, and returns the peer of each on the
+// other: sender on the initiating device, and receiver on the responding one.
+func handshakePeers(tb testing.TB, initiatorOpts, responderOpts []Option) (sender, receiver *Peer) {
+	var devs [2]*Device
+	for i, opts := range [][]Option{initiatorOpts, responderOpts} {
+		sk, err := newPrivateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		devs[i] = NewDeviceWithOptions(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""), opts...)
+		devs[i].SetPrivateKey(sk)
+		tb.Cleanup(devs[i].Close)
+	}
+	sender, err := devs[0].NewPeer(devs[1].staticIdentity.publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	receiver, err = devs[1].NewPeer(devs[0].staticIdentity.publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sender.Start()
+	receiver.Start()
+	return sender, receiver
+}
+
+func TestNoiseHandshakePrecomputation(t *testing.T) {
+	precomputed := []Option{WithHandshakePrecomputation(true)}
+	for _, opts := range [][2][]Option{{precomputed, precomputed}, {precomputed, nil}, {nil, precomputed}} {
+		t.Run(fmt.Sprintf("initiator=%v,responder=%v", opts[0] != nil, opts[1] != nil), func(t *testing.T) {
+			sender, receiver := handshakePeers(t, opts[0], opts[1])
+			msg, err := sender.device.CreateMessageInitiation(sender)
+			assertNil(t, err)
+			if peer := receiver.device.ConsumeMessageInitiation(msg); peer != receiver {
+				t.Fatal("handshake failed at initiation message")
+			}
+			assertEqual(t, sender.handshake.hash[:], receiver.handshake.hash[:])
+			assertEqual(t, sender.handshake.chainKey[:], receiver.handshake.chainKey[:])
+		})
+	}
+}
+
+func BenchmarkHandshakeInitiation(b *testing.B) {
+	for _, precomputed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("precomputed=%v", precomputed), func(b *testing.B) {
+			opts := []Option{WithHandshakePrecomputation(precomputed)}
+			sender, receiver := handshakePeers(b, opts, opts)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg, err := sender.device.CreateMessageInitiation(sender)
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Every initiation is a replay of the first otherwise.
+				receiver.handshake.mutex.Lock()
+				receiver.handshake.lastTimestamp = tai64n.Timestamp{}
+				receiver.handshake.lastInitiationConsumption = time.Time{}
+				receiver.handshake.mutex.Unlock()
+				if receiver.device.ConsumeMessageInitiation(msg) != receiver {
+					b.Fatal("handshake failed at initiation message")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// peerNoKeypairDrops counts the packets to a peer that were dropped because no
+// session was established to send them with: staged packets pushed out by
+// newer ones while waiting for a handshake, and those flushed when the
+// handshake is given up. The drops of an episode of waiting are reported by a
+// single NotificationNoKeypairDrops once it ends, telling whether the session
+// got established, so that early loss while connecting can be told apart
+// from a broken tunnel.
+type peerNoKeypairDrops struct {
+	total   atomic.Uint64
+	pending atomic.Uint64 // dropped in the current episode, not reported yet
+}
+
+func (peer *Peer) droppedNoKeypair(n uint64) {
+	if n == 0 {
+		return
+	}
+	peer.noKeypairDrops.total.Add(n)
+	peer.noKeypairDrops.pending.Add(n)
+}
+
+// reportNoKeypairDrops ends an episode of waiting for a session, because a
+// handshake completed or was given up.
+func (peer *Peer) reportNoKeypairDrops(established bool) {
+	dropped := peer.noKeypairDrops.pending.Swap(0)
+	if dropped == 0 {
+		return
+	}
+	var message string
+	if established {
+		message = fmt.Sprintf("%d packets were dropped while the session was being established", dropped)
+	} else {
+		message = fmt.Sprintf("%d packets were dropped because no session could be established", dropped)
+	}
+	peer.device.log.Verbosef("%v - %s", peer, message)
+	peer.device.notify(NotificationNoKeypairDrops, peer, message)
+}
@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestNoKeypairDrops(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, peerSk := NoisePrivateKey{8}, NoisePrivateKey{16}
+	pk := peerSk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+		"allowed_ip", "1.0.0.1/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+
+	notifications := make(chan Notification, 4)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationNoKeypairDrops {
+			notifications <- n
+		}
+	})()
+
+	// Without an endpoint, no handshake can be sent, so packets stay staged
+	// until newer ones push them out.
+	const overflow = 3
+	for i := 0; i < QueueStagedSize+overflow; i++ {
+		tun.Outbound <- tuntest.Ping(netip.MustParseAddr("1.0.0.1"), netip.MustParseAddr("1.0.0.2"))
+	}
+	for deadline := time.Now().Add(5 * time.Second); peer.noKeypairDrops.total.Load() < overflow || len(peer.queue.staged) < QueueStagedSize; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d dropped packets, got %d", overflow, peer.noKeypairDrops.total.Load())
+		}
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := fmt.Sprintf("tx_dropped_no_keypair=%d\n", overflow); !strings.Contains(cfg, line) {
+		t.Errorf("%q missing from IpcGet:\n%s", line, cfg)
+	}
+	select {
+	case n := <-notifications:
+		t.Fatalf("unexpected notification before the handshake ended: %s", n.Message)
+	default:
+	}
+
+	// Giving up the handshake drops the remaining staged packets, and reports
+	// all drops at once.
+	peer.timers.handshakeAttempts.Store(MaxTimerHandshakes + 1)
+	expiredRetransmitHandshake(peer)
+	select {
+	case n := <-notifications:
+		want := fmt.Sprintf("%d packets were dropped because no session could be established", QueueStagedSize+overflow)
+		if n.Peer != pk || n.Message != want {
+			t.Errorf("expected notification %q, got %+v", want, n)
+		}
+	default:
+		t.Fatal("expected a notification")
+	}
+	if total := peer.noKeypairDrops.total.Load(); total != QueueStagedSize+overflow {
+		t.Errorf("expected %d dropped packets in total, got %d", QueueStagedSize+overflow, total)
+	}
+
+	// The episode is over, so completing a handshake reports nothing.
+	peer.timersHandshakeComplete()
+	select {
+	case n := <-notifications:
+		t.Fatalf("unexpected notification: %s", n.Message)
+	default:
+	}
+}
+
+// TestStagedOverflowWithKeypair checks that staged packets pushed out while a
+// session could send them, here while DAITA blocks the peer, are not counted
+// as dropped for lack of a session.
+func TestStagedOverflowWithKeypair(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if err := peer.BlockOutgoing(time.Minute, false, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const overflow = 3
+	for i := 0; i < QueueStagedSize+overflow; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	}
+	for deadline := time.Now().Add(5 * time.Second); peer.txStagedOverflow.Load() < overflow; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d staged packets pushed out, got %d", overflow, peer.txStagedOverflow.Load())
+		}
+	}
+	if dropped := peer.noKeypairDrops.total.Load(); dropped != 0 {
+		t.Errorf("%d packets counted as dropped for lack of a session", dropped)
+	}
+	cfg, err := pair[1].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := fmt.Sprintf("tx_dropped_staged_overflow=%d\n", overflow); !strings.Contains(cfg, line) {
+		t.Errorf("%q missing from IpcGet:\n%s", line, cfg)
+	}
+}
@@ -0,0 +1,335 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A NotificationKind identifies what a Notification is about.
+type NotificationKind int
+
+const (
+	// NotificationEndpointFailover is sent when a peer switches to a fallback
+	// endpoint after repeated handshake failures.
+	NotificationEndpointFailover NotificationKind = iota
+
+	// NotificationDaitaClosed is sent when DAITA has been stopped for a peer,
+	// because the peer was removed or its device brought down, and all of its
+	// resources have been freed.
+	NotificationDaitaClosed
+
+	// NotificationPeerGoodbye is sent when a peer with goodbye messages
+	// enabled says goodbye, and its sessions have been expired.
+	NotificationPeerGoodbye
+
+	// NotificationNonceWarning is sent when a session of a peer passes
+	// NonceWarningThreshold, because rekeying has been failing for long.
+	NotificationNonceWarning
+
+	// NotificationSessionExhausted is sent when a session of a peer has
+	// exhausted its nonces, and no packets can be sent to the peer until a
+	// handshake completes.
+	NotificationSessionExhausted
+
+	// NotificationTUNWriteFailed is sent when writing to the TUN device has
+	// failed persistently, as configured with WithTUNWriteFailurePolicy.
+	NotificationTUNWriteFailed
+
+	// NotificationTUNWriteRecovered is sent when writing to the TUN device
+	// succeeds after having failed persistently.
+	NotificationTUNWriteRecovered
+
+	// NotificationClockSkew is sent when handshakes with a peer are likely
+	// failing because the wall clock stepped back, so that the peer drops
+	// initiations as replays. It is sent once until a handshake completes.
+	NotificationClockSkew
+
+	// NotificationNoKeypairDrops is sent when a handshake with a peer
+	// completes or is given up after packets to the peer were dropped for
+	// lack of a session. It is sent once for all packets dropped while
+	// waiting, and tells their number and whether the session got
+	// established.
+	NotificationNoKeypairDrops
+
+	// NotificationPathMTU is sent when sending to a peer fails because the
+	// datagram exceeds the path MTU to its endpoint. It is sent once for
+	// every path MTU learned by the kernel, which the message tells if known.
+	NotificationPathMTU
+
+	// NotificationFeatureMismatch is sent when a peer with feature
+	// announcements announces features lacking some that it is configured
+	// with, which the message lists.
+	NotificationFeatureMismatch
+
+	// NotificationDaitaPaddingNotSent is sent when no DAITA padding was sent
+	// to a peer within the window of its DAITA padding check after DAITA was
+	// enabled, see the "daita_padding_check" UAPI key.
+	NotificationDaitaPaddingNotSent
+
+	// NotificationSendFailed is sent when sending to a peer has failed
+	// persistently, and is suspended except for probes, which are sent with
+	// exponential backoff until one gets through.
+	NotificationSendFailed
+
+	// NotificationSendRecovered is sent when a probe gets through to a peer
+	// after sending to it failed persistently, and sending resumes.
+	NotificationSendRecovered
+
+	// NotificationDaitaMemoryLimit is sent when DAITA is not enabled for a
+	// peer, or its machines are not reloaded, because the DAITA state of the
+	// peers of the device would exceed the limit set with
+	// WithDaitaMemoryLimit, even with the smallest event queue.
+	NotificationDaitaMemoryLimit
+
+	// NotificationResumed is sent when the device has reset its peers after
+	// the system resumed from a suspend, detected or told with NotifyResume.
+	NotificationResumed
+
+	// NotificationBindSwapped is sent when SwapBind has replaced the bind of
+	// the device.
+	NotificationBindSwapped
+
+	// NotificationChainClosing is published by multihoptun.CloseAll to both
+	// devices of a multihop chain before it closes them.
+	NotificationChainClosing
+)
+
+func (kind NotificationKind) String() string {
+	switch kind {
+	case NotificationEndpointFailover:
+		return "EndpointFailover"
+	case NotificationDaitaClosed:
+		return "DaitaClosed"
+	case NotificationPeerGoodbye:
+		return "PeerGoodbye"
+	case NotificationNonceWarning:
+		return "NonceWarning"
+	case NotificationSessionExhausted:
+		return "SessionExhausted"
+	case NotificationTUNWriteFailed:
+		return "TUNWriteFailed"
+	case NotificationTUNWriteRecovered:
+		return "TUNWriteRecovered"
+	case NotificationClockSkew:
+		return "ClockSkew"
+	case NotificationNoKeypairDrops:
+		return "NoKeypairDrops"
+	case NotificationPathMTU:
+		return "PathMTU"
+	case NotificationFeatureMismatch:
+		return "FeatureMismatch"
+	case NotificationDaitaPaddingNotSent:
+		return "DaitaPaddingNotSent"
+	case NotificationSendFailed:
+		return "SendFailed"
+	case NotificationSendRecovered:
+		return "SendRecovered"
+	case NotificationDaitaMemoryLimit:
+		return "DaitaMemoryLimit"
+	case NotificationResumed:
+		return "Resumed"
+	case NotificationBindSwapped:
+		return "BindSwapped"
+	case NotificationChainClosing:
+		return "ChainClosing"
+	}
+	return "Unknown"
+}
+
+// Topic returns the topic of the notifications of the kind.
+func (kind NotificationKind) Topic() Topic {
+	switch kind {
+	case NotificationPeerGoodbye, NotificationNonceWarning, NotificationSessionExhausted,
+		NotificationClockSkew, NotificationNoKeypairDrops, NotificationFeatureMismatch:
+		return TopicHandshake
+	case NotificationEndpointFailover, NotificationPathMTU:
+		return TopicEndpoint
+	case NotificationDaitaClosed, NotificationDaitaPaddingNotSent, NotificationDaitaMemoryLimit:
+		return TopicDaita
+	case NotificationChainClosing:
+		return TopicChain
+	case NotificationSendFailed, NotificationSendRecovered, NotificationBindSwapped:
+		return TopicBind
+	}
+	return TopicDevice
+}
+
+// A Topic is a set of subsystems of a device, which notifications are about.
+// Each NotificationKind is about a single one.
+type Topic uint32
+
+const (
+	// TopicHandshake is about handshakes and the sessions of peers.
+	TopicHandshake Topic = 1 << iota
+	// TopicEndpoint is about the endpoints of peers and the paths to them.
+	TopicEndpoint
+	// TopicDaita is about DAITA.
+	TopicDaita
+	// TopicChain is about multihop chains of devices.
+	TopicChain
+	// TopicBind is about the bind and sending through it.
+	TopicBind
+	// TopicDevice is about the device as a whole, such as its TUN device.
+	TopicDevice
+
+	// AllTopics is the set of all topics.
+	AllTopics = TopicHandshake | TopicEndpoint | TopicDaita | TopicChain | TopicBind | TopicDevice
+)
+
+var topicNames = []string{"handshake", "endpoint", "daita", "chain", "bind", "device"}
+
+// String returns the names of the topics of the set, separated by commas.
+func (topic Topic) String() string {
+	var names []string
+	for i, name := range topicNames {
+		if topic&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseTopics parses a set of topics named as by Topic.String.
+func ParseTopics(s string) (Topic, error) {
+	var topics Topic
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.Index(topicNames, name)
+		if i < 0 {
+			return 0, fmt.Errorf("unknown topic %q", name)
+		}
+		topics |= 1 << i
+	}
+	return topics, nil
+}
+
+// A Notification informs an embedder about a noteworthy change in the state
+// of a Device or one of its peers.
+type Notification struct {
+	Kind  NotificationKind
+	Topic Topic // of Kind
+	Time  time.Time
+
+	// Peer is the public key of the peer the notification concerns.
+	// It is the zero key for device-wide notifications.
+	Peer NoisePublicKey
+
+	// Message is a human-readable description of the notification.
+	Message string
+}
+
+// A NotificationFilter selects the notifications delivered to a subscriber.
+// A notification is selected if it matches all of the fields that are set;
+// the zero filter selects all of them.
+type NotificationFilter struct {
+	Topics Topic              // selected, all of them if zero
+	Kinds  []NotificationKind // selected, all of them if empty
+	Peer   NoisePublicKey     // of the notifications selected, which are all if zero
+}
+
+func (filter *NotificationFilter) selects(n *Notification) bool {
+	if filter.Topics != 0 && filter.Topics&n.Topic == 0 {
+		return false
+	}
+	if len(filter.Kinds) != 0 && !slices.Contains(filter.Kinds, n.Kind) {
+		return false
+	}
+	return filter.Peer.IsZero() || filter.Peer == n.Peer
+}
+
+// The notifications of a device are its event bus: all of its subsystems
+// send their notifications to the same subscribers, which select those they
+// are interested in with a NotificationFilter.
+type notifications struct {
+	sync.RWMutex
+	subscribers map[int]subscriber
+	nextID      int
+}
+
+type subscriber struct {
+	filter NotificationFilter
+	fn     func(Notification)
+}
+
+// Subscribe registers fn to be called for every Notification sent by the device,
+// and returns a function that cancels the subscription.
+// fn is called synchronously from the device's internal routines and must not block.
+// It may subscribe and unsubscribe, but then may still be called for a
+// notification sent while it was unsubscribing.
+func (device *Device) Subscribe(fn func(Notification)) (unsubscribe func()) {
+	return device.SubscribeFiltered(NotificationFilter{}, fn)
+}
+
+// SubscribeFiltered is like Subscribe, but only calls fn for the notifications
+// selected by filter.
+func (device *Device) SubscribeFiltered(filter NotificationFilter, fn func(Notification)) (unsubscribe func()) {
+	filter.Kinds = slices.Clone(filter.Kinds)
+	n := &device.notifications
+	n.Lock()
+	defer n.Unlock()
+
+	if n.subscribers == nil {
+		n.subscribers = make(map[int]subscriber)
+	}
+	id := n.nextID
+	n.nextID++
+	n.subscribers[id] = subscriber{filter, fn}
+
+	return func() {
+		n.Lock()
+		defer n.Unlock()
+		delete(n.subscribers, id)
+	}
+}
+
+// Publish sends a notification of the given kind to the subscribers of the
+// device, for the subsystems built over devices outside of this package, such
+// as multihop chains, to share its subscribers. peer may be nil for
+// device-wide notifications.
+func (device *Device) Publish(kind NotificationKind, peer *Peer, message string) {
+	device.notify(kind, peer, message)
+}
+
+// notify sends a notification of the given kind to all subscribers.
+// peer may be nil for device-wide notifications.
+func (device *Device) notify(kind NotificationKind, peer *Peer, message string) {
+	n := &device.notifications
+	n.RLock()
+	if len(n.subscribers) == 0 {
+		n.RUnlock()
+		return
+	}
+	notification := Notification{
+		Kind:    kind,
+		Topic:   kind.Topic(),
+		Time:    time.Now(),
+		Message: message,
+	}
+	if peer != nil {
+		notification.Peer = peer.handshake.remoteStatic
+	}
+	// The subscribers are called without the lock, so that they may subscribe,
+	// unsubscribe and send notifications themselves.
+	var selected []func(Notification)
+	for _, s := range n.subscribers {
+		if s.filter.selects(&notification) {
+			selected = append(selected, s.fn)
+		}
+	}
+	n.RUnlock()
+
+	for _, fn := range selected {
+		fn(notification)
+	}
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+)
+
+func TestTopics(t *testing.T) {
+	for kind := NotificationEndpointFailover; kind <= NotificationChainClosing; kind++ {
+		if kind.String() == "Unknown" {
+			t.Errorf("notification kind %d has no name", kind)
+		}
+		if topic := kind.Topic(); topic&AllTopics != topic || topic&(topic-1) != 0 {
+			t.Errorf("%v is about %v, want a single topic", kind, topic)
+		}
+	}
+	topics, err := ParseTopics("daita, bind")
+	if err != nil || topics != TopicDaita|TopicBind {
+		t.Errorf("ParseTopics = %v, %v", topics, err)
+	}
+	if topics.String() != "daita,bind" {
+		t.Errorf("String = %q", topics.String())
+	}
+	if _, err := ParseTopics("daita,"); err == nil {
+		t.Error("parsed an empty topic")
+	}
+}
+
+// notificationRecorder records the notifications of a subscription.
+type notificationRecorder struct {
+	sync.Mutex
+	kinds []NotificationKind
+}
+
+func (r *notificationRecorder) record(n Notification) {
+	r.Lock()
+	defer r.Unlock()
+	if n.Topic != n.Kind.Topic() {
+		panic("notification with the topic of another kind")
+	}
+	r.kinds = append(r.kinds, n.Kind)
+}
+
+func (r *notificationRecorder) recorded() []NotificationKind {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.kinds)
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+
+	var all, bind, peers, kinds notificationRecorder
+	defer dev.Subscribe(all.record)()
+	defer dev.SubscribeFiltered(NotificationFilter{Topics: TopicBind | TopicChain}, bind.record)()
+	defer dev.SubscribeFiltered(NotificationFilter{Peer: peer.handshake.remoteStatic}, peers.record)()
+	filter := NotificationFilter{Kinds: []NotificationKind{NotificationPathMTU}}
+	defer dev.SubscribeFiltered(filter, kinds.record)()
+	// The filter is copied.
+	filter.Kinds[0] = NotificationBindSwapped
+
+	if err := dev.SwapBind(bindtest.NewChannelBinds()[0]); err != nil {
+		t.Fatal(err)
+	}
+	dev.Publish(NotificationPathMTU, peer, "path MTU 1280")
+
+	if got := all.recorded(); !slices.Contains(got, NotificationBindSwapped) || !slices.Contains(got, NotificationPathMTU) {
+		t.Errorf("unexpected notifications %v", got)
+	}
+	if got := bind.recorded(); !slices.Equal(got, []NotificationKind{NotificationBindSwapped}) {
+		t.Errorf("unexpected bind notifications %v", got)
+	}
+	if got := peers.recorded(); !slices.Contains(got, NotificationPathMTU) || slices.Contains(got, NotificationBindSwapped) {
+		t.Errorf("unexpected notifications of the peer %v", got)
+	}
+	if got := kinds.recorded(); !slices.Equal(got, []NotificationKind{NotificationPathMTU}) {
+		t.Errorf("unexpected notifications of the kind %v", got)
+	}
+}
+
+func TestSubscribeInCallback(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	kinds := NotificationFilter{Kinds: []NotificationKind{NotificationPathMTU, NotificationBindSwapped}}
+
+	// The first subscriber cancels itself, subscribes another and notifies it
+	// from its callback.
+	var first, second notificationRecorder
+	var unsubscribe, unsubscribeSecond func()
+	unsubscribe = dev.SubscribeFiltered(kinds, func(n Notification) {
+		first.record(n)
+		unsubscribe()
+		unsubscribeSecond = dev.SubscribeFiltered(kinds, second.record)
+		dev.Publish(NotificationBindSwapped, nil, "")
+	})
+	dev.Publish(NotificationPathMTU, nil, "path MTU 1280")
+	defer unsubscribeSecond()
+	dev.Publish(NotificationPathMTU, nil, "path MTU 1280")
+
+	if got := first.recorded(); !slices.Equal(got, []NotificationKind{NotificationPathMTU}) {
+		t.Errorf("unexpected notifications of the cancelled subscriber %v", got)
+	}
+	if got := second.recorded(); !slices.Equal(got, []NotificationKind{NotificationBindSwapped, NotificationPathMTU}) {
+		t.Errorf("unexpected notifications of the new subscriber %v", got)
+	}
+}
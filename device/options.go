@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"time"
+)
+
+// An Option configures a Device created with NewDeviceWithOptions. Options
+// given a non-positive value keep the default, which is what NewDevice uses.
+type Option func(*deviceOptions)
+
+type deviceOptions struct {
+	queueStagedSize     int
+	queueOutboundSize   int
+	queueInboundSize    int
+	queueHandshakeSize  int
+	preallocatedBuffers uint32
+	workers             int
+	underLoadAfterTime  time.Duration
+	daitaPaddingOrder   DaitaPaddingOrder
+	ipcMaxLineSize      int
+	ipcMaxSetSize       int
+	ipcMaxSetPeers      int
+	clock               Clock
+	tunWriteFailure     TUNWriteFailurePolicy
+	tunWriteThreshold   int
+	mtuDiscovery        bool
+	mtuFeedback         bool
+	outboundScheduler   OutboundScheduler
+	daitaTrace          *daitaTrace
+	random              *seededRand // nil unless deterministic
+	daitaMemoryLimit    uint64
+	daitaFactory        DaitaFactory
+
+	handshakePrecomputation bool
+	daitaPaddingReceived    func(peer *Peer, packetLen uint)
+}
+
+func defaultDeviceOptions() deviceOptions {
+	return deviceOptions{
+		queueStagedSize:     QueueStagedSize,
+		queueOutboundSize:   QueueOutboundSize,
+		queueInboundSize:    QueueInboundSize,
+		queueHandshakeSize:  QueueHandshakeSize,
+		preallocatedBuffers: PreallocatedBuffersPerPool,
+		workers:             runtime.NumCPU(),
+		underLoadAfterTime:  UnderLoadAfterTime,
+		daitaPaddingOrder:   DaitaPaddingOrderFIFO,
+		ipcMaxLineSize:      MaxIpcLineSize,
+		ipcMaxSetSize:       MaxIpcSetSize,
+		ipcMaxSetPeers:      MaxIpcSetPeers,
+		clock:               systemClock{},
+		tunWriteThreshold:   TUNWriteFailureThreshold,
+	}
+}
+
+// WithQueueSizes sets the capacity of the queues of packets staged for each
+// peer before a handshake, of the outbound and inbound queues of the device
+// and of each peer, and of the queue of handshake messages. The handshake
+// queue being an eighth full puts the device under load.
+func WithQueueSizes(staged, outbound, inbound, handshake int) Option {
+	return func(o *deviceOptions) {
+		setPositive(&o.queueStagedSize, staged)
+		setPositive(&o.queueOutboundSize, outbound)
+		setPositive(&o.queueInboundSize, inbound)
+		setPositive(&o.queueHandshakeSize, handshake)
+	}
+}
+
+// WithPreallocatedBuffers caps each pool of message buffers and queue elements
+// to n entries, which are allocated on demand. Once a pool is exhausted, the
+// routines needing an entry wait for one to be released.
+func WithPreallocatedBuffers(n uint32) Option {
+	return func(o *deviceOptions) {
+		if n > 0 {
+			o.preallocatedBuffers = n
+		}
+	}
+}
+
+// WithWorkers sets the number of encryption, decryption and handshake
+// routines, each, instead of one per CPU.
+func WithWorkers(n int) Option {
+	return func(o *deviceOptions) {
+		setPositive(&o.workers, n)
+	}
+}
+
+// WithUnderLoadAfterTime sets how long the device remains under load, and
+// answers handshakes with cookie replies, after the load was last detected.
+func WithUnderLoadAfterTime(d time.Duration) Option {
+	return func(o *deviceOptions) {
+		setPositive(&o.underLoadAfterTime, d)
+	}
+}
+
+// WithDaitaPaddingOrder sets the DaitaPaddingOrder of new peers, which can
+// still be changed per peer with the "daita_padding_order" UAPI key.
+func WithDaitaPaddingOrder(order DaitaPaddingOrder) Option {
+	return func(o *deviceOptions) {
+		o.daitaPaddingOrder = order
+	}
+}
+
+// WithIpcLimits sets the length of the longest line, the size of the largest
+// configuration, and the number of peers, accepted in a UAPI set operation.
+// Exceeding any of them fails the operation before any of it is applied.
+func WithIpcLimits(lineSize, setSize, peers int) Option {
+	return func(o *deviceOptions) {
+		setPositive(&o.ipcMaxLineSize, lineSize)
+		setPositive(&o.ipcMaxSetSize, setSize)
+		setPositive(&o.ipcMaxSetPeers, peers)
+	}
+}
+
+// WithHandshakePrecomputation keeps the initial handshake hash of the device
+// and of each peer, computed from their public keys when they are set, instead
+// of computing it for every handshake message. The static-static shared
+// secret and the cookie keys of each peer are precomputed regardless. This
+// trades 32 bytes per peer for less work on servers accepting many
+// initiations.
+func WithHandshakePrecomputation(enabled bool) Option {
+	return func(o *deviceOptions) {
+		o.handshakePrecomputation = enabled
+	}
+}
+
+// WithClock schedules the DAITA padding of the device on clock instead of the
+// system clock.
+func WithClock(clock Clock) Option {
+	return func(o *deviceOptions) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithTUNWriteFailurePolicy sets what the device does once writing to the TUN
+// device has failed threshold times in a row, such as after the interface was
+// deleted. Every policy sends a NotificationTUNWriteFailed when the failure
+// becomes persistent, and a NotificationTUNWriteRecovered once a write
+// succeeds again.
+func WithTUNWriteFailurePolicy(policy TUNWriteFailurePolicy, threshold int) Option {
+	return func(o *deviceOptions) {
+		o.tunWriteFailure = policy
+		setPositive(&o.tunWriteThreshold, threshold)
+	}
+}
+
+// WithMTUDiscovery makes the device probe the path MTU to the endpoints of its
+// peers whenever it is brought up, and set the MTU of the TUN device to fit
+// the smallest, if the TUN device is a tun.MTUSetter. Probing is only
+// supported on Linux.
+func WithMTUDiscovery(enabled bool) Option {
+	return func(o *deviceOptions) {
+		o.mtuDiscovery = enabled
+	}
+}
+
+// WithPathMTUFeedback makes the device lower the MTU of the TUN device, if it
+// is a tun.MTUSetter, when sending to a peer fails because the datagram
+// exceeds the path MTU to its endpoint, so that later packets fit. Such
+// failures are reported by a NotificationPathMTU either way.
+func WithPathMTUFeedback(enabled bool) Option {
+	return func(o *deviceOptions) {
+		o.mtuFeedback = enabled
+	}
+}
+
+// WithDaitaPaddingReceived has callback called for every DAITA padding packet
+// received from a peer with DAITA enabled, with the length of the padding
+// including the DAITA header, so that integrators can check that the other
+// end pads. It is called by the receive routine of the peer, and must not
+// block.
+func WithDaitaPaddingReceived(callback func(peer *Peer, packetLen uint)) Option {
+	return func(o *deviceOptions) {
+		o.daitaPaddingReceived = callback
+	}
+}
+
+func setPositive[T int | time.Duration](option *T, value T) {
+	if value > 0 {
+		*option = value
+	}
+}
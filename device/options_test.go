@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestNewDeviceWithOptions(t *testing.T) {
+	dev := NewDeviceWithOptions(
+		tuntest.NewChannelTUN().TUN(),
+		bindtest.NewChannelBinds()[0],
+		NewLogger(LogLevelSilent, ""),
+		WithQueueSizes(8, 16, 32, 0),
+		WithWorkers(2),
+		WithDaitaPaddingOrder(DaitaPaddingOrderDataFirst),
+	)
+	defer dev.Close()
+
+	if got := cap(dev.queue.encryption.c); got != 16 {
+		t.Errorf("encryption queue capacity %d, want 16", got)
+	}
+	if got := cap(dev.queue.decryption.c); got != 32 {
+		t.Errorf("decryption queue capacity %d, want 32", got)
+	}
+	if got := cap(dev.queue.handshake.c); got != QueueHandshakeSize {
+		t.Errorf("handshake queue capacity %d, want the default %d", got, QueueHandshakeSize)
+	}
+	if dev.options.workers != 2 {
+		t.Errorf("%d workers, want 2", dev.options.workers)
+	}
+
+	sk := NoisePrivateKey{8}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cap(peer.queue.staged); got != 8 {
+		t.Errorf("staged queue capacity %d, want 8", got)
+	}
+	if got := cap(peer.queue.outbound.c); got != 16 {
+		t.Errorf("peer outbound queue capacity %d, want 16", got)
+	}
+	if got := DaitaPaddingOrder(peer.daitaPaddingOrder.Load()); got != DaitaPaddingOrderDataFirst {
+		t.Errorf("peer DAITA padding order %v, want %v", got, DaitaPaddingOrderDataFirst)
+	}
+}
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pacing is an opt-in layer on the outbound path of a peer, configured with
+// the "pacing" UAPI key, that spaces out the transmission of transport packets.
+// It smooths bursts that NICs and drivers would otherwise drop, and blurs the
+// timing of the traffic, complementing DAITA. The spacing is one of:
+//
+//	rate:<packets per second>   a fixed spacing
+//	uniform:<min>,<max>         uniformly distributed between two durations
+//	exponential:<mean>          exponentially distributed with the given mean
+//
+// Durations use the syntax of time.ParseDuration, and "none" disables pacing.
+// The sequential sender of the peer waits between packets, so a peer sending
+// faster than its pacing fills its outbound queue and eventually blocks
+// reading from the TUN device, as a congested socket would.
+type pacer struct {
+	spec string // as configured, for IpcGet
+
+	distribution pacingDistribution
+	min, max     time.Duration // bounds of the spacing, equal for a fixed spacing
+	mean         time.Duration // mean of the exponential distribution
+	random       *seededRand   // source of the spacing, nil for the global one
+
+	next time.Time // earliest time of the next packet, only used by the sequential sender
+}
+
+type pacingDistribution int
+
+const (
+	pacingFixed pacingDistribution = iota
+	pacingUniform
+	pacingExponential
+)
+
+func parsePacing(spec string) (*pacer, error) {
+	kind, args, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid pacing %q", spec)
+	}
+	p := &pacer{spec: spec}
+	switch kind {
+	case "rate":
+		rate, err := strconv.ParseFloat(args, 64)
+		if err != nil || !(rate > 0) {
+			return nil, fmt.Errorf("invalid pacing rate %q", args)
+		}
+		p.distribution = pacingFixed
+		p.min = time.Duration(float64(time.Second) / rate)
+		p.max = p.min
+	case "uniform":
+		minArg, maxArg, ok := strings.Cut(args, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid uniform pacing %q", args)
+		}
+		var err error
+		if p.min, err = time.ParseDuration(minArg); err != nil {
+			return nil, err
+		}
+		if p.max, err = time.ParseDuration(maxArg); err != nil {
+			return nil, err
+		}
+		if p.min < 0 || p.max < p.min {
+			return nil, fmt.Errorf("invalid uniform pacing %q", args)
+		}
+		p.distribution = pacingUniform
+	case "exponential":
+		var err error
+		if p.mean, err = time.ParseDuration(args); err != nil {
+			return nil, err
+		}
+		if p.mean <= 0 {
+			return nil, fmt.Errorf("invalid exponential pacing %q", args)
+		}
+		p.distribution = pacingExponential
+		p.max = MaxPacingSpacing
+	default:
+		return nil, fmt.Errorf("unknown pacing %q", kind)
+	}
+	if p.max > MaxPacingSpacing || p.mean > MaxPacingSpacing {
+		return nil, errors.New("pacing spacing is longer than " + MaxPacingSpacing.String())
+	}
+	return p, nil
+}
+
+// spacing returns the time to leave between the current and the next packet.
+func (p *pacer) spacing() time.Duration {
+	switch p.distribution {
+	case pacingUniform:
+		if p.max == p.min {
+			return p.min
+		}
+		return p.min + time.Duration(p.random.Int63n(int64(p.max-p.min)+1))
+	case pacingExponential:
+		return min(time.Duration(p.random.ExpFloat64()*float64(p.mean)), p.max)
+	}
+	return p.min
+}
+
+// wait blocks until the next packet may be sent, and reports false if ctx was
+// cancelled first.
+func (p *pacer) wait(ctx context.Context) bool {
+	now := time.Now()
+	if p.next.After(now) {
+		timer := time.NewTimer(p.next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		now = p.next
+	}
+	p.next = now.Add(p.spacing())
+	return true
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePacing(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		min, max time.Duration
+	}{
+		{"rate:1000", time.Millisecond, time.Millisecond},
+		{"uniform:100us,2ms", 100 * time.Microsecond, 2 * time.Millisecond},
+		{"exponential:500us", 0, MaxPacingSpacing},
+	} {
+		p, err := parsePacing(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		for i := 0; i < 1000; i++ {
+			if spacing := p.spacing(); spacing < tc.min || spacing > tc.max {
+				t.Fatalf("%s: spacing %v out of [%v, %v]", tc.spec, spacing, tc.min, tc.max)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "rate", "rate:0", "rate:-1", "uniform:2ms,1ms", "uniform:1ms", "exponential:0s", "rate:0.5", "uniform:0s,2s", "poisson:1ms"} {
+		if _, err := parsePacing(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestPacerWait(t *testing.T) {
+	p, err := parsePacing("rate:200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		p.wait(context.Background())
+	}
+	// The first packet goes out immediately, the other 20 are 5ms apart.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("21 packets paced at 200/s were sent in %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p.wait(ctx) {
+		t.Error("wait did not return early once cancelled")
+	}
+}
+
+func TestPacingUAPI(t *testing.T) {
+	pair := genTestPair(t, false)
+	pk := hex.EncodeToString(pair[0].dev.staticIdentity.publicKey[:])
+	if err := pair[1].dev.IpcSet(uapiCfg("public_key", pk, "pacing", "uniform:1ms,2ms")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := pair[1].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "pacing=uniform:1ms,2ms\n") {
+		t.Fatalf("pacing missing from IpcGet:\n%s", cfg)
+	}
+	pair.Send(t, Ping, nil)
+
+	if err := pair[1].dev.IpcSet(uapiCfg("public_key", pk, "pacing", "rate:banana")); err == nil {
+		t.Error("expected an invalid pacing to be rejected")
+	}
+	if err := pair[1].dev.IpcSet(uapiCfg("public_key", pk, "pacing", "none")); err != nil {
+		t.Fatal(err)
+	}
+	if pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey).pacing.Load() != nil {
+		t.Error("pacing not disabled")
+	}
+}
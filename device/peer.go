@@ -7,14 +7,19 @@ package device
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"net/netip"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+var errNoEndpoint = errors.New("no known endpoint for peer")
+
 type Peer struct {
 	isRunning         atomic.Bool
 	sync.RWMutex      // Mostly protects endpoint, but is generally taken whenever we modify peer
@@ -27,7 +32,34 @@ type Peer struct {
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
 
+	rxDroppedNonIP       atomic.Uint64 // received packets that were neither IPv4/IPv6 nor DAITA padding
+	rxDroppedDaitaMarker atomic.Uint64 // received DAITA padding while DAITA is disabled for the peer
+	rxDaitaPadding       atomic.Uint64 // received DAITA padding packets while DAITA is enabled for the peer
+	rxDaitaPaddingBytes  atomic.Uint64 // bytes of the padding packets received, including the DAITA header
+	rxDaitaMalformed     atomic.Uint64 // received DAITA padding discarded for a malformed header
+	rxDuplicates         atomic.Uint64 // received transport packets rejected by the replay filter, such as multipath duplicates
+	rxRelayed            atomic.Uint64 // received packets forwarded to another peer, see RelayRoute
+	txStagedOverflow     atomic.Uint64 // staged packets pushed out by newer ones while a session could send them
+	rekeys               rekeyStats
+	ipHeaders            peerIPHeaders
+	sendCircuit          peerSendCircuit
+
 	disableRoaming bool
+	failover       endpointFailover // protected by the peer's mutex
+	flowLabel      atomic.Uint32    // IPv6 flow label of outgoing packets, see FlowLabelPolicy
+	staleFlowLabel atomic.Uint32    // flow label replaced by rotateFlowLabel, still to be released
+	sourceAddr     netip.Addr       // local address outgoing packets are pinned to, protected by the peer's mutex
+	goroutines     atomic.Int32     // running goroutines of the peer, see checkGoroutinesStopped
+	multipath      peerMultipath
+	dedup          peerDedup
+	clockSkew      peerClockSkew
+	classifier     peerClassifier
+	rtt            peerRTT
+	noKeypairDrops peerNoKeypairDrops
+	pathMTU        peerPathMTU
+	lastError      peerLastError
+	features       peerFeatures
+	direction      peerDirection
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -42,12 +74,20 @@ type Peer struct {
 
 	state struct {
 		sync.Mutex // protects against concurrent Start/Stop
+
+		// ctx is created by Start and cancelled by Stop. The routines of
+		// the peer derive from it, and return once it is cancelled.
+		ctx    context.Context
+		cancel context.CancelFunc
 	}
 
 	queue struct {
-		staged   chan *QueueOutboundElement // staged packets before a handshake is available
-		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
-		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
+		staged             chan *QueueOutboundElement // staged packets before a handshake is available
+		stagedClock        queueClock
+		stagedPadding      chan *QueueOutboundElement // staged DAITA padding, see DaitaPaddingOrder
+		stagedPaddingClock queueClock
+		outbound           *autodrainingOutboundQueue // sequential ordering of udp transmission
+		inbound            *autodrainingInboundQueue  // sequential ordering of tun writing
 	}
 
 	cookieGenerator             CookieGenerator
@@ -55,7 +95,20 @@ type Peer struct {
 	persistentKeepaliveInterval atomic.Uint32
 
 	daita              Daita
-	constantPacketSize bool
+	daitaPaddingOrder  atomic.Uint32                   // actually a DaitaPaddingOrder
+	constantPacketSize atomic.Bool                     // see SetConstantPacketSize
+	compression        atomic.Pointer[peerCompression] // nil if compression is disabled
+	pacing             atomic.Pointer[pacer]           // nil if pacing is disabled
+	goodbye            atomic.Bool                     // send and accept goodbye messages
+	pinEndpoint        atomic.Bool                     // ignore endpoints of incoming packets, see disable_roaming
+	latch              endpointLatch                   // see latch_endpoint
+	protocolVersion    atomic.Uint32                   // actually a ProtocolVersion, 0 for DefaultProtocolVersion
+	autoKeepalive      peerAutoKeepalive
+	daitaConfig        peerDaitaConfig // set through UAPI, protected by the peer lock
+	daitaCheck         daitaPaddingCheck
+	daitaBlocking      daitaBlocking
+	scheduled          scheduledPackets
+	trace              peerTrace
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -84,7 +137,16 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
-	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.queue.staged = make(chan *QueueOutboundElement, device.options.queueStagedSize)
+	peer.queue.stagedClock.reset()
+	peer.queue.stagedPadding = make(chan *QueueOutboundElement, device.options.queueStagedSize)
+	peer.queue.stagedPaddingClock.reset()
+	peer.daitaPaddingOrder.Store(uint32(device.options.daitaPaddingOrder))
+	if config := device.daitaDefault.Load(); config != nil {
+		peer.daitaConfig = *config
+	} else {
+		peer.daitaConfig = defaultDaitaConfig()
+	}
 
 	// map public key
 	_, ok := device.peers.keyMap[pk]
@@ -97,16 +159,21 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.mutex.Lock()
 	handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(pk)
 	handshake.remoteStatic = pk
+	if device.options.handshakePrecomputation {
+		precomputeInitialHash(&handshake.initialHash, pk)
+	}
 	handshake.mutex.Unlock()
 
 	// reset endpoint
 	peer.endpoint = nil
+	peer.flowLabel.Store(randomFlowLabel(device.options.random))
 
 	// init timers
 	peer.timersInit()
 
 	// add
 	device.peers.keyMap[pk] = peer
+	device.insertSortedPeerLocked(peer, pk)
 
 	return peer, nil
 }
@@ -123,12 +190,40 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	defer peer.RUnlock()
 
 	if peer.endpoint == nil {
-		return errors.New("no known endpoint for peer")
+		return errNoEndpoint
 	}
+	if !peer.allowSend() {
+		return errSendCircuitOpen
+	}
+	err := peer.sendTo(buffer, peer.endpoint, peer.sourceAddr)
+	peer.sendDone(err)
+	return err
+}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+// sendTo sends buffer to endpoint, from source if it is valid. The caller
+// must hold the read locks of the peer and the device's net.
+func (peer *Peer) sendTo(buffer []byte, endpoint conn.Endpoint, source netip.Addr) error {
+	if source.IsValid() && endpoint.SrcIP() != source {
+		// Roaming replaces the endpoint and with it the pinned source, so it
+		// is reapplied here. Endpoints of the other address family keep the
+		// source chosen by the bind.
+		if bind, ok := peer.device.net.bind.(conn.SourceAddrBind); ok {
+			bind.SetEndpointSource(endpoint, source)
+		}
+	}
+
+	var err error
+	if bind, ok := peer.device.net.bind.(conn.FlowLabelBind); ok && peer.device.FlowLabelPolicy() != FlowLabelOff {
+		peer.releaseStaleFlowLabel(bind)
+		err = bind.SendWithFlowLabel(buffer, endpoint, peer.flowLabel.Load())
+	} else {
+		err = peer.device.net.bind.Send(buffer, endpoint)
+	}
 	if err == nil {
 		peer.txBytes.Add(uint64(len(buffer)))
+		peer.autoKeepaliveSent()
+	} else if errors.Is(err, syscall.EMSGSIZE) {
+		peer.sendTooBig(len(buffer), endpoint)
 	}
 	return err
 }
@@ -187,11 +282,16 @@ func (peer *Peer) Start() {
 	peer.device.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
 
 	peer.timersStart()
+	peer.startScheduling()
 
 	device.flushInboundQueue(peer.queue.inbound)
 	device.flushOutboundQueue(peer.queue.outbound)
-	go peer.RoutineSequentialSender()
-	go peer.RoutineSequentialReceiver()
+	ctx, cancel := context.WithCancel(context.Background())
+	peer.state.ctx, peer.state.cancel = ctx, cancel
+	peer.goroutineEnter(GoroutinePeer) // RoutineSequentialSender
+	peer.goroutineEnter(GoroutinePeer) // RoutineSequentialReceiver
+	go peer.RoutineSequentialSender(ctx)
+	go peer.RoutineSequentialReceiver(ctx)
 
 	peer.isRunning.Store(true)
 }
@@ -252,27 +352,41 @@ func (peer *Peer) Stop() {
 	peer.device.log.Verbosef("%v - Stopping", peer)
 
 	peer.timersStop()
-	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
-	peer.queue.inbound.c <- nil
-	peer.queue.outbound.c <- nil
+	// Signal the routines of the peer, including those of DAITA, to return.
+	peer.state.cancel()
+
+	peer.stopScheduling()
+	peer.stopping.Wait()
 
+	// DAITA is closed once the routines of the peer, which tell it of the
+	// packets they handle, have returned.
 	if peer.daita != nil {
+		peer.stopDaitaPaddingCheck()
 		daita := peer.daita
 		peer.daita = nil
 		daita.Close()
+		peer.endDaitaBlocking()
+		peer.device.notify(NotificationDaitaClosed, peer, "DAITA stopped")
 	}
-
-	peer.stopping.Wait()
+	peer.checkGoroutinesStopped()
 	peer.device.queue.encryption.wg.Done() // no more writes to encryption queue from us
 
+	// Return the packets the routines left behind to the pools.
+	peer.device.flushInboundQueue(peer.queue.inbound)
+	peer.device.flushOutboundQueue(peer.queue.outbound)
+
 	peer.ZeroAndFlushAll()
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
-	if peer.disableRoaming {
+	if peer.disableRoaming || peer.pinEndpoint.Load() || peer.latch.enabled.Load() {
 		return
 	}
 	peer.Lock()
+	roamed := peer.endpoint != nil && peer.endpoint.DstIP() != endpoint.DstIP()
 	peer.endpoint = endpoint
 	peer.Unlock()
+	if roamed {
+		peer.autoKeepaliveReset()
+	}
 }
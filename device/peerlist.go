@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"slices"
+	"time"
+)
+
+// PeerSummary is the state of a peer reported by Device.Peers, a subset of
+// what IpcGet reports that is cheap to collect.
+type PeerSummary struct {
+	PublicKey     NoisePublicKey
+	Endpoint      string    // empty if unknown
+	LastHandshake time.Time // zero if there was none
+	RxBytes       uint64
+	TxBytes       uint64
+	Running       bool
+}
+
+// Peers returns summaries of up to limit peers, starting at the peer at
+// offset, and the number of peers of the device. Peers are ordered by public
+// key, so that successive pages list every peer once while no peer is added
+// or removed, and otherwise shift by at most the number of changes. The cost
+// is proportional to limit, not to the number of peers.
+func (device *Device) Peers(offset, limit int) (peers []PeerSummary, total int) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	total = len(device.peers.sorted)
+	if offset < 0 || offset >= total || limit <= 0 {
+		return nil, total
+	}
+	page := device.peers.sorted[offset:min(total, offset+limit)]
+	peers = make([]PeerSummary, len(page))
+	for i, peer := range page {
+		peers[i] = peer.summary()
+	}
+	return peers, total
+}
+
+func (peer *Peer) summary() PeerSummary {
+	summary := PeerSummary{
+		PublicKey: peer.handshake.remoteStatic,
+		RxBytes:   peer.rxBytes.Load(),
+		TxBytes:   peer.txBytes.Load(),
+		Running:   peer.isRunning.Load(),
+	}
+	if nano := peer.lastHandshakeNano.Load(); nano != 0 {
+		summary.LastHandshake = time.Unix(0, nano)
+	}
+	peer.RLock()
+	if peer.endpoint != nil {
+		summary.Endpoint = peer.endpoint.DstToString()
+	}
+	peer.RUnlock()
+	return summary
+}
+
+func comparePeers(a *Peer, pk NoisePublicKey) int {
+	return bytes.Compare(a.handshake.remoteStatic[:], pk[:])
+}
+
+// insertSortedPeerLocked adds peer to the peers ordered for Peers. The
+// caller must hold the write lock of device.peers.
+func (device *Device) insertSortedPeerLocked(peer *Peer, pk NoisePublicKey) {
+	i, _ := slices.BinarySearchFunc(device.peers.sorted, pk, comparePeers)
+	device.peers.sorted = slices.Insert(device.peers.sorted, i, peer)
+}
+
+// removeSortedPeerLocked removes the peer with public key pk from the peers
+// ordered for Peers, if it is there. The caller must hold the write lock of
+// device.peers.
+func (device *Device) removeSortedPeerLocked(pk NoisePublicKey) {
+	if i, ok := slices.BinarySearchFunc(device.peers.sorted, pk, comparePeers); ok {
+		device.peers.sorted = slices.Delete(device.peers.sorted, i, i+1)
+	}
+}
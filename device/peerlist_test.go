@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPeers(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	const n = 25
+	keys := make(map[NoisePublicKey]bool)
+	for i := 0; i < n; i++ {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk := sk.publicKey()
+		keys[pk] = true
+		if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "endpoint", "127.0.0.1:2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed []PeerSummary
+	for offset := 0; ; offset += 10 {
+		page, total := dev.Peers(offset, 10)
+		if total != n {
+			t.Fatalf("expected %d peers in total, got %d", n, total)
+		}
+		if len(page) == 0 {
+			break
+		}
+		listed = append(listed, page...)
+	}
+	if len(listed) != n {
+		t.Fatalf("expected %d peers listed, got %d", n, len(listed))
+	}
+	for i, peer := range listed {
+		if !keys[peer.PublicKey] {
+			t.Errorf("unknown peer %x listed", peer.PublicKey[:])
+		}
+		if i > 0 && bytes.Compare(listed[i-1].PublicKey[:], peer.PublicKey[:]) >= 0 {
+			t.Errorf("peers %d and %d out of order", i-1, i)
+		}
+		if peer.Endpoint != "127.0.0.1:2" || !peer.LastHandshake.IsZero() {
+			t.Errorf("unexpected summary %+v", peer)
+		}
+	}
+
+	// Removing a peer takes it out of the pages.
+	removed := listed[3].PublicKey
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(removed[:]), "remove", "true")); err != nil {
+		t.Fatal(err)
+	}
+	page, total := dev.Peers(3, 1)
+	if total != n-1 || len(page) != 1 || page[0].PublicKey != listed[4].PublicKey {
+		t.Errorf("unexpected page after removing a peer: %v of %d", page, total)
+	}
+	if page, _ := dev.Peers(n, 10); page != nil {
+		t.Errorf("expected no peers past the end, got %v", page)
+	}
+
+	dev.RemoveAllPeers()
+	if _, total := dev.Peers(0, 10); total != 0 {
+		t.Errorf("%d peers left after removing all", total)
+	}
+}
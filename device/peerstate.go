@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	peerStateSaveDelay = 10 * time.Second // batches saves after handshakes
+	peerStateMaxAge    = 24 * time.Hour   // endpoints older than this are not restored
+)
+
+// peerStateEntry is the persisted state of one peer.
+type peerStateEntry struct {
+	PublicKey     string `json:"public_key"`
+	Endpoint      string `json:"endpoint"`
+	LastHandshake int64  `json:"last_handshake_unix_nano"`
+}
+
+type peerStateFile struct {
+	Peers []peerStateEntry `json:"peers"`
+}
+
+// peerState persists the last known good endpoint of each peer, so that a
+// restarted device re-dials the endpoint a peer roamed to rather than the
+// possibly stale configured one.
+type peerState struct {
+	sync.Mutex
+	path      string
+	entries   map[NoisePublicKey]peerStateEntry
+	saveTimer *time.Timer
+	closed    bool // no saves are scheduled once the device is closing
+}
+
+// SetPeerStateFile enables persistence of peer endpoints and handshake times
+// to path, and loads the state saved there by a previous run. Peers created
+// by later configuration start at their saved endpoint, falling back to the
+// configured one through the endpoint failover order. A missing file is not
+// an error.
+func (device *Device) SetPeerStateFile(path string) error {
+	entries := make(map[NoisePublicKey]peerStateEntry)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var file peerStateFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		for _, entry := range file.Peers {
+			var pk NoisePublicKey
+			if err := pk.FromHex(entry.PublicKey); err != nil {
+				continue
+			}
+			entries[pk] = entry
+		}
+	}
+
+	device.peerState.Lock()
+	defer device.peerState.Unlock()
+	device.peerState.path = path
+	device.peerState.entries = entries
+	return nil
+}
+
+// restorePeerState points a newly created peer at its saved endpoint, unless
+// its endpoint is pinned to the configured one.
+func (device *Device) restorePeerState(peer *Peer) {
+	if peer.pinEndpoint.Load() {
+		return
+	}
+	device.peerState.Lock()
+	entry, ok := device.peerState.entries[peer.handshake.remoteStatic]
+	device.peerState.Unlock()
+	if !ok || entry.Endpoint == "" || time.Since(time.Unix(0, entry.LastHandshake)) > peerStateMaxAge {
+		return
+	}
+
+	endpoint, err := device.net.bind.ParseEndpoint(entry.Endpoint)
+	if err != nil {
+		device.log.Errorf("%v - Failed to restore saved endpoint %q: %v", peer, entry.Endpoint, err)
+		return
+	}
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.failover.lastGood = endpoint
+	peer.Unlock()
+	device.log.Verbosef("%v - Restored endpoint %v from peer state file", peer, entry.Endpoint)
+}
+
+// schedulePeerStateSave saves the peer state file after a short delay, if
+// persistence is enabled, no save is pending and the device is not closing.
+func (device *Device) schedulePeerStateSave() {
+	device.peerState.Lock()
+	defer device.peerState.Unlock()
+	if device.peerState.path == "" || device.peerState.saveTimer != nil || device.peerState.closed {
+		return
+	}
+	device.peerState.saveTimer = time.AfterFunc(peerStateSaveDelay, func() {
+		if err := device.savePeerState(); err != nil {
+			device.log.Errorf("Failed to save peer state file: %v", err)
+		}
+	})
+}
+
+// closePeerState stops the pending save, if any, and any later one from
+// being scheduled, and saves the peer state file a last time.
+func (device *Device) closePeerState() {
+	device.peerState.Lock()
+	device.peerState.closed = true
+	if device.peerState.saveTimer != nil {
+		device.peerState.saveTimer.Stop()
+		device.peerState.saveTimer = nil
+	}
+	device.peerState.Unlock()
+
+	if err := device.savePeerState(); err != nil {
+		device.log.Errorf("Failed to save peer state file: %v", err)
+	}
+}
+
+// savePeerState writes the last known good endpoint of every peer that has
+// completed a handshake to the peer state file. Saved entries of peers that
+// are not currently configured are kept until they expire.
+func (device *Device) savePeerState() error {
+	device.peers.RLock()
+	current := make(map[NoisePublicKey]peerStateEntry, len(device.peers.keyMap))
+	for pk, peer := range device.peers.keyMap {
+		peer.RLock()
+		endpoint := peer.failover.lastGood
+		peer.RUnlock()
+		lastHandshake := peer.lastHandshakeNano.Load()
+		if endpoint == nil || lastHandshake == 0 {
+			continue
+		}
+		current[pk] = peerStateEntry{
+			PublicKey:     hex.EncodeToString(pk[:]),
+			Endpoint:      endpoint.DstToString(),
+			LastHandshake: lastHandshake,
+		}
+	}
+	device.peers.RUnlock()
+
+	device.peerState.Lock()
+	defer device.peerState.Unlock()
+	if device.peerState.saveTimer != nil {
+		device.peerState.saveTimer.Stop()
+		device.peerState.saveTimer = nil
+	}
+	if device.peerState.path == "" {
+		return nil
+	}
+	for pk, entry := range current {
+		device.peerState.entries[pk] = entry
+	}
+
+	var file peerStateFile
+	for pk, entry := range device.peerState.entries {
+		if time.Since(time.Unix(0, entry.LastHandshake)) > peerStateMaxAge {
+			delete(device.peerState.entries, pk)
+			continue
+		}
+		file.Peers = append(file.Peers, entry)
+	}
+	data, err := json.MarshalIndent(&file, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated state file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(device.peerState.path), filepath.Base(device.peerState.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), device.peerState.path)
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPeerStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+
+	pair := genTestPair(t, false)
+	if err := pair[1].dev.SetPeerStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	if err := pair[1].dev.savePeerState(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file peerStateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Peers) != 1 || file.Peers[0].Endpoint == "" || file.Peers[0].LastHandshake == 0 {
+		t.Fatalf("unexpected peer state: %s", data)
+	}
+	saved := file.Peers[0]
+
+	// A restarted device starts at the saved endpoint, and keeps the
+	// configured one as fallback.
+	var sk NoisePrivateKey
+	sk[0] = 1
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.SetPeerStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", saved.PublicKey,
+		"endpoint", "127.0.0.1:9",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	var pk NoisePublicKey
+	if err := pk.FromHex(saved.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	peer.RLock()
+	defer peer.RUnlock()
+	if got := peer.endpoint.DstToString(); got != saved.Endpoint {
+		t.Errorf("expected restored endpoint %s, got %s", saved.Endpoint, got)
+	}
+	if got := peer.failover.configured.DstToString(); got != "127.0.0.1:9" {
+		t.Errorf("expected configured endpoint to be kept as fallback, got %s", got)
+	}
+}
+
+func TestPeerStateSaveStoppedOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	if err := dev.SetPeerStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	dev.schedulePeerStateSave()
+	dev.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected a final save on close: %v", err)
+	}
+
+	// Neither the save pending at close nor a later one outlives the device.
+	dev.schedulePeerStateSave()
+	dev.peerState.Lock()
+	defer dev.peerState.Unlock()
+	if dev.peerState.saveTimer != nil {
+		t.Error("expected no save to be pending after close")
+	}
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ProtocolVersion is the version of the protocol spoken with a peer, set with
+// the "protocol_version" UAPI key. Version 1 is the WireGuard protocol. Later
+// versions are reserved for fork-specific message extensions, such as
+// negotiating DAITA, which both ends of a tunnel must support. The version is
+// not sent to the peer, so both ends must be configured with the same one. A
+// version is only accepted once this package implements it, by listing it in
+// supportedProtocolVersions, and a device refuses handshakes with a peer it is
+// configured with a version it does not support for.
+type ProtocolVersion uint32
+
+const (
+	ProtocolVersion1 ProtocolVersion = 1
+
+	DefaultProtocolVersion = ProtocolVersion1
+)
+
+// supportedProtocolVersions are the protocol versions this package implements.
+var supportedProtocolVersions = protocolVersionSet{
+	ProtocolVersion1: true,
+}
+
+// protocolVersionSet is a set of protocol versions. A set stored in a device
+// is never modified, only replaced.
+type protocolVersionSet map[ProtocolVersion]bool
+
+// supportsProtocolVersion reports whether the device accepts version.
+func (device *Device) supportsProtocolVersion(version ProtocolVersion) bool {
+	if versions := device.protocolVersions.Load(); versions != nil {
+		return (*versions)[version]
+	}
+	return supportedProtocolVersions[version]
+}
+
+// setSupportedProtocolVersions replaces the protocol versions the device
+// accepts, which are supportedProtocolVersions by default.
+func (device *Device) setSupportedProtocolVersions(versions ...ProtocolVersion) {
+	set := make(protocolVersionSet, len(versions))
+	for _, version := range versions {
+		set[version] = true
+	}
+	device.protocolVersions.Store(&set)
+}
+
+var errUnsupportedProtocolVersion = errors.New("unsupported protocol version")
+
+func (device *Device) parseProtocolVersion(s string) (ProtocolVersion, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	version := ProtocolVersion(v)
+	if !device.supportsProtocolVersion(version) {
+		return 0, fmt.Errorf("%w: %d", errUnsupportedProtocolVersion, version)
+	}
+	return version, nil
+}
+
+// ProtocolVersion returns the protocol version configured for the peer.
+func (peer *Peer) ProtocolVersion() ProtocolVersion {
+	if version := ProtocolVersion(peer.protocolVersion.Load()); version != 0 {
+		return version
+	}
+	return DefaultProtocolVersion
+}
+
+// checkProtocolVersion fails if the protocol version configured for the peer
+// is not supported, which it must be for a handshake with the peer.
+func (peer *Peer) checkProtocolVersion() error {
+	if version := peer.ProtocolVersion(); !peer.device.supportsProtocolVersion(version) {
+		return fmt.Errorf("%w: %d", errUnsupportedProtocolVersion, version)
+	}
+	return nil
+}
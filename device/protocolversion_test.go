@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	// Pretend version 2 is implemented by the first device, as it uses the
+	// messages of version 1 until it has extensions.
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		device := NewDevice(tun, bind, logger)
+		if i == 0 {
+			device.setSupportedProtocolVersions(ProtocolVersion1, 2)
+		}
+		return device
+	})
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	setVersion := func(version string) error {
+		return dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"update_only", "true",
+			"protocol_version", version,
+		))
+	}
+	assertVersion := func(want string) {
+		t.Helper()
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(cfg, "protocol_version="+want+"\n") {
+			t.Errorf("expected protocol_version=%s in IpcGet, got:\n%s", want, cfg)
+		}
+	}
+	assertVersion("1")
+
+	var ipcErr *IPCError
+	if err := setVersion("3"); !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+		t.Errorf("expected an unsupported version to fail with IpcErrorInvalid, got %v", err)
+	}
+	if err := setVersion("2"); err != nil {
+		t.Fatal(err)
+	}
+	assertVersion("2")
+	pair.Send(t, Ping, nil)
+
+	// A handshake with a peer configured with a version that is no longer
+	// supported is refused in both directions.
+	dev.setSupportedProtocolVersions(ProtocolVersion1)
+	peer := dev.LookupPeer(pub)
+	if _, err := dev.CreateMessageInitiation(peer); !errors.Is(err, errUnsupportedProtocolVersion) {
+		t.Errorf("expected creating an initiation to fail, got %v", err)
+	}
+	remote := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+	msg, err := pair[1].dev.CreateMessageInitiation(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, failure, ok := dev.consumeMessageInitiation(msg); ok || got != peer || failure != HandshakeFailureProtocolVersion {
+		t.Errorf("expected the initiation to be refused for its protocol version, got %v, %v", ok, failure)
+	}
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QueueStat is a snapshot of the occupancy of one queue.
+type QueueStat struct {
+	Len int
+	Cap int
+
+	// OldestAge estimates how long the oldest queued element has been
+	// waiting. It is zero if the queue is empty. Elements are not timestamped
+	// individually while they wait, so this is an upper bound derived from
+	// the element dequeued last: for a stalled queue, it is the time since
+	// the queue last made progress.
+	OldestAge time.Duration
+}
+
+// PeerQueueStats holds the occupancy of the queues of one peer.
+type PeerQueueStats struct {
+	Staged        QueueStat // packets waiting for a session
+	StagedPadding QueueStat // DAITA padding waiting for a session
+	Outbound      QueueStat // packets waiting to be sent, in order
+	Inbound       QueueStat // packets waiting to be written to the TUN device, in order
+	DaitaEvents   QueueStat // events waiting for the DAITA machines, zero without DAITA
+}
+
+// QueueStats holds the occupancy of the queues of a device and its peers.
+type QueueStats struct {
+	Encryption QueueStat
+	Decryption QueueStat
+	Handshake  QueueStat
+	Peers      map[NoisePublicKey]PeerQueueStats
+}
+
+// queueNow returns the timestamp stored in queued elements.
+func queueNow() int64 {
+	return time.Now().UnixNano()
+}
+
+// queueClock tracks the progress of the consumer of a FIFO queue.
+type queueClock struct {
+	lastDequeue atomic.Int64 // when the consumer last took an element
+	lastAge     atomic.Int64 // how long that element had been queued, in nanoseconds
+}
+
+func (clock *queueClock) reset() {
+	clock.lastDequeue.Store(queueNow())
+	clock.lastAge.Store(0)
+}
+
+// dequeued records that the consumer took an element queued at queuedAt.
+func (clock *queueClock) dequeued(queuedAt int64) {
+	now := queueNow()
+	clock.lastDequeue.Store(now)
+	clock.lastAge.Store(now - queuedAt)
+}
+
+func (clock *queueClock) stat(length, capacity int) QueueStat {
+	stat := QueueStat{Len: length, Cap: capacity}
+	if length > 0 {
+		stat.OldestAge = time.Duration(clock.lastAge.Load() + queueNow() - clock.lastDequeue.Load())
+	}
+	return stat
+}
+
+func (q *outboundQueue) stat() QueueStat {
+	return q.clock.stat(len(q.c), cap(q.c))
+}
+
+func (q *inboundQueue) stat() QueueStat {
+	return q.clock.stat(len(q.c), cap(q.c))
+}
+
+func (q *handshakeQueue) stat() QueueStat {
+	return q.clock.stat(len(q.c), cap(q.c))
+}
+
+func (q *autodrainingOutboundQueue) stat() QueueStat {
+	return q.clock.stat(len(q.c), cap(q.c))
+}
+
+func (q *autodrainingInboundQueue) stat() QueueStat {
+	return q.clock.stat(len(q.c), cap(q.c))
+}
+
+// QueueStats returns the current occupancy of the device's queues, to help
+// triage a tunnel that stopped passing traffic.
+func (device *Device) QueueStats() QueueStats {
+	stats := QueueStats{
+		Encryption: device.queue.encryption.stat(),
+		Decryption: device.queue.decryption.stat(),
+		Handshake:  device.queue.handshake.stat(),
+		Peers:      make(map[NoisePublicKey]PeerQueueStats),
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for pk, peer := range device.peers.keyMap {
+		stats.Peers[pk] = peer.queueStats()
+	}
+	return stats
+}
+
+func (peer *Peer) queueStats() PeerQueueStats {
+	stats := PeerQueueStats{
+		Staged:        peer.queue.stagedClock.stat(len(peer.queue.staged), cap(peer.queue.staged)),
+		StagedPadding: peer.queue.stagedPaddingClock.stat(len(peer.queue.stagedPadding), cap(peer.queue.stagedPadding)),
+		Outbound:      peer.queue.outbound.stat(),
+		Inbound:       peer.queue.inbound.stat(),
+	}
+	if peer.daita != nil {
+		stats.DaitaEvents = peer.daita.EventQueue()
+	}
+	return stats
+}
+
+// ipcQueueStat serializes a non-empty queue for IpcGet.
+func ipcQueueStat(sendf func(string, ...any), name string, stat QueueStat) {
+	if stat.Len == 0 {
+		return
+	}
+	sendf("queue_%s=%d/%d", name, stat.Len, stat.Cap)
+	sendf("queue_%s_oldest_ms=%d", name, stat.OldestAge.Milliseconds())
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestQueueStatsStalledStaging(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, peerSk := NoisePrivateKey{8}, NoisePrivateKey{16}
+	pk := peerSk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+		"allowed_ip", "1.0.0.1/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an endpoint, no handshake can be sent and the packet stays
+	// staged.
+	tun.Outbound <- tuntest.Ping(netip.MustParseAddr("1.0.0.1"), netip.MustParseAddr("1.0.0.2"))
+	var staged QueueStat
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, peer := range dev.QueueStats().Peers {
+			staged = peer.Staged
+		}
+		if staged.Len == 1 {
+			break
+		}
+	}
+	if staged.Len != 1 || staged.Cap != QueueStagedSize {
+		t.Fatalf("expected one staged packet, got %+v", staged)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	for _, peer := range dev.QueueStats().Peers {
+		staged = peer.Staged
+	}
+	if staged.OldestAge < 50*time.Millisecond {
+		t.Errorf("expected the staged packet to be at least 50ms old, got %v", staged.OldestAge)
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "queue_staged=1/") || !strings.Contains(cfg, "queue_staged_oldest_ms=") {
+		t.Errorf("staged queue missing from IpcGet:\n%s", cfg)
+	}
+	if strings.Contains(cfg, "queue_encryption=") {
+		t.Errorf("empty queue reported in IpcGet:\n%s", cfg)
+	}
+}
@@ -7,6 +7,7 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"net"
@@ -24,6 +25,7 @@ type QueueHandshakeElement struct {
 	packet   []byte
 	endpoint conn.Endpoint
 	buffer   *[MaxMessageSize]byte
+	queuedAt int64 // see queueClock
 }
 
 type QueueInboundElement struct {
@@ -33,6 +35,18 @@ type QueueInboundElement struct {
 	counter  uint64
 	keypair  *Keypair
 	endpoint conn.Endpoint
+	queuedAt int64 // see queueClock
+}
+
+// receiveTime returns when the kernel received the packet that came from
+// endpoint, or the zero time if the bind did not report it.
+func receiveTime(endpoint conn.Endpoint) time.Time {
+	if endpoint, ok := endpoint.(conn.TimestampedEndpoint); ok {
+		if receivedAt, ok := endpoint.ReceiveTime(); ok {
+			return receivedAt
+		}
+	}
+	return time.Time{}
 }
 
 // clearPointers clears elem fields that contain pointers.
@@ -57,6 +71,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 	keypair := peer.keypairs.Current()
 	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
+		peer.countRekey(keypair, false)
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -67,7 +82,21 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * IPv4 and IPv6 (separately)
  */
 func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
-	recvName := recv.PrettyName()
+	device.routineReceiveIncoming(recv.PrettyName(), func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		size, endpoint, err := recv(bufs[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0], eps[0] = size, endpoint
+		return 1, nil
+	}, 1)
+}
+
+// routineReceiveIncoming is RoutineReceiveIncoming for a receive function
+// filling up to batchSize packets per call.
+func (device *Device) routineReceiveIncoming(recvName string, recv conn.BatchReceiveFunc, batchSize int) {
+	device.goroutineEnter(GoroutineReceive)
+	defer device.goroutineExit(GoroutineReceive)
 	defer func() {
 		device.log.Verbosef("Routine: receive incoming %s - stopped", recvName)
 		device.queue.decryption.wg.Done()
@@ -79,20 +108,29 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 
 	// receive datagrams until conn is closed
 
-	buffer := device.GetMessageBuffer()
+	buffers := make([]*[MaxMessageSize]byte, batchSize)
+	bufs := make([][]byte, batchSize)
+	getBuffers := func() {
+		for i := range buffers {
+			buffers[i] = device.GetMessageBuffer()
+			bufs[i] = buffers[i][:]
+		}
+	}
+	getBuffers()
 
 	var (
-		err         error
-		size        int
-		endpoint    conn.Endpoint
+		sizes       = make([]int, batchSize)
+		endpoints   = make([]conn.Endpoint, batchSize)
 		deathSpiral int
 	)
 
 	for {
-		size, endpoint, err = recv(buffer[:])
+		count, err := recv(bufs, sizes, endpoints)
 
 		if err != nil {
-			device.PutMessageBuffer(buffer)
+			for _, buffer := range buffers {
+				device.PutMessageBuffer(buffer)
+			}
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
@@ -103,111 +141,129 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			if deathSpiral < 10 {
 				deathSpiral++
 				time.Sleep(time.Second / 3)
-				buffer = device.GetMessageBuffer()
+				getBuffers()
 				continue
 			}
 			return
 		}
 		deathSpiral = 0
 
-		if size < MinMessageSize {
-			continue
+		for i := 0; i < count; i++ {
+			if device.receivePacket(buffers[i], sizes[i], endpoints[i]) {
+				buffers[i] = device.GetMessageBuffer()
+				bufs[i] = buffers[i][:]
+			}
+			endpoints[i] = nil
 		}
+	}
+}
 
-		// check size of packet
+// receivePacket queues a datagram received from endpoint for decryption or
+// handshake processing, and reports whether its buffer was handed over.
+func (device *Device) receivePacket(buffer *[MaxMessageSize]byte, size int, endpoint conn.Endpoint) bool {
+	if size < MinMessageSize {
+		return false
+	}
 
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+	// check size of packet
 
-		var okay bool
+	packet := buffer[:size]
+	msgType := binary.LittleEndian.Uint32(packet[:4])
 
-		switch msgType {
+	var okay bool
 
-		// check if transport
+	switch msgType {
 
-		case MessageTransportType:
+	// check if transport
 
-			// check size
+	case MessageTransportType:
 
-			if len(packet) < MessageTransportSize {
-				continue
-			}
+		// check size
+
+		if len(packet) < MessageTransportSize {
+			return false
+		}
 
-			// lookup key pair
+		// lookup key pair
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+		receiver := binary.LittleEndian.Uint32(
+			packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+		)
+		value := device.indexTable.Lookup(receiver)
+		keypair := value.keypair
+		if keypair == nil {
+			return false
+		}
 
-			// check keypair expiry
+		// check keypair expiry
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+		if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+			return false
+		}
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-			if peer.isRunning.Load() {
-				peer.queue.inbound.c <- elem
-				device.queue.decryption.c <- elem
-				buffer = device.GetMessageBuffer()
-			} else {
-				device.PutInboundElement(elem)
-			}
-			continue
+		// create work element
+		peer := value.peer
+		elem := device.GetInboundElement()
+		elem.packet = packet
+		elem.buffer = buffer
+		elem.keypair = keypair
+		elem.endpoint = endpoint
+		elem.counter = 0
+		elem.queuedAt = queueNow()
+		elem.Mutex = sync.Mutex{}
+		elem.Lock()
 
-		// otherwise it is a fixed size & handshake related packet
+		// add to decryption queues
+		if !peer.isRunning.Load() {
+			device.PutInboundElement(elem)
+			return false
+		}
+		peer.queue.inbound.c <- elem
+		device.queue.decryption.c <- elem
+		return true
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+	// otherwise it is a fixed size & handshake related packet
 
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+	case MessageInitiationType:
+		okay = len(packet) == MessageInitiationSize
 
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	case MessageResponseType:
+		okay = len(packet) == MessageResponseSize
 
-		default:
-			device.log.Verbosef("Received message with unknown type")
-		}
+	case MessageCookieReplyType:
+		okay = len(packet) == MessageCookieReplySize
 
-		if okay {
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
-				msgType:  msgType,
-				buffer:   buffer,
-				packet:   packet,
-				endpoint: endpoint,
-			}:
-				buffer = device.GetMessageBuffer()
-			default:
-			}
+	default:
+		device.log.Verbosef("Received message with unknown type")
+	}
+
+	if okay {
+		select {
+		case device.queue.handshake.c <- QueueHandshakeElement{
+			msgType:  msgType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+			queuedAt: queueNow(),
+		}:
+			return true
+		default:
 		}
 	}
+	return false
 }
 
 func (device *Device) RoutineDecryption(id int) {
 	var nonce [chacha20poly1305.NonceSize]byte
 
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	defer device.log.Verbosef("Routine: decryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: decryption worker %d - started", id)
 
 	for elem := range device.queue.decryption.c {
+		device.queue.decryption.clock.dequeued(elem.queuedAt)
+
 		// split message into fields
 		counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
 		content := elem.packet[MessageTransportOffsetContent:]
@@ -233,6 +289,8 @@ func (device *Device) RoutineDecryption(id int) {
 /* Handles incoming packets related to handshake
  */
 func (device *Device) RoutineHandshake(id int) {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	defer func() {
 		device.log.Verbosef("Routine: handshake worker %d - stopped", id)
 		device.queue.encryption.wg.Done()
@@ -240,6 +298,7 @@ func (device *Device) RoutineHandshake(id int) {
 	device.log.Verbosef("Routine: handshake worker %d - started", id)
 
 	for elem := range device.queue.handshake.c {
+		device.queue.handshake.clock.dequeued(elem.queuedAt)
 
 		// handle cookie fields and ratelimiting
 
@@ -271,6 +330,9 @@ func (device *Device) RoutineHandshake(id int) {
 				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
 					device.log.Verbosef("Could not decrypt invalid cookie response")
+					peer.recordError(PeerErrorCookieRequired, "invalid cookie reply")
+				} else {
+					peer.recordError(PeerErrorCookieRequired, "peer under load")
 				}
 			}
 
@@ -282,6 +344,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
 				device.log.Verbosef("Received packet with invalid mac1")
+				device.recordHandshakeFailure(HandshakeFailureMAC, nil, elem.endpoint, nil)
 				goto skip
 			}
 
@@ -289,9 +352,10 @@ func (device *Device) RoutineHandshake(id int) {
 
 			if device.IsUnderLoad() {
 
-				// verify MAC2 field
+				// verify MAC2 field, unless in stealth mode, where no cookie
+				// is handed out and only the ratelimiter applies
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) && !device.net.stealth.Load() {
 					device.SendHandshakeCookie(&elem)
 					goto skip
 				}
@@ -325,9 +389,10 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
-			if peer == nil {
+			peer, failure, ok := device.consumeMessageInitiation(&msg)
+			if !ok {
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.recordHandshakeFailure(failure, peer, elem.endpoint, nil)
 				goto skip
 			}
 
@@ -337,10 +402,12 @@ func (device *Device) RoutineHandshake(id int) {
 			peer.timersAnyAuthenticatedPacketReceived()
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.setEndpointFromHandshake(elem.endpoint)
 
 			device.log.Verbosef("%v - Received handshake initiation", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			peer.tracePacket(false, elem.msgType, len(elem.packet), elem.queuedAt)
+			peer.autoKeepaliveInitiationReceived()
 
 			peer.SendHandshakeResponse()
 
@@ -358,17 +425,21 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// consume response
 
-			peer := device.ConsumeMessageResponse(&msg)
-			if peer == nil {
+			peer, failure, ok := device.consumeMessageResponse(&msg)
+			if !ok {
 				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+				device.recordHandshakeFailure(failure, peer, elem.endpoint, nil)
 				goto skip
 			}
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.setEndpointFromHandshake(elem.endpoint)
 
 			device.log.Verbosef("%v - Received handshake response", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			peer.tracePacket(false, elem.msgType, len(elem.packet), elem.queuedAt)
+			peer.rttResponseReceived(elem.queuedAt)
+			peer.autoKeepaliveResponseReceived()
 
 			// update timers
 
@@ -393,31 +464,59 @@ func (device *Device) RoutineHandshake(id int) {
 	}
 }
 
-func (peer *Peer) RoutineSequentialReceiver() {
+// dropNonIPPacket logs the first bytes of a decrypted packet that was dropped for
+// not being a valid IPv4 or IPv6 packet, if sampling is enabled.
+func (peer *Peer) dropNonIPPacket(packet []byte) {
+	dropped := peer.rxDroppedNonIP.Load() + peer.rxDroppedDaitaMarker.Load()
+	if rate := peer.device.debug.nonIPSampleRate.Load(); rate != 0 && (dropped-1)%uint64(rate) == 0 {
+		peer.device.log.Verbosef("%v - Dropped non-IP packet (%d dropped in total): % x", peer, dropped, packet[:min(len(packet), nonIPSampleBytes)])
+	}
+}
+
+// dropMalformedPadding counts a received DAITA padding packet whose header is
+// truncated or has a length that the packet does not fit, logging the first.
+func (peer *Peer) dropMalformedPadding(packet []byte) {
+	if peer.rxDaitaMalformed.Add(1) == 1 {
+		peer.device.log.Verbosef("%v - Dropped DAITA padding with a malformed header: % x", peer, packet[:min(len(packet), int(DaitaHeaderLen))])
+	}
+}
+
+// RoutineSequentialReceiver writes the decrypted packets of the peer to the
+// TUN device in order, until ctx is cancelled.
+func (peer *Peer) RoutineSequentialReceiver(ctx context.Context) {
 	device := peer.device
 	defer func() {
 		device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
+		peer.goroutineExit(GoroutinePeer)
 		peer.stopping.Done()
 	}()
 	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
 
-	for elem := range peer.queue.inbound.c {
-		if elem == nil {
+	for {
+		var elem *QueueInboundElement
+		select {
+		case <-ctx.Done():
 			return
+		case elem = <-peer.queue.inbound.c:
 		}
+		peer.queue.inbound.clock.dequeued(elem.queuedAt)
 		var err error
 		elem.Lock()
 		if elem.packet == nil {
 			// decryption failed
+			peer.recordError(PeerErrorDecrypt, "transport packet failed authentication")
 			goto skip
 		}
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			peer.rxDuplicates.Add(1)
 			goto skip
 		}
 
 		peer.SetEndpointFromPacket(elem.endpoint)
+		peer.recordIPHeader(elem.endpoint)
 		if peer.ReceivedWithKeypair(elem.keypair) {
+			peer.rttKeyConfirmed(elem.queuedAt)
 			peer.timersHandshakeComplete()
 			peer.SendStagedPackets()
 		}
@@ -426,35 +525,76 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketReceived()
 		peer.rxBytes.Add(uint64(len(elem.packet) + MinMessageSize))
+		peer.tracePacket(false, MessageTransportType, len(elem.packet)+MinMessageSize, elem.queuedAt)
 
 		if len(elem.packet) == 0 {
 			device.log.Verbosef("%v - Receiving keepalive packet", peer)
 			goto skip
 		}
+		peer.rttDataReceived(elem.queuedAt)
 		peer.timersDataReceived()
 
+		if elem.packet[0] == GoodbyeMarker && peer.goodbye.Load() {
+			peer.receivedGoodbye()
+			goto skip
+		}
+
+		if elem.packet[0] == FeaturesMarker && peer.features.announce.Load() {
+			peer.receivedFeatures(elem.packet)
+			goto skip
+		}
+
 		// Check if packet is a DAITA padding packet
 		if elem.packet[0] == DaitaPaddingMarker && peer.daita != nil {
 			if len(elem.packet) < int(DaitaHeaderLen) {
+				peer.dropMalformedPadding(elem.packet)
 				goto skip
 			}
 			field := elem.packet[DaitaOffsetTotalLength : DaitaOffsetTotalLength+2]
 			paddingPacketLen := binary.BigEndian.Uint16(field)
 
-			if len(elem.packet) < int(paddingPacketLen) {
+			if paddingPacketLen < DaitaHeaderLen || len(elem.packet) < int(paddingPacketLen) {
+				peer.dropMalformedPadding(elem.packet)
 				goto skip
 			}
+			peer.rxDaitaPadding.Add(1)
+			peer.rxDaitaPaddingBytes.Add(uint64(paddingPacketLen))
+			if callback := device.options.daitaPaddingReceived; callback != nil {
+				callback(peer, uint(paddingPacketLen))
+			}
 
 			// NOTE: Daita padding packets can have EXTRA padding when constant packet size is
 			// enabled. In either case, paddingPacketLen will be equal to the original size of the
 			// DAITA padding packet.
-			peer.daita.PaddingReceived(peer, uint(paddingPacketLen))
+			peer.daita.PaddingReceived(peer, uint(paddingPacketLen), receiveTime(elem.endpoint))
+			goto skip
+		}
+
+		if elem.packet[0] == CompressionMarker {
+			if len(elem.packet) >= CompressionHeaderLen && elem.packet[1] == compressionTypeOffer {
+				peer.receivedCompressionOffer(elem.keypair, elem.packet)
+				goto skip
+			}
+			compression := elem.keypair.compression.Load()
+			if compression == nil || !peer.decompressPacket(elem, compression) {
+				peer.rxDroppedNonIP.Add(1)
+				peer.dropNonIPPacket(elem.packet)
+				goto skip
+			}
+		}
+
+		if elem.packet[0] == DaitaPaddingMarker {
+			// DAITA padding for a peer that has not enabled DAITA.
+			peer.rxDroppedDaitaMarker.Add(1)
+			peer.dropNonIPPacket(elem.packet)
 			goto skip
 		}
 
 		switch elem.packet[0] >> 4 {
 		case ipv4.Version:
 			if len(elem.packet) < ipv4.HeaderLen {
+				peer.rxDroppedNonIP.Add(1)
+				peer.dropNonIPPacket(elem.packet)
 				goto skip
 			}
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
@@ -470,11 +610,13 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			}
 
 			if peer.daita != nil {
-				peer.daita.NonpaddingReceived(peer, uint(totalLength))
+				peer.daita.NonpaddingReceived(peer, uint(totalLength), receiveTime(elem.endpoint))
 			}
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
+				peer.rxDroppedNonIP.Add(1)
+				peer.dropNonIPPacket(elem.packet)
 				goto skip
 			}
 			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
@@ -491,20 +633,34 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			}
 
 			if peer.daita != nil {
-				peer.daita.NonpaddingReceived(peer, uint(totalLength))
+				peer.daita.NonpaddingReceived(peer, uint(totalLength), receiveTime(elem.endpoint))
 			}
 
 		default:
 			device.log.Verbosef("Packet with invalid IP version from %v", peer)
+			peer.rxDroppedNonIP.Add(1)
+			peer.dropNonIPPacket(elem.packet)
 			goto skip
 		}
 
-		_, err = device.tun.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
-		if err != nil && !device.isClosed() {
-			device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		if device.probes.pending.Load() != 0 && device.probes.complete(elem.packet) {
+			goto skip
 		}
+
+		if peer.dedup.duplicate(elem.packet) || peer.dropReceive() {
+			goto skip
+		}
+
+		if egress := device.relay.lookup(peer, elem.packet); egress != nil {
+			if !peer.relayPacket(egress, elem.packet) {
+				device.log.Verbosef("%v - Dropped packet to relay to stopped %v", peer, egress)
+			}
+			goto skip
+		}
+
+		device.writeToTUN(ctx, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
 		if len(peer.queue.inbound.c) == 0 {
-			err = device.tun.device.Flush()
+			err = device.flushTUN()
 			if err != nil {
 				peer.device.log.Errorf("Unable to flush packets: %v", err)
 			}
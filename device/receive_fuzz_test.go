@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// fuzzMaxHeap bounds the heap of the fuzzed device. The pools and queues are
+// bounded, so anything close to it means packets are being retained.
+const fuzzMaxHeap = 512 << 20
+
+// sealTransport encrypts content as the next transport message from peer,
+// with its current keypair, as if it had gone through RoutineEncryption.
+// Like the send path, it rekeys when the keypair gets old, so that long fuzzing
+// runs outlive RejectAfterTime.
+func sealTransport(tb testing.TB, peer *Peer, content []byte) []byte {
+	peer.keepKeyFreshSending()
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		tb.Fatal("no current keypair")
+	}
+	counter := keypair.sendNonce.Add(1) - 1
+
+	packet := make([]byte, MessageTransportHeaderSize, MessageTransportHeaderSize+len(content)+chacha20poly1305.Overhead)
+	binary.LittleEndian.PutUint32(packet[0:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(packet[4:8], keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(packet[8:16], counter)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return keypair.send.Seal(packet, nonce[:], content, nil)
+}
+
+// FuzzReceive feeds arbitrary datagrams to a device with an established
+// session. If sealed is set, data is encrypted with the session first, so that
+// it reaches the parsing after decryption, including DAITA padding headers.
+func FuzzReceive(f *testing.F) {
+	ping := tuntest.Ping(netip.AddrFrom4([4]byte{1, 0, 0, 1}), netip.AddrFrom4([4]byte{1, 0, 0, 2}))
+	daitaPadding := make([]byte, 64)
+	daitaPadding[0] = DaitaPaddingMarker
+	binary.BigEndian.PutUint16(daitaPadding[DaitaOffsetTotalLength:], uint16(len(daitaPadding)))
+	daitaOverlong := bytes.Clone(daitaPadding)
+	binary.BigEndian.PutUint16(daitaOverlong[DaitaOffsetTotalLength:], 0xffff)
+	junkTransport := make([]byte, MessageTransportSize+16)
+	junkTransport[0] = byte(MessageTransportType)
+	junkInitiation := make([]byte, MessageInitiationSize)
+	junkInitiation[0] = byte(MessageInitiationType)
+
+	f.Add(true, []byte{})
+	f.Add(true, ping)
+	f.Add(true, ping[:10])
+	f.Add(true, daitaPadding)
+	f.Add(true, daitaPadding[:3])
+	f.Add(true, daitaOverlong)
+	f.Add(true, []byte{0x45})
+	f.Add(true, []byte{0x60, 0, 0, 0})
+	f.Add(false, []byte{})
+	f.Add(false, junkTransport)
+	f.Add(false, junkInitiation)
+	f.Add(false, junkInitiation[:MessageCookieReplySize])
+
+	pair := genTestPair(f, false)
+	for i := range pair {
+		pair[i].dev.SetLogLevel(LogLevelSilent)
+	}
+	pair.Send(f, Ping, nil)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	sentinel := tuntest.Ping(pair[0].ip, pair[1].ip)
+
+	var inputs int
+	f.Fuzz(func(t *testing.T, sealed bool, data []byte) {
+		if sealed {
+			if len(data) > MaxContentSize {
+				t.Skip()
+			}
+			data = sealTransport(t, peer, data)
+		}
+		if err := peer.SendBuffer(data); err != nil {
+			t.Fatal(err)
+		}
+
+		// Transport messages are written to the TUN device in order, so once
+		// the sentinel is, the input was fully processed.
+		if err := peer.SendBuffer(sealTransport(t, peer, sentinel)); err != nil {
+			t.Fatal(err)
+		}
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case packet := <-pair[0].tun.Inbound:
+				if !bytes.Equal(packet, sentinel) {
+					continue
+				}
+			case <-timeout:
+				t.Fatal("sentinel was not received")
+			}
+			break
+		}
+
+		if inputs++; inputs%256 == 0 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > fuzzMaxHeap {
+				t.Fatalf("heap grew to %d bytes", stats.HeapAlloc)
+			}
+		}
+	})
+}
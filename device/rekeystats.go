@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// NonceWarningThreshold is the send counter past which a session is reported
+// as approaching nonce exhaustion: it leaves room for as many messages as are
+// sent before the first rekey attempt. It is only reached when rekeying keeps
+// failing at a sustained high packet rate, and the session then stops hard at
+// RejectAfterMessages.
+const NonceWarningThreshold = RejectAfterMessages - RekeyAfterMessages
+
+// rekeyStats counts the rekeys and hard session stops of a peer caused by the
+// limits of the protocol. Each session is counted at most once per counter.
+type rekeyStats struct {
+	messageLimit  atomic.Uint64 // rekeys after RekeyAfterMessages
+	timeLimit     atomic.Uint64 // rekeys after RekeyAfterTime, when sending or receiving
+	rejectMessage atomic.Uint64 // sessions stopped at RejectAfterMessages
+	rejectTime    atomic.Uint64 // sessions expired at RejectAfterTime with packets waiting
+	nonceWarnings atomic.Uint64 // sessions that passed NonceWarningThreshold
+}
+
+// keypairLimits records which limits of a session have already been counted.
+type keypairLimits struct {
+	rekeyed     atomic.Bool
+	rejected    atomic.Bool
+	nonceWarned atomic.Bool
+}
+
+// countRekey counts a rekey of keypair due to the message or time limit.
+func (peer *Peer) countRekey(keypair *Keypair, messageLimit bool) {
+	if !keypair.limits.rekeyed.CompareAndSwap(false, true) {
+		return
+	}
+	if messageLimit {
+		peer.rekeys.messageLimit.Add(1)
+	} else {
+		peer.rekeys.timeLimit.Add(1)
+	}
+}
+
+// countReject counts a session that can no longer be used to send, because
+// it reached the message or time limit. Reaching the message limit means that
+// rekeying failed for a long time, so it is also logged and notified.
+func (peer *Peer) countReject(keypair *Keypair, messageLimit bool) {
+	if !keypair.limits.rejected.CompareAndSwap(false, true) {
+		return
+	}
+	if !messageLimit {
+		peer.rekeys.rejectTime.Add(1)
+		return
+	}
+	peer.rekeys.rejectMessage.Add(1)
+	peer.device.log.Errorf("%v - Session stopped after exhausting its nonces", peer)
+	peer.device.notify(NotificationSessionExhausted, peer, "session stopped after exhausting its nonces")
+}
+
+// checkNonce warns, once per session, when the send counter of keypair
+// passes NonceWarningThreshold.
+func (peer *Peer) checkNonce(keypair *Keypair, nonce uint64) {
+	if nonce < NonceWarningThreshold || nonce >= RejectAfterMessages || !keypair.limits.nonceWarned.CompareAndSwap(false, true) {
+		return
+	}
+	peer.rekeys.nonceWarnings.Add(1)
+	left := RejectAfterMessages - nonce
+	peer.device.log.Errorf("%v - Session approaching nonce exhaustion, %d messages left", peer, left)
+	peer.device.notify(NotificationNonceWarning, peer, fmt.Sprintf("session approaching nonce exhaustion, %d messages left", left))
+}
+
+func ipcRekeyStats(sendf func(string, ...any), stats *rekeyStats) {
+	for _, counter := range []struct {
+		key   string
+		value *atomic.Uint64
+	}{
+		{"rekey_message_limit", &stats.messageLimit},
+		{"rekey_time_limit", &stats.timeLimit},
+		{"reject_message_limit", &stats.rejectMessage},
+		{"reject_time_limit", &stats.rejectTime},
+		{"nonce_warnings", &stats.nonceWarnings},
+	} {
+		if value := counter.value.Load(); value != 0 {
+			sendf("%s=%d", counter.key, value)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRekeyStats(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	notifications := make(chan NotificationKind, 8)
+	defer dev.Subscribe(func(n Notification) {
+		notifications <- n.Kind
+	})()
+
+	// Allow an immediate handshake, instead of waiting for RekeyTimeout. The
+	// wait keeps the responder from rejecting the initiation as a replay or
+	// flood, as timestamps are coarse.
+	allowHandshake := func() {
+		time.Sleep(50 * time.Millisecond)
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Time{}
+		peer.handshake.mutex.Unlock()
+	}
+	awaitRekey := func(old *Keypair) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for peer.keypairs.Current() == old {
+			if time.Now().After(deadline) {
+				t.Fatal("session was not rekeyed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	expectNotification := func(kind NotificationKind) {
+		t.Helper()
+		select {
+		case got := <-notifications:
+			if got != kind {
+				t.Fatalf("expected notification %v, got %v", kind, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected notification %v", kind)
+		}
+	}
+
+	// Passing the warning threshold also triggers a rekey.
+	keypair := peer.keypairs.Current()
+	allowHandshake()
+	keypair.sendNonce.Store(NonceWarningThreshold)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+	expectNotification(NotificationNonceWarning)
+	awaitRekey(keypair)
+
+	keypair = peer.keypairs.Current()
+	allowHandshake()
+	keypair.sendNonce.Store(RejectAfterMessages)
+	pair.Send(t, Ping, nil)
+	expectNotification(NotificationSessionExhausted)
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"rekey_message_limit=1\n", "reject_message_limit=1\n", "nonce_warnings=1\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+	if strings.Contains(cfg, "reject_time_limit=") {
+		t.Errorf("unexpected time limit rejection:\n%s", cfg)
+	}
+}
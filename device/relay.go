@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A RelayRoute forwards the packets received from the Ingress peer whose
+// destination is within Prefix to the Egress peer, re-encrypting them
+// without writing them to the TUN device, as a hub relaying between peers
+// does. The packets must still come from the allowed IPs of the ingress
+// peer, and the egress peer checks that they come from the allowed IPs it has
+// for this device.
+type RelayRoute struct {
+	Ingress NoisePublicKey
+	Prefix  netip.Prefix
+	Egress  NoisePublicKey
+}
+
+// relayTable holds the relay routes of a device. It is replaced as a whole on
+// every change, so that the receive path looks routes up without locking.
+type relayTable struct {
+	sync.Mutex // serializes changes, taken after the peers lock
+	routes     atomic.Pointer[map[*Peer][]relayEntry]
+}
+
+// relayEntry is a route of an ingress peer. The routes of a peer are sorted
+// by decreasing prefix length, so that the first match is the longest.
+type relayEntry struct {
+	prefix netip.Prefix
+	egress *Peer
+}
+
+// update replaces the routes with a copy changed by change.
+func (table *relayTable) update(change func(routes map[*Peer][]relayEntry)) {
+	table.Lock()
+	defer table.Unlock()
+	routes := make(map[*Peer][]relayEntry)
+	if old := table.routes.Load(); old != nil {
+		for ingress, entries := range *old {
+			routes[ingress] = append([]relayEntry(nil), entries...)
+		}
+	}
+	change(routes)
+	for ingress, entries := range routes {
+		if len(entries) == 0 {
+			delete(routes, ingress)
+		}
+	}
+	if len(routes) == 0 {
+		table.routes.Store(nil)
+		return
+	}
+	table.routes.Store(&routes)
+}
+
+// lookup returns the peer to relay packet, received from ingress, to, or nil
+// if it is for the TUN device.
+func (table *relayTable) lookup(ingress *Peer, packet []byte) *Peer {
+	routes := table.routes.Load()
+	if routes == nil {
+		return nil
+	}
+	entries := (*routes)[ingress]
+	if len(entries) == 0 {
+		return nil
+	}
+	var dst netip.Addr
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		dst = netip.AddrFrom4([4]byte(packet[IPv4offsetDst : IPv4offsetDst+4]))
+	case ipv6.Version:
+		dst = netip.AddrFrom16([16]byte(packet[IPv6offsetDst : IPv6offsetDst+16]))
+	default:
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.prefix.Contains(dst) {
+			return entry.egress
+		}
+	}
+	return nil
+}
+
+// removePeer removes the routes from and to peer, which is being removed.
+func (table *relayTable) removePeer(peer *Peer) {
+	if table.routes.Load() == nil {
+		return
+	}
+	table.update(func(routes map[*Peer][]relayEntry) {
+		delete(routes, peer)
+		for ingress, entries := range routes {
+			kept := entries[:0]
+			for _, entry := range entries {
+				if entry.egress != peer {
+					kept = append(kept, entry)
+				}
+			}
+			routes[ingress] = kept
+		}
+	})
+}
+
+// AddRelayRoute adds route, replacing the route of its ingress peer for the
+// same prefix, if any. Both peers must exist and differ, and the routes are
+// removed along with either of them.
+func (device *Device) AddRelayRoute(route RelayRoute) error {
+	if !route.Prefix.IsValid() {
+		return errors.New("invalid relay prefix")
+	}
+	if route.Ingress == route.Egress {
+		return errors.New("cannot relay packets back to their ingress peer")
+	}
+	prefix := route.Prefix.Masked()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	ingress, egress := device.peers.keyMap[route.Ingress], device.peers.keyMap[route.Egress]
+	if ingress == nil || egress == nil {
+		return errors.New("unknown relay peer")
+	}
+	device.relay.update(func(routes map[*Peer][]relayEntry) {
+		entries := routes[ingress]
+		for i := range entries {
+			if entries[i].prefix == prefix {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		entries = append(entries, relayEntry{prefix: prefix, egress: egress})
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].prefix.Bits() > entries[j].prefix.Bits()
+		})
+		routes[ingress] = entries
+	})
+	device.log.Verbosef("%v - Relaying packets to %v to %v", ingress, prefix, egress)
+	return nil
+}
+
+// RemoveRelayRoute removes the route of the ingress peer for prefix, and
+// reports whether there was one.
+func (device *Device) RemoveRelayRoute(ingress NoisePublicKey, prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	peer := device.peers.keyMap[ingress]
+	if peer == nil {
+		return false
+	}
+	removed := false
+	device.relay.update(func(routes map[*Peer][]relayEntry) {
+		entries := routes[peer]
+		for i := range entries {
+			if entries[i].prefix == prefix {
+				routes[peer] = append(entries[:i], entries[i+1:]...)
+				removed = true
+				return
+			}
+		}
+	})
+	return removed
+}
+
+// RelayRoutes returns the relay routes of the device, those of each ingress
+// peer from the longest prefix to the shortest.
+func (device *Device) RelayRoutes() []RelayRoute {
+	routes := device.relay.routes.Load()
+	if routes == nil {
+		return nil
+	}
+	var list []RelayRoute
+	for ingress, entries := range *routes {
+		for _, entry := range entries {
+			list = append(list, RelayRoute{
+				Ingress: ingress.handshake.remoteStatic,
+				Prefix:  entry.prefix,
+				Egress:  entry.egress.handshake.remoteStatic,
+			})
+		}
+	}
+	return list
+}
+
+// relayPacket forwards packet, received from peer, to egress, and reports
+// whether it could.
+func (peer *Peer) relayPacket(egress *Peer, packet []byte) bool {
+	if !egress.isRunning.Load() || egress.dropSend() {
+		return false
+	}
+	egress.stagePacketCopy(packet)
+	peer.rxRelayed.Add(1)
+	return true
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestRelayRoute(t *testing.T) {
+	pair := genTestPair(t, false)
+	hub := pair[0].dev
+	ingress := pair[1].dev.staticIdentity.publicKey
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	egressKey := sk.publicKey()
+	egress, err := hub.NewPeer(egressKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.Start()
+
+	prefix := netip.PrefixFrom(pair[0].ip, pair[0].ip.BitLen())
+	for _, route := range []RelayRoute{
+		{Ingress: ingress, Egress: egressKey},
+		{Ingress: ingress, Prefix: prefix, Egress: ingress},
+		{Ingress: NoisePublicKey{1}, Prefix: prefix, Egress: egressKey},
+	} {
+		if hub.AddRelayRoute(route) == nil {
+			t.Errorf("added invalid relay route %+v", route)
+		}
+	}
+	route := RelayRoute{Ingress: ingress, Prefix: prefix, Egress: egressKey}
+	if err := hub.AddRelayRoute(route); err != nil {
+		t.Fatal(err)
+	}
+	if routes := hub.RelayRoutes(); len(routes) != 1 || routes[0] != route {
+		t.Fatalf("got relay routes %+v, want %+v", routes, route)
+	}
+
+	// Packets from the ingress peer to the prefix are staged for the egress
+	// peer, which has no session, instead of being written to the TUN device.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	peer := hub.LookupPeer(ingress)
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.rxRelayed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet was not relayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if staged := len(egress.queue.staged); staged != 1 {
+		t.Errorf("%d packets staged for the egress peer, want 1", staged)
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Error("relayed packet was written to the TUN device")
+	default:
+	}
+
+	if !hub.RemoveRelayRoute(ingress, prefix) || hub.RemoveRelayRoute(ingress, prefix) {
+		t.Error("relay route was not removed exactly once")
+	}
+	pair.Send(t, Ping, nil)
+
+	// Removing a peer removes its routes.
+	if err := hub.AddRelayRoute(route); err != nil {
+		t.Fatal(err)
+	}
+	hub.RemovePeer(egressKey)
+	if routes := hub.RelayRoutes(); len(routes) != 0 {
+		t.Errorf("routes to a removed peer remain: %+v", routes)
+	}
+}
@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A device resuming from a long suspend of the system, such as a laptop waking
+// up, is left with stale state: sessions that its peers have likely expired,
+// handshake and keepalive timers firing late, and packets queued before the
+// suspend. Rather than spending the first minutes after waking on retries,
+// the device resets all of it at once when it resumes. A suspend is detected
+// by the wall clock having run ahead of the monotonic clock, which stops while
+// the system is suspended, by more than SuspendThreshold between checks made
+// every SuspendCheckInterval while the device is up. Platforms that are told
+// of resumes may call NotifyResume instead of waiting for the next check.
+type suspendWatch struct {
+	sync.Mutex
+	timer *time.Timer // of the next check, nil while the device is down
+	last  time.Time   // of the last check, with a monotonic reading
+}
+
+// wallLead returns how far the wall clock ran ahead of the monotonic clock
+// while the given monotonic and wall clock times elapsed, beyond
+// SuspendThreshold. It is zero if it did not.
+func wallLead(monotonic, wall time.Duration) time.Duration {
+	if lead := wall - monotonic; lead > SuspendThreshold {
+		return lead
+	}
+	return 0
+}
+
+// startSuspendWatch starts checking for suspends, as the device comes up.
+func (device *Device) startSuspendWatch() {
+	w := &device.suspend
+	w.Lock()
+	defer w.Unlock()
+	w.last = time.Now()
+	if w.timer == nil {
+		w.timer = time.AfterFunc(SuspendCheckInterval, device.checkSuspend)
+	}
+}
+
+// stopSuspendWatch stops checking for suspends, as the device goes down.
+func (device *Device) stopSuspendWatch() {
+	w := &device.suspend
+	w.Lock()
+	defer w.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (device *Device) checkSuspend() {
+	w := &device.suspend
+	w.Lock()
+	if w.timer == nil {
+		w.Unlock()
+		return
+	}
+	now := time.Now()
+	lead := wallLead(now.Sub(w.last), now.Round(0).Sub(w.last.Round(0)))
+	w.last = now
+	w.timer.Reset(SuspendCheckInterval)
+	w.Unlock()
+
+	if lead != 0 {
+		device.resume(fmt.Sprintf("resumed from a suspend of about %v", lead.Round(time.Second)))
+	}
+}
+
+// NotifyResume tells the device that the system resumed from a suspend, so
+// that it resets the timers of its peers, drops the packets queued for them,
+// and starts new handshakes with those it had a session or was handshaking
+// with. It does nothing while the device is down.
+func (device *Device) NotifyResume() {
+	device.resume("resume notified")
+}
+
+func (device *Device) resume(reason string) {
+	device.state.Lock()
+	defer device.state.Unlock()
+	if !device.isUp() {
+		return
+	}
+
+	// A notified resume is not detected again by the next check.
+	device.suspend.Lock()
+	device.suspend.last = time.Now()
+	device.suspend.Unlock()
+
+	device.log.Verbosef("Resetting peers: %s", reason)
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.resume()
+	}
+	device.peers.RUnlock()
+	device.notify(NotificationResumed, nil, reason)
+}
+
+// resume resets the state of the peer gone stale during a suspend.
+func (peer *Peer) resume() {
+	peer.state.Lock()
+	defer peer.state.Unlock()
+	if !peer.isRunning.Load() {
+		return
+	}
+
+	handshaking := peer.timers.retransmitHandshake.IsPending()
+	peer.timers.retransmitHandshake.Del()
+	peer.timers.sendKeepalive.Del()
+	peer.timers.newHandshake.Del()
+	peer.timersStart()
+	dropped := peer.FlushQueues()
+
+	peer.keypairs.RLock()
+	hadSession := peer.keypairs.current != nil
+	peer.keypairs.RUnlock()
+
+	peer.Lock()
+	if peer.endpoint != nil {
+		peer.endpoint.ClearSrc()
+	}
+	peer.Unlock()
+
+	peer.device.log.Verbosef("%v - Resetting after resume, dropping %d queued packets", peer, dropped)
+	if hadSession || handshaking {
+		peer.ExpireCurrentKeypairs()
+		peer.SendHandshakeInitiation(false)
+	}
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWallLead(t *testing.T) {
+	for _, tc := range []struct {
+		monotonic, wall, want time.Duration
+	}{
+		{time.Minute, time.Minute, 0},
+		{time.Minute, 0, 0}, // clock stepped back
+		{time.Minute, time.Minute + SuspendThreshold, 0},
+		{time.Minute, time.Hour, time.Hour - time.Minute},
+	} {
+		if got := wallLead(tc.monotonic, tc.wall); got != tc.want {
+			t.Errorf("wallLead(%v, %v) = %v, want %v", tc.monotonic, tc.wall, got, tc.want)
+		}
+	}
+}
+
+func TestNotifyResume(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+
+	resumed := make(chan Notification, 4)
+	defer dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationResumed {
+			resumed <- n
+		}
+	})()
+
+	peer.keypairs.RLock()
+	stale := peer.keypairs.current
+	peer.keypairs.RUnlock()
+
+	// Initiations with the timestamp of the last one, whose nanoseconds are
+	// rounded down to about 16ms, are dropped as replays.
+	time.Sleep(50 * time.Millisecond)
+	dev.NotifyResume()
+	select {
+	case n := <-resumed:
+		if n.Peer != (NoisePublicKey{}) {
+			t.Errorf("resume notified for peer %v", n.Peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resume not notified")
+	}
+
+	// The session is renewed without waiting for data to be sent.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		peer.keypairs.RLock()
+		current := peer.keypairs.current
+		peer.keypairs.RUnlock()
+		if current != stale && current != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake after resume")
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev.Down()
+	dev.NotifyResume()
+	select {
+	case <-resumed:
+		t.Error("resume notified while the device is down")
+	default:
+	}
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// peerRTT estimates the round-trip time to a peer without pinging it, from
+// exchanges whose second message implicitly acknowledges the first:
+//
+//   - a handshake initiation and its response,
+//   - a handshake response and the first transport packet confirming it,
+//   - a data packet sent after both directions were quiet for RTTIdleGap, and
+//     the next data packet received, such as a DNS query and its answer or a
+//     TCP SYN and its SYN-ACK.
+//
+// Samples include the time the peer took to answer, so the estimate is coarse
+// and errs on the high side. Times are those returned by queueNow.
+type peerRTT struct {
+	initiationSent atomic.Int64 // of the initiation awaiting a response, or 0
+	responseSent   atomic.Int64 // of the response awaiting confirmation, or 0
+	probeSent      atomic.Int64 // of the data packet awaiting a reply, or 0
+	lastData       atomic.Int64 // when data was last sent or received
+
+	smoothed atomic.Int64 // in nanoseconds, or 0 before the first sample
+	samples  atomic.Uint64
+}
+
+// sample ends the exchange started at the time stored in sent, if any, with
+// a message received at the given time.
+func (r *peerRTT) sample(sent *atomic.Int64, received int64) {
+	start := sent.Swap(0)
+	if start == 0 {
+		return
+	}
+	sample := received - start
+	if sample <= 0 || sample > int64(RTTMaxSample) {
+		return
+	}
+	for {
+		old := r.smoothed.Load()
+		smoothed := sample
+		if old != 0 {
+			smoothed = old - old/RTTSmoothing + sample/RTTSmoothing
+		}
+		if r.smoothed.CompareAndSwap(old, smoothed) {
+			break
+		}
+	}
+	r.samples.Add(1)
+}
+
+// estimate returns the smoothed round-trip time, or 0 before the first sample.
+func (r *peerRTT) estimate() time.Duration {
+	return time.Duration(r.smoothed.Load())
+}
+
+func (peer *Peer) rttInitiationSent() {
+	peer.rtt.initiationSent.Store(queueNow())
+}
+
+func (peer *Peer) rttResponseReceived(at int64) {
+	peer.rtt.sample(&peer.rtt.initiationSent, at)
+}
+
+func (peer *Peer) rttResponseSent() {
+	peer.rtt.responseSent.Store(queueNow())
+}
+
+// rttKeyConfirmed is called with the time the first transport packet with the
+// keypair of a handshake the peer answered was received.
+func (peer *Peer) rttKeyConfirmed(at int64) {
+	peer.rtt.sample(&peer.rtt.responseSent, at)
+}
+
+// rttDataSent is called when data packets were sent to the peer, at the given
+// time.
+func (peer *Peer) rttDataSent(at int64) {
+	r := &peer.rtt
+	if at-r.lastData.Swap(at) >= int64(RTTIdleGap) {
+		r.probeSent.Store(at)
+	}
+}
+
+// rttDataReceived is called when a data packet was received from the peer, at
+// the given time.
+func (peer *Peer) rttDataReceived(at int64) {
+	r := &peer.rtt
+	r.lastData.Store(at)
+	if r.probeSent.Load() != 0 {
+		r.sample(&r.probeSent, at)
+	}
+}
+
+// PeerRTT returns the estimated round-trip time to the peer with the given
+// public key, and false if there is no such peer or no estimate yet.
+func (device *Device) PeerRTT(pk NoisePublicKey) (time.Duration, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return 0, false
+	}
+	rtt := peer.rtt.estimate()
+	return rtt, rtt != 0
+}
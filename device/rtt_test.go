@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRTTSample(t *testing.T) {
+	var r peerRTT
+
+	// Without a pending exchange, there is nothing to sample.
+	r.sample(&r.initiationSent, int64(time.Second))
+	if rtt := r.estimate(); rtt != 0 {
+		t.Fatalf("expected no estimate, got %v", rtt)
+	}
+
+	r.initiationSent.Store(int64(time.Second))
+	r.sample(&r.initiationSent, int64(time.Second+80*time.Millisecond))
+	if rtt := r.estimate(); rtt != 80*time.Millisecond {
+		t.Fatalf("expected the first sample as estimate, got %v", rtt)
+	}
+	if r.initiationSent.Load() != 0 {
+		t.Fatal("expected the exchange to be over")
+	}
+
+	// Later samples are smoothed.
+	r.responseSent.Store(int64(2 * time.Second))
+	r.sample(&r.responseSent, int64(2*time.Second+160*time.Millisecond))
+	if rtt, want := r.estimate(), 80*time.Millisecond+80*time.Millisecond/RTTSmoothing; rtt != want {
+		t.Fatalf("expected estimate %v, got %v", want, rtt)
+	}
+
+	// Answers too late to be answers are ignored.
+	r.probeSent.Store(int64(3 * time.Second))
+	r.sample(&r.probeSent, int64(3*time.Second+RTTMaxSample+time.Millisecond))
+	if r.samples.Load() != 2 {
+		t.Fatalf("expected 2 samples, got %d", r.samples.Load())
+	}
+}
+
+func TestRTTDataProbe(t *testing.T) {
+	var peer Peer
+	r := &peer.rtt
+	start := int64(time.Hour)
+
+	// Data sent after a quiet period starts an exchange, which the next data
+	// received ends.
+	peer.rttDataSent(start)
+	peer.rttDataSent(start + int64(time.Millisecond))
+	peer.rttDataReceived(start + int64(30*time.Millisecond))
+	if rtt := r.estimate(); rtt != 30*time.Millisecond {
+		t.Fatalf("expected an estimate of 30ms, got %v", rtt)
+	}
+
+	// Data sent during ongoing traffic may answer an earlier packet, so it is
+	// not sampled.
+	peer.rttDataSent(start + int64(40*time.Millisecond))
+	peer.rttDataReceived(start + int64(41*time.Millisecond))
+	if r.samples.Load() != 1 {
+		t.Fatalf("expected 1 sample, got %d", r.samples.Load())
+	}
+}
+
+func TestRTTHandshake(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Device 1 initiated the handshake and device 0 answered it.
+	for i, dev := range []*Device{pair[0].dev, pair[1].dev} {
+		rtt, ok := dev.PeerRTT(pair[i^1].dev.staticIdentity.publicKey)
+		if !ok || rtt <= 0 || rtt > RTTMaxSample {
+			t.Errorf("device %d: expected an estimate, got %v", i, rtt)
+		}
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(cfg, "rtt_nsec=") {
+			t.Errorf("device %d: rtt_nsec missing from IpcGet:\n%s", i, cfg)
+		}
+	}
+	if _, ok := pair[0].dev.PeerRTT(NoisePublicKey{}); ok {
+		t.Error("expected no estimate for an unknown peer")
+	}
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync"
+
+// An OutboundScheduler decides when the transport packets sent to a peer are
+// released to encryption, and thereby when they are sent, so that defenses
+// against traffic analysis other than DAITA, such as FRONT or Tamaraw, can be
+// implemented outside of this package. It is set with WithOutboundScheduler;
+// without one, packets are released as soon as they are sent.
+//
+// Packets are sent to a peer in the order they were scheduled, so holding
+// back a packet holds back those scheduled after it.
+type OutboundScheduler interface {
+	// Schedule is called for each packet sent to peer, including keepalives
+	// and DAITA padding, once it has been assigned its nonce. The scheduler
+	// must call release once, from any goroutine, when the packet is to be
+	// encrypted and sent. Schedule must not block. Packets that have not been
+	// released when the peer is stopped are released then, after which
+	// calling release does nothing.
+	Schedule(peer *Peer, packet OutboundPacket, release func())
+}
+
+// An OutboundPacket describes a packet passed to an OutboundScheduler.
+type OutboundPacket struct {
+	// Len is the length of the plaintext of the packet, including any
+	// padding, 0 for a keepalive.
+	Len int
+	// Padding is set for DAITA padding.
+	Padding bool
+}
+
+// WithOutboundScheduler has scheduler decide when the packets sent to the
+// peers of the device are released to encryption.
+func WithOutboundScheduler(scheduler OutboundScheduler) Option {
+	return func(o *deviceOptions) {
+		o.outboundScheduler = scheduler
+	}
+}
+
+// scheduledPackets are the packets sent to a peer that are held by the
+// OutboundScheduler of the device.
+type scheduledPackets struct {
+	sync.Mutex
+	held     map[uint64]*QueueOutboundElement // by ID
+	nextID   uint64
+	stopped  bool           // set while the peer is stopped, releasing nothing
+	releases sync.WaitGroup // releases in progress
+}
+
+// encrypt releases elem, which is queued to be sent to the peer, to
+// encryption, once the OutboundScheduler of the device, if any, lets it.
+func (peer *Peer) encrypt(elem *QueueOutboundElement) {
+	scheduler := peer.device.options.outboundScheduler
+	if scheduler == nil {
+		peer.device.queue.encryption.c <- elem
+		return
+	}
+
+	scheduled := &peer.scheduled
+	scheduled.Lock()
+	if scheduled.stopped {
+		scheduled.Unlock()
+		peer.device.queue.encryption.c <- elem
+		return
+	}
+	if scheduled.held == nil {
+		scheduled.held = make(map[uint64]*QueueOutboundElement)
+	}
+	id := scheduled.nextID
+	scheduled.nextID++
+	scheduled.held[id] = elem
+	scheduled.Unlock()
+
+	scheduler.Schedule(peer, OutboundPacket{Len: len(elem.packet), Padding: elem.padding}, func() {
+		peer.releaseScheduled(id)
+	})
+}
+
+func (peer *Peer) releaseScheduled(id uint64) {
+	scheduled := &peer.scheduled
+	scheduled.Lock()
+	elem, ok := scheduled.held[id]
+	if !ok {
+		scheduled.Unlock()
+		return
+	}
+	delete(scheduled.held, id)
+	// Stopping the peer waits for the release, so that the encryption queue
+	// is still open.
+	scheduled.releases.Add(1)
+	scheduled.Unlock()
+
+	peer.device.queue.encryption.c <- elem
+	scheduled.releases.Done()
+}
+
+// startScheduling lets the OutboundScheduler of the device hold the packets
+// sent to the peer.
+func (peer *Peer) startScheduling() {
+	scheduled := &peer.scheduled
+	scheduled.Lock()
+	defer scheduled.Unlock()
+	scheduled.stopped = false
+}
+
+// stopScheduling releases the packets held by the OutboundScheduler of the
+// device, so that the sequential sender waiting for them can return, and
+// waits for the releases in progress. The peer must be stopping, with the
+// encryption queue still open for its writes.
+func (peer *Peer) stopScheduling() {
+	scheduled := &peer.scheduled
+	scheduled.Lock()
+	scheduled.stopped = true
+	held := scheduled.held
+	scheduled.held = nil
+	scheduled.Unlock()
+
+	for _, elem := range held {
+		peer.device.queue.encryption.c <- elem
+	}
+	scheduled.releases.Wait()
+}
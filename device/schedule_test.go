@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// delayingScheduler releases every packet after delay, or holds them all if
+// delay is negative.
+type delayingScheduler struct {
+	delay     time.Duration
+	scheduled atomic.Uint64
+
+	sync.Mutex
+	held []func()
+}
+
+func (s *delayingScheduler) Schedule(peer *Peer, packet OutboundPacket, release func()) {
+	s.scheduled.Add(1)
+	if s.delay < 0 {
+		s.Lock()
+		s.held = append(s.held, release)
+		s.Unlock()
+		return
+	}
+	time.AfterFunc(s.delay, release)
+}
+
+func genScheduledTestPair(t *testing.T, scheduler OutboundScheduler) testPair {
+	return genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 1 {
+			return NewDeviceWithOptions(tun, bind, logger, WithOutboundScheduler(scheduler))
+		}
+		return NewDevice(tun, bind, logger)
+	})
+}
+
+func TestOutboundScheduler(t *testing.T) {
+	scheduler := &delayingScheduler{delay: 50 * time.Millisecond}
+	pair := genScheduledTestPair(t, scheduler)
+
+	start := time.Now()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+	if elapsed := time.Since(start); elapsed < 2*scheduler.delay {
+		t.Errorf("pings took %v, faster than the scheduler lets them", elapsed)
+	}
+	if scheduler.scheduled.Load() < 2 {
+		t.Errorf("scheduled %d packets, want at least 2", scheduler.scheduled.Load())
+	}
+	pair.Send(t, Pong, nil)
+}
+
+func TestOutboundSchedulerStop(t *testing.T) {
+	scheduler := &delayingScheduler{delay: -1}
+	pair := genScheduledTestPair(t, scheduler)
+
+	// Complete the handshake, so that a ping is held by the scheduler.
+	pair.Send(t, Pong, nil)
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	for deadline := time.Now().Add(5 * time.Second); scheduler.scheduled.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ping not scheduled")
+		}
+	}
+
+	// Stopping the peer releases the held packets, and later releases do
+	// nothing.
+	done := make(chan struct{})
+	go func() {
+		pair[1].dev.Down()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the peer waits for the scheduler")
+	}
+	scheduler.Lock()
+	for _, release := range scheduler.held {
+		release()
+	}
+	scheduler.Unlock()
+}
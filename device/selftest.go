@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Known-answer tests of the primitives of the Noise protocol, from the RFCs
+// specifying them.
+var (
+	// RFC 8439, section 2.8.2.
+	selfTestAEADKey       = mustHex("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	selfTestAEADNonce     = mustHex("070000004041424344454647")
+	selfTestAEADData      = mustHex("50515253c0c1c2c3c4c5c6c7")
+	selfTestAEADPlaintext = []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	selfTestAEADSealed    = mustHex("d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691")
+
+	// RFC 7693, appendix B.
+	selfTestHashInput  = []byte("abc")
+	selfTestHashDigest = mustHex("508c5e8c327c14e2e1a72ba34eeb452f37458b209ed63a294d999b4c86675982")
+
+	// RFC 7748, section 5.2.
+	selfTestX25519Scalar = mustHex("a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4")
+	selfTestX25519Point  = mustHex("e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c")
+	selfTestX25519Shared = mustHex("c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// CryptoSelfTest runs known-answer tests of ChaCha20-Poly1305, BLAKE2s and
+// Curve25519, for deployments that require cryptographic self-tests, and
+// returns the first failure. NewDevice runs it once per process, and a device
+// whose self-test failed refuses to come up.
+func CryptoSelfTest() error {
+	aead, err := chacha20poly1305.New(selfTestAEADKey)
+	if err != nil {
+		return fmt.Errorf("ChaCha20-Poly1305 self-test: %w", err)
+	}
+	sealed := aead.Seal(nil, selfTestAEADNonce, selfTestAEADPlaintext, selfTestAEADData)
+	if !bytes.Equal(sealed, selfTestAEADSealed) {
+		return fmt.Errorf("ChaCha20-Poly1305 self-test: wrong ciphertext")
+	}
+	opened, err := aead.Open(nil, selfTestAEADNonce, sealed, selfTestAEADData)
+	if err != nil || !bytes.Equal(opened, selfTestAEADPlaintext) {
+		return fmt.Errorf("ChaCha20-Poly1305 self-test: failed to open ciphertext")
+	}
+	sealed[0] ^= 1
+	if _, err := aead.Open(nil, selfTestAEADNonce, sealed, selfTestAEADData); err == nil {
+		return fmt.Errorf("ChaCha20-Poly1305 self-test: forged ciphertext accepted")
+	}
+
+	if digest := blake2s.Sum256(selfTestHashInput); !bytes.Equal(digest[:], selfTestHashDigest) {
+		return fmt.Errorf("BLAKE2s self-test: wrong digest")
+	}
+
+	shared, err := curve25519.X25519(selfTestX25519Scalar, selfTestX25519Point)
+	if err != nil {
+		return fmt.Errorf("Curve25519 self-test: %w", err)
+	}
+	if !bytes.Equal(shared, selfTestX25519Shared) {
+		return fmt.Errorf("Curve25519 self-test: wrong shared secret")
+	}
+	return nil
+}
+
+var startupSelfTest struct {
+	once sync.Once
+	err  error
+}
+
+// startupCryptoSelfTest returns the result of CryptoSelfTest, run at most
+// once per process.
+func startupCryptoSelfTest() error {
+	startupSelfTest.once.Do(func() {
+		startupSelfTest.err = CryptoSelfTest()
+	})
+	return startupSelfTest.err
+}
@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestCryptoSelfTest(t *testing.T) {
+	if err := CryptoSelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each known answer is checked.
+	for _, tc := range []struct {
+		name   string
+		answer []byte
+	}{
+		{"ChaCha20-Poly1305", selfTestAEADSealed},
+		{"BLAKE2s", selfTestHashDigest},
+		{"Curve25519", selfTestX25519Shared},
+	} {
+		tc.answer[len(tc.answer)-1] ^= 1
+		err := CryptoSelfTest()
+		tc.answer[len(tc.answer)-1] ^= 1
+		if err == nil || !strings.HasPrefix(err.Error(), tc.name) {
+			t.Errorf("corrupted %s answer not detected: %v", tc.name, err)
+		}
+	}
+}
+
+func TestCryptoSelfTestFailureBlocksUp(t *testing.T) {
+	startupCryptoSelfTest()
+	saved := startupSelfTest.err
+	startupSelfTest.err = errors.New("self-test failed")
+	defer func() { startupSelfTest.err = saved }()
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+	if err := dev.Up(); err == nil {
+		t.Fatal("device came up despite a failed self-test")
+	}
+	if dev.isUp() {
+		t.Error("device is up")
+	}
+}
@@ -7,6 +7,8 @@ package device
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"net"
@@ -51,6 +53,9 @@ type QueueOutboundElement struct {
 	keypair   *Keypair              // keypair for encryption
 	peer      *Peer                 // related peer
 	keepalive bool                  // is a keepalive message
+	padding   bool                  // is a DAITA padding packet
+	bypass    bool                  // is DAITA padding that may bypass blocking
+	queuedAt  int64                 // when the element entered its current queue, see queueClock
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -58,6 +63,9 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.buffer = device.GetMessageBuffer()
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
+	elem.keepalive = false
+	elem.padding = false
+	elem.bypass = false
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -79,6 +87,7 @@ func (peer *Peer) SendKeepalive() {
 	if len(peer.queue.staged) == 0 && peer.isRunning.Load() {
 		elem := peer.device.NewOutboundElement()
 		elem.keepalive = true
+		elem.queuedAt = queueNow()
 		select {
 		case peer.queue.staged <- elem:
 			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
@@ -129,7 +138,13 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		if !errors.Is(err, errSendCircuitOpen) {
+			peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		}
+		peer.recordHandshakeSendFailure(err)
+	} else {
+		peer.rttInitiationSent()
+		peer.tracePacket(true, MessageInitiationType, len(packet), 0)
 	}
 	peer.timersHandshakeInitiated()
 
@@ -167,7 +182,13 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, err)
+		if !errors.Is(err, errSendCircuitOpen) {
+			peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, err)
+		}
+		peer.recordHandshakeSendFailure(err)
+	} else {
+		peer.rttResponseSent()
+		peer.tracePacket(true, MessageResponseType, len(packet), 0)
 	}
 	return err
 }
@@ -195,7 +216,11 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages {
+		peer.countRekey(keypair, true)
+		peer.SendHandshakeInitiation(false)
+	} else if keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime {
+		peer.countRekey(keypair, false)
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -206,6 +231,8 @@ func (peer *Peer) keepKeyFreshSending() {
  * Obs. Single instance per TUN device
  */
 func (device *Device) RoutineReadFromTUN() {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	defer func() {
 		device.log.Verbosef("Routine: TUN reader - stopped")
 		device.state.stopping.Done()
@@ -215,6 +242,7 @@ func (device *Device) RoutineReadFromTUN() {
 	device.log.Verbosef("Routine: TUN reader - started")
 
 	var elem *QueueOutboundElement
+	tunDevice, generation := device.currentTUN()
 
 	for {
 		if elem != nil {
@@ -226,8 +254,14 @@ func (device *Device) RoutineReadFromTUN() {
 		// read packet
 
 		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		size, err := tunDevice.Read(elem.buffer[:], offset)
 		if err != nil {
+			if current, currentGeneration := device.currentTUN(); currentGeneration != generation {
+				// SwapTUN closed the device we were reading from.
+				device.log.Verbosef("Routine: TUN reader - reading from the swapped in TUN device")
+				tunDevice, generation = current, currentGeneration
+				continue
+			}
 			if !device.isClosed() {
 				if !errors.Is(err, os.ErrClosed) {
 					device.log.Errorf("Failed to read packet from TUN device: %v", err)
@@ -251,6 +285,7 @@ func (device *Device) RoutineReadFromTUN() {
 		switch elem.packet[0] >> 4 {
 		case ipv4.Version:
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.dropNonIPFrame(elem.packet)
 				continue
 			}
 			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
@@ -258,6 +293,7 @@ func (device *Device) RoutineReadFromTUN() {
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.dropNonIPFrame(elem.packet)
 				continue
 			}
 			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
@@ -265,11 +301,15 @@ func (device *Device) RoutineReadFromTUN() {
 
 		default:
 			device.log.Verbosef("Received packet with unknown IP version")
+			device.dropNonIPFrame(elem.packet)
 		}
 
-		if peer == nil {
+		if peer == nil || peer.dropSend() {
 			continue
 		}
+		if peer.classifier.enabled.Load() {
+			peer.classifier.count(elem.packet)
+		}
 		if peer.isRunning.Load() {
 			peer.StagePacket(elem)
 			elem = nil
@@ -282,90 +322,130 @@ func (device *Device) RoutineReadFromTUN() {
 	}
 }
 
-func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
-	for {
-		select {
-		case peer.queue.staged <- elem:
-			return
-		default:
-		}
-		select {
-		case tooOld := <-peer.queue.staged:
-			peer.device.PutMessageBuffer(tooOld.buffer)
-			peer.device.PutOutboundElement(tooOld)
-		default:
-		}
+// dropNonIPFrame accounts for a frame read from the TUN device that is not a valid
+// IPv4 or IPv6 packet, and logs its first bytes if sampling is enabled.
+func (device *Device) dropNonIPFrame(packet []byte) {
+	dropped := device.stats.txDroppedNonIP.Add(1)
+	if rate := device.debug.nonIPSampleRate.Load(); rate != 0 && (dropped-1)%uint64(rate) == 0 {
+		device.log.Verbosef("Dropped non-IP frame read from TUN (%d dropped in total): % x", dropped, packet[:min(len(packet), nonIPSampleBytes)])
 	}
 }
 
+// StagePacket stages a packet to be sent once a session is available. If the
+// staging queue is full, the oldest staged packet is dropped.
+func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
+	peer.stage(peer.queue.staged, &peer.queue.stagedClock, elem)
+}
+
 func (peer *Peer) SendStagedPackets() {
 top:
-	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
+	if (len(peer.queue.staged) == 0 && len(peer.queue.stagedPadding) == 0) || !peer.device.isUp() {
+		return
+	}
+	// While DAITA blocks the peer, staged packets are held, except for padding
+	// that may bypass the blocking.
+	blocked := peer.daitaBlocking.blocked.Load()
+	if blocked && (!peer.daitaBlocking.bypassable.Load() || len(peer.queue.stagedPadding) == 0) {
 		return
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if keypair == nil {
+		peer.SendHandshakeInitiation(false)
+		return
+	}
+	if exhausted := keypair.sendNonce.Load() >= RejectAfterMessages; exhausted || time.Since(keypair.created) >= RejectAfterTime {
+		peer.countReject(keypair, exhausted)
 		peer.SendHandshakeInitiation(false)
 		return
 	}
 
+	cursor := peer.newStagedCursor()
+	cursor.bypassOnly = blocked
 	for {
-		select {
-		case elem := <-peer.queue.staged:
-			elem.peer = peer
-			elem.nonce = keypair.sendNonce.Add(1) - 1
-			if elem.nonce >= RejectAfterMessages {
-				keypair.sendNonce.Store(RejectAfterMessages)
-				peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
-				goto top
-			}
+		elem := peer.nextStaged(&cursor)
+		if elem == nil {
+			return
+		}
 
-			if peer.constantPacketSize {
-				mtu := int(peer.device.tun.mtu.Load())
-				size := len(elem.packet)
-				offset := MessageTransportHeaderSize
-				// size should not and cannot be larger than mtu as far as we can tell, but for safety we check
-				if mtu > size {
-					// Here, we extend the packet to always be MTU sized as an obfuscation.
-					if offset+mtu < len(elem.buffer) {
-						elem.packet = elem.buffer[offset : offset+mtu]
-					} else {
-						elem.packet = elem.buffer[offset:]
-					}
+		elem.peer = peer
+		elem.nonce = keypair.sendNonce.Add(1) - 1
+		peer.checkNonce(keypair, elem.nonce)
+		if elem.nonce >= RejectAfterMessages {
+			keypair.sendNonce.Store(RejectAfterMessages)
+			peer.restage(elem) // XXX: Out of order, but we can't front-load go chans
+			peer.restageCursor(&cursor)
+			goto top
+		}
 
-					// To avoid sending data from the previous packet, we need to clear the extra buffer content that we add.
-					clear(elem.packet[size:])
-				}
-			}
+		if compression := keypair.compression.Load(); compression != nil && peer.compression.Load() != nil && !elem.keepalive && !elem.padding {
+			peer.compressPacket(elem, compression)
+		}
 
-			elem.keypair = keypair
-			elem.Lock()
+		peer.padToConstantSize(elem)
 
-			// add to parallel and sequential queue
-			if peer.isRunning.Load() {
-				peer.queue.outbound.c <- elem
-				peer.device.queue.encryption.c <- elem
-			} else {
-				peer.device.PutMessageBuffer(elem.buffer)
-				peer.device.PutOutboundElement(elem)
-			}
-		default:
-			return
+		elem.keypair = keypair
+		elem.queuedAt = queueNow()
+		elem.Lock()
+
+		// add to parallel and sequential queue
+		if peer.isRunning.Load() {
+			peer.queue.outbound.c <- elem
+			peer.encrypt(elem)
+		} else {
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
 		}
 	}
 }
 
 func (peer *Peer) FlushStagedPackets() {
+	peer.flushStaged()
+}
+
+// FlushQueues drops all packets of the peer that are waiting to be sent: the
+// staged packets and padding, and the packets queued for encryption and
+// transmission. Stale packets are only a waste of bandwidth after switching
+// endpoints or resuming from a long suspend. It returns the number of packets
+// dropped, not counting padding.
+func (peer *Peer) FlushQueues() uint64 {
+	dropped := peer.flushStaged()
+	q := peer.queue.outbound
 	for {
 		select {
-		case elem := <-peer.queue.staged:
+		case elem := <-q.c:
+			q.clock.dequeued(elem.queuedAt)
+			elem.Lock() // wait for encryption to be done with it
+			if !elem.padding {
+				dropped++
+			}
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
 		default:
-			return
+			return dropped
+		}
+	}
+}
+
+// flushStaged drops the staged packets and padding of the peer, and returns
+// the number of packets dropped, not counting padding.
+func (peer *Peer) flushStaged() (dropped uint64) {
+	for _, staged := range []chan *QueueOutboundElement{peer.queue.staged, peer.queue.stagedPadding} {
+	flush:
+		for {
+			select {
+			case elem := <-staged:
+				if !elem.padding {
+					dropped++
+				}
+				peer.device.PutMessageBuffer(elem.buffer)
+				peer.device.PutOutboundElement(elem)
+			default:
+				break flush
+			}
 		}
 	}
+	return dropped
 }
 
 func calculatePaddingSize(packetSize, mtu int) int {
@@ -383,6 +463,10 @@ func calculatePaddingSize(packetSize, mtu int) int {
 	return paddedSize - lastUnit
 }
 
+// EncryptionBatchSize is the largest number of elements an encryption worker
+// takes off the queue at once.
+const EncryptionBatchSize = 32
+
 /* Encrypts the elements in the queue
  * and marks them for sequential consumption (by releasing the mutex)
  *
@@ -391,56 +475,87 @@ func calculatePaddingSize(packetSize, mtu int) int {
 func (device *Device) RoutineEncryption(id int) {
 	var paddingZeros [PaddingMultiple]byte
 	var nonce [chacha20poly1305.NonceSize]byte
+	batch := make([]*QueueOutboundElement, 0, EncryptionBatchSize)
 
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	defer device.log.Verbosef("Routine: encryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
-	for elem := range device.queue.encryption.c {
-		// populate header fields
-		header := elem.buffer[:MessageTransportHeaderSize]
+	for {
+		batch = device.queue.encryption.receiveBatch(batch[:0], device.options.workers)
+		if len(batch) == 0 {
+			return
+		}
+		mtu := int(device.tun.mtu.Load())
+
+		// The elements of a peer are queued together, so batches are made of
+		// runs of elements sharing a keypair, which is looked up once per run.
+		// Elements are released as soon as they are sealed, in queue order,
+		// so the sequential senders keep the order of each peer.
+		var (
+			keypair  *Keypair
+			aead     cipher.AEAD
+			receiver uint32
+		)
+		for _, elem := range batch {
+			if elem.keypair != keypair {
+				keypair = elem.keypair
+				aead = keypair.send
+				receiver = keypair.remoteIndex
+			}
 
-		fieldType := header[0:4]
-		fieldReceiver := header[4:8]
-		fieldNonce := header[8:16]
+			// populate header fields
+			header := elem.buffer[:MessageTransportHeaderSize]
 
-		binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
-		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
-		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
+			fieldType := header[0:4]
+			fieldReceiver := header[4:8]
+			fieldNonce := header[8:16]
 
-		// pad content to multiple of 16
-		paddingSize := calculatePaddingSize(len(elem.packet), int(device.tun.mtu.Load()))
-		elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
+			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+			binary.LittleEndian.PutUint32(fieldReceiver, receiver)
+			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-		// encrypt content and release to consumer
+			// pad content to multiple of 16
+			paddingSize := calculatePaddingSize(len(elem.packet), mtu)
+			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
 
-		binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
-		elem.packet = elem.keypair.send.Seal(
-			header,
-			nonce[:],
-			elem.packet,
-			nil,
-		)
-		elem.Unlock()
+			// encrypt content and release to consumer
+
+			binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
+			elem.packet = aead.Seal(
+				header,
+				nonce[:],
+				elem.packet,
+				nil,
+			)
+			elem.Unlock()
+		}
+		clear(batch)
 	}
 }
 
-/* Sequentially reads packets from queue and sends to endpoint
- *
- * Obs. Single instance per peer.
- * The routine terminates then the outbound queue is closed.
- */
-func (peer *Peer) RoutineSequentialSender() {
+// RoutineSequentialSender sends the encrypted packets of the peer in order,
+// until ctx is cancelled.
+func (peer *Peer) RoutineSequentialSender(ctx context.Context) {
 	device := peer.device
 	defer func() {
 		defer device.log.Verbosef("%v - Routine: sequential sender - stopped", peer)
+		peer.goroutineExit(GoroutinePeer)
 		peer.stopping.Done()
 	}()
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
 
-	for elem := range peer.queue.outbound.c {
-		if elem == nil {
+	var batch []*QueueOutboundElement
+	var buffers [][]byte
+	for {
+		var elem *QueueOutboundElement
+		select {
+		case <-ctx.Done():
 			return
+		case elem = <-peer.queue.outbound.c:
 		}
+		peer.queue.outbound.clock.dequeued(elem.queuedAt)
 		elem.Lock()
 		if !peer.isRunning.Load() {
 			// peer has been stopped; return re-usable elems to the shared pool.
@@ -454,22 +569,71 @@ func (peer *Peer) RoutineSequentialSender() {
 			continue
 		}
 
+		if pacer := peer.pacing.Load(); pacer != nil && !pacer.wait(ctx) {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			return
+		}
+
+		batch = append(batch[:0], elem)
+		if len(elem.packet) <= coalesceMaxPacketSize {
+			if window := peer.canCoalesce(); window != 0 {
+				var ok bool
+				if batch, ok = peer.coalesce(ctx, batch, window); !ok {
+					for _, elem := range batch {
+						device.PutMessageBuffer(elem.buffer)
+						device.PutOutboundElement(elem)
+					}
+					return
+				}
+			}
+		}
+
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
 
-		// send message and return buffer to pool
+		// send messages and return buffers to pool
 
-		err := peer.SendBuffer(elem.packet)
-		if !elem.keepalive {
+		var err error
+		if len(batch) == 1 {
+			err = peer.SendBuffer(elem.packet)
+		} else {
+			buffers = buffers[:0]
+			for _, elem := range batch {
+				buffers = append(buffers, elem.packet)
+			}
+			err = peer.SendBuffers(buffers)
+			clear(buffers)
+		}
+		dataSent := false
+		for i, elem := range batch {
+			// A packet that made it out on the other path counts as sent,
+			// but the error of the batch is still reported.
+			if duplicated := peer.sendDuplicate(elem.packet); err == nil || duplicated {
+				peer.tracePacket(true, MessageTransportType, len(elem.packet), elem.queuedAt)
+				if elem.padding {
+					peer.daitaPaddingTransmitted()
+				}
+			}
+			dataSent = dataSent || !elem.keepalive
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			batch[i] = nil
+		}
+		if dataSent {
 			peer.timersDataSent()
 		}
 
-		device.PutMessageBuffer(elem.buffer)
-		device.PutOutboundElement(elem)
 		if err != nil {
-			device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+			if !errors.Is(err, errSendCircuitOpen) {
+				device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+				peer.recordError(PeerErrorSend, err.Error())
+			}
 			continue
 		}
+		if dataSent {
+			peer.rttDataSent(queueNow())
+		}
 
 		peer.keepKeyFreshSending()
 	}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errSendCircuitOpen is returned for packets to a peer that are not sent
+// because its send circuit is open.
+var errSendCircuitOpen = errors.New("sending suspended after persistent failures")
+
+// A peerSendCircuit stops sending to a peer once the bind has failed to send
+// to it SendFailureThreshold times in a row with errors that are not
+// temporary, such as the bind being closed, as multihop binds are when they
+// shut down, instead of hammering the bind and logging every failure. While
+// the circuit is open, packets to the peer are dropped, except for probes
+// sent with exponential backoff, the first of which to be sent closes the
+// circuit again.
+type peerSendCircuit struct {
+	open     atomic.Bool
+	failures atomic.Uint32 // consecutive persistent send failures
+	dropped  atomic.Uint64 // packets dropped while the circuit was open
+
+	sync.Mutex
+	backoff time.Duration // before the probe after the next one
+	probeAt time.Time     // when the next probe may be sent
+}
+
+// persistentSendError reports whether err, returned by the bind, is not
+// temporary, so that sending again is likely to fail the same way.
+func persistentSendError(err error) bool {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) {
+		return true
+	}
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return false // the packet is too large, not the bind broken
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Temporary() && !netErr.Timeout()
+}
+
+// allowSend reports whether a packet may be sent to the peer: always while
+// its send circuit is closed, and only as a probe, when one is due, while it
+// is open. Packets that may not be sent are counted as dropped.
+func (peer *Peer) allowSend() bool {
+	circuit := &peer.sendCircuit
+	if !circuit.open.Load() {
+		return true
+	}
+	circuit.Lock()
+	defer circuit.Unlock()
+	if !circuit.open.Load() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(circuit.probeAt) {
+		circuit.dropped.Add(1)
+		return false
+	}
+	circuit.probeAt = now.Add(circuit.backoff)
+	circuit.backoff = min(circuit.backoff*2, SendProbeMaxBackoff)
+	return true
+}
+
+// sendDone records the outcome of sending to the peer, opening its send
+// circuit once sending fails persistently, and closing it once a packet is
+// sent again.
+func (peer *Peer) sendDone(err error) {
+	circuit := &peer.sendCircuit
+	if err == nil {
+		if circuit.failures.Load() == 0 {
+			return
+		}
+		circuit.Lock()
+		circuit.failures.Store(0)
+		closed := circuit.open.Swap(false)
+		circuit.Unlock()
+		if closed {
+			peer.device.log.Verbosef("%v - Sending recovered, resuming", peer)
+			peer.device.notify(NotificationSendRecovered, peer, "sending recovered")
+		}
+		return
+	}
+	if !persistentSendError(err) || circuit.failures.Add(1) != SendFailureThreshold {
+		return
+	}
+
+	circuit.Lock()
+	circuit.backoff = SendProbeMinBackoff
+	circuit.probeAt = time.Now().Add(circuit.backoff)
+	circuit.open.Store(true)
+	circuit.Unlock()
+	message := fmt.Sprintf("sending failed %d times in a row, suspending: %v", SendFailureThreshold, err)
+	peer.device.log.Errorf("%v - Persistent send failure, %s", peer, message)
+	peer.device.notify(NotificationSendFailed, peer, message)
+}
+
+// ipcSendCircuit serializes the send circuit of a peer for IpcGet.
+func ipcSendCircuit(sendf func(string, ...any), circuit *peerSendCircuit) {
+	if circuit.open.Load() {
+		sendf("send_circuit_open=true")
+	}
+	if dropped := circuit.dropped.Load(); dropped != 0 {
+		sendf("tx_dropped_send_circuit=%d", dropped)
+	}
+}
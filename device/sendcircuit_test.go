@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// closedBind fails to send, as a closed bind does, while failing is set.
+type closedBind struct {
+	conn.Bind
+	failing atomic.Bool
+	sends   atomic.Uint64
+}
+
+func (bind *closedBind) Send(b []byte, ep conn.Endpoint) error {
+	bind.sends.Add(1)
+	if bind.failing.Load() {
+		return net.ErrClosed
+	}
+	return bind.Bind.Send(b, ep)
+}
+
+func TestSendCircuit(t *testing.T) {
+	var bind *closedBind
+	notifications := make(chan Notification, 16)
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, b conn.Bind, logger *Logger) *Device {
+		if i == 0 {
+			bind = &closedBind{Bind: b}
+			b = bind
+		}
+		dev := NewDevice(tun, b, logger)
+		if i == 0 {
+			dev.Subscribe(func(n Notification) {
+				if n.Kind == NotificationSendFailed || n.Kind == NotificationSendRecovered {
+					notifications <- n
+				}
+			})
+		}
+		return dev
+	})
+	pair.Send(t, Ping, nil)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	bind.failing.Store(true)
+	for i := 0; i < SendFailureThreshold; i++ {
+		if err := peer.SendBuffer([]byte{0}); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("send %d: got %v, want the error of the bind", i, err)
+		}
+	}
+	select {
+	case n := <-notifications:
+		if n.Kind != NotificationSendFailed {
+			t.Fatalf("got notification %v, want %v", n.Kind, NotificationSendFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification of the persistent failure")
+	}
+
+	// Sending is suspended, without reaching the bind.
+	sends := bind.sends.Load()
+	if err := peer.SendBuffer([]byte{0}); !errors.Is(err, errSendCircuitOpen) {
+		t.Fatalf("got %v while suspended, want %v", err, errSendCircuitOpen)
+	}
+	if bind.sends.Load() != sends {
+		t.Error("packet sent to the bind while suspended")
+	}
+
+	// A probe that gets through resumes sending.
+	bind.failing.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); peer.sendCircuit.open.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("sending did not recover")
+		}
+		peer.SendBuffer([]byte{0})
+	}
+	select {
+	case n := <-notifications:
+		if n.Kind != NotificationSendRecovered {
+			t.Fatalf("got notification %v, want %v", n.Kind, NotificationSendRecovered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification of the recovery")
+	}
+	if peer.sendCircuit.dropped.Load() == 0 {
+		t.Error("no packets counted as dropped while suspended")
+	}
+}
+
+func TestPersistentSendError(t *testing.T) {
+	for _, test := range []struct {
+		err        error
+		persistent bool
+	}{
+		{net.ErrClosed, true},
+		{&net.OpError{Op: "write", Err: syscall.ENETUNREACH}, true},
+		{&net.OpError{Op: "write", Err: syscall.EMSGSIZE}, false},
+		{&net.OpError{Op: "write", Err: syscall.EAGAIN}, false},
+		{errNoEndpoint, false},
+	} {
+		if got := persistentSendError(test.err); got != test.persistent {
+			t.Errorf("%v: persistent is %v, want %v", test.err, got, test.persistent)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// sharedBindQueueSize is the number of received datagrams queued for
+	// each device of a SharedBind. Datagrams arriving while it is full are
+	// dropped, as by a full socket buffer.
+	sharedBindQueueSize = 1024
+
+	// sharedBindIndexLifetime is how long a SharedBind routes messages to
+	// the device which sent a handshake message with a given sender index.
+	// It outlives the keypair derived from the handshake.
+	sharedBindIndexLifetime = 2 * RejectAfterTime
+)
+
+// A SharedBind lets several devices listen on the port of a single bind, such
+// as the entry and exit devices of a local multihop, so that a firewall needs
+// to allow only one port.
+//
+// Handshake initiations are routed to the device whose public key they are
+// addressed to, by their mac1. Other messages are routed by their receiver
+// index to the device which sent a handshake message with it as the sender
+// index. Messages that cannot be routed are dropped, unless only one device
+// is open.
+type SharedBind struct {
+	bind conn.Bind
+
+	openLock sync.Mutex // serializes opening and closing bind
+	open     int        // number of devices with an open bind
+	port     uint16
+	stopped  sync.WaitGroup
+
+	sync.RWMutex
+	devices []*sharedBindDevice // with an open bind
+	indices map[uint32]sharedBindIndex
+	pruned  time.Time
+}
+
+type sharedBindIndex struct {
+	device  *sharedBindDevice
+	learned time.Time
+}
+
+func NewSharedBind(bind conn.Bind) *SharedBind {
+	return &SharedBind{
+		bind:    bind,
+		indices: make(map[uint32]sharedBindIndex),
+	}
+}
+
+// Bind returns a bind for the device with the given public key, to be used
+// for that device only. A device whose private key changes needs a new bind.
+// Messages are only routed to the bind while it is open, so a bind that is
+// closed and dropped is released.
+func (shared *SharedBind) Bind(publicKey NoisePublicKey) conn.Bind {
+	device := &sharedBindDevice{shared: shared}
+	device.checker.Init(publicKey)
+	return device
+}
+
+type sharedBindDevice struct {
+	shared  *SharedBind
+	checker CookieChecker // for the mac1 of initiations to the device
+
+	// packets and closed are replaced whenever the device opens the bind,
+	// under the lock of shared, as the device joins shared.devices.
+	packets chan sharedBindPacket
+	closed  chan struct{}
+}
+
+type sharedBindPacket struct {
+	data []byte
+	ep   conn.Endpoint
+}
+
+var _ conn.Bind = (*sharedBindDevice)(nil)
+
+func (device *sharedBindDevice) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	shared := device.shared
+	shared.openLock.Lock()
+	defer shared.openLock.Unlock()
+
+	shared.RLock()
+	isOpen := device.packets != nil
+	shared.RUnlock()
+	if isOpen {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	if shared.open == 0 {
+		fns, actualPort, err := shared.bind.Open(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		shared.port = actualPort
+		for _, fn := range fns {
+			shared.stopped.Add(1)
+			go shared.routineDemux(fn)
+		}
+	}
+	shared.open++
+
+	packets, closed := make(chan sharedBindPacket, sharedBindQueueSize), make(chan struct{})
+	shared.Lock()
+	device.packets, device.closed = packets, closed
+	shared.devices = append(shared.devices, device)
+	shared.Unlock()
+
+	receive := func(b []byte) (int, conn.Endpoint, error) {
+		select {
+		case packet := <-packets:
+			return copy(b, packet.data), packet.ep, nil
+		case <-closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, shared.port, nil
+}
+
+// Close closes the bind of the device, and the shared bind once no device
+// has it open.
+func (device *sharedBindDevice) Close() error {
+	shared := device.shared
+	shared.openLock.Lock()
+	defer shared.openLock.Unlock()
+
+	shared.Lock()
+	if device.packets == nil {
+		shared.Unlock()
+		return nil
+	}
+	close(device.closed)
+	device.packets, device.closed = nil, nil
+	shared.devices = slices.DeleteFunc(shared.devices, func(d *sharedBindDevice) bool {
+		return d == device
+	})
+	for index, route := range shared.indices {
+		if route.device == device {
+			delete(shared.indices, index)
+		}
+	}
+	shared.Unlock()
+
+	shared.open--
+	if shared.open > 0 {
+		return nil
+	}
+	err := shared.bind.Close()
+	shared.stopped.Wait()
+	return err
+}
+
+func (device *sharedBindDevice) SetMark(mark uint32) error {
+	return device.shared.bind.SetMark(mark)
+}
+
+func (device *sharedBindDevice) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return device.shared.bind.ParseEndpoint(s)
+}
+
+func (device *sharedBindDevice) Send(b []byte, ep conn.Endpoint) error {
+	device.shared.learn(device, b)
+	return device.shared.bind.Send(b, ep)
+}
+
+// learn records the sender index of a handshake message sent by device, to
+// route the messages sent back to it.
+func (shared *SharedBind) learn(device *sharedBindDevice, msg []byte) {
+	if len(msg) < 8 {
+		return
+	}
+	switch binary.LittleEndian.Uint32(msg) {
+	case MessageInitiationType, MessageResponseType:
+	default:
+		return
+	}
+	index := binary.LittleEndian.Uint32(msg[4:])
+	now := time.Now()
+
+	shared.Lock()
+	defer shared.Unlock()
+	shared.indices[index] = sharedBindIndex{device: device, learned: now}
+	if now.Sub(shared.pruned) > sharedBindIndexLifetime {
+		for index, route := range shared.indices {
+			if now.Sub(route.learned) > sharedBindIndexLifetime {
+				delete(shared.indices, index)
+			}
+		}
+		shared.pruned = now
+	}
+}
+
+// routeLocked returns the device a received message is for, or nil if it
+// cannot be routed to an open device.
+func (shared *SharedBind) routeLocked(msg []byte) *sharedBindDevice {
+	var device *sharedBindDevice
+	if len(msg) >= 4 {
+		switch binary.LittleEndian.Uint32(msg) {
+		case MessageInitiationType:
+			if len(msg) == MessageInitiationSize {
+				for _, d := range shared.devices {
+					if d.checker.CheckMAC1(msg) {
+						device = d
+						break
+					}
+				}
+			}
+		case MessageResponseType:
+			if len(msg) == MessageResponseSize {
+				device = shared.indices[binary.LittleEndian.Uint32(msg[8:])].device
+			}
+		case MessageCookieReplyType, MessageTransportType:
+			if len(msg) >= 8 {
+				device = shared.indices[binary.LittleEndian.Uint32(msg[4:])].device
+			}
+		}
+	}
+	if device != nil || len(shared.devices) != 1 {
+		return device
+	}
+	return shared.devices[0]
+}
+
+// routineDemux receives datagrams from fn and queues each for the device it
+// is routed to, until the shared bind is closed.
+func (shared *SharedBind) routineDemux(fn conn.ReceiveFunc) {
+	defer shared.stopped.Done()
+	buf := make([]byte, MaxMessageSize)
+	deathSpiral := 0
+	for {
+		n, ep, err := fn(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if neterr, ok := err.(net.Error); ok && !neterr.Temporary() {
+				return
+			}
+			if deathSpiral < 10 {
+				deathSpiral++
+				time.Sleep(time.Second / 3)
+				continue
+			}
+			return
+		}
+		msg := buf[:n]
+
+		shared.RLock()
+		device := shared.routeLocked(msg)
+		if device != nil {
+			data := make([]byte, n)
+			copy(data, msg)
+			select {
+			case device.packets <- sharedBindPacket{data: data, ep: ep}:
+			default:
+			}
+		}
+		shared.RUnlock()
+	}
+}
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestSharedBind runs two devices on one shared socket, each peered with a
+// device on a socket of its own, and checks that they both reach their peer.
+func TestSharedBind(t *testing.T) {
+	shared := NewSharedBind(conn.NewDefaultBind())
+	type node struct {
+		tun *tuntest.ChannelTUN
+		dev *Device
+		sk  NoisePrivateKey
+		ip  netip.Addr
+	}
+	newNode := func(ip netip.Addr, bind func(NoisePublicKey) conn.Bind) *node {
+		t.Helper()
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &node{tun: tuntest.NewChannelTUN(), sk: sk, ip: ip}
+		n.dev = NewDevice(n.tun.TUN(), bind(sk.publicKey()), NewLogger(LogLevelError, ip.String()+": "))
+		t.Cleanup(n.dev.Close)
+		return n
+	}
+	ownBind := func(NoisePublicKey) conn.Bind { return conn.NewDefaultBind() }
+	peer := func(local, remote *node, port uint16) {
+		t.Helper()
+		pk := remote.sk.publicKey()
+		cfg := uapiCfg(
+			"private_key", hex.EncodeToString(local.sk[:]),
+			"listen_port", "0",
+			"public_key", hex.EncodeToString(pk[:]),
+			"allowed_ip", remote.ip.String()+"/32",
+		)
+		if port != 0 {
+			cfg += uapiCfg("endpoint", fmt.Sprintf("127.0.0.1:%d", port))
+		}
+		if err := local.dev.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := local.dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ping := func(from, to *node) {
+		t.Helper()
+		msg := tuntest.Ping(to.ip, from.ip)
+		from.tun.Outbound <- msg
+		select {
+		case got := <-to.tun.Inbound:
+			if !bytes.Equal(msg, got) {
+				t.Errorf("ping from %v to %v did not transit correctly", from.ip, to.ip)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ping from %v to %v did not transit", from.ip, to.ip)
+		}
+	}
+
+	entry := newNode(netip.MustParseAddr("1.0.0.1"), shared.Bind)
+	exit := newNode(netip.MustParseAddr("2.0.0.1"), shared.Bind)
+	entryPeer := newNode(netip.MustParseAddr("1.0.0.2"), ownBind)
+	exitPeer := newNode(netip.MustParseAddr("2.0.0.2"), ownBind)
+	peer(entry, entryPeer, 0)
+	peer(exit, exitPeer, 0)
+	if entry.dev.net.port != exit.dev.net.port {
+		t.Fatalf("devices listen on ports %d and %d", entry.dev.net.port, exit.dev.net.port)
+	}
+	peer(entryPeer, entry, entry.dev.net.port)
+	peer(exitPeer, exit, exit.dev.net.port)
+
+	// The peers initiate, so that the initiations are routed by mac1.
+	ping(entryPeer, entry)
+	ping(exitPeer, exit)
+	ping(entry, entryPeer)
+	ping(exit, exitPeer)
+
+	// The shared socket stays open until both devices close their bind.
+	if err := entry.dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	ping(exitPeer, exit)
+	if err := entry.dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// Going down dropped the session, so the entry device initiates.
+	ping(entry, entryPeer)
+	ping(entryPeer, entry)
+}
+
+// TestSharedBindRelease checks that the binds of a SharedBind that are
+// closed, as after a key change, are no longer routed to.
+func TestSharedBindRelease(t *testing.T) {
+	shared := NewSharedBind(conn.NewDefaultBind())
+	for i := 0; i < 8; i++ {
+		bind := shared.Bind(NoisePublicKey{byte(i)})
+		if _, _, err := bind.Open(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := bind.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := shared.Bind(NoisePublicKey{8})
+	if _, _, err := other.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	shared.RLock()
+	defer shared.RUnlock()
+	if len(shared.devices) != 1 || shared.devices[0] != other {
+		t.Errorf("%d binds routed to, want the open one only", len(shared.devices))
+	}
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestPeerSourceAddress(t *testing.T) {
+	pair := genTestPair(t, true)
+	if _, ok := pair[1].dev.net.bind.(conn.SourceAddrBind); !ok {
+		t.Skip("default bind does not support source addresses")
+	}
+
+	// Any address in 127.0.0.0/8 is local on loopback, so the responder sees
+	// the pinned address as the source of the initiator's packets.
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pair[0].dev.staticIdentity.publicKey[:]),
+		"source_address", "127.0.0.2",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := pair[1].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "source_address=127.0.0.2\n") {
+		t.Fatalf("source_address missing from IpcGet:\n%s", cfg)
+	}
+
+	pair.Send(t, Ping, nil)
+	cfg, err = pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "endpoint=127.0.0.2:") {
+		t.Fatalf("expected the responder to see the pinned source address:\n%s", cfg)
+	}
+}
+
+func TestPeerSourceAddressUnsupported(t *testing.T) {
+	pair := genTestPair(t, false)
+	err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pair[0].dev.staticIdentity.publicKey[:]),
+		"source_address", "127.0.0.2",
+	))
+	var ipcErr *IPCError
+	if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+		t.Fatalf("expected an invalid key error for a bind without source addresses, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+// DaitaPaddingOrder controls how staged DAITA padding is interleaved with
+// staged data when both are waiting to be sent. Padding and data are staged
+// in separate queues, so that a burst of one can never evict the other.
+type DaitaPaddingOrder uint32
+
+const (
+	// DaitaPaddingOrderFIFO sends padding and data in the order they were staged.
+	DaitaPaddingOrderFIFO DaitaPaddingOrder = iota
+	// DaitaPaddingOrderDataFirst sends the staged data before the staged padding.
+	DaitaPaddingOrderDataFirst
+)
+
+func (order DaitaPaddingOrder) String() string {
+	switch order {
+	case DaitaPaddingOrderFIFO:
+		return "fifo"
+	case DaitaPaddingOrderDataFirst:
+		return "data"
+	}
+	return fmt.Sprintf("DaitaPaddingOrder(%d)", uint32(order))
+}
+
+func parseDaitaPaddingOrder(s string) (DaitaPaddingOrder, error) {
+	switch s {
+	case "fifo":
+		return DaitaPaddingOrderFIFO, nil
+	case "data":
+		return DaitaPaddingOrderDataFirst, nil
+	}
+	return 0, fmt.Errorf("unknown padding order %q", s)
+}
+
+// StagePadding stages a DAITA padding packet. If the padding queue is full,
+// the oldest staged padding is dropped; staged data is never affected.
+func (peer *Peer) StagePadding(elem *QueueOutboundElement) {
+	elem.padding = true
+	peer.stage(peer.queue.stagedPadding, &peer.queue.stagedPaddingClock, elem)
+}
+
+func (peer *Peer) stage(staged chan *QueueOutboundElement, clock *queueClock, elem *QueueOutboundElement) {
+	elem.queuedAt = queueNow()
+	for {
+		select {
+		case staged <- elem:
+			return
+		default:
+		}
+		select {
+		case tooOld := <-staged:
+			clock.dequeued(tooOld.queuedAt)
+			if !tooOld.padding {
+				peer.droppedStaged()
+			}
+			peer.device.PutMessageBuffer(tooOld.buffer)
+			peer.device.PutOutboundElement(tooOld)
+		default:
+		}
+	}
+}
+
+// droppedStaged counts a staged packet pushed out by a newer one: as dropped
+// for lack of a session if the peer has no session to send it with, and as a
+// staging overflow otherwise, as while DAITA blocks the peer or its packets
+// are held or paced.
+func (peer *Peer) droppedStaged() {
+	keypair := peer.keypairs.Current()
+	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+		peer.droppedNoKeypair(1)
+		return
+	}
+	peer.txStagedOverflow.Add(1)
+}
+
+// restage puts elem back into the staging queue it came from.
+func (peer *Peer) restage(elem *QueueOutboundElement) {
+	if elem.padding {
+		peer.StagePadding(elem)
+	} else {
+		peer.StagePacket(elem)
+	}
+}
+
+// stagedCursor merges the data and padding staging queues for one call of
+// SendStagedPackets. It takes at most the elements that were staged when it
+// was created, so that neither kind can starve the other by being staged
+// faster than it is sent; later elements are sent by the next call, which
+// whoever staged them makes.
+type stagedCursor struct {
+	order         DaitaPaddingOrder
+	data, padding *QueueOutboundElement // taken from the queues, but not yet returned
+	dataLeft      int
+	paddingLeft   int
+	bypassOnly    bool // only take padding that may bypass blocking
+}
+
+func (peer *Peer) newStagedCursor() stagedCursor {
+	return stagedCursor{
+		order:       DaitaPaddingOrder(peer.daitaPaddingOrder.Load()),
+		dataLeft:    len(peer.queue.staged),
+		paddingLeft: len(peer.queue.stagedPadding),
+	}
+}
+
+// nextStaged returns the next element to send, or nil if the cursor is done.
+func (peer *Peer) nextStaged(cursor *stagedCursor) *QueueOutboundElement {
+	if cursor.bypassOnly {
+		return peer.nextBypassing(cursor)
+	}
+	if cursor.data == nil && cursor.dataLeft > 0 {
+		select {
+		case cursor.data = <-peer.queue.staged:
+			peer.queue.stagedClock.dequeued(cursor.data.queuedAt)
+			cursor.dataLeft--
+		default:
+			cursor.dataLeft = 0
+		}
+	}
+	if cursor.padding == nil && cursor.paddingLeft > 0 {
+		select {
+		case cursor.padding = <-peer.queue.stagedPadding:
+			peer.queue.stagedPaddingClock.dequeued(cursor.padding.queuedAt)
+			cursor.paddingLeft--
+		default:
+			cursor.paddingLeft = 0
+		}
+	}
+
+	var elem *QueueOutboundElement
+	switch {
+	case cursor.data == nil:
+		elem, cursor.padding = cursor.padding, nil
+	case cursor.padding == nil || cursor.order == DaitaPaddingOrderDataFirst || cursor.data.queuedAt <= cursor.padding.queuedAt:
+		elem, cursor.data = cursor.data, nil
+	default:
+		elem, cursor.padding = cursor.padding, nil
+	}
+	return elem
+}
+
+// nextBypassing returns the next staged padding that may bypass blocking, or
+// nil if the cursor is done. The padding it passes over is staged again.
+func (peer *Peer) nextBypassing(cursor *stagedCursor) *QueueOutboundElement {
+	for cursor.paddingLeft > 0 {
+		cursor.paddingLeft--
+		var elem *QueueOutboundElement
+		select {
+		case elem = <-peer.queue.stagedPadding:
+			peer.queue.stagedPaddingClock.dequeued(elem.queuedAt)
+		default:
+			return nil
+		}
+		if elem.bypass {
+			return elem
+		}
+		peer.StagePadding(elem)
+	}
+	return nil
+}
+
+// restageCursor puts the elements held by cursor back into their queues.
+func (peer *Peer) restageCursor(cursor *stagedCursor) {
+	for _, elem := range []*QueueOutboundElement{cursor.data, cursor.padding} {
+		if elem != nil {
+			peer.restage(elem)
+		}
+	}
+	cursor.data, cursor.padding = nil, nil
+}
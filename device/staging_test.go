@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func stagingTestPeer(t *testing.T) *Peer {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	t.Cleanup(dev.Close)
+	sk, peerSk := NoisePrivateKey{8}, NoisePrivateKey{16}
+	pk := peerSk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	return dev.LookupPeer(pk)
+}
+
+// stageTagged stages a one byte packet, 'd' for data and 'p' for padding,
+// numbered by the second byte.
+func stageTagged(peer *Peer, kind byte, n byte) {
+	elem := peer.device.NewOutboundElement()
+	elem.packet = append(elem.buffer[MessageTransportHeaderSize:MessageTransportHeaderSize], kind, n)
+	if kind == 'p' {
+		peer.StagePadding(elem)
+	} else {
+		peer.StagePacket(elem)
+	}
+}
+
+// drainStaged runs a cursor to completion, calling during after every
+// element, and returns the elements in the order they were sent.
+func drainStaged(peer *Peer, during func()) string {
+	var order []byte
+	cursor := peer.newStagedCursor()
+	for elem := peer.nextStaged(&cursor); elem != nil; elem = peer.nextStaged(&cursor) {
+		order = append(order, elem.packet[0], '0'+elem.packet[1])
+		peer.device.PutMessageBuffer(elem.buffer)
+		peer.device.PutOutboundElement(elem)
+		if during != nil {
+			during()
+		}
+	}
+	return string(order)
+}
+
+func TestStagedPaddingOrder(t *testing.T) {
+	for _, tc := range []struct {
+		order DaitaPaddingOrder
+		want  string
+	}{
+		{DaitaPaddingOrderFIFO, "d1p1d2p2"},
+		{DaitaPaddingOrderDataFirst, "d1d2p1p2"},
+	} {
+		peer := stagingTestPeer(t)
+		peer.daitaPaddingOrder.Store(uint32(tc.order))
+		stageTagged(peer, 'd', 1)
+		stageTagged(peer, 'p', 1)
+		stageTagged(peer, 'd', 2)
+		stageTagged(peer, 'p', 2)
+		if got := drainStaged(peer, nil); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.order, tc.want, got)
+		}
+	}
+}
+
+func TestStagedNoStarvation(t *testing.T) {
+	for _, order := range []DaitaPaddingOrder{DaitaPaddingOrderFIFO, DaitaPaddingOrderDataFirst} {
+		for _, flood := range []byte{'d', 'p'} {
+			peer := stagingTestPeer(t)
+			peer.daitaPaddingOrder.Store(uint32(order))
+			stageTagged(peer, 'd', 1)
+			stageTagged(peer, 'p', 1)
+
+			// Whatever is staged while sending must wait for the next
+			// call, so it cannot hold back what was staged before.
+			got := drainStaged(peer, func() { stageTagged(peer, flood, 9) })
+			if len(got) != 4 {
+				t.Errorf("%v with %c flood: expected both staged elements and nothing else, got %s", order, flood, got)
+			}
+		}
+	}
+}
+
+func TestStagedPaddingDoesNotEvictData(t *testing.T) {
+	peer := stagingTestPeer(t)
+	stageTagged(peer, 'd', 1)
+	for i := 0; i < QueueStagedSize+10; i++ {
+		stageTagged(peer, 'p', 2)
+	}
+	if n := len(peer.queue.staged); n != 1 {
+		t.Errorf("expected staged data to survive a padding burst, got %d staged packets", n)
+	}
+	if n := len(peer.queue.stagedPadding); n != QueueStagedSize {
+		t.Errorf("expected %d staged padding packets, got %d", QueueStagedSize, n)
+	}
+}
+
+func TestFlushQueues(t *testing.T) {
+	peer := stagingTestPeer(t)
+	stageTagged(peer, 'd', 1)
+	stageTagged(peer, 'd', 2)
+	stageTagged(peer, 'p', 1)
+
+	// The peer is not running, so nothing takes packets off the outbound
+	// queue but the flush.
+	for _, padding := range []bool{false, true} {
+		elem := peer.device.NewOutboundElement()
+		elem.padding = padding
+		elem.queuedAt = queueNow()
+		peer.queue.outbound.c <- elem
+	}
+
+	if err := peer.device.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(peer.handshake.remoteStatic[:]),
+		"flush_queues", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(peer.queue.staged) + len(peer.queue.stagedPadding) + len(peer.queue.outbound.c); n != 0 {
+		t.Errorf("expected empty queues, got %d packets", n)
+	}
+
+	stageTagged(peer, 'd', 3)
+	stageTagged(peer, 'p', 2)
+	if dropped := peer.FlushQueues(); dropped != 1 {
+		t.Errorf("expected 1 dropped packet, got %d", dropped)
+	}
+}
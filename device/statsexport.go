@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStatsInterval = 10 * time.Second
+
+	// statsDatagramSize is the largest datagram the exporter sends, so that
+	// its datagrams are not fragmented on common paths.
+	statsDatagramSize = 1400
+)
+
+// The stats exporter periodically pushes the counters of every peer over UDP,
+// so that headless servers can collect metrics without scraping the UAPI. It
+// is configured with the "stats_sink" UAPI key, one of:
+//
+//	statsd:<host:port>   statsd gauges named wireguard.peer.<public key>.<counter>
+//	json:<host:port>     a JSON object per peer and datagram
+//	none                 no export
+//
+// and pushes every "stats_interval", a duration defaulting to
+// DefaultStatsInterval.
+type statsExport struct {
+	sync.Mutex
+	sink     string // as configured, for IpcGet
+	conn     net.Conn
+	interval time.Duration // 0 for DefaultStatsInterval
+	reset    chan struct{} // wakes the exporter to pick up a new interval
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// statsCounter is a counter of a peer, named as in the UAPI.
+type statsCounter struct {
+	name  string
+	value uint64
+}
+
+func (peer *Peer) statsCounters() []statsCounter {
+	return []statsCounter{
+		{"rx_bytes", peer.rxBytes.Load()},
+		{"tx_bytes", peer.txBytes.Load()},
+		{"last_handshake_time_sec", uint64(peer.lastHandshakeNano.Load() / int64(time.Second))},
+		{"rx_dropped_non_ip", peer.rxDroppedNonIP.Load()},
+		{"rx_dropped_daita_marker", peer.rxDroppedDaitaMarker.Load()},
+		{"rx_daita_padding", peer.rxDaitaPadding.Load()},
+		{"rx_daita_padding_bytes", peer.rxDaitaPaddingBytes.Load()},
+		{"rx_daita_padding_malformed", peer.rxDaitaMalformed.Load()},
+		{"rx_duplicates", peer.rxDuplicates.Load()},
+		{"rx_relayed", peer.rxRelayed.Load()},
+		{"tx_duplicates", peer.multipath.txDuplicates.Load()},
+		{"rx_dedup_dropped", peer.dedup.dropped.Load()},
+		{"clock_skew_alerts", peer.clockSkew.alerts.Load()},
+		{"rtt_nsec", uint64(peer.rtt.estimate())},
+		{"tx_dropped_no_keypair", peer.noKeypairDrops.total.Load()},
+		{"tx_dropped_staged_overflow", peer.txStagedOverflow.Load()},
+		{"last_error_time_sec", peer.lastErrorTimeSec()},
+		{"tx_dropped_direction", peer.direction.txDropped.Load()},
+		{"rx_dropped_direction", peer.direction.rxDropped.Load()},
+		{"tx_packets_tcp", peer.classifier.packets[TrafficTCP].Load()},
+		{"tx_packets_udp", peer.classifier.packets[TrafficUDP].Load()},
+		{"tx_packets_icmp", peer.classifier.packets[TrafficICMP].Load()},
+		{"tx_packets_other", peer.classifier.packets[TrafficOther].Load()},
+		{"rekey_message_limit", peer.rekeys.messageLimit.Load()},
+		{"rekey_time_limit", peer.rekeys.timeLimit.Load()},
+		{"reject_message_limit", peer.rekeys.rejectMessage.Load()},
+		{"reject_time_limit", peer.rekeys.rejectTime.Load()},
+		{"nonce_warnings", peer.rekeys.nonceWarnings.Load()},
+		{"rx_hop_limit_changes", peer.ipHeaders.hopLimitChanges.Load()},
+		{"rx_dscp_changes", peer.ipHeaders.dscpChanges.Load()},
+		{"tx_dropped_send_circuit", peer.sendCircuit.dropped.Load()},
+	}
+}
+
+// SetStatsSink starts pushing the counters of every peer to sink, in the
+// syntax of the "stats_sink" UAPI key, or stops pushing them if sink is
+// "none".
+func (device *Device) SetStatsSink(sink string) error {
+	addr, asJSON, err := parseStatsSink(sink)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn
+	if addr != "" {
+		if conn, err = net.Dial("udp", addr); err != nil {
+			return err
+		}
+	}
+
+	export := &device.statsExport
+	export.Lock()
+	defer export.Unlock()
+	export.stopLocked()
+	if conn == nil {
+		export.sink = ""
+		return nil
+	}
+	export.sink, export.conn = sink, conn
+	export.reset = make(chan struct{}, 1)
+	export.stop, export.stopped = make(chan struct{}), make(chan struct{})
+	go device.routineStatsExport(conn, asJSON, export.reset, export.stop, export.stopped)
+	return nil
+}
+
+// parseStatsSink returns the address and format of sink, or an empty address
+// for "none".
+func parseStatsSink(sink string) (addr string, asJSON bool, err error) {
+	if sink == "none" {
+		return "", false, nil
+	}
+	format, addr, ok := strings.Cut(sink, ":")
+	if !ok || addr == "" {
+		return "", false, fmt.Errorf("invalid stats sink %q", sink)
+	}
+	switch format {
+	case "json":
+		asJSON = true
+	case "statsd":
+	default:
+		return "", false, fmt.Errorf("unknown stats sink format %q", format)
+	}
+	return addr, asJSON, nil
+}
+
+// SetStatsInterval sets how often the stats exporter pushes the counters, or
+// restores the default if interval is 0.
+func (device *Device) SetStatsInterval(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("negative stats interval %v", interval)
+	}
+	export := &device.statsExport
+	export.Lock()
+	defer export.Unlock()
+	export.interval = interval
+	if export.conn != nil {
+		select {
+		case export.reset <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// statsExportConfig returns the sink and the interval of the exporter, as
+// configured.
+func (device *Device) statsExportConfig() (sink string, interval time.Duration) {
+	export := &device.statsExport
+	export.Lock()
+	defer export.Unlock()
+	return export.sink, export.interval
+}
+
+func (export *statsExport) intervalLocked() time.Duration {
+	if export.interval == 0 {
+		return DefaultStatsInterval
+	}
+	return export.interval
+}
+
+// stopLocked stops the exporter, if running, and waits for it to return.
+func (export *statsExport) stopLocked() {
+	if export.conn == nil {
+		return
+	}
+	close(export.stop)
+	<-export.stopped
+	export.conn.Close()
+	export.conn = nil
+}
+
+func (device *Device) stopStatsExport() {
+	export := &device.statsExport
+	export.Lock()
+	defer export.Unlock()
+	export.stopLocked()
+	export.sink = ""
+}
+
+// routineStatsExport pushes the counters every interval until stop is
+// closed, restarting the interval whenever reset is signaled.
+func (device *Device) routineStatsExport(conn net.Conn, asJSON bool, reset, stop <-chan struct{}, stopped chan<- struct{}) {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
+	defer close(stopped)
+	device.log.Verbosef("Routine: stats exporter - started")
+	defer device.log.Verbosef("Routine: stats exporter - stopped")
+
+	for {
+		device.statsExport.Lock()
+		interval := device.statsExport.intervalLocked()
+		device.statsExport.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-reset:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		if err := device.pushStats(conn, asJSON); err != nil {
+			device.log.Verbosef("Failed to push stats: %v", err)
+		}
+	}
+}
+
+// pushStats sends the counters of every peer to conn.
+func (device *Device) pushStats(conn net.Conn, asJSON bool) error {
+	device.peers.RLock()
+	peers := make(map[NoisePublicKey][]statsCounter, len(device.peers.keyMap))
+	for pk, peer := range device.peers.keyMap {
+		peers[pk] = peer.statsCounters()
+	}
+	device.peers.RUnlock()
+
+	if asJSON {
+		return pushStatsJSON(conn, peers)
+	}
+	return pushStatsd(conn, peers)
+}
+
+// pushStatsd sends the counters as statsd gauges, as many per datagram as fit.
+func pushStatsd(conn net.Conn, peers map[NoisePublicKey][]statsCounter) error {
+	var datagram bytes.Buffer
+	flush := func() error {
+		if datagram.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(datagram.Bytes())
+		datagram.Reset()
+		return err
+	}
+	for pk, counters := range peers {
+		for _, counter := range counters {
+			line := fmt.Sprintf("wireguard.peer.%s.%s:%d|g", hex.EncodeToString(pk[:]), counter.name, counter.value)
+			if datagram.Len() > 0 && datagram.Len()+1+len(line) > statsDatagramSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if datagram.Len() > 0 {
+				datagram.WriteByte('\n')
+			}
+			datagram.WriteString(line)
+		}
+	}
+	return flush()
+}
+
+// pushStatsJSON sends the counters of each peer as a JSON object, along with
+// its public key and the time of the push.
+func pushStatsJSON(conn net.Conn, peers map[NoisePublicKey][]statsCounter) error {
+	now := time.Now().Unix()
+	for pk, counters := range peers {
+		object := make(map[string]any, len(counters)+2)
+		object["public_key"] = hex.EncodeToString(pk[:])
+		object["time"] = now
+		for _, counter := range counters {
+			object[counter.name] = counter.value
+		}
+		datagram, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
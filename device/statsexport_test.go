@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsExport(t *testing.T) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, 2048)
+		sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := sink.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peerHex := hex.EncodeToString(pk[:])
+
+	if err := dev.IpcSet(uapiCfg(
+		"stats_interval", "20ms",
+		"stats_sink", "statsd:"+sink.LocalAddr().String(),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	datagram := receive()
+	if !strings.Contains(datagram, "wireguard.peer."+peerHex+".rx_bytes:") || !strings.HasSuffix(strings.SplitN(datagram, "\n", 2)[0], "|g") {
+		t.Errorf("unexpected statsd datagram %q", datagram)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"stats_sink=statsd:" + sink.LocalAddr().String() + "\n", "stats_interval=20ms\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("expected IpcGet to contain %q, got:\n%s", line, cfg)
+		}
+	}
+
+	if err := dev.IpcSet(uapiCfg("stats_sink", "json:"+sink.LocalAddr().String())); err != nil {
+		t.Fatal(err)
+	}
+	var stats struct {
+		PublicKey string `json:"public_key"`
+		RxBytes   uint64 `json:"rx_bytes"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); stats.PublicKey == "" && time.Now().Before(deadline); {
+		// Skip statsd datagrams sent before the switch.
+		json.Unmarshal([]byte(receive()), &stats)
+	}
+	if stats.PublicKey != peerHex || stats.RxBytes == 0 {
+		t.Errorf("unexpected JSON stats %+v", stats)
+	}
+
+	if err := dev.IpcSet(uapiCfg("stats_sink", "none")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _ := dev.IpcGet(); strings.Contains(cfg, "stats_sink=") {
+		t.Errorf("stats sink still configured:\n%s", cfg)
+	}
+	if err := dev.IpcSet(uapiCfg("stats_sink", "graphite:127.0.0.1:2003")); err == nil {
+		t.Error("unknown stats sink format accepted")
+	}
+}
@@ -0,0 +1,33 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStealthHandshakeUnderLoad(t *testing.T) {
+	pair := genTestPair(t, false)
+	responder := pair[0].dev
+	if err := responder.IpcSet(uapiCfg("stealth", "true")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := responder.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "stealth=true\n") {
+		t.Fatalf("stealth missing from IpcGet:\n%s", cfg)
+	}
+
+	// Without stealth mode, the initiation would be answered with a cookie
+	// reply, and the handshake would only complete on the retry after
+	// RekeyTimeout, which is as long as pair.Send waits.
+	responder.rate.underLoadUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	pair.Send(t, Ping, nil)
+}
@@ -52,6 +52,8 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 	var reqPeer map[uint32]peerEndpointPtr
 	var reqPeerLock sync.Mutex
 
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	defer netlinkCancel.Close()
 	defer unix.Close(netlinkSock)
 
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// SwapBind replaces the bind of the device with newBind at runtime, for
+// example to move between a StdNetBind, an obfuscating bind and a multihop
+// bind, keeping the peers and their sessions. Sending waits while the binds
+// are swapped. The old bind is closed, and if the device is up, the new one is
+// opened on the same port if it can be, or a random port otherwise. The
+// endpoints of the peers are parsed again by the new bind; packets already
+// queued for an endpoint of the old bind may be dropped.
+//
+// If the new bind fails to open, the old one is reopened and the error is
+// returned.
+func (device *Device) SwapBind(newBind conn.Bind) error {
+	// Holding the state lock keeps the device from going up or down, which
+	// opens and closes the bind, during the swap.
+	device.state.Lock()
+	defer device.state.Unlock()
+	if device.isClosed() {
+		return errors.New("device closed")
+	}
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	// Closing the bind makes its receive routines return, and holding the net
+	// mutex keeps senders out.
+	if err := closeBindLocked(device); err != nil {
+		device.log.Verbosef("Failed to close the old bind: %v", err)
+	}
+	oldBind := device.net.bind
+	device.net.bind = newBind
+	device.rebindEndpointsLocked()
+	if !device.isUp() {
+		device.log.Verbosef("UDP bind has been swapped")
+		device.notify(NotificationBindSwapped, nil, "bind swapped while the device is down")
+		return nil
+	}
+
+	port := device.net.port
+	err := openBindLocked(device)
+	if err != nil && port != 0 {
+		device.log.Verbosef("Failed to open the new bind on port %d, trying a random port: %v", port, err)
+		device.net.port = 0
+		err = openBindLocked(device)
+	}
+	if err == nil {
+		device.log.Verbosef("UDP bind has been swapped, listening on port %d", device.net.port)
+		device.notify(NotificationBindSwapped, nil, fmt.Sprintf("bind swapped, listening on port %d", device.net.port))
+		return nil
+	}
+
+	device.log.Errorf("Failed to open the new bind, restoring the old one: %v", err)
+	device.net.bind = oldBind
+	device.rebindEndpointsLocked()
+	device.net.port = port
+	if restoreErr := openBindLocked(device); restoreErr != nil {
+		device.log.Errorf("Failed to reopen the old bind: %v", restoreErr)
+	}
+	return fmt.Errorf("unable to open new bind: %w", err)
+}
+
+// rebindEndpointsLocked parses the endpoints of every peer again with the
+// bind of the device, as endpoints are specific to the bind that parsed them.
+// The caller must hold the net mutex.
+func (device *Device) rebindEndpointsLocked() {
+	bind := device.net.bind
+	rebind := func(endpoint conn.Endpoint) conn.Endpoint {
+		if endpoint == nil {
+			return nil
+		}
+		rebound, err := bind.ParseEndpoint(endpoint.DstToString())
+		if err != nil {
+			device.log.Verbosef("Failed to parse endpoint %s with the new bind: %v", endpoint.DstToString(), err)
+			return endpoint
+		}
+		return rebound
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		peer.endpoint = rebind(peer.endpoint)
+		peer.multipath.endpoint = rebind(peer.multipath.endpoint)
+		peer.latch.handshake = rebind(peer.latch.handshake)
+		failover := &peer.failover
+		failover.lastGood = rebind(failover.lastGood)
+		failover.configured = rebind(failover.configured)
+		for i, candidate := range failover.candidates {
+			failover.candidates[i] = rebind(candidate)
+		}
+		peer.Unlock()
+	}
+}
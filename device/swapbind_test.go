@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// countingBind counts the packets sent through it.
+type countingBind struct {
+	conn.Bind
+	sent atomic.Uint64
+}
+
+func (bind *countingBind) Send(b []byte, ep conn.Endpoint) error {
+	bind.sent.Add(1)
+	return bind.Bind.Send(b, ep)
+}
+
+// failingBind fails to open.
+type failingBind struct {
+	conn.Bind
+}
+
+func (failingBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	return nil, 0, errors.New("failing bind")
+}
+
+func TestSwapBind(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+	port := dev.net.port
+
+	swapped := &countingBind{Bind: conn.NewDefaultBind()}
+	if err := dev.SwapBind(swapped); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Bind() != swapped {
+		t.Fatal("bind not swapped")
+	}
+	if dev.net.port != port {
+		t.Errorf("listening on port %d after the swap, want %d", dev.net.port, port)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if swapped.sent.Load() == 0 {
+		t.Error("nothing sent through the new bind")
+	}
+	if peer.keypairs.Current() != keypair {
+		t.Error("session lost in the swap")
+	}
+
+	// A bind that fails to open is swapped back.
+	if err := dev.SwapBind(failingBind{conn.NewDefaultBind()}); err == nil {
+		t.Fatal("swapped to a bind that fails to open")
+	}
+	if dev.Bind() != swapped {
+		t.Fatal("old bind not restored")
+	}
+	pair.Send(t, Pong, nil)
+
+	// A device that is down opens the new bind when it comes up.
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	down := &countingBind{Bind: conn.NewDefaultBind()}
+	if err := dev.SwapBind(down); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+	if down.sent.Load() == 0 {
+		t.Error("nothing sent through the bind swapped in while down")
+	}
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// SwapTUN replaces the TUN device of the device with newTun at runtime, for
+// example to replace a TUN device that failed, or to move between a native
+// TUN device and netstack, keeping the peers and their sessions. Writes of
+// received packets pause while the devices are swapped, so that no packet is
+// lost to the swap, and resume on newTun; SwapTUN waits for the writes in
+// progress to complete. The old device is flushed and closed, and the packets
+// read from it are sent as usual, while those still pending on it are lost.
+//
+// The device takes ownership of newTun, and takes its MTU. The events of the
+// old device after the swap, such as its closing, are ignored.
+func (device *Device) SwapTUN(newTun tun.Device) error {
+	// Holding the state lock keeps the device from closing, which closes the
+	// TUN device, during the swap.
+	device.state.Lock()
+	defer device.state.Unlock()
+	if device.isClosed() {
+		return errors.New("device closed")
+	}
+
+	device.tun.Lock()
+	oldTun := device.tun.device
+	if err := oldTun.Flush(); err != nil {
+		device.log.Verbosef("Failed to flush the old TUN device: %v", err)
+	}
+	device.tun.device = newTun
+	device.tun.generation++
+	device.tun.Unlock()
+
+	mtu, err := newTun.MTU()
+	if err != nil {
+		device.log.Errorf("Trouble determining MTU of the new TUN device, assuming default: %v", err)
+		mtu = DefaultMTU
+	}
+	device.tun.mtu.Store(int32(mtu))
+
+	// Closing the old device makes the TUN reader and event routines move on
+	// to the new one.
+	if err := oldTun.Close(); err != nil {
+		device.log.Verbosef("Failed to close the old TUN device: %v", err)
+	}
+	device.log.Verbosef("TUN device has been swapped, MTU %d", mtu)
+	return nil
+}
+
+// currentTUN returns the TUN device of the device, and its generation, which
+// SwapTUN increments when it replaces the device.
+func (device *Device) currentTUN() (tun.Device, uint64) {
+	device.tun.RLock()
+	defer device.tun.RUnlock()
+	return device.tun.device, device.tun.generation
+}
@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSwapTUN(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+
+	oldTun := pair[0].tun
+	pair[0].tun = tuntest.NewChannelTUN()
+	if err := dev.SwapTUN(pair[0].tun.TUN()); err != nil {
+		t.Fatal(err)
+	}
+	// Packets are both read from and written to the new device.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if peer.keypairs.Current() != keypair {
+		t.Error("session lost in the swap")
+	}
+	if !dev.isUp() {
+		t.Error("device not up after the swap")
+	}
+
+	if _, err := oldTun.TUN().Read(make([]byte, 1), 0); err == nil {
+		t.Error("old device not closed")
+	}
+
+	dev.Close()
+	if err := dev.SwapTUN(tuntest.NewChannelTUN().TUN()); err == nil {
+		t.Error("swapped the TUN device of a closed device")
+	}
+}
@@ -8,7 +8,6 @@
 package device
 
 import (
-	"sync"
 	"time"
 	_ "unsafe"
 )
@@ -16,62 +15,6 @@ import (
 //go:linkname fastrandn runtime.fastrandn
 func fastrandn(n uint32) uint32
 
-// A Timer manages time-based aspects of the WireGuard protocol.
-// Timer roughly copies the interface of the Linux kernel's struct timer_list.
-type Timer struct {
-	*time.Timer
-	modifyingLock sync.RWMutex
-	runningLock   sync.Mutex
-	isPending     bool
-}
-
-func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
-	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
-		timer.runningLock.Lock()
-		defer timer.runningLock.Unlock()
-
-		timer.modifyingLock.Lock()
-		if !timer.isPending {
-			timer.modifyingLock.Unlock()
-			return
-		}
-		timer.isPending = false
-		timer.modifyingLock.Unlock()
-
-		expirationFunction(peer)
-	})
-	timer.Stop()
-	return timer
-}
-
-func (timer *Timer) Mod(d time.Duration) {
-	timer.modifyingLock.Lock()
-	timer.isPending = true
-	timer.Reset(d)
-	timer.modifyingLock.Unlock()
-}
-
-func (timer *Timer) Del() {
-	timer.modifyingLock.Lock()
-	timer.isPending = false
-	timer.Stop()
-	timer.modifyingLock.Unlock()
-}
-
-func (timer *Timer) DelSync() {
-	timer.Del()
-	timer.runningLock.Lock()
-	timer.Del()
-	timer.runningLock.Unlock()
-}
-
-func (timer *Timer) IsPending() bool {
-	timer.modifyingLock.RLock()
-	defer timer.modifyingLock.RUnlock()
-	return timer.isPending
-}
-
 func (peer *Peer) timersActive() bool {
 	return peer.isRunning.Load() && peer.device != nil && peer.device.isUp()
 }
@@ -87,7 +30,8 @@ func expiredRetransmitHandshake(peer *Peer) {
 		/* We drop all packets without a keypair and don't try again,
 		 * if we try unsuccessfully for too long to make a handshake.
 		 */
-		peer.FlushStagedPackets()
+		peer.droppedNoKeypair(peer.flushStaged())
+		peer.reportNoKeypairDrops(false)
 
 		/* We set a timer for destroying any residue that might be left
 		 * of a partial exchange.
@@ -96,7 +40,8 @@ func expiredRetransmitHandshake(peer *Peer) {
 			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
 		}
 	} else {
-		peer.timers.handshakeAttempts.Add(1)
+		attempts := peer.timers.handshakeAttempts.Add(1)
+		peer.clockSkewRetransmit(attempts)
 		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
@@ -106,6 +51,10 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 		peer.Unlock()
 
+		/* If the endpoint itself is the cause of trouble, try another one. */
+		peer.unlatchEndpoint()
+		peer.failoverEndpoint()
+
 		peer.SendHandshakeInitiation(true)
 	}
 }
@@ -137,7 +86,7 @@ func expiredZeroKeyMaterial(peer *Peer) {
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval.Load() > 0 {
+	if peer.keepaliveInterval() > 0 {
 		peer.SendKeepalive()
 	}
 }
@@ -145,7 +94,7 @@ func expiredPersistentKeepalive(peer *Peer) {
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + peer.device.handshakeJitter())
 	}
 }
 
@@ -177,7 +126,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(RekeyTimeout + peer.device.handshakeJitter())
 	}
 }
 
@@ -189,6 +138,11 @@ func (peer *Peer) timersHandshakeComplete() {
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
 	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.clockSkewHandshakeComplete()
+	peer.reportNoKeypairDrops(true)
+	peer.markEndpointGood()
+	peer.announceFeatures()
+	peer.offerCompression()
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -200,7 +154,7 @@ func (peer *Peer) timersSessionDerived() {
 
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
-	keepalive := peer.persistentKeepaliveInterval.Load()
+	keepalive := peer.keepaliveInterval()
 	if keepalive > 0 && peer.timersActive() {
 		peer.timers.persistentKeepalive.Mod(time.Duration(keepalive) * time.Second)
 	}
@@ -0,0 +1,297 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The timers of all peers of a device share a hierarchical timing wheel, so
+// that timers expiring close to each other are handled in a single wakeup,
+// which matters for devices with hundreds of peers. As in the timer wheel of
+// the Linux kernel, which the kernel implementation of WireGuard relies on,
+// timers are not cascaded between levels: a timer expires at the granularity
+// of the level it was placed in, so up to about 12.5% late, and never early.
+const (
+	timerWheelTick       = 4 * time.Millisecond
+	timerWheelLevelShift = 3 // each level is 8 times coarser than the previous one
+	timerWheelSlotBits   = 6
+	timerWheelSlots      = 1 << timerWheelSlotBits
+	timerWheelLevels     = 6 // the last level holds timers of up to about 2 hours
+
+	// timerWheelMaxDelta is the longest delay, in ticks, that fits in the
+	// wheel. Longer timers are clamped to it.
+	timerWheelMaxDelta = (timerWheelSlots-1)<<(timerWheelLevelShift*(timerWheelLevels-1)) - 1
+)
+
+type timerWheel struct {
+	sync.Mutex
+	start   time.Time // time of tick 0
+	now     uint64    // last tick whose timers have been collected
+	slots   [timerWheelLevels][timerWheelSlots]*Timer
+	pending [timerWheelLevels]uint64 // bitmaps of the non-empty slots
+	next    uint64                   // tick the driver sleeps until, or 0 if idle
+	wake    chan struct{}
+
+	wakeups atomic.Uint64 // wakeups of the driver that expired timers
+	expired atomic.Uint64 // timers expired
+}
+
+func newTimerWheel() *timerWheel {
+	return &timerWheel{
+		start: time.Now(),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// tick returns the current tick.
+func (wheel *timerWheel) tick() uint64 {
+	return uint64(time.Since(wheel.start) / timerWheelTick)
+}
+
+// placeLocked links timer in the slot of the level whose granularity suits
+// its expiry, and returns the tick at which the slot is handled.
+func (wheel *timerWheel) placeLocked(timer *Timer, expires uint64) uint64 {
+	delta := expires - wheel.now
+	if expires <= wheel.now {
+		delta = 1
+	}
+	delta = min(delta, timerWheelMaxDelta)
+	level := 0
+	for delta >= (timerWheelSlots-1)<<(timerWheelLevelShift*level) {
+		level++
+	}
+	shift := timerWheelLevelShift * level
+	index := (wheel.now + delta + 1<<shift - 1) >> shift // round up to the granularity
+	slot := int(index & (timerWheelSlots - 1))
+
+	timer.level, timer.slot = level, slot
+	timer.prev = nil
+	timer.next = wheel.slots[level][slot]
+	if timer.next != nil {
+		timer.next.prev = timer
+	}
+	wheel.slots[level][slot] = timer
+	wheel.pending[level] |= 1 << slot
+	return index << shift
+}
+
+func (wheel *timerWheel) unlinkLocked(timer *Timer) {
+	if timer.prev != nil {
+		timer.prev.next = timer.next
+	} else {
+		wheel.slots[timer.level][timer.slot] = timer.next
+		if timer.next == nil {
+			wheel.pending[timer.level] &^= 1 << timer.slot
+		}
+	}
+	if timer.next != nil {
+		timer.next.prev = timer.prev
+	}
+	timer.prev, timer.next = nil, nil
+	timer.level = -1
+}
+
+// nextLocked returns the next tick after wheel.now at which a slot holding
+// timers is handled, or 0 if there are no timers.
+func (wheel *timerWheel) nextLocked() uint64 {
+	var next uint64
+	for level := range wheel.pending {
+		pending := wheel.pending[level]
+		if pending == 0 {
+			continue
+		}
+		shift := timerWheelLevelShift * level
+		base := wheel.now>>shift + 1
+		offset := uint64(bits.TrailingZeros64(bits.RotateLeft64(pending, -int(base&(timerWheelSlots-1)))))
+		if at := (base + offset) << shift; next == 0 || at < next {
+			next = at
+		}
+	}
+	return next
+}
+
+// collectLocked advances the wheel to tick, and returns the timers that
+// expired on the way, unlinked.
+func (wheel *timerWheel) collectLocked(tick uint64) (expired []*Timer) {
+	for {
+		next := wheel.nextLocked()
+		if next == 0 || next > tick {
+			wheel.now = tick
+			return expired
+		}
+		wheel.now = next
+		for level := 0; level < timerWheelLevels; level++ {
+			shift := timerWheelLevelShift * level
+			if next&(1<<shift-1) != 0 {
+				break
+			}
+			slot := (next >> shift) & (timerWheelSlots - 1)
+			for timer := wheel.slots[level][slot]; timer != nil; {
+				next := timer.next
+				timer.prev, timer.next = nil, nil
+				timer.level = -1
+				expired = append(expired, timer)
+				timer = next
+			}
+			wheel.slots[level][slot] = nil
+			wheel.pending[level] &^= 1 << slot
+		}
+	}
+}
+
+// run drives the wheel until closed is closed, sleeping until the next slot
+// holding timers is due, and starting the expiration of each timer in its own
+// goroutine, as time.AfterFunc does.
+func (wheel *timerWheel) run(closed <-chan struct{}) {
+	sleep := time.NewTimer(time.Hour)
+	sleep.Stop()
+	defer sleep.Stop()
+	for {
+		wheel.Lock()
+		expired := wheel.collectLocked(wheel.tick())
+		wheel.next = wheel.nextLocked()
+		next := wheel.next
+		wheel.Unlock()
+
+		if len(expired) > 0 {
+			wheel.wakeups.Add(1)
+			wheel.expired.Add(uint64(len(expired)))
+			for _, timer := range expired {
+				go timer.expire()
+			}
+		}
+
+		if next != 0 {
+			sleep.Reset(time.Until(wheel.start.Add(time.Duration(next) * timerWheelTick)))
+		}
+		select {
+		case <-closed:
+			return
+		case <-wheel.wake:
+		case <-sleep.C:
+		}
+		if !sleep.Stop() {
+			select {
+			case <-sleep.C:
+			default:
+			}
+		}
+	}
+}
+
+// A Timer manages time-based aspects of the WireGuard protocol.
+// Timer roughly copies the interface of the Linux kernel's struct timer_list.
+type Timer struct {
+	wheel       *timerWheel
+	expiration  func()
+	runningLock sync.Mutex
+	isPending   atomic.Bool // written with the wheel locked
+
+	// protected by the wheel's mutex
+	level, slot int // level is -1 if the timer is not linked
+	prev, next  *Timer
+}
+
+func newTimer(wheel *timerWheel, expiration func()) *Timer {
+	return &Timer{
+		wheel:      wheel,
+		expiration: expiration,
+		level:      -1,
+	}
+}
+
+func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
+	return newTimer(peer.device.timerWheel, func() {
+		peer.device.goroutineEnter(GoroutineTimer)
+		defer peer.device.goroutineExit(GoroutineTimer)
+		expirationFunction(peer)
+	})
+}
+
+// expire runs the expiration function of the timer, unless it has been
+// deleted or modified since it expired.
+func (timer *Timer) expire() {
+	timer.runningLock.Lock()
+	defer timer.runningLock.Unlock()
+
+	wheel := timer.wheel
+	wheel.Lock()
+	if !timer.isPending.Load() || timer.level >= 0 {
+		wheel.Unlock()
+		return
+	}
+	timer.isPending.Store(false)
+	wheel.Unlock()
+
+	timer.expiration()
+}
+
+func (timer *Timer) Mod(d time.Duration) {
+	wheel := timer.wheel
+	wheel.Lock()
+	if timer.level >= 0 {
+		wheel.unlinkLocked(timer)
+	}
+	timer.isPending.Store(true)
+	now := wheel.tick()
+	if wheel.next == 0 || wheel.next > now {
+		// No timer is due, so the wheel can catch up with the clock, and
+		// place the timer at the granularity its delay calls for.
+		wheel.now = max(wheel.now, now)
+	}
+	// The current tick has partly elapsed, hence the extra tick.
+	due := wheel.placeLocked(timer, now+1+uint64((max(d, 0)+timerWheelTick-1)/timerWheelTick))
+	wake := wheel.next == 0 || due < wheel.next
+	if wake {
+		wheel.next = due
+	}
+	wheel.Unlock()
+
+	if wake {
+		select {
+		case wheel.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (timer *Timer) Del() {
+	if !timer.isPending.Load() {
+		return
+	}
+	wheel := timer.wheel
+	wheel.Lock()
+	if timer.level >= 0 {
+		wheel.unlinkLocked(timer)
+	}
+	timer.isPending.Store(false)
+	wheel.Unlock()
+}
+
+func (timer *Timer) DelSync() {
+	timer.Del()
+	timer.runningLock.Lock()
+	timer.Del()
+	timer.runningLock.Unlock()
+}
+
+func (timer *Timer) IsPending() bool {
+	return timer.isPending.Load()
+}
+
+// RoutineTimerWheel drives the timer wheel of the device until it is closed.
+func (device *Device) RoutineTimerWheel() {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
+	device.log.Verbosef("Routine: timer wheel - started")
+	defer device.log.Verbosef("Routine: timer wheel - stopped")
+
+	device.timerWheel.run(device.closed)
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerWheelPlacement(t *testing.T) {
+	wheel := newTimerWheel()
+	wheel.now = uint64(rand.Int63n(1 << 40))
+	start := wheel.now
+
+	expires := make(map[*Timer]uint64)
+	for i := 0; i < 2000; i++ {
+		timer := newTimer(wheel, nil)
+		delta := uint64(rand.Int63n(1<<uint(rand.Intn(18))) + 1)
+		expires[timer] = start + delta
+		wheel.placeLocked(timer, start+delta)
+	}
+
+	for tick := start + 1; len(expires) > 0; tick++ {
+		if tick > start+1<<19 {
+			t.Fatalf("%d timers did not expire", len(expires))
+		}
+		for _, timer := range wheel.collectLocked(tick) {
+			due := expires[timer]
+			delete(expires, timer)
+			if tick < due {
+				t.Fatalf("timer due at %d expired early at %d", due-start, tick-start)
+			}
+			if late := tick - due; late > 1 && late > (due-start)/7 {
+				t.Errorf("timer due at %d expired %d ticks late", due-start, late)
+			}
+		}
+	}
+	if next := wheel.nextLocked(); next != 0 {
+		t.Errorf("wheel not empty, next at %d", next)
+	}
+}
+
+func TestTimerWheelExpiry(t *testing.T) {
+	wheel := newTimerWheel()
+	closed := make(chan struct{})
+	defer close(closed)
+	go wheel.run(closed)
+
+	var wg sync.WaitGroup
+	for _, d := range []time.Duration{0, time.Millisecond, 20 * time.Millisecond, 300 * time.Millisecond} {
+		d := d
+		wg.Add(1)
+		start := time.Now()
+		var timer *Timer
+		timer = newTimer(wheel, func() {
+			defer wg.Done()
+			if elapsed := time.Since(start); elapsed < d {
+				t.Errorf("timer of %v expired early, after %v", d, elapsed)
+			}
+			if timer.IsPending() {
+				t.Error("expired timer still pending")
+			}
+		})
+		timer.Mod(d)
+	}
+
+	deleted := newTimer(wheel, func() { t.Error("deleted timer expired") })
+	deleted.Mod(10 * time.Millisecond)
+	deleted.Del()
+	if deleted.IsPending() {
+		t.Error("deleted timer still pending")
+	}
+
+	// A timer modified before it expires only expires once, at the new time.
+	var modified sync.WaitGroup
+	modified.Add(1)
+	modifiedAt := time.Now()
+	rearmed := newTimer(wheel, func() {
+		if time.Since(modifiedAt) < 100*time.Millisecond {
+			t.Error("modified timer expired at its former time")
+		}
+		modified.Done()
+	})
+	rearmed.Mod(10 * time.Millisecond)
+	rearmed.Mod(100 * time.Millisecond)
+
+	wg.Wait()
+	modified.Wait()
+}
+
+func TestTimerWheelCoalescing(t *testing.T) {
+	wheel := newTimerWheel()
+	closed := make(chan struct{})
+	defer close(closed)
+	go wheel.run(closed)
+
+	// Timers of hundreds of peers, armed slightly apart, expire together.
+	const timers = 300
+	var wg sync.WaitGroup
+	wg.Add(timers)
+	for i := 0; i < timers; i++ {
+		newTimer(wheel, wg.Done).Mod(time.Second + time.Duration(i)*50*time.Microsecond)
+	}
+	wg.Wait()
+
+	if expired := wheel.expired.Load(); expired != timers {
+		t.Errorf("%d timers expired, want %d", expired, timers)
+	}
+	if wakeups := wheel.wakeups.Load(); wakeups > 4 {
+		t.Errorf("%d wakeups to expire %d timers", wakeups, timers)
+	}
+}
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceMaxPerSecond is the most packets of a peer traced per second, however
+// high its sample rate. Packets sampled beyond it are counted, and the count
+// is logged with the first trace of the next second.
+const TraceMaxPerSecond = 10
+
+// peerTrace samples the packets exchanged with a peer for tracing, set with
+// the "trace_sample_rate" UAPI key. Traces are logged at the verbose level.
+type peerTrace struct {
+	sampleRate atomic.Uint32 // trace every nth packet, 0 disables tracing
+	packets    atomic.Uint64 // packets seen while tracing
+
+	sync.Mutex        // protects the rate limit below, only taken for sampled packets
+	window     int64  // start of the current second, see queueNow
+	traced     uint32 // packets traced in the current second
+	suppressed uint64 // packets sampled but not traced since the last trace
+}
+
+// SetTraceSampleRate traces every nth packet exchanged with the peer, with
+// its size, direction, message type and queueing delay, or disables tracing
+// if n is 0.
+func (peer *Peer) SetTraceSampleRate(n uint32) {
+	peer.trace.sampleRate.Store(n)
+}
+
+// TraceSampleRate returns the rate set by SetTraceSampleRate.
+func (peer *Peer) TraceSampleRate() uint32 {
+	return peer.trace.sampleRate.Load()
+}
+
+func traceMessageType(msgType uint32, size int) string {
+	switch msgType {
+	case MessageInitiationType:
+		return "handshake initiation"
+	case MessageResponseType:
+		return "handshake response"
+	case MessageCookieReplyType:
+		return "cookie reply"
+	case MessageTransportType:
+		if size == MessageKeepaliveSize {
+			return "keepalive"
+		}
+		return "transport"
+	}
+	return "unknown"
+}
+
+// tracePacket traces a message of the peer if it is sampled. The message was
+// sent or received as given by sent, and queued at queuedAt, or 0 if it was
+// not queued.
+func (peer *Peer) tracePacket(sent bool, msgType uint32, size int, queuedAt int64) {
+	trace := &peer.trace
+	rate := trace.sampleRate.Load()
+	if rate == 0 || (trace.packets.Add(1)-1)%uint64(rate) != 0 {
+		return
+	}
+
+	now := queueNow()
+	trace.Lock()
+	if now-trace.window >= int64(time.Second) {
+		trace.window = now
+		trace.traced = 0
+	}
+	if trace.traced >= TraceMaxPerSecond {
+		trace.suppressed++
+		trace.Unlock()
+		return
+	}
+	trace.traced++
+	suppressed := trace.suppressed
+	trace.suppressed = 0
+	trace.Unlock()
+
+	log := peer.device.log
+	if suppressed != 0 {
+		log.Verbosef("%v - Trace: %d sampled packets not traced", peer, suppressed)
+	}
+	direction := "Received"
+	if sent {
+		direction = "Sent"
+	}
+	if queuedAt == 0 {
+		log.Verbosef("%v - Trace: %s %s of %d bytes", peer, direction, traceMessageType(msgType, size), size)
+		return
+	}
+	log.Verbosef("%v - Trace: %s %s of %d bytes, queued for %v", peer, direction, traceMessageType(msgType, size), size, time.Duration(now-queuedAt))
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// traceLog collects the traces logged by a device.
+type traceLog struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *traceLog) verbosef(format string, args ...any) {
+	if line := fmt.Sprintf(format, args...); strings.Contains(line, " - Trace: ") {
+		l.Lock()
+		l.lines = append(l.lines, line)
+		l.Unlock()
+	}
+}
+
+func (l *traceLog) take() []string {
+	l.Lock()
+	defer l.Unlock()
+	lines := l.lines
+	l.lines = nil
+	return lines
+}
+
+func TestPeerTrace(t *testing.T) {
+	var traces traceLog
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i == 0 {
+			logger = &Logger{Verbosef: traces.verbosef, Errorf: logger.Errorf}
+		}
+		return NewDevice(tun, bind, logger)
+	})
+	dev := pair[0].dev
+	pub := pair[1].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "trace_sample_rate", "1")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "trace_sample_rate=1\n") {
+		t.Errorf("trace_sample_rate missing from IpcGet:\n%s", cfg)
+	}
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pub[:]), "trace_sample_rate", "0")); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Join(traces.take(), "\n")
+	for _, want := range []string{
+		"Trace: Received handshake initiation of 148 bytes, queued for ",
+		"Trace: Sent handshake response of 92 bytes\n",
+		"Trace: Received transport of ",
+		"Trace: Sent transport of ",
+	} {
+		if !strings.Contains(lines+"\n", want) {
+			t.Errorf("expected a trace containing %q, got:\n%s", want, lines)
+		}
+	}
+
+	// Traces are limited to TraceMaxPerSecond, and the others are counted.
+	peer := &Peer{device: dev}
+	peer.SetTraceSampleRate(2)
+	for i := 0; i < 4*TraceMaxPerSecond; i++ {
+		peer.tracePacket(true, MessageTransportType, MessageKeepaliveSize, queueNow()-int64(time.Millisecond))
+	}
+	if n := len(traces.take()); n != TraceMaxPerSecond {
+		t.Errorf("expected %d traces, got %d", TraceMaxPerSecond, n)
+	}
+	if n := peer.trace.suppressed; n != TraceMaxPerSecond {
+		t.Errorf("expected %d suppressed traces, got %d", TraceMaxPerSecond, n)
+	}
+	peer.trace.window = 0
+	peer.tracePacket(false, MessageTransportType, MessageKeepaliveSize, 0)
+	lines = strings.Join(traces.take(), "\n")
+	if !strings.Contains(lines, fmt.Sprintf("%d sampled packets not traced", TraceMaxPerSecond)) || !strings.Contains(lines, "Received keepalive of 32 bytes") {
+		t.Errorf("unexpected traces after the rate limit:\n%s", lines)
+	}
+}
@@ -14,11 +14,35 @@ import (
 const DefaultMTU = 1420
 
 func (device *Device) RoutineTUNEventReader() {
+	device.goroutineEnter(GoroutineWorker)
+	defer device.goroutineExit(GoroutineWorker)
 	device.log.Verbosef("Routine: event worker - started")
 
-	for event := range device.tun.device.Events() {
+	tunDevice, generation := device.currentTUN()
+	for {
+		device.handleTUNEvents(tunDevice, generation)
+		// The events of a device end when it is closed, either by Close or by
+		// SwapTUN, which replaced it with another device.
+		current, currentGeneration := device.currentTUN()
+		if currentGeneration == generation {
+			break
+		}
+		tunDevice, generation = current, currentGeneration
+	}
+
+	device.log.Verbosef("Routine: event worker - stopped")
+}
+
+// handleTUNEvents handles the events of tunDevice until they end, ignoring
+// those sent once SwapTUN has replaced it.
+func (device *Device) handleTUNEvents(tunDevice tun.Device, generation uint64) {
+	for event := range tunDevice.Events() {
+		if _, current := device.currentTUN(); current != generation {
+			continue
+		}
+
 		if event&tun.EventMTUUpdate != 0 {
-			mtu, err := device.tun.device.MTU()
+			mtu, err := tunDevice.MTU()
 			if err != nil {
 				device.log.Errorf("Failed to load updated MTU of device: %v", err)
 				continue
@@ -48,6 +72,4 @@ func (device *Device) RoutineTUNEventReader() {
 			device.Down()
 		}
 	}
-
-	device.log.Verbosef("Routine: event worker - stopped")
 }
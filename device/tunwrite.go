@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A TUNWriteFailurePolicy decides what a Device does once writing received
+// packets to its TUN device fails persistently.
+type TUNWriteFailurePolicy int
+
+const (
+	// TUNWriteFailureNotify drops the packets that fail to be written, and
+	// only reports the failure. This is the default.
+	TUNWriteFailureNotify TUNWriteFailurePolicy = iota
+
+	// TUNWriteFailureDown brings the device down, which the embedder may
+	// bring up again once the TUN device has been repaired.
+	TUNWriteFailureDown
+
+	// TUNWriteFailureRetry retries writing each packet with exponential
+	// backoff, holding back the packets behind it, until it succeeds or the
+	// peer is stopped.
+	TUNWriteFailureRetry
+)
+
+func (policy TUNWriteFailurePolicy) String() string {
+	switch policy {
+	case TUNWriteFailureNotify:
+		return "notify"
+	case TUNWriteFailureDown:
+		return "down"
+	case TUNWriteFailureRetry:
+		return "retry"
+	}
+	return fmt.Sprintf("TUNWriteFailurePolicy(%d)", int(policy))
+}
+
+// writeToTUN writes a received packet to the TUN device, applying the
+// TUNWriteFailurePolicy of the device if the write fails.
+func (device *Device) writeToTUN(ctx context.Context, buf []byte, offset int) {
+	backoff := TUNWriteRetryMinBackoff
+	for {
+		// Writes wait while SwapTUN replaces the device.
+		device.tun.RLock()
+		_, err := device.tun.device.Write(buf, offset)
+		device.tun.RUnlock()
+		if err == nil {
+			device.tunWriteSucceeded()
+			return
+		}
+		if device.isClosed() {
+			return
+		}
+		persistent := device.tunWriteFailed(err)
+		if !persistent || device.options.tunWriteFailure != TUNWriteFailureRetry {
+			return
+		}
+		device.log.Verbosef("Retrying write to TUN device in %v", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, TUNWriteRetryMaxBackoff)
+	}
+}
+
+// flushTUN flushes the packets written to the TUN device.
+func (device *Device) flushTUN() error {
+	device.tun.RLock()
+	defer device.tun.RUnlock()
+	return device.tun.device.Flush()
+}
+
+// tunWriteFailed counts a failed write to the TUN device, reports the failure
+// when it becomes persistent, and returns whether it is.
+func (device *Device) tunWriteFailed(err error) bool {
+	threshold := uint32(device.options.tunWriteThreshold)
+	failures := device.tun.writeFailures.Add(1)
+	if failures < threshold {
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		return false
+	}
+	if failures > threshold {
+		return true
+	}
+
+	policy := device.options.tunWriteFailure
+	message := fmt.Sprintf("writing to TUN device failed %d times in a row: %v", failures, err)
+	device.log.Errorf("Persistent TUN device failure, applying policy %v: %s", policy, message)
+	device.notify(NotificationTUNWriteFailed, nil, message)
+	if policy == TUNWriteFailureDown {
+		// Count afresh once the device is brought up again.
+		device.tun.writeFailures.Store(0)
+		go device.Down()
+	}
+	return true
+}
+
+// tunWriteSucceeded resets the count of failed writes to the TUN device,
+// reporting the recovery from a persistent failure.
+func (device *Device) tunWriteSucceeded() {
+	if device.tun.writeFailures.Load() == 0 {
+		return
+	}
+	if device.tun.writeFailures.Swap(0) >= uint32(device.options.tunWriteThreshold) {
+		device.log.Verbosef("Writing to TUN device recovered")
+		device.notify(NotificationTUNWriteRecovered, nil, "writing to TUN device recovered")
+	}
+}
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// failingTUN fails every write while failing is set.
+type failingTUN struct {
+	tun.Device
+	failing atomic.Bool
+	writes  atomic.Uint32
+}
+
+func (t *failingTUN) Write(buf []byte, offset int) (int, error) {
+	if t.failing.Load() {
+		t.writes.Add(1)
+		return 0, errors.New("interface deleted")
+	}
+	return t.Device.Write(buf, offset)
+}
+
+// genFailingTUNPair creates a testPair whose first device writes to a
+// failingTUN, with the given failure policy and a threshold of 3.
+func genFailingTUNPair(t *testing.T, policy TUNWriteFailurePolicy) (testPair, *failingTUN, <-chan Notification) {
+	failing := new(failingTUN)
+	pair := genTestPairWith(t, false, func(i int, tun tun.Device, bind conn.Bind, logger *Logger) *Device {
+		if i != 0 {
+			return NewDevice(tun, bind, logger)
+		}
+		failing.Device = tun
+		return NewDeviceWithOptions(failing, bind, logger, WithTUNWriteFailurePolicy(policy, 3))
+	})
+	notifications := make(chan Notification, 8)
+	unsubscribe := pair[0].dev.Subscribe(func(n Notification) {
+		if n.Kind == NotificationTUNWriteFailed || n.Kind == NotificationTUNWriteRecovered {
+			notifications <- n
+		}
+	})
+	t.Cleanup(unsubscribe)
+	pair.Send(t, Ping, nil)
+	return pair, failing, notifications
+}
+
+func expectNotification(t *testing.T, notifications <-chan Notification, kind NotificationKind) {
+	t.Helper()
+	select {
+	case n := <-notifications:
+		if n.Kind != kind {
+			t.Fatalf("got notification %v, want %v", n.Kind, kind)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v notification", kind)
+	}
+}
+
+func sendPings(pair testPair, n int) {
+	for i := 0; i < n; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	}
+}
+
+func TestTUNWriteFailureNotify(t *testing.T) {
+	pair, failing, notifications := genFailingTUNPair(t, TUNWriteFailureNotify)
+	failing.failing.Store(true)
+	sendPings(pair, 2)
+	select {
+	case n := <-notifications:
+		t.Fatalf("unexpected %v notification below the threshold", n.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+	sendPings(pair, 4)
+	expectNotification(t, notifications, NotificationTUNWriteFailed)
+	select {
+	case n := <-notifications:
+		t.Fatalf("unexpected repeated %v notification", n.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	failing.failing.Store(false)
+	pair.Send(t, Ping, nil)
+	expectNotification(t, notifications, NotificationTUNWriteRecovered)
+	if n := pair[0].dev.tun.writeFailures.Load(); n != 0 {
+		t.Errorf("%d failures still counted after recovery", n)
+	}
+}
+
+func TestTUNWriteFailureDown(t *testing.T) {
+	pair, failing, notifications := genFailingTUNPair(t, TUNWriteFailureDown)
+	failing.failing.Store(true)
+	sendPings(pair, 3)
+	expectNotification(t, notifications, NotificationTUNWriteFailed)
+	deadline := time.Now().Add(5 * time.Second)
+	for pair[0].dev.deviceState() != deviceStateDown {
+		if time.Now().After(deadline) {
+			t.Fatal("device not brought down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	failing.failing.Store(false)
+	if err := pair[0].dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// Bringing the device down dropped its sessions, so let it initiate.
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+}
+
+func TestTUNWriteFailureRetry(t *testing.T) {
+	pair, failing, notifications := genFailingTUNPair(t, TUNWriteFailureRetry)
+	failing.failing.Store(true)
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	sendPings(pair, 3)
+	expectNotification(t, notifications, NotificationTUNWriteFailed)
+
+	// The last packet is retried rather than dropped, and delivered once the
+	// TUN device accepts it again.
+	for failing.writes.Load() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	failing.failing.Store(false)
+	select {
+	case got := <-pair[0].tun.Inbound:
+		if string(got) != string(msg) {
+			t.Error("retried packet changed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retried packet not delivered")
+	}
+	expectNotification(t, notifications, NotificationTUNWriteRecovered)
+}
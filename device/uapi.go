@@ -18,6 +18,7 @@ import (
 	"sync"
 	"time"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ipc"
 )
 
@@ -71,6 +72,10 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 		buf.WriteByte('\n')
 	}
 
+	// The stats exporter may be waiting for the peers lock while its
+	// configuration is locked, so it is read first.
+	statsSink, statsInterval := device.statsExportConfig()
+
 	func() {
 		// lock required resources
 
@@ -97,6 +102,47 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		if device.net.externalPort != 0 {
+			sendf("external_port=%d", device.net.externalPort)
+		}
+
+		if device.net.stealth.Load() {
+			sendf("stealth=true")
+		}
+
+		if features := device.Features(); features != AllFeatures {
+			sendf("features=%s", features)
+		}
+
+		if level := device.LogLevel(); level != LogLevelVerbose {
+			sendf("log_level=%s", logLevelString(level))
+		}
+
+		if policy := device.FlowLabelPolicy(); policy != FlowLabelOff {
+			sendf("flow_label=%s", policy)
+		}
+
+		if rate := device.debug.nonIPSampleRate.Load(); rate != 0 {
+			sendf("debug_non_ip_sample_rate=%d", rate)
+		}
+		if dropped := device.stats.txDroppedNonIP.Load(); dropped != 0 {
+			sendf("tx_dropped_non_ip=%d", dropped)
+		}
+		if statsSink != "" {
+			sendf("stats_sink=%s", statsSink)
+		}
+		if statsInterval != 0 {
+			sendf("stats_interval=%s", statsInterval)
+		}
+		ipcCoalescing(sendf, &device.coalesce)
+
+		ipcHandshakeFailures(sendf, device.HandshakeFailures())
+		ipcGoroutines(sendf, device.Goroutines())
+
+		ipcQueueStat(sendf, "encryption", device.queue.encryption.stat())
+		ipcQueueStat(sendf, "decryption", device.queue.decryption.stat())
+		ipcQueueStat(sendf, "handshake", device.queue.handshake.stat())
+
 		for _, peer := range device.peers.keyMap {
 			// Serialize peer state.
 			// Do the work in an anonymous function so that we can use defer.
@@ -106,10 +152,25 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 
 				keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
 				keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
-				sendf("protocol_version=1")
+				sendf("protocol_version=%d", peer.ProtocolVersion())
 				if peer.endpoint != nil {
 					sendf("endpoint=%s", peer.endpoint.DstToString())
 				}
+				if peer.sourceAddr.IsValid() {
+					sendf("source_address=%s", peer.sourceAddr)
+				}
+				if peer.multipath.endpoint != nil {
+					sendf("multipath_endpoint=%s", peer.multipath.endpoint.DstToString())
+				}
+				if peer.multipath.sourceAddr.IsValid() {
+					sendf("multipath_source_address=%s", peer.multipath.sourceAddr)
+				}
+				if peer.failover.threshold != 0 {
+					sendf("endpoint_failover_threshold=%d", peer.failover.threshold)
+				}
+				for _, candidate := range peer.failover.candidates {
+					sendf("endpoint_candidate=%s", candidate.DstToString())
+				}
 
 				nano := peer.lastHandshakeNano.Load()
 				secs := nano / time.Second.Nanoseconds()
@@ -120,11 +181,131 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 				sendf("tx_bytes=%d", peer.txBytes.Load())
 				sendf("rx_bytes=%d", peer.rxBytes.Load())
 				sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+				if compression := peer.compression.Load(); compression != nil {
+					sendf("compression=%s", compression.name)
+				}
+				if pacer := peer.pacing.Load(); pacer != nil {
+					sendf("pacing=%s", pacer.spec)
+				}
+				if window := time.Duration(peer.dedup.window.Load()); window != 0 {
+					sendf("dedup_window=%s", window)
+				}
+				if peer.goodbye.Load() {
+					sendf("goodbye=true")
+				}
+				if peer.pinEndpoint.Load() {
+					sendf("disable_roaming=true")
+				}
+				if peer.constantPacketSize.Load() {
+					sendf("constant_packet_size=true")
+				}
+				if peer.latch.handshake != nil {
+					sendf("handshake_endpoint=%s", peer.latch.handshake.DstToString())
+				}
+				if peer.latch.enabled.Load() {
+					sendf("latch_endpoint=true")
+				}
+				if rate := peer.TraceSampleRate(); rate != 0 {
+					sendf("trace_sample_rate=%d", rate)
+				}
+				if peer.autoKeepalive.handshakes.Load() {
+					sendf("auto_keepalive_handshakes=true")
+				}
+				if peer.autoKeepalive.disabled.Load() {
+					sendf("auto_keepalive=false")
+				} else if peer.persistentKeepaliveInterval.Load() == 0 && peer.autoKeepaliveActive() {
+					sendf("auto_keepalive_interval=%d", AutoKeepaliveInterval)
+				}
+				if direction := peer.Direction(); direction != PeerDirectionBoth {
+					sendf("direction=%s", direction)
+				}
+				if dropped := peer.direction.txDropped.Load(); dropped != 0 {
+					sendf("tx_dropped_direction=%d", dropped)
+				}
+				if dropped := peer.direction.rxDropped.Load(); dropped != 0 {
+					sendf("rx_dropped_direction=%d", dropped)
+				}
+				if peer.features.announce.Load() {
+					sendf("announce_features=true")
+				}
+				if remote, ok := peer.remoteFeatures(); ok {
+					sendf("remote_features=%s", remote)
+				}
+				ipcDaitaConfig(sendf, &peer.daitaConfig)
+				if window := time.Duration(peer.daitaCheck.window.Load()); window != 0 {
+					sendf("daita_padding_check=%s", window)
+				}
+				if padding := peer.daitaCheck.transmitted.Load(); padding != 0 {
+					sendf("tx_daita_padding=%d", padding)
+				}
+				if order := DaitaPaddingOrder(peer.daitaPaddingOrder.Load()); order != DaitaPaddingOrderFIFO {
+					sendf("daita_padding_order=%s", order)
+				}
+				if padding := peer.rxDaitaPadding.Load(); padding != 0 {
+					sendf("rx_daita_padding=%d", padding)
+					sendf("rx_daita_padding_bytes=%d", peer.rxDaitaPaddingBytes.Load())
+				}
+				if malformed := peer.rxDaitaMalformed.Load(); malformed != 0 {
+					sendf("rx_daita_padding_malformed=%d", malformed)
+				}
+				if dropped := peer.rxDroppedNonIP.Load(); dropped != 0 {
+					sendf("rx_dropped_non_ip=%d", dropped)
+				}
+				if dropped := peer.rxDroppedDaitaMarker.Load(); dropped != 0 {
+					sendf("rx_dropped_daita_marker=%d", dropped)
+				}
+				if relayed := peer.rxRelayed.Load(); relayed != 0 {
+					sendf("rx_relayed=%d", relayed)
+				}
+				if duplicates := peer.multipath.txDuplicates.Load(); duplicates != 0 {
+					sendf("tx_duplicates=%d", duplicates)
+				}
+				if duplicates := peer.rxDuplicates.Load(); duplicates != 0 {
+					sendf("rx_duplicates=%d", duplicates)
+				}
+				if dropped := peer.dedup.dropped.Load(); dropped != 0 {
+					sendf("rx_dedup_dropped=%d", dropped)
+				}
+				if alerts := peer.clockSkew.alerts.Load(); alerts != 0 {
+					sendf("clock_skew_alerts=%d", alerts)
+				}
+				if dropped := peer.noKeypairDrops.total.Load(); dropped != 0 {
+					sendf("tx_dropped_no_keypair=%d", dropped)
+				}
+				if dropped := peer.txStagedOverflow.Load(); dropped != 0 {
+					sendf("tx_dropped_staged_overflow=%d", dropped)
+				}
+				if rtt := peer.rtt.estimate(); rtt != 0 {
+					sendf("rtt_nsec=%d", rtt)
+				}
+				if lastError, ok := peer.loadLastError(); ok {
+					sendf("last_error=%d/%s/%s", lastError.Time.UnixNano(), lastError.Kind, lastError.Err)
+				}
+				if peer.classifier.enabled.Load() {
+					ipcTrafficClassification(sendf, peer.classifier.snapshot())
+				}
+				ipcRekeyStats(sendf, &peer.rekeys)
+				ipcIPHeaders(sendf, &peer.ipHeaders)
+				ipcSendCircuit(sendf, &peer.sendCircuit)
+
+				queues := peer.queueStats()
+				ipcQueueStat(sendf, "staged", queues.Staged)
+				ipcQueueStat(sendf, "staged_padding", queues.StagedPadding)
+				ipcQueueStat(sendf, "outbound", queues.Outbound)
+				ipcQueueStat(sendf, "inbound", queues.Inbound)
+				ipcQueueStat(sendf, "daita_events", queues.DaitaEvents)
 
 				device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
 					sendf("allowed_ip=%s", prefix.String())
 					return true
 				})
+
+				if peer.daita != nil {
+					for _, label := range peer.daita.MachineLabels() {
+						sendf("daita_machine=%s", label)
+					}
+					ipcDaitaStats(sendf, peer.daita.Stats())
+				}
 			}()
 		}
 	}()
@@ -149,27 +330,58 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 		}
 	}()
 
-	peer := new(ipcSetPeer)
-	deviceConfig := true
-
+	// Read the whole configuration, up to the blank line terminating the
+	// operation, so that it can be validated before any of it is applied.
+	// Its size is limited, so that a misbehaving client cannot exhaust memory.
+	limits := &device.options
+	var lines []ipcSetLine
+	var size, peers int
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, limits.ipcMaxLineSize+1) // the token includes the newline
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
-			// Blank line means terminate operation.
-			peer.handlePostConfig()
-			return nil
+			break
+		}
+		if size += len(line) + 1; size > limits.ipcMaxSetSize {
+			return ipcErrorf(ipc.IpcErrorProtocol, "configuration exceeds the maximum size of %d bytes", limits.ipcMaxSetSize)
 		}
 		key, value, ok := strings.Cut(line, "=")
 		if !ok {
 			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
 		}
+		if key == "public_key" {
+			if peers++; peers > limits.ipcMaxSetPeers {
+				return ipcErrorf(ipc.IpcErrorProtocol, "configuration exceeds the maximum of %d peers", limits.ipcMaxSetPeers)
+			}
+		}
+		lines = append(lines, ipcSetLine{key: key, value: value})
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return ipcErrorf(ipc.IpcErrorProtocol, "line %d exceeds the maximum length of %d bytes", len(lines)+1, limits.ipcMaxLineSize)
+	} else if err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
+	}
+	if err := device.validateIpcSet(lines); err != nil {
+		return err
+	}
+
+	peer := new(ipcSetPeer)
+	deviceConfig := true
+
+	for _, line := range lines {
+		if line.ignore {
+			continue
+		}
+		key, value := line.key, line.value
 
 		if key == "public_key" {
 			if deviceConfig {
 				deviceConfig = false
 			}
-			peer.handlePostConfig()
+			if err := peer.handlePostConfig(); err != nil {
+				return err
+			}
 			// Load/create the peer we are now configuring.
 			err := device.handlePublicKeyLine(peer, value)
 			if err != nil {
@@ -188,12 +400,7 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			return err
 		}
 	}
-	peer.handlePostConfig()
-
-	if err := scanner.Err(); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
-	}
-	return nil
+	return peer.handlePostConfig()
 }
 
 func (device *Device) handleDeviceLine(key, value string) error {
@@ -235,6 +442,85 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "stealth":
+		stealth, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set stealth, invalid value: %v", value)
+		}
+		if stealth {
+			if err := device.requireFeature(FeatureObfuscation); err != nil {
+				return err
+			}
+		}
+		device.log.Verbosef("UAPI: Updating stealth mode")
+		device.SetStealth(stealth)
+
+	case "external_port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse external_port: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating external port")
+		device.SetExternalPort(uint16(port))
+
+	case "features":
+		features, err := parseFeatures(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set features: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating features")
+		device.SetFeatures(features)
+
+	case "log_level":
+		level, err := parseLogLevel(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating log level")
+		device.SetLogLevel(level)
+
+	case "flow_label":
+		policy, err := parseFlowLabelPolicy(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set flow_label: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating flow label policy")
+		device.SetFlowLabelPolicy(policy)
+
+	case "debug_non_ip_sample_rate":
+		rate, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse debug_non_ip_sample_rate: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating non-IP frame sample rate")
+		device.debug.nonIPSampleRate.Store(uint32(rate))
+
+	case "stats_sink":
+		device.log.Verbosef("UAPI: Updating stats sink")
+		if err := device.SetStatsSink(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set stats_sink: %w", err)
+		}
+
+	case "stats_interval":
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse stats_interval: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating stats interval")
+		if err := device.SetStatsInterval(interval); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set stats_interval: %w", err)
+		}
+
+	case "coalesce_window":
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse coalesce_window: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating coalesce window")
+		if err := device.SetCoalesceWindow(window); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set coalesce_window: %w", err)
+		}
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -255,14 +541,24 @@ type ipcSetPeer struct {
 	dummy   bool // dummy reports whether this peer is a temporary, placeholder peer
 	created bool // new reports whether this is a newly created peer
 	pkaOn   bool // pkaOn reports whether the peer had the persistent keepalive turn on
+
+	pendingDaita         *peerDaitaConfig // DAITA configuration being set, nil if unchanged
+	pendingDaitaReplaced map[string]bool  // the "daita_*machines" keys whose machines pendingDaita has replaced
 }
 
-func (peer *ipcSetPeer) handlePostConfig() {
+func (peer *ipcSetPeer) handlePostConfig() error {
 	if peer.Peer == nil || peer.dummy {
-		return
+		peer.pendingDaita = nil
+		return nil
 	}
 	if peer.created {
+		peer.device.restorePeerState(peer.Peer)
 		peer.disableRoaming = peer.device.net.brokenRoaming && peer.endpoint != nil
+		if peer.pendingDaita == nil && peer.daitaConfig.enabled {
+			// Start the DAITA enabled by SetDefaultDaita.
+			config := peer.daitaConfig
+			peer.pendingDaita = &config
+		}
 	}
 	if peer.device.isUp() {
 		peer.Start()
@@ -270,7 +566,13 @@ func (peer *ipcSetPeer) handlePostConfig() {
 			peer.SendKeepalive()
 		}
 		peer.SendStagedPackets()
+		if peer.created && peer.pendingDaita == nil {
+			if err := peer.startFactoryDaita(); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to enable DAITA: %w", err)
+			}
+		}
 	}
+	return peer.applyPendingDaita()
 }
 
 func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error {
@@ -348,6 +650,80 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		peer.Lock()
 		defer peer.Unlock()
 		peer.endpoint = endpoint
+		peer.failover.configured = endpoint
+		peer.autoKeepaliveReset()
+
+	case "source_address":
+		device.log.Verbosef("%v - UAPI: Updating source address", peer.Peer)
+		addr, err := device.parseSourceAddr(key, value)
+		if err != nil {
+			return err
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.sourceAddr = addr
+		if !addr.IsValid() && peer.endpoint != nil {
+			peer.endpoint.ClearSrc()
+		}
+
+	case "multipath_endpoint":
+		device.log.Verbosef("%v - UAPI: Updating multipath endpoint", peer.Peer)
+		var endpoint conn.Endpoint
+		if value != "" {
+			if err := device.requireFeature(FeatureMultipath); err != nil {
+				return err
+			}
+			var err error
+			endpoint, err = device.net.bind.ParseEndpoint(value)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set multipath_endpoint %v: %w", value, err)
+			}
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.multipath.endpoint = endpoint
+
+	case "multipath_source_address":
+		device.log.Verbosef("%v - UAPI: Updating multipath source address", peer.Peer)
+		addr, err := device.parseSourceAddr(key, value)
+		if err != nil {
+			return err
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.multipath.sourceAddr = addr
+		if !addr.IsValid() && peer.multipath.endpoint != nil {
+			peer.multipath.endpoint.ClearSrc()
+		}
+
+	case "endpoint_candidate":
+		device.log.Verbosef("%v - UAPI: Adding endpoint candidate", peer.Peer)
+		endpoint, err := device.net.bind.ParseEndpoint(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to add endpoint candidate %v: %w", value, err)
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.failover.candidates = append(peer.failover.candidates, endpoint)
+
+	case "replace_endpoint_candidates":
+		device.log.Verbosef("%v - UAPI: Removing all endpoint candidates", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace endpoint candidates, invalid value: %v", value)
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.failover.candidates = nil
+
+	case "endpoint_failover_threshold":
+		device.log.Verbosef("%v - UAPI: Updating endpoint failover threshold", peer.Peer)
+		threshold, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint failover threshold: %w", err)
+		}
+		peer.Lock()
+		defer peer.Unlock()
+		peer.failover.threshold = uint32(threshold)
 
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
@@ -383,20 +759,171 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		}
 		device.allowedips.Insert(prefix, peer.Peer)
 
+	case "remove_allowed_ip":
+		device.log.Verbosef("%v - UAPI: Removing allowedip", peer.Peer)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to remove allowed ip: %w", err)
+		}
+		if peer.dummy {
+			return nil
+		}
+		device.allowedips.Remove(prefix, peer.Peer)
+
 	case "protocol_version":
-		if value != "1" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
+		version, err := device.parseProtocolVersion(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %w", err)
 		}
+		peer.protocolVersion.Store(uint32(version))
+
 	case "constant_packet_size":
-		if value != "true" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set constant packet size, invalid value: %v", value)
 		}
 		if peer.dummy {
 			return nil
 		}
-		peer.Lock()
-		defer peer.Unlock()
-		peer.constantPacketSize = true
+		return peer.SetConstantPacketSize(enabled)
+
+	case "compression":
+		device.log.Verbosef("%v - UAPI: Updating compression", peer.Peer)
+		if value == "none" {
+			peer.compression.Store(nil)
+			return nil
+		}
+		compressor, ok := lookupCompressor(value)
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set compression, unknown compressor: %v", value)
+		}
+		peer.compression.Store(&peerCompression{name: value, Compressor: compressor})
+
+	case "pacing":
+		device.log.Verbosef("%v - UAPI: Updating pacing", peer.Peer)
+		if value == "none" {
+			peer.pacing.Store(nil)
+			return nil
+		}
+		pacer, err := parsePacing(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set pacing: %w", err)
+		}
+		pacer.random = device.options.random
+		peer.pacing.Store(pacer)
+
+	case "dedup_window":
+		window, err := time.ParseDuration(value)
+		if err != nil || window < 0 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set dedup_window, invalid duration: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating dedup window", peer.Peer)
+		peer.dedup.setWindow(window)
+
+	case "goodbye":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set goodbye, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating goodbye messages", peer.Peer)
+		peer.goodbye.Store(enabled)
+
+	case "announce_features":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set announce_features, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating feature announcements", peer.Peer)
+		peer.features.announce.Store(enabled)
+
+	case "direction":
+		direction, err := parsePeerDirection(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set direction: %w", err)
+		}
+		device.log.Verbosef("%v - UAPI: Updating direction", peer.Peer)
+		peer.SetDirection(direction)
+
+	case "disable_roaming":
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set disable_roaming, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating roaming", peer.Peer)
+		peer.pinEndpoint.Store(disabled)
+
+	case "latch_endpoint":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set latch_endpoint, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating endpoint latching", peer.Peer)
+		peer.latchEndpoint(enabled)
+
+	case "trace_sample_rate":
+		rate, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse trace_sample_rate: %w", err)
+		}
+		device.log.Verbosef("%v - UAPI: Updating trace sample rate", peer.Peer)
+		peer.SetTraceSampleRate(uint32(rate))
+
+	case "auto_keepalive":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set auto_keepalive, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating automatic persistent keepalive", peer.Peer)
+		peer.autoKeepalive.disabled.Store(!enabled)
+
+	case "auto_keepalive_handshakes":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set auto_keepalive_handshakes, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating NAT detection from handshakes", peer.Peer)
+		peer.autoKeepalive.handshakes.Store(enabled)
+		if !enabled {
+			peer.autoKeepaliveReset()
+		}
+
+	case "flush_queues":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set flush_queues, invalid value: %v", value)
+		}
+		if !peer.dummy {
+			dropped := peer.FlushQueues()
+			device.log.Verbosef("%v - UAPI: Flushed queues, dropping %d packets", peer.Peer, dropped)
+		}
+
+	case "classify_traffic":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set classify_traffic, invalid value: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating traffic classification", peer.Peer)
+		peer.classifier.setEnabled(enabled)
+
+	case "daita", "daita_machines", "daita_sent_machines", "daita_received_machines",
+		"daita_events_capacity", "daita_actions_capacity",
+		"daita_max_padding_frac", "daita_max_blocking_frac":
+		return peer.handleDaitaLine(device, key, value)
+
+	case "daita_padding_check":
+		window, err := time.ParseDuration(value)
+		if err != nil || window < 0 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set daita_padding_check, invalid duration: %v", value)
+		}
+		device.log.Verbosef("%v - UAPI: Updating DAITA padding check", peer.Peer)
+		peer.daitaCheck.window.Store(int64(window))
+
+	case "daita_padding_order":
+		order, err := parseDaitaPaddingOrder(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set daita_padding_order: %w", err)
+		}
+		device.log.Verbosef("%v - UAPI: Updating DAITA padding order", peer.Peer)
+		peer.daitaPaddingOrder.Store(uint32(order))
 
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
@@ -421,16 +948,22 @@ func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
 	buffered := func(s io.ReadWriter) *bufio.ReadWriter {
-		reader := bufio.NewReader(s)
+		reader := bufio.NewReaderSize(s, maxIpcOpLineSize)
 		writer := bufio.NewWriter(s)
 		return bufio.NewReadWriter(reader, writer)
 	}(socket)
 
 	for {
-		op, err := buffered.ReadString('\n')
+		// The operation line is read into the fixed buffer of the reader, so
+		// that a client cannot exhaust memory with an endless line.
+		line, err := buffered.ReadSlice('\n')
 		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				device.log.Errorf("UAPI operation exceeds the maximum length of %d bytes", maxIpcOpLineSize)
+			}
 			return
 		}
+		op := string(line)
 
 		// handle operation
 		switch op {
@@ -447,6 +980,17 @@ func (device *Device) IpcHandle(socket net.Conn) {
 				break
 			}
 			err = device.IpcGetOperation(buffered.Writer)
+		case "get=json\n":
+			var nextByte byte
+			nextByte, err = buffered.ReadByte()
+			if err != nil {
+				return
+			}
+			if nextByte != '\n' {
+				err = ipcErrorf(ipc.IpcErrorInvalid, "trailing character in UAPI get: %q", nextByte)
+				break
+			}
+			err = device.IpcGetJSONOperation(buffered.Writer)
 		default:
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
@@ -467,3 +1011,19 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		buffered.Flush()
 	}
 }
+
+// parseSourceAddr parses the value of a source address key, which is empty to
+// let the bind choose the source address.
+func (device *Device) parseSourceAddr(key, value string) (netip.Addr, error) {
+	if value == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s %v: %w", key, value, err)
+	}
+	if _, ok := device.net.bind.(conn.SourceAddrBind); !ok {
+		return netip.Addr{}, ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s %v: bind does not support source addresses", key, value)
+	}
+	return addr.Unmap(), nil
+}
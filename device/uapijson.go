@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// ipcMultiValued lists the UAPI get keys that may appear more than once for a
+// device or peer. In JSON, their values are always arrays.
+var ipcMultiValued = map[string]bool{
+	"allowed_ip":              true,
+	"daita_machine":           true,
+	"daita_machines":          true,
+	"daita_received_machines": true,
+	"daita_sent_machines":     true,
+	"endpoint_candidate":      true,
+	"handshake_failure":       true,
+	"rx_dscp":                 true,
+	"rx_hop_limit":            true,
+	"tx_top_port":             true,
+}
+
+// IpcGetJSON returns the state reported by IpcGet as a JSON object. It has a
+// member for every UAPI key of the device, named after the key, and a "peers"
+// array of objects with the keys of each peer. Integers and booleans are JSON
+// numbers and booleans, keys listed in ipcMultiValued are arrays of strings,
+// and all other values, including keys, are strings.
+//
+// As the object is derived from the UAPI output, it includes every key this
+// fork adds to it, with the same omissions of default values.
+func (device *Device) IpcGetJSON() ([]byte, error) {
+	buf := new(strings.Builder)
+	if err := device.IpcGetOperation(buf); err != nil {
+		return nil, err
+	}
+	return ipcToJSON(buf.String())
+}
+
+// IpcGetJSONOperation writes the output of IpcGetJSON to w, followed by a newline.
+func (device *Device) IpcGetJSONOperation(w io.Writer) error {
+	state, err := device.IpcGetJSON()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(state, '\n')); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
+	return nil
+}
+
+func ipcToJSON(get string) ([]byte, error) {
+	newObject := func() map[string]any {
+		return make(map[string]any)
+	}
+	dev := newObject()
+	peers := []map[string]any{}
+	current := dev
+
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
+		}
+		if key == "public_key" {
+			current = newObject()
+			current["allowed_ip"] = []string{}
+			peers = append(peers, current)
+		}
+		if ipcMultiValued[key] {
+			values, _ := current[key].([]string)
+			current[key] = append(values, value)
+			continue
+		}
+		current[key] = ipcJSONValue(key, value)
+	}
+	dev["peers"] = peers
+
+	state, err := json.Marshal(dev)
+	if err != nil {
+		return nil, ipcErrorf(ipc.IpcErrorUnknown, "failed to encode state: %w", err)
+	}
+	return state, nil
+}
+
+// ipcJSONValue returns the JSON representation of a UAPI value.
+func ipcJSONValue(key, value string) any {
+	if strings.HasSuffix(key, "_key") {
+		return value
+	}
+	switch {
+	case value == "true" || value == "false":
+		return json.RawMessage(value)
+	case value != "" && (value[0] == '-' || value[0] >= '0' && value[0] <= '9') && json.Valid([]byte(value)):
+		return json.Number(value)
+	}
+	return value
+}
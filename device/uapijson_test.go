@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestIpcGetJSON(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pair.Send(t, Ping, nil)
+
+	state, err := dev.IpcGetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		PrivateKey string `json:"private_key"`
+		ListenPort *int   `json:"listen_port"`
+		Peers      []struct {
+			PublicKey       string   `json:"public_key"`
+			AllowedIPs      []string `json:"allowed_ip"`
+			RxBytes         uint64   `json:"rx_bytes"`
+			ProtocolVersion int      `json:"protocol_version"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(state, &decoded); err != nil {
+		t.Fatalf("invalid JSON %s: %v", state, err)
+	}
+	if decoded.PrivateKey != hex.EncodeToString(dev.staticIdentity.privateKey[:]) {
+		t.Errorf("unexpected private key %q", decoded.PrivateKey)
+	}
+	if decoded.ListenPort == nil {
+		t.Error("listen port missing")
+	}
+	if len(decoded.Peers) != 1 {
+		t.Fatalf("expected one peer, got %d", len(decoded.Peers))
+	}
+	peer := decoded.Peers[0]
+	if peer.PublicKey != hex.EncodeToString(pair[1].dev.staticIdentity.publicKey[:]) {
+		t.Errorf("unexpected public key %q", peer.PublicKey)
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0] != "1.0.0.2/32" {
+		t.Errorf("unexpected allowed IPs %v", peer.AllowedIPs)
+	}
+	if peer.RxBytes == 0 || peer.ProtocolVersion != 1 {
+		t.Errorf("unexpected peer counters in %s", state)
+	}
+}
+
+func TestIpcToJSON(t *testing.T) {
+	state, err := ipcToJSON("private_key=1234\nstealth=true\nlog_level=error\n" +
+		"public_key=5678\nendpoint=[::1]:51820\nqueue_outbound=1/8\npersistent_keepalive_interval=25\n" +
+		"public_key=9abc\nallowed_ip=10.0.0.0/8\nallowed_ip=::/0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"log_level":"error","peers":[` +
+		`{"allowed_ip":[],"endpoint":"[::1]:51820","persistent_keepalive_interval":25,"public_key":"5678","queue_outbound":"1/8"},` +
+		`{"allowed_ip":["10.0.0.0/8","::/0"],"public_key":"9abc"}],` +
+		`"private_key":"1234","stealth":true}`
+	if string(state) != want {
+		t.Errorf("unexpected JSON:\n got %s\nwant %s", state, want)
+	}
+
+	if _, err := ipcToJSON("no separator\n"); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestIpcHandleGetJSON(t *testing.T) {
+	pair := genTestPair(t, false)
+	client, server := net.Pipe()
+	go pair[0].dev.IpcHandle(server)
+	defer client.Close()
+
+	if _, err := client.Write([]byte("get=json\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(line) {
+		t.Errorf("invalid JSON %q", line)
+	}
+	status, err := reader.ReadString('\n')
+	if err != nil || status != "errno=0\n" {
+		t.Errorf("unexpected status %q: %v", status, err)
+	}
+}
@@ -0,0 +1,261 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// A uapiValidator checks the value of a UAPI set key without applying it.
+type uapiValidator func(device *Device, key, value string) error
+
+// uapiDeviceKeys and uapiPeerKeys are the registry of the keys accepted by
+// IpcSet, core and fork extensions alike. Every key handled by
+// handleDeviceLine and handlePeerLine must be listed here, as IpcSet checks a
+// whole configuration against the registry before applying any of it.
+var (
+	uapiDeviceKeys = map[string]uapiValidator{
+		"private_key": func(_ *Device, _, value string) error {
+			var sk NoisePrivateKey
+			return sk.FromMaybeZeroHex(value)
+		},
+		"listen_port":              uapiUint(16),
+		"fwmark":                   uapiUint(32),
+		"external_port":            uapiUint(16),
+		"stealth":                  uapiBool,
+		"log_level":                func(_ *Device, _, value string) error { _, err := parseLogLevel(value); return err },
+		"flow_label":               func(_ *Device, _, value string) error { _, err := parseFlowLabelPolicy(value); return err },
+		"debug_non_ip_sample_rate": uapiUint(32),
+		"stats_sink":               func(_ *Device, _, value string) error { _, _, err := parseStatsSink(value); return err },
+		"stats_interval":           uapiNonNegativeDuration,
+		"coalesce_window": func(_ *Device, _, value string) error {
+			window, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			return checkCoalesceWindow(window)
+		},
+		"replace_peers": uapiTrue,
+		"features":      func(_ *Device, _, value string) error { _, err := parseFeatures(value); return err },
+	}
+
+	uapiPeerKeys = map[string]uapiValidator{
+		"public_key": func(_ *Device, _, value string) error {
+			var pk NoisePublicKey
+			return pk.FromHex(value)
+		},
+		"update_only": uapiTrue,
+		"remove":      uapiTrue,
+		"preshared_key": func(_ *Device, _, value string) error {
+			var psk NoisePresharedKey
+			return psk.FromHex(value)
+		},
+		"endpoint": uapiEndpoint,
+		"source_address": func(device *Device, key, value string) error {
+			_, err := device.parseSourceAddr(key, value)
+			return err
+		},
+		"multipath_endpoint": func(device *Device, key, value string) error {
+			if value == "" {
+				return nil
+			}
+			return uapiEndpoint(device, key, value)
+		},
+		"multipath_source_address": func(device *Device, key, value string) error {
+			_, err := device.parseSourceAddr(key, value)
+			return err
+		},
+		"endpoint_candidate":            uapiEndpoint,
+		"replace_endpoint_candidates":   uapiTrue,
+		"endpoint_failover_threshold":   uapiUint(32),
+		"persistent_keepalive_interval": uapiUint(16),
+		"replace_allowed_ips":           uapiTrue,
+		"allowed_ip": func(_ *Device, _, value string) error {
+			_, err := netip.ParsePrefix(value)
+			return err
+		},
+		"remove_allowed_ip": func(_ *Device, _, value string) error {
+			_, err := netip.ParsePrefix(value)
+			return err
+		},
+		"protocol_version": func(device *Device, _, value string) error {
+			_, err := device.parseProtocolVersion(value)
+			return err
+		},
+		"constant_packet_size": uapiBool,
+		"compression": func(_ *Device, _, value string) error {
+			if _, ok := lookupCompressor(value); !ok && value != "none" {
+				return errors.New("unknown compressor")
+			}
+			return nil
+		},
+		"pacing": func(_ *Device, _, value string) error {
+			if value == "none" {
+				return nil
+			}
+			_, err := parsePacing(value)
+			return err
+		},
+		"dedup_window":              uapiNonNegativeDuration,
+		"goodbye":                   uapiBool,
+		"disable_roaming":           uapiBool,
+		"latch_endpoint":            uapiBool,
+		"auto_keepalive":            uapiBool,
+		"auto_keepalive_handshakes": uapiBool,
+		"trace_sample_rate":         uapiUint(32),
+		"direction":                 func(_ *Device, _, value string) error { _, err := parsePeerDirection(value); return err },
+		"announce_features":         uapiBool,
+		"flush_queues":              uapiTrue,
+		"classify_traffic":          uapiBool,
+		"daita": func(_ *Device, _, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			if err == nil && enabled && !daitaSupported {
+				err = errDaitaNotSupported
+			}
+			return err
+		},
+		"daita_machines":          func(_ *Device, _, value string) error { _, err := parseDaitaMachine(value); return err },
+		"daita_sent_machines":     func(_ *Device, _, value string) error { _, err := parseDaitaMachine(value); return err },
+		"daita_received_machines": func(_ *Device, _, value string) error { _, err := parseDaitaMachine(value); return err },
+		"daita_events_capacity":   uapiUint(32),
+		"daita_actions_capacity":  uapiUint(32),
+		"daita_max_padding_frac":  func(_ *Device, _, value string) error { _, err := parseDaitaFrac(value); return err },
+		"daita_max_blocking_frac": func(_ *Device, _, value string) error { _, err := parseDaitaFrac(value); return err },
+		"daita_padding_check":     uapiNonNegativeDuration,
+		"daita_padding_order": func(_ *Device, _, value string) error {
+			_, err := parseDaitaPaddingOrder(value)
+			return err
+		},
+	}
+)
+
+func uapiUint(bits int) uapiValidator {
+	return func(_ *Device, _, value string) error {
+		_, err := strconv.ParseUint(value, 10, bits)
+		return err
+	}
+}
+
+func uapiBool(_ *Device, _, value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+func uapiNonNegativeDuration(_ *Device, _, value string) error {
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %v", d)
+	}
+	return err
+}
+
+// uapiTrue validates the keys whose only valid value is "true".
+func uapiTrue(_ *Device, _, value string) error {
+	if value != "true" {
+		return errors.New("the only valid value is true")
+	}
+	return nil
+}
+
+func uapiEndpoint(device *Device, _, value string) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	_, err := device.net.bind.ParseEndpoint(value)
+	return err
+}
+
+// SetIpcPermissive sets whether IpcSet ignores unknown keys, logging them,
+// instead of rejecting the configuration. This lets a configuration written
+// for a newer version be applied, minus the keys this version lacks.
+// Malformed values of known keys are rejected either way.
+func (device *Device) SetIpcPermissive(permissive bool) {
+	device.ipcPermissive.Store(permissive)
+}
+
+// An ipcSetLine is a key=value line of an IpcSet operation.
+type ipcSetLine struct {
+	key, value string
+	ignore     bool // unknown key, skipped in permissive mode
+}
+
+// validateIpcSet checks every line of a configuration against the registry of
+// UAPI keys, so that a configuration with a mistake is rejected as a whole
+// instead of being applied up to the mistake.
+func (device *Device) validateIpcSet(lines []ipcSetLine) error {
+	keys, scope := uapiDeviceKeys, "device"
+	for i := range lines {
+		line := &lines[i]
+		if line.key == "public_key" {
+			keys, scope = uapiPeerKeys, "peer"
+		}
+		validate, ok := keys[line.key]
+		if !ok {
+			if device.ipcPermissive.Load() {
+				device.log.Errorf("UAPI: Ignoring unknown %s key on line %d: %v", scope, i+1, line.key)
+				line.ignore = true
+				continue
+			}
+			if suggestion := suggestUAPIKey(keys, line.key); suggestion != "" {
+				return ipcErrorf(ipc.IpcErrorInvalid, "line %d: invalid UAPI %s key: %v (did you mean %v?)", i+1, scope, line.key, suggestion)
+			}
+			return ipcErrorf(ipc.IpcErrorInvalid, "line %d: invalid UAPI %s key: %v", i+1, scope, line.key)
+		}
+		if err := validate(device, line.key, line.value); err != nil {
+			var ipcErr *IPCError
+			if errors.As(err, &ipcErr) {
+				return ipcErrorf(ipcErr.ErrorCode(), "line %d: %w", i+1, ipcErr.err)
+			}
+			return ipcErrorf(ipc.IpcErrorInvalid, "line %d: invalid %v %q: %w", i+1, line.key, line.value, err)
+		}
+	}
+	return nil
+}
+
+// suggestUAPIKey returns the known key closest to a mistyped one, if any is
+// close enough to be what was meant.
+func suggestUAPIKey(keys map[string]uapiValidator, key string) string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if d := editDistance(name, key); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func newUAPIKeysTestDevice(t *testing.T) *Device {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+	return dev
+}
+
+func TestUAPIKeysHandled(t *testing.T) {
+	dev := newUAPIKeysTestDevice(t)
+	sk := NoisePrivateKey{16}
+	pk := sk.publicKey()
+	peer := new(ipcSetPeer)
+	if err := dev.handlePublicKeyLine(peer, hex.EncodeToString(pk[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every registered key must be known to its handler, which rejects the
+	// malformed value instead of the key.
+	check := func(scope, key string, err error) {
+		if err == nil {
+			t.Errorf("%s key %v accepted a malformed value", scope, key)
+		} else if strings.Contains(err.Error(), "invalid UAPI") {
+			t.Errorf("%s key %v is registered but not handled: %v", scope, key, err)
+		}
+	}
+	for key := range uapiDeviceKeys {
+		check("device", key, dev.handleDeviceLine(key, "malformed"))
+	}
+	for key := range uapiPeerKeys {
+		if key == "public_key" {
+			continue
+		}
+		check("peer", key, dev.handlePeerLine(peer, key, "malformed"))
+	}
+}
+
+func TestUAPIKeysStrict(t *testing.T) {
+	dev := newUAPIKeysTestDevice(t)
+	sk := NoisePrivateKey{16}
+	pk := sk.publicKey()
+
+	err := dev.IpcSet(uapiCfg(
+		"listen_port", "0",
+		"public_key", hex.EncodeToString(pk[:]),
+		"allowed_ip", "10.0.0.0/8",
+		"persistent_keepalive_intervall", "25",
+	))
+	var ipcErr *IPCError
+	if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+		t.Fatalf("expected an invalid argument error, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "line 4") || !strings.Contains(msg, "did you mean persistent_keepalive_interval?") {
+		t.Errorf("imprecise error: %v", err)
+	}
+	// Nothing before the mistake was applied.
+	if dev.LookupPeer(pk) != nil {
+		t.Error("peer created by a rejected configuration")
+	}
+
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"allowed_ip", "10.0.0.0/33",
+	))
+	if err == nil || !strings.Contains(err.Error(), `line 2: invalid allowed_ip "10.0.0.0/33"`) {
+		t.Errorf("imprecise error: %v", err)
+	}
+
+	// Device keys are not accepted for peers.
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"listen_port", "0",
+	))
+	if err == nil || !strings.Contains(err.Error(), "invalid UAPI peer key: listen_port") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUAPIKeysPermissive(t *testing.T) {
+	dev := newUAPIKeysTestDevice(t)
+	dev.SetIpcPermissive(true)
+	sk := NoisePrivateKey{16}
+	pk := sk.publicKey()
+
+	if err := dev.IpcSet(uapiCfg(
+		"future_device_key", "1",
+		"public_key", hex.EncodeToString(pk[:]),
+		"future_peer_key", "1",
+		"persistent_keepalive_interval", "25",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	if peer == nil || peer.persistentKeepaliveInterval.Load() != 25 {
+		t.Error("known keys not applied in permissive mode")
+	}
+
+	// Malformed values are still rejected.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"persistent_keepalive_interval", "forever",
+	)); err == nil {
+		t.Error("malformed value accepted in permissive mode")
+	}
+}
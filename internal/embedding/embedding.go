@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package embedding turns on the tunnels of libwg and mobile, which embed
+// wireguard-go in apps: a device on a TUN device, or two chained devices in a
+// multihop tunnel.
+package embedding
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/multihoptun"
+)
+
+// A Tunnel is one device on a TUN device, or two chained devices in a
+// multihop tunnel.
+type Tunnel struct {
+	// Devices[0] is the device on the TUN device; in a multihop tunnel,
+	// Devices[1] is the entry device.
+	Devices []*device.Device
+
+	multihop  *multihoptun.MultihopTun // between the devices of a multihop tunnel
+	closeOnce sync.Once
+}
+
+// A DeviceConfig is the TUN device, bind and settings of a device to start.
+type DeviceConfig struct {
+	TUN      tun.Device
+	Bind     conn.Bind
+	Settings string
+}
+
+// TurnOn starts a tunnel on tunDev, configured with settings.
+func TurnOn(logger *device.Logger, tunDev tun.Device, settings string) (*Tunnel, error) {
+	return Start(logger, DeviceConfig{tunDev, conn.NewDefaultBind(), settings})
+}
+
+// TurnOnMultihop starts a tunnel through two relays on tunDev, of the given
+// MTU. The exit device, configured with exitSettings, tunnels its traffic to
+// the exit peer at remote through the entry device, configured with
+// entrySettings. local is the address of this host inside the entry tunnel.
+func TurnOnMultihop(logger *device.Logger, tunDev tun.Device, mtu int, local netip.Addr, remote netip.AddrPort, exitSettings, entrySettings string) (*Tunnel, error) {
+	// Size the entry hop so that packets of the full MTU of the TUN device
+	// fit through it once encrypted by the exit device.
+	probe := multihoptun.NewMultihopTun(local, remote.Addr(), remote.Port(), mtu)
+	entryMTU := 2*mtu - probe.InnerMTU(false)
+	probe.Close()
+	multihop := multihoptun.NewMultihopTun(local, remote.Addr(), remote.Port(), entryMTU)
+
+	t := &Tunnel{multihop: &multihop}
+	if err := t.start(logger,
+		DeviceConfig{tunDev, multihop.Binder(), exitSettings},
+		DeviceConfig{&multihop, conn.NewDefaultBind(), entrySettings},
+	); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Start creates, configures and brings up a device for every config. On
+// failure, the devices and TUN devices created so far are closed, and the
+// error of a configuration is a *device.IPCError.
+func Start(logger *device.Logger, configs ...DeviceConfig) (*Tunnel, error) {
+	t := &Tunnel{}
+	if err := t.start(logger, configs...); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tunnel) start(logger *device.Logger, configs ...DeviceConfig) error {
+	for i, config := range configs {
+		dev := device.NewDevice(config.TUN, config.Bind, logger)
+		t.Devices = append(t.Devices, dev)
+		if err := dev.IpcSet(config.Settings); err != nil {
+			logger.Errorf("Failed to configure device: %v", err)
+			t.Close()
+			for _, config := range configs[i+1:] {
+				config.TUN.Close()
+			}
+			return fmt.Errorf("failed to configure device: %w", err)
+		}
+	}
+	for _, dev := range t.Devices {
+		if err := dev.Up(); err != nil {
+			logger.Errorf("Failed to bring up device: %v", err)
+			t.Close()
+			return fmt.Errorf("failed to bring up device: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the tunnel and its TUN device. The devices of a multihop
+// tunnel are closed with multihoptun.CloseAll. It may be called more than
+// once.
+func (t *Tunnel) Close() {
+	t.closeOnce.Do(func() {
+		if t.multihop == nil {
+			for _, dev := range t.Devices {
+				dev.Close()
+			}
+			return
+		}
+		var entry *device.Device
+		if len(t.Devices) > 1 {
+			entry = t.Devices[1]
+		}
+		multihoptun.CloseAll(entry, t.Devices[0], t.multihop)
+	})
+}
+
+// Peer returns the device the peer belongs to, and the peer.
+func (t *Tunnel) Peer(pk device.NoisePublicKey) (*device.Device, *device.Peer) {
+	for _, dev := range t.Devices {
+		if peer := dev.LookupPeer(pk); peer != nil {
+			return dev, peer
+		}
+	}
+	return nil, nil
+}
+
+// NewLogger returns a logger passing the messages up to level to log, or a
+// silent one if log is nil.
+func NewLogger(level int, log func(level int, msg string)) *device.Logger {
+	if log == nil {
+		return device.NewLogger(device.LogLevelSilent, "")
+	}
+	logf := func(msgLevel int) func(string, ...any) {
+		return func(format string, args ...any) {
+			log(msgLevel, fmt.Sprintf(format, args...))
+		}
+	}
+	logger := &device.Logger{Verbosef: device.DiscardLogf, Errorf: device.DiscardLogf}
+	if level >= device.LogLevelVerbose {
+		logger.Verbosef = logf(device.LogLevelVerbose)
+	}
+	if level >= device.LogLevelError {
+		logger.Errorf = logf(device.LogLevelError)
+	}
+	return logger
+}
+
+// SettingsEndpoint returns the last endpoint in settings.
+func SettingsEndpoint(settings string) (netip.AddrPort, error) {
+	var endpoint string
+	scanner := bufio.NewScanner(strings.NewReader(settings))
+	for scanner.Scan() {
+		if key, value, _ := strings.Cut(scanner.Text(), "="); key == "endpoint" {
+			endpoint = value
+		}
+	}
+	return netip.ParseAddrPort(endpoint)
+}
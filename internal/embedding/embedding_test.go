@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package embedding
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSettingsEndpoint(t *testing.T) {
+	endpoint, err := SettingsEndpoint("public_key=00\nendpoint=[::1]:51820\nallowed_ip=0.0.0.0/0\n")
+	if err != nil || endpoint.String() != "[::1]:51820" {
+		t.Errorf("unexpected endpoint %v: %v", endpoint, err)
+	}
+	if _, err := SettingsEndpoint("public_key=00\n"); err == nil {
+		t.Error("expected an error for settings without an endpoint")
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	binds := bindtest.NewChannelBinds()
+	_, err := Start(logger,
+		DeviceConfig{tuntest.NewChannelTUN().TUN(), binds[0], "listen_port=0\n"},
+		DeviceConfig{tuntest.NewChannelTUN().TUN(), binds[1], "no_such_key=1\n"},
+	)
+	var ipcErr *device.IPCError
+	if !errors.As(err, &ipcErr) {
+		t.Fatalf("expected an IPCError, got %v", err)
+	}
+}
+
+// TestMultihopClose checks that a multihop tunnel is closed as a chain, and
+// only once.
+func TestMultihopClose(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	remote := netip.MustParseAddrPort("127.0.0.1:51820")
+	tunnel, err := TurnOnMultihop(logger, tuntest.NewChannelTUN().TUN(), 1420, netip.MustParseAddr("10.0.0.2"), remote, "listen_port=0\n", "listen_port=0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := make(chan struct{}, 4)
+	for _, dev := range tunnel.Devices {
+		dev.SubscribeFiltered(device.NotificationFilter{Kinds: []device.NotificationKind{device.NotificationChainClosing}}, func(device.Notification) {
+			closing <- struct{}{}
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		tunnel.Close()
+		tunnel.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if len(closing) != 2 {
+		t.Errorf("chain closing published %d times, want 2", len(closing))
+	}
+}
@@ -64,3 +64,9 @@ func UAPIOpen(name string) (*os.File, error) {
 	}
 	return listener.File()
 }
+
+// UAPIDial connects to the UAPI socket of the interface name, as opened by
+// UAPIOpen.
+func UAPIDial(name string) (net.Conn, error) {
+	return net.Dial("unix", sockPath(name))
+}
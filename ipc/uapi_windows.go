@@ -6,7 +6,9 @@
 package ipc
 
 import (
+	"fmt"
 	"net"
+	"strings"
 
 	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/ipc/namedpipe"
@@ -49,8 +51,14 @@ func (l *UAPIListener) Addr() net.Addr {
 	return l.listener.Addr()
 }
 
+// UAPISecurityDescriptor grants full access to the UAPI named pipe to
+// SYSTEM and to the builtin Administrators only, at high integrity.
 var UAPISecurityDescriptor *windows.SECURITY_DESCRIPTOR
 
+// UAPIPipePrefix is the directory of the UAPI named pipes of interfaces,
+// which only Administrators may create pipes in.
+const UAPIPipePrefix = `\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`
+
 func init() {
 	var err error
 	UAPISecurityDescriptor, err = windows.SecurityDescriptorFromString("O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)S:(ML;;NWNRNX;;;HI)")
@@ -59,10 +67,49 @@ func init() {
 	}
 }
 
+// UAPIListenConfig configures the named pipe of UAPIListenConfig.Listen.
+// The zero value is that of UAPIListen.
+type UAPIListenConfig struct {
+	// PipeName is the name of the pipe, a path starting with \\.\pipe\.
+	// If empty, it is the interface name in UAPIPipePrefix.
+	PipeName string
+
+	// SDDL is a security descriptor in SDDL format, controlling who may
+	// connect to the pipe. If empty, UAPISecurityDescriptor is used.
+	SDDL string
+}
+
+// PipePath returns the path of the pipe of the interface name.
+func (config *UAPIListenConfig) PipePath(name string) string {
+	if config.PipeName != "" {
+		return config.PipeName
+	}
+	return UAPIPipePrefix + name
+}
+
+// UAPIListen listens on the named pipe of the interface name in
+// UAPIPipePrefix, which only SYSTEM and Administrators may connect to.
 func UAPIListen(name string) (net.Listener, error) {
+	return (&UAPIListenConfig{}).Listen(name)
+}
+
+// Listen listens on the named pipe of the interface name.
+func (config *UAPIListenConfig) Listen(name string) (net.Listener, error) {
+	sd := UAPISecurityDescriptor
+	if config.SDDL != "" {
+		var err error
+		sd, err = windows.SecurityDescriptorFromString(config.SDDL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid security descriptor %q: %w", config.SDDL, err)
+		}
+	}
+	path := config.PipePath(name)
+	if !strings.HasPrefix(strings.ToLower(path), `\\.\pipe\`) {
+		return nil, fmt.Errorf("invalid pipe name %q", path)
+	}
 	listener, err := (&namedpipe.ListenConfig{
-		SecurityDescriptor: UAPISecurityDescriptor,
-	}).Listen(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\` + name)
+		SecurityDescriptor: sd,
+	}).Listen(path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,101 @@
+//go:build daita && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// wgActivateDaita enables DAITA for the peer with the given public key, in
+// either device of the tunnel, with the given maybenot machines.
+//
+//export wgActivateDaita
+func wgActivateDaita(handle C.int32_t, publicKey *C.uint8_t, machines *C.char, eventsCapacity C.uint32_t, actionsCapacity C.uint32_t, maxPaddingFrac C.double, maxBlockingFrac C.double) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	if publicKey == nil || machines == nil {
+		return C.int32_t(errInvalid)
+	}
+	var pk device.NoisePublicKey
+	copy(pk[:], unsafe.Slice((*byte)(publicKey), device.NoisePublicKeySize))
+	_, peer := t.Peer(pk)
+	if peer == nil {
+		return C.int32_t(errNoPeer)
+	}
+	if peer.EnableDaita(C.GoString(machines), uint(eventsCapacity), uint(actionsCapacity), float64(maxPaddingFrac), float64(maxBlockingFrac)) != nil {
+		return C.int32_t(errInvalid)
+	}
+	return 0
+}
+
+// wgActivateDaitaDirectional enables DAITA for the peer with the given public
+// key, in either device of the tunnel, with separate maybenot machines and
+// budgets for the packets sent to the peer and those received from it.
+//
+//export wgActivateDaitaDirectional
+func wgActivateDaitaDirectional(handle C.int32_t, publicKey *C.uint8_t, sentMachines *C.char, sentMaxPaddingFrac C.double, sentMaxBlockingFrac C.double, receivedMachines *C.char, receivedMaxPaddingFrac C.double, receivedMaxBlockingFrac C.double, eventsCapacity C.uint32_t, actionsCapacity C.uint32_t) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	if publicKey == nil || sentMachines == nil || receivedMachines == nil {
+		return C.int32_t(errInvalid)
+	}
+	var pk device.NoisePublicKey
+	copy(pk[:], unsafe.Slice((*byte)(publicKey), device.NoisePublicKeySize))
+	_, peer := t.Peer(pk)
+	if peer == nil {
+		return C.int32_t(errNoPeer)
+	}
+	sent := device.DaitaMachines{
+		Machines:        C.GoString(sentMachines),
+		MaxPaddingFrac:  float64(sentMaxPaddingFrac),
+		MaxBlockingFrac: float64(sentMaxBlockingFrac),
+	}
+	received := device.DaitaMachines{
+		Machines:        C.GoString(receivedMachines),
+		MaxPaddingFrac:  float64(receivedMaxPaddingFrac),
+		MaxBlockingFrac: float64(receivedMaxBlockingFrac),
+	}
+	if peer.EnableDaitaDirectional(sent, received, uint(eventsCapacity), uint(actionsCapacity)) != nil {
+		return C.int32_t(errInvalid)
+	}
+	return 0
+}
+
+// wgReloadDaitaMachines replaces the maybenot machines of the peer with the
+// given public key, in either device of the tunnel, which must have DAITA
+// enabled, without bringing the tunnel down.
+//
+//export wgReloadDaitaMachines
+func wgReloadDaitaMachines(handle C.int32_t, publicKey *C.uint8_t, machines *C.char) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	if publicKey == nil || machines == nil {
+		return C.int32_t(errInvalid)
+	}
+	var pk device.NoisePublicKey
+	copy(pk[:], unsafe.Slice((*byte)(publicKey), device.NoisePublicKeySize))
+	_, peer := t.Peer(pk)
+	if peer == nil {
+		return C.int32_t(errNoPeer)
+	}
+	if peer.ReloadDaitaMachines(C.GoString(machines)) != nil {
+		return C.int32_t(errInvalid)
+	}
+	return 0
+}
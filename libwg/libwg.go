@@ -0,0 +1,309 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Command libwg is built with -buildmode=c-shared into a shared library that
+// embeds a wireguard-go device, for apps that cannot spawn the wireguard-go
+// binary. Run "make libwg" to build libwg.so and its header, libwg.h.
+//
+// The ABI is versioned by wgAbiVersion; functions are only ever added to it.
+// A tunnel is identified by a non-negative handle, returned by wgTurnOn or
+// wgTurnOnMultihop. Functions returning int32_t return 0 or a handle on
+// success and a negative errno value on failure:
+//
+//	-EBADF    the handle does not refer to a tunnel
+//	-EINVAL   invalid arguments or configuration
+//	-EIO      the TUN device or the bind could not be brought up
+//	-ENOENT   no peer has the given public key
+//	-ENOTSUP  the library was built without DAITA support
+//
+// Settings are in the format of the UAPI "set=1" operation, without the
+// operation line and the terminating empty line. Strings passed to the library
+// are copied and remain owned by the caller; strings returned by the library
+// must be released with wgFreePtr. Public keys are passed as 32 bytes.
+//
+// Log messages are passed to an optional callback, which may be called from
+// any thread until the tunnel is turned off.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef void (*wg_log_callback)(void *context, int32_t level, const char *msg);
+
+static void call_log_callback(wg_log_callback cb, void *context, int32_t level, const char *msg)
+{
+	cb(context, level, msg);
+}
+
+typedef struct {
+	uint64_t rx_bytes;
+	uint64_t tx_bytes;
+	int64_t last_handshake_sec;
+	int64_t last_handshake_nsec;
+} wg_peer_stats;
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/internal/embedding"
+)
+
+// abiVersion is incremented whenever functions are added to the ABI.
+const abiVersion = 2
+
+const (
+	errBadHandle    = -int32(unix.EBADF)
+	errInvalid      = -int32(unix.EINVAL)
+	errIO           = -int32(unix.EIO)
+	errNoPeer       = -int32(unix.ENOENT)
+	errNotSupported = -int32(unix.ENOTSUP)
+)
+
+var tunnels = struct {
+	sync.Mutex
+	m    map[int32]*embedding.Tunnel
+	next int32
+}{m: make(map[int32]*embedding.Tunnel)}
+
+func addTunnel(t *embedding.Tunnel) int32 {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	for {
+		handle := tunnels.next
+		if tunnels.next++; tunnels.next < 0 {
+			tunnels.next = 0
+		}
+		if _, ok := tunnels.m[handle]; !ok {
+			tunnels.m[handle] = t
+			return handle
+		}
+	}
+}
+
+func lookupTunnel(handle int32) *embedding.Tunnel {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	return tunnels.m[handle]
+}
+
+func removeTunnel(handle int32) *embedding.Tunnel {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	t := tunnels.m[handle]
+	delete(tunnels.m, handle)
+	return t
+}
+
+func newLogger(cb C.wg_log_callback, context unsafe.Pointer, level int) *device.Logger {
+	if cb == nil {
+		return embedding.NewLogger(level, nil)
+	}
+	return embedding.NewLogger(level, func(level int, msg string) {
+		cMsg := C.CString(msg)
+		C.call_log_callback(cb, context, C.int32_t(level), cMsg)
+		C.free(unsafe.Pointer(cMsg))
+	})
+}
+
+func tunFile(fd C.int32_t) (*os.File, int32) {
+	if fd < 0 {
+		return nil, errInvalid
+	}
+	return os.NewFile(uintptr(fd), "/dev/tun"), 0
+}
+
+//export wgAbiVersion
+func wgAbiVersion() C.int32_t {
+	return abiVersion
+}
+
+// wgTurnOn creates a tunnel on the TUN device tunFd, which the tunnel takes
+// ownership of, and applies settings to it.
+//
+//export wgTurnOn
+func wgTurnOn(tunFd C.int32_t, mtu C.int32_t, settings *C.char, logLevel C.int32_t, logCb C.wg_log_callback, logContext unsafe.Pointer) C.int32_t {
+	file, errno := tunFile(tunFd)
+	if file == nil {
+		return C.int32_t(errno)
+	}
+	logger := newLogger(logCb, logContext, int(logLevel))
+	t, errno := turnOn(file, int(mtu), C.GoString(settings), logger)
+	if t == nil {
+		return C.int32_t(errno)
+	}
+	return C.int32_t(addTunnel(t))
+}
+
+// wgTurnOnMultihop creates a tunnel through two relays on the TUN device
+// tunFd, which the tunnel takes ownership of. The exit device is configured
+// with exitSettings, which must contain the endpoint of the exit peer, and
+// tunnels its traffic through the entry device, configured with entrySettings.
+// privateIp is the address of this host inside the entry tunnel.
+//
+//export wgTurnOnMultihop
+func wgTurnOnMultihop(tunFd C.int32_t, mtu C.int32_t, exitSettings *C.char, entrySettings *C.char, privateIp *C.char, logLevel C.int32_t, logCb C.wg_log_callback, logContext unsafe.Pointer) C.int32_t {
+	file, errno := tunFile(tunFd)
+	if file == nil {
+		return C.int32_t(errno)
+	}
+	logger := newLogger(logCb, logContext, int(logLevel))
+	t, errno := turnOnMultihop(file, int(mtu), C.GoString(exitSettings), C.GoString(entrySettings), C.GoString(privateIp), logger)
+	if t == nil {
+		return C.int32_t(errno)
+	}
+	return C.int32_t(addTunnel(t))
+}
+
+// wgTurnOff closes the tunnel and its TUN device. The handle may be reused.
+//
+//export wgTurnOff
+func wgTurnOff(handle C.int32_t) C.int32_t {
+	t := removeTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	t.Close()
+	return 0
+}
+
+// wgSetConfig applies settings to the tunnel. In a multihop tunnel, they
+// apply to the exit device.
+//
+//export wgSetConfig
+func wgSetConfig(handle C.int32_t, settings *C.char) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	return C.int32_t(ipcSet(t.Devices[0], C.GoString(settings)))
+}
+
+// wgGetConfig returns the UAPI "get=1" output of the tunnel, or NULL. In a
+// multihop tunnel, the output is that of the exit device. The string must be
+// released with wgFreePtr.
+//
+//export wgGetConfig
+func wgGetConfig(handle C.int32_t) *C.char {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return nil
+	}
+	settings, err := t.Devices[0].IpcGet()
+	if err != nil {
+		return nil
+	}
+	return C.CString(settings)
+}
+
+// wgGetPeerStats fills stats with the counters of the peer with the given
+// public key, in either device of the tunnel.
+//
+//export wgGetPeerStats
+func wgGetPeerStats(handle C.int32_t, publicKey *C.uint8_t, stats *C.wg_peer_stats) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	if publicKey == nil || stats == nil {
+		return C.int32_t(errInvalid)
+	}
+	var pk device.NoisePublicKey
+	copy(pk[:], unsafe.Slice((*byte)(publicKey), device.NoisePublicKeySize))
+	s, errno := peerStatsOf(t, pk)
+	if errno != 0 {
+		return C.int32_t(errno)
+	}
+	stats.rx_bytes = C.uint64_t(s.rxBytes)
+	stats.tx_bytes = C.uint64_t(s.txBytes)
+	stats.last_handshake_sec = C.int64_t(s.lastHandshakeSec)
+	stats.last_handshake_nsec = C.int64_t(s.lastHandshakeNsec)
+	return 0
+}
+
+// wgNotifyResume tells both devices of the tunnel that the system resumed
+// from a suspend, so that they start over with their peers right away. Added
+// in version 2 of the ABI.
+//
+//export wgNotifyResume
+func wgNotifyResume(handle C.int32_t) C.int32_t {
+	t := lookupTunnel(int32(handle))
+	if t == nil {
+		return C.int32_t(errBadHandle)
+	}
+	for _, dev := range t.Devices {
+		dev.NotifyResume()
+	}
+	return 0
+}
+
+// wgFreePtr releases a string returned by the library.
+//
+//export wgFreePtr
+func wgFreePtr(ptr unsafe.Pointer) {
+	C.free(ptr)
+}
+
+func ipcSet(dev *device.Device, settings string) int32 {
+	err := dev.IpcSet(settings)
+	if err == nil {
+		return 0
+	}
+	var ipcErr *device.IPCError
+	if errors.As(err, &ipcErr) {
+		return int32(ipcErr.ErrorCode())
+	}
+	return errInvalid
+}
+
+type peerStats struct {
+	rxBytes, txBytes                    uint64
+	lastHandshakeSec, lastHandshakeNsec int64
+}
+
+// parsePeerStats extracts the counters of the peer with the given public key
+// from the output of IpcGet.
+func parsePeerStats(settings string, pk device.NoisePublicKey) (s peerStats, ok bool) {
+	want := fmt.Sprintf("%x", pk[:])
+	for _, line := range strings.Split(settings, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		if key == "public_key" {
+			if ok {
+				break
+			}
+			ok = value == want
+			continue
+		}
+		if !ok {
+			continue
+		}
+		switch key {
+		case "rx_bytes":
+			s.rxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			s.txBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "last_handshake_time_sec":
+			s.lastHandshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			s.lastHandshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return s, ok
+}
+
+func main() {}
@@ -0,0 +1,74 @@
+//go:build !windows && cgo
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/internal/embedding"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParsePeerStats(t *testing.T) {
+	var pk1, pk2 device.NoisePublicKey
+	pk1[0], pk2[0] = 1, 2
+	settings := fmt.Sprintf("private_key=%x\nlisten_port=51820\n"+
+		"public_key=%x\nrx_bytes=10\ntx_bytes=20\nlast_handshake_time_sec=30\nlast_handshake_time_nsec=40\n"+
+		"public_key=%x\nrx_bytes=50\ntx_bytes=60\n", pk1[:], pk1[:], pk2[:])
+
+	if s, ok := parsePeerStats(settings, pk1); !ok || s != (peerStats{10, 20, 30, 40}) {
+		t.Errorf("unexpected stats for the first peer: %+v, %v", s, ok)
+	}
+	if s, ok := parsePeerStats(settings, pk2); !ok || s != (peerStats{50, 60, 0, 0}) {
+		t.Errorf("unexpected stats for the second peer: %+v, %v", s, ok)
+	}
+	var pk3 device.NoisePublicKey
+	if _, ok := parsePeerStats(settings, pk3); ok {
+		t.Error("found stats for a missing peer")
+	}
+}
+
+func TestStartTunnel(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	binds := bindtest.NewChannelBinds()
+
+	tun := tuntest.NewChannelTUN()
+	tunnel, errno := started(embedding.Start(logger, embedding.DeviceConfig{TUN: tun.TUN(), Bind: binds[0], Settings: "listen_port=0\n"}))
+	if errno != 0 {
+		t.Fatalf("failed to start tunnel: %d", errno)
+	}
+	handle := addTunnel(tunnel)
+	if lookupTunnel(handle) != tunnel {
+		t.Fatal("tunnel not registered")
+	}
+	if removeTunnel(handle) != tunnel || lookupTunnel(handle) != nil {
+		t.Fatal("tunnel not removed")
+	}
+	tunnel.Close()
+
+	// Invalid settings of the second device close the first one, and the TUN
+	// device of the second one.
+	tun1, tun2 := tuntest.NewChannelTUN(), tuntest.NewChannelTUN()
+	_, errno = started(embedding.Start(logger,
+		embedding.DeviceConfig{TUN: tun1.TUN(), Bind: binds[0], Settings: "listen_port=0\n"},
+		embedding.DeviceConfig{TUN: tun2.TUN(), Bind: binds[1], Settings: "no_such_key=1\n"},
+	))
+	if errno != errInvalid {
+		t.Fatalf("expected %d, got %d", errInvalid, errno)
+	}
+	_, errno = started(embedding.Start(logger,
+		embedding.DeviceConfig{TUN: tuntest.NewChannelTUN().TUN(), Bind: binds[0], Settings: "no_such_key=1\n"},
+		embedding.DeviceConfig{TUN: tuntest.NewChannelTUN().TUN(), Bind: binds[1], Settings: "listen_port=0\n"},
+	))
+	if errno != errInvalid {
+		t.Fatalf("expected %d, got %d", errInvalid, errno)
+	}
+}
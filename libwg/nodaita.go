@@ -0,0 +1,33 @@
+//go:build !daita && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdint.h>
+import "C"
+
+// wgActivateDaita fails, as the library was built without DAITA support.
+//
+//export wgActivateDaita
+func wgActivateDaita(handle C.int32_t, publicKey *C.uint8_t, machines *C.char, eventsCapacity C.uint32_t, actionsCapacity C.uint32_t, maxPaddingFrac C.double, maxBlockingFrac C.double) C.int32_t {
+	return C.int32_t(errNotSupported)
+}
+
+// wgActivateDaitaDirectional fails, as the library was built without DAITA
+// support.
+//
+//export wgActivateDaitaDirectional
+func wgActivateDaitaDirectional(handle C.int32_t, publicKey *C.uint8_t, sentMachines *C.char, sentMaxPaddingFrac C.double, sentMaxBlockingFrac C.double, receivedMachines *C.char, receivedMaxPaddingFrac C.double, receivedMaxBlockingFrac C.double, eventsCapacity C.uint32_t, actionsCapacity C.uint32_t) C.int32_t {
+	return C.int32_t(errNotSupported)
+}
+
+// wgReloadDaitaMachines fails, as the library was built without DAITA support.
+//
+//export wgReloadDaitaMachines
+func wgReloadDaitaMachines(handle C.int32_t, publicKey *C.uint8_t, machines *C.char) C.int32_t {
+	return C.int32_t(errNotSupported)
+}
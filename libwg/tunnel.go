@@ -0,0 +1,79 @@
+//go:build !windows && cgo
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/internal/embedding"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func turnOn(file *os.File, mtu int, settings string, logger *device.Logger) (*embedding.Tunnel, int32) {
+	tunDev, err := tun.CreateTUNFromFile(file, mtu)
+	if err != nil {
+		logger.Errorf("Failed to create TUN device: %v", err)
+		file.Close()
+		return nil, errIO
+	}
+	return started(embedding.TurnOn(logger, tunDev, settings))
+}
+
+func turnOnMultihop(file *os.File, mtu int, exitSettings, entrySettings, privateIp string, logger *device.Logger) (*embedding.Tunnel, int32) {
+	local, err := netip.ParseAddr(privateIp)
+	if err != nil {
+		logger.Errorf("Invalid private IP %q: %v", privateIp, err)
+		file.Close()
+		return nil, errInvalid
+	}
+	remote, err := embedding.SettingsEndpoint(exitSettings)
+	if err != nil {
+		logger.Errorf("Invalid exit endpoint: %v", err)
+		file.Close()
+		return nil, errInvalid
+	}
+	tunDev, err := tun.CreateTUNFromFile(file, mtu)
+	if err != nil {
+		logger.Errorf("Failed to create TUN device: %v", err)
+		file.Close()
+		return nil, errIO
+	}
+	return started(embedding.TurnOnMultihop(logger, tunDev, mtu, local, remote, exitSettings, entrySettings))
+}
+
+// started returns the tunnel, or the errno of the error starting it: that of
+// the invalid configuration, or errIO if a device could not be brought up.
+func started(t *embedding.Tunnel, err error) (*embedding.Tunnel, int32) {
+	if err == nil {
+		return t, 0
+	}
+	var ipcErr *device.IPCError
+	if errors.As(err, &ipcErr) {
+		return nil, int32(ipcErr.ErrorCode())
+	}
+	return nil, errIO
+}
+
+func peerStatsOf(t *embedding.Tunnel, pk device.NoisePublicKey) (peerStats, int32) {
+	dev, _ := t.Peer(pk)
+	if dev == nil {
+		return peerStats{}, errNoPeer
+	}
+	settings, err := dev.IpcGet()
+	if err != nil {
+		return peerStats{}, errIO
+	}
+	s, ok := parsePeerStats(settings, pk)
+	if !ok {
+		return peerStats{}, errNoPeer
+	}
+	return s, 0
+}
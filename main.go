@@ -8,11 +8,13 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"golang.zx2c4.com/wireguard/conn"
@@ -30,10 +32,91 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_STATE_FILE         = "WG_STATE_FILE"
 )
 
 func printUsage() {
-	fmt.Printf("Usage: %s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("Usage: %s [-f/--foreground] [--config PATH] [--daita --daita-machines-file PATH [--daita-max-padding-frac FRAC] [--daita-max-blocking-frac FRAC]] INTERFACE-NAME\n", os.Args[0])
+	printCommandUsage()
+}
+
+// options are the command line arguments.
+type options struct {
+	foreground        bool
+	configFile        string  // wg-quick configuration to set up the interface with
+	daita             bool    // enable DAITA for every configured peer
+	daitaMachinesFile string  // maybenot machines for DAITA, one per line
+	daitaMaxPadding   float64 // fraction of the traffic DAITA may pad, 0 for no limit
+	daitaMaxBlocking  float64 // fraction of the traffic DAITA may block, 0 for no limit
+	interfaceName     string
+}
+
+func parseArgs(args []string) (opts options, ok bool) {
+	for len(args) > 1 {
+		switch args[0] {
+		case "-f", "--foreground":
+			opts.foreground = true
+			args = args[1:]
+		case "--config":
+			opts.configFile = args[1]
+			args = args[2:]
+		case "--daita":
+			opts.daita = true
+			args = args[1:]
+		case "--daita-machines-file":
+			opts.daitaMachinesFile = args[1]
+			args = args[2:]
+		case "--daita-max-padding-frac", "--daita-max-blocking-frac":
+			frac, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || !(frac >= 0 && frac <= 1) {
+				return opts, false
+			}
+			if args[0] == "--daita-max-padding-frac" {
+				opts.daitaMaxPadding = frac
+			} else {
+				opts.daitaMaxBlocking = frac
+			}
+			args = args[2:]
+		default:
+			return opts, false
+		}
+	}
+	if len(args) != 1 || args[0] == "" || args[0][0] == '-' {
+		return opts, false
+	}
+	// DAITA needs machines to run, and its limits are only valid with DAITA.
+	if opts.daita != (opts.daitaMachinesFile != "") || (!opts.daita && (opts.daitaMaxPadding != 0 || opts.daitaMaxBlocking != 0)) {
+		return opts, false
+	}
+	opts.interfaceName = args[0]
+	return opts, true
+}
+
+// readDaitaMachines reads the maybenot machines in path, one per line.
+// Empty lines and lines starting with # are skipped.
+func readDaitaMachines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var machines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		machines = append(machines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(machines) == 0 {
+		return nil, fmt.Errorf("no machines in %s", path)
+	}
+	return machines, nil
 }
 
 func warning() {
@@ -63,33 +146,19 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 && (os.Args[1] == "status" || os.Args[1] == "stats") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	warning()
 
-	var foreground bool
-	var interfaceName string
-	if len(os.Args) < 2 || len(os.Args) > 3 {
+	opts, ok := parseArgs(os.Args[1:])
+	if !ok {
 		printUsage()
 		return
 	}
-
-	switch os.Args[1] {
-
-	case "-f", "--foreground":
-		foreground = true
-		if len(os.Args) != 3 {
-			printUsage()
-			return
-		}
-		interfaceName = os.Args[2]
-
-	default:
-		foreground = false
-		if len(os.Args) != 2 {
-			printUsage()
-			return
-		}
-		interfaceName = os.Args[1]
-	}
+	foreground := opts.foreground
+	interfaceName := opts.interfaceName
 
 	if !foreground {
 		foreground = os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1"
@@ -109,12 +178,34 @@ func main() {
 		return device.LogLevelError
 	}()
 
+	// read the configuration file before creating the TUN device, which
+	// gets its MTU
+
+	var config *quickConfig
+	mtu := device.DefaultMTU
+	if opts.configFile != "" {
+		var err error
+		config, err = readQuickConfig(opts.configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", opts.configFile, err)
+			os.Exit(ExitSetupFailed)
+		}
+		if config.mtu != 0 {
+			mtu = config.mtu
+		}
+	}
+
 	// open TUN device (or use supplied fd)
 
 	tun, err := func() (tun.Device, error) {
 		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
 		if tunFdStr == "" {
-			return tun.CreateTUN(interfaceName, device.DefaultMTU)
+			if config != nil {
+				if err := runQuickHooks(config.preUp, interfaceName); err != nil {
+					return nil, fmt.Errorf("PreUp failed: %w", err)
+				}
+			}
+			return tun.CreateTUN(interfaceName, mtu)
 		}
 
 		// construct tun device from supplied fd
@@ -130,7 +221,7 @@ func main() {
 		}
 
 		file := os.NewFile(uintptr(fd), "")
-		return tun.CreateTUNFromFile(file, device.DefaultMTU)
+		return tun.CreateTUNFromFile(file, mtu)
 	}()
 
 	if err == nil {
@@ -152,6 +243,22 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	if err := device.CryptoSelfTest(); err != nil {
+		logger.Errorf("Cryptographic self-test failed: %v", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	// read the DAITA machines before daemonizing, to report errors
+
+	var daitaMachines []string
+	if opts.daita {
+		daitaMachines, err = readDaitaMachines(opts.daitaMachinesFile)
+		if err != nil {
+			logger.Errorf("Failed to read DAITA machines: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
 	// open UAPI file (or use supplied fd)
 
 	fileUAPI, err := func() (*os.File, error) {
@@ -222,7 +329,47 @@ func main() {
 		return
 	}
 
-	device := device.NewDevice(tun, conn.NewDefaultBind(), logger)
+	// The device gets a verbose logger capped at logLevel, so that the
+	// log_level UAPI key can raise it while the device is running.
+	deviceLogger := device.NewLogger(
+		device.LogLevelVerbose,
+		fmt.Sprintf("(%s) ", interfaceName),
+	)
+	device := device.NewDevice(tun, conn.NewDefaultBind(), deviceLogger)
+	device.SetLogLevel(logLevel)
+
+	if err := device.SetDefaultDaita(daitaMachines, opts.daitaMaxPadding, opts.daitaMaxBlocking); err != nil {
+		logger.Errorf("Failed to enable DAITA: %v", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	if path := os.Getenv(ENV_WG_STATE_FILE); path != "" {
+		if err := device.SetPeerStateFile(path); err != nil {
+			logger.Errorf("Failed to load peer state file: %v", err)
+		}
+	}
+
+	// set up the interface as wg-quick would
+
+	var routing *quickRouting
+	if config != nil {
+		if err := device.IpcSet(config.uapi); err != nil {
+			logger.Errorf("Failed to configure device: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+		routing, err = setUpQuickRouting(interfaceName, config, device)
+		if err != nil {
+			logger.Errorf("Failed to set up routing: %v", err)
+			device.Close()
+			os.Exit(ExitSetupFailed)
+		}
+		if err := runQuickHooks(config.postUp, interfaceName); err != nil {
+			logger.Errorf("PostUp failed: %v", err)
+			routing.Close()
+			device.Close()
+			os.Exit(ExitSetupFailed)
+		}
+	}
 
 	logger.Verbosef("Device started")
 
@@ -261,8 +408,21 @@ func main() {
 
 	// clean up
 
+	if config != nil {
+		if err := runQuickHooks(config.preDown, interfaceName); err != nil {
+			logger.Errorf("PreDown failed: %v", err)
+		}
+		if err := routing.Close(); err != nil {
+			logger.Errorf("Failed to tear down routing: %v", err)
+		}
+	}
 	uapi.Close()
 	device.Close()
+	if config != nil {
+		if err := runQuickHooks(config.postDown, interfaceName); err != nil {
+			logger.Errorf("PostDown failed: %v", err)
+		}
+	}
 
 	logger.Verbosef("Shutting down")
 }
@@ -11,6 +11,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	"golang.org/x/sys/windows/svc"
+
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/ipc"
@@ -23,14 +25,75 @@ const (
 	ExitSetupFailed  = 1
 )
 
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [--pipe-name PIPE] [--pipe-sddl SDDL] INTERFACE-NAME\n", os.Args[0])
+}
+
+// options are the command line arguments.
+type options struct {
+	interfaceName string
+	uapi          ipc.UAPIListenConfig
+}
+
+func parseArgs(args []string) (opts options, ok bool) {
+	for len(args) > 1 {
+		switch args[0] {
+		case "--pipe-name":
+			opts.uapi.PipeName = args[1]
+		case "--pipe-sddl":
+			opts.uapi.SDDL = args[1]
+		default:
+			return opts, false
+		}
+		args = args[2:]
+	}
+	if len(args) != 1 || args[0] == "" || args[0][0] == '-' {
+		return opts, false
+	}
+	opts.interfaceName = args[0]
+	return opts, true
+}
+
 func main() {
-	if len(os.Args) != 2 {
+	opts, ok := parseArgs(os.Args[1:])
+	if !ok {
+		printUsage()
+		os.Exit(ExitSetupFailed)
+	}
+
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to determine whether running as a service: %v\n", err)
 		os.Exit(ExitSetupFailed)
 	}
-	interfaceName := os.Args[1]
+	if isService {
+		// The service control manager reports the exit code of the tunnel
+		// as the service-specific exit code.
+		if err := svc.Run(opts.interfaceName, &service{opts}); err != nil {
+			os.Exit(ExitSetupFailed)
+		}
+		return
+	}
 
 	fmt.Fprintln(os.Stderr, "Warning: this is a test program for Windows, mainly used for debugging this Go package. For a real WireGuard for Windows client, the repo you want is <https://git.zx2c4.com/wireguard-windows/>, which includes this code as a module.")
 
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt)
+	signal.Notify(term, os.Kill)
+	signal.Notify(term, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-term
+		close(stop)
+	}()
+	os.Exit(run(opts, stop, func() {}))
+}
+
+// run brings up the tunnel, calls started once it is up and its UAPI pipe
+// is listening, and runs it until stop is closed, the UAPI listener fails
+// or the device is closed. It returns the exit code of the process.
+func run(opts options, stop <-chan struct{}, started func()) int {
+	interfaceName := opts.interfaceName
 	logger := device.NewLogger(
 		device.LogLevelVerbose,
 		fmt.Sprintf("(%s) ", interfaceName),
@@ -45,25 +108,26 @@ func main() {
 		}
 	} else {
 		logger.Errorf("Failed to create TUN device: %v", err)
-		os.Exit(ExitSetupFailed)
+		return ExitSetupFailed
 	}
 
 	device := device.NewDevice(tun, conn.NewDefaultBind(), logger)
 	err = device.Up()
 	if err != nil {
 		logger.Errorf("Failed to bring up device: %v", err)
-		os.Exit(ExitSetupFailed)
+		device.Close()
+		return ExitSetupFailed
 	}
 	logger.Verbosef("Device started")
 
-	uapi, err := ipc.UAPIListen(interfaceName)
+	uapi, err := opts.uapi.Listen(interfaceName)
 	if err != nil {
-		logger.Errorf("Failed to listen on uapi socket: %v", err)
-		os.Exit(ExitSetupFailed)
+		logger.Errorf("Failed to listen on uapi pipe %s: %v", opts.uapi.PipePath(interfaceName), err)
+		device.Close()
+		return ExitSetupFailed
 	}
 
 	errs := make(chan error)
-	term := make(chan os.Signal, 1)
 
 	go func() {
 		for {
@@ -75,16 +139,13 @@ func main() {
 			go device.IpcHandle(conn)
 		}
 	}()
-	logger.Verbosef("UAPI listener started")
+	logger.Verbosef("UAPI listener started on %s", opts.uapi.PipePath(interfaceName))
+	started()
 
 	// wait for program to terminate
 
-	signal.Notify(term, os.Interrupt)
-	signal.Notify(term, os.Kill)
-	signal.Notify(term, syscall.SIGTERM)
-
 	select {
-	case <-term:
+	case <-stop:
 	case <-errs:
 	case <-device.Wait():
 	}
@@ -95,4 +156,44 @@ func main() {
 	device.Close()
 
 	logger.Verbosef("Shutting down")
+	return ExitSetupSuccess
+}
+
+// service runs the tunnel as a Windows service, reporting its state to the
+// service control manager, which stops it on service stop and on shutdown.
+type service struct {
+	opts options
+}
+
+func (s *service) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() {
+		done <- run(s.opts, stop, func() {
+			changes <- svc.Status{State: svc.Running, Accepts: accepted}
+		})
+	}()
+
+	for {
+		select {
+		case code := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			return code != ExitSetupSuccess, uint32(code)
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				select {
+				case <-stop:
+				default:
+					close(stop)
+				}
+			}
+		}
+	}
 }
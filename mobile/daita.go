@@ -0,0 +1,64 @@
+//go:build daita && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package mobile
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// EnableDaita enables DAITA for the peer with the given public key, in either
+// device of the tunnel, with the given maybenot machines, separated by
+// newlines.
+func (t *Tunnel) EnableDaita(publicKey []byte, machines string, eventsCapacity int, actionsCapacity int, maxPaddingFrac float64, maxBlockingFrac float64) error {
+	peer, err := t.daitaPeer(publicKey, eventsCapacity, actionsCapacity)
+	if err != nil {
+		return err
+	}
+	if err := peer.EnableDaita(machines, uint(eventsCapacity), uint(actionsCapacity), maxPaddingFrac, maxBlockingFrac); err != nil {
+		return fmt.Errorf("failed to enable DAITA: %w", err)
+	}
+	return nil
+}
+
+// EnableDaitaDirectional enables DAITA for the peer with the given public key,
+// in either device of the tunnel, with separate maybenot machines, separated
+// by newlines, for the packets sent to the peer and for those received from
+// it. Either may be empty, but not both. Each set has its own padding and
+// blocking budgets, both limited by maxPaddingFrac and maxBlockingFrac.
+func (t *Tunnel) EnableDaitaDirectional(publicKey []byte, sentMachines string, receivedMachines string, eventsCapacity int, actionsCapacity int, maxPaddingFrac float64, maxBlockingFrac float64) error {
+	peer, err := t.daitaPeer(publicKey, eventsCapacity, actionsCapacity)
+	if err != nil {
+		return err
+	}
+	sent := device.DaitaMachines{Machines: sentMachines, MaxPaddingFrac: maxPaddingFrac, MaxBlockingFrac: maxBlockingFrac}
+	received := device.DaitaMachines{Machines: receivedMachines, MaxPaddingFrac: maxPaddingFrac, MaxBlockingFrac: maxBlockingFrac}
+	if err := peer.EnableDaitaDirectional(sent, received, uint(eventsCapacity), uint(actionsCapacity)); err != nil {
+		return fmt.Errorf("failed to enable DAITA: %w", err)
+	}
+	return nil
+}
+
+// daitaPeer returns the peer with the given public key, in either device of
+// the tunnel, checking the capacities of its DAITA queues.
+func (t *Tunnel) daitaPeer(publicKey []byte, eventsCapacity int, actionsCapacity int) (*device.Peer, error) {
+	pk, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	_, peer := t.tunnel.Peer(pk)
+	if peer == nil {
+		return nil, errNoPeer
+	}
+	if eventsCapacity < 0 || actionsCapacity < 0 {
+		return nil, errors.New("negative queue capacity")
+	}
+	return peer, nil
+}
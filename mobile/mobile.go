@@ -0,0 +1,264 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package mobile embeds wireguard-go in Android and iOS apps. It is built with
+// gomobile, with "make wireguard.aar" or "make Wireguard.xcframework", so its
+// API is limited to the types gomobile can bind: strings, byte slices,
+// numbers, and structs and interfaces of them.
+//
+// A Tunnel is turned on with TurnOn or TurnOnMultihop on a TUN device
+// created by the app, which passes its file descriptor. Settings are in the
+// format of the UAPI "set=1" operation, without the operation line and the
+// terminating empty line. Public keys are passed as 32 bytes.
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/internal/embedding"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Log levels passed to TurnOn and to Logger.Log.
+const (
+	LogLevelSilent  = device.LogLevelSilent
+	LogLevelError   = device.LogLevelError
+	LogLevelVerbose = device.LogLevelVerbose
+)
+
+// A Logger receives the log messages of a tunnel. It may be called from any
+// thread until the tunnel is closed.
+type Logger interface {
+	Log(level int, msg string)
+}
+
+// An EventHandler receives the events of a tunnel. OnEvent is called from the
+// routines of the tunnel and must return quickly.
+type EventHandler interface {
+	OnEvent(event *Event)
+}
+
+// An Event is a device.Notification.
+type Event struct {
+	Kind     string // the name of the device.NotificationKind, such as "PeerGoodbye"
+	Topic    string // the name of its device.Topic, such as "handshake"
+	UnixNano int64
+	Peer     []byte // public key of the peer, or nil for tunnel-wide events
+	Message  string
+}
+
+// PeerStats are the counters of a peer.
+type PeerStats struct {
+	RxBytes  int64
+	TxBytes  int64
+	Endpoint string // empty if unknown
+	// LastHandshakeUnixNano is the time of the last handshake, or 0 if there
+	// was none.
+	LastHandshakeUnixNano int64
+}
+
+// A Tunnel is one device on a TUN device, or two chained devices in a
+// multihop tunnel.
+type Tunnel struct {
+	tunnel *embedding.Tunnel
+}
+
+// TurnOn creates a tunnel on the TUN device tunFd, which the tunnel takes
+// ownership of, and applies settings to it. logger may be nil.
+func TurnOn(tunFd int, mtu int, settings string, logLevel int, logger Logger) (*Tunnel, error) {
+	log := newLogger(logger, logLevel)
+	tunDev, err := createTUN(tunFd, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return newTunnel(embedding.TurnOn(log, tunDev, settings))
+}
+
+// TurnOnMultihop creates a tunnel through two relays on the TUN device tunFd,
+// which the tunnel takes ownership of. The exit device is configured with
+// exitSettings, which must contain the endpoint of the exit peer, and tunnels
+// its traffic through the entry device, configured with entrySettings.
+// privateIP is the address of this host inside the entry tunnel. logger may
+// be nil.
+func TurnOnMultihop(tunFd int, mtu int, exitSettings string, entrySettings string, privateIP string, logLevel int, logger Logger) (*Tunnel, error) {
+	log := newLogger(logger, logLevel)
+	local, err := netip.ParseAddr(privateIP)
+	if err != nil {
+		closeFd(tunFd)
+		return nil, fmt.Errorf("invalid private IP %q: %w", privateIP, err)
+	}
+	remote, err := embedding.SettingsEndpoint(exitSettings)
+	if err != nil {
+		closeFd(tunFd)
+		return nil, fmt.Errorf("invalid exit endpoint: %w", err)
+	}
+	tunDev, err := createTUN(tunFd, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return newTunnel(embedding.TurnOnMultihop(log, tunDev, mtu, local, remote, exitSettings, entrySettings))
+}
+
+func newTunnel(tunnel *embedding.Tunnel, err error) (*Tunnel, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{tunnel}, nil
+}
+
+// SetConfig applies settings to the tunnel. In a multihop tunnel, they apply
+// to the exit device.
+func (t *Tunnel) SetConfig(settings string) error {
+	return t.tunnel.Devices[0].IpcSet(settings)
+}
+
+// SetEntryConfig applies settings to the entry device of a multihop tunnel.
+func (t *Tunnel) SetEntryConfig(settings string) error {
+	if len(t.tunnel.Devices) < 2 {
+		return errors.New("not a multihop tunnel")
+	}
+	return t.tunnel.Devices[1].IpcSet(settings)
+}
+
+// Config returns the UAPI "get=1" output of the tunnel. In a multihop tunnel,
+// the output is that of the exit device.
+func (t *Tunnel) Config() (string, error) {
+	return t.tunnel.Devices[0].IpcGet()
+}
+
+// PeerStats returns the counters of the peer with the given public key, in
+// either device of the tunnel.
+func (t *Tunnel) PeerStats(publicKey []byte) (*PeerStats, error) {
+	pk, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	dev, _ := t.tunnel.Peer(pk)
+	if dev == nil {
+		return nil, errNoPeer
+	}
+	_, total := dev.Peers(0, 0)
+	peers, _ := dev.Peers(0, total)
+	for _, peer := range peers {
+		if peer.PublicKey != pk {
+			continue
+		}
+		stats := &PeerStats{
+			RxBytes:  int64(peer.RxBytes),
+			TxBytes:  int64(peer.TxBytes),
+			Endpoint: peer.Endpoint,
+		}
+		if !peer.LastHandshake.IsZero() {
+			stats.LastHandshakeUnixNano = peer.LastHandshake.UnixNano()
+		}
+		return stats, nil
+	}
+	return nil, errNoPeer
+}
+
+// NotifyResume tells both devices of the tunnel that the system resumed from
+// a suspend, so that they start over with their peers right away.
+func (t *Tunnel) NotifyResume() {
+	for _, dev := range t.tunnel.Devices {
+		dev.NotifyResume()
+	}
+}
+
+// A Subscription delivers the events of a tunnel to an EventHandler until it
+// is cancelled.
+type Subscription struct {
+	unsubscribe []func()
+}
+
+// Cancel stops the delivery of events. It may be called more than once.
+func (s *Subscription) Cancel() {
+	for _, unsubscribe := range s.unsubscribe {
+		unsubscribe()
+	}
+	s.unsubscribe = nil
+}
+
+// Subscribe delivers the events of both devices of the tunnel to handler.
+func (t *Tunnel) Subscribe(handler EventHandler) *Subscription {
+	return t.subscribe(device.NotificationFilter{}, handler)
+}
+
+// SubscribeTopics delivers the events of both devices of the tunnel about
+// topics, a comma-separated list of topic names such as "handshake,daita", to
+// handler.
+func (t *Tunnel) SubscribeTopics(topics string, handler EventHandler) (*Subscription, error) {
+	filter, err := device.ParseTopics(topics)
+	if err != nil {
+		return nil, err
+	}
+	return t.subscribe(device.NotificationFilter{Topics: filter}, handler), nil
+}
+
+func (t *Tunnel) subscribe(filter device.NotificationFilter, handler EventHandler) *Subscription {
+	s := &Subscription{}
+	for _, dev := range t.tunnel.Devices {
+		s.unsubscribe = append(s.unsubscribe, dev.SubscribeFiltered(filter, func(n device.Notification) {
+			event := &Event{
+				Kind:     n.Kind.String(),
+				Topic:    n.Topic.String(),
+				UnixNano: n.Time.UnixNano(),
+				Message:  n.Message,
+			}
+			if n.Peer != (device.NoisePublicKey{}) {
+				event.Peer = n.Peer[:]
+			}
+			handler.OnEvent(event)
+		}))
+	}
+	return s
+}
+
+// Close closes the tunnel and its TUN device, the exit device first so that
+// it stops sending into the entry device. It may be called more than once.
+func (t *Tunnel) Close() {
+	t.tunnel.Close()
+}
+
+var errNoPeer = errors.New("no peer has the given public key")
+
+func parsePublicKey(publicKey []byte) (pk device.NoisePublicKey, err error) {
+	if len(publicKey) != device.NoisePublicKeySize {
+		return pk, fmt.Errorf("public key of %d bytes instead of %d", len(publicKey), device.NoisePublicKeySize)
+	}
+	copy(pk[:], publicKey)
+	return pk, nil
+}
+
+func newLogger(logger Logger, level int) *device.Logger {
+	if logger == nil {
+		return embedding.NewLogger(level, nil)
+	}
+	return embedding.NewLogger(level, logger.Log)
+}
+
+func createTUN(fd int, mtu int) (tun.Device, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid TUN file descriptor %d", fd)
+	}
+	file := os.NewFile(uintptr(fd), "/dev/tun")
+	tunDev, err := tun.CreateTUNFromFile(file, mtu)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	return tunDev, nil
+}
+
+func closeFd(fd int) {
+	if fd >= 0 {
+		os.NewFile(uintptr(fd), "/dev/tun").Close()
+	}
+}
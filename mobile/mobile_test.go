@@ -0,0 +1,152 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package mobile
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/internal/embedding"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type eventRecorder chan *Event
+
+func (r eventRecorder) OnEvent(event *Event) {
+	select {
+	case r <- event:
+	default:
+	}
+}
+
+type keyPair struct {
+	private, public []byte
+}
+
+func newKeyPair(t *testing.T) keyPair {
+	private := make([]byte, 32)
+	if _, err := rand.Read(private); err != nil {
+		t.Fatal(err)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPair{private, public}
+}
+
+func TestTunnel(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	binds := bindtest.NewChannelBinds()
+	keys := [2]keyPair{newKeyPair(t), newKeyPair(t)}
+	tuns := [2]*tuntest.ChannelTUN{tuntest.NewChannelTUN(), tuntest.NewChannelTUN()}
+
+	var tunnels [2]*Tunnel
+	for i := range tunnels {
+		settings := fmt.Sprintf("private_key=%x\npublic_key=%x\ngoodbye=true\nallowed_ip=1.0.0.%d/32\n",
+			keys[i].private, keys[i^1].public, 2-i)
+		tunnel, err := newTunnel(embedding.Start(logger, embedding.DeviceConfig{TUN: tuns[i].TUN(), Bind: binds[i], Settings: settings}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+		tunnels[i] = tunnel
+	}
+	// The channel binds pick the ports of the devices.
+	for i, tunnel := range tunnels {
+		cfg, err := tunnels[i^1].Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := strings.Cut(cfg, "listen_port=")
+		port, _, _ = strings.Cut(port, "\n")
+		if err := tunnel.SetConfig(fmt.Sprintf("public_key=%x\nendpoint=127.0.0.1:%s\n", keys[i^1].public, port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := make(eventRecorder, 1)
+	subscription := tunnels[0].Subscribe(events)
+	defer subscription.Cancel()
+
+	msg := tuntest.Ping(testIP(1), testIP(2))
+	tuns[1].Outbound <- msg
+	select {
+	case got := <-tuns[0].Inbound:
+		if string(got) != string(msg) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	stats, err := tunnels[0].PeerStats(keys[1].public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RxBytes == 0 || stats.LastHandshakeUnixNano == 0 || stats.Endpoint == "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, err := tunnels[0].PeerStats(keys[0].public); err != errNoPeer {
+		t.Errorf("expected no peer, got %v", err)
+	}
+	if _, err := tunnels[0].PeerStats([]byte{1}); err == nil {
+		t.Error("accepted a short public key")
+	}
+	if _, err := tunnels[0].SubscribeTopics("handshake,bogus", events); err == nil {
+		t.Error("subscribed to an unknown topic")
+	}
+	if err := tunnels[0].SetEntryConfig("listen_port=0\n"); err == nil {
+		t.Error("configured the entry device of a single hop tunnel")
+	}
+	if cfg, err := tunnels[0].Config(); err != nil || !strings.Contains(cfg, fmt.Sprintf("public_key=%x\n", keys[1].public)) {
+		t.Errorf("unexpected config %q: %v", cfg, err)
+	}
+
+	tunnels[0].NotifyResume()
+	select {
+	case event := <-events:
+		if event.Kind != "Resumed" || event.Topic != "device" || event.Peer != nil {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no resume event")
+	}
+
+	// Closing the second tunnel says goodbye to the first one.
+	tunnels[1].Close()
+	tunnels[1].Close()
+	select {
+	case event := <-events:
+		if event.Kind != "PeerGoodbye" || string(event.Peer) != string(keys[1].public) {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no goodbye event")
+	}
+}
+
+func testIP(last byte) netip.Addr {
+	return netip.AddrFrom4([4]byte{1, 0, 0, last})
+}
+
+func TestTurnOnFailure(t *testing.T) {
+	if _, err := TurnOn(-1, 1280, "", LogLevelSilent, nil); err == nil {
+		t.Error("turned on a tunnel without a TUN device")
+	}
+	if _, err := TurnOnMultihop(-1, 1280, "endpoint=[::1]:51820\n", "", "not an ip", LogLevelSilent, nil); err == nil {
+		t.Error("turned on a multihop tunnel with an invalid private IP")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !daita && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package mobile
+
+import (
+	"errors"
+)
+
+// EnableDaita fails, as the package was built without DAITA support.
+func (t *Tunnel) EnableDaita(publicKey []byte, machines string, eventsCapacity int, actionsCapacity int, maxPaddingFrac float64, maxBlockingFrac float64) error {
+	return errDaitaNotSupported
+}
+
+// EnableDaitaDirectional fails, as the package was built without DAITA
+// support.
+func (t *Tunnel) EnableDaitaDirectional(publicKey []byte, sentMachines string, receivedMachines string, eventsCapacity int, actionsCapacity int, maxPaddingFrac float64, maxBlockingFrac float64) error {
+	return errDaitaNotSupported
+}
+
+var errDaitaNotSupported = errors.New("built without DAITA support")
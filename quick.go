@@ -0,0 +1,273 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// A quickConfig is a configuration file in the format of wg-quick(8): the
+// configuration of wg(8), with the [Interface] section extended with the keys
+// of wg-quick that set up the interface and its routing. DNS and SaveConfig
+// are not supported.
+type quickConfig struct {
+	uapi       string         // the keys of wg(8), as an IpcSet configuration
+	addresses  []netip.Prefix // of the interface
+	mtu        int            // of the interface, 0 for device.DefaultMTU
+	table      string         // "auto", "off", or the routing table of the routes
+	fwmark     uint32         // set with FwMark, 0 if none
+	allowedIPs []netip.Prefix // of all peers, routed through the interface
+
+	preUp, postUp, preDown, postDown []string
+}
+
+// readQuickConfig reads the wg-quick configuration file at path.
+func readQuickConfig(path string) (*quickConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseQuickConfig(file)
+}
+
+// parseQuickConfig parses a wg-quick configuration. Like wg-quick, it takes
+// keys to be case-insensitive, and lists to be separated by commas.
+func parseQuickConfig(r io.Reader) (*quickConfig, error) {
+	config := &quickConfig{table: "auto"}
+	var uapi strings.Builder // of the interface
+	var peers []*quickPeer
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line)
+			switch section {
+			case "[interface]":
+			case "[peer]":
+				peers = append(peers, new(quickPeer))
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", n, line)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a key and a value", n)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		var err error
+		switch section {
+		case "[interface]":
+			err = config.parseInterfaceKey(&uapi, key, value)
+		case "[peer]":
+			err = config.parsePeerKey(peers[len(peers)-1], key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Peers start with their public key in the UAPI configuration, wherever
+	// it is in their section.
+	uapi.WriteString("replace_peers=true\n")
+	for _, peer := range peers {
+		if peer.publicKey == "" {
+			return nil, errors.New("peer without PublicKey")
+		}
+		fmt.Fprintf(&uapi, "public_key=%s\nreplace_allowed_ips=true\n%s", peer.publicKey, peer.uapi.String())
+	}
+	config.uapi = uapi.String()
+	return config, nil
+}
+
+// A quickPeer is a [Peer] section being parsed.
+type quickPeer struct {
+	publicKey string          // in hex
+	uapi      strings.Builder // the other keys of the peer
+}
+
+func (config *quickConfig) parseInterfaceKey(uapi *strings.Builder, key, value string) error {
+	switch key {
+	case "privatekey":
+		privateKey, err := decodeQuickKey("PrivateKey", value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "private_key=%s\n", privateKey)
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid ListenPort %q", value)
+		}
+		fmt.Fprintf(uapi, "listen_port=%d\n", port)
+	case "fwmark":
+		if value == "off" {
+			value = "0"
+		}
+		mark, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid FwMark %q", value)
+		}
+		config.fwmark = uint32(mark)
+		fmt.Fprintf(uapi, "fwmark=%d\n", mark)
+	case "address":
+		for _, address := range splitQuickList(value) {
+			prefix, err := parseQuickPrefix(address)
+			if err != nil {
+				return fmt.Errorf("invalid Address %q", address)
+			}
+			config.addresses = append(config.addresses, prefix)
+		}
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu < 576 || mtu > device.MaxContentSize {
+			return fmt.Errorf("invalid MTU %q", value)
+		}
+		config.mtu = mtu
+	case "table":
+		if value == "" {
+			return fmt.Errorf("invalid Table %q", value)
+		}
+		config.table = value
+	case "preup":
+		config.preUp = append(config.preUp, value)
+	case "postup":
+		config.postUp = append(config.postUp, value)
+	case "predown":
+		config.preDown = append(config.preDown, value)
+	case "postdown":
+		config.postDown = append(config.postDown, value)
+	case "dns":
+		return errors.New("DNS is not supported, set up the resolver in PostUp instead")
+	case "saveconfig":
+		if value == "true" {
+			return errors.New("SaveConfig is not supported")
+		}
+	default:
+		return fmt.Errorf("unknown key %q in [Interface]", key)
+	}
+	return nil
+}
+
+func (config *quickConfig) parsePeerKey(peer *quickPeer, key, value string) error {
+	uapi := &peer.uapi
+	switch key {
+	case "publickey":
+		publicKey, err := decodeQuickKey("PublicKey", value)
+		if err != nil {
+			return err
+		}
+		peer.publicKey = publicKey
+	case "presharedkey":
+		presharedKey, err := decodeQuickKey("PresharedKey", value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "preshared_key=%s\n", presharedKey)
+	case "allowedips":
+		for _, allowedIP := range splitQuickList(value) {
+			prefix, err := parseQuickPrefix(allowedIP)
+			if err != nil {
+				return fmt.Errorf("invalid AllowedIPs %q", allowedIP)
+			}
+			config.allowedIPs = append(config.allowedIPs, prefix)
+			fmt.Fprintf(uapi, "allowed_ip=%s\n", prefix)
+		}
+	case "endpoint":
+		addr, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return fmt.Errorf("invalid Endpoint %q: %w", value, err)
+		}
+		endpoint := addr.AddrPort()
+		fmt.Fprintf(uapi, "endpoint=%s\n", netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port()))
+	case "persistentkeepalive":
+		if value == "off" {
+			value = "0"
+		}
+		interval, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive %q", value)
+		}
+		fmt.Fprintf(uapi, "persistent_keepalive_interval=%d\n", interval)
+	default:
+		return fmt.Errorf("unknown key %q in [Peer]", key)
+	}
+	return nil
+}
+
+// decodeQuickKey converts the key called name from base64, as in the
+// configuration, to hex, as in the UAPI configuration.
+func decodeQuickKey(name, key string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("invalid %s", name)
+	}
+	return hex.EncodeToString(decoded), nil
+}
+
+func splitQuickList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseQuickPrefix parses an address with an optional prefix length, which is
+// that of a single address if missing.
+func parseQuickPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// runQuickHooks runs the commands of a PreUp, PostUp, PreDown or PostDown
+// hook with the shell, as wg-quick does, with %i replaced by the name of the
+// interface. It stops at the first command that fails.
+func runQuickHooks(hooks []string, interfaceName string) error {
+	for _, hook := range hooks {
+		command := strings.ReplaceAll(hook, "%i", interfaceName)
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%q: %w", command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type quickRouting struct{}
+
+// setUpQuickRouting fails, as the routing of wg-quick is only set up on Linux.
+func setUpQuickRouting(interfaceName string, config *quickConfig, dev *device.Device) (*quickRouting, error) {
+	return nil, errors.New("configuration files are only supported on Linux")
+}
+
+func (routing *quickRouting) Close() error {
+	return nil
+}
@@ -0,0 +1,314 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// quickDefaultTable is the routing table of the default routes of Table =
+// auto, and the fwmark that keeps the packets of the tunnel out of it, unless
+// FwMark is set, as with wg-quick.
+const quickDefaultTable = 51820
+
+// quickRouting is the routing of an interface set up by setUpQuickRouting.
+// Its addresses and routes go away with the interface, but the rules of
+// Table = auto must be deleted by Close.
+type quickRouting struct {
+	netlink *routeNetlink
+	rules   [][]byte // the bodies of the RTM_NEWRULE requests of the rules added
+}
+
+// setUpQuickRouting brings the interface up with the addresses of config,
+// and routes the allowed IPs of its peers through it, as wg-quick does, over
+// route netlink. With Table = auto, default routes go to a table of their
+// own, which a rule sends the packets without the fwmark of the device to,
+// while the packets of the tunnel are routed by the main table.
+func setUpQuickRouting(interfaceName string, config *quickConfig, dev *device.Device) (*quickRouting, error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	nl, err := openRouteNetlink()
+	if err != nil {
+		return nil, err
+	}
+	routing := &quickRouting{netlink: nl}
+	if err := routing.setUp(iface.Index, config, dev); err != nil {
+		routing.Close()
+		return nil, err
+	}
+	return routing, nil
+}
+
+func (routing *quickRouting) setUp(index int, config *quickConfig, dev *device.Device) error {
+	nl := routing.netlink
+	for _, prefix := range config.addresses {
+		msg := structBytes(&unix.IfAddrmsg{
+			Family:    prefixFamily(prefix),
+			Prefixlen: uint8(prefix.Bits()),
+			Index:     uint32(index),
+		})
+		msg = netlinkAttr(msg, unix.IFA_LOCAL, prefix.Addr().AsSlice())
+		msg = netlinkAttr(msg, unix.IFA_ADDRESS, prefix.Addr().AsSlice())
+		if err := nl.request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add address %v: %w", prefix, err)
+		}
+	}
+	link := structBytes(&unix.IfInfomsg{Index: int32(index), Flags: unix.IFF_UP, Change: unix.IFF_UP})
+	if err := nl.request(unix.RTM_NEWLINK, 0, link); err != nil {
+		return fmt.Errorf("failed to bring the interface up: %w", err)
+	}
+
+	if config.table == "off" {
+		return nil
+	}
+	table := uint32(unix.RT_TABLE_MAIN)
+	if config.table != "auto" {
+		var err error
+		if table, err = parseQuickTable(config.table); err != nil {
+			return err
+		}
+	}
+
+	// Like wg-quick, route the longest prefixes first.
+	prefixes := make([]netip.Prefix, 0, len(config.allowedIPs))
+	for _, prefix := range config.allowedIPs {
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return prefixes[i].Bits() > prefixes[j].Bits()
+	})
+	routed := make(map[netip.Prefix]bool)
+	for _, prefix := range prefixes {
+		if routed[prefix] {
+			continue
+		}
+		routed[prefix] = true
+		if config.table == "auto" && prefix.Bits() == 0 {
+			if err := routing.addDefault(index, prefix, config, dev); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := routing.addRoute(index, prefix, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRoute routes prefix through the interface in table.
+func (routing *quickRouting) addRoute(index int, prefix netip.Prefix, table uint32) error {
+	header := unix.RtMsg{
+		Family:   prefixFamily(prefix),
+		Dst_len:  uint8(prefix.Bits()),
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	if table < 256 {
+		header.Table = uint8(table)
+	}
+	msg := structBytes(&header)
+	if prefix.Bits() != 0 {
+		msg = netlinkAttr(msg, unix.RTA_DST, prefix.Addr().AsSlice())
+	}
+	msg = netlinkAttr(msg, unix.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(index)))
+	msg = netlinkAttr(msg, unix.RTA_TABLE, binary.NativeEndian.AppendUint32(nil, table))
+	// A route may already exist, such as the route of an address of the
+	// interface covering an allowed IP.
+	if err := routing.netlink.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add route %v: %w", prefix, err)
+	}
+	return nil
+}
+
+// addDefault routes the default route of the family of prefix through the
+// interface, in the table of the fwmark of the device, which is set to
+// quickDefaultTable if it has none.
+func (routing *quickRouting) addDefault(index int, prefix netip.Prefix, config *quickConfig, dev *device.Device) error {
+	if config.fwmark == 0 {
+		if err := dev.IpcSet(fmt.Sprintf("fwmark=%d\n", quickDefaultTable)); err != nil {
+			return fmt.Errorf("failed to set fwmark: %w", err)
+		}
+		config.fwmark = quickDefaultTable
+	}
+	table := config.fwmark
+	family := prefixFamily(prefix)
+	u32 := func(v uint32) []byte { return binary.NativeEndian.AppendUint32(nil, v) }
+
+	// not fwmark TABLE table TABLE
+	rule := structBytes(&unix.RtMsg{Family: family, Type: unix.FR_ACT_TO_TBL, Flags: unix.FIB_RULE_INVERT})
+	rule = netlinkAttr(rule, unix.FRA_FWMARK, u32(table))
+	rule = netlinkAttr(rule, unix.FRA_TABLE, u32(table))
+	if err := routing.addRule(rule); err != nil {
+		return err
+	}
+	// table main suppress_prefixlength 0
+	rule = structBytes(&unix.RtMsg{Family: family, Table: unix.RT_TABLE_MAIN, Type: unix.FR_ACT_TO_TBL})
+	rule = netlinkAttr(rule, unix.FRA_TABLE, u32(unix.RT_TABLE_MAIN))
+	rule = netlinkAttr(rule, unix.FRA_SUPPRESS_PREFIXLEN, u32(0))
+	if err := routing.addRule(rule); err != nil {
+		return err
+	}
+	if err := routing.addRoute(index, prefix, table); err != nil {
+		return err
+	}
+	if family == unix.AF_INET {
+		// Replies to the packets of the tunnel are routed by their fwmark.
+		if err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRule adds the rule of the body of an RTM_NEWRULE request, to be deleted
+// by Close.
+func (routing *quickRouting) addRule(rule []byte) error {
+	if err := routing.netlink.request(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, rule); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("failed to add rule: %w", err)
+	}
+	routing.rules = append(routing.rules, rule)
+	return nil
+}
+
+// Close deletes the rules that were added, and returns the first error.
+func (routing *quickRouting) Close() error {
+	var err error
+	for _, rule := range routing.rules {
+		if e := routing.netlink.request(unix.RTM_DELRULE, 0, rule); e != nil && !errors.Is(e, unix.ENOENT) && err == nil {
+			err = fmt.Errorf("failed to delete rule: %w", e)
+		}
+	}
+	routing.rules = nil
+	routing.netlink.Close()
+	return err
+}
+
+// parseQuickTable returns the number of the routing table name, a number or
+// a name of /etc/iproute2/rt_tables.
+func parseQuickTable(name string) (uint32, error) {
+	if table, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(table), nil
+	}
+	if name == "main" {
+		return unix.RT_TABLE_MAIN, nil
+	}
+	if file, err := os.Open("/etc/iproute2/rt_tables"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[1] == name {
+				if table, err := strconv.ParseUint(fields[0], 0, 32); err == nil {
+					return uint32(table), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown routing table %q", name)
+}
+
+func prefixFamily(prefix netip.Prefix) uint8 {
+	if prefix.Addr().Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// routeNetlink is a route netlink socket making one request at a time.
+type routeNetlink struct {
+	fd  int
+	seq uint32
+}
+
+func openRouteNetlink() (*routeNetlink, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &routeNetlink{fd: fd}, nil
+}
+
+// request sends a request of type typ with body, and waits for the kernel to
+// acknowledge it.
+func (nl *routeNetlink) request(typ, flags uint16, body []byte) error {
+	nl.seq++
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(body)),
+		Type:  typ,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   nl.seq,
+	}
+	msg := append(structBytes(&header), body...)
+	if err := unix.Sendto(nl.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(nl.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != nl.seq || reply.Header.Type != unix.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(reply.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func (nl *routeNetlink) Close() error {
+	return unix.Close(nl.fd)
+}
+
+// netlinkAttr appends an attribute of type typ holding data to msg.
+func netlinkAttr(msg []byte, typ uint16, data []byte) []byte {
+	attr := unix.RtAttr{Len: uint16(unix.SizeofRtAttr + len(data)), Type: typ}
+	msg = append(msg, structBytes(&attr)...)
+	msg = append(msg, data...)
+	for len(msg)%unix.NLMSG_ALIGNTO != 0 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// structBytes returns a copy of the memory of v, a netlink header.
+func structBytes[T any](v *T) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))...)
+}
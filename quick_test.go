@@ -0,0 +1,75 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuickConfig(t *testing.T) {
+	config, err := parseQuickConfig(strings.NewReader(`
+[Interface]
+PrivateKey = 6EtabScXwQA6E7QxVwNT26ypFGzxUMX4V1aA/rpSAno=
+ListenPort = 51820
+Address = 10.64.0.2/32, fc00:bbbb::2
+MTU = 1380
+Table = off
+PostUp = echo up %i # comments are ignored
+PostUp = echo still up
+
+[Peer]
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 192.0.2.1:51820
+PublicKey = uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=
+PersistentKeepalive = 25
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=51820
+replace_peers=true
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+replace_allowed_ips=true
+allowed_ip=0.0.0.0/0
+allowed_ip=::/0
+endpoint=192.0.2.1:51820
+persistent_keepalive_interval=25
+`
+	if config.uapi != want {
+		t.Errorf("got UAPI configuration:\n%s\nwant:\n%s", config.uapi, want)
+	}
+	addresses := []netip.Prefix{netip.MustParsePrefix("10.64.0.2/32"), netip.MustParsePrefix("fc00:bbbb::2/128")}
+	if !reflect.DeepEqual(config.addresses, addresses) {
+		t.Errorf("got addresses %v, want %v", config.addresses, addresses)
+	}
+	if config.mtu != 1380 || config.table != "off" || len(config.allowedIPs) != 2 {
+		t.Errorf("got MTU %d, table %q and allowed IPs %v", config.mtu, config.table, config.allowedIPs)
+	}
+	if postUp := []string{"echo up %i", "echo still up"}; !reflect.DeepEqual(config.postUp, postUp) {
+		t.Errorf("got PostUp %q, want %q", config.postUp, postUp)
+	}
+
+	for _, invalid := range []string{
+		"PrivateKey = x",
+		"[Interface]\nDNS = 10.64.0.1",
+		"[Interface]\nSaveConfig = true",
+		"[Interface]\nAddress = 10.64.0.300",
+		"[Interface]\nPeer = x",
+		"[Peer]\nAllowedIPs = 10.0.0.0/8",
+		"[Peer]\nPublicKey = uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=\nPersistentKeepalive = -1",
+		"[Relay]",
+	} {
+		if _, err := parseQuickConfig(strings.NewReader(invalid)); err == nil {
+			t.Errorf("parsed invalid configuration %q", invalid)
+		}
+	}
+}
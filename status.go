@@ -0,0 +1,324 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// printCommandUsage prints the usage of the status and stats subcommands,
+// which print the state of a running interface, including the keys of this
+// fork that wg(8) does not know about.
+func printCommandUsage() {
+	fmt.Printf("       %s status INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("       %s stats [--json] INTERFACE-NAME\n", os.Args[0])
+}
+
+// runCommand runs the subcommand command with args, and returns the exit code
+// of the process.
+func runCommand(command string, args []string) int {
+	var asJSON bool
+	if command == "stats" && len(args) > 0 && args[0] == "--json" {
+		asJSON = true
+		args = args[1:]
+	}
+	if len(args) != 1 || args[0] == "" || args[0][0] == '-' {
+		printUsage()
+		return ExitSetupFailed
+	}
+	name := args[0]
+
+	op := "get=1"
+	if asJSON {
+		op = "get=json"
+	}
+	get, err := uapiGet(name, op)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to access interface %s: %v\n", name, err)
+		return ExitSetupFailed
+	}
+
+	switch {
+	case command == "status":
+		writeStatus(os.Stdout, name, get, time.Now())
+	case asJSON:
+		stats, err := statsJSON([]byte(get))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to parse the state of interface %s: %v\n", name, err)
+			return ExitSetupFailed
+		}
+		os.Stdout.Write(append(stats, '\n'))
+	default:
+		writeStats(os.Stdout, name, get)
+	}
+	return ExitSetupSuccess
+}
+
+// uapiGet runs the UAPI get operation op, "get=1" or "get=json", on the
+// interface name, and returns its output without the errno line.
+func uapiGet(name, op string) (string, error) {
+	conn, err := ipc.UAPIDial(name)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n\n", op); err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(conn)
+	var get strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if errno, ok := strings.CutPrefix(line, "errno="); ok {
+			if errno = strings.TrimSpace(errno); errno != "0" {
+				return "", fmt.Errorf("UAPI error %s", errno)
+			}
+			return get.String(), nil
+		}
+		get.WriteString(line)
+	}
+}
+
+// uapiSection is the keys of the device, or of one of its peers, in the
+// output of a UAPI get operation, in order.
+type uapiSection []struct{ key, value string }
+
+func (s uapiSection) get(key string) string {
+	for _, pair := range s {
+		if pair.key == key {
+			return pair.value
+		}
+	}
+	return ""
+}
+
+func (s uapiSection) all(key string) []string {
+	var values []string
+	for _, pair := range s {
+		if pair.key == key {
+			values = append(values, pair.value)
+		}
+	}
+	return values
+}
+
+func parseUAPIGet(get string) (device uapiSection, peers []uapiSection) {
+	current := &device
+	for _, line := range strings.Split(get, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			peers = append(peers, nil)
+			current = &peers[len(peers)-1]
+		}
+		*current = append(*current, struct{ key, value string }{key, value})
+	}
+	return device, peers
+}
+
+// base64Key returns the hex encoded key in the base64 encoding of wg(8).
+func base64Key(hexKey string) string {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return hexKey
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 3 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.2f %ciB", value, "KMGT"[prefix])
+}
+
+func formatSince(t, now time.Time) string {
+	d := now.Sub(t).Round(time.Second)
+	if d <= 0 {
+		return "Now"
+	}
+	return d.String() + " ago"
+}
+
+// writeStatus prints the status of the interface name, from the output of a
+// "get=1" operation, similar to wg show.
+func writeStatus(w io.Writer, name, get string, now time.Time) {
+	dev, peers := parseUAPIGet(get)
+
+	fmt.Fprintf(w, "interface: %s\n", name)
+	if private, err := hex.DecodeString(dev.get("private_key")); err == nil && len(private) == 32 {
+		if public, err := curve25519.X25519(private, curve25519.Basepoint); err == nil {
+			fmt.Fprintf(w, "  public key: %s\n", base64.StdEncoding.EncodeToString(public))
+		}
+	}
+	for _, field := range []struct{ key, label string }{
+		{"listen_port", "listening port"},
+		{"fwmark", "fwmark"},
+		{"external_port", "external port"},
+		{"stealth", "stealth"},
+		{"features", "features"},
+	} {
+		if value := dev.get(field.key); value != "" {
+			fmt.Fprintf(w, "  %s: %s\n", field.label, value)
+		}
+	}
+
+	for _, peer := range peers {
+		fmt.Fprintf(w, "\npeer: %s\n", base64Key(peer.get("public_key")))
+		for _, field := range []struct{ key, label string }{
+			{"endpoint", "endpoint"},
+			{"multipath_endpoint", "multipath endpoint"},
+			{"direction", "direction"},
+		} {
+			if value := peer.get(field.key); value != "" {
+				fmt.Fprintf(w, "  %s: %s\n", field.label, value)
+			}
+		}
+		allowedIPs := strings.Join(peer.all("allowed_ip"), ", ")
+		if allowedIPs == "" {
+			allowedIPs = "(none)"
+		}
+		fmt.Fprintf(w, "  allowed ips: %s\n", allowedIPs)
+
+		if sec, _ := strconv.ParseInt(peer.get("last_handshake_time_sec"), 10, 64); sec != 0 {
+			nsec, _ := strconv.ParseInt(peer.get("last_handshake_time_nsec"), 10, 64)
+			fmt.Fprintf(w, "  latest handshake: %s\n", formatSince(time.Unix(sec, nsec), now))
+		}
+		rx, _ := strconv.ParseUint(peer.get("rx_bytes"), 10, 64)
+		tx, _ := strconv.ParseUint(peer.get("tx_bytes"), 10, 64)
+		if rx != 0 || tx != 0 {
+			fmt.Fprintf(w, "  transfer: %s received, %s sent\n", formatBytes(rx), formatBytes(tx))
+		}
+		if rtt, _ := strconv.ParseInt(peer.get("rtt_nsec"), 10, 64); rtt != 0 {
+			fmt.Fprintf(w, "  round-trip time: %s\n", time.Duration(rtt).Round(time.Microsecond))
+		}
+		if interval := peer.get("persistent_keepalive_interval"); interval != "" && interval != "0" {
+			fmt.Fprintf(w, "  persistent keepalive: every %s seconds\n", interval)
+		} else if interval := peer.get("auto_keepalive_interval"); interval != "" {
+			fmt.Fprintf(w, "  persistent keepalive: every %s seconds, behind NAT\n", interval)
+		}
+		if peer.get("daita") == "true" {
+			configured := len(peer.all("daita_machines")) + len(peer.all("daita_sent_machines")) + len(peer.all("daita_received_machines"))
+			daita := fmt.Sprintf("enabled, %d machines configured", configured)
+			if running := peer.all("daita_machine"); len(running) != 0 {
+				daita += fmt.Sprintf(", running %s", strings.Join(running, ", "))
+			} else {
+				daita += ", not running"
+			}
+			fmt.Fprintf(w, "  daita: %s\n", daita)
+		} else if running := peer.all("daita_machine"); len(running) != 0 {
+			fmt.Fprintf(w, "  daita: running %s\n", strings.Join(running, ", "))
+		}
+		if padding := peer.get("rx_daita_padding"); padding != "" {
+			bytes, _ := strconv.ParseUint(peer.get("rx_daita_padding_bytes"), 10, 64)
+			fmt.Fprintf(w, "  daita padding received: %s packets, %s\n", padding, formatBytes(bytes))
+		}
+		if malformed := peer.get("rx_daita_padding_malformed"); malformed != "" {
+			fmt.Fprintf(w, "  daita padding malformed: %s\n", malformed)
+		}
+		if dropped := peer.get("rx_dropped_daita_marker"); dropped != "" {
+			fmt.Fprintf(w, "  daita padding dropped: %s\n", dropped)
+		}
+		if remote := peer.get("remote_features"); remote != "" {
+			fmt.Fprintf(w, "  remote features: %s\n", remote)
+		}
+		if lastError := peer.get("last_error"); lastError != "" {
+			fmt.Fprintf(w, "  last error: %s\n", lastError)
+		}
+	}
+}
+
+// isStatKey reports whether a UAPI get key is a counter or a measurement,
+// rather than configuration.
+func isStatKey(key string) bool {
+	for _, prefix := range []string{"tx_", "rx_", "queue_", "handshake_failure", "goroutines_", "rekey_", "reject_"} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	switch key {
+	case "nonce_warnings", "clock_skew_alerts", "rtt_nsec", "last_handshake_time_sec", "last_handshake_time_nsec":
+		return true
+	}
+	return false
+}
+
+// writeStats prints the counters of the interface name, and of each of its
+// peers, from the output of a "get=1" operation.
+func writeStats(w io.Writer, name, get string) {
+	dev, peers := parseUAPIGet(get)
+	fmt.Fprintf(w, "interface: %s\n", name)
+	for _, pair := range dev {
+		if isStatKey(pair.key) {
+			fmt.Fprintf(w, "  %s: %s\n", pair.key, pair.value)
+		}
+	}
+	for _, peer := range peers {
+		fmt.Fprintf(w, "\npeer: %s\n", base64Key(peer.get("public_key")))
+		for _, pair := range peer {
+			if isStatKey(pair.key) {
+				fmt.Fprintf(w, "  %s: %s\n", pair.key, pair.value)
+			}
+		}
+	}
+}
+
+// statsJSON keeps the counters of the output of a "get=json" operation, and
+// the public keys of the peers.
+func statsJSON(get []byte) ([]byte, error) {
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(get, &state); err != nil {
+		return nil, err
+	}
+	var peers []map[string]json.RawMessage
+	if err := json.Unmarshal(state["peers"], &peers); err != nil {
+		return nil, err
+	}
+	keep := func(object map[string]json.RawMessage, also string) {
+		for key := range object {
+			if key != also && !isStatKey(key) {
+				delete(object, key)
+			}
+		}
+	}
+	keep(state, "")
+	stats := make(map[string]any, len(state)+1)
+	for key, value := range state {
+		stats[key] = value
+	}
+	for _, peer := range peers {
+		keep(peer, "public_key")
+	}
+	stats["peers"] = peers
+	return json.Marshal(stats)
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUAPIGet = `private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=51820
+queue_encryption=0/1024
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+endpoint=192.0.2.1:51820
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=0
+tx_bytes=2048
+rx_bytes=100
+persistent_keepalive_interval=25
+daita=true
+daita_machines=machine1
+daita_machines=machine2
+daita_sent_machines=machine3
+rx_daita_padding=12
+rx_daita_padding_bytes=6144
+rx_dropped_daita_marker=3
+allowed_ip=10.0.0.0/8
+allowed_ip=fd00::/64
+daita_machine=0:padding
+`
+
+func TestWriteStatus(t *testing.T) {
+	var b strings.Builder
+	writeStatus(&b, "wg0", testUAPIGet, time.Unix(1700000065, 0))
+	status := b.String()
+	for _, line := range []string{
+		"interface: wg0\n",
+		"  public key: wVMuGz01CPx+vDVPpnliDzPyhxSVQuaExnt7DYE2Kyk=\n",
+		"  listening port: 51820\n",
+		"peer: uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=\n",
+		"  allowed ips: 10.0.0.0/8, fd00::/64\n",
+		"  latest handshake: 1m5s ago\n",
+		"  transfer: 100 B received, 2.00 KiB sent\n",
+		"  persistent keepalive: every 25 seconds\n",
+		"  daita: enabled, 3 machines configured, running 0:padding\n",
+		"  daita padding received: 12 packets, 6.00 KiB\n",
+		"  daita padding dropped: 3\n",
+	} {
+		if !strings.Contains(status, line) {
+			t.Errorf("expected status to contain %q, got:\n%s", line, status)
+		}
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	get := `{"listen_port":51820,"queue_encryption":"0/1024","peers":[{"public_key":"b859","endpoint":"192.0.2.1:51820","tx_bytes":2048,"allowed_ip":[]}]}`
+	out, err := statsJSON([]byte(get))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats struct {
+		ListenPort      *int   `json:"listen_port"`
+		QueueEncryption string `json:"queue_encryption"`
+		Peers           []map[string]any
+	}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.ListenPort != nil || stats.QueueEncryption != "0/1024" {
+		t.Errorf("unexpected device stats: %s", out)
+	}
+	if len(stats.Peers) != 1 || len(stats.Peers[0]) != 2 || stats.Peers[0]["public_key"] != "b859" || stats.Peers[0]["tx_bytes"] != 2048.0 {
+		t.Errorf("unexpected peer stats: %s", out)
+	}
+}
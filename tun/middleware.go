@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// A Middleware intercepts the packets passing through a Device, so that layers
+// such as packet capture, padding or diagnostics can be written once and
+// stacked over any Device with Stack.
+//
+// A Middleware may additionally implement MTUMiddleware, to change the MTU
+// reported to the layers above, and io.Closer, to be closed with the stack.
+type Middleware interface {
+	// ReadPacket processes a packet read from the layer below, in
+	// buf[offset:offset+size], before it is passed up. It may rewrite the
+	// packet in place within buf, and returns its new size, or 0 to drop it.
+	ReadPacket(buf []byte, offset, size int) (int, error)
+
+	// WritePacket processes a packet written by the layer above, in
+	// buf[offset:], before it is passed down. It may rewrite the packet in
+	// place, growing it up to cap(buf), and returns its new size, or 0 to
+	// drop it.
+	WritePacket(buf []byte, offset int) (int, error)
+}
+
+// An MTUMiddleware is a Middleware that changes the MTU of the device, for
+// example because it adds headers or padding to the packets it writes.
+type MTUMiddleware interface {
+	Middleware
+	MTU(mtu int) int
+}
+
+// A ContextDevice is a Device whose reads and writes can give up once a
+// context is done.
+type ContextDevice interface {
+	Device
+	ReadContext(ctx context.Context, buf []byte, offset int) (int, error)
+	WriteContext(ctx context.Context, buf []byte, offset int) (int, error)
+}
+
+// Stack returns a Device passing the packets of dev through middlewares. The
+// first middleware is closest to dev: it sees packets read from dev first, and
+// packets written to the stack last. A dropped packet is not passed to the
+// middlewares above or below it, and a dropped write is reported as written.
+//
+// The returned Device is a ContextDevice, whose contexts are passed on to dev
+// if it is one as well. It has an Unwrap method returning dev, and a Dropped
+// method returning the number of packets read and written that the
+// middlewares dropped.
+func Stack(dev Device, middlewares ...Middleware) Device {
+	return &stack{
+		Device:      dev,
+		middlewares: append([]Middleware(nil), middlewares...),
+	}
+}
+
+type stack struct {
+	Device
+	middlewares []Middleware
+	dropped     struct {
+		read, written atomic.Uint64
+	}
+}
+
+// Unwrap returns the Device the stack was built over.
+func (s *stack) Unwrap() Device {
+	return s.Device
+}
+
+// Dropped returns the number of packets read and written that the middlewares
+// dropped.
+func (s *stack) Dropped() (read, written uint64) {
+	return s.dropped.read.Load(), s.dropped.written.Load()
+}
+
+func (s *stack) Read(buf []byte, offset int) (int, error) {
+	return s.ReadContext(context.Background(), buf, offset)
+}
+
+func (s *stack) ReadContext(ctx context.Context, buf []byte, offset int) (int, error) {
+	for {
+		var n int
+		var err error
+		if dev, ok := s.Device.(ContextDevice); ok {
+			n, err = dev.ReadContext(ctx, buf, offset)
+		} else {
+			n, err = s.Device.Read(buf, offset)
+		}
+		if err != nil || n == 0 {
+			return n, err
+		}
+		n, err = s.readPacket(buf, offset, n)
+		if err != nil || n > 0 {
+			return n, err
+		}
+		// The packet was dropped, read the next one.
+		s.dropped.read.Add(1)
+	}
+}
+
+// readPacket passes a packet read from the device up through the middlewares.
+func (s *stack) readPacket(buf []byte, offset, n int) (int, error) {
+	for _, m := range s.middlewares {
+		var err error
+		n, err = m.ReadPacket(buf, offset, n)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+	}
+	return n, nil
+}
+
+func (s *stack) Write(buf []byte, offset int) (int, error) {
+	return s.WriteContext(context.Background(), buf, offset)
+}
+
+func (s *stack) WriteContext(ctx context.Context, buf []byte, offset int) (int, error) {
+	written := len(buf) - offset
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		n, err := s.middlewares[i].WritePacket(buf, offset)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			s.dropped.written.Add(1)
+			return written, nil
+		}
+		buf = buf[:offset+n]
+	}
+	var err error
+	if dev, ok := s.Device.(ContextDevice); ok {
+		_, err = dev.WriteContext(ctx, buf, offset)
+	} else {
+		_, err = s.Device.Write(buf, offset)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+func (s *stack) MTU() (int, error) {
+	mtu, err := s.Device.MTU()
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range s.middlewares {
+		if m, ok := m.(MTUMiddleware); ok {
+			mtu = m.MTU(mtu)
+		}
+	}
+	return mtu, nil
+}
+
+// Close closes the middlewares that implement io.Closer, from the top of the
+// stack down, and then the device.
+func (s *stack) Close() error {
+	var errs []error
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		if c, ok := s.middlewares[i].(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	errs = append(errs, s.Device.Close())
+	return errors.Join(errs...)
+}
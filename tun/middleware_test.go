@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun_test
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// tagMiddleware appends its tag to packets read, and strips it from packets
+// written, if present. Packets starting with drop are dropped.
+type tagMiddleware struct {
+	tag    byte
+	drop   byte
+	closed bool
+}
+
+func (m *tagMiddleware) ReadPacket(buf []byte, offset, size int) (int, error) {
+	if buf[offset] == m.drop {
+		return 0, nil
+	}
+	buf[offset+size] = m.tag
+	return size + 1, nil
+}
+
+func (m *tagMiddleware) WritePacket(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	if packet[0] == m.drop {
+		return 0, nil
+	}
+	if packet[len(packet)-1] != m.tag {
+		return len(packet), nil
+	}
+	return len(packet) - 1, nil
+}
+
+func (m *tagMiddleware) MTU(mtu int) int {
+	return mtu - 1
+}
+
+func (m *tagMiddleware) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestStack(t *testing.T) {
+	ch := tuntest.NewChannelTUN()
+	lower := &tagMiddleware{tag: 'a', drop: 'x'}
+	upper := &tagMiddleware{tag: 'b', drop: 'y'}
+	dev := tun.Stack(ch.TUN(), lower, upper)
+
+	go func() {
+		ch.Outbound <- []byte("x dropped by lower")
+		ch.Outbound <- []byte("y dropped by upper")
+		ch.Outbound <- []byte("packet")
+	}()
+	const offset = 4
+	buf := make([]byte, 64)
+	n, err := dev.Read(buf, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf[offset : offset+n]; !bytes.Equal(got, []byte("packetab")) {
+		t.Errorf("read %q, want %q", got, "packetab")
+	}
+
+	written := make(chan []byte, 1)
+	go func() { written <- <-ch.Inbound }()
+	for _, packet := range []string{"y dropped by upper", "x dropped by lower", "packetab"} {
+		buf := append(make([]byte, offset), packet...)
+		n, err := dev.Write(buf, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(packet) {
+			t.Errorf("wrote %d bytes of %q, want %d", n, packet, len(packet))
+		}
+	}
+	if got := <-written; !bytes.Equal(got, []byte("packet")) {
+		t.Errorf("wrote %q, want %q", got, "packet")
+	}
+	dropped := dev.(interface{ Dropped() (uint64, uint64) })
+	if read, written := dropped.Dropped(); read != 2 || written != 2 {
+		t.Errorf("dropped %d reads and %d writes, want 2 and 2", read, written)
+	}
+
+	if mtu, err := dev.MTU(); err != nil || mtu != tuntest.DefaultMTU-2 {
+		t.Errorf("MTU %d, %v, want %d", mtu, err, tuntest.DefaultMTU-2)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !lower.closed || !upper.closed {
+		t.Error("middlewares not closed")
+	}
+	if unwrapped := dev.(interface{ Unwrap() tun.Device }).Unwrap(); unwrapped != ch.TUN() {
+		t.Error("Unwrap did not return the wrapped device")
+	}
+}
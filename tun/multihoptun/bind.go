@@ -1,83 +1,134 @@
 package multihoptun
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 
 	"golang.zx2c4.com/wireguard/conn"
 
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
+// multihopBind is a bind of a MultihopTun. Its context is derived from that
+// of the MultihopTun, so it is canceled when either is closed, and replaced
+// whenever the bind is opened.
 type multihopBind struct {
 	*MultihopTun
-	socketShutdown chan struct{}
+	mu     sync.Mutex // protects ctx and cancel
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// Close implements tun.Device
+// context returns the context of the bind since it was last opened.
+func (st *multihopBind) context() context.Context {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ctx
+}
+
+// Close implements conn.Bind.
 func (st *multihopBind) Close() error {
-	select {
-	case <-st.socketShutdown:
-		return nil
-	default:
-		close(st.socketShutdown)
-	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.cancel()
 	return nil
 }
 
 // Open implements conn.Bind.
-func (st *multihopBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
-	if port != 0 {
-		st.localPort = port
-	} else {
-		st.localPort = uint16(rand.Uint32()>>16) | 1
-	}
-	// WireGuard will close existing sockets before bringing up a new device on Bind updates.
-	// This guarantees that the socket shutdown channel is always available.
-	st.socketShutdown = make(chan struct{})
-
-	actualPort = st.localPort
-	fns = []conn.ReceiveFunc{
-		func(packet []byte) (bytesRead int, ep conn.Endpoint, err error) {
-			var batch packetBatch
-			var ok bool
-
-			select {
-			case <-st.shutdownChan:
-				return 0, ep, net.ErrClosed
-			case <-st.socketShutdown:
-				return 0, ep, net.ErrClosed
-			case batch, ok = <-st.writeRecv:
-				break
-			}
-			if !ok {
-				return 0, ep, net.ErrClosed
+func (st *multihopBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	ctx, actualPort := st.open(port)
+	fns := []conn.ReceiveFunc{
+		func(packet []byte) (int, conn.Endpoint, error) {
+			batch, _, err := st.nextWrite(ctx, true)
+			if err != nil {
+				return 0, nil, err
 			}
+			return st.fill(packet, batch), st.endpoint, nil
+		},
+	}
+	return fns, actualPort, nil
+}
 
-			ipVersion := header.IPVersion(batch.packet[batch.offset:])
-			if ipVersion == 4 {
-				v4 := header.IPv4(batch.packet[batch.offset:])
-				udp := header.UDP(v4.Payload())
-				copy(packet, udp.Payload())
-				bytesRead = len(udp.Payload())
-
-			} else if ipVersion == 6 {
-				v6 := header.IPv6(batch.packet[batch.offset:])
-				udp := header.UDP(v6.Payload())
-				copy(packet, udp.Payload())
-				bytesRead = len(udp.Payload())
+// OpenBatch implements conn.BatchReceiveBind. Its receive function waits for
+// a packet to be written to the MultihopTun, and fills the others already
+// waiting as well.
+func (st *multihopBind) OpenBatch(port uint16) ([]conn.BatchReceiveFunc, uint16, error) {
+	ctx, actualPort := st.open(port)
+	fns := []conn.BatchReceiveFunc{
+		func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+			for n < len(bufs) {
+				batch, ok, err := st.nextWrite(ctx, n == 0)
+				if err != nil {
+					return 0, err
+				}
+				if !ok {
+					break
+				}
+				sizes[n], eps[n] = st.fill(bufs[n], batch), st.endpoint
+				n++
 			}
-			batch.size = bytesRead
-			ep = st.endpoint
-
-			batch.completion <- batch
-			return
+			return n, nil
 		},
 	}
-
 	return fns, actualPort, nil
 }
 
+// open sets the local port of the bind and replaces its context, returning
+// the new one.
+func (st *multihopBind) open(port uint16) (context.Context, uint16) {
+	if port != 0 {
+		st.encapsulation.localPort = port
+	} else {
+		st.encapsulation.localPort = uint16(rand.Uint32()>>16) | 1
+	}
+	// WireGuard closes the bind before opening it again on bind updates, but
+	// the context of the previous opening is canceled here as well, so that
+	// its receive functions return even if it was not.
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.cancel()
+	st.ctx, st.cancel = context.WithCancel(st.MultihopTun.ctx)
+	return st.ctx, st.encapsulation.localPort
+}
+
+// nextWrite takes the next packet written to the MultihopTun. If wait is set,
+// it waits for one until ctx is done, otherwise it reports false if there is
+// none.
+func (st *multihopBind) nextWrite(ctx context.Context, wait bool) (batch packetBatch, ok bool, err error) {
+	if wait {
+		select {
+		case <-ctx.Done():
+			return batch, false, net.ErrClosed
+		case batch, ok = <-st.pipe.writeRecv:
+		}
+		if !ok {
+			return batch, false, net.ErrClosed
+		}
+		return batch, true, nil
+	}
+	select {
+	case batch, ok = <-st.pipe.writeRecv:
+		return batch, ok, nil
+	default:
+		return batch, false, nil
+	}
+}
+
+// fill copies the payload of batch into packet and hands batch back to its
+// writer. Payloads that would be truncated are consumed and reported as
+// empty, which the device drops.
+func (st *multihopBind) fill(packet []byte, batch packetBatch) int {
+	batch.size = 0
+	if payload := batch.packet[batch.offset:]; len(payload) <= len(packet) {
+		batch.size = copy(packet, payload)
+	}
+	batch.completion <- batch
+	return batch.size
+}
+
 // ParseEndpoint implements conn.Bind.
 func (*multihopBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 	return conn.NewStdNetBind().ParseEndpoint(s)
@@ -85,19 +136,41 @@ func (*multihopBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 
 // Send implements conn.Bind.
 func (st *multihopBind) Send(buf []byte, ep conn.Endpoint) error {
+	return st.SendWithFlowLabel(buf, ep, 0)
+}
+
+// SendWithFlowLabel implements conn.FlowLabelBind. The label is written into
+// the synthesized IPv6 header and ignored for IPv4.
+func (st *multihopBind) SendWithFlowLabel(buf []byte, ep conn.Endpoint, flowLabel uint32) error {
+	ctx := st.context()
+	if ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	if st.pipe.latency.delayed(&st.pipe.latency.toEntry, buf, flowLabel) {
+		return nil
+	}
+	return st.pipe.deliverToRead(ctx, buf, flowLabel)
+}
+
+// ReleaseFlowLabel implements conn.FlowLabelBind. Labels hold no resources.
+func (*multihopBind) ReleaseFlowLabel(uint32) {}
+
+// deliverToRead hands buf to a pending Read of the pipe, and returns once it
+// has been read. It gives up when the MultihopTun is closed or ctx is done.
+func (p *pipe) deliverToRead(ctx context.Context, buf []byte, flowLabel uint32) error {
 	var packetBatch packetBatch
 	var ok bool
 
 	select {
-	case <-st.shutdownChan:
+	case <-p.ctx.Done():
 		return net.ErrClosed
-	case <-st.socketShutdown:
+	case <-ctx.Done():
 		// it is important to return a net.ErrClosed, since it implements the
 		// net.Error interface and indicates that it is not a recoverable error.
 		// wg-go uses the net.Error interface to deduce if it should try to send
 		// packets again after some time or if it should give up.
 		return net.ErrClosed
-	case packetBatch, ok = <-st.readRecv:
+	case packetBatch, ok = <-p.readRecv:
 		break
 	}
 
@@ -105,10 +178,13 @@ func (st *multihopBind) Send(buf []byte, ep conn.Endpoint) error {
 		return net.ErrClosed
 	}
 
-	targetPacket := packetBatch.packet[packetBatch.offset:]
-	size, err := st.writePayload(targetPacket, buf)
-
-	packetBatch.size = size
+	var err error
+	if targetPacket := packetBatch.packet[packetBatch.offset:]; len(buf) <= len(targetPacket) {
+		packetBatch.size = copy(targetPacket, buf)
+		packetBatch.flowLabel = flowLabel
+	} else {
+		err = fmt.Errorf("target buffer is too small, need %d, got %d", len(buf), len(targetPacket))
+	}
 
 	packetBatch.completion <- packetBatch
 
@@ -119,3 +195,48 @@ func (st *multihopBind) Send(buf []byte, ep conn.Endpoint) error {
 func (*multihopBind) SetMark(mark uint32) error {
 	return nil
 }
+
+// udpPayload returns the UDP payload of an IPv4 or IPv6 packet without
+// allocating, or false if the packet is not a well-formed UDP datagram. IPv6
+// extension headers are not supported, as the peer device never emits them.
+func udpPayload(packet []byte) ([]byte, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+
+	var ipHeaderLen, ipLen int
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		if len(packet) < header.IPv4MinimumSize {
+			return nil, false
+		}
+		v4 := header.IPv4(packet)
+		ipHeaderLen = int(v4.HeaderLength())
+		ipLen = int(v4.TotalLength())
+		if v4.TransportProtocol() != header.UDPProtocolNumber {
+			return nil, false
+		}
+	case header.IPv6Version:
+		if len(packet) < header.IPv6MinimumSize {
+			return nil, false
+		}
+		v6 := header.IPv6(packet)
+		ipHeaderLen = header.IPv6MinimumSize
+		ipLen = header.IPv6MinimumSize + int(v6.PayloadLength())
+		if v6.TransportProtocol() != header.UDPProtocolNumber {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if ipHeaderLen < header.IPv4MinimumSize || ipLen > len(packet) || ipLen < ipHeaderLen+header.UDPMinimumSize {
+		return nil, false
+	}
+
+	udp := header.UDP(packet[ipHeaderLen:ipLen])
+	udpLen := int(udp.Length())
+	if udpLen < header.UDPMinimumSize || udpLen > len(udp) {
+		return nil, false
+	}
+	return udp[header.UDPMinimumSize:udpLen], true
+}
@@ -0,0 +1,43 @@
+package multihoptun
+
+import (
+	"errors"
+	"io"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// CloseAll shuts down a multihop setup, in which exit tunnels its traffic
+// through a Binder of st, and entry uses st as its TUN device. The exit
+// device is closed first, so that it stops sending into st while the entry
+// device still reads from it, then the entry device, st itself, and finally
+// closers, such as binds shared with other devices. Any argument may be nil.
+//
+// Closing the devices in another order can leave routines of one blocked on
+// st until the other is closed.
+//
+// Both devices publish a device.NotificationChainClosing before either is
+// closed.
+func CloseAll(entry, exit *device.Device, st *MultihopTun, closers ...io.Closer) error {
+	for _, dev := range []*device.Device{exit, entry} {
+		if dev != nil {
+			dev.Publish(device.NotificationChainClosing, nil, "multihop chain closing")
+		}
+	}
+	if exit != nil {
+		exit.Close()
+	}
+	if entry != nil {
+		entry.Close()
+	}
+	var errs []error
+	if st != nil {
+		errs = append(errs, st.Close())
+	}
+	for _, closer := range closers {
+		if closer != nil {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
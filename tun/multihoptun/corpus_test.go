@@ -0,0 +1,180 @@
+package multihoptun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// corpusHeaders are the IP and UDP headers MultihopTun synthesizes for each
+// message of testdata/corpus.txt, for a tunnel from :40000 to :51820 with IPv4
+// ID 0x1234 and, for IPv6, flow label 0xabcde. The UDP checksum is left zero.
+var corpusHeaders = map[string]map[string]string{
+	"ipv4": {
+		"initiation": "450000b012340000401153870a4000020a400001" + "9c40ca6c009c0000",
+		"response":   "4500007812340000401153bf0a4000020a400001" + "9c40ca6c00640000",
+		"transport":  "4500005c12340000401153db0a4000020a400001" + "9c40ca6c00480000",
+		"keepalive":  "4500003c12340000401153fb0a4000020a400001" + "9c40ca6c00280000",
+	},
+	"ipv6": {
+		"initiation": "600abcde009c1140fd000000000000000000000000000002fd000000000000000000000000000001" + "9c40ca6c009c0000",
+		"response":   "600abcde00641140fd000000000000000000000000000002fd000000000000000000000000000001" + "9c40ca6c00640000",
+		"transport":  "600abcde00481140fd000000000000000000000000000002fd000000000000000000000000000001" + "9c40ca6c00480000",
+		"keepalive":  "600abcde00281140fd000000000000000000000000000002fd000000000000000000000000000001" + "9c40ca6c00280000",
+	},
+}
+
+// readCorpus returns the messages of testdata/corpus.txt by name, in order.
+func readCorpus(t *testing.T) (names []string, messages map[string][]byte) {
+	f, err := os.Open("testdata/corpus.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	messages = make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<16)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, encoded, ok := strings.Cut(line, " ")
+		message, err := hex.DecodeString(encoded)
+		if !ok || err != nil {
+			t.Fatalf("malformed corpus line %q", line)
+		}
+		names = append(names, name)
+		messages[name] = message
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names, messages
+}
+
+func TestCorpus(t *testing.T) {
+	names, messages := readCorpus(t)
+	for _, family := range []struct {
+		name          string
+		local, remote netip.Addr
+	}{
+		{"ipv4", netip.MustParseAddr("10.64.0.2"), netip.MustParseAddr("10.64.0.1")},
+		{"ipv6", netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::1")},
+	} {
+		for _, name := range names {
+			message := messages[name]
+			t.Run(family.name+"/"+name, func(t *testing.T) {
+				st := NewMultihopTun(family.local, family.remote, 51820, 1280)
+				defer st.Close()
+				st.encapsulation.ipConnectionId = 0x1234
+				bind := st.Binder().(*multihopBind)
+				fns, _, err := bind.Open(40000)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer bind.Close()
+				headerSize := st.headerSize()
+
+				// Sending through the bind synthesizes the headers read from
+				// the TUN device.
+				sent := make(chan error, 1)
+				go func() {
+					sent <- bind.SendWithFlowLabel(message, nil, 0xabcde)
+				}()
+				const offset = 16
+				buf := make([]byte, 1600)
+				n, err := st.Read(buf, offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := <-sent; err != nil {
+					t.Fatal(err)
+				}
+				packet := buf[offset : offset+n]
+				if n != headerSize+len(message) || !bytes.Equal(packet[headerSize:], message) {
+					t.Fatalf("message not carried intact in %x", packet)
+				}
+				got := hex.EncodeToString(packet[:headerSize])
+				if want := corpusHeaders[family.name][name]; got != want {
+					t.Errorf("synthesized headers\n%s\nexpected\n%s", got, want)
+				}
+				if family.name == "ipv4" && !header.IPv4(packet).IsChecksumValid() {
+					t.Error("invalid IPv4 header checksum")
+				}
+
+				// Writing the packet back to the TUN device strips the
+				// headers before the bind receives it.
+				written := make(chan error, 1)
+				go func() {
+					_, err := st.Write(packet, 0)
+					written <- err
+				}()
+				n, ep, err := fns[0](buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := <-written; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], message) {
+					t.Errorf("received %x, expected %x", buf[:n], message)
+				}
+				if want := netip.AddrPortFrom(family.remote, 51820).String(); ep.DstToString() != want {
+					t.Errorf("received from %v, expected %v", ep.DstToString(), want)
+				}
+			})
+		}
+	}
+}
+
+// TestCorpusMalformed writes corrupted copies of a corpus packet to the TUN
+// device, which must be dropped before they reach the bind.
+func TestCorpusMalformed(t *testing.T) {
+	_, messages := readCorpus(t)
+	headers, _ := hex.DecodeString(corpusHeaders["ipv4"]["transport"])
+	valid := append(headers, messages["transport"]...)
+	for _, tc := range []struct {
+		name    string
+		corrupt func(packet []byte) []byte
+	}{
+		{"truncated", func(p []byte) []byte { return p[:len(p)-1] }},
+		{"not udp", func(p []byte) []byte { p[9] = byte(header.TCPProtocolNumber); return p }},
+		{"udp length past ip length", func(p []byte) []byte { p[25]++; return p }},
+		{"udp length below header", func(p []byte) []byte { p[24], p[25] = 0, 7; return p }},
+		{"ip version", func(p []byte) []byte { p[0] = 0x55; return p }},
+		{"empty", func(p []byte) []byte { return p[:0] }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := NewMultihopTun(netip.MustParseAddr("10.64.0.2"), netip.MustParseAddr("10.64.0.1"), 51820, 1280)
+			defer st.Close()
+			bind := st.Binder()
+			fns, _, err := bind.Open(40000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bind.Close()
+
+			packet := tc.corrupt(append([]byte(nil), valid...))
+			if n, err := st.Write(packet, 0); n != len(packet) || err != nil {
+				t.Errorf("wrote %d bytes, error %v, of a malformed packet", n, err)
+			}
+			if _, written := st.Dropped(); written != 1 {
+				t.Errorf("expected the malformed packet to be dropped, %d dropped", written)
+			}
+
+			// The next packet is the first the bind receives.
+			go st.Write(append([]byte(nil), valid...), 0)
+			buf := make([]byte, 1600)
+			if n, _, err := fns[0](buf); n != len(messages["transport"]) || err != nil {
+				t.Errorf("read %d bytes, error %v, after a malformed packet", n, err)
+			}
+		})
+	}
+}
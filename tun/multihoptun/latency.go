@@ -0,0 +1,133 @@
+package multihoptun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// latencyQueueSize is the number of packets that can be in flight in each
+// direction while latency is injected. Further packets are dropped, as by a
+// full socket buffer.
+const latencyQueueSize = 1024
+
+// latency delays the packets relayed through a MultihopTun, to reproduce the
+// behavior of the inner tunnel over a slow entry hop without netem.
+type latency struct {
+	sync.Mutex
+	delay, jitter time.Duration
+	relays        context.Context // of the routines relaying the delay lines, nil if none run
+	until         context.Context // given to SetLatencyContext, stopping relays once done
+	stopRelays    context.CancelFunc
+	toEntry       delayLine // from the exit device's bind to Read
+	toExit        delayLine // from Write to the exit device's bind
+}
+
+type delayLine struct {
+	queue chan delayedPacket
+	last  time.Time // due time of the last queued packet
+}
+
+type delayedPacket struct {
+	packet    []byte
+	flowLabel uint32
+	due       time.Time
+}
+
+// SetLatency delays every packet relayed through the MultihopTun, in both
+// directions, by delay plus a uniformly distributed jitter of up to ±jitter.
+// Packets keep their order, so jitter does not reorder them. A zero delay and
+// jitter turns the injection off. It is meant for diagnostics and testing.
+func (st *MultihopTun) SetLatency(delay, jitter time.Duration) error {
+	return st.SetLatencyContext(context.Background(), delay, jitter)
+}
+
+// SetLatencyContext is like SetLatency, but the injection also stops once ctx
+// is done. Packets still delayed when the injection stops, or when it is set
+// again, are dropped.
+func (st *MultihopTun) SetLatencyContext(ctx context.Context, delay, jitter time.Duration) error {
+	if delay < 0 || jitter < 0 {
+		return errors.New("negative latency")
+	}
+	l := st.pipe.latency
+	l.Lock()
+	defer l.Unlock()
+	if l.stopRelays != nil {
+		l.stopRelays()
+		l.relays, l.until, l.stopRelays = nil, nil, nil
+	}
+	l.delay, l.jitter = delay, jitter
+	if delay == 0 && jitter == 0 {
+		return nil
+	}
+	relays, cancel := context.WithCancel(st.ctx)
+	stopAfter := context.AfterFunc(ctx, cancel)
+	l.relays, l.until = relays, ctx
+	l.stopRelays = func() {
+		stopAfter()
+		cancel()
+	}
+	l.toEntry = delayLine{queue: make(chan delayedPacket, latencyQueueSize)}
+	l.toExit = delayLine{queue: make(chan delayedPacket, latencyQueueSize)}
+	go st.relayDelayed(relays, l.toEntry.queue, func(ctx context.Context, p delayedPacket) error {
+		return st.pipe.deliverToRead(ctx, p.packet, p.flowLabel)
+	})
+	go st.relayDelayed(relays, l.toExit.queue, func(ctx context.Context, p delayedPacket) error {
+		_, err := st.pipe.deliverToBind(ctx, p.packet, 0)
+		return err
+	})
+	return nil
+}
+
+// delayed queues a copy of packet on line if latency is injected, and reports
+// whether it did. A packet that does not fit in the queue is dropped.
+func (l *latency) delayed(line *delayLine, packet []byte, flowLabel uint32) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.relays == nil || l.relays.Err() != nil || l.until.Err() != nil {
+		return false
+	}
+	delay := l.delay
+	if l.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*l.jitter)+1)) - l.jitter
+	}
+	due := time.Now().Add(max(delay, 0))
+	if due.Before(line.last) {
+		due = line.last
+	}
+	select {
+	case line.queue <- delayedPacket{append([]byte(nil), packet...), flowLabel, due}:
+		line.last = due
+	default:
+	}
+	return true
+}
+
+// relayDelayed delivers the packets of a delay line once they are due, until
+// ctx is done.
+func (st *MultihopTun) relayDelayed(ctx context.Context, queue <-chan delayedPacket, deliver func(context.Context, delayedPacket) error) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for {
+		var p delayedPacket
+		select {
+		case <-ctx.Done():
+			return
+		case p = <-queue:
+		}
+		if wait := time.Until(p.due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+		}
+		if err := deliver(ctx, p); err != nil {
+			return
+		}
+	}
+}
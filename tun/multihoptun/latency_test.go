@@ -0,0 +1,122 @@
+package multihoptun
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMultihopTunLatency(t *testing.T) {
+	local := netip.AddrFrom4([4]byte{1, 2, 3, 5})
+	remote := netip.AddrFrom4([4]byte{1, 2, 3, 4})
+	st := NewMultihopTun(local, remote, 5005, 1280)
+	defer st.Close()
+	stBind := st.Binder()
+	recvFuncs, _, err := stBind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stBind.Close()
+
+	if err := st.SetLatency(-time.Millisecond, 0); err == nil {
+		t.Error("negative latency accepted")
+	}
+	const delay, jitter = 50 * time.Millisecond, 20 * time.Millisecond
+	if err := st.SetLatency(delay, jitter); err != nil {
+		t.Fatal(err)
+	}
+
+	// Towards the entry device, packets are delayed and keep their order.
+	const count = 20
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(i))
+		if err := stBind.Send(payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= delay-jitter {
+		t.Errorf("sending blocked for %v", elapsed)
+	}
+	packet := make([]byte, 1280)
+	for i := 0; i < count; i++ {
+		n, err := st.Read(packet, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if elapsed := time.Since(start); elapsed < delay-jitter {
+				t.Errorf("first packet arrived after %v", elapsed)
+			}
+		}
+		payload, ok := udpPayload(packet[:n])
+		if !ok || binary.BigEndian.Uint64(payload) != uint64(i) {
+			t.Fatalf("packet %d out of order", i)
+		}
+	}
+
+	// Towards the exit device too, here with the last packet read.
+	start = time.Now()
+	if _, err := st.Write(packet[:st.headerSize()+8], 0); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := recvFuncs[0](make([]byte, 1280))
+	if err != nil || n != 8 {
+		t.Fatalf("received %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < delay-jitter {
+		t.Errorf("packet towards the exit arrived after %v", elapsed)
+	}
+
+	// Turning the injection off relays packets synchronously again.
+	if err := st.SetLatency(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		stBind.Send(make([]byte, 8), nil)
+		close(done)
+	}()
+	if _, err := st.Read(packet, 0); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestMultihopTunLatencyContext(t *testing.T) {
+	local := netip.AddrFrom4([4]byte{1, 2, 3, 5})
+	remote := netip.AddrFrom4([4]byte{1, 2, 3, 4})
+	st := NewMultihopTun(local, remote, 5005, 1280)
+	defer st.Close()
+	stBind := st.Binder()
+	if _, _, err := stBind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer stBind.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := st.SetLatencyContext(ctx, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := stBind.Send(make([]byte, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the context is done, packets are relayed without delay, and the
+	// delayed one is dropped.
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- stBind.Send(make([]byte, 8), nil)
+	}()
+	packet := make([]byte, 1280)
+	if _, err := st.Read(packet, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
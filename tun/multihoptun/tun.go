@@ -1,13 +1,13 @@
 package multihoptun
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"io"
 	"math"
 	"math/rand"
 	"net/netip"
 	"os"
+	"sync"
 	"sync/atomic"
 
 	"golang.zx2c4.com/wireguard/conn"
@@ -25,34 +25,38 @@ import (
 // ever a single read from the real tunnel device needed to send it to the
 // entry hop.
 //
-// tun.Device.Write will push a buffer via writeRecv to be read by the recvfunc
-// of conn.Bind, stripping IPv4/IPv6 + UDP headers in the process. When the
-// packets have been transferred to the UDP receiver, writeDone will be used to
-// return from tun.Device.Write. Conversely, conn.Bind.Send will push a buffer
-// via readRecv to be read by tun.Device.Read, adding valid IPv4/IPv6 + UDP
-// headers in the process.
+// It is a tun.Stack of two layers. At the bottom, a pipe device carries UDP
+// payloads: tun.Device.Write will push a buffer via writeRecv to be read by
+// the recvfunc of conn.Bind, and conversely, conn.Bind.Send will push a buffer
+// via readRecv to be read by tun.Device.Read. Over it, a udpEncapsulation
+// middleware strips the IPv4/IPv6 + UDP headers from the packets written, and
+// adds valid ones to the packets read.
 //
-// Implements tun.Device and can create instances of conn.Bind.
+// Implements tun.Device and can create instances of conn.Bind. Middlewares can
+// be stacked over it with tun.Stack, like over any other tun.Device, for
+// example to capture the packets of the exit hop.
 type MultihopTun struct {
-	readRecv       chan packetBatch
-	writeRecv      chan packetBatch
-	isIpv4         bool
-	localIp        []byte
-	localPort      uint16
-	remoteIp       []byte
-	remotePort     uint16
-	ipConnectionId uint16
-	tunEvent       chan tun.Event
-	mtu            int
-	endpoint       conn.Endpoint
-	closed         atomic.Bool
-	shutdownChan   chan struct{}
+	pipe          *pipe
+	encapsulation *udpEncapsulation
+	stack         stackDevice // encapsulation over pipe
+	tunEvent      chan tun.Event
+	mtu           int
+	endpoint      conn.Endpoint
+	ctx           context.Context // canceled by Close
+	cancel        context.CancelFunc
+}
+
+// stackDevice is the tun.Device returned by tun.Stack.
+type stackDevice interface {
+	tun.ContextDevice
+	Dropped() (read, written uint64)
 }
 
 type packetBatch struct {
-	packet []byte
-	size   int
-	offset int
+	packet    []byte
+	size      int
+	offset    int
+	flowLabel uint32
 	// to be used to return the packet batch back to tun.Read and tun.Write
 	completion chan packetBatch
 }
@@ -61,41 +65,57 @@ func (pb *packetBatch) Size() int {
 	return len(pb.packet)
 }
 
+// completionPool recycles the channels used to hand a packetBatch back to
+// Read and Write, which would otherwise be allocated for every packet.
+// A channel is only returned to the pool once its single value was received.
+var completionPool = sync.Pool{
+	New: func() any {
+		return make(chan packetBatch)
+	},
+}
+
 func NewMultihopTun(local, remote netip.Addr, remotePort uint16, mtu int) MultihopTun {
-	readRecv := make(chan packetBatch)
-	writeRecv := make(chan packetBatch)
 	endpoint, err := conn.NewStdNetBind().ParseEndpoint(netip.AddrPortFrom(remote, remotePort).String())
 	if err != nil {
 		panic("Failed to parse endpoint")
 	}
 
-	connectionId := uint16(rand.Uint32()>>16) | 1
-	shutdownChan := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	encapsulation := &udpEncapsulation{
+		isIpv4:         local.Is4(),
+		localIp:        local.AsSlice(),
+		remoteIp:       remote.AsSlice(),
+		remotePort:     remotePort,
+		ipConnectionId: uint16(rand.Uint32()>>16) | 1,
+	}
+	pipe := &pipe{
+		readRecv:  make(chan packetBatch),
+		writeRecv: make(chan packetBatch),
+		mtu:       mtu - encapsulation.headerSize(),
+		ctx:       ctx,
+		latency:   &latency{},
+	}
+	encapsulation.pipe = pipe
 
 	return MultihopTun{
-		readRecv,
-		writeRecv,
-		local.Is4(),
-		local.AsSlice(),
-		0,
-		remote.AsSlice(),
-		remotePort,
-		connectionId,
-		make(chan tun.Event),
-		mtu,
-		endpoint,
-		atomic.Bool{},
-		shutdownChan,
+		pipe:          pipe,
+		encapsulation: encapsulation,
+		stack:         tun.Stack(pipe, encapsulation).(stackDevice),
+		tunEvent:      make(chan tun.Event),
+		mtu:           mtu,
+		endpoint:      endpoint,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 }
 
 func (st *MultihopTun) Binder() conn.Bind {
-	socketShutdown := make(chan struct{})
+	ctx, cancel := context.WithCancel(st.ctx)
 	return &multihopBind{
-		st,
-		socketShutdown,
+		MultihopTun: st,
+		ctx:         ctx,
+		cancel:      cancel,
 	}
-
 }
 
 // Events implements tun.Device.
@@ -110,7 +130,41 @@ func (*MultihopTun) File() *os.File {
 
 // MTU implements tun.Device.
 func (st *MultihopTun) MTU() (int, error) {
-	return st.mtu, nil
+	return st.stack.MTU()
+}
+
+// Dropped returns the number of packets written to the MultihopTun that were
+// dropped because they are not well-formed UDP datagrams, and of packets the
+// bind sent that were dropped because they did not fit in the buffer read
+// into.
+func (st *MultihopTun) Dropped() (read, written uint64) {
+	return st.stack.Dropped()
+}
+
+const (
+	// wireguardOverhead is the size a transport message adds to its
+	// content, device.MessageTransportSize.
+	wireguardOverhead = 32
+	// daitaHeaderLen is the size of the header of a DAITA padding packet,
+	// device.DaitaHeaderLen.
+	daitaHeaderLen = 4
+)
+
+// MaxPayloadSize returns the size of the largest message the exit device can
+// send through the bind without exceeding the MTU of the entry device.
+func (st *MultihopTun) MaxPayloadSize() int {
+	return st.mtu - st.headerSize()
+}
+
+// InnerMTU returns the MTU to configure on the exit device's TUN device, so
+// that any packet it sends fits in the entry hop. With DAITA enabled on the
+// exit peer, room is left for the DAITA header of maximum-size padding packets.
+func (st *MultihopTun) InnerMTU(daita bool) int {
+	mtu := st.MaxPayloadSize() - wireguardOverhead
+	if daita {
+		mtu -= daitaHeaderLen
+	}
+	return mtu
 }
 
 // Name implements tun.Device.
@@ -120,19 +174,102 @@ func (*MultihopTun) Name() (string, error) {
 
 // Write implements tun.Device.
 func (st *MultihopTun) Write(packet []byte, offset int) (int, error) {
-	completion := make(chan packetBatch)
+	return st.WriteContext(context.Background(), packet, offset)
+}
+
+// WriteContext is like Write, but gives up with the error of ctx once it is
+// done before the bind is ready to receive the packet.
+func (st *MultihopTun) WriteContext(ctx context.Context, packet []byte, offset int) (int, error) {
+	return st.stack.WriteContext(ctx, packet, offset)
+}
+
+// Read implements tun.Device.
+func (st *MultihopTun) Read(packet []byte, offset int) (n int, err error) {
+	return st.ReadContext(context.Background(), packet, offset)
+}
+
+// ReadContext is like Read, but gives up with the error of ctx once it is
+// done before the bind has a packet to hand over.
+func (st *MultihopTun) ReadContext(ctx context.Context, packet []byte, offset int) (n int, err error) {
+	return st.stack.ReadContext(ctx, packet, offset)
+}
+
+// pipe is the tun.Device at the bottom of a MultihopTun. It carries the UDP
+// payloads written to it to the receive function of the bind, and those the
+// bind sends to its reader.
+type pipe struct {
+	readRecv  chan packetBatch
+	writeRecv chan packetBatch
+	flowLabel atomic.Uint32 // of the payload read last
+	mtu       int
+	ctx       context.Context // of the MultihopTun
+	latency   *latency
+}
+
+// File implements tun.Device.
+func (*pipe) File() *os.File {
+	return nil
+}
+
+// Flush implements tun.Device.
+func (*pipe) Flush() error {
+	return nil
+}
+
+// MTU implements tun.Device.
+func (p *pipe) MTU() (int, error) {
+	return p.mtu, nil
+}
+
+// Name implements tun.Device.
+func (*pipe) Name() (string, error) {
+	return "stun", nil
+}
+
+// Events implements tun.Device. The events of a MultihopTun are its own.
+func (*pipe) Events() <-chan tun.Event {
+	return nil
+}
+
+// Close implements tun.Device. The pipe is closed with its MultihopTun.
+func (*pipe) Close() error {
+	return nil
+}
+
+// Write implements tun.Device.
+func (p *pipe) Write(payload []byte, offset int) (int, error) {
+	return p.WriteContext(context.Background(), payload, offset)
+}
+
+// WriteContext implements tun.ContextDevice.
+func (p *pipe) WriteContext(ctx context.Context, payload []byte, offset int) (int, error) {
+	if p.latency.delayed(&p.latency.toExit, payload[offset:], 0) {
+		return len(payload) - offset, nil
+	}
+	return p.deliverToBind(ctx, payload, offset)
+}
+
+// deliverToBind hands payload to the receive function of the bind, and
+// returns once it has been received. Once the bind took the payload, it is
+// received without blocking, so ctx is only waited on before.
+func (p *pipe) deliverToBind(ctx context.Context, payload []byte, offset int) (int, error) {
+	completion := completionPool.Get().(chan packetBatch)
 	packetBatch := packetBatch{
-		packet:     packet,
+		packet:     payload,
 		offset:     offset,
-		size:       len(packet),
+		size:       len(payload),
 		completion: completion,
 	}
 
 	select {
-	case st.writeRecv <- packetBatch:
+	case p.writeRecv <- packetBatch:
 		break
-	case <-st.shutdownChan:
+	case <-p.ctx.Done():
+		completionPool.Put(completion)
 		return 0, io.EOF
+	case <-ctx.Done():
+		completionPool.Put(completion)
+		return 0, ctx.Err()
 	}
 
 	packetBatch, ok := <-completion
@@ -140,25 +277,35 @@ func (st *MultihopTun) Write(packet []byte, offset int) (int, error) {
 	if !ok {
 		return 0, io.EOF
 	}
+	completionPool.Put(completion)
 
 	return packetBatch.size, nil
 }
 
 // Read implements tun.Device.
-func (st *MultihopTun) Read(packet []byte, offset int) (n int, err error) {
-	completion := make(chan packetBatch)
+func (p *pipe) Read(payload []byte, offset int) (n int, err error) {
+	return p.ReadContext(context.Background(), payload, offset)
+}
+
+// ReadContext implements tun.ContextDevice.
+func (p *pipe) ReadContext(ctx context.Context, payload []byte, offset int) (n int, err error) {
+	completion := completionPool.Get().(chan packetBatch)
 	packetBatch := packetBatch{
-		packet:     packet,
+		packet:     payload,
 		size:       0,
 		offset:     offset,
 		completion: completion,
 	}
 
 	select {
-	case st.readRecv <- packetBatch:
+	case p.readRecv <- packetBatch:
 		break
-	case <-st.shutdownChan:
+	case <-p.ctx.Done():
+		completionPool.Put(completion)
 		return 0, io.EOF
+	case <-ctx.Done():
+		completionPool.Put(completion)
+		return 0, ctx.Err()
 	}
 
 	var ok bool
@@ -167,36 +314,74 @@ func (st *MultihopTun) Read(packet []byte, offset int) (n int, err error) {
 	if !ok {
 		return 0, io.EOF
 	}
+	completionPool.Put(completion)
+	p.flowLabel.Store(packetBatch.flowLabel)
 
 	return packetBatch.size, nil
 }
 
-func (st *MultihopTun) writePayload(target, payload []byte) (size int, err error) {
-	headerSize := st.headerSize()
-	if headerSize+len(payload) > len(target) {
-		err = errors.New(fmt.Sprintf("target buffer is too small, need %d, got %d", headerSize+len(payload), len(target)))
-		return
+// udpEncapsulation is the tun.Middleware of a MultihopTun that adds the IPv4
+// or IPv6 and UDP headers of the entry hop to the payloads read from its pipe,
+// and strips them from the packets written to it. Packets that are not
+// well-formed UDP datagrams are dropped.
+type udpEncapsulation struct {
+	isIpv4         bool
+	localIp        []byte
+	localPort      uint16
+	remoteIp       []byte
+	remotePort     uint16
+	ipConnectionId uint16
+	pipe           *pipe // the flow label of each payload is taken from
+}
+
+// ReadPacket implements tun.Middleware. Payloads that leave no room for the
+// headers in buf are dropped.
+func (e *udpEncapsulation) ReadPacket(buf []byte, offset, size int) (int, error) {
+	headerSize := e.headerSize()
+	if offset+headerSize+size > len(buf) {
+		return 0, nil
+	}
+	copy(buf[offset+headerSize:], buf[offset:offset+size])
+	return e.writeHeaders(buf[offset:offset+headerSize+size], e.pipe.flowLabel.Load()), nil
+}
+
+// WritePacket implements tun.Middleware.
+func (e *udpEncapsulation) WritePacket(buf []byte, offset int) (int, error) {
+	payload, ok := udpPayload(buf[offset:])
+	if !ok {
+		return 0, nil
 	}
+	return copy(buf[offset:], payload), nil
+}
+
+// MTU implements tun.MTUMiddleware.
+func (e *udpEncapsulation) MTU(mtu int) int {
+	return mtu + e.headerSize()
+}
 
-	if st.isIpv4 {
-		return st.writeV4Payload(target, payload)
+// writeHeaders writes the IPv4 or IPv6 and UDP headers into packet, in front
+// of the payload already at packet[e.headerSize():], and returns the size of
+// the packet.
+func (e *udpEncapsulation) writeHeaders(packet []byte, flowLabel uint32) int {
+	if e.isIpv4 {
+		e.writeV4Headers(packet)
 	} else {
-		return st.writeV6Payload(target, payload)
+		e.writeV6Headers(packet, flowLabel)
 	}
+	return len(packet)
 }
 
-func (st *MultihopTun) writeV4Payload(target, payload []byte) (size int, err error) {
+func (e *udpEncapsulation) writeV4Headers(target []byte) {
 	var ipv4 header.IPv4
 	ipv4 = target
 
-	size = st.headerSize() + len(payload)
-	src := tcpip.AddrFrom4Slice(st.localIp)
-	dst := tcpip.AddrFrom4Slice(st.remoteIp)
+	src := tcpip.AddrFrom4Slice(e.localIp)
+	dst := tcpip.AddrFrom4Slice(e.remoteIp)
 	fields := header.IPv4Fields{
 		// TODO: Figure out the best DSCP value, ideally would be 0x88 for handshakes and 0x00 for rest.
 		TOS:         0,
-		TotalLength: uint16(size),
-		ID:          st.ipConnectionId,
+		TotalLength: uint16(len(target)),
+		ID:          e.ipConnectionId,
 		TTL:         64,
 		Protocol:    uint8(header.UDPProtocolNumber),
 		SrcAddr:     src,
@@ -205,22 +390,20 @@ func (st *MultihopTun) writeV4Payload(target, payload []byte) (size int, err err
 	}
 	ipv4.Encode(&fields)
 	ipv4.SetChecksum(^ipv4.CalculateChecksum())
-	st.writeUdpPayload(ipv4.Payload(), payload, src, dst)
-	return
+	e.writeUdpHeader(ipv4.Payload(), src, dst)
 }
 
-func (st *MultihopTun) writeV6Payload(target, payload []byte) (size int, err error) {
+func (e *udpEncapsulation) writeV6Headers(target []byte, flowLabel uint32) {
 
 	var ipv6 header.IPv6
 	ipv6 = target
 
-	size = st.headerSize() + len(payload)
-	src := tcpip.AddrFrom4Slice(st.localIp)
-	dst := tcpip.AddrFrom4Slice(st.remoteIp)
+	src := tcpip.AddrFrom16Slice(e.localIp)
+	dst := tcpip.AddrFrom16Slice(e.remoteIp)
 	fields := header.IPv6Fields{
 		TrafficClass:      0,
-		PayloadLength:     uint16(len(payload)),
-		FlowLabel:         uint32(st.ipConnectionId),
+		PayloadLength:     uint16(len(target) - header.IPv6MinimumSize),
+		FlowLabel:         flowLabel & 0xfffff,
 		TransportProtocol: header.UDPProtocolNumber,
 		SrcAddr:           src,
 		DstAddr:           dst,
@@ -228,25 +411,22 @@ func (st *MultihopTun) writeV6Payload(target, payload []byte) (size int, err err
 	}
 	ipv6.Encode(&fields)
 
-	st.writeUdpPayload(ipv6.Payload(), payload, src, dst)
-	return
+	e.writeUdpHeader(ipv6.Payload(), src, dst)
 }
 
-func (st *MultihopTun) writeUdpPayload(target header.UDP, payload []byte, src, dst tcpip.Address) {
+func (e *udpEncapsulation) writeUdpHeader(target header.UDP, src, dst tcpip.Address) {
 	target.Encode(&header.UDPFields{
-		SrcPort:  st.localPort,
-		DstPort:  st.remotePort,
-		Length:   uint16(len(payload) + header.UDPMinimumSize),
+		SrcPort:  e.localPort,
+		DstPort:  e.remotePort,
+		Length:   uint16(len(target)),
 		Checksum: 0,
 	})
-	copy(target.Payload()[:], payload[:])
-
 	// Set the checksum field unless TX checksum offload is enabled.
 	// On IPv4, UDP checksum is optional, and a zero value indicates the
 	// transmitter skipped the checksum generation (RFC768).
 	// On IPv6, UDP checksum is not optional (RFC2460 Section 8.1).
 	xsum := target.CalculateChecksum(checksum.Combine(
-		header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(len(payload)+header.UDPMinimumSize)),
+		header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(len(target))),
 		checksum.Checksum(target, 0),
 	))
 	// As per RFC 768 page 2,
@@ -276,15 +456,19 @@ func (st *MultihopTun) writeUdpPayload(target header.UDP, payload []byte, src, d
 }
 
 func (st *MultihopTun) headerSize() int {
+	return st.encapsulation.headerSize()
+}
+
+func (e *udpEncapsulation) headerSize() int {
 	udpPacketSize := header.UDPMinimumSize
-	if st.isIpv4 {
+	if e.isIpv4 {
 		return header.IPv4MinimumSize + udpPacketSize
 	} else {
 		return header.IPv6MinimumSize + udpPacketSize
 	}
 }
 
-// BatchSize implements conn.Bind.
+// BatchSize implements conn.BatchReceiveBind for the binds of the MultihopTun.
 func (*MultihopTun) BatchSize() int {
 	return 128
 }
@@ -294,11 +478,8 @@ func (*MultihopTun) Flush() error {
 	return nil
 }
 
-// Close implements tun.Device
+// Close implements tun.Device. Closing it again has no effect.
 func (st *MultihopTun) Close() error {
-	if !st.closed.Load() {
-		st.closed.Store(true)
-	}
-	close(st.shutdownChan)
+	st.cancel()
 	return nil
 }
@@ -2,8 +2,10 @@ package multihoptun
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
@@ -192,6 +194,69 @@ func TestMultihopTunWrite(t *testing.T) {
 	}
 }
 
+func TestOpenBatch(t *testing.T) {
+	stIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
+	virtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
+	remotePort := uint16(5005)
+
+	st := NewMultihopTun(stIp, virtualIp, remotePort, 1280)
+	batchBind, ok := st.Binder().(conn.BatchReceiveBind)
+	if !ok {
+		t.Fatalf("Expected the bind to implement conn.BatchReceiveBind")
+	}
+
+	receivers, _, err := batchBind.OpenBatch(0)
+	if err != nil {
+		t.Fatalf("Failed to open bind: %s", err)
+	}
+	if len(receivers) != 1 {
+		t.Fatalf("Expected 1 receiver func, got %v", len(receivers))
+	}
+
+	const writes = 3
+	for i := 0; i < writes; i++ {
+		payload := []byte{byte(i), 2, 3, 4}
+		packet := make([]byte, st.headerSize()+len(payload))
+		copy(packet, payload)
+		size, err := st.encapsulation.ReadPacket(packet, 0, len(payload))
+		if err != nil || size == 0 {
+			t.Fatalf("Failed to encapsulate packet: %v", err)
+		}
+		go st.Write(packet[:size], 0)
+	}
+	// Give the writers time to block on the bind.
+	time.Sleep(50 * time.Millisecond)
+
+	bufs := make([][]byte, writes+1)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1600)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]conn.Endpoint, len(bufs))
+
+	seen := make(map[byte]bool)
+	calls := 0
+	for len(seen) < writes {
+		n, err := receivers[0](bufs, sizes, eps)
+		if err != nil {
+			t.Fatalf("Failed to receive packets: %s", err)
+		}
+		calls++
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(bufs[i][1:sizes[i]], []byte{2, 3, 4}) {
+				t.Fatalf("Unexpected payload %v", bufs[i][:sizes[i]])
+			}
+			if eps[i] == nil {
+				t.Fatalf("Expected an endpoint for packet %d", i)
+			}
+			seen[bufs[i][0]] = true
+		}
+	}
+	if calls == writes {
+		t.Fatalf("Expected pending writes to be received in fewer than %d calls", writes)
+	}
+}
+
 func TestMultihopTunRead(t *testing.T) {
 	stIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
 	virtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
@@ -337,18 +402,56 @@ func uapiCfg(cfg ...string) string {
 }
 
 func TestShutdown(t *testing.T) {
-	a, b := generateTestPair(t)
+	a, b, _ := generateTestPair(t)
 	b.Close()
 	a.Close()
 }
 
 func TestReversedShutdown(t *testing.T) {
-	a, b := generateTestPair(t)
+	a, b, _ := generateTestPair(t)
 	a.Close()
 	b.Close()
 }
 
-func generateTestPair(t *testing.T) (*device.Device, *device.Device) {
+func TestCloseAll(t *testing.T) {
+	exit, entry, st := generateTestPair(t)
+	bind := conn.NewStdNetBind()
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+
+	closing := make(chan *device.Device, 2)
+	for _, dev := range []*device.Device{entry, exit} {
+		dev := dev
+		dev.SubscribeFiltered(device.NotificationFilter{Topics: device.TopicChain}, func(n device.Notification) {
+			closing <- dev
+		})
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- CloseAll(entry, exit, st, bind)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloseAll did not return")
+	}
+	if len(closing) != 2 {
+		t.Errorf("%d devices published the chain closing, want 2", len(closing))
+	}
+	// Everything is closed already, so closing again has no effect.
+	if err := CloseAll(nil, nil, st); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// generateTestPair returns the exit and entry devices of a multihop setup,
+// and the MultihopTun connecting them.
+func generateTestPair(t *testing.T) (*device.Device, *device.Device, *MultihopTun) {
 	stIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
 	virtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
 	remotePort := uint16(5005)
@@ -378,7 +481,7 @@ func generateTestPair(t *testing.T) (*device.Device, *device.Device) {
 		t.Fatal(err)
 	}
 
-	return readerDev, otherDev
+	return readerDev, otherDev, &st
 }
 
 func TestShutdownBind(t *testing.T) {
@@ -406,6 +509,74 @@ func TestShutdownBind(t *testing.T) {
 	}
 }
 
+func TestContextCancel(t *testing.T) {
+	stIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
+	virtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
+	st := NewMultihopTun(stIp, virtualIp, 5005, 1280)
+	defer st.Close()
+	binder := st.Binder()
+	if _, _, err := binder.Open(0); err != nil {
+		t.Fatalf("Failed to open a UDP socket, %v", err)
+	}
+
+	// Nothing is sent or received through the bind, so both give up once
+	// their context is done.
+	buf := make([]byte, 1600)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := st.ReadContext(ctx, buf, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ReadContext to time out, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	n, err := st.encapsulation.ReadPacket(buf, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.WriteContext(ctx, buf[:n], 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected WriteContext to be canceled, got %v", err)
+	}
+
+	// A Send waiting for a Read gives up with net.ErrClosed once the bind is
+	// closed.
+	errs := make(chan error)
+	go func() {
+		errs <- binder.Send(buf[:10], nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	binder.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send did not return after closing the bind")
+	}
+}
+
+func TestReopenBind(t *testing.T) {
+	stIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
+	virtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
+	st := NewMultihopTun(stIp, virtualIp, 5005, 1280)
+	defer st.Close()
+	binder := st.Binder()
+	defer binder.Close()
+	old, _, err := binder.Open(0)
+	if err != nil {
+		t.Fatalf("Failed to open a UDP socket, %v", err)
+	}
+
+	// Opening the bind again cancels the receive functions of the previous
+	// opening, even though it was not closed.
+	if _, _, err := binder.Open(0); err != nil {
+		t.Fatalf("Failed to reopen the UDP socket, %v", err)
+	}
+	if _, _, err := old[0](make([]byte, 1600)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed from the previous receive function, got %v", err)
+	}
+}
+
 func TestMultihopLocally(t *testing.T) {
 	aVirtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 5})
 	bVirtualIp := netip.AddrFrom4([4]byte{1, 2, 3, 4})
@@ -495,3 +666,109 @@ func TestMultihopLocally(t *testing.T) {
 	bEntryDevice.Close()
 	bExitDevice.Close()
 }
+
+func TestUdpPayload(t *testing.T) {
+	payload := []byte("multihop payload")
+	for _, tc := range []struct {
+		local, remote netip.Addr
+	}{
+		{netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("192.168.1.11")},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::11")},
+	} {
+		st := NewMultihopTun(tc.local, tc.remote, 5005, 1280)
+		buf := make([]byte, 1500)
+		copy(buf, payload)
+		st.pipe.flowLabel.Store(0x12345)
+		size, err := st.encapsulation.ReadPacket(buf, 0, len(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := udpPayload(buf[:size])
+		if !ok || !bytes.Equal(got, payload) {
+			t.Fatalf("%v: expected payload %q, got %q (ok=%v)", tc.local, payload, got, ok)
+		}
+		if _, ok := udpPayload(buf[:size-len(payload)-1]); ok {
+			t.Fatalf("%v: truncated packet was accepted", tc.local)
+		}
+		if tc.local.Is6() {
+			if _, label := header.IPv6(buf).TOS(); label != 0x12345 {
+				t.Fatalf("expected flow label 0x12345, got %#x", label)
+			}
+		}
+	}
+	if _, ok := udpPayload([]byte{0x45}); ok {
+		t.Fatal("short packet was accepted")
+	}
+}
+
+func TestMultihopTunDaitaBoundary(t *testing.T) {
+	if wireguardOverhead != device.MessageTransportSize || daitaHeaderLen != device.DaitaHeaderLen {
+		t.Fatalf("overhead constants are out of sync with the device package")
+	}
+
+	for _, tc := range []struct {
+		local, remote netip.Addr
+	}{
+		{netip.MustParseAddr("1.2.3.5"), netip.MustParseAddr("1.2.3.4")},
+		{netip.MustParseAddr("fd00::5"), netip.MustParseAddr("fd00::4")},
+	} {
+		st := NewMultihopTun(tc.local, tc.remote, 5005, 1280)
+		stBind := st.Binder()
+		recvFunc, _, err := stBind.Open(0)
+		if err != nil {
+			t.Fatalf("Failed to open bind: %v", err)
+		}
+
+		// A maximum-size DAITA padding packet from the exit device, once
+		// encrypted, must fill the entry MTU exactly.
+		payload := make([]byte, st.InnerMTU(true)+daitaHeaderLen+wireguardOverhead)
+		if len(payload) != st.MaxPayloadSize() {
+			t.Fatalf("%v: expected a %d byte message, got %d", tc.local, st.MaxPayloadSize(), len(payload))
+		}
+		rand.Read(payload)
+
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- stBind.Send(payload, nil)
+		}()
+		packet := make([]byte, st.mtu)
+		n, err := st.Read(packet, 0)
+		if err != nil {
+			t.Fatalf("%v: failed to read from tunnel device: %v", tc.local, err)
+		}
+		if err := <-sendErr; err != nil {
+			t.Fatalf("%v: failed to send a boundary-sized message: %v", tc.local, err)
+		}
+		if n != st.mtu {
+			t.Fatalf("%v: expected a %d byte packet, got %d", tc.local, st.mtu, n)
+		}
+		packet = packet[:n]
+		got, ok := udpPayload(packet)
+		if !ok || !bytes.Equal(got, payload) {
+			t.Fatalf("%v: boundary-sized message did not survive the entry hop", tc.local)
+		}
+
+		// And the other way around, into a receive buffer of exactly the
+		// message size. Writing strips the headers in place, so copies of
+		// the packet are written.
+		go st.Write(append([]byte(nil), packet...), 0)
+		buf := make([]byte, len(payload))
+		n, _, err = recvFunc[0](buf)
+		if err != nil {
+			t.Fatalf("%v: failed to receive: %v", tc.local, err)
+		}
+		if n != len(payload) || !bytes.Equal(buf, payload) {
+			t.Fatalf("%v: boundary-sized message was truncated to %d bytes", tc.local, n)
+		}
+
+		// A message that does not fit is dropped rather than truncated.
+		go st.Write(append([]byte(nil), packet...), 0)
+		n, _, err = recvFunc[0](buf[:len(buf)-1])
+		if err != nil || n != 0 {
+			t.Fatalf("%v: expected an oversized message to be dropped, got %d bytes, %v", tc.local, n, err)
+		}
+
+		st.Close()
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/tun"
@@ -41,6 +42,8 @@ import (
 type netTun struct {
 	ep             *channel.Endpoint
 	stack          *stack.Stack
+	nic            tcpip.NICID
+	shared         *Stack // the stack shared with other devices, or nil if the device has its own
 	events         chan tun.Event
 	incomingPacket chan *buffer.View
 	mtu            int
@@ -50,24 +53,83 @@ type netTun struct {
 
 type Net netTun
 
-func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
-	opts := stack.Options{
+// A Stack is a gVisor network stack shared by several netstack TUN devices,
+// which saves the memory of a stack per device when an application needs
+// several virtual networks at once. Each device has a NIC of its own, and its
+// Net only uses that NIC, so the networks are kept apart even if their
+// addresses overlap.
+type Stack struct {
+	stack *stack.Stack
+
+	mu      sync.Mutex
+	lastNIC tcpip.NICID
+	closed  bool
+}
+
+func newStack() *stack.Stack {
+	return stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
 		HandleLocal:        true,
+	})
+}
+
+// NewStack creates a network stack to be shared by the TUN devices created
+// with its CreateNetTUN.
+func NewStack() *Stack {
+	return &Stack{stack: newStack()}
+}
+
+// CreateNetTUN creates a TUN device with a new NIC of the stack, like the
+// CreateNetTUN function does with a stack of its own. Closing the device
+// removes its NIC, leaving the stack to the other devices.
+func (s *Stack) CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, errors.New("stack closed")
+	}
+	s.lastNIC++
+	dev, err := createNetTUN(s.stack, s.lastNIC, localAddresses, dnsServers, mtu)
+	if err != nil {
+		return nil, nil, err
+	}
+	dev.shared = s
+	return dev, (*Net)(dev), nil
+}
+
+// Close closes the stack, which must not be used by its devices afterwards.
+func (s *Stack) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.stack.Close()
 	}
+}
+
+func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	dev, err := createNetTUN(newStack(), 1, localAddresses, dnsServers, mtu)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dev, (*Net)(dev), nil
+}
+
+func createNetTUN(s *stack.Stack, nic tcpip.NICID, localAddresses, dnsServers []netip.Addr, mtu int) (*netTun, error) {
 	dev := &netTun{
 		ep:             channel.New(1024, uint32(mtu), ""),
-		stack:          stack.New(opts),
+		stack:          s,
+		nic:            nic,
 		events:         make(chan tun.Event, 10),
 		incomingPacket: make(chan *buffer.View),
 		dnsServers:     dnsServers,
 		mtu:            mtu,
 	}
 	dev.ep.AddNotify(dev)
-	tcpipErr := dev.stack.CreateNIC(1, dev.ep)
+	tcpipErr := dev.stack.CreateNIC(nic, dev.ep)
 	if tcpipErr != nil {
-		return nil, nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
+		return nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
 	}
 	for _, ip := range localAddresses {
 		var protoNumber tcpip.NetworkProtocolNumber
@@ -80,9 +142,10 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 			Protocol:          protoNumber,
 			AddressWithPrefix: tcpip.AddrFromSlice(ip.AsSlice()).WithPrefix(),
 		}
-		tcpipErr := dev.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{})
+		tcpipErr := dev.stack.AddProtocolAddress(nic, protoAddr, stack.AddressProperties{})
 		if tcpipErr != nil {
-			return nil, nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
+			dev.stack.RemoveNIC(nic)
+			return nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
 		}
 		if ip.Is4() {
 			dev.hasV4 = true
@@ -91,14 +154,14 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 		}
 	}
 	if dev.hasV4 {
-		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nic})
 	}
 	if dev.hasV6 {
-		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nic})
 	}
 
 	dev.events <- tun.EventUp
-	return dev, (*Net)(dev), nil
+	return dev, nil
 }
 
 func (tun *netTun) Name() (string, error) {
@@ -156,8 +219,10 @@ func (tun *netTun) Flush() error {
 }
 
 func (tun *netTun) Close() error {
-	tun.stack.RemoveNIC(1)
-	tun.stack.Close()
+	tun.stack.RemoveNIC(tun.nic)
+	if tun.shared == nil {
+		tun.stack.Close()
+	}
 
 	if tun.events != nil {
 		close(tun.events)
@@ -176,7 +241,7 @@ func (tun *netTun) MTU() (int, error) {
 	return tun.mtu, nil
 }
 
-func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+func convertToFullAddr(nic tcpip.NICID, endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
 	var protoNumber tcpip.NetworkProtocolNumber
 	if endpoint.Addr().Is4() {
 		protoNumber = ipv4.ProtocolNumber
@@ -184,14 +249,14 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 		protoNumber = ipv6.ProtocolNumber
 	}
 	return tcpip.FullAddress{
-		NIC:  1,
+		NIC:  nic,
 		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
 		Port: endpoint.Port(),
 	}, protoNumber
 }
 
 func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
+	fa, pn := convertToFullAddr(net.nic, addr)
 	return gonet.DialContextTCP(ctx, net.stack, fa, pn)
 }
 
@@ -204,7 +269,7 @@ func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.T
 }
 
 func (net *Net) DialTCPAddrPort(addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
+	fa, pn := convertToFullAddr(net.nic, addr)
 	return gonet.DialTCP(net.stack, fa, pn)
 }
 
@@ -217,7 +282,7 @@ func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
 }
 
 func (net *Net) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
-	fa, pn := convertToFullAddr(addr)
+	fa, pn := convertToFullAddr(net.nic, addr)
 	return gonet.ListenTCP(net.stack, fa, pn)
 }
 
@@ -234,12 +299,12 @@ func (net *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, er
 	var pn tcpip.NetworkProtocolNumber
 	if laddr.IsValid() || laddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(laddr)
+		addr, pn = convertToFullAddr(net.nic, laddr)
 		lfa = &addr
 	}
 	if raddr.IsValid() || raddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(raddr)
+		addr, pn = convertToFullAddr(net.nic, raddr)
 		rfa = &addr
 	}
 	return gonet.DialUDP(net.stack, lfa, rfa, pn)
@@ -271,6 +336,7 @@ type PingConn struct {
 	raddr    PingAddr
 	wq       waiter.Queue
 	ep       tcpip.Endpoint
+	nic      tcpip.NICID
 	deadline *time.Timer
 }
 
@@ -320,6 +386,7 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 
 	pc := &PingConn{
 		laddr:    PingAddr{laddr},
+		nic:      net.nic,
 		deadline: time.NewTimer(time.Hour << 10),
 	}
 	pc.deadline.Stop()
@@ -331,7 +398,7 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 	pc.ep = ep
 
 	if bind {
-		fa, _ := convertToFullAddr(netip.AddrPortFrom(laddr, 0))
+		fa, _ := convertToFullAddr(net.nic, netip.AddrPortFrom(laddr, 0))
 		if tcpipErr = pc.ep.Bind(fa); tcpipErr != nil {
 			return nil, fmt.Errorf("ping bind: %s", tcpipErr)
 		}
@@ -339,7 +406,7 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 
 	if raddr.IsValid() {
 		pc.raddr = PingAddr{raddr}
-		fa, _ := convertToFullAddr(netip.AddrPortFrom(raddr, 0))
+		fa, _ := convertToFullAddr(net.nic, netip.AddrPortFrom(raddr, 0))
 		if tcpipErr = pc.ep.Connect(fa); tcpipErr != nil {
 			return nil, fmt.Errorf("ping connect: %s", tcpipErr)
 		}
@@ -371,6 +438,60 @@ func (net *Net) ListenPing(laddr *PingAddr) (*PingConn, error) {
 	return net.ListenPingAddr(la)
 }
 
+// Ping sends an ICMP echo request from source to target through the network
+// stack and waits for its reply, or until ctx is done. It allows
+// device.VerifyConnectivity to check the tunnel through the stack.
+func (tun *netTun) Ping(ctx context.Context, source, target netip.Addr) error {
+	pc, err := (*Net)(tun).DialPingAddr(source, target)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() {
+		pc.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	seq := randU16()
+	var request []byte
+	if target.Is4() {
+		icmpHeader := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize))
+		icmpHeader.SetType(header.ICMPv4Echo)
+		icmpHeader.SetSequence(seq)
+		request = icmpHeader
+	} else {
+		icmpHeader := header.ICMPv6(make([]byte, header.ICMPv6EchoMinimumSize))
+		icmpHeader.SetType(header.ICMPv6EchoRequest)
+		icmpHeader.SetSequence(seq)
+		request = icmpHeader
+	}
+	if _, err := pc.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, tun.mtu)
+	for {
+		n, err := pc.Read(reply)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if target.Is4() {
+			icmpHeader := header.ICMPv4(reply[:n])
+			if n >= header.ICMPv4MinimumSize && icmpHeader.Type() == header.ICMPv4EchoReply && icmpHeader.Sequence() == seq {
+				return nil
+			}
+		} else {
+			icmpHeader := header.ICMPv6(reply[:n])
+			if n >= header.ICMPv6EchoMinimumSize && icmpHeader.Type() == header.ICMPv6EchoReply && icmpHeader.Sequence() == seq {
+				return nil
+			}
+		}
+	}
+}
+
 func (pc *PingConn) LocalAddr() net.Addr {
 	return pc.laddr
 }
@@ -404,7 +525,7 @@ func (pc *PingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 
 	buf := bytes.NewReader(p)
-	rfa, _ := convertToFullAddr(netip.AddrPortFrom(na, 0))
+	rfa, _ := convertToFullAddr(pc.nic, netip.AddrPortFrom(na, 0))
 	// won't block, no deadlines
 	n64, tcpipErr := pc.ep.Write(buf, tcpip.WriteOptions{
 		To: &rfa,
@@ -425,23 +546,28 @@ func (pc *PingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	pc.wq.EventRegister(&e)
 	defer pc.wq.EventUnregister(&e)
 
-	select {
-	case <-pc.deadline.C:
-		return 0, nil, os.ErrDeadlineExceeded
-	case <-notifyCh:
-	}
-
+	// A reply may already be queued, so read before waiting for one to
+	// arrive. The waiter is registered first so that no arrival is missed.
 	w := tcpip.SliceWriter(p)
+	for {
+		res, tcpipErr := pc.ep.Read(&w, tcpip.ReadOptions{
+			NeedRemoteAddr: true,
+		})
+		if _, ok := tcpipErr.(*tcpip.ErrWouldBlock); ok {
+			select {
+			case <-pc.deadline.C:
+				return 0, nil, os.ErrDeadlineExceeded
+			case <-notifyCh:
+			}
+			continue
+		}
+		if tcpipErr != nil {
+			return 0, nil, fmt.Errorf("ping read: %s", tcpipErr)
+		}
 
-	res, tcpipErr := pc.ep.Read(&w, tcpip.ReadOptions{
-		NeedRemoteAddr: true,
-	})
-	if tcpipErr != nil {
-		return 0, nil, fmt.Errorf("ping read: %s", tcpipErr)
+		remoteAddr, _ := netip.AddrFromSlice([]byte(res.RemoteAddr.Addr.AsSlice()))
+		return res.Count, &PingAddr{remoteAddr}, nil
 	}
-
-	remoteAddr, _ := netip.AddrFromSlice([]byte(res.RemoteAddr.Addr.AsSlice()))
-	return res.Count, &PingAddr{remoteAddr}, nil
 }
 
 func (pc *PingConn) Read(p []byte) (n int, err error) {
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// readPackets reads the packets sent through dev until it is closed.
+func readPackets(dev tun.Device) <-chan []byte {
+	packets := make(chan []byte, 16)
+	go func() {
+		defer close(packets)
+		for {
+			buf := make([]byte, 2048)
+			n, err := dev.Read(buf, 0)
+			if err != nil {
+				return
+			}
+			packets <- buf[:n]
+		}
+	}()
+	return packets
+}
+
+func TestStackSeparateNICs(t *testing.T) {
+	s := NewStack()
+	defer s.Close()
+
+	// Both devices have the same address, as separate virtual networks may.
+	local := netip.MustParseAddr("10.0.0.1")
+	var devs [2]tun.Device
+	var nets [2]*Net
+	var packets [2]<-chan []byte
+	for i := range devs {
+		var err error
+		devs[i], nets[i], err = s.CreateNetTUN([]netip.Addr{local}, nil, 1420)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets[i] = readPackets(devs[i])
+	}
+	defer devs[1].Close()
+
+	for i, net := range nets {
+		remote := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), uint16(1000+i))
+		conn, err := net.DialUDPAddrPort(netip.AddrPort{}, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		select {
+		case packet := <-packets[i]:
+			udp := header.UDP(header.IPv4(packet).Payload())
+			if udp.DestinationPort() != remote.Port() {
+				t.Errorf("device %d sent a packet to port %d, want %d", i, udp.DestinationPort(), remote.Port())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("device %d sent nothing", i)
+		}
+		select {
+		case <-packets[1-i]:
+			t.Errorf("packet of device %d sent through device %d", i, 1-i)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Closing a device leaves the stack to the other.
+	devs[0].Close()
+	if _, err := nets[1].DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.2:53")); err != nil {
+		t.Errorf("dialing after closing the other device: %v", err)
+	}
+}
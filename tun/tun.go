@@ -27,3 +27,9 @@ type Device interface {
 	Events() <-chan Event           // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// An MTUSetter is a Device whose MTU can be changed, such as the native TUN
+// devices of Linux, macOS, FreeBSD and OpenBSD.
+type MTUSetter interface {
+	SetMTU(mtu int) error
+}
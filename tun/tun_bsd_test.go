@@ -0,0 +1,36 @@
+//go:build freebsd || openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// The address family header is written before offset, so packets must leave
+// room for it, as the device and MultihopTun do.
+func TestNativeTunOffset(t *testing.T) {
+	tun := &NativeTun{}
+	buf := make([]byte, 64)
+	if _, err := tun.Read(buf, 3); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Read with offset 3: expected io.ErrShortBuffer, got %v", err)
+	}
+	if _, err := tun.Write(buf, 3); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Write with offset 3: expected io.ErrShortBuffer, got %v", err)
+	}
+	if _, err := tun.Write(buf[:4], 4); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Write of an empty packet: expected io.ErrShortBuffer, got %v", err)
+	}
+	buf[16] = 0x50
+	if _, err := tun.Write(buf, 16); !errors.Is(err, unix.EAFNOSUPPORT) {
+		t.Errorf("Write of a non-IP packet: expected EAFNOSUPPORT, got %v", err)
+	}
+}
@@ -275,6 +275,11 @@ func (tun *NativeTun) Close() error {
 	return err2
 }
 
+// SetMTU sets the MTU of the device.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) setMTU(n int) error {
 	fd, err := socketCloexec(
 		unix.AF_INET,
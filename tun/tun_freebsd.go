@@ -334,6 +334,11 @@ func (tun *NativeTun) Events() <-chan Event {
 }
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
+	// The packet is preceded by a 4 byte address family header, read into
+	// the space before offset.
+	if offset < 4 {
+		return 0, io.ErrShortBuffer
+	}
 	select {
 	case err := <-tun.errors:
 		return 0, err
@@ -396,6 +401,11 @@ func (tun *NativeTun) Close() error {
 	return err3
 }
 
+// SetMTU sets the MTU of the device.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) setMTU(n int) error {
 	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
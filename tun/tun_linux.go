@@ -219,6 +219,11 @@ func getIFIndex(name string) (int32, error) {
 	return *(*int32)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])), nil
 }
 
+// SetMTU sets the MTU of the device.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) setMTU(n int) error {
 	name, err := tun.Name()
 	if err != nil {
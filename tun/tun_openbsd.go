@@ -8,13 +8,13 @@ package tun
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sync"
 	"syscall"
 	"unsafe"
 
-	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 )
 
@@ -205,6 +205,11 @@ func (tun *NativeTun) Events() <-chan Event {
 }
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
+	// The packet is preceded by a 4 byte address family header, read into
+	// the space before offset.
+	if offset < 4 {
+		return 0, io.ErrShortBuffer
+	}
 	select {
 	case err := <-tun.errors:
 		return 0, err
@@ -218,26 +223,26 @@ func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
 	}
 }
 
-func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
-	// reserve space for header
-
-	buff = buff[offset-4:]
-
-	// add packet information header
-
-	buff[0] = 0x00
-	buff[1] = 0x00
-	buff[2] = 0x00
-
-	if buff[4]>>4 == ipv6.Version {
-		buff[3] = unix.AF_INET6
-	} else {
-		buff[3] = unix.AF_INET
+func (tun *NativeTun) Write(buf []byte, offset int) (int, error) {
+	if offset < 4 {
+		return 0, io.ErrShortBuffer
 	}
-
-	// write
-
-	return tun.tunFile.Write(buff)
+	buf = buf[offset-4:]
+	if len(buf) < 5 {
+		return 0, io.ErrShortBuffer
+	}
+	buf[0] = 0x00
+	buf[1] = 0x00
+	buf[2] = 0x00
+	switch buf[4] >> 4 {
+	case 4:
+		buf[3] = unix.AF_INET
+	case 6:
+		buf[3] = unix.AF_INET6
+	default:
+		return 0, unix.EAFNOSUPPORT
+	}
+	return tun.tunFile.Write(buf)
 }
 
 func (tun *NativeTun) Flush() error {
@@ -263,6 +268,11 @@ func (tun *NativeTun) Close() error {
 	return err2
 }
 
+// SetMTU sets the MTU of the device.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) setMTU(n int) error {
 	// open datagram socket
 